@@ -1,12 +1,40 @@
 // The spillbox command is a command-line tool for managing a spilldb database.
 //
+// Commands:
+//	spillbox user [username] [-json]
+//	spillbox user [username] printmsg [-headers-only] [-part=N] [msgid]
+//	spillbox user [username] gc [-retention=duration]
+//	spillbox user [username] mailboxes [-deleted]
+//	spillbox user [username] devices
+//	spillbox user [username] audit [-event=name] [-since=duration] [-limit=n]
+//	spillbox user [username] apppass [add name | revoke deviceid]
+//	spillbox user [username] totp setup|enable [code]|disable
+//	spillbox user [username] sendas [add addr | rm addr]
+//	spillbox user [username] reparse
+//	spillbox user [username] repair
+//	spillbox unparsable
+//	spillbox user [username] webhooks [add [-events=list] url | rm id]
+//	spillbox webhooks [add [-events=list] url | rm id | dead]
+//	spillbox bimi set [-selector=s] [-authority=url] domain logo.svg logo-url
+//	spillbox bimi rm domain
+//	spillbox dkim ls [domain]
+//	spillbox [-blobkey file] dkim new [-selector=s] [-active=duration] domain
+//	spillbox [-blobkey file] dkim rotate [-overlap=duration] domain
+//	spillbox dkim rm domain selector
+//	spillbox -blobkey file user [username] sealblobs
+//	spillbox user [username] contacts export [file.vcf]
+//	spillbox user [username] contacts import [file.vcf]
+//	spillbox user [username] contacts import-part msgid partnum
+//	spillbox user [username] backup [-s3-bucket=b ...] -to dir
+//	spillbox user [username] restore -from dir
+//	spillbox user [username] promote
+//	spillbox migrate [-dry-run] [-backup dir]
+//	spillbox msg [-dump-parts | -part=N] [-check-dkim] < msg.eml
+//
 // TODO:
 //	spillbox users 			- list users
 //	spillbox users add 		- add a new user
-//	spillbox user [username] 	- print user summary
-//	spillbox user [username] gc	- garbage collect and vacuum
 //	spillbox user [username] import [path to mbox, maildir, or spillbox]
-//	spillbox user [username] printmsg [msgid]
 package main
 
 import (
@@ -15,21 +43,36 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"spilled.ink/spilldb/db"
 
 	"crawshaw.io/iox"
 	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/email/bimi"
+	"spilled.ink/email/dkim"
 	"spilled.ink/email/msgbuilder"
 	"spilled.ink/email/msgcleaver"
+	"spilled.ink/email/vcard"
 	"spilled.ink/spilldb"
 	"spilled.ink/spilldb/boxmgmt"
+	"spilled.ink/spilldb/dkimkeys"
+	"spilled.ink/spilldb/migrate"
+	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/spilldb/webhook"
+	"spilled.ink/util/s3store"
+	"spilled.ink/util/totp"
 )
 
 var filer *iox.Filer
@@ -43,6 +86,7 @@ func main() {
 	// TODO: default location in data storage directory for a user.
 	flagDBDir := flag.String("dbdir", "", "spilldb database directory")
 	flagVerbose := flag.Bool("verbose", false, "verbose logging")
+	flagBlobKey := flag.String("blobkey", "", "file holding the master key that seals stored mail")
 	flag.Parse()
 
 	if len(flag.Args()) == 0 {
@@ -61,6 +105,13 @@ func main() {
 			exit(1)
 		}
 		return
+	case "migrate":
+		// Run before spilldb.New, which migrates the databases it opens.
+		if err := migrateDBs(*flagDBDir, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s migrate: %v\n", os.Args[0], err)
+			exit(1)
+		}
+		return
 	case "help":
 		fmt.Fprintf(os.Stderr, "TODO provide help. Sorry.\n") // TODO
 		exit(2)
@@ -77,6 +128,12 @@ func main() {
 	if !*flagVerbose {
 		sdb.Logf = func(format string, v ...interface{}) {} // drop
 	}
+	if *flagBlobKey != "" {
+		if sdb.BoxMgmt.BlobKey, err = boxmgmt.ReadKeyFile(*flagBlobKey); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			exit(2)
+		}
+	}
 
 	switch flag.Arg(0) {
 	default:
@@ -108,6 +165,26 @@ func main() {
 			exit(1)
 		}
 
+	case "webhooks":
+		if err := webhooks(0, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s webhooks: %v\n", os.Args[0], err)
+			exit(1)
+		}
+	case "bimi":
+		if err := setBIMI(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s bimi: %v\n", os.Args[0], err)
+			exit(1)
+		}
+	case "dkim":
+		if err := dkimKeys(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s dkim: %v\n", os.Args[0], err)
+			exit(1)
+		}
+	case "unparsable":
+		if err := unparsable(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s unparsable: %v\n", os.Args[0], err)
+			exit(1)
+		}
 	case "user":
 		if len(flag.Args()) < 2 {
 			fmt.Fprintf(os.Stderr, "usage: %s [-dbdir path] user [userid or username] [user-command]\nRun '%s help user' for details.\n", os.Args[0], os.Args[0])
@@ -127,10 +204,12 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%s user: cannot find user ID %d: %v\n", os.Args[0], userID, err)
 			exit(1)
 		}
-		_ = u
 
-		if len(flag.Args()) == 2 {
-			fmt.Printf("TODO print summary of user %d\n", userID)
+		if len(flag.Args()) == 2 || strings.HasPrefix(flag.Arg(2), "-") {
+			if err := summary(u, userID, flag.Args()[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user: %v\n", os.Args[0], err)
+				exit(1)
+			}
 			exit(0)
 		}
 
@@ -148,6 +227,118 @@ func main() {
 				exit(1)
 			}
 			exit(0)
+		case "gc":
+			if err := gc(u, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user gc: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "contacts":
+			if err := contacts(u, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user contacts: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "printmsg":
+			if err := printMsg(u, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user printmsg: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "mailboxes":
+			if err := mailboxes(u, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user mailboxes: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "attachments":
+			if err := attachments(u, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user attachments: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "verify-sizes":
+			if err := verifySizes(u, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user verify-sizes: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "devices":
+			if err := devices(u, userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user devices: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "audit":
+			if err := audit(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user audit: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "sealblobs":
+			n, err := u.Box.SealBlobs(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s user sealblobs: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			fmt.Printf("sealed %d blobs\n", n)
+			exit(0)
+		case "backup":
+			if err := backup(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user backup: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "restore":
+			if err := restore(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user restore: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "promote":
+			if err := u.Box.Promote(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user promote: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "apppass":
+			if err := appPass(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user apppass: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "totp":
+			if err := totpCmd(userID, flag.Arg(1), flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user totp: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "reparse":
+			released, failed, err := sdb.Reparse(ctx, userID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s user reparse: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			fmt.Printf("%d released, %d unparsable\n", released, failed)
+			exit(0)
+		case "repair":
+			if err := repair(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user repair: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "sendas":
+			if err := sendAs(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user sendas: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
+		case "webhooks":
+			if err := webhooks(userID, flag.Args()[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s user webhooks: %v\n", os.Args[0], err)
+				exit(1)
+			}
+			exit(0)
 		}
 	}
 
@@ -244,15 +435,16 @@ func importData(u *boxmgmt.User, sourcePath string) (err error) {
 	INSERT INTO Contacts SELECT * FROM old.Contacts;
 	INSERT INTO Addresses SELECT * FROM old.Addresses;
 	DELETE FROM MailboxSequencing;
-	INSERT INTO MailboxSequencing SELECT * FROM old.MailboxSequencing;
+	INSERT INTO MailboxSequencing (Name, NextModSequence) SELECT Name, NextModSequence FROM old.MailboxSequencing;
 	DELETE FROM Mailboxes;
-	INSERT INTO Mailboxes SELECT MailboxID, NextUID, UIDValidity, Attrs, Name, DeletedName, Subscribed FROM old.Mailboxes;
+	INSERT INTO Mailboxes (MailboxID, NextUID, UIDValidity, Attrs, Name, DeletedName, Subscribed) SELECT MailboxID, NextUID, UIDValidity, Attrs, Name, DeletedName, Subscribed FROM old.Mailboxes;
 	INSERT INTO Convos SELECT * FROM old.Convos;
 	INSERT INTO ConvoContacts SELECT * FROM old.ConvoContacts;
 	INSERT INTO ConvoLabels SELECT * FROM old.ConvoLabels;
-	INSERT INTO Msgs SELECT MsgID, StagingID, ModSequence, Seed, RawHash, ConvoID, State, ParseError, MailboxID, UID, Flags, EncodedSize, Date, Expunged, NULL AS HdrsBlobID, HasUnsubscribe FROM old.Msgs;
+	INSERT INTO Msgs (MsgID, StagingID, ModSequence, Seed, RawHash, ConvoID, State, ParseError, MailboxID, UID, SysFlags, EncodedSize, Date, Expunged, HdrsBlobID, HasUnsubscribe) SELECT MsgID, StagingID, ModSequence, Seed, RawHash, ConvoID, State, ParseError, MailboxID, UID, (SELECT coalesce(sum(CASE key WHEN '\Seen' THEN 1 WHEN '\Answered' THEN 2 WHEN '\Flagged' THEN 4 WHEN '\Deleted' THEN 8 WHEN '\Draft' THEN 16 WHEN '\Recent' THEN 32 ELSE 0 END), 0) FROM json_each(old.Msgs.Flags)) AS SysFlags, EncodedSize, Date, Expunged, NULL AS HdrsBlobID, HasUnsubscribe FROM old.Msgs;
+	INSERT OR IGNORE INTO MsgKeywords (MsgID, Keyword) SELECT MsgID, key FROM old.Msgs, json_each(old.Msgs.Flags) WHERE key NOT IN ('\Seen', '\Answered', '\Flagged', '\Deleted', '\Draft', '\Recent');
 	INSERT INTO MsgAddresses SELECT * FROM old.MsgAddresses;
-	INSERT INTO MsgParts SELECT MsgID, PartNum, Name, IsBody, IsAttachment, IsCompressed, CompressedSize, ContentType, ContentID, BlobID, ContentTransferEncoding, ContentTransferSize, ContentTransferLines FROM old.MsgParts;
+	INSERT INTO MsgParts (MsgID, PartNum, Name, IsBody, IsAttachment, IsCompressed, CompressedSize, ContentType, ContentID, BlobID, ContentTransferEncoding, ContentTransferSize, ContentTransferLines) SELECT MsgID, PartNum, Name, IsBody, IsAttachment, IsCompressed, CompressedSize, ContentType, ContentID, BlobID, ContentTransferEncoding, ContentTransferSize, ContentTransferLines FROM old.MsgParts;
 	INSERT INTO blobs.Blobs SELECT BlobID, NULL AS SHA256, NULL AS Deleted, Content FROM old.MsgPartContents;
 	`
 	if err := sqlitex.ExecScript(conn, coreCopy); err != nil {
@@ -310,38 +502,1195 @@ func importData(u *boxmgmt.User, sourcePath string) (err error) {
 	return nil
 }
 
-func findUserID(username string) (int64, error) {
+// gc garbage collects and vacuums a user's spillbox.
+func gc(u *boxmgmt.User, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	retention := fs.Duration("retention", 30*24*time.Hour, "keep expunged messages and deleted mailboxes for this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	stats, err := u.Box.GC(context.Background(), *retention)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Mailboxes removed: %d\n", stats.MailboxesRemoved)
+	fmt.Printf("Messages removed:  %d\n", stats.MsgsRemoved)
+	fmt.Printf("Blobs removed:     %d (%d bytes)\n", stats.BlobsRemoved, stats.BlobBytes)
+	fmt.Printf("Bytes reclaimed:   %d\n", stats.Reclaimed)
+	return nil
+}
+
+// backup writes a snapshot of a user's mailbox to a new directory.
+// It can be run while spilld is serving the user.
+//
+// The backup holds the blobs spilld has moved to S3, so backing up
+// a mailbox with offloaded blobs needs the -s3 flags of spilld's
+// [s3] configuration.
+func backup(userID int64, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	to := fs.String("to", "", "directory to create for the backup")
+	s3Endpoint := fs.String("s3-endpoint", "", "S3 endpoint of offloaded blobs")
+	s3Bucket := fs.String("s3-bucket", "", "S3 bucket of offloaded blobs")
+	s3Region := fs.String("s3-region", "", "S3 region")
+	s3AccessKeyID := fs.String("s3-access-key-id", "", "S3 access key ID")
+	s3SecretKeyFile := fs.String("s3-secret-key-file", "", "file holding the S3 secret access key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *to == "" {
+		return fmt.Errorf("missing -to directory")
+	}
+	if *s3Bucket != "" {
+		secretKey, err := ioutil.ReadFile(*s3SecretKeyFile)
+		if err != nil {
+			return err
+		}
+		sdb.BoxMgmt.ObjectStore = &s3store.Store{
+			Endpoint:    *s3Endpoint,
+			Bucket:      *s3Bucket,
+			Region:      *s3Region,
+			AccessKeyID: *s3AccessKeyID,
+			SecretKey:   strings.TrimSpace(string(secretKey)),
+		}
+	}
+	return sdb.BoxMgmt.Backup(context.Background(), userID, *to)
+}
+
+// migrateDBs brings the schema of the spilld database and every
+// user mailbox up to date. Opening them does the same, so this is
+// for seeing what will change, with -dry-run, or for keeping a copy
+// of each database from before it changes, with -backup.
+// spilld must not be running.
+func migrateDBs(dbdir string, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the steps without applying them")
+	backupDir := fs.String("backup", "", "directory to create for copies of the databases before they are migrated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if dbdir == "" {
+		return fmt.Errorf("missing -dbdir")
+	}
+	if *backupDir != "" && !*dryRun {
+		if err := os.Mkdir(*backupDir, 0770); err != nil {
+			return err
+		}
+	}
+	backupfile := func(dbfile string) string {
+		if *backupDir == "" {
+			return ""
+		}
+		return filepath.Join(*backupDir, filepath.Base(dbfile))
+	}
+	report := func(dbfile string, steps []migrate.Step) {
+		for _, step := range steps {
+			fmt.Printf("%s: %d %s\n", dbfile, step.Version, step.Name)
+		}
+	}
+
+	dbfile := filepath.Join(dbdir, "spilld.db")
+	steps, err := db.Migrate(dbfile, backupfile(dbfile), *dryRun)
+	if err != nil {
+		return err
+	}
+	report(dbfile, steps)
+
+	userFiles, err := filepath.Glob(filepath.Join(dbdir, "users", "spilld_user*.db"))
+	if err != nil {
+		return err
+	}
+	for _, dbfile := range userFiles {
+		if strings.HasSuffix(dbfile, "_blobs.db") {
+			continue
+		}
+		steps, err := spillbox.Migrate(dbfile, backupfile(dbfile), *dryRun)
+		if err != nil {
+			return err
+		}
+		report(dbfile, steps)
+	}
+	return nil
+}
+
+// restore replaces a user's mailbox with a backup.
+// Every mailbox gets a new UIDVALIDITY, so clients resynchronize.
+// spilld must not be running.
+func restore(userID int64, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := fs.String("from", "", "backup directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *from == "" {
+		return fmt.Errorf("missing -from directory")
+	}
+	return sdb.BoxMgmt.Restore(context.Background(), userID, *from)
+}
+
+// userSummary is what "spillbox user [username]" reports.
+type userSummary struct {
+	UserID    int64
+	Address   string
+	LastLogin *userLogin // nil if the user has never logged in
+	Mailboxes []mailboxSummary
+	Devices   []spillbox.PushDevice
+	Queue     []queueCount // outgoing and incoming messages not yet done
+}
+
+type userLogin struct {
+	Time   time.Time
+	Addr   string
+	Device string
+}
+
+type mailboxSummary struct {
+	MailboxID int64
+	Name      string
+	Messages  int
+	Unseen    int
+	BlobBytes int64 // stored size of the headers and parts of its messages
+}
+
+type queueCount struct {
+	State string // db.DeliveryState
+	Count int
+}
+
+// summary prints a user's mailboxes, storage, last login,
+// push devices, and the messages queued for or from them.
+func summary(u *boxmgmt.User, userID int64, args []string) error {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the summary as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	sum := userSummary{UserID: userID}
+	if err := spilldSummary(&sum); err != nil {
+		return err
+	}
+	if err := spillboxSummary(u, &sum); err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(sum)
+	}
+
+	fmt.Printf("User:       %d %s\n", sum.UserID, sum.Address)
+	if l := sum.LastLogin; l != nil {
+		fmt.Printf("Last login: %s from %s (%s)\n", l.Time.Format(time.RFC3339), l.Addr, l.Device)
+	} else {
+		fmt.Printf("Last login: never\n")
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Mailbox\tMessages\tUnseen\tBlobBytes\t\n")
+	var total mailboxSummary
+	for _, m := range sum.Mailboxes {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", m.Name, m.Messages, m.Unseen, m.BlobBytes)
+		total.Messages += m.Messages
+		total.Unseen += m.Unseen
+		total.BlobBytes += m.BlobBytes
+	}
+	fmt.Fprintf(w, "Total\t%d\t%d\t%d\t\n", total.Messages, total.Unseen, total.BlobBytes)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	if len(sum.Devices) == 0 {
+		fmt.Printf("Push devices: none\n")
+	} else {
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "Mailbox\tKind\tDevice\tFailures\n")
+		for _, d := range sum.Devices {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", d.Mailbox, d.Kind, d.ID, d.Failures)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	fmt.Println()
+
+	if len(sum.Queue) == 0 {
+		fmt.Printf("Queue: empty\n")
+		return nil
+	}
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "State\tMessages\n")
+	for _, q := range sum.Queue {
+		fmt.Fprintf(w, "%s\t%d\n", q.State, q.Count)
+	}
+	return w.Flush()
+}
+
+// spilldSummary fills in the parts of a user summary
+// kept in the spilld database.
+func spilldSummary(sum *userSummary) error {
 	conn := sdb.DB.Get(nil)
 	defer sdb.DB.Put(conn)
-	stmt := conn.Prep("SELECT UserID FROM UserAddresses WHERE Address = $username")
-	stmt.SetText("$username", username)
+
+	stmt := conn.Prep("SELECT Address FROM UserAddresses WHERE UserID = $userID AND PrimaryAddr IS TRUE;")
+	stmt.SetInt64("$userID", sum.UserID)
 	if hasNext, err := stmt.Step(); err != nil {
-		return 0, fmt.Errorf("searching for username: %v\n", err)
-	} else if !hasNext {
-		return 0, fmt.Errorf("cannot find user %q\n", username)
+		return err
+	} else if hasNext {
+		sum.Address = stmt.GetText("Address")
+		stmt.Reset()
 	}
-	userID := stmt.GetInt64("UserID")
-	stmt.Reset()
-	return userID, nil
+
+	devices, err := db.Devices(conn, sum.UserID)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.LastAccessTime.IsZero() {
+			continue
+		}
+		if sum.LastLogin == nil || d.LastAccessTime.After(sum.LastLogin.Time) {
+			sum.LastLogin = &userLogin{
+				Time:   d.LastAccessTime,
+				Addr:   d.LastAccessAddr,
+				Device: d.DeviceName,
+			}
+		}
+	}
+
+	stmt = conn.Prep(`SELECT DeliveryState, count(*) AS Count
+		FROM MsgRecipients
+		INNER JOIN Msgs ON Msgs.StagingID = MsgRecipients.StagingID
+		WHERE (Msgs.UserID = $userID OR MsgRecipients.UserID = $userID)
+		AND DeliveryState NOT IN ($done, $failed, $cancelled)
+		GROUP BY DeliveryState
+		ORDER BY DeliveryState;`)
+	stmt.SetInt64("$userID", sum.UserID)
+	stmt.SetInt64("$done", db.DeliveryDone)
+	stmt.SetInt64("$failed", db.DeliveryFailed)
+	stmt.SetInt64("$cancelled", db.DeliveryCancelled)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		sum.Queue = append(sum.Queue, queueCount{
+			State: db.DeliveryState(stmt.GetInt64("DeliveryState")).String(),
+			Count: int(stmt.GetInt64("Count")),
+		})
+	}
+	return nil
 }
 
-func cmdMsg(args []string) error {
-	// TODO: add flags
-	var src io.Reader
-	var dst io.Writer
-	if len(args) == 0 {
-		src = os.Stdin
-		dst = os.Stdout
-	} else {
-		return fmt.Errorf("TODO: args to msg")
+// spillboxSummary fills in the parts of a user summary
+// kept in the user's spillbox.
+func spillboxSummary(u *boxmgmt.User, sum *userSummary) error {
+	conn := u.Box.PoolRO.Get(nil)
+	defer u.Box.PoolRO.Put(conn)
+
+	// A blob shared by messages of a mailbox is counted once.
+	// Blobs in the object store have an empty Content.
+	stmt := conn.Prep(`SELECT MailboxID, Name,
+			(SELECT count(*) FROM Msgs
+				WHERE Msgs.MailboxID = Mailboxes.MailboxID
+				AND State = $msgReady) AS NumMsgs,
+			(SELECT count(*) FROM Msgs
+				WHERE Msgs.MailboxID = Mailboxes.MailboxID
+				AND State = $msgReady
+				AND (SysFlags & $flagSeen) = 0) AS NumUnseen,
+			(SELECT coalesce(sum(coalesce(RemoteBlobs.Size, length(Blobs.Content))), 0)
+				FROM blobs.Blobs
+				LEFT JOIN blobs.RemoteBlobs ON RemoteBlobs.BlobID = Blobs.BlobID
+				WHERE Blobs.BlobID IN (
+					SELECT MsgParts.BlobID FROM Msgs
+					INNER JOIN MsgParts ON MsgParts.MsgID = Msgs.MsgID
+					WHERE Msgs.MailboxID = Mailboxes.MailboxID
+					UNION
+					SELECT HdrsBlobID FROM Msgs
+					WHERE Msgs.MailboxID = Mailboxes.MailboxID
+				)) AS BlobBytes
+		FROM Mailboxes WHERE Name IS NOT NULL ORDER BY Name;`)
+	stmt.SetInt64("$msgReady", int64(spillbox.MsgReady))
+	stmt.SetInt64("$flagSeen", spillbox.FlagSeen)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		sum.Mailboxes = append(sum.Mailboxes, mailboxSummary{
+			MailboxID: stmt.GetInt64("MailboxID"),
+			Name:      stmt.GetText("Name"),
+			Messages:  int(stmt.GetInt64("NumMsgs")),
+			Unseen:    int(stmt.GetInt64("NumUnseen")),
+			BlobBytes: stmt.GetInt64("BlobBytes"),
+		})
 	}
 
-	msg, err := msgcleaver.Cleave(filer, src)
+	devices, err := spillbox.PushDevices(conn)
+	if err != nil {
+		return err
+	}
+	sum.Devices = devices
+	return nil
+}
+
+// mailboxes lists a user's mailboxes.
+//
+// With -deleted, it lists the deleted mailboxes that are kept
+// until the next gc after their retention period.
+func mailboxes(u *boxmgmt.User, args []string) error {
+	fs := flag.NewFlagSet("mailboxes", flag.ExitOnError)
+	deleted := fs.Bool("deleted", false, "list deleted mailboxes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	conn := u.Box.PoolRO.Get(nil)
+	defer u.Box.PoolRO.Put(conn)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if *deleted {
+		mailboxes, err := spillbox.DeletedMailboxes(conn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "MailboxID\tName\tDeleted\tUIDValidity\tMessages\n")
+		for _, m := range mailboxes {
+			deleted := "unknown"
+			if !m.Deleted.IsZero() {
+				deleted = m.Deleted.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\n", m.MailboxID, m.DeletedName, deleted, m.UIDValidity, m.NumMsgs)
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintf(w, "MailboxID\tName\tUIDValidity\tMessages\n")
+	stmt := conn.Prep(`SELECT MailboxID, Name, UIDValidity,
+			(SELECT count(*) FROM Msgs
+				WHERE Msgs.MailboxID = Mailboxes.MailboxID
+				AND State = $msgReady) AS NumMsgs
+		FROM Mailboxes WHERE Name IS NOT NULL ORDER BY Name;`)
+	stmt.SetInt64("$msgReady", int64(spillbox.MsgReady))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\n", stmt.GetInt64("MailboxID"), stmt.GetText("Name"), stmt.GetInt64("UIDValidity"), stmt.GetInt64("NumMsgs"))
+	}
+	return w.Flush()
+}
+
+// attachments finds a user's attachments by name or MIME type.
+func attachments(u *boxmgmt.User, args []string) error {
+	fs := flag.NewFlagSet("attachments", flag.ExitOnError)
+	name := fs.String("name", "", "file name contains")
+	contentType := fs.String("type", "", `MIME type, or "image/*"`)
+	mailbox := fs.String("mailbox", "", "mailbox name")
+	since := fs.String("since", "", "messages on or after date, YYYY-MM-DD")
+	limit := fs.Int("limit", 100, "maximum number of attachments listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	conn := u.Box.PoolRO.Get(nil)
+	defer u.Box.PoolRO.Put(conn)
+
+	q := spillbox.AttachmentQuery{
+		Name:        *name,
+		ContentType: *contentType,
+		Limit:       *limit,
+	}
+	if *mailbox != "" {
+		mailboxID, err := spillbox.FindMailbox(conn, *mailbox)
+		if err != nil {
+			return err
+		}
+		if mailboxID == 0 {
+			return fmt.Errorf("no mailbox %q", *mailbox)
+		}
+		q.MailboxID = mailboxID
+	}
+	if *since != "" {
+		t, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			return fmt.Errorf("bad -since: %v", err)
+		}
+		q.Since = t
+	}
+	atts, err := spillbox.FindAttachments(conn, q)
 	if err != nil {
 		return err
 	}
-	builder := msgbuilder.Builder{Filer: filer}
-	return builder.Build(dst, msg)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "MsgID\tPart\tMailboxID\tDate\tType\tName\n")
+	for _, att := range atts {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", att.MsgID, att.PartNum, att.MailboxID, att.Date.Format(time.RFC3339), att.ContentType, att.Name)
+	}
+	return w.Flush()
+}
+
+// verifySizes rebuilds a user's messages to correct their
+// stored RFC822.SIZE.
+func verifySizes(u *boxmgmt.User, args []string) error {
+	fs := flag.NewFlagSet("verify-sizes", flag.ExitOnError)
+	unverified := fs.Bool("new", false, "only check messages not verified before")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	stats, err := u.Box.VerifySizes(context.Background(), !*unverified)
+	fmt.Printf("checked %d messages, fixed %d (%+d bytes), failed %d\n", stats.Msgs, stats.Fixed, stats.Delta, stats.Failed)
+	return err
+}
+
+// devices lists the mail clients that have logged in as a user,
+// as they identified themselves with IMAP ID, and the devices
+// registered for the user's push notifications, with the number
+// of recent APNS failures.
+func devices(u *boxmgmt.User, userID int64, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+
+	spilldConn := sdb.DB.Get(nil)
+	clients, err := db.DeviceClients(spilldConn, userID)
+	sdb.DB.Put(spilldConn)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "DeviceID\tDevice\tClient\tVersion\tOS\tFirstSeen\tLastSeen\tLastAddr\n")
+	for _, c := range clients {
+		name := c.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.DeviceID, c.DeviceName, name, c.Version, c.OS,
+			c.FirstSeen.Format(time.RFC3339), c.LastSeen.Format(time.RFC3339), c.LastAddr)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	conn := u.Box.PoolRO.Get(nil)
+	defer u.Box.PoolRO.Put(conn)
+
+	devices, err := spillbox.PushDevices(conn)
+	if err != nil {
+		return err
+	}
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Mailbox\tKind\tDevice\tFailures\tLastFailure\n")
+	for _, d := range devices {
+		lastFailure := "-"
+		if !d.LastFailure.IsZero() {
+			lastFailure = d.LastFailure.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", d.Mailbox, d.Kind, d.ID, d.Failures, lastFailure)
+	}
+	return w.Flush()
+}
+
+// audit lists the security events recorded for a user,
+// most recent first.
+func audit(userID int64, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	event := fs.String("event", "", `only events of this kind, "login", "expunge", etc.`)
+	since := fs.Duration("since", 0, "only events in the last duration")
+	limit := fs.Int("limit", 100, "maximum number of events listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	q := db.AuditQuery{
+		UserID: userID,
+		Event:  db.AuditEvent(*event),
+		Limit:  *limit,
+	}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	entries, err := db.FindAudit(conn, q)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Time\tEvent\tAddr\tClient\tDetail\n")
+	for _, e := range entries {
+		addr, client := e.Addr, e.Client
+		if addr == "" {
+			addr = "-"
+		}
+		if client == "" {
+			client = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Event, addr, client, e.Detail)
+	}
+	return w.Flush()
+}
+
+// appPass lists, adds, or revokes the app-specific passwords
+// a user logs in to IMAP and SMTP with.
+func appPass(userID int64, args []string) error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	switch {
+	case len(args) == 0:
+		devices, err := db.Devices(conn, userID)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "DeviceID\tName\tCreated\tLastAccess\tLastAddr\n")
+		for _, d := range devices {
+			if d.Deleted {
+				continue
+			}
+			lastAccess := "-"
+			if !d.LastAccessTime.IsZero() {
+				lastAccess = d.LastAccessTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", d.DeviceID, d.DeviceName, d.Created.Format(time.RFC3339), lastAccess, d.LastAccessAddr)
+		}
+		return w.Flush()
+	case len(args) == 2 && args[0] == "add":
+		password, err := db.NewAppPassword()
+		if err != nil {
+			return err
+		}
+		deviceID, err := db.AddDevice(conn, userID, args[1], password)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Device ID:    %d\n", deviceID)
+		fmt.Fprintf(os.Stderr, "App Password: %s\n", password)
+		return nil
+	case len(args) == 2 && args[0] == "revoke":
+		deviceID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad device ID: %v", err)
+		}
+		return db.RevokeDevice(conn, userID, deviceID)
+	}
+	return fmt.Errorf("usage: apppass [add name | revoke deviceid]")
+}
+
+// totpCmd sets up two-factor authentication for a user.
+func totpCmd(userID int64, username string, args []string) error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	switch {
+	case len(args) == 1 && args[0] == "setup":
+		secret, err := db.SetupTOTP(conn, userID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Secret: %s\n", secret)
+		fmt.Printf("URL:    %s\n", totp.URL("spilled.ink", username, secret))
+		fmt.Printf("Confirm with: totp enable [code]\n")
+		return nil
+	case len(args) == 2 && args[0] == "enable":
+		return db.EnableTOTP(conn, userID, args[1], time.Now())
+	case len(args) == 1 && args[0] == "disable":
+		return db.DisableTOTP(conn, userID)
+	}
+	return fmt.Errorf("usage: totp setup|enable [code]|disable")
+}
+
+// unparsable lists the incoming messages quarantined because they
+// could not be parsed. They are retried with "user [username] reparse".
+func unparsable() error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	msgs, err := db.QuarantinedMsgs(conn, 0)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "StagingID\tReceived\tSender\tSize\tUsers\tError\n")
+	for _, m := range msgs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%v\t%s\n", m.StagingID, m.DateReceived.Format(time.RFC3339), m.Sender, m.Size, m.UserIDs, m.ParseError)
+	}
+	return w.Flush()
+}
+
+// repair completes or fails the messages of a user's mailbox left
+// half inserted by a crash, see boxmgmt.BoxMgmt.Repair.
+//
+// Opening the mailbox for the command already repairs it, logging
+// what it did, so this pass usually finds nothing left to do.
+func repair(userID int64, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	stats, redeliver, err := sdb.BoxMgmt.Repair(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stuck messages: %d\n", stats.Stuck)
+	fmt.Printf("Completed:      %d\n", stats.Completed)
+	fmt.Printf("Failed:         %d\n", stats.Failed)
+	fmt.Printf("Redelivering:   %d\n", redeliver)
+	return nil
+}
+
+// sendAs lists, adds, or removes the addresses other than their
+// own a user may send mail from through the MSA.
+func sendAs(userID int64, args []string) error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	switch {
+	case len(args) == 0:
+		addrs, err := db.SendAsAddresses(conn, userID)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			fmt.Println(addr)
+		}
+		return nil
+	case len(args) == 2 && args[0] == "add":
+		return db.AddSendAs(conn, userID, args[1])
+	case len(args) == 2 && args[0] == "rm":
+		return db.RemoveSendAs(conn, userID, args[1])
+	}
+	return fmt.Errorf("usage: sendas [add addr | rm addr]")
+}
+
+// webhooks lists, adds, or removes the webhooks told about the
+// mail events of a user or, with a userID of 0, of every user.
+// Payloads that could not be sent are listed with dead.
+func webhooks(userID int64, args []string) error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	switch {
+	case len(args) == 0:
+		hooks, err := webhook.List(conn, userID)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "WebhookID\tUser\tEvents\tURL\tCreated\n")
+		for _, h := range hooks {
+			user := "all"
+			if h.UserID != 0 {
+				user = strconv.FormatInt(h.UserID, 10)
+			}
+			events := make([]string, len(h.Events))
+			for i, e := range h.Events {
+				events[i] = string(e)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", h.WebhookID, user, strings.Join(events, ","), h.URL, h.Created.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case args[0] == "add":
+		fs := flag.NewFlagSet("add", flag.ExitOnError)
+		eventList := fs.String("events", "delivered,spam,bounce", "comma-separated events the webhook is told about")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			break
+		}
+		secret, err := webhook.NewSecret()
+		if err != nil {
+			return err
+		}
+		hook := webhook.Webhook{
+			UserID: userID,
+			URL:    fs.Arg(0),
+			Secret: secret,
+		}
+		for _, e := range strings.Split(*eventList, ",") {
+			hook.Events = append(hook.Events, webhook.Event(strings.TrimSpace(e)))
+		}
+		webhookID, err := webhook.Add(conn, hook)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Webhook ID: %d\n", webhookID)
+		fmt.Fprintf(os.Stderr, "Secret:     %s\n", secret)
+		return nil
+	case len(args) == 2 && args[0] == "rm":
+		webhookID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad webhook ID: %v", err)
+		}
+		return webhook.Remove(conn, webhookID)
+	case len(args) == 1 && args[0] == "dead":
+		letters, err := webhook.DeadLetters(conn, 0)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "Died\tWebhookID\tEvent\tAttempts\tURL\tLastError\n")
+		for _, l := range letters {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\n", l.Died.Format(time.RFC3339), l.WebhookID, l.Event, l.Attempts, l.URL, l.LastError)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("usage: webhooks [add [-events=list] url | rm id | dead]")
+}
+
+// setBIMI sets or removes the BIMI record of a sending domain.
+// The logo is checked against the SVG Tiny PS profile.
+func setBIMI(args []string) error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	switch {
+	case len(args) > 0 && args[0] == "set":
+		fs := flag.NewFlagSet("set", flag.ExitOnError)
+		selector := fs.String("selector", bimi.DefaultSelector, "BIMI-Selector of signed mail")
+		authority := fs.String("authority", "", "HTTPS URL of the Verified Mark Certificate")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 3 {
+			break
+		}
+		logo, err := ioutil.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		rec := bimi.Record{
+			Domain:       fs.Arg(0),
+			Selector:     *selector,
+			LogoURL:      fs.Arg(2),
+			AuthorityURL: *authority,
+		}
+		if err := db.SetBIMI(conn, rec, logo); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Publish the TXT record:\n")
+		fmt.Fprintf(os.Stderr, "\t%s\t%q\n", rec.Name(), rec.TXT())
+		fmt.Fprintf(os.Stderr, "and serve %s at %s\n", fs.Arg(1), rec.LogoURL)
+		return nil
+	case len(args) == 2 && args[0] == "rm":
+		return db.RemoveBIMI(conn, args[1])
+	}
+	return fmt.Errorf("usage: bimi [set [-selector=s] [-authority=url] domain logo.svg logo-url | rm domain]")
+}
+
+// dkimKeys manages the DKIM keys of outgoing mail.
+// Keys are sealed with the -blobkey master key, which spilld
+// must then be given with blob_key_file to sign with them.
+func dkimKeys(args []string) error {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+
+	printTXT := func(k dkimkeys.Key) {
+		fmt.Fprintf(os.Stderr, "Publish the TXT record:\n")
+		fmt.Fprintf(os.Stderr, "\t%s\t%q\n", k.Name(), k.TXT())
+		fmt.Fprintf(os.Stderr, "It signs mail from %s.\n", k.ActiveFrom.Format(time.RFC3339))
+	}
+
+	switch {
+	case len(args) > 0 && (args[0] == "ls" || args[0] == "list") && len(args) <= 2:
+		domain := ""
+		if len(args) == 2 {
+			domain = args[1]
+		}
+		keys, err := dkimkeys.Keys(conn, domain)
+		if err != nil {
+			return err
+		}
+		fmtTime := func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.Format(time.RFC3339)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(w, "Domain\tSelector\tActive from\tRetire\tSealed\n")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", k.Domain, k.Selector, fmtTime(k.ActiveFrom), fmtTime(k.Retire), k.Sealed)
+		}
+		return w.Flush()
+	case len(args) > 0 && args[0] == "new":
+		fs := flag.NewFlagSet("new", flag.ExitOnError)
+		selector := fs.String("selector", "", `selector, default the next "siN"`)
+		active := fs.Duration("active", 0, "wait before the key signs mail, for its TXT record to be published")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			break
+		}
+		k, err := dkimkeys.Generate(conn, fs.Arg(0), *selector, time.Now().Add(*active), sdb.BoxMgmt.BlobKey)
+		if err != nil {
+			return err
+		}
+		printTXT(k)
+		return nil
+	case len(args) > 0 && args[0] == "rotate":
+		fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+		overlap := fs.Duration("overlap", dkimkeys.DefaultOverlap, "time the new key is published before it signs mail, and the old key after")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			break
+		}
+		k, err := dkimkeys.Rotate(conn, fs.Arg(0), time.Now(), *overlap, sdb.BoxMgmt.BlobKey)
+		if err != nil {
+			return err
+		}
+		printTXT(k)
+		return nil
+	case len(args) == 3 && args[0] == "rm":
+		return dkimkeys.Remove(conn, args[1], args[2])
+	}
+	return fmt.Errorf("usage: dkim [ls [domain] | new [-selector=s] [-active=duration] domain | rotate [-overlap=duration] domain | rm domain selector]")
+}
+
+// contacts exports or imports a user's address book as vCards.
+//
+// With no file, export writes to stdout and import reads stdin.
+// import-part imports the vCards attached to a message.
+func contacts(u *boxmgmt.User, args []string) error {
+	if len(args) == 0 || len(args) > 3 || (len(args) == 3) != (args[0] == "import-part") {
+		return fmt.Errorf("usage: contacts export|import [file.vcf] | contacts import-part msgid partnum")
+	}
+	ctx := context.Background()
+	conn, err := u.Box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer u.Box.PutRW(conn)
+
+	switch args[0] {
+	case "export":
+		cards, err := spillbox.ExportContacts(conn)
+		if err != nil {
+			return err
+		}
+		f := os.Stdout
+		if len(args) == 2 {
+			if f, err = os.Create(args[1]); err != nil {
+				return err
+			}
+		}
+		for _, cc := range cards {
+			if err := cc.Card.Encode(f); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		return f.Close()
+	case "import":
+		r := io.Reader(os.Stdin)
+		if len(args) == 2 {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		cards, err := vcard.Parse(r)
+		if err != nil {
+			return err
+		}
+		contactIDs, err := spillbox.ImportContacts(conn, cards)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Contacts imported: %d\n", len(contactIDs))
+		return nil
+	case "import-part":
+		msgID, err := spillbox.ParseMsgID(args[1])
+		if err != nil {
+			id, err2 := strconv.ParseInt(args[1], 10, 64)
+			if err2 != nil {
+				return err
+			}
+			msgID = email.MsgID(id)
+		}
+		partNum, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("bad part number: %v", err)
+		}
+		contactIDs, err := u.Box.ImportPartContacts(conn, msgID, partNum)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Contacts imported: %d\n", len(contactIDs))
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+type printMsgFlags struct {
+	flagSet     *flag.FlagSet
+	headersOnly *bool
+	part        *int
+}
+
+func newPrintMsgFlags() *printMsgFlags {
+	fs := flag.NewFlagSet("printmsg", flag.ExitOnError)
+	return &printMsgFlags{
+		flagSet:     fs,
+		headersOnly: fs.Bool("headers-only", false, "print only the message headers"),
+		part:        fs.Int("part", -1, "print the decoded content of part N"),
+	}
+}
+
+// printMsg writes a stored message to stdout.
+//
+// By default the full RFC 822 message is rebuilt from its stored parts.
+func printMsg(u *boxmgmt.User, args []string) error {
+	fs := newPrintMsgFlags()
+	if err := fs.flagSet.Parse(args); err != nil {
+		return err
+	}
+	if fs.flagSet.NArg() == 0 {
+		return fmt.Errorf("missing msgid")
+	}
+	msgIDStr := fs.flagSet.Arg(0)
+	// Allow flags after the msgid.
+	if err := fs.flagSet.Parse(fs.flagSet.Args()[1:]); err != nil {
+		return err
+	}
+	if fs.flagSet.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.flagSet.Args())
+	}
+	if *fs.headersOnly && *fs.part >= 0 {
+		return fmt.Errorf("-headers-only and -part are mutually exclusive")
+	}
+
+	msgID, err := spillbox.ParseMsgID(msgIDStr)
+	if err != nil {
+		id, err2 := strconv.ParseInt(msgIDStr, 10, 64)
+		if err2 != nil {
+			return err
+		}
+		msgID = email.MsgID(id)
+	}
+
+	conn := u.Box.PoolRO.Get(nil)
+	defer u.Box.PoolRO.Put(conn)
+
+	switch {
+	case *fs.headersOnly:
+		hdr, err := u.Box.LoadMsgHdrs(conn, msgID)
+		if err != nil {
+			return err
+		}
+		_, err = hdr.Encode(os.Stdout)
+		return err
+
+	case *fs.part >= 0:
+		parts, err := spillbox.LoadPartsSummary(conn, msgID)
+		if err != nil {
+			return err
+		}
+		for i := range parts {
+			part := &parts[i]
+			if part.PartNum != *fs.part {
+				continue
+			}
+			if err := u.Box.LoadPartContent(conn, part); err != nil {
+				return err
+			}
+			defer part.Content.Close()
+			fmt.Fprintf(os.Stderr, "part %d: %s, %q, %d bytes\n", part.PartNum, part.ContentType, part.Name, part.Content.Size())
+			_, err := io.Copy(os.Stdout, part.Content)
+			return err
+		}
+		return fmt.Errorf("%v has no part %d (%d parts)", msgID, *fs.part, len(parts))
+
+	default:
+		buf, err := u.Box.BuildMessage(conn, msgID)
+		if err != nil {
+			return err
+		}
+		defer buf.Close()
+		if _, err := buf.Seek(0, 0); err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, buf)
+		return err
+	}
+}
+
+func findUserID(username string) (int64, error) {
+	conn := sdb.DB.Get(nil)
+	defer sdb.DB.Put(conn)
+	stmt := conn.Prep("SELECT UserID FROM UserAddresses WHERE Address = $username")
+	stmt.SetText("$username", username)
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("searching for username: %v\n", err)
+	} else if !hasNext {
+		return 0, fmt.Errorf("cannot find user %q\n", username)
+	}
+	userID := stmt.GetInt64("UserID")
+	stmt.Reset()
+	return userID, nil
+}
+
+// cmdMsg reads a message from stdin and cleaves it into parts, as
+// spilld does when a message is delivered.
+//
+// By default the message is rebuilt from its parts and written to
+// stdout. With -dump-parts the parts are listed instead, and with
+// -part the decoded content of one part is written. -check-dkim
+// verifies the DKIM-Signature of the message as received.
+func cmdMsg(args []string) error {
+	fs := flag.NewFlagSet("msg", flag.ExitOnError)
+	dumpParts := fs.Bool("dump-parts", false, "list the parts of the message")
+	partNum := fs.Int("part", -1, "print the decoded content of part N")
+	checkDKIM := fs.Bool("check-dkim", false, "verify the DKIM-Signature of the message")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *dumpParts && *partNum >= 0 {
+		return fmt.Errorf("-dump-parts and -part are mutually exclusive")
+	}
+
+	// The verifier and the cleaver both read the message.
+	src := filer.BufferFile(0)
+	defer src.Close()
+	if _, err := io.Copy(src, os.Stdin); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if *checkDKIM {
+		v := dkim.Verifier{}
+		if err := v.Verify(context.Background(), src); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "dkim: PASS\n")
+		if !*dumpParts && *partNum < 0 {
+			return nil
+		}
+		if _, err := src.Seek(0, 0); err != nil {
+			return err
+		}
+	}
+
+	msg, err := msgcleaver.Cleave(filer, src)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+
+	switch {
+	case *dumpParts:
+		return printParts(msg)
+	case *partNum >= 0:
+		if *partNum >= len(msg.Parts) {
+			return fmt.Errorf("message has no part %d (%d parts)", *partNum, len(msg.Parts))
+		}
+		part := &msg.Parts[*partNum]
+		fmt.Fprintf(os.Stderr, "part %d: %s, %q, %d bytes\n", part.PartNum, part.ContentType, part.Name, part.Content.Size())
+		if _, err := part.Content.Seek(0, 0); err != nil {
+			return err
+		}
+		_, err := io.Copy(os.Stdout, part.Content)
+		return err
+	default:
+		builder := msgbuilder.Builder{Filer: filer}
+		return builder.Build(os.Stdout, msg)
+	}
+}
+
+// printParts lists the parts of a cleaved message.
+// The cleaver flattens the MIME tree, so the multipart
+// containers are not parts.
+func printParts(msg *email.Msg) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Part\tContentType\tKind\tSize\tEncoding\tEncodedSize\tName\tNotes\n")
+	for i := range msg.Parts {
+		part := &msg.Parts[i]
+		var kind []string
+		if part.IsBody {
+			kind = append(kind, "body")
+		}
+		if part.IsAttachment {
+			kind = append(kind, "attachment")
+		}
+		if part.IsSynthesized {
+			kind = append(kind, "synthesized")
+		}
+		if len(kind) == 0 {
+			kind = append(kind, "-")
+		}
+		encoding := part.ContentTransferEncoding
+		if encoding == "" {
+			encoding = "-"
+		}
+		var size int64
+		if part.Content != nil {
+			size = part.Content.Size()
+		}
+		var notes []string
+		if part.OriginalCharset != "" {
+			notes = append(notes, "charset "+part.OriginalCharset)
+		}
+		if part.TransferAnomalies != "" {
+			notes = append(notes, part.TransferAnomalies)
+		}
+		name := part.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%d\t%s\t%s\n", part.PartNum, part.ContentType,
+			strings.Join(kind, ","), size, encoding, part.ContentTransferSize, name, strings.Join(notes, "; "))
+	}
+	return w.Flush()
 }
 
 func exit(code int) {
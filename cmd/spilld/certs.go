@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// A certFile is a certificate and key provided by the operator
+// in PEM files. The files are read again by reload, so a renewed
+// certificate is served on SIGHUP without a restart.
+type certFile struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// reload reads the certificate files. If they cannot be read,
+// the certificate loaded before is kept.
+func (c *certFile) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate serves the certificate whatever the SNI of the
+// client. It is a tls.Config.GetCertificate.
+func (c *certFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// certFiles is the certificates in use, by certificate and key path.
+type certFiles map[[2]string]*certFile
+
+// load returns the certificate in the files at certPath and keyPath,
+// reading them the first time they are used.
+func (cf certFiles) load(certPath, keyPath string) (*certFile, error) {
+	if keyPath == "" {
+		return nil, fmt.Errorf("tls: %s: no key_file", certPath)
+	}
+	c := cf[[2]string{certPath, keyPath}]
+	if c != nil {
+		return c, nil
+	}
+	c = &certFile{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	cf[[2]string{certPath, keyPath}] = c
+	return c, nil
+}
+
+// reload rereads the files of every certificate,
+// logging the ones that cannot be read with logf.
+func (cf certFiles) reload(logf func(format string, v ...interface{})) {
+	for _, c := range cf {
+		if err := c.reload(); err != nil {
+			logf("spilld: reload: %v, still serving the old certificate", err)
+		}
+	}
+}
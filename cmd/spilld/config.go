@@ -0,0 +1,763 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is the contents of a spilld configuration file.
+//
+// The file is a subset of TOML: tables, comments, and keys with
+// string, integer, boolean, or single-line string array values.
+//
+//	dbdir = "/var/spilld"
+//	log_level = "info"
+//	drain_timeout = "10m"
+//
+//	[smtp]
+//	hostname = "mx.example.com"
+//	addr = [":25", "[::1]:2525"]
+//
+//	[limits]
+//	smtp_msgs_per_hour = 200
+//
+// Only the values marked reloadable take effect on SIGHUP,
+// the rest require a restart.
+type config struct {
+	Dev       bool
+	DBDir     string
+	DebugAddr string
+	HTTPAddr  string
+	LogLevel  string // reloadable
+
+	// DrainTimeout is how long connections have to finish
+	// after a handoff to a new process.
+	DrainTimeout time.Duration
+
+	// BlobKeyFile, if set, holds the master key stored
+	// mail is sealed with, see boxmgmt.BoxMgmt.BlobKey.
+	BlobKeyFile string
+
+	// Fidelity keeps received mail byte-identical where
+	// possible, so FETCH BODY[] returns what was delivered.
+	Fidelity bool
+
+	// AuditRetention is how long the audit log of security
+	// events is kept, zero for db.DefaultAuditRetention.
+	AuditRetention time.Duration
+
+	IMAP listenerConfig
+	SMTP listenerConfig
+	MSA  listenerConfig
+	DNS  listenerConfig
+
+	TLS      tlsConfig
+	APNS     tlsConfig // reloadable
+	WebPush  webPushConfig
+	AppPass  appPassConfig
+	S3       s3Config
+	Repl     replConfig
+	Hooks    hooksConfig
+	Webhooks webhooksConfig
+	Outbound outboundConfig
+	Milter   milterConfig
+	Clamd    clamdConfig
+	DKIM     dkimConfig
+	Limits   limitsConfig
+	Tracing  tracingConfig
+
+	IMAPDebug imapDebugConfig
+}
+
+// listenerConfig is a network service. Its addr keys take
+// a single address or an array of them.
+//
+// A listener with a cert_file serves that certificate instead of
+// the one of the [tls] table.
+type listenerConfig struct {
+	Hostname      string
+	Addrs         []string
+	StartTLSAddrs []string // IMAP port 143 and MSA port 587, cleartext until STARTTLS
+	SenderPolicy  string   // MSA only, "reject" or "rewrite" mail from addresses not the user's
+	CompressLevel int      // IMAP only, flate level of COMPRESS, -2 to 9
+	CertFile      string
+	KeyFile       string
+}
+
+// tlsConfig is a certificate. The [tls] table sets the certificate
+// of the listeners, from the PEM files CertFile and KeyFile if set,
+// otherwise from Let's Encrypt. The contents of the files, but not
+// their paths, are reloadable.
+type tlsConfig struct {
+	CertFile    string
+	KeyFile     string
+	AutocertDir string // TLS only, default: dbdir/tls_certs
+}
+
+// webPushConfig enables Web Push notifications.
+type webPushConfig struct {
+	KeyFile string // VAPID P-256 private key, PEM
+	Subject string // VAPID contact, a mailto: or https: URL
+}
+
+// appPassConfig serves the HTTPS endpoint users manage their
+// app passwords with, see apppass.Handler.
+type appPassConfig struct {
+	Addr string
+}
+
+// s3Config moves large blobs to an S3-compatible object store.
+type s3Config struct {
+	Endpoint         string
+	Bucket           string
+	Region           string
+	AccessKeyID      string
+	SecretKeyFile    string // holds the secret access key
+	OffloadThreshold int    // bytes, default boxmgmt.DefaultOffloadThreshold
+}
+
+// replConfig replicates mailboxes to a standby spilld.
+// A primary sets Addr, a standby sets Primary. Both need the
+// token. A standby should not be sent mail until it is promoted.
+type replConfig struct {
+	Addr      string // primary: HTTPS address serving the changes
+	Primary   string // standby: URL of the primary, "https://host:port"
+	TokenFile string // holds the shared bearer token
+}
+
+// hooksConfig runs programs on incoming mail before delivery,
+// in order. See deliveryhook.Exec.
+type hooksConfig struct {
+	Exec    []string // program paths
+	Timeout time.Duration
+}
+
+// webhooksConfig tunes the sending of mail events to webhooks,
+// which are added with the spillbox webhooks command.
+type webhooksConfig struct {
+	Timeout     time.Duration // for each POST
+	MaxAttempts int           // default webhook.DefaultMaxAttempts
+}
+
+// outboundConfig limits the SMTP connections made to deliver mail.
+// Connections to an MX host are reused for the messages queued for it.
+//
+// The rate limits, see deliverer.RateLimit, are reloadable.
+type outboundConfig struct {
+	MaxConnsPerHost int           // 0 for no limit
+	IdleTimeout     time.Duration // default smtpclient.DefaultIdleTimeout, negative disables reuse
+	MaxMsgsPerConn  int           // default smtpclient.DefaultMaxMsgsPerConn
+
+	DomainMsgsPerHour int      // 0 for no limit
+	DomainLimits      []string // "example.com=100", messages an hour to one domain
+	WarmupStart       string   // "2006-01-02", first day of sending from a new IP
+	WarmupMsgsPerHour int      // domain limit on the first day, doubling daily
+}
+
+// milterConfig consults mail filters about inbound SMTP mail,
+// in order. Addresses are "unix:/path" or "inet:host:port".
+type milterConfig struct {
+	Addrs    []string
+	Timeout  time.Duration
+	FailOpen bool // accept mail when a filter is down
+}
+
+// clamdConfig scans attachments of incoming mail for viruses.
+// Infected mail is quarantined unless Reject is set.
+type clamdConfig struct {
+	Addr       string // "unix:/path" or "inet:host:port"
+	Timeout    time.Duration
+	Reject     bool
+	RescanAddr string // HTTPS address serving rescans, see virusscan.Handler
+}
+
+// dkimConfig rotates the DKIM keys of outgoing mail, which are
+// generated with the spillbox dkim command. See dkimkeys.Rotator.
+// Keys are sealed with the blob_key_file master key if it is set.
+type dkimConfig struct {
+	RotateEvery time.Duration // 0 disables rotation
+	Overlap     time.Duration // default dkimkeys.DefaultOverlap
+}
+
+// imapDebugConfig sets where IMAP transcripts are kept once
+// capture is enabled with /admin/imapdebug, see imapserver.DebugCapture.
+type imapDebugConfig struct {
+	Dir       string // default "imap_debug" in the dbdir
+	MaxSize   int    // bytes, a transcript is rotated at this size
+	MaxFiles  int    // rotated transcripts kept for a session
+	Retention time.Duration
+}
+
+// tracingConfig exports spans of IMAP commands, SMTP transactions,
+// and their database operations to an OpenTelemetry collector.
+// See otlptrace.Exporter.
+type tracingConfig struct {
+	Endpoint    string // OTLP/HTTP traces URL, "http://localhost:4318/v1/traces"
+	ServiceName string // default "spilld"
+}
+
+type limitsConfig struct {
+	MaxMsgSize       int
+	MaxSMTPSessions  int
+	MaxRecipients    int
+	MaxSMTPMsgs      int // per connection
+	MaxIMAPConns     int
+	MaxIMAPUserConns int
+	MaxIMAPIPConns   int
+	MaxLoginFailures int
+	MaxLoginLockout  time.Duration
+	SMTPMsgsPerHour  int // reloadable
+
+	// Finding dead IMAP connections, such as phones gone
+	// from the network in IDLE. Negative disables each.
+	IMAPKeepAlive     time.Duration // TCP keepalive period
+	IMAPIdleHeartbeat time.Duration // "* OK still here" during IDLE
+	IMAPAckTimeout    time.Duration // unacknowledged writes, Linux only
+
+	// IMAPLiteralMemSize is how many bytes of an IMAP literal,
+	// such as an APPENDed message, are held in memory before
+	// the rest is written to a file in dbdir/tmp.
+	IMAPLiteralMemSize int
+
+	// IMAPSlowCommand is the latency past which an IMAP command is
+	// logged with its parse, database and write times. Zero disables.
+	IMAPSlowCommand time.Duration
+
+	// Limits on the MIME structure and decoded size of a message,
+	// see msgcleaver.Limits. Zero keeps msgcleaver's default.
+	MaxMIMEDepth       int
+	MaxMIMEParts       int
+	MaxDecodedPartSize int
+	MaxDecodedMsgSize  int
+
+	// MailboxWriteTimeout is how long a writer waits behind others
+	// for a mailbox, see spillbox.Box.WriteTimeout.
+	MailboxWriteTimeout time.Duration
+	// SQLiteBusyTimeout is how long a mailbox database access
+	// retries while the file is locked by another process.
+	SQLiteBusyTimeout time.Duration
+	// SendDelay is the undo send window, how long submitted
+	// mail is held before it is sent, see spilldb.Limits.
+	SendDelay time.Duration
+}
+
+// load reads the configuration file at path over the values of c.
+func (c *config) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if err := c.parse(data); err != nil {
+		return fmt.Errorf("config: %s:%v", path, err)
+	}
+	return nil
+}
+
+// flagKeys maps command line flags to configuration keys.
+// A flag given on the command line overrides the file.
+var flagKeys = map[string]string{
+	"dev":                "dev",
+	"dbdir":              "dbdir",
+	"debug_addr":         "debug_addr",
+	"http_addr":          "http_addr",
+	"log_level":          "log_level",
+	"drain_timeout":      "drain_timeout",
+	"imap_hostname":      "imap.hostname",
+	"imap_addr":          "imap.addr",
+	"imap_starttls_addr": "imap.starttls_addr",
+	"smtp_hostname":      "smtp.hostname",
+	"smtp_addr":          "smtp.addr",
+	"msa_hostname":       "msa.hostname",
+	"msa_addr":           "msa.addr",
+	"msa_starttls_addr":  "msa.starttls_addr",
+	"dns_hostname":       "dns.hostname",
+	"dns_addr":           "dns.addr",
+}
+
+// setFlag sets the configuration value of a command line flag.
+func (c *config) setFlag(f *flag.Flag) error {
+	key := flagKeys[f.Name]
+	if key == "" {
+		return nil
+	}
+	var val interface{} = f.Value.String()
+	if getter, ok := f.Value.(flag.Getter); ok {
+		val = getter.Get()
+	}
+	return c.set(key, val)
+}
+
+// restartNeeded reports whether the difference between c and
+// newc requires a restart, that is, if any value that cannot
+// be reloaded has changed.
+func (c *config) restartNeeded(newc *config) bool {
+	c1, c2 := *c, *newc
+	c1.LogLevel, c2.LogLevel = "", ""
+	c1.APNS, c2.APNS = tlsConfig{}, tlsConfig{}
+	c1.Limits.SMTPMsgsPerHour, c2.Limits.SMTPMsgsPerHour = 0, 0
+	c1.Outbound.DomainMsgsPerHour, c2.Outbound.DomainMsgsPerHour = 0, 0
+	c1.Outbound.DomainLimits, c2.Outbound.DomainLimits = nil, nil
+	c1.Outbound.WarmupStart, c2.Outbound.WarmupStart = "", ""
+	c1.Outbound.WarmupMsgsPerHour, c2.Outbound.WarmupMsgsPerHour = 0, 0
+	return !reflect.DeepEqual(c1, c2)
+}
+
+func (c *config) parse(data []byte) error {
+	table := ""
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return fmt.Errorf("%d: bad table header %q", lineNum, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return fmt.Errorf("%d: expected key = value", lineNum)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if table != "" {
+			key = table + "." + key
+		}
+		if seen[key] {
+			return fmt.Errorf("%d: duplicate key %q", lineNum, key)
+		}
+		seen[key] = true
+		val, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("%d: %s: %v", lineNum, key, err)
+		}
+		if err := c.set(key, val); err != nil {
+			return fmt.Errorf("%d: %v", lineNum, err)
+		}
+	}
+	return s.Err()
+}
+
+func (c *config) set(key string, val interface{}) error {
+	if p := c.stringField(key); p != nil {
+		v, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("%s: want a string", key)
+		}
+		*p = v
+		return nil
+	}
+	if p := c.addrsField(key); p != nil {
+		switch v := val.(type) {
+		case string:
+			if v == "" {
+				*p = []string{} // service disabled
+			} else {
+				*p = []string{v}
+			}
+		case []string:
+			*p = v
+		default:
+			return fmt.Errorf("%s: want an address or array of addresses", key)
+		}
+		return nil
+	}
+	if p := c.stringsField(key); p != nil {
+		switch v := val.(type) {
+		case string:
+			*p = []string{v}
+		case []string:
+			*p = v
+		default:
+			return fmt.Errorf("%s: want a string or array of strings", key)
+		}
+		return nil
+	}
+	if p := c.intField(key); p != nil {
+		v, ok := val.(int)
+		if !ok {
+			return fmt.Errorf("%s: want an integer", key)
+		}
+		*p = v
+		return nil
+	}
+	if p := c.durationField(key); p != nil {
+		switch v := val.(type) {
+		case time.Duration:
+			*p = v
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			*p = d
+		default:
+			return fmt.Errorf("%s: want a duration", key)
+		}
+		return nil
+	}
+	if p := c.boolField(key); p != nil {
+		v, ok := val.(bool)
+		if !ok {
+			return fmt.Errorf("%s: want a boolean", key)
+		}
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unknown key %q", key)
+}
+
+func (c *config) stringField(key string) *string {
+	switch key {
+	case "dbdir":
+		return &c.DBDir
+	case "blob_key_file":
+		return &c.BlobKeyFile
+	case "debug_addr":
+		return &c.DebugAddr
+	case "http_addr":
+		return &c.HTTPAddr
+	case "log_level":
+		return &c.LogLevel
+	case "imap.hostname":
+		return &c.IMAP.Hostname
+	case "smtp.hostname":
+		return &c.SMTP.Hostname
+	case "msa.hostname":
+		return &c.MSA.Hostname
+	case "msa.sender_policy":
+		return &c.MSA.SenderPolicy
+	case "dns.hostname":
+		return &c.DNS.Hostname
+	case "imap.cert_file":
+		return &c.IMAP.CertFile
+	case "imap.key_file":
+		return &c.IMAP.KeyFile
+	case "smtp.cert_file":
+		return &c.SMTP.CertFile
+	case "smtp.key_file":
+		return &c.SMTP.KeyFile
+	case "msa.cert_file":
+		return &c.MSA.CertFile
+	case "msa.key_file":
+		return &c.MSA.KeyFile
+	case "tls.cert_file":
+		return &c.TLS.CertFile
+	case "tls.key_file":
+		return &c.TLS.KeyFile
+	case "tls.autocert_dir":
+		return &c.TLS.AutocertDir
+	case "apns.cert_file":
+		return &c.APNS.CertFile
+	case "apns.key_file":
+		return &c.APNS.KeyFile
+	case "webpush.key_file":
+		return &c.WebPush.KeyFile
+	case "webpush.subject":
+		return &c.WebPush.Subject
+	case "apppass.addr":
+		return &c.AppPass.Addr
+	case "s3.endpoint":
+		return &c.S3.Endpoint
+	case "s3.bucket":
+		return &c.S3.Bucket
+	case "s3.region":
+		return &c.S3.Region
+	case "s3.access_key_id":
+		return &c.S3.AccessKeyID
+	case "s3.secret_key_file":
+		return &c.S3.SecretKeyFile
+	case "replication.addr":
+		return &c.Repl.Addr
+	case "replication.primary":
+		return &c.Repl.Primary
+	case "replication.token_file":
+		return &c.Repl.TokenFile
+	case "clamd.addr":
+		return &c.Clamd.Addr
+	case "clamd.rescan_addr":
+		return &c.Clamd.RescanAddr
+	case "outbound.warmup_start":
+		return &c.Outbound.WarmupStart
+	case "imap_debug.dir":
+		return &c.IMAPDebug.Dir
+	case "tracing.endpoint":
+		return &c.Tracing.Endpoint
+	case "tracing.service_name":
+		return &c.Tracing.ServiceName
+	}
+	return nil
+}
+
+func (c *config) addrsField(key string) *[]string {
+	switch key {
+	case "imap.addr":
+		return &c.IMAP.Addrs
+	case "smtp.addr":
+		return &c.SMTP.Addrs
+	case "msa.addr":
+		return &c.MSA.Addrs
+	case "imap.starttls_addr":
+		return &c.IMAP.StartTLSAddrs
+	case "msa.starttls_addr":
+		return &c.MSA.StartTLSAddrs
+	case "dns.addr":
+		return &c.DNS.Addrs
+	case "milter.addr":
+		return &c.Milter.Addrs
+	}
+	return nil
+}
+
+func (c *config) stringsField(key string) *[]string {
+	switch key {
+	case "hooks.exec":
+		return &c.Hooks.Exec
+	case "outbound.domain_limits":
+		return &c.Outbound.DomainLimits
+	}
+	return nil
+}
+
+func (c *config) intField(key string) *int {
+	switch key {
+	case "limits.max_msg_size":
+		return &c.Limits.MaxMsgSize
+	case "limits.max_smtp_sessions":
+		return &c.Limits.MaxSMTPSessions
+	case "limits.max_recipients":
+		return &c.Limits.MaxRecipients
+	case "limits.max_smtp_msgs":
+		return &c.Limits.MaxSMTPMsgs
+	case "imap.compress_level":
+		return &c.IMAP.CompressLevel
+	case "limits.max_imap_conns":
+		return &c.Limits.MaxIMAPConns
+	case "limits.max_imap_user_conns":
+		return &c.Limits.MaxIMAPUserConns
+	case "limits.max_imap_ip_conns":
+		return &c.Limits.MaxIMAPIPConns
+	case "limits.max_login_failures":
+		return &c.Limits.MaxLoginFailures
+	case "limits.smtp_msgs_per_hour":
+		return &c.Limits.SMTPMsgsPerHour
+	case "limits.imap_literal_mem_size":
+		return &c.Limits.IMAPLiteralMemSize
+	case "limits.max_mime_depth":
+		return &c.Limits.MaxMIMEDepth
+	case "limits.max_mime_parts":
+		return &c.Limits.MaxMIMEParts
+	case "limits.max_decoded_part_size":
+		return &c.Limits.MaxDecodedPartSize
+	case "limits.max_decoded_msg_size":
+		return &c.Limits.MaxDecodedMsgSize
+	case "s3.offload_threshold":
+		return &c.S3.OffloadThreshold
+	case "webhooks.max_attempts":
+		return &c.Webhooks.MaxAttempts
+	case "outbound.max_conns_per_host":
+		return &c.Outbound.MaxConnsPerHost
+	case "outbound.max_msgs_per_conn":
+		return &c.Outbound.MaxMsgsPerConn
+	case "outbound.domain_msgs_per_hour":
+		return &c.Outbound.DomainMsgsPerHour
+	case "outbound.warmup_msgs_per_hour":
+		return &c.Outbound.WarmupMsgsPerHour
+	case "imap_debug.max_size":
+		return &c.IMAPDebug.MaxSize
+	case "imap_debug.max_files":
+		return &c.IMAPDebug.MaxFiles
+	}
+	return nil
+}
+
+func (c *config) durationField(key string) *time.Duration {
+	switch key {
+	case "drain_timeout":
+		return &c.DrainTimeout
+	case "audit_retention":
+		return &c.AuditRetention
+	case "limits.max_login_lockout":
+		return &c.Limits.MaxLoginLockout
+	case "limits.mailbox_write_timeout":
+		return &c.Limits.MailboxWriteTimeout
+	case "limits.sqlite_busy_timeout":
+		return &c.Limits.SQLiteBusyTimeout
+	case "limits.send_delay":
+		return &c.Limits.SendDelay
+	case "limits.imap_keepalive":
+		return &c.Limits.IMAPKeepAlive
+	case "limits.imap_idle_heartbeat":
+		return &c.Limits.IMAPIdleHeartbeat
+	case "limits.imap_ack_timeout":
+		return &c.Limits.IMAPAckTimeout
+	case "limits.imap_slow_command":
+		return &c.Limits.IMAPSlowCommand
+	case "hooks.timeout":
+		return &c.Hooks.Timeout
+	case "webhooks.timeout":
+		return &c.Webhooks.Timeout
+	case "outbound.idle_timeout":
+		return &c.Outbound.IdleTimeout
+	case "milter.timeout":
+		return &c.Milter.Timeout
+	case "clamd.timeout":
+		return &c.Clamd.Timeout
+	case "dkim.rotate_every":
+		return &c.DKIM.RotateEvery
+	case "dkim.overlap":
+		return &c.DKIM.Overlap
+	case "imap_debug.retention":
+		return &c.IMAPDebug.Retention
+	}
+	return nil
+}
+
+func (c *config) boolField(key string) *bool {
+	switch key {
+	case "dev":
+		return &c.Dev
+	case "fidelity":
+		return &c.Fidelity
+	case "milter.fail_open":
+		return &c.Milter.FailOpen
+	case "clamd.reject":
+		return &c.Clamd.Reject
+	}
+	return nil
+}
+
+// sockAddr splits a sendmail-style socket address, as used for
+// milters and clamd, "unix:/path" or "inet:host:port", into a
+// network and address.
+func sockAddr(addr string) (network, address string, err error) {
+	i := strings.IndexByte(addr, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("socket address %q: missing unix: or inet: prefix", addr)
+	}
+	switch addr[:i] {
+	case "unix", "local":
+		return "unix", addr[i+1:], nil
+	case "inet", "inet6":
+		return "tcp", addr[i+1:], nil
+	}
+	return "", "", fmt.Errorf("socket address %q: unknown network %q", addr, addr[:i])
+}
+
+// stripComment removes a # comment that is not inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseValue parses a TOML value: a string, integer, boolean,
+// or array of strings.
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		vals := []string{}
+		rest := strings.TrimSpace(s[1 : len(s)-1])
+		for rest != "" {
+			v, n, err := parseString(rest)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+			rest = strings.TrimSpace(rest[n:])
+			if rest == "" {
+				break
+			}
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("expected , in array")
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+		return vals, nil
+	case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'"):
+		v, n, err := parseString(s)
+		if err != nil {
+			return nil, err
+		}
+		if n != len(s) {
+			return nil, fmt.Errorf("trailing characters after string")
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bad value %q", s)
+	}
+	return int(v), nil
+}
+
+// parseString parses the string at the beginning of s and
+// reports the number of bytes it used.
+func parseString(s string) (v string, n int, err error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return "", 0, fmt.Errorf("expected a string")
+	}
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], end + 2, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				return "", 0, fmt.Errorf("unknown escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
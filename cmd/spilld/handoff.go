@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Listening sockets are passed to spilld with the systemd socket
+// activation protocol, sd_listen_fds(3). The sockets are file
+// descriptors 3 and up, LISTEN_FDS is their count and LISTEN_FDNAMES
+// their colon-separated names. The names spilld uses are:
+//
+//	imap, imap-starttls, smtp, msa, msa-starttls, dns (TCP), dns-udp
+//
+// set with FileDescriptorName= in a systemd .socket unit.
+// A service with inherited sockets uses them in place of the
+// addresses in its configuration.
+//
+// A running spilld hands its sockets to a new process the same way
+// on SIGUSR2. systemd sets LISTEN_PID to the PID of the process
+// the sockets are for. A handoff cannot know the new PID before exec,
+// so it leaves LISTEN_PID unset.
+const listenFDsStart = 3
+
+// handoffTimeout is how long a new process has to start serving.
+const handoffTimeout = 30 * time.Second
+
+// listeners opens, inherits, and hands off listening sockets.
+type listeners struct {
+	inherited map[string][]*os.File // name -> unused inherited sockets
+	serving   []namedSocket
+}
+
+type namedSocket struct {
+	name string
+	sock interface {
+		File() (*os.File, error)
+	}
+}
+
+func inheritListeners() (*listeners, error) {
+	l := &listeners{inherited: make(map[string][]*os.File)}
+
+	defer func() {
+		// Do not pass the environment on to children.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	fdsStr := os.Getenv("LISTEN_FDS")
+	if fdsStr == "" {
+		return l, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return l, nil
+	}
+	numFDs, err := strconv.Atoi(fdsStr)
+	if err != nil || numFDs < 0 {
+		return nil, fmt.Errorf("spilld: bad LISTEN_FDS=%q", fdsStr)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < numFDs; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		l.inherited[name] = append(l.inherited[name], os.NewFile(uintptr(fd), name))
+	}
+	return l, nil
+}
+
+// listen returns the TCP listeners for the service name.
+// Inherited listeners are used if there are any, otherwise
+// a listener is opened on each of addrs.
+func (l *listeners) listen(name string, addrs []string) ([]net.Listener, error) {
+	var lns []net.Listener
+	if files := l.inherited[name]; len(files) > 0 {
+		delete(l.inherited, name)
+		for _, f := range files {
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("spilld: inherited %s listener: %v", name, err)
+			}
+			lns = append(lns, ln)
+		}
+	} else {
+		for _, addr := range addrs {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			lns = append(lns, ln)
+		}
+	}
+	for _, ln := range lns {
+		sock, ok := ln.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("spilld: %s listener is not TCP: %T", name, ln)
+		}
+		l.serving = append(l.serving, namedSocket{name: name, sock: sock})
+	}
+	return lns, nil
+}
+
+// listenPacket is listen for UDP sockets.
+func (l *listeners) listenPacket(name string, addrs []string) ([]net.PacketConn, error) {
+	var pcs []net.PacketConn
+	if files := l.inherited[name]; len(files) > 0 {
+		delete(l.inherited, name)
+		for _, f := range files {
+			pc, err := net.FilePacketConn(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("spilld: inherited %s socket: %v", name, err)
+			}
+			pcs = append(pcs, pc)
+		}
+	} else {
+		for _, addr := range addrs {
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			pcs = append(pcs, pc)
+		}
+	}
+	for _, pc := range pcs {
+		sock, ok := pc.(*net.UDPConn)
+		if !ok {
+			return nil, fmt.Errorf("spilld: %s socket is not UDP: %T", name, pc)
+		}
+		l.serving = append(l.serving, namedSocket{name: name, sock: sock})
+	}
+	return pcs, nil
+}
+
+// closeUnused closes inherited sockets no service asked for.
+func (l *listeners) closeUnused() {
+	for name, files := range l.inherited {
+		log.Printf("spilld: closing %d unused inherited %q sockets", len(files), name)
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	l.inherited = nil
+}
+
+// handoff starts a new spilld process with the listening sockets.
+// It returns once the new process is serving.
+//
+// The new process reports it is ready by writing a byte to the
+// pipe named by SPILLD_READY_FD. If it does not, it is killed and
+// this process keeps serving.
+func (l *listeners) handoff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var names []string
+	for _, s := range l.serving {
+		f, err := s.sock.File()
+		if err != nil {
+			return fmt.Errorf("%s socket: %v", s.name, err)
+		}
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"SPILLD_READY_FD="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	readyW.Close() // the child holds the only write end
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		n, err := readyR.Read(b[:])
+		if n == 1 {
+			err = nil
+		} else if err == nil {
+			err = errors.New("no ready message")
+		}
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("new process %d not ready: %v", cmd.Process.Pid, err)
+		}
+		log.Printf("spilld: new process %d is serving", cmd.Process.Pid)
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("new process exited: %v", err)
+	case <-time.After(handoffTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d not ready after %v", cmd.Process.Pid, handoffTimeout)
+	}
+}
+
+// notifyReady tells the process that handed off its sockets
+// that this process is serving.
+func notifyReady() {
+	fdStr := os.Getenv("SPILLD_READY_FD")
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv("SPILLD_READY_FD")
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		log.Printf("spilld: bad SPILLD_READY_FD=%q", fdStr)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("spilld: ready notification: %v", err)
+	}
+	f.Close()
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -13,14 +16,34 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 
 	"crawshaw.io/iox"
+	"spilled.ink/email"
+	"spilled.ink/email/bimi"
+	"spilled.ink/email/msgcleaver"
+	"spilled.ink/smtp/milter"
 	"spilled.ink/spilldb"
+	"spilled.ink/spilldb/apppass"
+	"spilled.ink/spilldb/boxmgmt"
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/deliverer"
+	"spilled.ink/spilldb/deliveryhook"
+	"spilled.ink/spilldb/replication"
+	"spilled.ink/spilldb/smtpdb"
+	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/spilldb/virusscan"
+	"spilled.ink/spilldb/webpush"
+	"spilled.ink/util/clamd"
 	"spilled.ink/util/devcert"
+	"spilled.ink/util/otlptrace"
+	"spilled.ink/util/s3store"
 )
 
 var version = "unknown" // filled in by "-ldflags=-X main.version=<val>"
@@ -33,21 +56,37 @@ func main() {
 		hostname = "localhost"
 	}
 
-	flagDev := flag.Bool("dev", false, `development server, local CA is used and backup ports are opened with an 8-prefix`)
-	flagDBDir := flag.String("dbdir", "", "spilldb database directory")
-	flagDebugAddr := flag.String("debug_addr", "", "HTTP address for the debug server (do *not* expose to the public)")
-	flagIMAPHostname := flag.String("imap_hostname", hostname, "IMAP hostname")
-	flagIMAPAddr := flag.String("imap_addr", ":943", "IMAP address")
-	flagSMTPHostname := flag.String("smtp_hostname", hostname, "SMTP hostname")
-	flagSMTPAddr := flag.String("smtp_addr", ":25", "SMTP address")
-	flagMSAHostname := flag.String("msa_hostname", hostname, "MSA hostname")
-	flagMSAAddr := flag.String("msa_addr", ":465", "MSA (mail submission) address")
-	flagDNSHostname := flag.String("dns_hostname", hostname, "DNS hostname")
-	flagDNSAddr := flag.String("dns_addr", ":53", "DNS (TCP and UDP) address")
-	flagHTTPAddr := flag.String("http_addr", ":80", "address for HTTP (used by Let's Encrypt autocert)")
+	flagConfig := flag.String("config", "", "configuration file, reloaded on SIGHUP; flags override its values")
+	flag.Bool("dev", false, `development server, local CA is used and backup ports are opened with an 8-prefix`)
+	flag.String("dbdir", "", "spilldb database directory")
+	flag.String("debug_addr", "", "HTTP address for the debug server (do *not* expose to the public)")
+	flag.String("log_level", "info", `logging verbosity: "quiet", "info", or "debug"`)
+	flag.Duration("drain_timeout", 10*time.Minute, "time connections have to finish after a SIGUSR2 handoff to a new process")
+	flag.String("imap_hostname", hostname, "IMAP hostname")
+	flag.String("imap_addr", ":943", "IMAP address")
+	flag.String("imap_starttls_addr", "", "IMAP STARTTLS address, such as :143")
+	flag.String("smtp_hostname", hostname, "SMTP hostname")
+	flag.String("smtp_addr", ":25", "SMTP address")
+	flag.String("msa_hostname", hostname, "MSA hostname")
+	flag.String("msa_addr", ":465", "MSA (mail submission) address")
+	flag.String("msa_starttls_addr", "", "MSA STARTTLS address, such as :587")
+	flag.String("dns_hostname", hostname, "DNS hostname")
+	flag.String("dns_addr", ":53", "DNS (TCP and UDP) address")
+	flag.String("http_addr", ":80", "address for HTTP (used by Let's Encrypt autocert)")
 
 	flag.Parse()
 
+	cfg, err := readConfig(*flagConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadedCfg := *cfg // before defaults are filled in below
+
+	lns, err := inheritListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
 	filer := iox.NewFiler(0)
 
@@ -59,117 +98,364 @@ func main() {
 
 	log.Printf("spilld, version %s, starting at %s", version, time.Now())
 
-	if *flagDBDir == "" {
-		*flagDBDir = tempdir
+	if cfg.DBDir == "" {
+		cfg.DBDir = tempdir
 	}
 
+	// Listeners are served tlsConfig if it is set, otherwise
+	// getCert composed by spilldb.Server with its SMTP fallback.
 	var certManager *autocert.Manager
 	var tlsConfig *tls.Config
-	if *flagDev {
+	var getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	certs := make(certFiles)
+	if cfg.Dev {
 		log.Printf("***DEVELOPMENT MODE***")
 		tlsConfig, err = devcert.Config()
 		if err != nil {
 			log.Fatal(err)
 		}
+	} else if cfg.TLS.CertFile != "" {
+		cert, err := certs.load(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		getCert = cert.GetCertificate
 	} else {
 		var hosts []string
-		if *flagIMAPHostname != "" {
-			hosts = append(hosts, *flagIMAPHostname)
-		}
-		if *flagSMTPHostname != "" {
-			hosts = append(hosts, *flagSMTPHostname)
+		for _, l := range []listenerConfig{cfg.IMAP, cfg.SMTP, cfg.MSA} {
+			if l.Hostname != "" && l.CertFile == "" {
+				hosts = append(hosts, l.Hostname)
+			}
 		}
-		if *flagMSAHostname != "" {
-			hosts = append(hosts, *flagMSAHostname)
+		certDir := cfg.TLS.AutocertDir
+		if certDir == "" {
+			certDir = filepath.Join(cfg.DBDir, "tls_certs")
 		}
 		certManager = &autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
 			HostPolicy: autocert.HostWhitelist(hosts...),
-			Cache:      autocert.DirCache(filepath.Join(*flagDBDir, "tls_certs")),
-		}
-		// TODO: this clobbers spilldb.Server.tlsConfig,
-		// which has a necessary hack for SMTP.
-		tlsConfig = &tls.Config{
-			GetCertificate: certManager.GetCertificate,
+			Cache:      autocert.DirCache(certDir),
 		}
+		getCert = certManager.GetCertificate
+	}
+	// httpsConfig is for the HTTPS servers other than the listeners.
+	httpsConfig := tlsConfig
+	if httpsConfig == nil {
+		httpsConfig = &tls.Config{GetCertificate: getCert}
 	}
 
 	log.Printf("temp dir %s", tempdir)
 
-	s, err := spilldb.New(filer, *flagDBDir)
+	s, err := spilldb.New(filer, cfg.DBDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 	s.CertManager = certManager
-	s.Logf = log.Printf
+	s.Processor.Fidelity = cfg.Fidelity
+	s.LocalSender.Fidelity = cfg.Fidelity
+	s.Janitor.AuditRetention = cfg.AuditRetention
+	s.Webhooks.MaxAttempts = cfg.Webhooks.MaxAttempts
+	if cfg.Webhooks.Timeout != 0 {
+		s.Webhooks.Client.Timeout = cfg.Webhooks.Timeout
+	}
+	s.Deliverer.Client().MaxConnsPerHost = cfg.Outbound.MaxConnsPerHost
+	s.Deliverer.Client().IdleTimeout = cfg.Outbound.IdleTimeout
+	s.Deliverer.Client().MaxMsgsPerConn = cfg.Outbound.MaxMsgsPerConn
+	if cfg.IMAPDebug.Dir != "" {
+		s.IMAPDebug.Dir = cfg.IMAPDebug.Dir
+	}
+	s.IMAPDebug.MaxSize = int64(cfg.IMAPDebug.MaxSize)
+	s.IMAPDebug.MaxFiles = cfg.IMAPDebug.MaxFiles
+	s.IMAPDebug.Retention = cfg.IMAPDebug.Retention
+	s.IMAPCompressLevel = cfg.IMAP.CompressLevel
+	if cfg.Tracing.Endpoint != "" {
+		s.Tracer = otlptrace.NewExporter(cfg.Tracing.Endpoint)
+		if cfg.Tracing.ServiceName != "" {
+			s.Tracer.ServiceName = cfg.Tracing.ServiceName
+		}
+		s.Tracer.Logf = s.Logf
+	}
+	if n := cfg.Limits.MaxMIMEDepth; n != 0 {
+		msgcleaver.DefaultLimits.MaxDepth = n
+	}
+	if n := cfg.Limits.MaxMIMEParts; n != 0 {
+		msgcleaver.DefaultLimits.MaxParts = n
+	}
+	if n := cfg.Limits.MaxDecodedPartSize; n != 0 {
+		msgcleaver.DefaultLimits.MaxPartSize = int64(n)
+	}
+	if n := cfg.Limits.MaxDecodedMsgSize; n != 0 {
+		msgcleaver.DefaultLimits.MaxMsgSize = int64(n)
+	}
+	s.BoxMgmt.WriteTimeout = cfg.Limits.MailboxWriteTimeout
+	s.BoxMgmt.BusyTimeout = cfg.Limits.SQLiteBusyTimeout
+	if cfg.BlobKeyFile != "" {
+		if s.BoxMgmt.BlobKey, err = boxmgmt.ReadKeyFile(cfg.BlobKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	s.Deliverer.DKIMKey = s.BoxMgmt.BlobKey
+	s.DKIMRotator.MasterKey = s.BoxMgmt.BlobKey
+	s.DKIMRotator.Every = cfg.DKIM.RotateEvery
+	s.DKIMRotator.Overlap = cfg.DKIM.Overlap
+	if cfg.S3.Bucket != "" {
+		secretKey, err := ioutil.ReadFile(cfg.S3.SecretKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.BoxMgmt.ObjectStore = &s3store.Store{
+			Endpoint:    cfg.S3.Endpoint,
+			Bucket:      cfg.S3.Bucket,
+			Region:      cfg.S3.Region,
+			AccessKeyID: cfg.S3.AccessKeyID,
+			SecretKey:   strings.TrimSpace(string(secretKey)),
+		}
+		if cfg.S3.OffloadThreshold > 0 {
+			s.Offloader.Threshold = int64(cfg.S3.OffloadThreshold)
+		}
+	}
+	s.Logf = func(format string, v ...interface{}) {
+		if s.LogLevel() >= spilldb.LogInfo {
+			log.Printf(format, v...)
+		}
+	}
+	s.Limits = spilldb.Limits{
+		MaxMsgSize:      cfg.Limits.MaxMsgSize,
+		MaxSMTPSessions: cfg.Limits.MaxSMTPSessions,
+		MaxRecipients:   cfg.Limits.MaxRecipients,
+		MaxSMTPMsgs:     cfg.Limits.MaxSMTPMsgs,
+		MaxIMAPConns:    cfg.Limits.MaxIMAPConns,
+
+		MaxIMAPConnsPerUser: cfg.Limits.MaxIMAPUserConns,
+		MaxIMAPConnsPerIP:   cfg.Limits.MaxIMAPIPConns,
+
+		IMAPKeepAlive:     cfg.Limits.IMAPKeepAlive,
+		IMAPIdleHeartbeat: cfg.Limits.IMAPIdleHeartbeat,
+		IMAPAckTimeout:    cfg.Limits.IMAPAckTimeout,
 
-	var imapAddrs, smtpAddrs, msaAddrs, msaStartTLSAddrs, dnsAddrs []spilldb.ServerAddr
+		IMAPLiteralMemSize: cfg.Limits.IMAPLiteralMemSize,
+		IMAPSlowCommand:    cfg.Limits.IMAPSlowCommand,
 
-	if *flagIMAPAddr != "" {
-		ln, err := net.Listen("tcp", *flagIMAPAddr)
+		MaxLoginFailures: cfg.Limits.MaxLoginFailures,
+		MaxLoginLockout:  cfg.Limits.MaxLoginLockout,
+
+		SendDelay: cfg.Limits.SendDelay,
+	}
+	switch cfg.MSA.SenderPolicy {
+	case "", "reject":
+		s.SenderPolicy = smtpdb.SenderReject
+	case "rewrite":
+		s.SenderPolicy = smtpdb.SenderRewrite
+	default:
+		log.Fatalf("msa.sender_policy: unknown policy %q, want \"reject\" or \"rewrite\"", cfg.MSA.SenderPolicy)
+	}
+	if err := applyConfig(s, cfg); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.WebPush.KeyFile != "" {
+		key, err := webpush.LoadKey(cfg.WebPush.KeyFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		addr := spilldb.ServerAddr{
-			Hostname:  *flagIMAPHostname,
-			Ln:        ln,
-			TLSConfig: tlsConfig,
+		s.WebPush = &webpush.Sender{
+			Key:     key,
+			Subject: cfg.WebPush.Subject,
 		}
-		imapAddrs = append(imapAddrs, addr)
 	}
-	if *flagSMTPAddr != "" {
-		ln, err := net.Listen("tcp", *flagSMTPAddr)
+	var hooks deliveryhook.Chain
+	if cfg.Clamd.Addr != "" {
+		network, address, err := sockAddr(cfg.Clamd.Addr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		smtpAddrs = append(smtpAddrs, spilldb.ServerAddr{
-			Hostname:  *flagSMTPHostname,
-			Ln:        ln,
-			TLSConfig: tlsConfig,
+		clamdClient := &clamd.Client{
+			Network: network,
+			Addr:    address,
+			Timeout: cfg.Clamd.Timeout,
+		}
+		hooks = append(hooks, &virusscan.Hook{
+			Clamd:  clamdClient,
+			Reject: cfg.Clamd.Reject,
+			Logf:   s.Logf,
 		})
+		if cfg.Clamd.RescanAddr != "" {
+			rescanServer := &http.Server{
+				Addr:      cfg.Clamd.RescanAddr,
+				TLSConfig: httpsConfig,
+				Handler: &virusscan.Handler{
+					Clamd:   clamdClient,
+					BoxMgmt: s.BoxMgmt,
+					Auth: &db.Authenticator{
+						DB:      s.DB,
+						Lockout: s.Lockout,
+						Logf:    s.Logf,
+						Where:   "virusscan",
+					},
+				},
+			}
+			go func() {
+				s.Logf("virus rescan HTTPS starting on %s", cfg.Clamd.RescanAddr)
+				err := rescanServer.ListenAndServeTLS("", "")
+				if err != nil && err != http.ErrServerClosed {
+					s.Logf("virus rescan serving error: %v", err)
+				}
+			}()
+		}
+	}
+	if cfg.AppPass.Addr != "" {
+		appPassServer := &http.Server{
+			Addr:      cfg.AppPass.Addr,
+			TLSConfig: httpsConfig,
+			Handler: &apppass.Handler{
+				Auth: &db.Authenticator{
+					DB:      s.DB,
+					Lockout: s.Lockout,
+					Logf:    s.Logf,
+					Where:   "apppass",
+				},
+			},
+		}
+		go func() {
+			s.Logf("app password HTTPS starting on %s", cfg.AppPass.Addr)
+			err := appPassServer.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
+				s.Logf("app password serving error: %v", err)
+			}
+		}()
 	}
-	if *flagMSAAddr != "" {
-		ln, err := net.Listen("tcp", *flagMSAAddr)
+	if len(cfg.Hooks.Exec) > 0 {
+		for _, path := range cfg.Hooks.Exec {
+			hooks = append(hooks, &deliveryhook.Exec{
+				Path:    path,
+				Timeout: cfg.Hooks.Timeout,
+			})
+		}
+	}
+	if len(hooks) > 0 {
+		s.LocalSender.Hook = hooks
+	}
+	for _, addr := range cfg.Milter.Addrs {
+		network, address, err := sockAddr(addr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		msaAddrs = append(msaAddrs, spilldb.ServerAddr{
-			Hostname:  *flagMSAHostname,
-			Ln:        ln,
-			TLSConfig: tlsConfig,
+		s.Milters = append(s.Milters, &milter.Client{
+			Network:  network,
+			Addr:     address,
+			Timeout:  cfg.Milter.Timeout,
+			FailOpen: cfg.Milter.FailOpen,
 		})
 	}
-	if *flagDNSAddr != "" {
-		ln, err := net.Listen("tcp", *flagDNSAddr)
+	if cfg.Repl.Addr != "" || cfg.Repl.Primary != "" {
+		token, err := ioutil.ReadFile(cfg.Repl.TokenFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		pc, err := net.ListenPacket("tcp", *flagDNSAddr)
+		if cfg.Repl.Primary != "" {
+			s.Standby = replication.NewStandby(s.BoxMgmt, cfg.Repl.Primary, strings.TrimSpace(string(token)))
+			s.Standby.Logf = s.Logf
+		}
+		if cfg.Repl.Addr != "" {
+			s.BoxMgmt.Replicate = true
+			replServer := &http.Server{
+				Addr:      cfg.Repl.Addr,
+				TLSConfig: httpsConfig,
+				Handler: &replication.Handler{
+					BoxMgmt: s.BoxMgmt,
+					Token:   strings.TrimSpace(string(token)),
+				},
+			}
+			go func() {
+				s.Logf("replication HTTPS starting on %s", cfg.Repl.Addr)
+				err := replServer.ListenAndServeTLS("", "")
+				if err != nil && err != http.ErrServerClosed {
+					s.Logf("replication serving error: %v", err)
+				}
+			}()
+		}
+	}
+
+	listen := func(name string, l listenerConfig, addrs []string) (serverAddrs []spilldb.ServerAddr) {
+		netLns, err := lns.listen(name, addrs)
 		if err != nil {
 			log.Fatal(err)
 		}
+		addrTLSConfig, addrGetCert := tlsConfig, getCert
+		if l.CertFile != "" {
+			cert, err := certs.load(l.CertFile, l.KeyFile)
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			addrTLSConfig, addrGetCert = nil, cert.GetCertificate
+		}
+		for _, ln := range netLns {
+			serverAddrs = append(serverAddrs, spilldb.ServerAddr{
+				Hostname:       l.Hostname,
+				Ln:             ln,
+				TLSConfig:      addrTLSConfig,
+				GetCertificate: addrGetCert,
+			})
+		}
+		return serverAddrs
+	}
+	imapAddrs := listen("imap", cfg.IMAP, cfg.IMAP.Addrs)
+	imapStartTLSAddrs := listen("imap-starttls", cfg.IMAP, cfg.IMAP.StartTLSAddrs)
+	smtpAddrs := listen("smtp", cfg.SMTP, cfg.SMTP.Addrs)
+	msaAddrs := listen("msa", cfg.MSA, cfg.MSA.Addrs)
+	msaStartTLSAddrs := listen("msa-starttls", cfg.MSA, cfg.MSA.StartTLSAddrs)
+
+	var dnsAddrs []spilldb.ServerAddr
+	dnsLns, err := lns.listen("dns", cfg.DNS.Addrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsPCs, err := lns.listenPacket("dns-udp", cfg.DNS.Addrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(dnsLns) != len(dnsPCs) {
+		log.Fatalf("spilld: %d DNS TCP listeners and %d UDP sockets", len(dnsLns), len(dnsPCs))
+	}
+	for i := range dnsLns {
 		dnsAddrs = append(dnsAddrs, spilldb.ServerAddr{
-			Hostname: *flagDNSHostname,
-			PC:       pc,
-			Ln:       ln,
+			Hostname: cfg.DNS.Hostname,
+			PC:       dnsPCs[i],
+			Ln:       dnsLns[i],
 		})
 	}
+	lns.closeUnused()
 
 	// TODO: call debugServer.Shutdown
-	if *flagDev && *flagDebugAddr == "" {
-		*flagDebugAddr = ":1380"
+	if cfg.Dev && cfg.DebugAddr == "" {
+		cfg.DebugAddr = ":1380"
 	}
-	if *flagDebugAddr != "" {
+	if cfg.DebugAddr != "" {
 		debugMux := http.NewServeMux()
 		debugMux.HandleFunc("/debug/pprof/", pprof.Index)
 		debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 		debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		debugMux.Handle("/debug/vars", expvar.Handler())
+		debugMux.HandleFunc("/admin/unsubscribe", unsubscribeHandler(s))
+		debugMux.HandleFunc("/admin/webpush", webPushHandler(s))
+		debugMux.HandleFunc("/admin/audit", auditHandler(s))
+		debugMux.HandleFunc("/admin/bimi", bimiHandler(s))
+		debugMux.HandleFunc("/admin/imapdebug", imapDebugHandler(s))
+		debugMux.HandleFunc("/admin/undosend", undoSendHandler(s))
+		debugMux.HandleFunc("/admin/senddelay", sendDelayHandler(s))
+		debugMux.HandleFunc("/admin/unparsable", unparsableHandler(s))
+		expvar.Publish("push", expvar.Func(func() interface{} { return s.PushStats() }))
+		expvar.Publish("dnscache", expvar.Func(func() interface{} { return s.Resolver.Stats() }))
+		expvar.Publish("imap", expvar.Func(func() interface{} { return s.IMAPStats() }))
+		expvar.Publish("lockout", expvar.Func(func() interface{} { return s.Lockout.Stats() }))
+		expvar.Publish("spillbox", expvar.Func(func() interface{} { return spillbox.GetWriteStats() }))
+		expvar.Publish("smtpclient", expvar.Func(func() interface{} { return s.Deliverer.Client().PoolStats() }))
+		expvar.Publish("quarantine", expvar.Func(func() interface{} { return s.QuarantineStats() }))
 
 		debugServer := &http.Server{Handler: debugMux}
 		go func() {
-			ln, err := net.Listen("tcp", *flagDebugAddr)
+			ln, err := net.Listen("tcp", cfg.DebugAddr)
 			if err != nil {
 				s.Logf("http debug server: %s", err)
 				return
@@ -182,12 +468,12 @@ func main() {
 		}()
 	}
 
-	if *flagDev {
+	if cfg.Dev {
 		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "hi\n")
 		})
 		srv := &http.Server{
-			TLSConfig: tlsConfig,
+			TLSConfig: httpsConfig,
 			Handler:   handler,
 			Addr:      ":8443",
 		}
@@ -199,9 +485,9 @@ func main() {
 	}
 
 	// TODO: call certmanager debugServer.Shutdown
-	if certManager != nil && *flagHTTPAddr != "" {
+	if certManager != nil && cfg.HTTPAddr != "" {
 		go func() {
-			err := http.ListenAndServe(*flagHTTPAddr, certManager.HTTPHandler(nil))
+			err := http.ListenAndServe(cfg.HTTPAddr, certManager.HTTPHandler(nil))
 			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("HTTP: %v", err)
 			}
@@ -209,21 +495,41 @@ func main() {
 	}
 
 	go func() {
-		if err := s.Serve(smtpAddrs, msaAddrs, msaStartTLSAddrs, imapAddrs, dnsAddrs); err != nil {
-			s.Logf("spilldb serve error: %v", err)
+		if err := s.Serve(smtpAddrs, msaAddrs, msaStartTLSAddrs, imapAddrs, imapStartTLSAddrs, dnsAddrs); err != nil {
+			log.Printf("spilldb serve error: %v", err)
 		}
 	}()
 
+	notifyReady()
+
+	go reloadOnHangup(s, &loadedCfg, *flagConfig, certs)
+
+	// On SIGUSR2 a new process takes over the listening sockets
+	// and this one shuts down once its connections finish,
+	// so long-lived IMAP IDLE connections are not cut off.
+	// Background workers stop right away: the new process
+	// picks up pending work from the database.
+	drainTimeout := 2 * time.Second
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
-		interrupt := make(chan os.Signal, 1)
-		signal.Notify(interrupt, os.Interrupt)
-		<-interrupt
-		cancel()
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
+		for sig := range sigs {
+			if sig == syscall.SIGUSR2 {
+				if err := lns.handoff(); err != nil {
+					log.Printf("spilld: handoff: %v", err)
+					continue
+				}
+				log.Printf("spilld: handed off listeners, draining connections for %v", cfg.DrainTimeout)
+				drainTimeout = cfg.DrainTimeout
+			}
+			cancel()
+			return
+		}
 	}()
 	<-ctx.Done()
 
-	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
 
 	var wg sync.WaitGroup
@@ -239,3 +545,492 @@ func main() {
 	}
 	log.Printf("spilld: shut down")
 }
+
+// unsubscribeHandler unsubscribes a user from the mailing list of
+// a message: POST /admin/unsubscribe?user=<userID>&msg=<msgID>.
+func unsubscribeHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, err := strconv.ParseInt(r.FormValue("user"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad user ID", http.StatusBadRequest)
+			return
+		}
+		msgID, err := strconv.ParseInt(r.FormValue("msg"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad message ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.Unsubscribe(r.Context(), userID, email.MsgID(msgID)); err != nil {
+			s.Logf("unsubscribe user %d msg %d: %v", userID, msgID, err)
+			code := http.StatusInternalServerError
+			if err == spilldb.ErrNoUnsubscribe {
+				code = http.StatusUnprocessableEntity
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		fmt.Fprintf(w, "unsubscribed\n")
+	}
+}
+
+// webPushHandler registers browsers for Web Push notifications.
+// GET /admin/webpush reports the VAPID applicationServerKey
+// browsers subscribe with.
+// POST /admin/webpush?user=<userID>&mailbox=<name> registers the
+// PushSubscription JSON of the request body. The mailbox defaults
+// to INBOX.
+func webPushHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.WebPush == nil {
+			http.Error(w, spilldb.ErrNoWebPush.Error(), http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				ApplicationServerKey string `json:"applicationServerKey"`
+			}{s.WebPush.PublicKey()})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, err := strconv.ParseInt(r.FormValue("user"), 10, 64)
+		if err != nil || userID <= 0 {
+			http.Error(w, "bad user ID", http.StatusBadRequest)
+			return
+		}
+		mailbox := r.FormValue("mailbox")
+		if mailbox == "" {
+			mailbox = "INBOX"
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub, err := webpush.ParseSubscription(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.RegisterWebPush(r.Context(), userID, mailbox, sub); err != nil {
+			s.Logf("webpush register user %d: %v", userID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "registered\n")
+	}
+}
+
+// auditHandler reports AuditLog entries as JSON:
+// GET /admin/audit?user=<userID>&event=<event>&since=<duration>&limit=<n>.
+// All parameters are optional.
+func auditHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var q db.AuditQuery
+		var err error
+		if v := r.FormValue("user"); v != "" {
+			if q.UserID, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, "bad user ID", http.StatusBadRequest)
+				return
+			}
+		}
+		q.Event = db.AuditEvent(r.FormValue("event"))
+		if v := r.FormValue("since"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "bad since duration", http.StatusBadRequest)
+				return
+			}
+			q.Since = time.Now().Add(-d)
+		}
+		if v := r.FormValue("limit"); v != "" {
+			if q.Limit, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "bad limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		conn := s.DB.Get(r.Context())
+		if conn == nil {
+			return
+		}
+		entries, err := db.FindAudit(conn, q)
+		s.DB.Put(conn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(entries)
+	}
+}
+
+// bimiHandler reports, as JSON, what a sending domain has to publish
+// for receivers to show its BIMI logo: GET /admin/bimi?domain=<domain>.
+// The record and logo are set with the spillbox bimi command.
+func bimiHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain := r.FormValue("domain")
+		if domain == "" {
+			http.Error(w, "missing domain", http.StatusBadRequest)
+			return
+		}
+		conn := s.DB.Get(r.Context())
+		if conn == nil {
+			return
+		}
+		rec, logo, err := db.FindBIMI(conn, domain)
+		s.DB.Put(conn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rec == nil {
+			http.Error(w, "no BIMI record for "+domain, http.StatusNotFound)
+			return
+		}
+		lookupTXT := func(ctx context.Context, name string) ([]string, error) {
+			txts, _, err := s.Resolver.LookupTXT(ctx, name)
+			return txts, err
+		}
+		g := bimi.Check(r.Context(), lookupTXT, rec, logo)
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(g)
+	}
+}
+
+// imapDebugHandler controls the capture of IMAP transcripts.
+//
+//	GET    /admin/imapdebug lists the users and sessions captured
+//	POST   /admin/imapdebug?user=<userID>&for=<duration> captures a user
+//	POST   /admin/imapdebug?session=<sessionID>&for=<duration> captures a session
+//	DELETE /admin/imapdebug?user=<userID> or ?session=<sessionID> stops
+//
+// Capture lasts an hour if for is not given.
+func imapDebugHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "\t")
+			enc.Encode(s.IMAPDebug.Enabled())
+			return
+		}
+		if r.Method != "POST" && r.Method != "DELETE" {
+			http.Error(w, "GET, POST, or DELETE required", http.StatusMethodNotAllowed)
+			return
+		}
+		var userID int64
+		if v := r.FormValue("user"); v != "" {
+			var err error
+			if userID, err = strconv.ParseInt(v, 10, 64); err != nil || userID <= 0 {
+				http.Error(w, "bad user ID", http.StatusBadRequest)
+				return
+			}
+		}
+		sessionID := r.FormValue("session")
+		if (userID == 0) == (sessionID == "") {
+			http.Error(w, "one of user or session required", http.StatusBadRequest)
+			return
+		}
+		d := time.Hour
+		if v := r.FormValue("for"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+				http.Error(w, "bad for duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch {
+		case r.Method == "DELETE" && userID != 0:
+			s.IMAPDebug.DisableUser(userID)
+		case r.Method == "DELETE":
+			s.IMAPDebug.DisableSession(sessionID)
+		case userID != 0:
+			s.IMAPDebug.EnableUser(userID, d)
+		default:
+			s.IMAPDebug.EnableSession(sessionID, d)
+		}
+		s.Logf("spilld: imap debug capture %s user=%d session=%q for %v", r.Method, userID, sessionID, d)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// undoSendHandler lists and cancels mail held for the undo send window.
+//
+//	GET  /admin/undosend?user=<userID> lists the held messages as JSON
+//	POST /admin/undosend?user=<userID>&msg=<stagingID> cancels one
+//
+// A cancelled message is put in the user's Drafts mailbox.
+// The user is optional for GET.
+func undoSendHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userID int64
+		if v := r.FormValue("user"); v != "" {
+			var err error
+			if userID, err = strconv.ParseInt(v, 10, 64); err != nil || userID <= 0 {
+				http.Error(w, "bad user ID", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == "GET" {
+			conn := s.DB.Get(r.Context())
+			if conn == nil {
+				return
+			}
+			msgs, err := db.HeldMsgs(conn, userID)
+			s.DB.Put(conn)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "\t")
+			enc.Encode(msgs)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if userID == 0 {
+			http.Error(w, "missing user ID", http.StatusBadRequest)
+			return
+		}
+		stagingID, err := strconv.ParseInt(r.FormValue("msg"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad message ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.CancelSend(r.Context(), userID, stagingID); err != nil {
+			code := http.StatusInternalServerError
+			if err == db.ErrNotHeld {
+				code = http.StatusConflict
+			} else {
+				s.Logf("cancel send user %d msg %d: %v", userID, stagingID, err)
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		fmt.Fprintf(w, "cancelled\n")
+	}
+}
+
+// sendDelayHandler sets the undo send window of a user:
+// POST /admin/senddelay?user=<userID>&delay=<duration>.
+// A delay of "default" gives the user the limits.send_delay
+// of the server, "0s" sends their mail at once.
+func sendDelayHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, err := strconv.ParseInt(r.FormValue("user"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad user ID", http.StatusBadRequest)
+			return
+		}
+		delay := time.Duration(-1)
+		if v := r.FormValue("delay"); v != "default" {
+			if delay, err = time.ParseDuration(v); err != nil || delay < 0 {
+				http.Error(w, "bad delay", http.StatusBadRequest)
+				return
+			}
+		}
+		conn := s.DB.Get(r.Context())
+		if conn == nil {
+			return
+		}
+		err = db.SetSendDelay(conn, userID, delay)
+		s.DB.Put(conn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// unparsableHandler lists and reparses the incoming messages that
+// are quarantined because they could not be parsed.
+//
+//	GET  /admin/unparsable?user=<userID> lists them as JSON
+//	POST /admin/unparsable?msg=<stagingID> reparses one
+//	POST /admin/unparsable?user=<userID> reparses those of a user
+//
+// The user is optional. A POST with neither reparses every message.
+func unparsableHandler(s *spilldb.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userID int64
+		if v := r.FormValue("user"); v != "" {
+			var err error
+			if userID, err = strconv.ParseInt(v, 10, 64); err != nil || userID <= 0 {
+				http.Error(w, "bad user ID", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method == "GET" {
+			conn := s.DB.Get(r.Context())
+			if conn == nil {
+				return
+			}
+			msgs, err := db.QuarantinedMsgs(conn, userID)
+			s.DB.Put(conn)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "\t")
+			enc.Encode(msgs)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if v := r.FormValue("msg"); v != "" {
+			stagingID, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "bad message ID", http.StatusBadRequest)
+				return
+			}
+			ok, err := s.ReparseMsg(r.Context(), stagingID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "still unparsable", http.StatusConflict)
+				return
+			}
+			fmt.Fprintf(w, "released\n")
+			return
+		}
+		released, failed, err := s.Reparse(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.Logf("spilld: reparse user=%d: %d released, %d unparsable", userID, released, failed)
+		fmt.Fprintf(w, "%d released, %d unparsable\n", released, failed)
+	}
+}
+
+// readConfig builds the configuration from the flag defaults,
+// the configuration file at path if there is one, and the flags
+// set on the command line, in increasing order of precedence.
+func readConfig(path string) (*config, error) {
+	cfg := new(config)
+	var err error
+	setFlag := func(f *flag.Flag) {
+		if err == nil {
+			err = cfg.setFlag(f)
+		}
+	}
+	flag.VisitAll(setFlag)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := cfg.load(path); err != nil {
+			return nil, err
+		}
+	}
+	flag.Visit(setFlag)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyConfig applies the values of cfg that can change at runtime.
+func applyConfig(s *spilldb.Server, cfg *config) error {
+	level, err := spilldb.ParseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	var apnsCert *tls.Certificate
+	if cfg.APNS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.APNS.CertFile, cfg.APNS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("APNS: %v", err)
+		}
+		apnsCert = &cert
+	}
+	rateLimit, err := outboundRateLimit(cfg.Outbound)
+	if err != nil {
+		return err
+	}
+	s.SetLogLevel(level)
+	s.SetRateLimit(cfg.Limits.SMTPMsgsPerHour)
+	s.Deliverer.SetRateLimit(rateLimit)
+	return s.SetAPNSCert(apnsCert)
+}
+
+// outboundRateLimit parses the outbound rate limits of cfg.
+func outboundRateLimit(cfg outboundConfig) (rl deliverer.RateLimit, err error) {
+	rl.MsgsPerHour = cfg.DomainMsgsPerHour
+	rl.DomainLimits = make(map[string]int)
+	for _, v := range cfg.DomainLimits {
+		i := strings.IndexByte(v, '=')
+		if i < 0 {
+			return rl, fmt.Errorf("outbound.domain_limits: %q is not domain=limit", v)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(v[i+1:]))
+		if err != nil {
+			return rl, fmt.Errorf("outbound.domain_limits: %q: %v", v, err)
+		}
+		rl.DomainLimits[strings.TrimSpace(v[:i])] = limit
+	}
+	if cfg.WarmupMsgsPerHour > 0 {
+		start, err := time.ParseInLocation("2006-01-02", cfg.WarmupStart, time.Local)
+		if err != nil {
+			return rl, fmt.Errorf("outbound.warmup_start: %v", err)
+		}
+		rl.Warmup = deliverer.Warmup{Start: start, MsgsPerHour: cfg.WarmupMsgsPerHour}
+	}
+	return rl, nil
+}
+
+// reloadOnHangup rereads the certificate files and, if there is
+// one, the configuration file at path on SIGHUP.
+func reloadOnHangup(s *spilldb.Server, cfg *config, path string, certs certFiles) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		certs.reload(log.Printf)
+		if path == "" {
+			log.Printf("spilld: reloaded certificates")
+			continue
+		}
+		newCfg, err := readConfig(path)
+		if err != nil {
+			log.Printf("spilld: reload: %v", err)
+			continue
+		}
+		if err := applyConfig(s, newCfg); err != nil {
+			log.Printf("spilld: reload: %v", err)
+			continue
+		}
+		if cfg.restartNeeded(newCfg) {
+			log.Printf("spilld: reload: some changes take effect after a restart")
+		}
+		log.Printf("spilld: reloaded %s, log level %s", path, s.LogLevel())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runIMAPClient behaves like a mail client left open on INBOX
+// until ctx is done, reconnecting after errors.
+func runIMAPClient(ctx context.Context, cfg *config, user credentials, stats *stats) {
+	for ctx.Err() == nil {
+		if err := imapSession(ctx, cfg, user, stats); err != nil && ctx.Err() == nil {
+			pause(ctx, 1*time.Second)
+		}
+	}
+}
+
+func imapSession(ctx context.Context, cfg *config, user credentials, stats *stats) error {
+	start := time.Now()
+	c, err := dialIMAP(ctx, cfg.imapAddr, cfg.tlsConfig)
+	stats.record(ctx, "imap connect", start, err)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	// Unblock any read or write when the run ends.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	start = time.Now()
+	err = c.cmd("LOGIN " + quote(user.username) + " " + quote(user.password))
+	stats.record(ctx, "imap login", start, err)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	err = c.cmd("SELECT INBOX")
+	stats.record(ctx, "imap select", start, err)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := c.idle(ctx, cfg.fetchInterval, stats); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		start = time.Now()
+		err = c.fetch(cfg.fetchCount)
+		stats.record(ctx, "imap fetch", start, err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type imapClient struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	partial []byte // line read before a timeout
+	tag     int
+	exists  int // messages in the selected mailbox
+}
+
+func dialIMAP(ctx context.Context, addr string, tlsConfig *tls.Config) (*imapClient, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	tcpConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	conn := tls.Client(tcpConn, tlsConfig)
+	c := &imapClient{
+		conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("imap: bad greeting: %q", greeting)
+	}
+	return c, nil
+}
+
+func (c *imapClient) write(format string, v ...interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := fmt.Fprintf(c.conn, format, v...)
+	return err
+}
+
+// cmd sends cmd and reads its responses, reporting an error unless
+// the command completes with OK.
+func (c *imapClient) cmd(cmd string) error {
+	c.tag++
+	tag := "L" + strconv.Itoa(c.tag)
+	if err := c.write("%s %s\r\n", tag, cmd); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+	return c.readUntil(tag, cmd)
+}
+
+func (c *imapClient) readUntil(tag, cmd string) error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			if status := line[len(tag)+1:]; !strings.HasPrefix(status, "OK") {
+				if i := strings.IndexByte(cmd, ' '); i >= 0 {
+					cmd = cmd[:i]
+				}
+				return fmt.Errorf("imap: %s: %s", cmd, status)
+			}
+			return nil
+		}
+		c.untagged(line)
+	}
+}
+
+var existsResponse = regexp.MustCompile(`^\* ([0-9]+) EXISTS`)
+
+func (c *imapClient) untagged(line string) {
+	if m := existsResponse.FindStringSubmatch(line); m != nil {
+		c.exists, _ = strconv.Atoi(m[1])
+	}
+}
+
+// idle waits in IDLE for d or until ctx is done.
+// The time taken to end IDLE is recorded.
+func (c *imapClient) idle(ctx context.Context, d time.Duration, stats *stats) error {
+	c.tag++
+	tag := "L" + strconv.Itoa(c.tag)
+	start := time.Now()
+	if err := c.write("%s IDLE\r\n", tag); err != nil {
+		stats.record(ctx, "imap idle", start, err)
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	line, err := c.readLine()
+	if err == nil && !strings.HasPrefix(line, "+") {
+		err = fmt.Errorf("imap: IDLE: %s", line)
+	}
+	stats.record(ctx, "imap idle", start, err)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now().Add(d)
+	for time.Now().Before(end) && ctx.Err() == nil {
+		c.conn.SetReadDeadline(end)
+		line, err := c.readLine()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return err
+		}
+		c.untagged(line)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	start = time.Now()
+	if err := c.write("DONE\r\n"); err != nil {
+		stats.record(ctx, "imap done", start, err)
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+	err = c.readUntil(tag, "IDLE")
+	stats.record(ctx, "imap done", start, err)
+	return err
+}
+
+// fetch fetches the summaries of the newest messages, as a client
+// does to fill its message list.
+func (c *imapClient) fetch(count int) error {
+	if c.exists == 0 {
+		return c.cmd("NOOP")
+	}
+	first := c.exists - count + 1
+	if first < 1 {
+		first = 1
+	}
+	return c.cmd(fmt.Sprintf("FETCH %d:* (UID FLAGS INTERNALDATE RFC822.SIZE ENVELOPE BODY.PEEK[HEADER.FIELDS (REFERENCES)])", first))
+}
+
+var literalSuffix = regexp.MustCompile(`\{([0-9]+)\}\r\n$`)
+
+// readLine reads a response line, along with any literals and the
+// lines that follow them. The final CRLF is removed.
+//
+// If the read times out, the part of the line read so far is kept
+// for the next call.
+func (c *imapClient) readLine() (string, error) {
+	res := c.partial
+	c.partial = nil
+	for {
+		line, err := c.br.ReadBytes('\n')
+		res = append(res, line...)
+		if err != nil {
+			c.partial = res
+			return "", err
+		}
+		m := literalSuffix.FindSubmatch(line)
+		if m == nil {
+			break
+		}
+		n, err := strconv.Atoi(string(m[1]))
+		if err != nil {
+			return "", err
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.br, literal); err != nil {
+			// Not a timeout, the line cannot be resumed.
+			return "", fmt.Errorf("imap: reading literal: %v", err)
+		}
+		res = append(res, literal...)
+	}
+	return strings.TrimSuffix(string(res), "\r\n"), nil
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// runSMTPSender delivers a message every cfg.sendInterval until
+// ctx is done, each on a new connection as another MTA would.
+func runSMTPSender(ctx context.Context, cfg *config, sender int, stats *stats) {
+	for n := 0; ctx.Err() == nil; n++ {
+		msg := genMsg(cfg, sender, n)
+		start := time.Now()
+		err := sendMsg(ctx, cfg, msg, stats)
+		stats.record(ctx, "smtp send", start, err)
+		pause(ctx, cfg.sendInterval)
+	}
+}
+
+func sendMsg(ctx context.Context, cfg *config, msg []byte, stats *stats) error {
+	start := time.Now()
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.smtpAddr)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	}
+	var c *smtp.Client
+	host, _, _ := net.SplitHostPort(cfg.smtpAddr)
+	if err == nil {
+		c, err = smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+		}
+	}
+	stats.record(ctx, "smtp connect", start, err)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err := c.Hello("spilldload.localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := cfg.tlsConfig.Clone()
+		tlsConfig.ServerName = host
+		start := time.Now()
+		err := c.StartTLS(tlsConfig)
+		stats.record(ctx, "smtp starttls", start, err)
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(cfg.rcpt); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// genMsg generates a plain text message of about cfg.msgSize bytes.
+func genMsg(cfg *config, sender, n int) []byte {
+	buf := new(bytes.Buffer)
+	id := make([]byte, 12)
+	rand.Read(id)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "From: spilldload <%s>\r\n", cfg.from)
+	fmt.Fprintf(buf, "To: <%s>\r\n", cfg.rcpt)
+	fmt.Fprintf(buf, "Subject: spilldload sender %d message %d\r\n", sender, n)
+	fmt.Fprintf(buf, "Message-ID: <%s@spilldload.localhost>\r\n", base64.RawURLEncoding.EncodeToString(id))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=us-ascii\r\n")
+	fmt.Fprintf(buf, "\r\n")
+
+	// Random words, so messages do not compress or deduplicate.
+	line := make([]byte, 0, 80)
+	word := make([]byte, 6)
+	for buf.Len() < cfg.msgSize {
+		rand.Read(word)
+		line = append(line, base64.RawURLEncoding.EncodeToString(word)...)
+		line = append(line, ' ')
+		if len(line) > 70 {
+			buf.Write(line)
+			buf.WriteString("\r\n")
+			line = line[:0]
+		}
+	}
+	buf.Write(line)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,220 @@
+// The spilldload command generates synthetic load against a running spilld.
+//
+// It simulates IMAP clients that log in, SELECT INBOX, and then
+// alternate between IDLE and a FETCH of the newest messages,
+// along with SMTP senders delivering messages to the server.
+// When it finishes it reports the latency of each operation and
+// its error rate.
+//
+// Usage:
+//
+//	spilldload [flags] -user name -pass password -rcpt addr
+//
+// For example:
+//
+//	spilldload -imap_addr mail.example.com:943 -smtp_addr mail.example.com:25 \
+//		-user alice@example.com -pass aaaabbbbccccdddd \
+//		-rcpt alice@example.com -imap_clients 200 -smtp_senders 5 -duration 5m
+//
+// Use -insecure against development servers using a local CA.
+// The -users flag names a file of "username password" lines. IMAP
+// clients are spread across the users in it.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+type config struct {
+	imapAddr      string
+	smtpAddr      string
+	tlsConfig     *tls.Config
+	users         []credentials
+	imapClients   int
+	fetchInterval time.Duration
+	fetchCount    int
+	smtpSenders   int
+	sendInterval  time.Duration
+	from          string
+	rcpt          string
+	msgSize       int
+	ramp          time.Duration
+}
+
+type credentials struct {
+	username string
+	password string
+}
+
+func main() {
+	log.SetFlags(0)
+	flagIMAPAddr := flag.String("imap_addr", "localhost:943", "IMAP (TLS) address of the server")
+	flagSMTPAddr := flag.String("smtp_addr", "localhost:25", "SMTP address of the server")
+	flagInsecure := flag.Bool("insecure", false, "do not verify server certificates")
+	flagUser := flag.String("user", "", "IMAP username")
+	flagPass := flag.String("pass", "", "IMAP password")
+	flagUsers := flag.String("users", "", `file of "username password" lines, used instead of -user and -pass`)
+	flagIMAPClients := flag.Int("imap_clients", 10, "number of concurrent IMAP clients")
+	flagFetchInterval := flag.Duration("fetch_interval", 30*time.Second, "time each IMAP client spends in IDLE between FETCHes")
+	flagFetchCount := flag.Int("fetch_count", 20, "number of the newest messages each FETCH asks for")
+	flagSMTPSenders := flag.Int("smtp_senders", 1, "number of concurrent SMTP senders")
+	flagSendInterval := flag.Duration("send_interval", 1*time.Second, "time between messages from each SMTP sender")
+	flagFrom := flag.String("from", "spilldload@example.com", "SMTP envelope sender")
+	flagRcpt := flag.String("rcpt", "", "SMTP envelope recipient, a user of the server")
+	flagMsgSize := flag.Int("msg_size", 4<<10, "approximate size of each message sent, in bytes")
+	flagDuration := flag.Duration("duration", 1*time.Minute, "how long to generate load")
+	flagRamp := flag.Duration("ramp", 10*time.Second, "time over which clients are started")
+	flagReport := flag.Duration("report_interval", 10*time.Second, "time between progress reports, 0 for none")
+	flag.Parse()
+
+	cfg := &config{
+		imapAddr:      *flagIMAPAddr,
+		smtpAddr:      *flagSMTPAddr,
+		tlsConfig:     &tls.Config{InsecureSkipVerify: *flagInsecure},
+		imapClients:   *flagIMAPClients,
+		fetchInterval: *flagFetchInterval,
+		fetchCount:    *flagFetchCount,
+		smtpSenders:   *flagSMTPSenders,
+		sendInterval:  *flagSendInterval,
+		from:          *flagFrom,
+		rcpt:          *flagRcpt,
+		msgSize:       *flagMsgSize,
+		ramp:          *flagRamp,
+	}
+	if *flagUsers != "" {
+		var err error
+		cfg.users, err = readUsers(*flagUsers)
+		if err != nil {
+			log.Fatalf("spilldload: %v", err)
+		}
+	} else if *flagUser != "" {
+		cfg.users = []credentials{{*flagUser, *flagPass}}
+	}
+	if cfg.imapClients > 0 && len(cfg.users) == 0 {
+		log.Fatal("spilldload: IMAP clients need -user and -pass, or -users")
+	}
+	if cfg.smtpSenders > 0 && cfg.rcpt == "" {
+		log.Fatal("spilldload: SMTP senders need -rcpt")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *flagDuration)
+	defer cancel()
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt)
+		<-sigCh
+		log.Print("spilldload: interrupted, stopping")
+		cancel()
+	}()
+
+	stats := newStats()
+	start := time.Now()
+	if *flagReport > 0 {
+		go func() {
+			t := time.NewTicker(*flagReport)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+				log.Printf("%s: %s", time.Since(start).Round(time.Second), stats.progress())
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	clients := cfg.imapClients + cfg.smtpSenders
+	for i := 0; i < cfg.imapClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if !rampWait(ctx, cfg.ramp, i, clients) {
+				return
+			}
+			runIMAPClient(ctx, cfg, cfg.users[i%len(cfg.users)], stats)
+		}(i)
+	}
+	for i := 0; i < cfg.smtpSenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if !rampWait(ctx, cfg.ramp, cfg.imapClients+i, clients) {
+				return
+			}
+			runSMTPSender(ctx, cfg, i, stats)
+		}(i)
+	}
+	wg.Wait()
+
+	fmt.Printf("%d IMAP clients, %d SMTP senders, %s\n\n", cfg.imapClients, cfg.smtpSenders, time.Since(start).Round(time.Second))
+	if err := stats.report(os.Stdout); err != nil {
+		log.Fatalf("spilldload: %v", err)
+	}
+}
+
+// rampWait spreads the start of n clients evenly over ramp.
+// It reports false if ctx is done first.
+func rampWait(ctx context.Context, ramp time.Duration, i, n int) bool {
+	if ramp <= 0 || n <= 1 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(ramp * time.Duration(i) / time.Duration(n))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// pause waits for d, or reports false if ctx is done first.
+func pause(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func readUsers(path string) (users []credentials, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"username password\"", path, lineNum)
+		}
+		users = append(users, credentials{fields[0], fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users", path)
+	}
+	return users, nil
+}
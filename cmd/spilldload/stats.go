@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stats collects the latency and errors of each operation.
+type stats struct {
+	mu  sync.Mutex
+	ops map[string]*histogram
+}
+
+func newStats() *stats {
+	return &stats{ops: make(map[string]*histogram)}
+}
+
+// record adds an operation that started at start.
+// Errors caused by the end of the run are not counted.
+func (s *stats) record(ctx context.Context, op string, start time.Time, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	d := time.Since(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.ops[op]
+	if h == nil {
+		h = new(histogram)
+		s.ops[op] = h
+	}
+	if err != nil {
+		h.errors++
+		h.lastErr = err.Error()
+		return
+	}
+	h.add(d)
+}
+
+func (s *stats) names() []string {
+	var names []string
+	for name := range s.ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// progress summarizes the operations so far on one line.
+func (s *stats) progress() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var parts []string
+	for _, name := range s.names() {
+		h := s.ops[name]
+		parts = append(parts, fmt.Sprintf("%s %d/%d err p50 %s", name, h.errors, h.count+h.errors, h.quantile(0.5)))
+	}
+	if len(parts) == 0 {
+		return "no operations"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *stats) report(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Op\tCount\tErrors\tErr%%\tMin\tp50\tp90\tp99\tMax\t\n")
+	for _, name := range s.names() {
+		h := s.ops[name]
+		errPct := 0.0
+		if total := h.count + h.errors; total > 0 {
+			errPct = 100 * float64(h.errors) / float64(total)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%s\t%s\t%s\t%s\t%s\t\n",
+			name, h.count, h.errors, errPct,
+			h.min.Round(time.Microsecond), h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.max.Round(time.Microsecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, name := range s.names() {
+		if h := s.ops[name]; h.lastErr != "" {
+			fmt.Fprintf(w, "\n%s error: %s", name, h.lastErr)
+		}
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// numBuckets covers latencies up to a minute.
+// Bucket i holds latencies under 2^i * 100µs.
+const numBuckets = 20
+
+const bucketBase = 100 * time.Microsecond
+
+// histogram is a latency histogram with exponential buckets.
+type histogram struct {
+	buckets [numBuckets + 1]int // last bucket holds the overflow
+	count   int
+	errors  int
+	min     time.Duration
+	max     time.Duration
+	lastErr string // most recent error
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := 0
+	for i < numBuckets && d >= bucketBase<<uint(i) {
+		i++
+	}
+	h.buckets[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+}
+
+// quantile reports an upper bound on the latency of the q quantile.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	n := 0
+	for i, c := range h.buckets {
+		n += c
+		if n >= rank {
+			if i == numBuckets {
+				return h.max
+			}
+			if bound := bucketBase << uint(i); bound < h.max {
+				return bound
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
@@ -1,7 +1,79 @@
 package email
 
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
 // Address is an email address.
 type Address struct {
 	Name string // proper name, may be empty
 	Addr string // user@domain
 }
+
+// CheckAddrSpec reports whether addr is a plain addr-spec,
+// RFC 5322 section 3.4.1, as used in an SMTP envelope or a
+// mailto URI: a dot-atom local part, "@", and a domain name.
+//
+// Quoted local parts, domain literals, comments, and white
+// space, including CR and LF, are rejected. Non-ASCII UTF-8
+// is allowed in both parts, RFC 6532.
+func CheckAddrSpec(addr string) error {
+	if len(addr) > 254 {
+		return fmt.Errorf("email: address is %d bytes, more than 254", len(addr))
+	}
+	if !utf8.ValidString(addr) {
+		return fmt.Errorf("email: address %q is not valid UTF-8", addr)
+	}
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return fmt.Errorf("email: address %q has no domain", addr)
+	}
+	local, domain := addr[:i], addr[i+1:]
+	if len(local) > 64 {
+		return fmt.Errorf("email: address %q local part is more than 64 bytes", addr)
+	}
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return fmt.Errorf("email: address %q has a bad local part", addr)
+		}
+		for _, r := range atom {
+			if !isAtext(r) {
+				return fmt.Errorf("email: address %q has a bad local part", addr)
+			}
+		}
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("email: address %q has a bad domain", addr)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("email: address %q has a bad domain", addr)
+		}
+		for _, r := range label {
+			if !isLetDig(r) && r != '-' {
+				return fmt.Errorf("email: address %q has a bad domain", addr)
+			}
+		}
+	}
+	return nil
+}
+
+// isAtext reports whether r is an atext character, RFC 5322
+// section 3.2.3, extended with non-ASCII characters by RFC 6532.
+func isAtext(r rune) bool {
+	if r >= utf8.RuneSelf {
+		return unicode.IsGraphic(r) && !unicode.IsSpace(r)
+	}
+	return isLetDig(r) || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+func isLetDig(r rune) bool {
+	if r >= utf8.RuneSelf {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+	}
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
@@ -0,0 +1,50 @@
+package email
+
+import "testing"
+
+func TestCheckAddrSpec(t *testing.T) {
+	valid := []string{
+		"user@example.com",
+		"list-request+unsub@lists.example.org",
+		"a.b.c@xn--bcher-kva.example",
+		"o'neil@example.com",
+		"用户@例子.广告",
+	}
+	for _, addr := range valid {
+		if err := CheckAddrSpec(addr); err != nil {
+			t.Errorf("CheckAddrSpec(%q): %v", addr, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"user",
+		"user@",
+		"@example.com",
+		"user@localhost",
+		"user@example.com\r\nBcc: victim@example.com",
+		"user@example.com\nSubject: x",
+		"us\rer@example.com",
+		"user @example.com",
+		"<user@example.com>",
+		"User <user@example.com>",
+		"\"quoted\"@example.com",
+		"user@[192.0.2.1]",
+		"user(comment)@example.com",
+		".user@example.com",
+		"us..er@example.com",
+		"user.@example.com",
+		"user@example..com",
+		"user@-example.com",
+		"user@example.com.",
+		"user@exa_mple.com",
+		"a@b@example.com",
+		"user@example.com,other@example.com",
+		"\xffuser@example.com",
+	}
+	for _, addr := range invalid {
+		if err := CheckAddrSpec(addr); err == nil {
+			t.Errorf("CheckAddrSpec(%q) succeeded", addr)
+		}
+	}
+}
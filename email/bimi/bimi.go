@@ -0,0 +1,294 @@
+// Package bimi implements the sending side of Brand Indicators for
+// Message Identification, which lets receivers show a brand logo
+// next to mail that passes DMARC.
+//
+// A domain publishes a TXT record at <selector>._bimi.<domain>
+// pointing to its logo, an SVG in the SVG Tiny Portable/Secure
+// profile. Signed mail names the selector in a BIMI-Selector header.
+//
+// Receivers only show the logo if the domain has a DMARC policy of
+// quarantine or reject, and some require a Verified Mark Certificate
+// at the record's authority URL.
+package bimi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultSelector is the selector receivers use
+// for mail without a BIMI-Selector header.
+const DefaultSelector = "default"
+
+// MaxLogoSize is the largest logo receivers are expected to fetch.
+const MaxLogoSize = 32 << 10
+
+// Record is the BIMI DNS record of a domain.
+type Record struct {
+	Domain       string
+	Selector     string // DefaultSelector if empty
+	LogoURL      string // l=, HTTPS URL of the SVG logo
+	AuthorityURL string // a=, HTTPS URL of the VMC PEM file, optional
+}
+
+func (r *Record) selector() string {
+	if r.Selector == "" {
+		return DefaultSelector
+	}
+	return r.Selector
+}
+
+// Name is the DNS name the record is published at.
+func (r *Record) Name() string {
+	return r.selector() + "._bimi." + r.Domain
+}
+
+// TXT is the value of the record's TXT entry.
+func (r *Record) TXT() string {
+	txt := "v=BIMI1; l=" + r.LogoURL + ";"
+	if r.AuthorityURL != "" {
+		txt += " a=" + r.AuthorityURL + ";"
+	}
+	return txt
+}
+
+// SelectorHeader is the value of the BIMI-Selector header
+// added to mail signed for the record's domain.
+func (r *Record) SelectorHeader() string {
+	return "v=BIMI1; s=" + r.selector() + ";"
+}
+
+// Validate checks the fields of a record.
+func (r *Record) Validate() error {
+	if r.Domain == "" {
+		return errors.New("bimi: no domain")
+	}
+	for _, c := range r.selector() {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return fmt.Errorf("bimi: bad selector %q", r.Selector)
+		}
+	}
+	if err := checkURL("logo", r.LogoURL); err != nil {
+		return err
+	}
+	if r.AuthorityURL != "" {
+		if err := checkURL("authority", r.AuthorityURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkURL(name, v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return fmt.Errorf("bimi: %s URL: %v", name, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("bimi: %s URL %q is not https", name, v)
+	}
+	if strings.ContainsAny(v, "; ") {
+		return fmt.Errorf("bimi: %s URL %q cannot be put in a record", name, v)
+	}
+	return nil
+}
+
+// forbidden are the SVG elements the Tiny PS profile excludes:
+// scripts, animation, multimedia, and external content.
+var forbidden = map[string]bool{
+	"script":           true,
+	"animate":          true,
+	"animateColor":     true,
+	"animateMotion":    true,
+	"animateTransform": true,
+	"set":              true,
+	"audio":            true,
+	"video":            true,
+	"image":            true,
+	"foreignObject":    true,
+	"a":                true,
+}
+
+const svgNS = "http://www.w3.org/2000/svg"
+
+// ValidateLogo checks that an SVG logo meets the SVG Tiny
+// Portable/Secure profile required by BIMI, and that it is
+// square so receivers can display it.
+func ValidateLogo(svg []byte) error {
+	if len(svg) > MaxLogoSize {
+		return fmt.Errorf("bimi: logo is %d bytes, more than %d", len(svg), MaxLogoSize)
+	}
+	d := xml.NewDecoder(bytes.NewReader(svg))
+	depth := 0
+	hasTitle := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("bimi: logo: %v", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if err := checkRoot(tok); err != nil {
+					return err
+				}
+			}
+			if depth == 2 && tok.Name.Local == "title" {
+				hasTitle = true
+			}
+			if forbidden[tok.Name.Local] {
+				return fmt.Errorf("bimi: logo: <%s> is not allowed", tok.Name.Local)
+			}
+			for _, attr := range tok.Attr {
+				if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") {
+					return fmt.Errorf("bimi: logo: event attribute %s is not allowed", attr.Name.Local)
+				}
+				if attr.Name.Local == "href" && !strings.HasPrefix(attr.Value, "#") {
+					return fmt.Errorf("bimi: logo: external reference %q is not allowed", attr.Value)
+				}
+			}
+		case xml.EndElement:
+			depth--
+		case xml.Directive:
+			if bytes.Contains(tok, []byte("ENTITY")) {
+				return errors.New("bimi: logo: entity declarations are not allowed")
+			}
+		}
+	}
+	if depth != 0 {
+		return errors.New("bimi: logo: truncated")
+	}
+	if !hasTitle {
+		return errors.New("bimi: logo: missing <title>")
+	}
+	return nil
+}
+
+func checkRoot(root xml.StartElement) error {
+	if root.Name.Local != "svg" || root.Name.Space != svgNS {
+		return errors.New("bimi: logo: not an SVG document")
+	}
+	var version, baseProfile, viewBox string
+	for _, attr := range root.Attr {
+		switch attr.Name.Local {
+		case "version":
+			version = attr.Value
+		case "baseProfile":
+			baseProfile = attr.Value
+		case "viewBox":
+			viewBox = attr.Value
+		case "x", "y":
+			return fmt.Errorf("bimi: logo: %s attribute on <svg> is not allowed", attr.Name.Local)
+		}
+	}
+	if version != "1.2" {
+		return fmt.Errorf("bimi: logo: version %q, want 1.2", version)
+	}
+	if baseProfile != "tiny-ps" {
+		return fmt.Errorf("bimi: logo: baseProfile %q, want tiny-ps", baseProfile)
+	}
+	box := strings.Fields(strings.Replace(viewBox, ",", " ", -1))
+	if len(box) != 4 {
+		return fmt.Errorf("bimi: logo: bad viewBox %q", viewBox)
+	}
+	width, err1 := strconv.ParseFloat(box[2], 64)
+	height, err2 := strconv.ParseFloat(box[3], 64)
+	if err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+		return fmt.Errorf("bimi: logo: bad viewBox %q", viewBox)
+	}
+	if width != height {
+		return fmt.Errorf("bimi: logo: %gx%g is not square", width, height)
+	}
+	return nil
+}
+
+// Guidance describes what a domain has to publish for receivers
+// to show its logo, and what it has published so far.
+type Guidance struct {
+	Domain         string   `json:"domain"`
+	RecordName     string   `json:"record_name"`     // TXT record to publish
+	RecordTXT      string   `json:"record_txt"`      // its value
+	LogoURL        string   `json:"logo_url"`        // where to serve the logo
+	SelectorHeader string   `json:"selector_header"` // added to signed mail
+	LogoSize       int      `json:"logo_size"`
+	LogoError      string   `json:"logo_error,omitempty"`
+	Published      []string `json:"published"`    // TXT records found at RecordName
+	DMARCPolicy    string   `json:"dmarc_policy"` // p= of the domain's DMARC record
+	Problems       []string `json:"problems,omitempty"`
+}
+
+// LookupTXTFunc looks up the TXT records of a DNS name.
+type LookupTXTFunc func(ctx context.Context, name string) ([]string, error)
+
+// Check reports the guidance for a domain's record and logo,
+// consulting DNS with lookupTXT for what is published.
+func Check(ctx context.Context, lookupTXT LookupTXTFunc, rec *Record, logo []byte) Guidance {
+	g := Guidance{
+		Domain:         rec.Domain,
+		RecordName:     rec.Name(),
+		RecordTXT:      rec.TXT(),
+		LogoURL:        rec.LogoURL,
+		SelectorHeader: rec.SelectorHeader(),
+		LogoSize:       len(logo),
+	}
+	if err := ValidateLogo(logo); err != nil {
+		g.LogoError = err.Error()
+		g.Problems = append(g.Problems, "the logo does not meet the SVG Tiny PS profile")
+	}
+
+	txts, err := lookupTXT(ctx, g.RecordName)
+	if err != nil {
+		g.Problems = append(g.Problems, fmt.Sprintf("looking up %s: %v", g.RecordName, err))
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=BIMI1") {
+			g.Published = append(g.Published, txt)
+		}
+	}
+	switch {
+	case len(g.Published) == 0:
+		g.Problems = append(g.Problems, "publish the TXT record "+g.RecordName)
+	case len(g.Published) > 1:
+		g.Problems = append(g.Problems, "more than one BIMI record is published at "+g.RecordName)
+	case g.Published[0] != g.RecordTXT:
+		g.Problems = append(g.Problems, "the published record differs from "+g.RecordTXT)
+	}
+
+	txts, err = lookupTXT(ctx, "_dmarc."+rec.Domain)
+	if err != nil {
+		g.Problems = append(g.Problems, fmt.Sprintf("looking up _dmarc.%s: %v", rec.Domain, err))
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			g.DMARCPolicy = dmarcTag(txt, "p")
+			if pct := dmarcTag(txt, "pct"); pct != "" && pct != "100" {
+				g.Problems = append(g.Problems, "the DMARC policy must apply to all mail, pct=100")
+			}
+		}
+	}
+	if p := strings.ToLower(g.DMARCPolicy); p != "quarantine" && p != "reject" {
+		g.Problems = append(g.Problems, "the DMARC policy must be p=quarantine or p=reject")
+	}
+	return g
+}
+
+// dmarcTag is the value of a tag in a DMARC record.
+func dmarcTag(txt, tag string) string {
+	for _, kv := range strings.Split(txt, ";") {
+		kv = strings.TrimSpace(kv)
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.TrimSpace(kv[:i]) == tag {
+			return strings.TrimSpace(kv[i+1:])
+		}
+	}
+	return ""
+}
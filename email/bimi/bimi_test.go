@@ -0,0 +1,108 @@
+package bimi
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const logo = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"
+	version="1.2" baseProfile="tiny-ps" viewBox="0 0 100 100">
+	<title>Spilled Ink</title>
+	<defs><circle id="c" cx="50" cy="50" r="40"/></defs>
+	<use xlink:href="#c" fill="#123456"/>
+</svg>`
+
+func TestValidateLogo(t *testing.T) {
+	if err := ValidateLogo([]byte(logo)); err != nil {
+		t.Fatalf("valid logo: %v", err)
+	}
+
+	tests := []struct {
+		name, old, new, err string
+	}{
+		{"profile", `baseProfile="tiny-ps"`, `baseProfile="tiny"`, "baseProfile"},
+		{"version", `version="1.2"`, `version="1.1"`, "version"},
+		{"title", `<title>Spilled Ink</title>`, ``, "missing <title>"},
+		{"square", `viewBox="0 0 100 100"`, `viewBox="0 0 100 50"`, "not square"},
+		{"root x", `version="1.2"`, `version="1.2" x="0"`, "x attribute"},
+		{"script", `<defs>`, `<script>alert(1)</script><defs>`, "<script>"},
+		{"external", `xlink:href="#c"`, `xlink:href="https://example.com/c.svg"`, "external reference"},
+		{"event", `fill="#123456"`, `fill="#123456" onclick="x()"`, "event attribute"},
+		{"namespace", `xmlns="http://www.w3.org/2000/svg" `, ``, "not an SVG"},
+	}
+	for _, test := range tests {
+		svg := strings.Replace(logo, test.old, test.new, 1)
+		err := ValidateLogo([]byte(svg))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: err=%v, want %q", test.name, err, test.err)
+		}
+	}
+
+	big := strings.Replace(logo, "</svg>", "<!--"+strings.Repeat("x", MaxLogoSize)+"--></svg>", 1)
+	if err := ValidateLogo([]byte(big)); err == nil {
+		t.Error("oversized logo is valid")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	r := Record{
+		Domain:  "example.com",
+		LogoURL: "https://example.com/logo.svg",
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Name(), "default._bimi.example.com"; got != want {
+		t.Errorf("Name=%q, want %q", got, want)
+	}
+	if got, want := r.TXT(), "v=BIMI1; l=https://example.com/logo.svg;"; got != want {
+		t.Errorf("TXT=%q, want %q", got, want)
+	}
+
+	r.Selector = "brand"
+	r.AuthorityURL = "https://example.com/vmc.pem"
+	if got, want := r.TXT(), "v=BIMI1; l=https://example.com/logo.svg; a=https://example.com/vmc.pem;"; got != want {
+		t.Errorf("TXT=%q, want %q", got, want)
+	}
+	if got, want := r.SelectorHeader(), "v=BIMI1; s=brand;"; got != want {
+		t.Errorf("SelectorHeader=%q, want %q", got, want)
+	}
+
+	r.LogoURL = "http://example.com/logo.svg"
+	if err := r.Validate(); err == nil {
+		t.Error("http logo URL is valid")
+	}
+	r.LogoURL = "https://example.com/logo.svg"
+	r.Selector = "a;b"
+	if err := r.Validate(); err == nil {
+		t.Error("bad selector is valid")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	rec := &Record{
+		Domain:  "example.com",
+		LogoURL: "https://example.com/logo.svg",
+	}
+	dns := map[string][]string{
+		"default._bimi.example.com": {"v=BIMI1; l=https://example.com/logo.svg;"},
+		"_dmarc.example.com":        {"v=DMARC1; p=reject; rua=mailto:d@example.com"},
+	}
+	lookupTXT := func(ctx context.Context, name string) ([]string, error) {
+		return dns[name], nil
+	}
+
+	g := Check(context.Background(), lookupTXT, rec, []byte(logo))
+	if len(g.Problems) != 0 || g.DMARCPolicy != "reject" || len(g.Published) != 1 {
+		t.Errorf("guidance: %+v", g)
+	}
+
+	dns["_dmarc.example.com"] = []string{"v=DMARC1; p=none"}
+	delete(dns, "default._bimi.example.com")
+	g = Check(context.Background(), lookupTXT, rec, []byte("<svg/>"))
+	if len(g.Problems) != 3 || g.LogoError == "" {
+		t.Errorf("guidance problems: %q, logo error %q", g.Problems, g.LogoError)
+	}
+}
@@ -0,0 +1,199 @@
+// Package charset finds the character encoding of message text and
+// converts it to UTF-8.
+//
+// The charset MIME parameter is honored when it names an encoding
+// that is known. Text with no charset, an unknown one, or labeled
+// UTF-8 or US-ASCII when it is neither, has its encoding guessed by
+// Detect.
+package charset
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// UTF8 is the name of the charset that needs no conversion.
+const UTF8 = "utf-8"
+
+// Lookup finds the encoding of a charset label.
+//
+// Labels are resolved as web browsers resolve them, so "gb2312" is
+// decoded as GBK and "iso-8859-1" as windows-1252, which is what
+// mail labeled so is usually written in.
+// It reports a nil encoding for UTF-8 and US-ASCII, and ok false
+// if the label is not known.
+func Lookup(label string) (enc encoding.Encoding, name string, ok bool) {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	switch label {
+	case "":
+		return nil, "", false
+	case "utf-8", "utf8", "us-ascii", "ascii", "ansi_x3.4-1968", "iso646-us":
+		return nil, UTF8, true
+	}
+	if e, err := htmlindex.Get(label); err == nil {
+		if name, err := htmlindex.Name(e); err == nil {
+			if name == UTF8 {
+				return nil, UTF8, true
+			}
+			return e, name, true
+		}
+	}
+	if e, err := ianaindex.MIME.Encoding(label); err == nil && e != nil {
+		if name, err := ianaindex.MIME.Name(e); err == nil {
+			return e, strings.ToLower(name), true
+		}
+	}
+	return nil, "", false
+}
+
+// Choose decides the encoding of text labeled declared, which
+// starts with sample. If the sample is the first part of the text,
+// truncated is set. A nil encoding means the text is UTF-8.
+func Choose(declared string, sample []byte, truncated bool) (enc encoding.Encoding, name string) {
+	enc, name, ok := Lookup(declared)
+	if ok && (enc != nil || validUTF8(sample, truncated)) {
+		return enc, name
+	}
+	name = Detect(sample, truncated)
+	enc, _, _ = Lookup(name)
+	return enc, name
+}
+
+// candidates are the encodings Detect chooses between, in order of
+// preference when they score the same.
+var candidates = []string{
+	"windows-1252",
+	"windows-1251",
+	"koi8-r",
+	"shift_jis",
+	"euc-jp",
+	"gbk",
+	"big5",
+	"euc-kr",
+}
+
+// Detect guesses the encoding of text that starts with sample.
+// If the sample is the first part of the text, truncated is set.
+//
+// Each candidate encoding decodes the sample and is scored by how
+// much the result looks like natural language text: letters of one
+// script in plausible case, common CJK characters, and no invalid
+// sequences or control characters.
+func Detect(sample []byte, truncated bool) (name string) {
+	if isISO2022JP(sample) {
+		return "iso-2022-jp" // 7-bit, so also valid UTF-8
+	}
+	if validUTF8(sample, truncated) {
+		return UTF8 // including ASCII
+	}
+	best, bestScore := candidates[0], 0
+	for i, name := range candidates {
+		enc, _, _ := Lookup(name)
+		text, err := enc.NewDecoder().Bytes(sample)
+		if err != nil {
+			continue
+		}
+		if s := score(text); i == 0 || s > bestScore {
+			best, bestScore = name, s
+		}
+	}
+	return best
+}
+
+func validUTF8(b []byte, truncated bool) bool {
+	if truncated {
+		// Do not count a rune cut in two at the end.
+		for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+			if utf8.RuneStart(b[len(b)-i]) {
+				if !utf8.FullRune(b[len(b)-i:]) {
+					b = b[:len(b)-i]
+				}
+				break
+			}
+		}
+	}
+	return utf8.Valid(b)
+}
+
+// isISO2022JP reports whether b has the escape sequences
+// that switch ISO-2022-JP into JIS X 0208.
+func isISO2022JP(b []byte) bool {
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] == 0x1b && b[i+1] == '$' && (b[i+2] == 'B' || b[i+2] == '@') {
+			return true
+		}
+	}
+	return false
+}
+
+// score rates how much text looks like natural language.
+// Only non-ASCII runes are scored, ASCII decodes the same in
+// every candidate.
+func score(text []byte) (s int) {
+	var prev rune
+	for _, r := range string(text) {
+		if r < utf8.RuneSelf {
+			prev = r
+			continue
+		}
+		switch {
+		case r == utf8.RuneError, r >= 0x80 && r <= 0x9f, unicode.Is(unicode.Co, r):
+			s -= 10
+		case common[r]:
+			s += 6
+		case r >= 0xff61 && r <= 0xff9f:
+			// Half-width katakana are single bytes in Shift_JIS
+			// that any 8-bit text decodes to, and are rare in mail.
+			s--
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			s += 4
+		case unicode.In(r, unicode.Han, unicode.Hangul):
+			s++
+		case unicode.Is(unicode.Cyrillic, r):
+			if unicode.IsLower(r) {
+				s += 2
+			} else {
+				s++
+			}
+			if isASCIILetter(prev) {
+				s -= 3 // one word in two scripts
+			}
+		case unicode.Is(unicode.Latin, r):
+			// Accented letters are rarely more than one in a row.
+			s += 2
+			if prev >= utf8.RuneSelf && unicode.Is(unicode.Latin, prev) {
+				s -= 4
+			}
+		default:
+			s -= 2
+		}
+		if unicode.IsLower(prev) && unicode.IsUpper(r) {
+			s -= 4 // case changes mid-word
+		}
+		prev = r
+	}
+	return s
+}
+
+func isASCIILetter(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// common are some of the most frequent Chinese characters,
+// simplified and traditional, and Korean syllables. They are
+// rare in CJK text decoded with the wrong encoding.
+var common = make(map[rune]bool)
+
+func init() {
+	const chars = "的一是不了人我在有他这這中大来來上个個们們到说說时時地也子就道要出你会會对對生能而那得于於着著下自之年过過发發后後作里裡用" +
+		"以家可多天经經么麼去好小心学學还還都看起没沒样樣现現开開前所国國和日月本行事如分成方法同" +
+		"이다는의에가고하지을를로서한으기도사들것수나그리대정아자해있게면시요니라습됩제"
+	for _, r := range chars {
+		common[r] = true
+	}
+}
@@ -0,0 +1,78 @@
+package charset
+
+import (
+	"testing"
+)
+
+var samples = []struct {
+	charset string
+	text    string
+}{
+	{"windows-1252", "Bonjour, je voulais confirmer notre rendez-vous à Genève. Le café était très bon, merci beaucoup!"},
+	{"windows-1252", "Grüße aus München. Wir treffen uns übermorgen um 15 Uhr vor dem Bahnhof."},
+	{"windows-1251", "Здравствуйте! Спасибо за письмо, встреча состоится в понедельник в Москве."},
+	{"koi8-r", "Здравствуйте! Спасибо за письмо, встреча состоится в понедельник в Москве."},
+	{"gbk", "你好，我们明天在北京开会。这是一个很重要的会议，请大家准时到达。"},
+	{"big5", "你好，我們明天在台北開會。這是一個很重要的會議，請大家準時到達。"},
+	{"shift_jis", "こんにちは。明日の会議は東京で行います。よろしくお願いします。"},
+	{"euc-jp", "こんにちは。明日の会議は東京で行います。よろしくお願いします。"},
+	{"iso-2022-jp", "こんにちは。明日の会議は東京で行います。よろしくお願いします。"},
+	{"euc-kr", "안녕하세요. 내일 서울에서 회의가 있습니다. 시간에 맞춰 와 주시기 바랍니다."},
+}
+
+func encode(t *testing.T, charset, text string) []byte {
+	t.Helper()
+	enc, _, ok := Lookup(charset)
+	if !ok || enc == nil {
+		t.Fatalf("no encoding %q", charset)
+	}
+	b, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatalf("encoding %s: %v", charset, err)
+	}
+	return b
+}
+
+func TestDetect(t *testing.T) {
+	for _, s := range samples {
+		b := encode(t, s.charset, s.text)
+		if got := Detect(b, false); got != s.charset {
+			t.Errorf("Detect(%s %q) = %s", s.charset, s.text[:20], got)
+		}
+	}
+	if got := Detect([]byte("plain ascii"), false); got != UTF8 {
+		t.Errorf("Detect(ascii) = %s", got)
+	}
+	// A sample may end mid-rune.
+	if got := Detect([]byte("caf\xc3\xa9 \xe4\xbd"), true); got != UTF8 {
+		t.Errorf("Detect(truncated UTF-8) = %s", got)
+	}
+}
+
+func TestChoose(t *testing.T) {
+	latin := encode(t, "windows-1252", "déjà vu")
+	tests := []struct {
+		declared string
+		sample   []byte
+		want     string
+	}{
+		{"utf-8", []byte("déjà vu"), UTF8},
+		{"UTF-8", latin, "windows-1252"}, // mislabeled
+		{"us-ascii", latin, "windows-1252"},
+		{"ISO-8859-1", latin, "windows-1252"},
+		{`"iso-8859-15"`, latin, "iso-8859-15"},
+		{"gb2312", encode(t, "gbk", "你好"), "gbk"},
+		{"ks_c_5601-1987", encode(t, "euc-kr", "안녕"), "euc-kr"},
+		{"x-unknown", encode(t, "windows-1251", "Здравствуйте, как дела"), "windows-1251"},
+		{"", encode(t, "shift_jis", "こんにちは"), "shift_jis"},
+	}
+	for _, tt := range tests {
+		enc, name := Choose(tt.declared, tt.sample, false)
+		if name != tt.want {
+			t.Errorf("Choose(%q, %q) = %s, want %s", tt.declared, tt.sample, name, tt.want)
+		}
+		if (enc == nil) != (name == UTF8) {
+			t.Errorf("Choose(%q): encoding %v for %s", tt.declared, enc, name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Package contentline reads the content lines that iCalendar
+// (RFC 5545) and vCard (RFC 6350) data is made of.
+package contentline
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxLineLen limits the length of an unfolded content line.
+const MaxLineLen = 1 << 16
+
+// Unfold splits r into content lines, joining folded lines.
+func Unfold(r io.Reader) (lines []string, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), MaxLineLen)
+	var cur []byte
+	started := false
+	for sc.Scan() {
+		line := bytes.TrimRight(sc.Bytes(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			cur = append(cur, line[1:]...)
+			if len(cur) > MaxLineLen {
+				return nil, errors.New("content line too long")
+			}
+			continue
+		}
+		if started {
+			lines = append(lines, string(cur))
+		}
+		cur = append(cur[:0], line...)
+		started = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if started {
+		lines = append(lines, string(cur))
+	}
+	return lines, nil
+}
+
+// Line is a parsed "group.NAME;PARAM=VALUE:VALUE" content line.
+type Line struct {
+	Group string // "item1" of "item1.EMAIL", as used by Apple
+	Name  string // upper case
+
+	// Params maps upper case parameter names to values.
+	// The values of a repeated parameter are joined with commas.
+	// A parameter with no name, as written by vCard 2.1
+	// ("TEL;CELL:..."), is a TYPE.
+	Params map[string]string
+
+	Value string
+}
+
+// Parse parses an unfolded content line.
+func Parse(line string) (cl Line, err error) {
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return cl, errors.New("missing property name")
+	}
+	cl.Name = strings.ToUpper(line[:i])
+	if dot := strings.LastIndexByte(cl.Name, '.'); dot >= 0 {
+		cl.Group = line[:dot]
+		cl.Name = cl.Name[dot+1:]
+	}
+	for line[i] == ';' {
+		line = line[i+1:]
+		var name string
+		if eq := strings.IndexByte(line, '='); eq > 0 && eq < strings.IndexAny(line, ";:") {
+			name = strings.ToUpper(line[:eq])
+			line = line[eq+1:]
+		} else {
+			name = "TYPE"
+		}
+		var val string
+		if len(line) > 0 && line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				return cl, fmt.Errorf("%s: unterminated parameter quote", cl.Name)
+			}
+			val = line[1 : end+1]
+			line = line[end+2:]
+			i = 0
+		} else {
+			i = strings.IndexAny(line, ";:")
+			if i < 0 {
+				return cl, fmt.Errorf("%s: missing value", cl.Name)
+			}
+			val = line[:i]
+		}
+		if cl.Params == nil {
+			cl.Params = make(map[string]string)
+		}
+		if prev, ok := cl.Params[name]; ok {
+			val = prev + "," + val
+		}
+		cl.Params[name] = val
+		if i >= len(line) {
+			return cl, fmt.Errorf("%s: missing value", cl.Name)
+		}
+	}
+	if line[i] != ':' {
+		return cl, fmt.Errorf("%s: missing value", cl.Name)
+	}
+	cl.Value = line[i+1:]
+	return cl, nil
+}
+
+// UnescapeText decodes a TEXT value, undoing the backslash
+// escapes of RFC 5545 section 3.3.11 and RFC 6350 section 3.4.
+func UnescapeText(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			c = s[i]
+			if c == 'n' || c == 'N' {
+				c = '\n'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package contentline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnfold(t *testing.T) {
+	const in = "BEGIN:VCARD\r\nEMAIL:asmith@\r\n work.example.com\r\nNOTE:a\n\tb\nEND:VCARD"
+	lines, err := Unfold(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"BEGIN:VCARD", "EMAIL:asmith@work.example.com", "NOTE:ab", "END:VCARD"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Unfold=%q, want %q", lines, want)
+	}
+
+	long := "NOTE:x\r\n" + strings.Repeat(" "+strings.Repeat("x", 1000)+"\r\n", MaxLineLen/1000+1)
+	if _, err := Unfold(strings.NewReader(long)); err == nil {
+		t.Error("Unfold of an over-long folded line succeeded")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want Line
+	}{
+		{
+			line: "SUMMARY:Lunch",
+			want: Line{Name: "SUMMARY", Value: "Lunch"},
+		},
+		{
+			line: `ATTENDEE;CN="Doe; Jane";PartStat=ACCEPTED:mailto:jane@example.com`,
+			want: Line{
+				Name:   "ATTENDEE",
+				Params: map[string]string{"CN": "Doe; Jane", "PARTSTAT": "ACCEPTED"},
+				Value:  "mailto:jane@example.com",
+			},
+		},
+		{
+			line: "item1.email;type=INTERNET;type=pref:alice@example.com",
+			want: Line{
+				Group:  "item1",
+				Name:   "EMAIL",
+				Params: map[string]string{"TYPE": "INTERNET,pref"},
+				Value:  "alice@example.com",
+			},
+		},
+		{
+			line: "TEL;CELL:+1 555 0100",
+			want: Line{Name: "TEL", Params: map[string]string{"TYPE": "CELL"}, Value: "+1 555 0100"},
+		},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.line)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q)=%+v, want %+v", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{"", ":value", "NOVALUE", "X;P=1", `X;P="open:v`, `X;P="q"`} {
+		if cl, err := Parse(line); err == nil {
+			t.Errorf("Parse(%q)=%+v, want error", line, cl)
+		}
+	}
+}
+
+func TestUnescapeText(t *testing.T) {
+	if got, want := UnescapeText(`a\, b\; c\\d\ne\N`), "a, b; c\\d\ne\n"; got != want {
+		t.Errorf("UnescapeText=%q, want %q", got, want)
+	}
+}
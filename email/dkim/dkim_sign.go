@@ -30,6 +30,7 @@ type Signer struct {
 // Set the Domain and Selector fields before using it.
 func NewSigner(privateKey []byte) (*Signer, error) {
 	headers := []string{
+		"bimi-selector",
 		"content-type",
 		"date",
 		"from",
@@ -0,0 +1,358 @@
+// Package dsn implements SMTP delivery status notifications.
+//
+// It covers the ESMTP parameters of RFC 3461 and writes
+// notification messages in the format of RFC 3464.
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Notify is the set of conditions under which a recipient's
+// sender asked to be notified, the RCPT NOTIFY parameter.
+//
+// The zero value means the parameter was not given, in which
+// case failures and delays are reported.
+type Notify uint8
+
+const (
+	NotifyNever Notify = 1 << iota
+	NotifySuccess
+	NotifyFailure
+	NotifyDelay
+)
+
+// ParseNotify parses the value of a NOTIFY parameter,
+// for example "SUCCESS,FAILURE".
+func ParseNotify(s string) (n Notify, err error) {
+	for _, v := range strings.Split(s, ",") {
+		switch strings.ToUpper(v) {
+		case "NEVER":
+			n |= NotifyNever
+		case "SUCCESS":
+			n |= NotifySuccess
+		case "FAILURE":
+			n |= NotifyFailure
+		case "DELAY":
+			n |= NotifyDelay
+		default:
+			return 0, fmt.Errorf("dsn: unknown NOTIFY value %q", v)
+		}
+	}
+	if n&NotifyNever != 0 && n != NotifyNever {
+		return 0, errors.New("dsn: NOTIFY=NEVER combined with other values")
+	}
+	return n, nil
+}
+
+func (n Notify) String() string {
+	var vals []string
+	if n&NotifyNever != 0 {
+		vals = append(vals, "NEVER")
+	}
+	if n&NotifySuccess != 0 {
+		vals = append(vals, "SUCCESS")
+	}
+	if n&NotifyFailure != 0 {
+		vals = append(vals, "FAILURE")
+	}
+	if n&NotifyDelay != 0 {
+		vals = append(vals, "DELAY")
+	}
+	return strings.Join(vals, ",")
+}
+
+// Wants reports whether a notification of action should be sent.
+func (n Notify) Wants(action Action) bool {
+	if n == 0 {
+		n = NotifyFailure | NotifyDelay
+	}
+	switch action {
+	case ActionFailed:
+		return n&NotifyFailure != 0
+	case ActionDelayed:
+		return n&NotifyDelay != 0
+	case ActionDelivered, ActionRelayed, ActionExpanded:
+		return n&NotifySuccess != 0
+	}
+	return false
+}
+
+// Ret is the MAIL RET parameter, how much of a message
+// to return in a notification.
+type Ret string
+
+const (
+	RetDefault Ret = ""
+	RetFull    Ret = "FULL"
+	RetHdrs    Ret = "HDRS"
+)
+
+// ParseRet parses the value of a RET parameter.
+func ParseRet(s string) (Ret, error) {
+	switch ret := Ret(strings.ToUpper(s)); ret {
+	case RetFull, RetHdrs:
+		return ret, nil
+	}
+	return RetDefault, fmt.Errorf("dsn: unknown RET value %q", s)
+}
+
+// Action is the Action field of a per-recipient report.
+type Action string
+
+const (
+	ActionFailed    Action = "failed"
+	ActionDelayed   Action = "delayed"
+	ActionDelivered Action = "delivered"
+	ActionRelayed   Action = "relayed"
+	ActionExpanded  Action = "expanded"
+)
+
+// Recipient is the delivery status of one recipient.
+type Recipient struct {
+	FinalRecipient    string // address the delivery was attempted to
+	OriginalRecipient string // ORCPT, "rfc822;bob@example.com"
+	Action            Action
+	Status            string // enhanced status code, "5.1.1"
+	RemoteMTA         string // host name
+	Diagnostic        string // "550 5.1.1 no such user"
+	LastAttempt       time.Time
+	WillRetryUntil    time.Time // for delayed actions
+}
+
+// Report is a delivery status notification.
+type Report struct {
+	From         string // address the notification is sent from
+	To           string // sender of the original message
+	ReportingMTA string // host name of this server
+	EnvID        string // ENVID parameter of the original message
+	ArrivalDate  time.Time
+	Recipients   []Recipient
+
+	// Original is the original message. If Ret is not RetFull,
+	// only its header is included in the notification.
+	Original io.Reader
+	Ret      Ret
+
+	Rand *rand.Rand // source of the MIME boundary, may be nil
+}
+
+// Write writes the notification as an RFC 3464 multipart/report message.
+func Write(w io.Writer, r *Report) error {
+	if err := write(w, r); err != nil {
+		return fmt.Errorf("dsn.Write: %v", err)
+	}
+	return nil
+}
+
+func write(w io.Writer, r *Report) error {
+	bw := bufio.NewWriter(w)
+	mw := multipart.NewWriter(bw)
+	if r.Rand != nil {
+		b := make([]byte, 15)
+		r.Rand.Read(b)
+		mw.SetBoundary(fmt.Sprintf("%x", b))
+	}
+
+	subject, summary := r.summary()
+	date := time.Now()
+	fmt.Fprintf(bw, "From: Mail Delivery System <%s>\r\n", r.From)
+	fmt.Fprintf(bw, "To: <%s>\r\n", r.To)
+	fmt.Fprintf(bw, "Subject: %s\r\n", subject)
+	fmt.Fprintf(bw, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(bw, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(bw, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(bw, "Content-Type: multipart/report; report-type=delivery-status;\r\n")
+	fmt.Fprintf(bw, "\tboundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(pw, "%s\r\n\r\n", summary)
+	for _, rcpt := range r.Recipients {
+		fmt.Fprintf(pw, "<%s>: %s", rcpt.FinalRecipient, rcpt.Action)
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(pw, ", %s", rcpt.Diagnostic)
+		}
+		fmt.Fprintf(pw, "\r\n")
+	}
+
+	pw, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(pw, "Reporting-MTA: dns;%s\r\n", r.ReportingMTA)
+	if r.EnvID != "" {
+		fmt.Fprintf(pw, "Original-Envelope-Id: %s\r\n", EncodeXtext(r.EnvID))
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(pw, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range r.Recipients {
+		fmt.Fprintf(pw, "\r\n")
+		if rcpt.OriginalRecipient != "" {
+			fmt.Fprintf(pw, "Original-Recipient: %s\r\n", rcpt.OriginalRecipient)
+		}
+		fmt.Fprintf(pw, "Final-Recipient: rfc822;%s\r\n", rcpt.FinalRecipient)
+		fmt.Fprintf(pw, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(pw, "Status: %s\r\n", rcpt.status())
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(pw, "Remote-MTA: dns;%s\r\n", rcpt.RemoteMTA)
+		}
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(pw, "Diagnostic-Code: smtp;%s\r\n", oneLine(rcpt.Diagnostic))
+		}
+		if !rcpt.LastAttempt.IsZero() {
+			fmt.Fprintf(pw, "Last-Attempt-Date: %s\r\n", rcpt.LastAttempt.Format(time.RFC1123Z))
+		}
+		if !rcpt.WillRetryUntil.IsZero() {
+			fmt.Fprintf(pw, "Will-Retry-Until: %s\r\n", rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	if r.Original != nil {
+		contentType := "text/rfc822-headers"
+		if r.Ret == RetFull {
+			contentType = "message/rfc822"
+		}
+		pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {contentType},
+		})
+		if err != nil {
+			return err
+		}
+		if r.Ret == RetFull {
+			if _, err := io.Copy(pw, r.Original); err != nil {
+				return err
+			}
+		} else if err := copyHeader(pw, r.Original); err != nil {
+			return err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (r *Report) summary() (subject, summary string) {
+	var failed, delayed bool
+	for _, rcpt := range r.Recipients {
+		switch rcpt.Action {
+		case ActionFailed:
+			failed = true
+		case ActionDelayed:
+			delayed = true
+		}
+	}
+	switch {
+	case failed:
+		return "Undelivered Mail Returned to Sender",
+			"Your message could not be delivered to one or more recipients."
+	case delayed:
+		return "Delayed Mail (still being retried)",
+			"Your message has not been delivered yet. Delivery will be retried."
+	}
+	return "Successful Mail Delivery Report",
+		"Your message was delivered to the following recipients."
+}
+
+// status reports the Status field, the enhanced status code of
+// the diagnostic if there is one, otherwise a generic code.
+func (rcpt *Recipient) status() string {
+	if rcpt.Status != "" {
+		return rcpt.Status
+	}
+	switch rcpt.Action {
+	case ActionFailed:
+		return "5.0.0"
+	case ActionDelayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// copyHeader copies the header of a message, ending at the first empty line.
+func copyHeader(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil
+		}
+		if _, werr := w.Write(line); werr != nil {
+			return werr
+		}
+		if err == io.EOF || err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// EncodeXtext encodes s as an RFC 3461 xtext, the form of
+// the ENVID and ORCPT parameters.
+func EncodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeXtext decodes an RFC 3461 xtext.
+func DecodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return "", fmt.Errorf("dsn: bad xtext %q", s)
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("dsn: bad xtext %q", s)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isUpperHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	if c <= '9' {
+		return c - '0'
+	}
+	return c - 'A' + 10
+}
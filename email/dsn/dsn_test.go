@@ -0,0 +1,237 @@
+package dsn
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Notify
+		str  string
+	}{
+		{"NEVER", NotifyNever, "NEVER"},
+		{"failure", NotifyFailure, "FAILURE"},
+		{"DELAY,SUCCESS,FAILURE", NotifySuccess | NotifyFailure | NotifyDelay, "SUCCESS,FAILURE,DELAY"},
+	}
+	for _, test := range tests {
+		got, err := ParseNotify(test.in)
+		if err != nil {
+			t.Errorf("ParseNotify(%q): %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseNotify(%q)=%v, want %v", test.in, got, test.want)
+		}
+		if s := got.String(); s != test.str {
+			t.Errorf("ParseNotify(%q).String()=%q, want %q", test.in, s, test.str)
+		}
+	}
+
+	for _, in := range []string{"", "NEVER,FAILURE", "SOMETIMES"} {
+		if _, err := ParseNotify(in); err == nil {
+			t.Errorf("ParseNotify(%q): want error", in)
+		}
+	}
+
+	var n Notify
+	if !n.Wants(ActionFailed) || !n.Wants(ActionDelayed) || n.Wants(ActionRelayed) {
+		t.Error("default NOTIFY should report failures and delays only")
+	}
+	if NotifyNever.Wants(ActionFailed) {
+		t.Error("NOTIFY=NEVER wants failures")
+	}
+	if !NotifySuccess.Wants(ActionRelayed) {
+		t.Error("NOTIFY=SUCCESS does not want relayed")
+	}
+}
+
+func TestXtext(t *testing.T) {
+	tests := []struct {
+		dec, enc string
+	}{
+		{"", ""},
+		{"QQ314159", "QQ314159"},
+		{"rfc822;bob+tag@example.com", "rfc822;bob+2Btag@example.com"},
+		{"a=b c", "a+3Db+20c"},
+	}
+	for _, test := range tests {
+		if got := EncodeXtext(test.dec); got != test.enc {
+			t.Errorf("EncodeXtext(%q)=%q, want %q", test.dec, got, test.enc)
+		}
+		got, err := DecodeXtext(test.enc)
+		if err != nil {
+			t.Errorf("DecodeXtext(%q): %v", test.enc, err)
+		} else if got != test.dec {
+			t.Errorf("DecodeXtext(%q)=%q, want %q", test.enc, got, test.dec)
+		}
+	}
+
+	for _, in := range []string{"a+2", "a+2b", "a=b", "a b"} {
+		if _, err := DecodeXtext(in); err == nil {
+			t.Errorf("DecodeXtext(%q): want error", in)
+		}
+	}
+}
+
+const original = "From: alice@example.com\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: lunch\r\n" +
+	"\r\n" +
+	"Are you free?\r\n"
+
+func TestWrite(t *testing.T) {
+	last := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := &Report{
+		From:         "MAILER-DAEMON@mx.example.com",
+		To:           "alice@example.com",
+		ReportingMTA: "mx.example.com",
+		EnvID:        "QQ314159",
+		Recipients: []Recipient{{
+			FinalRecipient:    "bob@example.org",
+			OriginalRecipient: "rfc822;Bob@example.org",
+			Action:            ActionFailed,
+			Status:            "5.1.1",
+			RemoteMTA:         "mx.example.org",
+			Diagnostic:        "550 5.1.1 no such\r\n user",
+			LastAttempt:       last,
+		}},
+		Original: strings.NewReader(original),
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Write(buf, r); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"To: <alice@example.com>\r\n",
+		"Subject: Undelivered Mail Returned to Sender\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Reporting-MTA: dns;mx.example.com\r\n",
+		"Original-Envelope-Id: QQ314159\r\n",
+		"Original-Recipient: rfc822;Bob@example.org\r\n",
+		"Final-Recipient: rfc822;bob@example.org\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Remote-MTA: dns;mx.example.org\r\n",
+		"Diagnostic-Code: smtp;550 5.1.1 no such user\r\n",
+		"Last-Attempt-Date: Sat, 01 Jun 2019 12:00:00 +0000\r\n",
+		"Content-Type: text/rfc822-headers\r\n",
+		"Subject: lunch\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Are you free?") {
+		t.Error("RET=HDRS report includes the message body")
+	}
+
+	r.Ret = RetFull
+	r.Original = strings.NewReader(original)
+	r.Recipients[0].Action = ActionDelayed
+	r.Recipients[0].Status = ""
+	buf.Reset()
+	if err := Write(buf, r); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	for _, want := range []string{
+		"Subject: Delayed Mail",
+		"Status: 4.0.0\r\n",
+		"Content-Type: message/rfc822\r\n",
+		"Are you free?",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	last := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	want := &Report{
+		ReportingMTA: "mx.example.com",
+		EnvID:        "QQ+314159",
+		Recipients: []Recipient{{
+			FinalRecipient:    "bob@example.org",
+			OriginalRecipient: "rfc822;Bob@example.org",
+			Action:            ActionFailed,
+			Status:            "5.1.1",
+			RemoteMTA:         "mx.example.org",
+			Diagnostic:        "550 5.1.1 no such user",
+			LastAttempt:       last,
+		}, {
+			FinalRecipient: "carol@example.org",
+			Action:         ActionDelayed,
+			Status:         "4.0.0",
+			WillRetryUntil: last.Add(36 * time.Hour),
+		}},
+	}
+	r := *want
+	r.From = "MAILER-DAEMON@mx.example.com"
+	r.To = "alice@example.com"
+	r.Original = strings.NewReader(original)
+	buf := new(bytes.Buffer)
+	if err := Write(buf, &r); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(Write(r)):\n%+v\nwant:\n%+v", got, want)
+	}
+
+	// A report written by another MTA, with a folded diagnostic.
+	const postfix = "From: MAILER-DAEMON@mail.example.net (Mail Delivery System)\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status;\r\n" +
+		"\tboundary=\"B1\"\r\n" +
+		"\r\n" +
+		"--B1\r\n" +
+		"Content-Description: Notification\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"I'm sorry to have to inform you that your message could not\r\n" +
+		"be delivered to one or more recipients.\r\n" +
+		"--B1\r\n" +
+		"Content-Description: Delivery report\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mail.example.net\r\n" +
+		"X-Postfix-Queue-ID: 4C1F2A0B3\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; dave@example.net\r\n" +
+		"Action: Failed\r\n" +
+		"Status: 5.2.2\r\n" +
+		"Diagnostic-Code: smtp; 552 5.2.2 mailbox\r\n" +
+		"    full\r\n" +
+		"--B1--\r\n"
+	got, err = Parse(strings.NewReader(postfix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &Report{
+		ReportingMTA: "mail.example.net",
+		Recipients: []Recipient{{
+			FinalRecipient: "dave@example.net",
+			Action:         ActionFailed,
+			Status:         "5.2.2",
+			Diagnostic:     "552 5.2.2 mailbox full",
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(postfix):\n%+v\nwant:\n%+v", got, want)
+	}
+
+	if _, err := Parse(strings.NewReader(original)); err == nil {
+		t.Error("Parse of a message that is not a report succeeded")
+	}
+}
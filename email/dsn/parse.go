@@ -0,0 +1,112 @@
+package dsn
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Parse reads the delivery status of a notification message,
+// the message/delivery-status part of an RFC 3464 report.
+//
+// The returned Report has no Original, From, or To.
+// Fields of the report that cannot be parsed are left empty.
+func Parse(r io.Reader) (*Report, error) {
+	report, err := parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("dsn.Parse: %v", err)
+	}
+	return report, nil
+}
+
+func parse(r io.Reader) (*Report, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	hdr, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/report" {
+		return nil, fmt.Errorf("not a report: %s", mediaType)
+	}
+	mr := multipart.NewReader(tr.R, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no message/delivery-status part")
+		} else if err != nil {
+			return nil, err
+		}
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if mediaType == "message/delivery-status" {
+			return parseStatus(p)
+		}
+	}
+}
+
+// parseStatus parses the fields of a message/delivery-status part,
+// the per-message fields followed by the fields of each recipient.
+func parseStatus(r io.Reader) (*Report, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	fields, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	report := &Report{
+		ReportingMTA: typedValue(fields.Get("Reporting-Mta")),
+		ArrivalDate:  parseDate(fields.Get("Arrival-Date")),
+	}
+	if envID := fields.Get("Original-Envelope-Id"); envID != "" {
+		if v, err := DecodeXtext(envID); err == nil {
+			report.EnvID = v
+		} else {
+			report.EnvID = envID
+		}
+	}
+	for err != io.EOF {
+		fields, err = tr.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		report.Recipients = append(report.Recipients, Recipient{
+			FinalRecipient:    typedValue(fields.Get("Final-Recipient")),
+			OriginalRecipient: fields.Get("Original-Recipient"),
+			Action:            Action(strings.ToLower(fields.Get("Action"))),
+			Status:            fields.Get("Status"),
+			RemoteMTA:         typedValue(fields.Get("Remote-Mta")),
+			Diagnostic:        typedValue(fields.Get("Diagnostic-Code")),
+			LastAttempt:       parseDate(fields.Get("Last-Attempt-Date")),
+			WillRetryUntil:    parseDate(fields.Get("Will-Retry-Until")),
+		})
+	}
+	return report, nil
+}
+
+// typedValue removes the type of a field value, as "rfc822;"
+// in "rfc822;bob@example.com".
+func typedValue(v string) string {
+	if i := strings.IndexByte(v, ';'); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+func parseDate(v string) time.Time {
+	t, err := time.Parse(time.RFC1123Z, v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
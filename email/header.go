@@ -14,6 +14,11 @@ type Key string
 type HeaderEntry struct {
 	Key   Key
 	Value []byte
+
+	// Raw is the field body as it was read, after the colon,
+	// with its original folding and encoded-words intact.
+	// It is nil for fields that were not read from a message.
+	Raw []byte
 }
 
 func (entry *HeaderEntry) Encode(w io.Writer) (n int, err error) {
@@ -0,0 +1,338 @@
+// Package ical parses iCalendar (RFC 5545) data.
+//
+// It covers what is needed to show meeting invitations carried
+// in text/calendar message parts: the calendar METHOD, and the
+// VEVENT and VTIMEZONE components. Recurrence rules of events,
+// alarms, and to-dos are ignored.
+package ical
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"spilled.ink/email/contentline"
+)
+
+// Calendar is an iCalendar object.
+type Calendar struct {
+	Method string // REQUEST, CANCEL, REPLY, PUBLISH, ...
+	Events []Event
+}
+
+// Event is a VEVENT.
+type Event struct {
+	UID         string
+	Sequence    int
+	Status      string // TENTATIVE, CONFIRMED, CANCELLED
+	Summary     string
+	Description string
+	Location    string
+	Organizer   Attendee
+	Attendees   []Attendee
+	Start       time.Time
+	End         time.Time
+	AllDay      bool // Start and End are dates
+}
+
+// Attendee is an ORGANIZER or ATTENDEE of an event.
+type Attendee struct {
+	Name     string // CN parameter
+	Addr     string // email address, from a mailto: URI
+	PartStat string // ACCEPTED, DECLINED, NEEDS-ACTION, ...
+}
+
+// Parse parses an iCalendar stream.
+func Parse(r io.Reader) (*Calendar, error) {
+	lines, err := contentline.Unfold(r)
+	if err != nil {
+		return nil, fmt.Errorf("ical: %v", err)
+	}
+
+	p := &parser{
+		cal:       new(Calendar),
+		timezones: make(map[string]*timezone),
+	}
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		cl, err := contentline.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("ical: line %d: %v", i+1, err)
+		}
+		if err := p.line(cl); err != nil {
+			return nil, fmt.Errorf("ical: line %d: %v", i+1, err)
+		}
+	}
+	if !p.sawCalendar {
+		return nil, errors.New("ical: no VCALENDAR")
+	}
+	if err := p.resolveTimes(); err != nil {
+		return nil, fmt.Errorf("ical: %v", err)
+	}
+	return p.cal, nil
+}
+
+type parser struct {
+	cal         *Calendar
+	sawCalendar bool
+	stack       []string // open component names
+
+	event     *Event
+	times     []eventTimes // for cal.Events[i]
+	timezones map[string]*timezone
+	tz        *timezone
+	tzRule    *tzRule
+}
+
+// eventTimes holds the unresolved times of an event
+// until all VTIMEZONE components have been read.
+type eventTimes struct {
+	start, end, duration contentline.Line
+}
+
+func (p *parser) top() string {
+	if len(p.stack) == 0 {
+		return ""
+	}
+	return p.stack[len(p.stack)-1]
+}
+
+func (p *parser) line(cl contentline.Line) error {
+	switch cl.Name {
+	case "BEGIN":
+		return p.begin(strings.ToUpper(cl.Value))
+	case "END":
+		return p.end(strings.ToUpper(cl.Value))
+	}
+
+	switch p.top() {
+	case "VCALENDAR":
+		if cl.Name == "METHOD" {
+			p.cal.Method = strings.ToUpper(cl.Value)
+		}
+	case "VEVENT":
+		p.eventProp(cl)
+	case "VTIMEZONE":
+		if cl.Name == "TZID" {
+			p.tz.id = cl.Value
+		}
+	case "STANDARD", "DAYLIGHT":
+		return p.tzRuleProp(cl)
+	}
+	return nil
+}
+
+func (p *parser) begin(name string) error {
+	switch name {
+	case "VCALENDAR":
+		if len(p.stack) != 0 {
+			return errors.New("nested VCALENDAR")
+		}
+		p.sawCalendar = true
+	case "VEVENT":
+		if p.top() != "VCALENDAR" {
+			return errors.New("VEVENT outside VCALENDAR")
+		}
+		p.cal.Events = append(p.cal.Events, Event{})
+		p.times = append(p.times, eventTimes{})
+		p.event = &p.cal.Events[len(p.cal.Events)-1]
+	case "VTIMEZONE":
+		p.tz = new(timezone)
+	case "STANDARD", "DAYLIGHT":
+		if p.top() != "VTIMEZONE" {
+			return fmt.Errorf("%s outside VTIMEZONE", name)
+		}
+		p.tz.rules = append(p.tz.rules, tzRule{})
+		p.tzRule = &p.tz.rules[len(p.tz.rules)-1]
+	default:
+		if len(p.stack) == 0 {
+			return fmt.Errorf("%s outside VCALENDAR", name)
+		}
+	}
+	p.stack = append(p.stack, name)
+	return nil
+}
+
+func (p *parser) end(name string) error {
+	if p.top() != name {
+		return fmt.Errorf("END:%s does not match BEGIN:%s", name, p.top())
+	}
+	p.stack = p.stack[:len(p.stack)-1]
+	switch name {
+	case "VEVENT":
+		p.event = nil
+	case "VTIMEZONE":
+		if p.tz.id != "" {
+			p.timezones[p.tz.id] = p.tz
+		}
+		p.tz = nil
+	case "STANDARD", "DAYLIGHT":
+		p.tzRule = nil
+	}
+	return nil
+}
+
+func (p *parser) eventProp(cl contentline.Line) {
+	ev := p.event
+	switch cl.Name {
+	case "UID":
+		ev.UID = cl.Value
+	case "SEQUENCE":
+		ev.Sequence, _ = strconv.Atoi(cl.Value)
+	case "STATUS":
+		ev.Status = strings.ToUpper(cl.Value)
+	case "SUMMARY":
+		ev.Summary = contentline.UnescapeText(cl.Value)
+	case "DESCRIPTION":
+		ev.Description = contentline.UnescapeText(cl.Value)
+	case "LOCATION":
+		ev.Location = contentline.UnescapeText(cl.Value)
+	case "ORGANIZER":
+		ev.Organizer = attendee(cl)
+	case "ATTENDEE":
+		ev.Attendees = append(ev.Attendees, attendee(cl))
+	case "DTSTART":
+		p.times[len(p.times)-1].start = cl
+	case "DTEND":
+		p.times[len(p.times)-1].end = cl
+	case "DURATION":
+		p.times[len(p.times)-1].duration = cl
+	}
+}
+
+func attendee(cl contentline.Line) Attendee {
+	a := Attendee{
+		Name:     cl.Params["CN"],
+		PartStat: strings.ToUpper(cl.Params["PARTSTAT"]),
+	}
+	if len(cl.Value) > 7 && strings.EqualFold(cl.Value[:7], "mailto:") {
+		a.Addr = cl.Value[7:]
+	}
+	return a
+}
+
+func (p *parser) resolveTimes() error {
+	for i := range p.cal.Events {
+		ev := &p.cal.Events[i]
+		times := &p.times[i]
+		if times.start.Name == "" {
+			continue
+		}
+		var err error
+		ev.Start, ev.AllDay, err = p.parseTime(times.start)
+		if err != nil {
+			return fmt.Errorf("event %q: DTSTART: %v", ev.UID, err)
+		}
+		switch {
+		case times.end.Name != "":
+			ev.End, _, err = p.parseTime(times.end)
+			if err != nil {
+				return fmt.Errorf("event %q: DTEND: %v", ev.UID, err)
+			}
+		case times.duration.Name != "":
+			d, err := parseDuration(times.duration.Value)
+			if err != nil {
+				return fmt.Errorf("event %q: DURATION: %v", ev.UID, err)
+			}
+			ev.End = ev.Start.Add(d)
+		case ev.AllDay:
+			ev.End = ev.Start.AddDate(0, 0, 1)
+		default:
+			ev.End = ev.Start
+		}
+	}
+	return nil
+}
+
+// parseTime parses a DATE or DATE-TIME property value.
+func (p *parser) parseTime(cl contentline.Line) (t time.Time, isDate bool, err error) {
+	v := cl.Value
+	if strings.EqualFold(cl.Params["VALUE"], "DATE") || len(v) == 8 {
+		t, err = time.Parse("20060102", v)
+		return t, true, err
+	}
+	if strings.HasSuffix(v, "Z") {
+		t, err = time.Parse("20060102T150405Z", v)
+		return t, false, err
+	}
+	local, err := time.Parse("20060102T150405", v)
+	if err != nil {
+		return t, false, err
+	}
+	tzid := cl.Params["TZID"]
+	if tzid == "" {
+		return local, false, nil // floating time, treat as UTC
+	}
+	if tz := p.timezones[tzid]; tz != nil {
+		return local.Add(-time.Duration(tz.offset(local)) * time.Second), false, nil
+	}
+	if loc, err := time.LoadLocation(tzid); err == nil {
+		y, mo, d := local.Date()
+		h, mi, s := local.Clock()
+		return time.Date(y, mo, d, h, mi, s, 0, loc), false, nil
+	}
+	return t, false, fmt.Errorf("unknown TZID %q", tzid)
+}
+
+// parseDuration parses an RFC 5545 DURATION value, such as "PT1H30M".
+func parseDuration(s string) (time.Duration, error) {
+	orig := s
+	neg := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	if s == "" || s[0] != 'P' {
+		return 0, fmt.Errorf("bad duration %q", orig)
+	}
+	s = s[1:]
+	if s == "" {
+		return 0, fmt.Errorf("bad duration %q", orig)
+	}
+	var d time.Duration
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		i := 0
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(s) {
+			return 0, fmt.Errorf("bad duration %q", orig)
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %q", orig)
+		}
+		unit := time.Duration(0)
+		switch {
+		case s[i] == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case s[i] == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case s[i] == 'H' && inTime:
+			unit = time.Hour
+		case s[i] == 'M' && inTime:
+			unit = time.Minute
+		case s[i] == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("bad duration %q", orig)
+		}
+		d += time.Duration(n) * unit
+		s = s[i+1:]
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,128 @@
+package ical
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const exchangeInvite = `BEGIN:VCALENDAR
+METHOD:REQUEST
+PRODID:Microsoft Exchange Server 2010
+VERSION:2.0
+BEGIN:VTIMEZONE
+TZID:Pacific Standard Time
+BEGIN:STANDARD
+DTSTART:16010101T020000
+TZOFFSETFROM:-0700
+TZOFFSETTO:-0800
+RRULE:FREQ=YEARLY;INTERVAL=1;BYDAY=1SU;BYMONTH=11
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:16010101T020000
+TZOFFSETFROM:-0800
+TZOFFSETTO:-0700
+RRULE:FREQ=YEARLY;INTERVAL=1;BYDAY=2SU;BYMONTH=3
+END:DAYLIGHT
+END:VTIMEZONE
+BEGIN:VEVENT
+ORGANIZER;CN="Smith, Alice":mailto:alice@example.com
+ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE;CN=Bob:mailto:
+ bob@example.com
+DESCRIPTION;LANGUAGE=en-US:Agenda:\n1. Budget\, again\n
+UID:040000008200E00074C5B7101A82E008
+SUMMARY;LANGUAGE=en-US:Budget review
+DTSTART;TZID=Pacific Standard Time:20190710T100000
+DTEND;TZID=Pacific Standard Time:20190710T110000
+SEQUENCE:2
+LOCATION;LANGUAGE=en-US:Room 4
+STATUS:CONFIRMED
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestParse(t *testing.T) {
+	cal, err := Parse(strings.NewReader(strings.Replace(exchangeInvite, "\n", "\r\n", -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Calendar{
+		Method: "REQUEST",
+		Events: []Event{{
+			UID:         "040000008200E00074C5B7101A82E008",
+			Sequence:    2,
+			Status:      "CONFIRMED",
+			Summary:     "Budget review",
+			Description: "Agenda:\n1. Budget, again\n",
+			Location:    "Room 4",
+			Organizer:   Attendee{Name: "Smith, Alice", Addr: "alice@example.com"},
+			Attendees: []Attendee{
+				{Name: "Bob", Addr: "bob@example.com", PartStat: "NEEDS-ACTION"},
+			},
+			Start: time.Date(2019, 7, 10, 17, 0, 0, 0, time.UTC),
+			End:   time.Date(2019, 7, 10, 18, 0, 0, 0, time.UTC),
+		}},
+	}
+	if !reflect.DeepEqual(cal, want) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", cal, want)
+	}
+}
+
+func TestTimezoneOffset(t *testing.T) {
+	cal := strings.Replace(exchangeInvite, "20190710T", "20190115T", -1)
+	c, err := Parse(strings.NewReader(cal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Events[0].Start, time.Date(2019, 1, 15, 18, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("winter start %v, want %v", got, want)
+	}
+}
+
+func TestParseAllDay(t *testing.T) {
+	const cal = "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:x\nDTSTART;VALUE=DATE:20200301\nEND:VEVENT\nEND:VCALENDAR\n"
+	c, err := Parse(strings.NewReader(cal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := c.Events[0]
+	if !ev.AllDay || !ev.Start.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)) || !ev.End.Equal(time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("all day event: %+v", ev)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"PT1H30M": 90 * time.Minute,
+		"P1D":     24 * time.Hour,
+		"P1W":     7 * 24 * time.Hour,
+		"-PT15M":  -15 * time.Minute,
+		"P1DT2H":  26 * time.Hour,
+	}
+	for s, want := range tests {
+		got, err := parseDuration(s)
+		if err != nil || got != want {
+			t.Errorf("parseDuration(%q)=%v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "P", "1H", "PT1D", "P1H"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("parseDuration(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, cal := range []string{
+		"",
+		"BEGIN:VEVENT\nEND:VEVENT\n",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VCALENDAR\n",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;TZID=Nowhere/Special:20190710T100000\nEND:VEVENT\nEND:VCALENDAR\n",
+		"BEGIN:VCALENDAR\nNOVALUE\nEND:VCALENDAR\n",
+	} {
+		if _, err := Parse(strings.NewReader(cal)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", cal)
+		}
+	}
+}
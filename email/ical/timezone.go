@@ -0,0 +1,157 @@
+package ical
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"spilled.ink/email/contentline"
+)
+
+// timezone is a VTIMEZONE.
+//
+// Calendars from Microsoft Exchange name their time zones
+// "Pacific Standard Time" and so on, so the VTIMEZONE rules
+// are needed to place event times.
+type timezone struct {
+	id    string
+	rules []tzRule
+}
+
+// tzRule is a STANDARD or DAYLIGHT observance.
+type tzRule struct {
+	start   time.Time // DTSTART, local time of first onset
+	offset  int       // TZOFFSETTO, seconds east of UTC
+	month   time.Month
+	week    int // nth weekday of the month, negative counts from the end
+	weekday time.Weekday
+	yearly  bool // RRULE:FREQ=YEARLY;BYMONTH=m;BYDAY=nDD
+}
+
+func (p *parser) tzRuleProp(cl contentline.Line) (err error) {
+	r := p.tzRule
+	switch cl.Name {
+	case "DTSTART":
+		r.start, err = time.Parse("20060102T150405", cl.Value)
+	case "TZOFFSETTO":
+		r.offset, err = parseOffset(cl.Value)
+	case "RRULE":
+		err = r.parseRRule(cl.Value)
+	}
+	return err
+}
+
+// parseOffset parses a UTC offset such as "-0800" or "+053000".
+func parseOffset(s string) (int, error) {
+	if len(s) != 5 && len(s) != 7 || (s[0] != '+' && s[0] != '-') {
+		return 0, errors.New("bad UTC offset " + strconv.Quote(s))
+	}
+	var secs int
+	for i, mul := range []int{3600, 60, 1} {
+		if 1+2*i+2 > len(s) {
+			break
+		}
+		n, err := strconv.Atoi(s[1+2*i : 1+2*i+2])
+		if err != nil {
+			return 0, errors.New("bad UTC offset " + strconv.Quote(s))
+		}
+		secs += n * mul
+	}
+	if s[0] == '-' {
+		secs = -secs
+	}
+	return secs, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday,
+	"WE": time.Wednesday, "TH": time.Thursday, "FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// parseRRule parses the subset of RRULE used by time zone observances.
+// Other rules are ignored and the observance applies from its DTSTART.
+func (r *tzRule) parseRRule(s string) error {
+	var freq, byMonth, byDay string
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			freq = strings.ToUpper(kv[1])
+		case "BYMONTH":
+			byMonth = kv[1]
+		case "BYDAY":
+			byDay = strings.ToUpper(kv[1])
+		}
+	}
+	if freq != "YEARLY" || byMonth == "" || len(byDay) < 3 {
+		return nil
+	}
+	month, err := strconv.Atoi(byMonth)
+	if err != nil || month < 1 || month > 12 {
+		return errors.New("bad RRULE BYMONTH " + strconv.Quote(byMonth))
+	}
+	wd, ok := weekdays[byDay[len(byDay)-2:]]
+	if !ok {
+		return errors.New("bad RRULE BYDAY " + strconv.Quote(byDay))
+	}
+	week, err := strconv.Atoi(byDay[:len(byDay)-2])
+	if err != nil || week == 0 || week < -5 || week > 5 {
+		return errors.New("bad RRULE BYDAY " + strconv.Quote(byDay))
+	}
+	r.month = time.Month(month)
+	r.week = week
+	r.weekday = wd
+	r.yearly = true
+	return nil
+}
+
+// onset reports the local time the observance begins in year.
+func (r *tzRule) onset(year int) (time.Time, bool) {
+	if !r.yearly {
+		return r.start, r.start.Year() <= year
+	}
+	if year < r.start.Year() {
+		return time.Time{}, false
+	}
+	h, m, s := r.start.Clock()
+	var day time.Time
+	if r.week > 0 {
+		day = time.Date(year, r.month, 1, h, m, s, 0, time.UTC)
+		shift := (int(r.weekday) - int(day.Weekday()) + 7) % 7
+		day = day.AddDate(0, 0, shift+7*(r.week-1))
+	} else {
+		day = time.Date(year, r.month+1, 0, h, m, s, 0, time.UTC) // last day of month
+		shift := (int(day.Weekday()) - int(r.weekday) + 7) % 7
+		day = day.AddDate(0, 0, -shift+7*(r.week+1))
+	}
+	return day, true
+}
+
+// offset reports the UTC offset in seconds in effect at local time t.
+func (tz *timezone) offset(t time.Time) int {
+	// Find the most recent onset of an observance,
+	// looking back into the previous year if necessary.
+	var best time.Time
+	offset := 0
+	for _, year := range []int{t.Year(), t.Year() - 1} {
+		for i := range tz.rules {
+			onset, ok := tz.rules[i].onset(year)
+			if !ok || onset.After(t) {
+				continue
+			}
+			if onset.After(best) {
+				best = onset
+				offset = tz.rules[i].offset
+			}
+		}
+	}
+	if best.IsZero() && len(tz.rules) > 0 {
+		offset = tz.rules[0].offset
+	}
+	return offset
+}
@@ -23,10 +23,21 @@ type Msg struct {
 	MailboxID   int64 // assigned on insertion into user mailbox, 0 otherwise
 	RawHash     string
 	Date        time.Time // TODO: raw user Date, sanatized Date, or server recv date?
+	SentDate    time.Time // Date header field, zero if missing or unparsable
 	Headers     Header
 	Flags       []string
 	Parts       []Part // Parts[i].PartNum == i
 	EncodedSize int64  // size of encoded message, IMAP value RFC822.SIZE
+	Invites     []Invite
+	Tags        []string  // recipient address tags, "tag" in user+tag@example.com
+	VirusScan   string    // antivirus verdict: "" not scanned, "clean", or the virus found
+	Skeleton    *Skeleton // MIME framing as received, nil if it cannot be reproduced
+
+	// The SMTP envelope the message was delivered with.
+	// EnvelopeFrom is empty for a bounce, which has the null
+	// sender, and for a message not delivered over SMTP.
+	EnvelopeFrom string   // MAIL FROM, also in the Return-Path field
+	EnvelopeTo   []string // RCPT TO addresses of the mailbox owner
 }
 
 func (m *Msg) Close() {
@@ -57,6 +68,60 @@ type Part struct {
 	ContentTransferEncoding string // "", "quoted-printable", "base64"
 	ContentTransferSize     int64  // transfer-encoded size
 	ContentTransferLines    int64  // transfer-encoded line count
+
+	// TransferAnomalies describes the malformations of the
+	// transfer encoding that were tolerated when the part was
+	// decoded, "" if there were none.
+	TransferAnomalies string
+
+	// OriginalCharset is the charset the text of the part was
+	// received in, before it was converted to UTF-8. It is ""
+	// if the part was received as UTF-8 or is not text.
+	OriginalCharset string
+
+	// IsSynthesized is set for a part generated when the message
+	// was received, not sent by its author: a text/plain rendering
+	// of a message with only an HTML body. A message rebuilt from
+	// its Skeleton does not include it.
+	IsSynthesized bool
+}
+
+// Skeleton is the MIME framing of a message as it was received.
+//
+// It holds the raw bytes of the message except for the content of
+// the parts, which are kept in Parts. Together they reproduce the
+// received message byte for byte.
+type Skeleton struct {
+	Header    []byte // raw message header, including the blank line
+	HeaderSum string // base64 sha256 of Headers when the skeleton was made
+	Segments  []SkeletonSegment
+}
+
+// SkeletonSegment is a piece of a message body.
+// It is either raw bytes or the encoded content of a part.
+type SkeletonSegment struct {
+	Raw      []byte `json:",omitempty"` // copied as is, if non-nil
+	PartNum  int    `json:",omitempty"`
+	Size     int64  `json:",omitempty"` // size of the part content
+	Encoding string `json:",omitempty"` // "", "quoted-printable", "base64"
+	LineLen  int    `json:",omitempty"` // base64 line length
+	LF       bool   `json:",omitempty"` // base64 lines end in \n, not \r\n
+}
+
+// Invite is a calendar event carried in a text/calendar part,
+// usually a meeting invitation.
+type Invite struct {
+	PartNum       int
+	Method        string // iCalendar METHOD: REQUEST, CANCEL, REPLY, ...
+	UID           string // iCalendar UID, the same for all updates of an event
+	Sequence      int    // revision of the event
+	Summary       string
+	Location      string
+	Organizer     string // address
+	OrganizerName string
+	Start         time.Time
+	End           time.Time
+	AllDay        bool
 }
 
 // Buffer is content store.
@@ -14,6 +14,7 @@ import (
 	"crawshaw.io/iox"
 	"spilled.ink/email"
 	"spilled.ink/email/dkim"
+	"spilled.ink/third_party/imf"
 )
 
 type Builder struct {
@@ -24,7 +25,18 @@ type Builder struct {
 
 // Build builds the MIME-encoded text form of msg.
 // It rewrites msg.Headers as necessary.
+//
+// A message with an email.Skeleton is written exactly as it was
+// received: the same boundaries, transfer encodings, and headers.
+// Messages whose headers or parts have changed since they were
+// cleaved, and messages signed with DKIM, are regenerated.
 func (b *Builder) Build(w io.Writer, msg *email.Msg) error {
+	if b.DKIM == nil && skeletonFits(msg) {
+		if err := b.writeSkeleton(w, msg); err != nil {
+			return fmt.Errorf("msgbuilder.Build: %v", err)
+		}
+		return nil
+	}
 	if err := b.write(w, msg); err != nil {
 		return fmt.Errorf("msgbuilder.Build: %v", err)
 	}
@@ -71,7 +83,7 @@ func (b *Builder) write(w io.Writer, msg *email.Msg) error {
 		}
 	}
 
-	if _, err := msg.Headers.Encode(w); err != nil {
+	if _, err := imf.WriteHeader(w, &msg.Headers); err != nil {
 		return err
 	}
 	if _, err := io.Copy(w, body); err != nil {
@@ -190,8 +202,16 @@ type stringHeaders struct {
 	hdr *email.Header
 }
 
+// Get reports the first value of name as imf.WriteHeader encodes it,
+// so the DKIM signature covers the field as it is sent.
 func (s stringHeaders) Get(name string) string {
-	return string(s.hdr.Get(email.CanonicalKey([]byte(name))))
+	key := email.CanonicalKey([]byte(name))
+	for i := range s.hdr.Entries {
+		if s.hdr.Entries[i].Key == key {
+			return string(imf.EncodedValue(&s.hdr.Entries[i]))
+		}
+	}
+	return ""
 }
 
 type lengthWriter struct {
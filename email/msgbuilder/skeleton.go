@@ -0,0 +1,132 @@
+package msgbuilder
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+
+	"spilled.ink/email"
+)
+
+// HeaderSum is the email.Skeleton HeaderSum of hdr.
+func HeaderSum(hdr *email.Header) string {
+	h := sha256.New()
+	if _, err := hdr.Encode(h); err != nil {
+		panic(err) // hash writes do not fail
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// skeletonFits reports whether msg can be rebuilt from its skeleton.
+//
+// Headers and parts can be changed after a message is cleaved,
+// for example by delivery hooks. Those messages are regenerated.
+func skeletonFits(msg *email.Msg) bool {
+	sk := msg.Skeleton
+	if sk == nil || HeaderSum(&msg.Headers) != sk.HeaderSum {
+		return false
+	}
+	for i := range sk.Segments {
+		seg := &sk.Segments[i]
+		if seg.Raw != nil {
+			continue
+		}
+		if seg.PartNum >= len(msg.Parts) {
+			return false
+		}
+		content := msg.Parts[seg.PartNum].Content
+		if content == nil || content.Size() != seg.Size {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Builder) writeSkeleton(w io.Writer, msg *email.Msg) error {
+	sk := msg.Skeleton
+	if _, err := w.Write(sk.Header); err != nil {
+		return err
+	}
+	for i := range sk.Segments {
+		seg := &sk.Segments[i]
+		if seg.Raw != nil {
+			if _, err := w.Write(seg.Raw); err != nil {
+				return err
+			}
+			continue
+		}
+		part := &msg.Parts[seg.PartNum]
+		if _, err := part.Content.Seek(0, 0); err != nil {
+			return fmt.Errorf("part %d seek failed: %v", part.PartNum, err)
+		}
+		if err := EncodeSegment(w, seg, part.Content); err != nil {
+			return fmt.Errorf("part %d: %v", part.PartNum, err)
+		}
+		part.Content.Seek(0, 0)
+	}
+	return nil
+}
+
+// EncodeSegment writes content encoded as described by seg.
+func EncodeSegment(w io.Writer, seg *email.SkeletonSegment, content io.Reader) error {
+	switch seg.Encoding {
+	case "":
+		_, err := io.Copy(w, content)
+		return err
+	case "quoted-printable":
+		qpw := quotedprintable.NewWriter(w)
+		if _, err := io.Copy(qpw, content); err != nil {
+			return err
+		}
+		return qpw.Close()
+	case "base64":
+		lw := &lineWriter{w: w, lineLen: seg.LineLen, eol: crlf}
+		if seg.LF {
+			lw.eol = crlf[1:]
+		}
+		b64w := base64.NewEncoder(base64.StdEncoding, lw)
+		if _, err := io.Copy(b64w, content); err != nil {
+			return err
+		}
+		return b64w.Close()
+	default:
+		return fmt.Errorf("msgbuilder: unknown segment encoding: %q", seg.Encoding)
+	}
+}
+
+// lineWriter breaks its output into lines of lineLen bytes.
+// There is no line break after the final line.
+type lineWriter struct {
+	w       io.Writer
+	lineLen int // 0 for one unbroken line
+	eol     []byte
+	col     int
+}
+
+func (w *lineWriter) Write(p []byte) (n int, err error) {
+	if w.lineLen <= 0 {
+		return w.w.Write(p)
+	}
+	for len(p) > 0 {
+		if w.col == w.lineLen {
+			if _, err := w.w.Write(w.eol); err != nil {
+				return n, err
+			}
+			w.col = 0
+		}
+		toWrite := len(p)
+		if toWrite > w.lineLen-w.col {
+			toWrite = w.lineLen - w.col
+		}
+		n2, err := w.w.Write(p[:toWrite])
+		n += n2
+		w.col += n2
+		p = p[n2:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -143,7 +143,12 @@ func pullParts(msg *email.Msg) (body, related, attachments []*email.Part, err er
 	for i := 0; i < len(msg.Parts); i++ {
 		p := &msg.Parts[i]
 		if p.IsBody {
-			body = append(body, p)
+			if p.IsSynthesized {
+				// A text alternative comes before the HTML.
+				body = append([]*email.Part{p}, body...)
+			} else {
+				body = append(body, p)
+			}
 			continue
 		}
 		if p.Name == "" {
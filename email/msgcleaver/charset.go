@@ -0,0 +1,48 @@
+package msgcleaver
+
+import (
+	"io"
+
+	"crawshaw.io/iox"
+	"spilled.ink/email/charset"
+)
+
+// charsetSample is how much of a part is read to detect its charset.
+const charsetSample = 64 << 10
+
+// toUTF8 converts the text in buf, labeled with the charset
+// parameter declared, to UTF-8.
+//
+// If the text is already UTF-8, buf is returned. Otherwise buf is
+// closed and the UTF-8 text is returned in a new buffer, with the
+// name of the charset it was converted from.
+//
+// A part converted here does not re-encode to the bytes it was
+// received as, so in fidelity mode it is kept in the skeleton raw.
+func toUTF8(filer *iox.Filer, buf *iox.BufferFile, declared string) (*iox.BufferFile, string, error) {
+	sample := make([]byte, charsetSample)
+	n, err := io.ReadFull(buf, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return buf, "", err
+	}
+	truncated := int64(n) < buf.Size()
+	if _, err := buf.Seek(0, 0); err != nil {
+		return buf, "", err
+	}
+	enc, name := charset.Choose(declared, sample[:n], truncated)
+	if enc == nil {
+		return buf, "", nil
+	}
+
+	out := filer.BufferFile(0)
+	if _, err := io.Copy(out, enc.NewDecoder().Reader(buf)); err != nil {
+		out.Close()
+		return buf, "", err
+	}
+	if _, err := out.Seek(0, 0); err != nil {
+		out.Close()
+		return buf, "", err
+	}
+	buf.Close()
+	return out, name, nil
+}
@@ -0,0 +1,284 @@
+package msgcleaver
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var errDecodedTooLarge = errors.New("decoded content too large")
+
+// maxAnomalies is the most anomalies recorded for a part.
+const maxAnomalies = 8
+
+// anomalies collects the malformations of a transfer encoding
+// that were tolerated while decoding a part.
+type anomalies struct {
+	list []string
+	more bool
+}
+
+func (a *anomalies) add(format string, v ...interface{}) {
+	s := fmt.Sprintf(format, v...)
+	for _, have := range a.list {
+		if have == s {
+			return
+		}
+	}
+	if len(a.list) == maxAnomalies {
+		a.more = true
+		return
+	}
+	a.list = append(a.list, s)
+}
+
+// String reports the anomalies as stored in Part.TransferAnomalies.
+func (a *anomalies) String() string {
+	s := strings.Join(a.list, "; ")
+	if a.more {
+		s += "; ..."
+	}
+	return s
+}
+
+// newDecoder returns a reader of the content of r, decoded from the
+// Content-Transfer-Encoding cte. Malformations are recorded in a.
+func newDecoder(cte string, r io.Reader, a *anomalies) io.Reader {
+	switch cte = strings.ToLower(strings.TrimSpace(cte)); cte {
+	case "base64":
+		return &base64Reader{src: bufio.NewReader(r), a: a}
+	case "quoted-printable":
+		return &qpReader{src: bufio.NewReader(r), a: a}
+	case "", "7bit", "8bit", "binary":
+		return r
+	default:
+		a.add("unknown Content-Transfer-Encoding %q", cte)
+		return r
+	}
+}
+
+// limitReader reports errDecodedTooLarge once more than n bytes,
+// or more than the *msgLeft bytes left for the message, are read.
+type limitReader struct {
+	r       io.Reader
+	n       int64
+	msgLeft *int64
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	*l.msgLeft -= int64(n)
+	if l.n < 0 || *l.msgLeft < 0 {
+		return n, errDecodedTooLarge
+	}
+	return n, err
+}
+
+// qpReader decodes quoted-printable, RFC 2045 section 6.7.
+//
+// Unlike mime/quotedprintable it does not fail on bad input.
+// An invalid escape is passed through as it appears, and a soft
+// line break may end in a bare LF or have whitespace before it.
+// Lines keep the line ending they were received with.
+type qpReader struct {
+	src *bufio.Reader
+	a   *anomalies
+	ws  []byte // whitespace pending, dropped at the end of a line
+	out []byte // decoded, not yet read
+	err error
+}
+
+func (q *qpReader) Read(p []byte) (n int, err error) {
+	for len(q.out) == 0 && q.err == nil {
+		q.fill()
+	}
+	if len(q.out) > 0 {
+		n = copy(p, q.out)
+		q.out = q.out[n:]
+		return n, nil
+	}
+	return 0, q.err
+}
+
+// fill decodes the next byte, or escape, of the source.
+func (q *qpReader) fill() {
+	c, err := q.src.ReadByte()
+	if err != nil {
+		q.ws = q.ws[:0] // trailing whitespace of the last line
+		q.err = err
+		return
+	}
+	switch c {
+	case ' ', '\t':
+		q.ws = append(q.ws, c)
+		return
+	case '\r', '\n':
+		q.ws = q.ws[:0]
+		q.out = append(q.out, c)
+		return
+	}
+	q.out = append(q.out, q.ws...)
+	q.ws = q.ws[:0]
+	if c != '=' {
+		q.out = append(q.out, c)
+		return
+	}
+
+	// An escape, or a soft line break.
+	b, err := q.src.Peek(2)
+	switch {
+	case len(b) == 2 && isHex(b[0]) && isHex(b[1]):
+		q.src.Discard(2)
+		q.out = append(q.out, unhex(b[0])<<4|unhex(b[1]))
+		return
+	case len(b) > 0 && (b[0] == '\r' || b[0] == '\n'):
+		q.softBreak()
+		return
+	case len(b) > 0 && (b[0] == ' ' || b[0] == '\t'):
+		// Transport padding is allowed before a soft line break.
+		i := 0
+		for {
+			b, _ := q.src.Peek(i + 1)
+			if len(b) <= i || (b[i] != ' ' && b[i] != '\t') {
+				if len(b) <= i || b[i] == '\r' || b[i] == '\n' {
+					q.src.Discard(i)
+					q.softBreak()
+					return
+				}
+				break
+			}
+			i++
+		}
+	case err == io.EOF && len(b) == 0:
+		q.a.add("quoted-printable ends in =")
+		q.out = append(q.out, '=')
+		return
+	}
+	q.a.add("invalid quoted-printable escape")
+	q.out = append(q.out, '=')
+}
+
+// softBreak consumes the line ending after a '='.
+func (q *qpReader) softBreak() {
+	c, err := q.src.ReadByte()
+	if err != nil {
+		return
+	}
+	if c == '\r' {
+		if c, err := q.src.ReadByte(); err == nil && c != '\n' {
+			q.src.UnreadByte()
+			q.a.add("quoted-printable soft line break with bare CR")
+		}
+	}
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'F' || 'a' <= c && c <= 'f'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// base64Reader decodes base64, RFC 2045 section 6.8.
+//
+// Unlike encoding/base64 it ignores all whitespace, decodes input
+// missing its padding, skips bytes outside the alphabet, and
+// decodes base64 data concatenated after padding.
+type base64Reader struct {
+	src   *bufio.Reader
+	a     *anomalies
+	chunk []byte
+	in    []byte // alphabet bytes not yet decoded
+	out   []byte // decoded, not yet read
+	pad   bool   // padding seen since the last alphabet byte
+	err   error
+}
+
+func (d *base64Reader) Read(p []byte) (n int, err error) {
+	for len(d.out) == 0 && d.err == nil {
+		d.fill()
+	}
+	if len(d.out) > 0 {
+		n = copy(p, d.out)
+		d.out = d.out[n:]
+		return n, nil
+	}
+	return 0, d.err
+}
+
+func (d *base64Reader) fill() {
+	if d.chunk == nil {
+		d.chunk = make([]byte, 4096)
+	}
+	n, err := d.src.Read(d.chunk)
+	for _, c := range d.chunk[:n] {
+		switch {
+		case c == '=':
+			if !d.pad {
+				d.flush()
+			}
+			d.pad = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '-' || c == '_':
+			d.a.add("base64 uses the URL alphabet")
+			if c == '-' {
+				c = '+'
+			} else {
+				c = '/'
+			}
+			fallthrough
+		case 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/':
+			if d.pad {
+				d.a.add("base64 data after padding")
+				d.pad = false
+			}
+			d.in = append(d.in, c)
+		default:
+			d.a.add("invalid base64 byte 0x%02x", c)
+		}
+	}
+	d.decode(len(d.in) - len(d.in)%4)
+	if err != nil {
+		if !d.pad && len(d.in) > 0 {
+			d.a.add("base64 missing padding")
+		}
+		d.flush()
+		d.err = err
+	}
+}
+
+// flush decodes all of in, ending in an incomplete quantum.
+func (d *base64Reader) flush() {
+	if len(d.in)%4 == 1 {
+		d.a.add("base64 truncated")
+		d.in = d.in[:len(d.in)-1]
+	}
+	d.decode(len(d.in))
+}
+
+// decode decodes the first n bytes of in.
+func (d *base64Reader) decode(n int) {
+	if n == 0 {
+		return
+	}
+	out := len(d.out)
+	d.out = append(d.out, make([]byte, base64.RawStdEncoding.DecodedLen(n))...)
+	m, err := base64.RawStdEncoding.Decode(d.out[out:], d.in[:n])
+	if err != nil {
+		d.a.add("base64 %v", err) // cannot happen, in is filtered
+	}
+	d.out = d.out[:out+m]
+	d.in = append(d.in[:0], d.in[n:]...)
+}
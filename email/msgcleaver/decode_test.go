@@ -0,0 +1,207 @@
+package msgcleaver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"crawshaw.io/iox"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name, cte, in string
+		want          string
+		anomalies     string
+	}{
+		{
+			name: "qp",
+			cte:  "quoted-printable",
+			in:   "caf=C3=A9 =\r\nau lait  \r\nfin=3D=3d",
+			want: "café au lait\r\nfin==",
+		},
+		{
+			name: "qp bare LF soft break",
+			cte:  "Quoted-Printable",
+			in:   "one=\ntwo =  \nthree\n",
+			want: "onetwo three\n",
+		},
+		{
+			name:      "qp invalid escapes",
+			cte:       "quoted-printable",
+			in:        "100=% =ZZ =4 end=",
+			want:      "100=% =ZZ =4 end=",
+			anomalies: "invalid quoted-printable escape; quoted-printable ends in =",
+		},
+		{
+			name: "base64",
+			cte:  "base64",
+			in:   "aGVsbG8s\r\nIHdvcmxk\r\n",
+			want: "hello, world",
+		},
+		{
+			name: "base64 whitespace",
+			cte:  "base64",
+			in:   " aGVs bG8s\tIHdv\r\ncmxk ",
+			want: "hello, world",
+		},
+		{
+			name:      "base64 no padding",
+			cte:       "base64",
+			in:        "aGVsbG8",
+			want:      "hello",
+			anomalies: "base64 missing padding",
+		},
+		{
+			name:      "base64 garbage",
+			cte:       "base64",
+			in:        "aGVs*bG8=\r\nd29y_bGQ=",
+			want:      "hellowor\xfd\xb1\x90",
+			anomalies: "invalid base64 byte 0x2a; base64 data after padding; base64 uses the URL alphabet",
+		},
+		{
+			name:      "base64 truncated",
+			cte:       "base64",
+			in:        "aGVsbG8sI",
+			want:      "hello,",
+			anomalies: "base64 missing padding; base64 truncated",
+		},
+		{
+			name:      "unknown",
+			cte:       "x-uuencode",
+			in:        "begin 644 f",
+			want:      "begin 644 f",
+			anomalies: `unknown Content-Transfer-Encoding "x-uuencode"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a anomalies
+			r := newDecoder(tt.cte, iotest.OneByteReader(strings.NewReader(tt.in)), &a)
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != tt.want {
+				t.Errorf("decoded %q, want %q", got, tt.want)
+			}
+			if got := a.String(); got != tt.anomalies {
+				t.Errorf("anomalies %q, want %q", got, tt.anomalies)
+			}
+		})
+	}
+}
+
+func TestCleaveAnomalies(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	const src = "MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"50=% off=\n"
+	msg, err := Cleave(filer, strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+	if got, want := msg.Parts[0].TransferAnomalies, "invalid quoted-printable escape"; got != want {
+		t.Errorf("TransferAnomalies=%q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(msg.Parts[0].Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "50=% off"; got != want {
+		t.Errorf("content %q, want %q", got, want)
+	}
+}
+
+func TestCleaveTooLarge(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	defer func(l Limits) { DefaultLimits = l }(DefaultLimits)
+	DefaultLimits.MaxPartSize, DefaultLimits.MaxMsgSize = 100, 150
+
+	part := func(n int) string {
+		return "--b\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("x", n) + "\r\n"
+	}
+	msg := func(parts ...string) string {
+		return "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			strings.Join(parts, "") + "--b--\r\n"
+	}
+	tests := []struct {
+		name string
+		src  string
+		ok   bool
+	}{
+		{"fits", msg(part(80), part(60)), true},
+		{"part", msg(part(101)), false},
+		{"message", msg(part(80), part(80)), false},
+	}
+	for _, tt := range tests {
+		m, err := Cleave(filer, strings.NewReader(tt.src))
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else {
+				m.Close()
+			}
+		} else if err == nil || !strings.Contains(err.Error(), errDecodedTooLarge.Error()) {
+			t.Errorf("%s: err=%v, want %v", tt.name, err, errDecodedTooLarge)
+		}
+	}
+}
+
+func TestCleaveMultipartLimits(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	defer func(l Limits) { DefaultLimits = l }(DefaultLimits)
+	DefaultLimits.MaxDepth, DefaultLimits.MaxParts = 3, 5
+
+	// nested is a message of multiparts depth deep, around one part.
+	nested := func(depth int) string {
+		var b strings.Builder
+		b.WriteString("MIME-Version: 1.0\r\n")
+		for i := 0; i < depth; i++ {
+			fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n", i, i)
+		}
+		b.WriteString("Content-Type: text/plain\r\n\r\nhello\r\n")
+		for i := depth - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "--b%d--\r\n", i)
+		}
+		return b.String()
+	}
+	parts := func(n int) string {
+		return "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			strings.Repeat("--b\r\nContent-Type: text/plain\r\n\r\nx\r\n", n) + "--b--\r\n"
+	}
+	tests := []struct {
+		name   string
+		src    string
+		errstr string // empty if the message is cleaved
+	}{
+		{"depth", nested(3), ""},
+		{"too deep", nested(4), errTooDeep.Error()},
+		{"parts", parts(5), ""},
+		{"too many parts", parts(6), errTooManyParts.Error()},
+	}
+	for _, tt := range tests {
+		m, err := Cleave(filer, strings.NewReader(tt.src))
+		if tt.errstr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else {
+				m.Close()
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.errstr) {
+			t.Errorf("%s: err=%v, want %q", tt.name, err, tt.errstr)
+		}
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"mime"
-	"mime/quotedprintable"
 	"strings"
 
 	"crawshaw.io/iox"
@@ -19,13 +21,83 @@ import (
 	"spilled.ink/third_party/imf"
 )
 
+// Limits bound what cleaving one message costs, so a small message
+// cannot be made to take unbounded memory or temporary files, by
+// expanding when decoded, by nesting multiparts hundreds deep, or
+// by holding thousands of parts.
+//
+// A message past a limit is not cleaved. The error names the limit,
+// and a message received by spilld is quarantined with it as its
+// ParseError.
+type Limits struct {
+	MaxDepth    int   // nesting of multiparts
+	MaxParts    int   // MIME entities in multiparts, multiparts included
+	MaxPartSize int64 // decoded bytes of a part
+	MaxMsgSize  int64 // decoded bytes of all the parts of a message
+}
+
+// DefaultLimits are the limits of Cleave, CleaveFidelity and Sign.
+// A zero or negative field is no limit. They are read as each
+// message is cleaved, so set them before cleaving starts.
+var DefaultLimits = Limits{
+	MaxDepth:    100,
+	MaxParts:    1000,
+	MaxPartSize: 64 << 20,
+	MaxMsgSize:  256 << 20,
+}
+
+var (
+	errTooDeep      = errors.New("multipart nesting too deep")
+	errTooManyParts = errors.New("too many MIME parts")
+)
+
+// Cleave splits a message into its parts.
+//
+// A message with only an HTML body is given a text/plain
+// alternative, see email.Part.IsSynthesized.
 func Cleave(filer *iox.Filer, src io.Reader) (*email.Msg, error) {
+	return cleaveMsg(filer, src, false)
+}
+
+// CleaveFidelity is Cleave in fidelity mode.
+//
+// If the message can be reproduced exactly from its parts, its
+// MIME framing is recorded in msg.Skeleton so msgbuilder rebuilds
+// it byte for byte, and its EncodedSize is the size of src.
+func CleaveFidelity(filer *iox.Filer, src io.Reader) (*email.Msg, error) {
+	return cleaveMsg(filer, src, true)
+}
+
+func cleaveMsg(filer *iox.Filer, src io.Reader, fidelity bool) (*email.Msg, error) {
+	var raw *rawCapture
+	if fidelity {
+		raw = &rawCapture{max: maxSkeletonSrc}
+		src = io.TeeReader(src, raw)
+	}
+
 	// Split the input into parts.
 	msg, err := cleave(filer, src)
 	if err != nil {
 		return nil, fmt.Errorf("msgcleaver: %v", err)
 	}
 
+	var skeleton *email.Skeleton
+	if fidelity {
+		// Read the epilogue, if any, to keep all of the source.
+		if _, err := io.Copy(ioutil.Discard, src); err != nil {
+			msg.Close()
+			return nil, fmt.Errorf("msgcleaver: %v", err)
+		}
+		if !raw.overflow {
+			skeleton = buildSkeleton(raw.b, msg)
+		}
+	}
+
+	if err := addTextAlt(filer, msg); err != nil {
+		msg.Close()
+		return nil, fmt.Errorf("msgcleaver: %v", err)
+	}
+
 	// Re-encode the parts to compute the body structure fields.
 	// This is not cheap, but this work is largely unavoidable:
 	// there is no obvious way to calculate the size of a
@@ -40,6 +112,11 @@ func Cleave(filer *iox.Filer, src io.Reader) (*email.Msg, error) {
 		return nil, fmt.Errorf("msgcleaver: %v", err)
 	}
 	msg.EncodedSize = lw.n // TODO: move this into msgbuilder?
+	if skeleton != nil {
+		skeleton.HeaderSum = msgbuilder.HeaderSum(&msg.Headers)
+		msg.Skeleton = skeleton
+		msg.EncodedSize = int64(len(raw.b))
+	}
 	for i := range msg.Parts {
 		msg.Parts[i].Content.Seek(0, 0)
 	}
@@ -77,10 +154,24 @@ func cleave(filer *iox.Filer, src io.Reader) (msgPtr *email.Msg, err error) {
 	r := bufio.NewReader(io.TeeReader(src, h))
 
 	imfr := imf.NewReader(r)
+	imfr.KeepRaw = true
 	msg.Headers, err = imfr.ReadMIMEHeader()
 	if err != nil {
 		return nil, err
 	}
+	if date := msg.Headers.Get("Date"); len(date) > 0 {
+		msg.SentDate, _ = imf.ParseDate(string(date))
+	}
+
+	limits := DefaultLimits
+	decodedLeft := limits.MaxMsgSize
+	if decodedLeft <= 0 {
+		decodedLeft = math.MaxInt64
+	}
+	partSize := limits.MaxPartSize
+	if partSize <= 0 {
+		partSize = math.MaxInt64
+	}
 
 	processPartFn := func(hdr email.Header, parentMediaType string, localPartNum int, r io.Reader) (err error) {
 		var buf *iox.BufferFile
@@ -95,12 +186,9 @@ func cleave(filer *iox.Filer, src io.Reader) (msgPtr *email.Msg, err error) {
 			return err
 		}
 
-		switch strings.ToLower(string(hdr.Get("Content-Transfer-Encoding"))) {
-		case "base64":
-			r = base64.NewDecoder(base64.StdEncoding, r)
-		case "quoted-printable":
-			r = quotedprintable.NewReader(r)
-		}
+		var anoms anomalies
+		r = newDecoder(string(hdr.Get("Content-Transfer-Encoding")), r, &anoms)
+		r = &limitReader{r: r, n: partSize, msgLeft: &decodedLeft}
 
 		isAttachment := false
 		fileName := ""
@@ -143,7 +231,9 @@ func cleave(filer *iox.Filer, src io.Reader) (msgPtr *email.Msg, err error) {
 		} else {
 			_, err = io.Copy(buf, r)
 		}
-		if err != nil {
+		if err == errDecodedTooLarge {
+			return fmt.Errorf("part %d: %v, limit %d bytes per part and %d per message", len(msg.Parts), err, limits.MaxPartSize, limits.MaxMsgSize)
+		} else if err != nil {
 			return err
 		}
 		if _, err := buf.Seek(0, 0); err != nil {
@@ -154,6 +244,15 @@ func cleave(filer *iox.Filer, src io.Reader) (msgPtr *email.Msg, err error) {
 			mediaType = "image/jpeg"
 		}
 
+		// Text is stored as UTF-8, the charset msgbuilder labels it.
+		var originalCharset string
+		if mediaType == "text/plain" || mediaType == "text/html" {
+			buf, originalCharset, err = toUTF8(filer, buf, params["charset"])
+			if err != nil {
+				return err
+			}
+		}
+
 		var compressedSize int64
 		compress := true
 		switch mediaType {
@@ -195,12 +294,15 @@ func cleave(filer *iox.Filer, src io.Reader) (msgPtr *email.Msg, err error) {
 			ContentType:    mediaType,
 			ContentID:      contentID,
 			Content:        buf,
+
+			TransferAnomalies: anoms.String(),
+			OriginalCharset:   originalCharset,
 		}
 		msg.Parts = append(msg.Parts, p)
 
 		return nil
 	}
-	if err := walkMime(msg.Headers, processPartFn, r); err != nil {
+	if err := walkMime(msg.Headers, processPartFn, limits, r); err != nil {
 		return nil, fmt.Errorf("cannot process mime part: %v", err)
 	}
 
@@ -211,17 +313,30 @@ func cleave(filer *iox.Filer, src io.Reader) (msgPtr *email.Msg, err error) {
 	return msg, nil
 }
 
-func walkMime(hdr email.Header, fn func(hdr email.Header, parentMediaType string, localPartNum int, r io.Reader) error, r io.Reader) error {
-	return walkMimeRec(hdr, fn, "", 0, r)
+// walkMime calls fn with each part of a message that is not a
+// multipart, in order, within the depth and part limits.
+func walkMime(hdr email.Header, fn func(hdr email.Header, parentMediaType string, localPartNum int, r io.Reader) error, limits Limits, r io.Reader) error {
+	w := &mimeWalker{fn: fn, limits: limits}
+	return w.walk(hdr, "", 0, 0, r)
 }
 
-func walkMimeRec(hdr email.Header, fn func(hdr email.Header, parentMediaType string, localPartNum int, r io.Reader) error, parentMediaType string, localPartNum int, r io.Reader) error {
+type mimeWalker struct {
+	fn     func(hdr email.Header, parentMediaType string, localPartNum int, r io.Reader) error
+	limits Limits
+	parts  int // MIME entities seen in multiparts
+}
+
+func (w *mimeWalker) walk(hdr email.Header, parentMediaType string, localPartNum, depth int, r io.Reader) error {
 	mediaType, params, err := mime.ParseMediaType(string(hdr.Get("Content-Type")))
 	if err != nil {
-		return fn(hdr, parentMediaType, 0, r)
+		return w.fn(hdr, parentMediaType, 0, r)
 	}
 
 	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		depth++
+		if w.limits.MaxDepth > 0 && depth > w.limits.MaxDepth {
+			return fmt.Errorf("walkMime: %v, limit %d", errTooDeep, w.limits.MaxDepth)
+		}
 		mr := imf.NewMultipartReader(r, params["boundary"])
 		for i := 0; ; i++ {
 			part, err := mr.NextPart()
@@ -232,13 +347,17 @@ func walkMimeRec(hdr email.Header, fn func(hdr email.Header, parentMediaType str
 				// TODO: handle this. just fill out plain text?
 				return fmt.Errorf("walkMime: corrupt mime part: %v", err)
 			}
-			if err := walkMimeRec(part.Header, fn, mediaType, i, part); err != nil {
+			w.parts++
+			if w.limits.MaxParts > 0 && w.parts > w.limits.MaxParts {
+				return fmt.Errorf("walkMime: %v, limit %d", errTooManyParts, w.limits.MaxParts)
+			}
+			if err := w.walk(part.Header, mediaType, i, depth, part); err != nil {
 				return err
 			}
 		}
 		return nil
 	} else {
-		return fn(hdr, parentMediaType, localPartNum, r)
+		return w.fn(hdr, parentMediaType, localPartNum, r)
 	}
 }
 
@@ -1,6 +1,7 @@
 package msgcleaver
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"io"
@@ -339,3 +340,195 @@ Content-Type: text/plain
 
 Hello!
 `
+
+func TestCleaveFidelity(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"quoted-printable", strings.Replace(textQuotedPrintable, "\n", "\r\n", -1)},
+		{"related-and-attached", strings.Replace(relatedAndAttached, "\n", "\r\n", -1)},
+		{"lf-related-and-attached", relatedAndAttached},
+		{"long-headers", strings.Replace(longHeaders, "\n", "\r\n", -1)},
+		{"base64-76", strings.Replace(base64Preamble, "\n", "\r\n", -1)},
+		{"lf-base64-76", base64Preamble},
+		{"charset", strings.Replace(latin1Alt, "\n", "\r\n", -1)},
+	}
+	for _, test := range tests {
+		msg, err := CleaveFidelity(filer, strings.NewReader(test.src))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if msg.Skeleton == nil {
+			t.Errorf("%s: no skeleton", test.name)
+			msg.Close()
+			continue
+		}
+		if got, want := msg.EncodedSize, int64(len(test.src)); got != want {
+			t.Errorf("%s: EncodedSize=%d, want %d", test.name, got, want)
+		}
+
+		// Headers round-trip through storage.
+		hdrBuf := new(bytes.Buffer)
+		if _, err := msg.Headers.Encode(hdrBuf); err != nil {
+			t.Fatal(err)
+		}
+		hdrs, err := imf.NewReader(bufio.NewReader(hdrBuf)).ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Headers = hdrs
+
+		builder := msgbuilder.Builder{Filer: filer}
+		buf := new(bytes.Buffer)
+		if err := builder.Build(buf, msg); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if got := buf.String(); got != test.src {
+			t.Errorf("%s: rebuilt message differs:\n%s", test.name, got)
+		}
+
+		// Changed headers are regenerated.
+		msg.Headers.Add("X-Hook", []byte("changed"))
+		buf.Reset()
+		if err := builder.Build(buf, msg); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !strings.Contains(buf.String(), "X-Hook: changed") {
+			t.Errorf("%s: changed headers not regenerated:\n%s", test.name, buf.String())
+		}
+		msg.Close()
+	}
+}
+
+const latin1Alt = `MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Un caf=E9 =E0 Gen=E8ve.
+--b1
+Content-Type: text/html
+Content-Transfer-Encoding: quoted-printable
+
+<p>Un caf=E9 =E0 Gen=E8ve.</p>
+--b1--
+`
+
+func TestCleaveCharset(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	msg, err := Cleave(filer, strings.NewReader(latin1Alt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+
+	want := []struct {
+		content, charset string
+	}{
+		{"Un café à Genève.", "windows-1252"},
+		{"<p>Un café à Genève.</p>", "windows-1252"}, // detected
+	}
+	if len(msg.Parts) != len(want) {
+		t.Fatalf("got %d parts, want %d", len(msg.Parts), len(want))
+	}
+	for i, w := range want {
+		part := msg.Parts[i]
+		b, err := ioutil.ReadAll(part.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != w.content {
+			t.Errorf("part %d content %q, want %q", i, got, w.content)
+		}
+		if part.OriginalCharset != w.charset {
+			t.Errorf("part %d OriginalCharset=%q, want %q", i, part.OriginalCharset, w.charset)
+		}
+	}
+}
+
+const htmlOnly = `MIME-Version: 1.0
+Content-Type: text/html; charset=utf-8
+
+<p>Hello, <a href="https://example.com/x">read this</a>.</p>
+`
+
+func TestCleaveTextAlt(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	src := strings.Replace(htmlOnly, "\n", "\r\n", -1)
+	msg, err := CleaveFidelity(filer, strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+
+	if len(msg.Parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(msg.Parts))
+	}
+	part := msg.Parts[1]
+	if !part.IsSynthesized || !part.IsBody || part.ContentType != "text/plain" {
+		t.Errorf("part 1: IsSynthesized=%v, IsBody=%v, ContentType=%q", part.IsSynthesized, part.IsBody, part.ContentType)
+	}
+	b, err := ioutil.ReadAll(part.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Content.Seek(0, 0)
+	if got, want := string(b), "Hello, read this [1].\r\n\r\n[1] https://example.com/x\r\n"; got != want {
+		t.Errorf("text %q, want %q", got, want)
+	}
+
+	// The received message is reproduced without the text.
+	builder := msgbuilder.Builder{Filer: filer}
+	buf := new(bytes.Buffer)
+	if err := builder.Build(buf, msg); err != nil {
+		t.Fatal(err)
+	} else if got := buf.String(); got != src {
+		t.Errorf("rebuilt message differs:\n%s", got)
+	}
+
+	// A regenerated message has the text as its first alternative.
+	msg.Skeleton = nil
+	buf.Reset()
+	if err := builder.Build(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := buf.String()
+	textAt := strings.Index(rebuilt, "Content-Type: text/plain")
+	htmlAt := strings.Index(rebuilt, "Content-Type: text/html")
+	if !strings.Contains(rebuilt, "multipart/alternative") || textAt < 0 || htmlAt < textAt {
+		t.Errorf("regenerated message does not start with the text:\n%s", rebuilt)
+	}
+}
+
+const base64Preamble = `MIME-Version: 1.0
+Content-Type: multipart/mixed;
+	boundary="b1"
+
+This is a multi-part message in MIME format.
+--b1
+Content-Type: text/plain; charset=us-ascii
+Content-Transfer-Encoding: 7bit
+
+See attached.
+
+--b1
+Content-Type: application/octet-stream; name="data.bin"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="data.bin"
+
+AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gISIjJCUmJygpKissLS4vMDEyMzQ1Njc4
+OTo7PD0+P0BBQkNERUZHSElKS0xNTk9QUVJTVFVWV1hZWltcXV5fYGFiY2RlZmdoaWprbG1ub3Bx
+cnN0dXZ3eHl6e3x9fn8=
+
+--b1--
+epilogue
+`
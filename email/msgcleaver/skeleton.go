@@ -0,0 +1,236 @@
+package msgcleaver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"spilled.ink/email"
+	"spilled.ink/email/msgbuilder"
+	"spilled.ink/third_party/imf"
+)
+
+const (
+	maxSkeletonSrc = 32 << 20 // larger messages are not kept byte-identical
+	maxSkeletonRaw = 64 << 10 // largest part stored raw in a skeleton
+)
+
+// rawCapture keeps a copy of the first max bytes written to it.
+type rawCapture struct {
+	b        []byte
+	max      int
+	overflow bool
+}
+
+func (c *rawCapture) Write(p []byte) (n int, err error) {
+	if !c.overflow {
+		if len(c.b)+len(p) > c.max {
+			c.overflow = true
+			c.b = nil
+		} else {
+			c.b = append(c.b, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// buildSkeleton finds the MIME framing of raw, the source of msg.
+//
+// Parts are walked in the same order as walkMime. Where re-encoding
+// the content of a part does not reproduce raw, the raw text of the
+// part is kept in the skeleton, if it is small.
+//
+// It reports nil if the message cannot be reproduced exactly.
+func buildSkeleton(raw []byte, msg *email.Msg) *email.Skeleton {
+	hdrLen := headerLen(raw)
+	if hdrLen < 0 {
+		return nil
+	}
+	s := &skeletonBuilder{msg: msg}
+	s.sk.Header = raw[:hdrLen]
+	if !s.walk(msg.Headers, raw[hdrLen:]) || s.partNum != len(msg.Parts) {
+		return nil
+	}
+	s.flushRaw()
+	return &s.sk
+}
+
+type skeletonBuilder struct {
+	msg     *email.Msg
+	sk      email.Skeleton
+	raw     []byte // pending raw bytes
+	partNum int
+}
+
+func (s *skeletonBuilder) addRaw(b []byte) {
+	s.raw = append(s.raw, b...)
+}
+
+func (s *skeletonBuilder) flushRaw() {
+	if len(s.raw) > 0 {
+		s.sk.Segments = append(s.sk.Segments, email.SkeletonSegment{Raw: s.raw})
+		s.raw = nil
+	}
+}
+
+func (s *skeletonBuilder) walk(hdr email.Header, body []byte) bool {
+	mediaType, params, err := mime.ParseMediaType(string(hdr.Get("Content-Type")))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return s.leaf(hdr, body)
+	}
+
+	dashBoundary := []byte("--" + params["boundary"])
+	start := findDelimiter(body, dashBoundary, 0)
+	if start < 0 {
+		return false
+	}
+	s.addRaw(body[:start]) // preamble
+	for {
+		line := body[start:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		if bytes.HasPrefix(line[len(dashBoundary):], []byte("--")) {
+			s.addRaw(body[start:]) // close delimiter and epilogue
+			return true
+		}
+		s.addRaw(line)
+		partStart := start + len(line)
+		next := findDelimiter(body, dashBoundary, partStart)
+		if next < 0 {
+			return false
+		}
+		// The line break before a delimiter belongs to the delimiter.
+		partEnd := next
+		if partEnd > partStart && body[partEnd-1] == '\n' {
+			partEnd--
+			if partEnd > partStart && body[partEnd-1] == '\r' {
+				partEnd--
+			}
+		}
+		part := body[partStart:partEnd]
+		hdrLen := headerLen(part)
+		if hdrLen < 0 {
+			return false
+		}
+		partHdr, err := imf.NewReader(bufio.NewReader(bytes.NewReader(part[:hdrLen]))).ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return false
+		}
+		s.addRaw(part[:hdrLen])
+		if !s.walk(partHdr, part[hdrLen:]) {
+			return false
+		}
+		s.addRaw(body[partEnd:next])
+		start = next
+	}
+}
+
+func (s *skeletonBuilder) leaf(hdr email.Header, body []byte) bool {
+	if s.partNum >= len(s.msg.Parts) {
+		return false
+	}
+	part := &s.msg.Parts[s.partNum]
+	s.partNum++
+
+	seg := email.SkeletonSegment{
+		PartNum: part.PartNum,
+		Size:    part.Content.Size(),
+	}
+	var trailer []byte
+	switch cte := strings.ToLower(string(hdr.Get("Content-Transfer-Encoding"))); cte {
+	case "quoted-printable":
+		seg.Encoding = cte
+	case "base64":
+		seg.Encoding = cte
+		// Line breaks after the final line are not content.
+		trimmed := bytes.TrimRight(body, "\r\n")
+		body, trailer = trimmed, body[len(trimmed):]
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			seg.LineLen = i
+			if i > 0 && body[i-1] == '\r' {
+				seg.LineLen--
+			} else {
+				seg.LF = true
+			}
+		}
+	}
+
+	cw := &compareWriter{want: body}
+	if _, err := part.Content.Seek(0, 0); err != nil {
+		return false
+	}
+	err := msgbuilder.EncodeSegment(cw, &seg, part.Content)
+	part.Content.Seek(0, 0)
+	if err == nil && cw.match() {
+		s.flushRaw()
+		s.sk.Segments = append(s.sk.Segments, seg)
+	} else if len(body) <= maxSkeletonRaw {
+		s.addRaw(body)
+	} else {
+		return false
+	}
+	s.addRaw(trailer)
+	return true
+}
+
+// headerLen reports the length of the header at the start of b,
+// including the blank line that ends it, or -1 if there is none.
+func headerLen(b []byte) int {
+	for i := 0; i < len(b); {
+		switch {
+		case b[i] == '\n':
+			return i + 1
+		case b[i] == '\r' && i+1 < len(b) && b[i+1] == '\n':
+			return i + 2
+		}
+		j := bytes.IndexByte(b[i:], '\n')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return -1
+}
+
+// findDelimiter finds the next line at or after off that is
+// a boundary delimiter line, or -1.
+func findDelimiter(b, dashBoundary []byte, off int) int {
+	for off < len(b) {
+		i := bytes.Index(b[off:], dashBoundary)
+		if i < 0 {
+			return -1
+		}
+		i += off
+		if i == 0 || b[i-1] == '\n' {
+			rest := b[i+len(dashBoundary):]
+			rest = bytes.TrimLeft(rest, " \t")
+			if len(rest) == 0 || rest[0] == '\n' || bytes.HasPrefix(rest, []byte("\r\n")) || bytes.HasPrefix(rest, []byte("--")) {
+				return i
+			}
+		}
+		off = i + len(dashBoundary)
+	}
+	return -1
+}
+
+// compareWriter reports whether exactly want is written to it.
+type compareWriter struct {
+	want     []byte
+	mismatch bool
+}
+
+func (w *compareWriter) Write(p []byte) (n int, err error) {
+	if !w.mismatch {
+		if len(p) > len(w.want) || !bytes.Equal(p, w.want[:len(p)]) {
+			w.mismatch = true
+		} else {
+			w.want = w.want[len(p):]
+		}
+	}
+	return len(p), nil
+}
+
+func (w *compareWriter) match() bool { return !w.mismatch && len(w.want) == 0 }
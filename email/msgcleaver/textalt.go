@@ -0,0 +1,64 @@
+package msgcleaver
+
+import (
+	"crawshaw.io/iox"
+	"spilled.ink/email"
+	"spilled.ink/html/htmltext"
+)
+
+// maxTextAltSrc is the largest HTML body given a text alternative.
+const maxTextAltSrc = 4 << 20
+
+// addTextAlt adds a text/plain body part rendered from the HTML
+// body of msg, if the message has no text body of its own.
+//
+// The part is marked synthesized. It is not part of the message as
+// it was received, so it is left out of msg.Skeleton.
+func addTextAlt(filer *iox.Filer, msg *email.Msg) error {
+	var htmlPart *email.Part
+	for i := range msg.Parts {
+		part := &msg.Parts[i]
+		if !part.IsBody {
+			continue
+		}
+		switch part.ContentType {
+		case "text/plain":
+			return nil
+		case "text/html":
+			if htmlPart == nil {
+				htmlPart = part
+			}
+		}
+	}
+	if htmlPart == nil || htmlPart.Content.Size() > maxTextAltSrc {
+		return nil
+	}
+
+	if _, err := htmlPart.Content.Seek(0, 0); err != nil {
+		return err
+	}
+	buf := filer.BufferFile(0)
+	err := htmltext.Convert(buf, htmlPart.Content)
+	if _, err := htmlPart.Content.Seek(0, 0); err != nil {
+		buf.Close()
+		return err
+	}
+	if err != nil || buf.Size() == 0 {
+		// Unparsable HTML or no text, the message is
+		// still stored as it was received.
+		buf.Close()
+		return nil
+	}
+	if _, err := buf.Seek(0, 0); err != nil {
+		buf.Close()
+		return err
+	}
+	msg.Parts = append(msg.Parts, email.Part{
+		PartNum:       len(msg.Parts),
+		IsBody:        true,
+		IsSynthesized: true,
+		ContentType:   "text/plain",
+		Content:       buf,
+	})
+	return nil
+}
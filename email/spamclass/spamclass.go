@@ -0,0 +1,230 @@
+// Package spamclass is a statistical spam classifier.
+//
+// It is a naive Bayesian classifier in the style of Paul Graham's
+// "A Plan for Spam", using Gary Robinson's adjustment for rare tokens
+// and Fisher's method for combining token probabilities.
+//
+// The package holds no state. Token statistics are kept by the caller,
+// typically per-user in a spillbox.
+package spamclass
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"spilled.ink/email"
+)
+
+// Counts is the number of trained spam and ham (non-spam) messages.
+//
+// Used for the entire training set, or for the subset of the
+// training set that contains a particular token.
+type Counts struct {
+	Spam int64
+	Ham  int64
+}
+
+const (
+	minTokenLen = 3
+	maxTokenLen = 40
+	maxTokens   = 3000    // limit on distinct tokens per message
+	maxPartRead = 1 << 18 // limit on body bytes tokenized per part
+)
+
+// tokenHeaders are the headers whose contents are tokenized.
+// Tokens from headers are prefixed with the header name, so
+// "subject:free" is distinct from "free" in the body.
+var tokenHeaders = []email.Key{"Subject", "From", "Reply-To", "To", "Content-Type"}
+
+// Tokens returns the distinct, sorted tokens of msg.
+//
+// Tokens are drawn from a few headers and from the text body parts
+// of the message, as split by msgcleaver. HTML markup is discarded.
+// Each part's Content is read from the beginning and left at offset 0.
+func Tokens(msg *email.Msg) ([]string, error) {
+	set := make(map[string]struct{})
+	add := func(prefix, s string) {
+		for _, tok := range split(s) {
+			if len(set) >= maxTokens {
+				return
+			}
+			set[prefix+tok] = struct{}{}
+		}
+	}
+
+	for _, entry := range msg.Headers.Entries {
+		for _, key := range tokenHeaders {
+			if entry.Key == key {
+				add(strings.ToLower(string(key))+":", string(entry.Value))
+			}
+		}
+	}
+
+	for i := range msg.Parts {
+		part := &msg.Parts[i]
+		if !part.IsBody || part.IsSynthesized || part.Content == nil {
+			continue
+		}
+		isHTML := part.ContentType == "text/html"
+		if !isHTML && part.ContentType != "text/plain" {
+			continue
+		}
+		if _, err := part.Content.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		text, err := readText(io.LimitReader(part.Content, maxPartRead), isHTML)
+		if _, err := part.Content.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		add("", text)
+	}
+
+	tokens := make([]string, 0, len(set))
+	for tok := range set {
+		tokens = append(tokens, tok)
+	}
+	sort.Strings(tokens)
+	return tokens, nil
+}
+
+// readText reads the text of r.
+// If isHTML is set, everything between < and > is dropped.
+func readText(r io.Reader, isHTML bool) (string, error) {
+	br := bufio.NewReader(r)
+	var b strings.Builder
+	inTag := false
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if isHTML {
+			switch {
+			case c == '<':
+				inTag = true
+				b.WriteByte(' ')
+				continue
+			case c == '>' && inTag:
+				inTag = false
+				continue
+			case inTag:
+				continue
+			}
+		}
+		b.WriteRune(c)
+	}
+	return b.String(), nil
+}
+
+// split breaks s into lower-case word tokens.
+//
+// Words are runs of letters, digits, and the punctuation that tends
+// to be meaningful in spam: dollar signs, exclamation marks,
+// apostrophes, and hyphens.
+// Very short and very long words are discarded.
+func split(s string) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		switch r {
+		case '$', '!', '\'', '-':
+			return false
+		}
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		w = strings.Trim(w, "'-")
+		if n := utf8.RuneCountInString(w); n < minTokenLen || n > maxTokenLen {
+			continue
+		}
+		tokens = append(tokens, strings.ToLower(w))
+	}
+	return tokens
+}
+
+const (
+	unknownProb   = 0.5 // Robinson's x, probability of an unseen token
+	unknownWeight = 1.0 // Robinson's s, strength of the unknownProb prior
+	minDeviation  = 0.1 // ignore tokens with probability in 0.5±minDeviation
+	maxDiscrim    = 150 // number of most interesting tokens used
+)
+
+// TokenProb reports the probability that a message containing a token
+// is spam, given the token's counts and the training set total.
+func TokenProb(total, token Counts) float64 {
+	if total.Spam == 0 || total.Ham == 0 {
+		return unknownProb
+	}
+	spamRatio := float64(token.Spam) / float64(total.Spam)
+	hamRatio := float64(token.Ham) / float64(total.Ham)
+	n := float64(token.Spam + token.Ham)
+	if n == 0 {
+		return unknownProb
+	}
+	p := spamRatio / (spamRatio + hamRatio)
+	return (unknownWeight*unknownProb + n*p) / (unknownWeight + n)
+}
+
+// Score reports the probability that a message is spam, in [0, 1].
+//
+// The total is the size of the training set and tokens holds the
+// counts of each of the distinct tokens in the message.
+// A score of 0.5 means the classifier cannot tell.
+func Score(total Counts, tokens []Counts) float64 {
+	if total.Spam == 0 || total.Ham == 0 {
+		return unknownProb
+	}
+
+	probs := make([]float64, 0, len(tokens))
+	for _, c := range tokens {
+		p := TokenProb(total, c)
+		if math.Abs(p-0.5) < minDeviation {
+			continue
+		}
+		probs = append(probs, p)
+	}
+	if len(probs) == 0 {
+		return unknownProb
+	}
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > maxDiscrim {
+		probs = probs[:maxDiscrim]
+	}
+
+	var lnSpam, lnHam float64
+	for _, p := range probs {
+		lnSpam += math.Log(1 - p)
+		lnHam += math.Log(p)
+	}
+	n := 2 * len(probs)
+	s := 1 - chi2Q(-2*lnSpam, n)
+	h := 1 - chi2Q(-2*lnHam, n)
+	return (s - h + 1) / 2
+}
+
+// chi2Q is the probability that a chi-squared value x with v degrees
+// of freedom (v even) could be exceeded by chance.
+func chi2Q(x float64, v int) float64 {
+	m := x / 2
+	sum := math.Exp(-m)
+	term := sum
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	if sum > 1 {
+		return 1
+	}
+	return sum
+}
@@ -0,0 +1,60 @@
+package spamclass
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"spilled.ink/email"
+)
+
+type memBuffer struct{ *bytes.Reader }
+
+func (memBuffer) Write([]byte) (int, error) { return 0, errors.New("read-only") }
+func (memBuffer) Close() error              { return nil }
+
+func newMsg(subject, contentType, body string) *email.Msg {
+	msg := &email.Msg{}
+	msg.Headers.Add("Subject", []byte(subject))
+	msg.Parts = []email.Part{{
+		IsBody:      true,
+		ContentType: contentType,
+		Content:     memBuffer{bytes.NewReader([]byte(body))},
+	}}
+	return msg
+}
+
+func TestTokens(t *testing.T) {
+	msg := newMsg("Cheap Watches!", "text/html", `<p class="x">Buy <b>now</b>, only $19.99 at it's best-price</p>`)
+	got, err := Tokens(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"$19", "best-price", "buy", "it's", "now", "only", "subject:cheap", "subject:watches!"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokens=%q,\nwant %q", got, want)
+	}
+	if off, _ := msg.Parts[0].Content.Seek(0, 1); off != 0 {
+		t.Errorf("part content left at offset %d, want 0", off)
+	}
+}
+
+func TestScore(t *testing.T) {
+	total := Counts{Spam: 100, Ham: 100}
+	spammy := []Counts{{Spam: 90, Ham: 1}, {Spam: 70, Ham: 2}, {Spam: 40, Ham: 40}}
+	hammy := []Counts{{Spam: 1, Ham: 80}, {Spam: 3, Ham: 60}, {Spam: 40, Ham: 40}}
+
+	if s := Score(total, spammy); s < 0.9 {
+		t.Errorf("spammy score %f, want > 0.9", s)
+	}
+	if s := Score(total, hammy); s > 0.1 {
+		t.Errorf("hammy score %f, want < 0.1", s)
+	}
+	if s := Score(total, nil); s != 0.5 {
+		t.Errorf("no tokens score %f, want 0.5", s)
+	}
+	if s := Score(Counts{Spam: 10}, spammy); s != 0.5 {
+		t.Errorf("untrained ham score %f, want 0.5", s)
+	}
+}
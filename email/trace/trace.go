@@ -0,0 +1,158 @@
+// Package trace builds the trace header fields, RFC 5321 section 4.4,
+// a mail server adds to the messages it accepts and delivers.
+//
+// A Received field is prepended when a message is accepted over SMTP,
+// by an MX or an MSA, and a Return-Path field at final delivery.
+// New fields always go above the existing ones, so the header reads
+// as the message's path in reverse.
+package trace
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"spilled.ink/email"
+	"spilled.ink/third_party/imf"
+)
+
+// Received describes the acceptance of a message over SMTP.
+type Received struct {
+	Helo  string   // HELO or EHLO argument of the client
+	Addr  net.Addr // client address
+	By    string   // hostname of the server
+	ESMTP bool     // the client used EHLO
+	Auth  bool     // the client authenticated, RFC 3848 "A"
+	TLS   *tls.ConnectionState
+	ID    string    // server ID of the message
+	For   string    // the recipient, if there is only one
+	Date  time.Time // when the message was accepted
+}
+
+// Protocol is the "with" clause of the Received field, one of
+// the RFC 3848 protocol types, e.g. "ESMTPSA".
+func (r *Received) Protocol() string {
+	if !r.ESMTP {
+		return "SMTP"
+	}
+	p := "ESMTP"
+	if r.TLS != nil {
+		p += "S"
+	}
+	if r.Auth {
+		p += "A"
+	}
+	return p
+}
+
+// Entry is the Received header field.
+//
+// The TLS version is noted in a comment and the cipher suite in
+// the "tls" clause of RFC 8314 section 4.3. The client's
+// username is never included.
+func (r *Received) Entry() email.HeaderEntry {
+	buf := new(bytes.Buffer)
+	helo := r.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	buf.WriteString("from ")
+	buf.WriteString(helo)
+	if ip := addrIP(r.Addr); ip != "" {
+		buf.WriteString(" ([")
+		if strings.IndexByte(ip, ':') != -1 {
+			buf.WriteString("IPv6:")
+		}
+		buf.WriteString(ip)
+		buf.WriteString("])")
+	}
+	buf.WriteString(" by ")
+	buf.WriteString(r.By)
+	buf.WriteString(" with ")
+	buf.WriteString(r.Protocol())
+	if r.TLS != nil {
+		buf.WriteString(" (")
+		buf.WriteString(tlsVersion(r.TLS.Version))
+		buf.WriteString(")")
+	}
+	if r.ID != "" {
+		buf.WriteString(" id ")
+		buf.WriteString(r.ID)
+	}
+	if r.For != "" {
+		buf.WriteString(" for <")
+		buf.WriteString(r.For)
+		buf.WriteString(">")
+	}
+	if r.TLS != nil {
+		buf.WriteString(" tls ")
+		buf.WriteString(tls.CipherSuiteName(r.TLS.CipherSuite))
+	}
+	buf.WriteString("; ")
+	buf.WriteString(r.Date.Format(time.RFC1123Z))
+	return email.HeaderEntry{Key: "Received", Value: buf.Bytes()}
+}
+
+// ReturnPath is the Return-Path header field added at final
+// delivery for the envelope sender. An empty sender is the
+// null reverse-path, "<>".
+func ReturnPath(sender string) email.HeaderEntry {
+	return email.HeaderEntry{Key: "Return-Path", Value: []byte("<" + sender + ">")}
+}
+
+// NewReader returns a reader of the message src with entries,
+// in order, prepended to its header. Fields are written as
+// imf.WriteField writes them.
+func NewReader(src io.Reader, entries ...email.HeaderEntry) io.Reader {
+	return io.MultiReader(bytes.NewReader(bytes.Join(Lines(entries...), nil)), src)
+}
+
+// Lines encodes entries as the CRLF terminated lines of a header.
+func Lines(entries ...email.HeaderEntry) [][]byte {
+	buf := new(bytes.Buffer)
+	for i := range entries {
+		imf.WriteField(buf, &entries[i]) // bytes.Buffer writes do not fail
+	}
+	var lines [][]byte
+	b := buf.Bytes()
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		lines = append(lines, b[:i])
+		b = b[i:]
+	}
+	return lines
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return "TLS"
+}
@@ -0,0 +1,112 @@
+package trace
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"spilled.ink/third_party/imf"
+)
+
+var date = time.Date(2019, time.March, 4, 15, 4, 5, 0, time.FixedZone("", -7*60*60))
+
+func TestReceived(t *testing.T) {
+	tests := []struct {
+		name string
+		r    Received
+		want string
+	}{
+		{
+			name: "mx",
+			r: Received{
+				Helo:  "mail.example.org",
+				Addr:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+				By:    "mx.spilled.ink",
+				ESMTP: true,
+				ID:    "3f2a.1",
+				For:   "bob@spilled.ink",
+				Date:  date,
+			},
+			want: "Received: from mail.example.org ([192.0.2.1]) by mx.spilled.ink with ESMTP id\r\n" +
+				" 3f2a.1 for <bob@spilled.ink>; Mon, 04 Mar 2019 15:04:05 -0700\r\n",
+		},
+		{
+			name: "submission",
+			r: Received{
+				Helo:  "[192.168.1.2]",
+				Addr:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 465},
+				By:    "msa.spilled.ink",
+				ESMTP: true,
+				Auth:  true,
+				TLS: &tls.ConnectionState{
+					Version:     tls.VersionTLS13,
+					CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+				},
+				ID:   "9c.2",
+				Date: date,
+			},
+			want: "Received: from [192.168.1.2] ([IPv6:2001:db8::1]) by msa.spilled.ink with\r\n" +
+				" ESMTPSA (TLS1.3) id 9c.2 tls TLS_AES_128_GCM_SHA256; Mon, 04 Mar 2019\r\n" +
+				" 15:04:05 -0700\r\n",
+		},
+		{
+			name: "helo",
+			r:    Received{By: "mx.spilled.ink", Date: date},
+			want: "Received: from unknown by mx.spilled.ink with SMTP; Mon, 04 Mar 2019 15:04:05\r\n" +
+				" -0700\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := tt.r.Entry()
+			buf := new(bytes.Buffer)
+			if _, err := imf.WriteField(buf, &entry); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+
+			// Unfolding gives back the field value.
+			unfolded := strings.Replace(buf.String(), "\r\n ", " ", -1)
+			if want := "Received: " + string(entry.Value) + "\r\n"; unfolded != want {
+				t.Errorf("unfolded:\n%q\nwant:\n%q", unfolded, want)
+			}
+		})
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	const msg = "Received: from a.example.org by b.example.org; Sun, 03 Mar 2019 10:00:00 +0000\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Return-Path: <not@a.header>\r\n"
+	r := Received{Helo: "b.example.org", By: "mx.spilled.ink", ESMTP: true, Date: date}
+
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, NewReader(strings.NewReader(msg), ReturnPath("alice@example.org"), r.Entry())); err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <alice@example.org>\r\n" +
+		"Received: from b.example.org by mx.spilled.ink with ESMTP; Mon, 04 Mar 2019\r\n" +
+		" 15:04:05 -0700\r\n" +
+		msg
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	lines := Lines(ReturnPath(""), r.Entry())
+	if len(lines) != 3 {
+		t.Fatalf("Lines: %q, want 3 lines", lines)
+	}
+	if got := string(lines[0]); got != "Return-Path: <>\r\n" {
+		t.Errorf("null reverse-path: %q", got)
+	}
+	if !bytes.Equal(bytes.Join(lines[1:], nil), []byte(want[len("Return-Path: <alice@example.org>\r\n"):len(want)-len(msg)])) {
+		t.Errorf("Lines: %q", lines[1:])
+	}
+}
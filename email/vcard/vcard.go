@@ -0,0 +1,240 @@
+// Package vcard parses and writes vCard (RFC 2426, RFC 6350) data.
+//
+// It covers what is needed to exchange an address book with
+// CardDAV clients: names, email addresses, and telephone numbers.
+// Other properties are kept as raw content lines so a card can be
+// written back out without losing them.
+package vcard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"spilled.ink/email/contentline"
+)
+
+// Card is a vCard.
+type Card struct {
+	UID           string
+	FormattedName string // FN
+	Org           string
+	Emails        []Email
+	Phones        []Phone
+
+	// Extra holds the unfolded content lines of properties
+	// not otherwise represented in Card.
+	Extra []string
+}
+
+// Email is an EMAIL property.
+type Email struct {
+	Addr  string
+	Types []string // lower case: "home", "work", ...
+	Pref  bool
+}
+
+// Phone is a TEL property.
+type Phone struct {
+	Number string
+	Types  []string // lower case: "cell", "voice", "work", ...
+}
+
+// Parse parses a stream of vCards.
+func Parse(r io.Reader) ([]Card, error) {
+	lines, err := contentline.Unfold(r)
+	if err != nil {
+		return nil, fmt.Errorf("vcard: %v", err)
+	}
+
+	var cards []Card
+	var card *Card
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		cl, err := contentline.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("vcard: line %d: %v", i+1, err)
+		}
+		switch {
+		case cl.Name == "BEGIN" && strings.EqualFold(cl.Value, "VCARD"):
+			if card != nil {
+				return nil, fmt.Errorf("vcard: line %d: nested VCARD", i+1)
+			}
+			cards = append(cards, Card{})
+			card = &cards[len(cards)-1]
+		case cl.Name == "END" && strings.EqualFold(cl.Value, "VCARD"):
+			if card == nil {
+				return nil, fmt.Errorf("vcard: line %d: END without BEGIN", i+1)
+			}
+			card = nil
+		case card == nil:
+			return nil, fmt.Errorf("vcard: line %d: %s outside VCARD", i+1, cl.Name)
+		default:
+			card.property(cl, line)
+		}
+	}
+	if card != nil {
+		return nil, errors.New("vcard: missing END:VCARD")
+	}
+	if len(cards) == 0 {
+		return nil, errors.New("vcard: no VCARD")
+	}
+	return cards, nil
+}
+
+func (card *Card) property(cl contentline.Line, line string) {
+	switch cl.Name {
+	case "VERSION", "PRODID":
+		// Replaced when the card is written.
+	case "UID":
+		card.UID = strings.TrimPrefix(cl.Value, "urn:uuid:")
+	case "FN":
+		card.FormattedName = contentline.UnescapeText(cl.Value)
+	case "ORG":
+		// Only the organization name, not its units.
+		card.Org = contentline.UnescapeText(splitValue(cl.Value)[0])
+	case "EMAIL":
+		types, pref := lineTypes(cl)
+		card.Emails = append(card.Emails, Email{
+			Addr:  strings.TrimSpace(contentline.UnescapeText(cl.Value)),
+			Types: types,
+			Pref:  pref,
+		})
+	case "TEL":
+		types, _ := lineTypes(cl)
+		card.Phones = append(card.Phones, Phone{
+			Number: strings.TrimPrefix(contentline.UnescapeText(cl.Value), "tel:"),
+			Types:  types,
+		})
+	default:
+		card.Extra = append(card.Extra, line)
+	}
+}
+
+// lineTypes reports the TYPE parameter values of a content line,
+// and whether it is marked preferred, in either the vCard 3.0
+// TYPE=pref or the vCard 4.0 PREF=1 style.
+func lineTypes(cl contentline.Line) (types []string, pref bool) {
+	if cl.Params["PREF"] != "" {
+		pref = true
+	}
+	if cl.Params["TYPE"] == "" {
+		return nil, pref
+	}
+	for _, t := range strings.Split(strings.ToLower(cl.Params["TYPE"]), ",") {
+		switch t {
+		case "":
+		case "pref":
+			pref = true
+		case "internet":
+			// Implied for EMAIL.
+		default:
+			types = append(types, t)
+		}
+	}
+	return types, pref
+}
+
+// splitValue splits a structured value on unescaped semicolons.
+func splitValue(s string) []string {
+	var vals []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ';':
+			vals = append(vals, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(vals, s[start:])
+}
+
+// escapeText encodes an RFC 6350 text value.
+func escapeText(s string) string {
+	if !strings.ContainsAny(s, "\\,;\n\r") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', ',', ';':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Encode writes card as a vCard 3.0, the version
+// understood by the widest range of CardDAV clients.
+func (card *Card) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeLine(bw, "BEGIN:VCARD")
+	writeLine(bw, "VERSION:3.0")
+	writeLine(bw, "PRODID:-//spilled.ink//spilld//EN")
+	if card.UID != "" {
+		writeLine(bw, "UID:"+card.UID)
+	}
+	writeLine(bw, "FN:"+escapeText(card.FormattedName))
+	hasN := false
+	for _, line := range card.Extra {
+		if cl, err := contentline.Parse(line); err == nil && cl.Name == "N" {
+			hasN = true
+		}
+	}
+	if !hasN {
+		// N is required by vCard 3.0.
+		writeLine(bw, "N:"+escapeText(card.FormattedName)+";;;;")
+	}
+	if card.Org != "" {
+		writeLine(bw, "ORG:"+escapeText(card.Org))
+	}
+	for _, e := range card.Emails {
+		types := append([]string{"INTERNET"}, e.Types...)
+		if e.Pref {
+			types = append(types, "pref")
+		}
+		writeLine(bw, "EMAIL;TYPE="+strings.Join(types, ",")+":"+e.Addr)
+	}
+	for _, p := range card.Phones {
+		line := "TEL"
+		if len(p.Types) > 0 {
+			line += ";TYPE=" + strings.Join(p.Types, ",")
+		}
+		writeLine(bw, line+":"+escapeText(p.Number))
+	}
+	for _, line := range card.Extra {
+		writeLine(bw, line)
+	}
+	writeLine(bw, "END:VCARD")
+	return bw.Flush()
+}
+
+// writeLine writes a content line, folding it at 75 octets
+// without splitting a UTF-8 sequence.
+func writeLine(w *bufio.Writer, line string) {
+	n := 75
+	for len(line) > n {
+		i := n
+		for i > 0 && line[i]&0xc0 == 0x80 {
+			i--
+		}
+		w.WriteString(line[:i])
+		w.WriteString("\r\n ")
+		line = line[i:]
+		n = 74 // leave room for the leading space
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
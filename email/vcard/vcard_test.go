@@ -0,0 +1,114 @@
+package vcard
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const appleCard = `BEGIN:VCARD
+VERSION:3.0
+PRODID:-//Apple Inc.//iPhone OS 12.3.1//EN
+N:Smith;Alice;;;
+FN:Alice Smith
+ORG:Example\, Inc.;Sales;
+item1.EMAIL;type=INTERNET;type=pref:alice@example.com
+item1.X-ABLabel:_$!<Other>!$_
+EMAIL;type=INTERNET;type=WORK:asmith@
+ work.example.com
+TEL;type=CELL;type=VOICE;type=pref:+1 555 0100
+NOTE:Met at the\nconference
+END:VCARD
+BEGIN:VCARD
+VERSION:4.0
+UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1
+FN:Bob
+EMAIL;PREF=1:bob@example.com
+TEL;VALUE=uri;TYPE=home:tel:+1-555-0199
+END:VCARD
+`
+
+func TestParse(t *testing.T) {
+	cards, err := Parse(strings.NewReader(strings.Replace(appleCard, "\n", "\r\n", -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Card{
+		{
+			FormattedName: "Alice Smith",
+			Org:           "Example, Inc.",
+			Emails: []Email{
+				{Addr: "alice@example.com", Pref: true},
+				{Addr: "asmith@work.example.com", Types: []string{"work"}},
+			},
+			Phones: []Phone{
+				{Number: "+1 555 0100", Types: []string{"cell", "voice"}},
+			},
+			Extra: []string{
+				"N:Smith;Alice;;;",
+				"item1.X-ABLabel:_$!<Other>!$_",
+				`NOTE:Met at the\nconference`,
+			},
+		},
+		{
+			UID:           "4fbe8971-0bc3-424c-9c26-36c3e1eff6b1",
+			FormattedName: "Bob",
+			Emails:        []Email{{Addr: "bob@example.com", Pref: true}},
+			Phones:        []Phone{{Number: "+1-555-0199", Types: []string{"home"}}},
+		},
+	}
+	if !reflect.DeepEqual(cards, want) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", cards, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"FN:Alice\r\n",
+		"BEGIN:VCARD\r\nFN:Alice\r\n",
+		"BEGIN:VCARD\r\nBEGIN:VCARD\r\n",
+		"BEGIN:VCARD\r\nFN\r\nEND:VCARD\r\n",
+	} {
+		if _, err := Parse(strings.NewReader(text)); err == nil {
+			t.Errorf("Parse(%q): no error", text)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	card := &Card{
+		UID:           "c1",
+		FormattedName: "Smith; Alice",
+		Emails:        []Email{{Addr: "alice@example.com", Types: []string{"home"}, Pref: true}},
+		Phones:        []Phone{{Number: "+1 555 0100", Types: []string{"cell"}}},
+		Extra:         []string{"NOTE:" + strings.Repeat("x", 100)},
+	}
+	buf := new(bytes.Buffer)
+	if err := card.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"PRODID:-//spilled.ink//spilld//EN\r\n" +
+		"UID:c1\r\n" +
+		"FN:Smith\\; Alice\r\n" +
+		"N:Smith\\; Alice;;;;\r\n" +
+		"EMAIL;TYPE=INTERNET,home,pref:alice@example.com\r\n" +
+		"TEL;TYPE=cell:+1 555 0100\r\n" +
+		"NOTE:" + strings.Repeat("x", 70) + "\r\n " + strings.Repeat("x", 30) + "\r\n" +
+		"END:VCARD\r\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Encode:\n got %q\nwant %q", got, want)
+	}
+
+	cards, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card.Extra = append([]string{"N:Smith\\; Alice;;;;"}, card.Extra...)
+	if !reflect.DeepEqual(&cards[0], card) {
+		t.Errorf("round trip:\n got %+v\nwant %+v", cards[0], *card)
+	}
+}
@@ -1,6 +1,6 @@
 /*
 Package css implements a CSS tokenizer and parser.
-The parser is currently incomplete, it only covers declaration lists.
+The parser covers declaration lists and style sheets.
 
 It is written to the CSS Syntax Module Level 3 specification,
 https://www.w3.org/TR/css-syntax-3/.
@@ -46,5 +46,14 @@ An example of parsing a style attribute:
 		// and any parse errors are reported to errh.
 	}
 
+An example of parsing the contents of a <style> element:
+
+	p := css.NewParser(css.NewScanner(r, errh))
+	sheet := p.ParseStylesheet()
+	for _, rule := range sheet.Rules {
+		// Qualified rules have rule.Prelude (the selectors)
+		// and rule.Decls. At-rules have a rule.AtKeyword.
+	}
+
 */
 package css
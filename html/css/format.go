@@ -1,6 +1,7 @@
 package css
 
 import (
+	"io"
 	"strconv"
 )
 
@@ -9,8 +10,11 @@ func appendEscapedString(dst, src []byte) []byte {
 		switch c {
 		case '\\':
 			dst = append(dst, '\\', '\\')
-		case '\n':
-			dst = append(dst, '\\', '\n')
+		case '\n', '\r', '\f', '<':
+			// A backslash-newline in a string is a line
+			// continuation, so use a hex escape.
+			// Escaping '<' keeps "</style>" out of the output.
+			dst = appendHexEscape(dst, c)
 		case '"':
 			dst = append(dst, '\\', '"')
 		default:
@@ -20,16 +24,58 @@ func appendEscapedString(dst, src []byte) []byte {
 	return dst
 }
 
+// appendName appends src escaping any bytes
+// that are not CSS name code points.
+func appendName(dst, src []byte) []byte {
+	for _, c := range src {
+		switch {
+		case c >= 0x80, c == '_', c == '-',
+			'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			dst = append(dst, c)
+		case c < 0x20, c == 0x7f:
+			dst = appendHexEscape(dst, c)
+		default:
+			dst = append(dst, '\\', c)
+		}
+	}
+	return dst
+}
+
+// appendIdent appends src as a CSS identifier.
+// It is escaped so that it scans as a single identifier.
+func appendIdent(dst, src []byte) []byte {
+	start := src
+	if len(start) > 0 && start[0] == '-' {
+		dst = append(dst, '-')
+		start = start[1:]
+	}
+	if len(start) > 0 && '0' <= start[0] && start[0] <= '9' {
+		// An identifier cannot start with a digit.
+		dst = appendHexEscape(dst, start[0])
+		start = start[1:]
+	}
+	return appendName(dst, start)
+}
+
+func appendHexEscape(dst []byte, c byte) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '\\')
+	if c >= 0x10 {
+		dst = append(dst, hex[c>>4])
+	}
+	return append(dst, hex[c&0xf], ' ')
+}
+
 func AppendValue(dst []byte, v *Value) []byte {
 	switch v.Type {
 	case ValueIdent:
-		dst = appendEscapedString(dst, v.Value)
+		dst = appendIdent(dst, v.Value)
 	case ValueFunction:
-		dst = appendEscapedString(dst, v.Value)
+		dst = appendIdent(dst, v.Value)
 		dst = append(dst, '(')
 	case ValueHash, ValueHashID:
 		dst = append(dst, '#')
-		dst = appendEscapedString(dst, v.Value)
+		dst = appendName(dst, v.Value)
 	case ValueString:
 		dst = append(dst, '"')
 		dst = appendEscapedString(dst, v.Value)
@@ -67,7 +113,7 @@ func AppendValue(dst []byte, v *Value) []byte {
 }
 
 func AppendDecl(dst []byte, d *Decl) []byte {
-	dst = appendEscapedString(dst, d.Property)
+	dst = appendIdent(dst, d.Property)
 	dst = append(dst, ':', ' ')
 	for i := range d.Values {
 		v := &d.Values[i]
@@ -84,6 +130,179 @@ func AppendDecl(dst []byte, d *Decl) []byte {
 		}
 		dst = AppendValue(dst, v)
 	}
+	if d.BangImportant {
+		dst = append(dst, " !important"...)
+	}
 	dst = append(dst, ';')
 	return dst
 }
+
+// AppendComponent appends the CSS text of a component value.
+func AppendComponent(dst []byte, c *Component) []byte {
+	switch c.Type {
+	case ComponentFunc:
+		dst = appendIdent(dst, c.Value)
+		dst = append(dst, '(')
+		dst = AppendComponents(dst, c.Values)
+		dst = append(dst, ')')
+	case ComponentBlockParen:
+		dst = append(dst, '(')
+		dst = AppendComponents(dst, c.Values)
+		dst = append(dst, ')')
+	case ComponentBlockBrack:
+		dst = append(dst, '[')
+		dst = AppendComponents(dst, c.Values)
+		dst = append(dst, ']')
+	case ComponentBlockBrace:
+		dst = append(dst, '{')
+		dst = AppendComponents(dst, c.Values)
+		dst = append(dst, '}')
+	case ComponentValue:
+		dst = appendToken(dst, c)
+	}
+	return dst
+}
+
+// AppendComponents appends the CSS text of a list of component values.
+// Whitespace is kept between components that were separated by it.
+func AppendComponents(dst []byte, values []Component) []byte {
+	for i := range values {
+		c := &values[i]
+		if i > 0 && c.Space {
+			dst = append(dst, ' ')
+		}
+		dst = AppendComponent(dst, c)
+	}
+	return dst
+}
+
+func appendToken(dst []byte, c *Component) []byte {
+	switch c.Token {
+	case Ident:
+		dst = appendIdent(dst, c.Value)
+	case AtKeyword:
+		dst = append(dst, '@')
+		dst = appendIdent(dst, c.Value)
+	case Hash:
+		dst = append(dst, '#')
+		dst = appendName(dst, c.Value)
+	case String:
+		dst = append(dst, '"')
+		dst = appendEscapedString(dst, c.Value)
+		dst = append(dst, '"')
+	case URL:
+		dst = append(dst, `url("`...)
+		dst = appendEscapedString(dst, c.Value)
+		dst = append(dst, `")`...)
+	case BadString, BadURL:
+		// Dropped, they are parse errors.
+	default:
+		if len(c.Literal) > 0 {
+			dst = append(dst, c.Literal...)
+		} else {
+			dst = append(dst, tokenText[c.Token]...)
+		}
+	}
+	return dst
+}
+
+// tokenText is the CSS text of tokens that have no literal.
+var tokenText = [...]string{
+	IncludeMatch:   "~=",
+	DashMatch:      "|=",
+	PrefixMatch:    "^=",
+	SuffixMatch:    "$=",
+	SubstringMatch: "*=",
+	Column:         "||",
+	CDO:            "<!--",
+	CDC:            "-->",
+	Colon:          ":",
+	Semicolon:      ";",
+	Comma:          ",",
+	LeftBrack:      "[",
+	RightBrack:     "]",
+	LeftParen:      "(",
+	RightParen:     ")",
+	LeftBrace:      "{",
+	RightBrace:     "}",
+}
+
+// AppendRule appends the CSS text of a rule.
+func AppendRule(dst []byte, r *Rule) []byte {
+	if len(r.AtKeyword) > 0 {
+		dst = append(dst, '@')
+		dst = appendIdent(dst, r.AtKeyword)
+		if len(r.Prelude) > 0 {
+			dst = append(dst, ' ')
+		}
+	}
+	dst = AppendComponents(dst, r.Prelude)
+	if !r.HasBlock {
+		return append(dst, ';')
+	}
+	if len(r.Prelude) > 0 {
+		dst = append(dst, ' ')
+	}
+	dst = append(dst, '{')
+	for i := range r.Decls {
+		dst = append(dst, ' ')
+		dst = AppendDecl(dst, &r.Decls[i])
+	}
+	for i := range r.Rules {
+		dst = append(dst, ' ')
+		dst = AppendRule(dst, &r.Rules[i])
+	}
+	if len(r.Block) > 0 {
+		dst = append(dst, ' ')
+		dst = AppendComponents(dst, r.Block)
+	}
+	if len(r.Decls) > 0 || len(r.Rules) > 0 || len(r.Block) > 0 {
+		dst = append(dst, ' ')
+	}
+	return append(dst, '}')
+}
+
+// AppendStylesheet appends the CSS text of a style sheet,
+// one rule per line.
+func AppendStylesheet(dst []byte, sheet *Stylesheet) []byte {
+	for i := range sheet.Rules {
+		dst = AppendRule(dst, &sheet.Rules[i])
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// Writer writes CSS text.
+//
+// The output of a Writer parses back to the same
+// declarations and rules that were written.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter creates a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteDecl writes a declaration.
+func (w *Writer) WriteDecl(d *Decl) error {
+	w.buf = AppendDecl(w.buf[:0], d)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// WriteRule writes a rule.
+func (w *Writer) WriteRule(r *Rule) error {
+	w.buf = AppendRule(w.buf[:0], r)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// WriteStylesheet writes a style sheet.
+func (w *Writer) WriteStylesheet(sheet *Stylesheet) error {
+	w.buf = AppendStylesheet(w.buf[:0], sheet)
+	_, err := w.w.Write(w.buf)
+	return err
+}
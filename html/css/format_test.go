@@ -1,6 +1,8 @@
 package css
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +16,71 @@ func TestAppendDecl(t *testing.T) {
 		})
 	}
 }
+
+var formatStylesheetTests = []struct {
+	name string
+	text string
+	want string
+}{
+	{
+		name: "style rules",
+		text: `div   p,a:hover{color:red!important;border:1px solid}`,
+		want: "div p,a:hover { color: red !important; border: 1px solid; }\n",
+	},
+	{
+		name: "at-rules",
+		text: `@import url(foo.css) screen;@media screen and (max-width:600px){.a{color:blue}}`,
+		want: "@import url(\"foo.css\") screen;\n@media screen and (max-width:600px) { .a { color: blue; } }\n",
+	},
+	{
+		name: "escapes",
+		text: `.a\ b, #\31 23 { content: "x\"\A y"; font-family: \31 st }`,
+		want: ".a\\ b, #123 { content: \"x\\\"\\a y\"; font-family: \\31 st; }\n",
+	},
+	{
+		name: "end style",
+		text: `a[title="</style>"] { content: "</style>" }`,
+		want: "a[title=\"\\3c /style>\"] { content: \"\\3c /style>\"; }\n",
+	},
+	{
+		name: "attribute selectors",
+		text: `a[href^="http"], a[class~=x], a[lang|=en] {}`,
+		want: "a[href^=\"http\"], a[class~=x], a[lang|=en] {}\n",
+	},
+}
+
+func TestAppendStylesheet(t *testing.T) {
+	errh := func(line, col, n int, msg string) {}
+	parse := func(text string) *Stylesheet {
+		return NewParser(NewScanner(strings.NewReader(text), errh)).ParseStylesheet()
+	}
+	for _, test := range formatStylesheetTests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(AppendStylesheet(nil, parse(test.text)))
+			if got != test.want {
+				t.Errorf("\n got: %q\nwant: %q", got, test.want)
+			}
+			again := string(AppendStylesheet(nil, parse(got)))
+			if again != got {
+				t.Errorf("round trip:\n got: %q\nwant: %q", again, got)
+			}
+		})
+	}
+}
+
+func TestWriterDecl(t *testing.T) {
+	errh := func(line, col, n int, msg string) {}
+	p := NewParser(NewScanner(strings.NewReader(`color: red ! IMPORTANT; width: 0`), errh))
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	var decl Decl
+	for p.ParseDecl(&decl) {
+		if err := w.WriteDecl(&decl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const want = `color: red !important;width: 0;`
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
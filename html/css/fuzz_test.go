@@ -0,0 +1,25 @@
+package css
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzCSSScanner(f *testing.F) {
+	for _, test := range scannerTests {
+		f.Add(test.input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		s := NewScanner(strings.NewReader(input), func(line, col, n int, msg string) {})
+		// Every token but EOF consumes input.
+		for i := 0; ; i++ {
+			if i > len(input) {
+				t.Fatalf("%d tokens from %d bytes of input", i, len(input))
+			}
+			s.Next()
+			if s.Token == EOF {
+				break
+			}
+		}
+	})
+}
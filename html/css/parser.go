@@ -7,7 +7,9 @@ import (
 
 // Parser parses CSS.
 type Parser struct {
-	s *Scanner
+	s      *Scanner
+	unread bool // the current token is to be returned again by next
+	depth  int  // {}-block nesting depth of rule parsing
 }
 
 // NewParser creates a new CSS parser.
@@ -46,6 +48,10 @@ func (p *Parser) ParseDecl(decl *Decl) bool {
 }
 
 func (p *Parser) next() {
+	if p.unread {
+		p.unread = false
+		return
+	}
 	p.s.Next()
 }
 
@@ -65,7 +71,7 @@ func (p *Parser) parseDecl(d *Decl) bool {
 		return false
 	}
 	p.next()
-	for p.s.Token != EOF && p.s.Token != Semicolon {
+	for p.s.Token != EOF && p.s.Token != Semicolon && !p.blockEnd() {
 		if len(d.Values) == cap(d.Values) {
 			d.Values = append(d.Values, Value{})
 		} else {
@@ -91,9 +97,21 @@ func (p *Parser) parseDecl(d *Decl) bool {
 		}
 		p.next()
 	}
+
+	// A trailing "!important" is a flag, not part of the value.
+	if n := len(d.Values); n >= 2 {
+		bang, imp := &d.Values[n-2], &d.Values[n-1]
+		if bang.Type == ValueDelim && string(bang.Value) == "!" &&
+			imp.Type == ValueIdent && bytes.EqualFold(imp.Value, important) {
+			d.Values = d.Values[:n-2]
+			d.BangImportant = true
+		}
+	}
 	return true
 }
 
+var important = []byte("important")
+
 func (p *Parser) valueType() (t ValueType, number float64) {
 	switch p.s.Token {
 	case Ident:
@@ -258,34 +276,279 @@ func (d *Decl) clear() {
 	d.BangImportant = false
 }
 
-/*
+// ParseStylesheet parses a CSS style sheet,
+// such as the contents of an HTML <style> element.
+//
+// Parse errors are reported to the scanner's error handler
+// and the invalid rules are dropped.
+func (p *Parser) ParseStylesheet() *Stylesheet {
+	sheet := &Stylesheet{}
+	for {
+		var rule Rule
+		if !p.ParseRule(&rule) {
+			break
+		}
+		sheet.Rules = append(sheet.Rules, rule)
+	}
+	return sheet
+}
+
+// ParseRule parses the next rule of a CSS style sheet.
+// It reports false when there are no more rules.
+func (p *Parser) ParseRule(rule *Rule) bool {
+	// CSS Syntax 5.4.1 "Consume a list of rules", top-level flag set
+	for {
+		*rule = Rule{}
+		p.next()
+		switch p.s.Token {
+		case EOF:
+			return false
+		case CDO, CDC:
+			continue
+		case AtKeyword:
+			p.parseAtRule(rule)
+			return true
+		default:
+			if p.parseQualifiedRule(rule) {
+				return true
+			}
+		}
+	}
+}
+
+// blockEnd reports whether the current token closes the {}-block
+// of the rule being parsed.
+func (p *Parser) blockEnd() bool {
+	return p.depth > 0 && p.s.Token == RightBrace
+}
+
+func (p *Parser) parseAtRule(rule *Rule) {
+	// CSS Syntax 5.4.2 "Consume an at-rule"
+	rule.Pos = Position{Line: p.s.Line, Col: p.s.Col}
+	rule.AtKeyword = append(rule.AtKeyword, p.s.Value...)
+	for {
+		p.next()
+		switch p.s.Token {
+		case Semicolon, EOF:
+			return
+		case LeftBrace:
+			rule.HasBlock = true
+			switch name := string(bytes.ToLower(rule.AtKeyword)); {
+			case declBlockAtRules[name]:
+				p.parseDeclBlock(&rule.Decls)
+			case ruleBlockAtRules[name]:
+				p.parseRuleBlock(&rule.Rules)
+			default:
+				rule.Block = p.parseComponents(RightBrace)
+			}
+			return
+		}
+		if p.blockEnd() {
+			p.unread = true
+			return
+		}
+		rule.Prelude = append(rule.Prelude, p.parseComponent())
+	}
+}
+
+func (p *Parser) parseQualifiedRule(rule *Rule) bool {
+	// CSS Syntax 5.4.3 "Consume a qualified rule"
+	rule.Pos = Position{Line: p.s.Line, Col: p.s.Col}
+	for {
+		switch p.s.Token {
+		case EOF:
+			p.error("bad rule: unexpected EOF")
+			return false
+		case LeftBrace:
+			rule.HasBlock = true
+			p.parseDeclBlock(&rule.Decls)
+			return true
+		}
+		if p.blockEnd() {
+			p.error("bad rule: unexpected '}'")
+			p.unread = true
+			return false
+		}
+		rule.Prelude = append(rule.Prelude, p.parseComponent())
+		p.next()
+	}
+}
+
+// parseDeclBlock parses the contents of a {}-block
+// holding a list of declarations.
+func (p *Parser) parseDeclBlock(decls *[]Decl) {
+	// CSS Syntax 5.4.4 "Consume a list of declarations"
+	p.depth++
+	defer func() { p.depth-- }()
+
+	for {
+		p.next()
+		switch p.s.Token {
+		case EOF:
+			p.error("bad block: unexpected EOF")
+			return
+		case RightBrace:
+			return
+		case Semicolon:
+			continue
+		case AtKeyword:
+			// Nested at-rules are not kept in declaration lists.
+			var rule Rule
+			p.parseAtRule(&rule)
+			continue
+		case Ident:
+			var d Decl
+			if p.parseDecl(&d) {
+				*decls = append(*decls, d)
+			}
+		default:
+			p.error("invalid token")
+		}
+		p.skipDecl()
+		if p.s.Token == EOF || p.s.Token == RightBrace {
+			return
+		}
+	}
+}
+
+// skipDecl skips the remainder of an invalid declaration.
+func (p *Parser) skipDecl() {
+	for p.s.Token != EOF && p.s.Token != Semicolon && !p.blockEnd() {
+		p.parseComponent()
+		p.next()
+	}
+}
+
+// parseRuleBlock parses the contents of a {}-block
+// holding a list of rules.
+func (p *Parser) parseRuleBlock(rules *[]Rule) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	for {
+		var rule Rule
+		p.next()
+		switch p.s.Token {
+		case EOF:
+			p.error("bad block: unexpected EOF")
+			return
+		case RightBrace:
+			return
+		case Semicolon:
+			continue
+		case AtKeyword:
+			p.parseAtRule(&rule)
+			*rules = append(*rules, rule)
+		default:
+			if p.parseQualifiedRule(&rule) {
+				*rules = append(*rules, rule)
+			}
+		}
+	}
+}
+
+// parseComponent parses the component value starting at the current token.
+func (p *Parser) parseComponent() Component {
+	// CSS Syntax 5.4.7 "Consume a component value"
+	c := Component{
+		Pos:   Position{Line: p.s.Line, Col: p.s.Col},
+		Space: p.s.Space,
+		Token: p.s.Token,
+	}
+	switch p.s.Token {
+	case Function:
+		c.Type = ComponentFunc
+		c.Value = append(c.Value, p.s.Value...)
+		c.Values = p.parseComponents(RightParen)
+	case LeftParen:
+		c.Type = ComponentBlockParen
+		c.Values = p.parseComponents(RightParen)
+	case LeftBrack:
+		c.Type = ComponentBlockBrack
+		c.Values = p.parseComponents(RightBrack)
+	case LeftBrace:
+		c.Type = ComponentBlockBrace
+		c.Values = p.parseComponents(RightBrace)
+	default:
+		c.Type = ComponentValue
+		c.Literal = append(c.Literal, p.s.Literal...)
+		c.Value = append(c.Value, p.s.Value...)
+	}
+	return c
+}
+
+// parseComponents parses component values up to the end token.
+func (p *Parser) parseComponents(end Token) (values []Component) {
+	// CSS Syntax 5.4.8 "Consume a simple block"
+	for {
+		p.next()
+		switch p.s.Token {
+		case end:
+			return values
+		case EOF:
+			p.error("bad block: unexpected EOF")
+			return values
+		}
+		values = append(values, p.parseComponent())
+	}
+}
+
+// declBlockAtRules are at-rules whose block is a list of declarations.
+var declBlockAtRules = map[string]bool{
+	"font-face": true,
+	"page":      true,
+}
+
+// ruleBlockAtRules are at-rules whose block is a list of rules.
+var ruleBlockAtRules = map[string]bool{
+	"media":             true,
+	"supports":          true,
+	"document":          true,
+	"-moz-document":     true,
+	"keyframes":         true,
+	"-webkit-keyframes": true,
+}
+
+// Stylesheet is a CSS style sheet.
 type Stylesheet struct {
 	Rules []Rule
 }
 
 // Rule is either a CSS qualified rule or a CSS at-rule.
 //
-// Rules are only produced as part of a Stylesheet.
+// How the {}-block of a rule is parsed depends on the kind of rule.
+// Qualified (style) rules, @font-face, and @page hold declarations.
+// Conditional rules such as @media and @supports, and @keyframes,
+// hold nested rules. The block of any other at-rule is kept as
+// component values.
 type Rule struct {
-	// Either len(AtToken.Literal) > 0, len(Qualifiers) > 0, or neither.
-	AtToken    Identifier
-	Qualifiers []Component
-
-	Block Component // Type == ComponentBlockBrace or ComponentNone
+	Pos       Position
+	AtKeyword []byte      // at-rule name without the '@', empty for qualified rules
+	Prelude   []Component // selectors of a qualified rule, or the at-rule prelude
+	HasBlock  bool        // rule ends with a {}-block rather than a ';'
+	Decls     []Decl
+	Rules     []Rule
+	Block     []Component
 }
 
-
-// Component is a block or a series of tokens (a "Component Value").
+// Component is a single token, a function, or a block of
+// component values (a "Component Value").
 //
 // It corresponds to several constructions the CSS Syntax spec
 // which are distinguished by the Type field.
 type Component struct {
-	Pos  Position
-	Type ComponentType
+	Pos   Position
+	Type  ComponentType
+	Space bool  // whitespace precedes the component
+	Token Token // the token, or the token opening a function or block
+
+	// Literal and Value are the raw and escaped token text
+	// for a ComponentValue. For a ComponentFunc, Value is
+	// the function name.
+	Literal []byte
+	Value   []byte
 
-	// Either len(Token.Literal) > 0 or len(Values) > 0.
-	Token  Identifier  // Type == ComponentValue
-	Values []Component // Type != CompoonentValue
+	Values []Component // block contents or function arguments
 }
 
 type ComponentType int
@@ -297,6 +560,5 @@ const (
 	ComponentBlockBrace               // https://www.w3.org/TR/css-syntax-3/#%7B%7D-block-diagram
 	ComponentBlockParen               // https://www.w3.org/TR/css-syntax-3/#%28%29-block-diagram
 	ComponentBlockBrack               // https://www.w3.org/TR/css-syntax-3/#%5B%5D-block-diagram
-	ComponentBlockFunc                // https://www.w3.org/TR/css-syntax-3/#function-block-diagram
+	ComponentFunc                     // https://www.w3.org/TR/css-syntax-3/#function-block-diagram
 )
-*/
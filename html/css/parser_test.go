@@ -246,3 +246,132 @@ func clearPos(decl *Decl) {
 		decl.Values[i].Pos = Position{}
 	}
 }
+
+var parseStylesheetTests = []struct {
+	name string
+	text string
+	want string
+}{
+	{
+		name: "style rule",
+		text: `div p, a:hover { color: red; border: 1px solid }`,
+		want: `[div p<Comma> a<Colon>hover]{color: red; border: 1px solid;}`,
+	},
+	{
+		name: "at-rules",
+		text: `@import url(foo.css) screen; @charset "utf-8";`,
+		want: `@import[url(foo.css) screen]; @charset["utf-8"];`,
+	},
+	{
+		name: "media",
+		text: `@media screen and (max-width: 600px) { .a { color: blue } #b{padding:0} }`,
+		want: `@media[screen and (max-width<Colon> 600px)]{[.a]{color: blue;} [#b]{padding: 0;}}`,
+	},
+	{
+		name: "font-face",
+		text: `<!-- @font-face { font-family: x; src: url(x.woff) } -->`,
+		want: `@font-face[]{font-family: x; src: url("x.woff");}`,
+	},
+	{
+		name: "attribute selector",
+		text: `a[href^="http"] { color: green; }`,
+		want: `[a[href<PrefixMatch>"http"]]{color: green;}`,
+	},
+	{
+		name: "unknown at-rule",
+		text: `@foo bar { baz: 1 } p { color: red }`,
+		want: `@foo[bar]{baz<Colon> 1} [p]{color: red;}`,
+	},
+}
+
+func TestParseStylesheet(t *testing.T) {
+	for _, test := range parseStylesheetTests {
+		t.Run(test.name, func(t *testing.T) {
+			errh := func(line, col, n int, msg string) {
+				t.Errorf("%d:%d: (n=%d): %s", line, col, n, msg)
+			}
+			p := NewParser(NewScanner(strings.NewReader(test.text), errh))
+			sheet := p.ParseStylesheet()
+
+			buf := new(bytes.Buffer)
+			fprintRules(buf, sheet.Rules)
+			if got := buf.String(); got != test.want {
+				t.Errorf("\ngot:  %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseStylesheetErrors(t *testing.T) {
+	const text = `p { color red; padding: 0 } }} a { margin: 0 `
+	errh := func(line, col, n int, msg string) {}
+	p := NewParser(NewScanner(strings.NewReader(text), errh))
+	sheet := p.ParseStylesheet()
+
+	buf := new(bytes.Buffer)
+	fprintRules(buf, sheet.Rules)
+	const want = `[p]{padding: 0;} [<RightBrace><RightBrace> a]{margin: 0;}`
+	if got := buf.String(); got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func fprintRules(buf *bytes.Buffer, rules []Rule) {
+	for i, rule := range rules {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		if len(rule.AtKeyword) > 0 {
+			fmt.Fprintf(buf, "@%s", rule.AtKeyword)
+		}
+		buf.WriteByte('[')
+		fprintComponents(buf, rule.Prelude)
+		buf.WriteByte(']')
+		if !rule.HasBlock {
+			buf.WriteByte(';')
+			continue
+		}
+		buf.WriteByte('{')
+		for i := range rule.Decls {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.Write(AppendDecl(nil, &rule.Decls[i]))
+		}
+		fprintRules(buf, rule.Rules)
+		fprintComponents(buf, rule.Block)
+		buf.WriteByte('}')
+	}
+}
+
+func fprintComponents(buf *bytes.Buffer, values []Component) {
+	for i, c := range values {
+		if i > 0 && c.Space {
+			buf.WriteByte(' ')
+		}
+		switch c.Type {
+		case ComponentFunc:
+			fmt.Fprintf(buf, "%s(", c.Value)
+			fprintComponents(buf, c.Values)
+			buf.WriteByte(')')
+		case ComponentBlockParen:
+			buf.WriteByte('(')
+			fprintComponents(buf, c.Values)
+			buf.WriteByte(')')
+		case ComponentBlockBrack:
+			buf.WriteByte('[')
+			fprintComponents(buf, c.Values)
+			buf.WriteByte(']')
+		case ComponentBlockBrace:
+			buf.WriteByte('{')
+			fprintComponents(buf, c.Values)
+			buf.WriteByte('}')
+		default:
+			if len(c.Literal) > 0 {
+				buf.Write(c.Literal)
+			} else {
+				fmt.Fprintf(buf, "<%s>", c.Token)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package css
+
+import (
+	"bytes"
+)
+
+// Policy is an allowlist for sanitizing CSS declarations.
+type Policy struct {
+	// Properties is the set of allowed lower-case property names.
+	Properties map[string]bool
+
+	// RewriteURL is called with the contents of each url() value.
+	// It returns the URL to use in its place, or "" to drop the
+	// declaration. If RewriteURL is nil, declarations with
+	// URLs are dropped.
+	RewriteURL func(url string) string
+
+	// LocalSelectors, if set, keeps only the selectors of style
+	// rules that match elements by class, ID or attribute in each
+	// compound selector. Selectors using a type selector such as
+	// body or p, the universal selector, or :root are removed, so
+	// the rules of a style sheet embedded in a page cannot restyle
+	// the rest of the page.
+	LocalSelectors bool
+}
+
+// unsafeFuncs are CSS functions that are never allowed.
+// Some execute script (expression), others load resources
+// outside the reach of Policy.RewriteURL.
+var unsafeFuncs = map[string]bool{
+	"expression":        true,
+	"url":               true, // a url( function with a quoted string argument
+	"image":             true,
+	"image-set":         true,
+	"-webkit-image-set": true,
+	"element":           true,
+	"cross-fade":        true,
+	"paint":             true,
+}
+
+// Sanitize appends to dst the declarations in the list src
+// that are permitted by policy.
+//
+// Declarations are dropped if their property is not allowed,
+// if they call a function that can run script or load resources,
+// or if they use fixed positioning to escape their element.
+// At-rules such as @import are never part of a declaration list
+// and are dropped.
+func Sanitize(dst, src []byte, policy *Policy) []byte {
+	errh := func(line, col, n int, msg string) {}
+	p := NewParser(NewScanner(bytes.NewReader(src), errh))
+	var decl Decl
+	i := 0
+	for {
+		if !p.ParseDecl(&decl) {
+			if p.s.Token == EOF {
+				break
+			}
+			continue // skip an invalid or empty declaration
+		}
+		if !policy.sanitize(&decl) {
+			continue
+		}
+		if i > 0 {
+			dst = append(dst, ' ')
+		}
+		i++
+		dst = AppendDecl(dst, &decl)
+	}
+	return dst
+}
+
+// sanitize reports whether d is allowed, rewriting any URLs it holds.
+func (policy *Policy) sanitize(d *Decl) bool {
+	d.Property = bytes.ToLower(d.Property)
+	if !policy.Properties[string(d.Property)] {
+		return false
+	}
+	for i := range d.Values {
+		v := &d.Values[i]
+		switch v.Type {
+		case ValueFunction:
+			if unsafeFuncs[string(bytes.ToLower(v.Value))] {
+				return false
+			}
+		case ValueURL:
+			if policy.RewriteURL == nil {
+				return false
+			}
+			u := policy.RewriteURL(string(v.Value))
+			if u == "" {
+				return false
+			}
+			v.Raw = v.Raw[:0]
+			v.Value = append(v.Value[:0], u...)
+		case ValueDelim:
+			if string(v.Value) == "<" {
+				return false
+			}
+		case ValueIdent:
+			if string(d.Property) == "position" {
+				switch string(bytes.ToLower(v.Value)) {
+				case "fixed", "sticky":
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// SanitizeStylesheet removes from sheet the rules and declarations
+// that are not permitted by policy.
+//
+// Only style rules and @media rules are kept. Rules with selectors
+// that could load resources or end an HTML <style> element are
+// dropped, as are rules left with no declarations or, with
+// LocalSelectors, no selectors.
+func SanitizeStylesheet(sheet *Stylesheet, policy *Policy) {
+	sheet.Rules = policy.sanitizeRules(sheet.Rules)
+}
+
+func (policy *Policy) sanitizeRules(rules []Rule) []Rule {
+	kept := rules[:0]
+	for _, rule := range rules {
+		if !rule.HasBlock || !safeComponents(rule.Prelude) {
+			continue
+		}
+		if len(rule.AtKeyword) > 0 {
+			if !bytes.EqualFold(rule.AtKeyword, []byte("media")) {
+				continue
+			}
+			rule.Rules = policy.sanitizeRules(rule.Rules)
+			if len(rule.Rules) == 0 {
+				continue
+			}
+			kept = append(kept, rule)
+			continue
+		}
+		if policy.LocalSelectors {
+			rule.Prelude = localSelectors(rule.Prelude)
+			if len(rule.Prelude) == 0 {
+				continue
+			}
+		}
+		decls := rule.Decls[:0]
+		for i := range rule.Decls {
+			if policy.sanitize(&rule.Decls[i]) {
+				decls = append(decls, rule.Decls[i])
+			}
+		}
+		rule.Decls = decls
+		if len(rule.Decls) == 0 {
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	return kept
+}
+
+func safeComponents(values []Component) bool {
+	for i := range values {
+		c := &values[i]
+		switch c.Type {
+		case ComponentFunc:
+			if unsafeFuncs[string(bytes.ToLower(c.Value))] {
+				return false
+			}
+		case ComponentValue:
+			switch c.Token {
+			case URL, BadURL, BadString, CDO, CDC:
+				return false
+			case Delim:
+				if string(c.Literal) == "<" {
+					return false
+				}
+			}
+		}
+		if !safeComponents(c.Values) {
+			return false
+		}
+	}
+	return true
+}
+
+// localSelectors returns the selectors of the list sel
+// that are kept under Policy.LocalSelectors.
+func localSelectors(sel []Component) (kept []Component) {
+	start := 0
+	for i := 0; i <= len(sel); i++ {
+		if i < len(sel) && !(sel[i].Type == ComponentValue && sel[i].Token == Comma) {
+			continue
+		}
+		if localSelector(sel[start:i]) {
+			if len(kept) > 0 {
+				kept = append(kept, Component{Type: ComponentValue, Token: Comma})
+			}
+			n := len(kept)
+			kept = append(kept, sel[start:i]...)
+			kept[n].Space = n > 0
+		}
+		start = i + 1
+	}
+	return kept
+}
+
+// localSelector reports whether every compound selector
+// of the complex selector sel is local.
+func localSelector(sel []Component) bool {
+	compounds := 0
+	start := 0
+	for i := 0; i <= len(sel); i++ {
+		combinator := i < len(sel) && isCombinator(&sel[i])
+		if i < len(sel) && !combinator && !(i > start && sel[i].Space) {
+			continue
+		}
+		if i > start {
+			if !localCompound(sel[start:i]) {
+				return false
+			}
+			compounds++
+		}
+		start = i
+		if combinator {
+			start = i + 1
+		}
+	}
+	return compounds > 0
+}
+
+func isCombinator(c *Component) bool {
+	if c.Type != ComponentValue || c.Token != Delim {
+		return false
+	}
+	switch string(c.Literal) {
+	case ">", "+", "~":
+		return true
+	}
+	return false
+}
+
+// localCompound reports whether a compound selector has a class,
+// ID or attribute selector and no type, universal or :root selector.
+func localCompound(sel []Component) bool {
+	local := false
+	for i := range sel {
+		c := &sel[i]
+		if c.Type == ComponentBlockBrack {
+			local = true
+			continue
+		}
+		if c.Type != ComponentValue {
+			continue
+		}
+		switch c.Token {
+		case Hash:
+			local = true
+		case Delim:
+			if string(c.Literal) == "*" {
+				return false
+			}
+		case Ident:
+			if i == 0 {
+				return false // type selector
+			}
+			prev := &sel[i-1]
+			if prev.Token == Delim && string(prev.Literal) == "." {
+				local = true
+			}
+			if prev.Token == Colon && bytes.EqualFold(c.Value, []byte("root")) {
+				return false
+			}
+		}
+	}
+	return local
+}
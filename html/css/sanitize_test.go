@@ -0,0 +1,147 @@
+package css
+
+import (
+	"strings"
+	"testing"
+)
+
+var sanitizeTests = []struct {
+	name string
+	in   string
+	out  string
+}{
+	{
+		name: "allowed",
+		in:   `color: red; border: 1px solid black`,
+		out:  `color: red; border: 1px solid black;`,
+	},
+	{
+		name: "disallowed property",
+		in:   `color: red; -moz-binding: foo; behavior: bar`,
+		out:  `color: red;`,
+	},
+	{
+		name: "property case",
+		in:   `COLOR: red`,
+		out:  `color: red;`,
+	},
+	{
+		name: "expression",
+		in:   `width: expression(alert(1)); color: red`,
+		out:  `color: red;`,
+	},
+	{
+		name: "escaped expression",
+		in:   `width: expr\65ssion(alert(1)); color: red`,
+		out:  `color: red;`,
+	},
+	{
+		name: "url rewrite",
+		in:   `background: url(http://example.com/a.png) blue`,
+		out:  `background: url("https://proxy.example/a.png") blue;`,
+	},
+	{
+		name: "url dropped",
+		in:   `background: url(http://bad.example/a.png); color: red`,
+		out:  `color: red;`,
+	},
+	{
+		name: "image-set",
+		in:   `background: image-set("a.png" 1x); color: red`,
+		out:  `color: red;`,
+	},
+	{
+		name: "position fixed",
+		in:   `position: fixed; position: relative`,
+		out:  `position: relative;`,
+	},
+	{
+		name: "import",
+		in:   `@import url(http://example.com/evil.css); color: red`,
+		out:  `color: red;`,
+	},
+}
+
+func TestSanitize(t *testing.T) {
+	policy := &Policy{
+		Properties: map[string]bool{
+			"background": true,
+			"border":     true,
+			"color":      true,
+			"position":   true,
+			"width":      true,
+		},
+		RewriteURL: func(u string) string {
+			if strings.HasPrefix(u, "http://example.com/") {
+				return "https://proxy.example/" + strings.TrimPrefix(u, "http://example.com/")
+			}
+			return ""
+		},
+	}
+	for _, test := range sanitizeTests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(Sanitize(nil, []byte(test.in), policy))
+			if got != test.out {
+				t.Errorf("Sanitize(%q)\n\t   = %q,\n\twant %q", test.in, got, test.out)
+			}
+		})
+	}
+}
+
+func TestSanitizeStylesheet(t *testing.T) {
+	const text = `@import url(http://example.com/evil.css);
+		p { color: red; position: fixed; -moz-binding: url(x) }
+		div { position: fixed }
+		a[href=url(x)] { color: blue }
+		@media screen { .a { background: url(http://example.com/a.png); width: expression(1) } }
+		@font-face { font-family: x; src: url(x.woff) }`
+	const want = "p { color: red; }\n" +
+		"@media screen { .a { background: url(\"https://proxy.example/a.png\"); } }\n"
+
+	policy := &Policy{
+		Properties: map[string]bool{"background": true, "color": true, "position": true, "width": true},
+		RewriteURL: func(u string) string {
+			return "https://proxy.example/" + strings.TrimPrefix(u, "http://example.com/")
+		},
+	}
+	errh := func(line, col, n int, msg string) {}
+	sheet := NewParser(NewScanner(strings.NewReader(text), errh)).ParseStylesheet()
+	SanitizeStylesheet(sheet, policy)
+	if got := string(AppendStylesheet(nil, sheet)); got != want {
+		t.Errorf("\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestLocalSelectors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{".a { color: red }", ".a { color: red; }\n"},
+		{"#a .b > [title=x] { color: red }", "#a .b > [title=x] { color: red; }\n"},
+		{".a:hover, .b::before { color: red }", ".a:hover, .b::before { color: red; }\n"},
+		{"* { color: red }", ""},
+		{"body { color: red }", ""},
+		{"html, .a { color: red }", ".a { color: red; }\n"},
+		{".a, BODY, .b { color: red }", ".a, .b { color: red; }\n"},
+		{"p.a { color: red }", ""},
+		{".a p { color: red }", ""},
+		{".a > * { color: red }", ""},
+		{".a *.b { color: red }", ""},
+		{":root { color: red }", ""},
+		{":not(.a) { color: red }", ""},
+		{"@media screen { body { color: red } .a { color: red } }", "@media screen { .a { color: red; } }\n"},
+		{"@media screen { body { color: red } }", ""},
+	}
+	policy := &Policy{
+		Properties:     map[string]bool{"color": true},
+		LocalSelectors: true,
+	}
+	errh := func(line, col, n int, msg string) {}
+	for _, test := range tests {
+		sheet := NewParser(NewScanner(strings.NewReader(test.in), errh)).ParseStylesheet()
+		SanitizeStylesheet(sheet, policy)
+		if got := string(AppendStylesheet(nil, sheet)); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
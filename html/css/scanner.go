@@ -77,6 +77,7 @@ type Scanner struct {
 	Line       int      // line number at token beginning
 	Col        int      // column offset in bytes at token beginning
 	N          int      // byte offset at token beginning
+	Space      bool     // whitespace or a comment precedes the token
 
 	source *_SourceReader
 }
@@ -103,12 +104,14 @@ func (s *Scanner) Next() {
 	s.Unit = nil
 	s.RangeStart = 0
 	s.RangeEnd = 0
+	s.Space = false
 
 	// CSS Syntax 4.3.1 consume as much whitespace as possible
 redo:
 	s.updatePos()
 	c := s.source.GetRune()
 	for isWhitespace(c) {
+		s.Space = true
 		s.updatePos()
 		c = s.source.GetRune()
 	}
@@ -199,6 +202,7 @@ redo:
 		if s.source.PeekRune() == '*' {
 			s.source.GetRune()
 			s.skipComment()
+			s.Space = true
 			goto redo
 		} else {
 			s.Token = Delim
@@ -0,0 +1,37 @@
+package htmlproxy
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSigner(t *testing.T) {
+	s := &Signer{Path: "/proxy", Key: []byte("secret")}
+	const remote = "https://tracker.example/p.gif?id=1&x=2"
+
+	u, err := url.Parse(s.URL(remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/proxy" {
+		t.Errorf("path=%q, want /proxy", u.Path)
+	}
+	got, ok := s.Check(u.Query())
+	if !ok || got != remote {
+		t.Errorf("Check=%q, %v, want %q, true", got, ok, remote)
+	}
+
+	q := u.Query()
+	q.Set("url", strings.Replace(remote, "id=1", "id=2", 1))
+	if _, ok := s.Check(q); ok {
+		t.Error("Check accepted a modified URL")
+	}
+	other := &Signer{Path: "/proxy", Key: []byte("other")}
+	if _, ok := other.Check(u.Query()); ok {
+		t.Error("Check accepted a URL signed with another key")
+	}
+	if _, ok := s.Check(url.Values{"url": {remote}}); ok {
+		t.Error("Check accepted an unsigned URL")
+	}
+}
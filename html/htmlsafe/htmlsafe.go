@@ -5,8 +5,6 @@
 // clients.
 package htmlsafe
 
-// TODO: allow a top-level <style> tag with careful CSS filtering.
-
 import (
 	"bytes"
 	"fmt"
@@ -44,7 +42,7 @@ var StrictEmail = &Options{
 		a.H6:     Tag{Attrs: []a.Atom{a.Align, a.Class, a.Dir, a.Id, a.Style}},
 		a.Head:   Tag{Attrs: []a.Atom{a.Dir, a.Lang}},
 		a.Hr:     Tag{Attrs: []a.Atom{a.Align, a.Size, a.Width}},
-		a.Img:    Tag{Attrs: []a.Atom{a.Align, a.Class, a.Height, a.Id, a.Src, a.Style, a.Usemap, a.Width}},
+		a.Img:    Tag{Attrs: []a.Atom{a.Align, a.Class, a.Height, a.Id, a.Src, a.Srcset, a.Style, a.Usemap, a.Width}},
 		a.Label:  Tag{Attrs: []a.Atom{a.Class, a.Id, a.Style}},
 		a.Li:     Tag{Attrs: []a.Atom{a.Class, a.Dir, a.Id, a.Style, a.Type}},
 		a.Ol:     Tag{Attrs: []a.Atom{a.Class, a.Dir, a.Id, a.Style, a.Type}},
@@ -110,6 +108,7 @@ var Safe = unionOptions(*StrictEmail, Options{
 	AllowedTags: map[a.Atom]Tag{
 		a.Html:  Tag{},
 		a.Body:  Tag{Attrs: []a.Atom{a.Dir, a.Style}},
+		a.Style: Tag{Attrs: []a.Atom{a.Type}},
 		a.Title: Tag{Attrs: []a.Atom{a.Dir}},
 	},
 })
@@ -163,6 +162,7 @@ func (s *Sanitizer) Sanitize(dst io.Writer, src io.Reader) (n int, err error) {
 	}
 
 	discarding := false
+	inStyle := false
 
 	z := html.NewTokenizer(src)
 	z.SetMaxBuf(s.MaxBuf)
@@ -182,6 +182,7 @@ func (s *Sanitizer) Sanitize(dst io.Writer, src io.Reader) (n int, err error) {
 			allowTag, found := opts.AllowedTags[t.DataAtom]
 			if found {
 				discarding = false
+				inStyle = t.DataAtom == a.Style && !selfClosing
 			} else {
 				discarding = true
 				break
@@ -204,6 +205,8 @@ func (s *Sanitizer) Sanitize(dst io.Writer, src io.Reader) (n int, err error) {
 					n2, err = s.styleAttr(dst, attr.Val, opts)
 				case a.Href, a.Src:
 					n2, err = s.urlAttr(dst, key, attr.Val)
+				case a.Srcset:
+					n2, err = s.srcsetAttr(dst, attr.Val)
 				default:
 					n2, err = fmt.Fprintf(dst, " %s=%q", attr.Key, attr.Val)
 				}
@@ -224,11 +227,20 @@ func (s *Sanitizer) Sanitize(dst io.Writer, src io.Reader) (n int, err error) {
 			continue
 		case html.EndTagToken:
 			discarding = false
+			inStyle = false
 			t := z.Token()
 			if _, found := opts.AllowedTags[t.DataAtom]; !found {
 				continue
 			}
-			//case html.TextToken:
+		case html.TextToken:
+			if inStyle {
+				n2, err := s.styleElem(dst, z.Text(), opts)
+				n += n2
+				if err != nil {
+					return n, err
+				}
+				continue
+			}
 		}
 
 		if !discarding {
@@ -254,6 +266,91 @@ func (s *Sanitizer) urlAttr(dst io.Writer, attr a.Atom, val string) (n int, err
 	return 0, nil
 }
 
+// srcsetAttr writes an image candidate list, rewriting each URL.
+// Candidates with URLs that are removed are dropped.
+func (s *Sanitizer) srcsetAttr(dst io.Writer, val string) (n int, err error) {
+	var buf []byte
+	for _, c := range parseSrcset(val) {
+		if len(c.descs) > 1 {
+			continue
+		}
+		u := s.rewriteURL(a.Srcset, c.url)
+		if u == "" {
+			continue
+		}
+		if len(buf) > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = append(buf, u...)
+		for _, desc := range c.descs {
+			buf = append(buf, ' ')
+			buf = append(buf, desc...)
+		}
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(buf)+32))
+	out.WriteString(" srcset=\"")
+	escapeAttr(out, buf)
+	out.WriteByte('"')
+	return dst.Write(out.Bytes())
+}
+
+type srcsetCandidate struct {
+	url   string
+	descs []string
+}
+
+// parseSrcset splits a srcset attribute into image candidates as
+// the HTML specification does. A URL runs to the next whitespace,
+// so it may hold commas. Trailing commas end a URL with no
+// descriptors, otherwise a comma outside parentheses ends the
+// descriptors of a candidate.
+func parseSrcset(val string) (candidates []srcsetCandidate) {
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+	}
+	i := 0
+	for {
+		for i < len(val) && (isSpace(val[i]) || val[i] == ',') {
+			i++
+		}
+		if i == len(val) {
+			return candidates
+		}
+		start := i
+		for i < len(val) && !isSpace(val[i]) {
+			i++
+		}
+		c := srcsetCandidate{url: val[start:i]}
+		if strings.HasSuffix(c.url, ",") {
+			c.url = strings.TrimRight(c.url, ",")
+			candidates = append(candidates, c)
+			continue
+		}
+		start = i
+		depth := 0
+	descs:
+		for ; i < len(val); i++ {
+			switch val[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				}
+			case ',':
+				if depth == 0 {
+					break descs
+				}
+			}
+		}
+		c.descs = strings.Fields(val[start:i])
+		candidates = append(candidates, c)
+	}
+}
+
 func (s *Sanitizer) rewriteURL(attr a.Atom, val string) string {
 	u, err := url.Parse(strings.TrimSpace(val))
 	if err != nil {
@@ -274,32 +371,11 @@ func (s *Sanitizer) rewriteURL(attr a.Atom, val string) string {
 }
 
 func (s *Sanitizer) styleAttr(dst io.Writer, val string, opts *Options) (n int, err error) {
-	var buf []byte
-
-	i := 0
-	errh := func(line, col, n int, msg string) {}
-	p := css.NewParser(css.NewScanner(strings.NewReader(val), errh))
-	var decl css.Decl
-	for p.ParseDecl(&decl) {
-		key := decl.Property
-		if !opts.AllowedStyles[string(key)] {
-			continue
-		}
-		if i > 0 {
-			buf = append(buf, ' ')
-		}
-		i++
-
-		for i := range decl.Values {
-			v := &decl.Values[i]
-			if v.Type == css.ValueURL {
-				u := s.rewriteURL(a.Style, string(v.Value))
-				v.Raw = v.Raw[:0]
-				v.Value = append(v.Value[:0], u...)
-			}
-		}
-		buf = css.AppendDecl(buf, &decl)
+	policy := &css.Policy{
+		Properties: opts.AllowedStyles,
+		RewriteURL: func(u string) string { return s.rewriteURL(a.Style, u) },
 	}
+	buf := css.Sanitize(nil, []byte(val), policy)
 
 	out := bytes.NewBuffer(make([]byte, 0, len(buf)+32))
 	out.WriteString(" style=\"")
@@ -309,6 +385,22 @@ func (s *Sanitizer) styleAttr(dst io.Writer, val string, opts *Options) (n int,
 	return dst.Write(out.Bytes())
 }
 
+// styleElem writes the sanitized contents of a <style> element.
+// Only rules with local selectors are kept, so a message cannot
+// restyle the page that shows it, see css.Policy.LocalSelectors.
+func (s *Sanitizer) styleElem(dst io.Writer, text []byte, opts *Options) (n int, err error) {
+	policy := &css.Policy{
+		Properties:     opts.AllowedStyles,
+		RewriteURL:     func(u string) string { return s.rewriteURL(a.Style, u) },
+		LocalSelectors: true,
+	}
+	errh := func(line, col, n int, msg string) {}
+	p := css.NewParser(css.NewScanner(bytes.NewReader(text), errh))
+	sheet := p.ParseStylesheet()
+	css.SanitizeStylesheet(sheet, policy)
+	return dst.Write(css.AppendStylesheet(nil, sheet))
+}
+
 func escapeAttr(dst *bytes.Buffer, src []byte) {
 	for _, c := range src {
 		switch c {
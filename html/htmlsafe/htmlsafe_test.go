@@ -87,6 +87,39 @@ var sanitizeTests = []struct {
 		in:   `<img src='https://example.com/"foo"'/>`,
 		out:  `<img src="https://example.com/%22foo%22"/>`,
 	},
+	{
+		name: "unsafe styles",
+		in:   `<div style="width: expression(alert(1)); position: fixed; color: red"></div>`,
+		out:  `<div style="color: red;"></div>`,
+	},
+	{
+		name: "style element",
+		in:   `<html><head><style type="text/css">@import url(x.css); .p { color: red; position: fixed } .a[title="\3c /style>"] { color: blue }</style></head></html>`,
+		out:  "<html><head><style type=\"text/css\">.p { color: red; }\n.a[title=\"\\3c /style>\"] { color: blue; }\n</style></head></html>",
+		opts: Safe,
+	},
+	{
+		name: "style element page rules",
+		in:   `<style>* { display: none } body { color: red } html, :root { color: red } .x, p, td.y { color: blue }</style>`,
+		out:  "<style>.x { color: blue; }\n</style>",
+		opts: Safe,
+	},
+	{
+		name: "style element strict",
+		in:   `<style>p { color: red }</style><p>hi</p>`,
+		out:  `<p>hi</p>`,
+		opts: StrictEmail,
+	},
+	{
+		name: "srcset",
+		in:   `<img src="https://example.com/a.png" srcset="https://example.com/a2.png 2x, javascript:alert(1) 3x,https://example.com/a4.png  4x">`,
+		out:  `<img src="https://example.com/a.png" srcset="https://example.com/a2.png 2x, https://example.com/a4.png 4x">`,
+	},
+	{
+		name: "srcset commas",
+		in:   `<img srcset="https://example.com/img?w=1,2 2x,https://example.com/b.png,, https://example.com/c.png 3x , https://example.com/d,e.png">`,
+		out:  `<img srcset="https://example.com/img?w=1,2 2x, https://example.com/b.png, https://example.com/c.png 3x, https://example.com/d,e.png">`,
+	},
 	{
 		name: "replace URLs",
 		in:   `<a href="http://bogus.com/foo" style='background:url("http://sketch.io/bar"), blue;'><img src="https://bad.com/baz"/></a>`,
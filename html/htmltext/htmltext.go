@@ -0,0 +1,328 @@
+// Package htmltext renders an HTML document as plain text.
+//
+// The text is meant for reading in a text-only email client and
+// for indexing. Links are numbered and listed as footnotes at the
+// end, tables are flattened to one line per row, and lists and
+// block quotes are marked the way they are in plain text email.
+package htmltext
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	a "golang.org/x/net/html/atom"
+)
+
+// Convert writes the text of the HTML document src to dst.
+// Lines end in CRLF.
+func Convert(dst io.Writer, src io.Reader) error {
+	doc, err := html.Parse(src)
+	if err != nil {
+		return err
+	}
+	c := &converter{linkNums: make(map[string]int)}
+	c.walk(doc)
+	if c.buf.Len() > 0 {
+		c.buf.WriteString("\r\n")
+	}
+	for i, link := range c.links {
+		if i == 0 && c.buf.Len() > 0 {
+			c.buf.WriteString("\r\n")
+		}
+		c.buf.WriteString("[" + strconv.Itoa(i+1) + "] " + link + "\r\n")
+	}
+	_, err = c.buf.WriteTo(dst)
+	return err
+}
+
+type converter struct {
+	buf       bytes.Buffer
+	newlines  int    // line breaks to write before the next text
+	space     bool   // a space to write before the next text
+	sep       string // a table cell separator to write before the next text
+	lineLen   int    // bytes of text on the current line
+	quote     int    // block quote depth
+	lastQuote int    // block quote depth of the last text
+	pre       int    // preformatted depth
+	lists     []list
+	links     []string
+	linkNums  map[string]int
+}
+
+type list struct {
+	ordered bool
+	n       int
+}
+
+// block ends the current line, leaving a blank line if blank is set.
+func (c *converter) block(blank bool) {
+	n := 1
+	if blank {
+		n = 2
+	}
+	if c.newlines < n {
+		c.newlines = n
+	}
+	c.space, c.sep = false, ""
+}
+
+// lineBreak ends the current line, as <br> does.
+func (c *converter) lineBreak() {
+	if c.newlines < 2 {
+		c.newlines++
+	}
+	c.space, c.sep = false, ""
+}
+
+// emit writes s on the current line.
+func (c *converter) emit(s string) {
+	if s == "" {
+		return
+	}
+	if c.buf.Len() == 0 {
+		c.newlines = 0
+	}
+	for ; c.newlines > 0; c.newlines-- {
+		if c.lineLen == 0 && c.buf.Len() > 0 {
+			// A blank line, quoted as ">" inside a quote.
+			depth := c.quote
+			if c.lastQuote < depth {
+				depth = c.lastQuote
+			}
+			c.buf.WriteString(strings.TrimRight(strings.Repeat("> ", depth), " "))
+		}
+		if c.buf.Len() > 0 {
+			c.buf.WriteString("\r\n")
+		}
+		c.lineLen = 0
+	}
+	if c.lineLen == 0 {
+		c.buf.WriteString(c.prefix())
+		c.space, c.sep = false, ""
+	}
+	switch {
+	case c.sep != "":
+		c.buf.WriteString(c.sep)
+	case c.space && c.buf.Bytes()[c.buf.Len()-1] != ' ':
+		c.buf.WriteByte(' ')
+	}
+	c.space, c.sep = false, ""
+	c.buf.WriteString(s)
+	c.lineLen += len(s)
+	c.lastQuote = c.quote
+}
+
+func (c *converter) prefix() string {
+	return strings.Repeat("> ", c.quote)
+}
+
+// text writes the content of a text node.
+func (c *converter) text(s string) {
+	s = strings.Map(dropInvisible, s)
+	if c.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				c.newlines++ // blank lines are kept
+				c.space, c.sep = false, ""
+			}
+			c.emit(strings.TrimRight(line, "\r"))
+		}
+		return
+	}
+	if s != "" && isSpace(firstRune(s)) {
+		c.space = true
+	}
+	for i, word := range strings.FieldsFunc(s, isSpace) {
+		if i > 0 {
+			c.space = true
+		}
+		c.emit(word)
+	}
+	if s != "" && isSpace(lastRune(s)) {
+		c.space = true
+	}
+}
+
+func (c *converter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		c.text(n.Data)
+		return
+	case html.ElementNode:
+	case html.DocumentNode:
+		c.walkKids(n)
+		return
+	default:
+		return
+	}
+	if hidden(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case a.Head, a.Script, a.Style, a.Template, a.Noscript,
+		a.Select, a.Textarea, a.Object, a.Iframe, a.Svg:
+		return
+	case a.Br:
+		c.lineBreak()
+	case a.Hr:
+		c.block(true)
+		c.emit("----------")
+		c.block(true)
+	case a.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			c.emit("[" + alt + "]")
+		}
+	case a.A:
+		start := c.buf.Len()
+		c.walkKids(n)
+		c.link(n, strings.TrimSpace(c.buf.String()[start:]))
+	case a.P, a.H1, a.H2, a.H3, a.H4, a.H5, a.H6, a.Table, a.Dl, a.Address, a.Figure:
+		c.block(true)
+		c.walkKids(n)
+		c.block(true)
+	case a.Pre:
+		c.block(true)
+		c.pre++
+		c.walkKids(n)
+		c.pre--
+		c.block(true)
+	case a.Blockquote:
+		c.block(true)
+		c.quote++
+		c.walkKids(n)
+		c.block(true)
+		c.quote--
+	case a.Ul, a.Ol:
+		c.block(len(c.lists) == 0)
+		c.lists = append(c.lists, list{ordered: n.DataAtom == a.Ol})
+		c.walkKids(n)
+		c.lists = c.lists[:len(c.lists)-1]
+		c.block(len(c.lists) == 0)
+	case a.Li:
+		c.block(false)
+		marker := "* "
+		if len(c.lists) > 0 {
+			l := &c.lists[len(c.lists)-1]
+			l.n++
+			if l.ordered {
+				marker = strconv.Itoa(l.n) + ". "
+			}
+			marker = strings.Repeat("  ", len(c.lists)-1) + marker
+		}
+		c.emit(marker)
+		c.walkKids(n)
+		c.block(false)
+	case a.Td, a.Th:
+		// Cells of a row are written on one line.
+		if c.lineLen > 0 {
+			c.sep = " | "
+		}
+		c.walkKids(n)
+		if c.lineLen > 0 {
+			c.sep = " | "
+		}
+	case a.Div, a.Tr, a.Dt, a.Dd, a.Section, a.Article, a.Header,
+		a.Footer, a.Nav, a.Aside, a.Main, a.Form, a.Center, a.Caption,
+		a.Fieldset, a.Details, a.Summary, a.Figcaption, a.Legend:
+		c.block(false)
+		c.walkKids(n)
+		c.block(false)
+	default:
+		c.walkKids(n)
+	}
+}
+
+func (c *converter) walkKids(n *html.Node) {
+	for kid := n.FirstChild; kid != nil; kid = kid.NextSibling {
+		c.walk(kid)
+	}
+}
+
+// link numbers the link n with the text text, to be listed as a
+// footnote. Links to anchors and scripts, and links whose text is
+// the address they go to, are not numbered.
+func (c *converter) link(n *html.Node, text string) {
+	href := strings.TrimSpace(attr(n, "href"))
+	u, err := url.Parse(href)
+	if err != nil || text == "" {
+		return
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "ftp":
+		if text == href || text == strings.TrimPrefix(href, u.Scheme+"://") ||
+			text == strings.TrimSuffix(strings.TrimPrefix(href, u.Scheme+"://"), "/") {
+			return
+		}
+	case "mailto":
+		if text == href || text == u.Opaque {
+			return
+		}
+	default:
+		return
+	}
+	num, ok := c.linkNums[href]
+	if !ok {
+		c.links = append(c.links, href)
+		num = len(c.links)
+		c.linkNums[href] = num
+	}
+	c.space, c.sep = true, ""
+	c.emit("[" + strconv.Itoa(num) + "]")
+}
+
+func attr(n *html.Node, key string) string {
+	for _, at := range n.Attr {
+		if at.Namespace == "" && at.Key == key {
+			return at.Val
+		}
+	}
+	return ""
+}
+
+// hidden reports whether the element n is not displayed,
+// such as the preheader text many HTML emails start with.
+func hidden(n *html.Node) bool {
+	for _, at := range n.Attr {
+		switch at.Key {
+		case "hidden":
+			return true
+		case "style":
+			style := strings.ToLower(strings.Join(strings.Fields(at.Val), ""))
+			if strings.Contains(style, "display:none") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropInvisible removes runes that have no width, which HTML
+// email uses to pad preheaders and defeat text extraction.
+func dropInvisible(r rune) rune {
+	switch r {
+	case '\u00ad', '\u034f', '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff':
+		return -1
+	}
+	return r
+}
+
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r) // includes U+00A0, &nbsp;
+}
+
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
@@ -0,0 +1,74 @@
+package htmltext
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var convertTests = []struct {
+	name string
+	in   string
+	want string
+}{
+	{
+		name: "paragraphs",
+		in:   "<html><head><title>T</title><style>p{}</style></head><body><p>Hello,\n  world.</p><p>Second&nbsp;para<br>next line</p></body></html>",
+		want: "Hello, world.\n\nSecond para\nnext line\n",
+	},
+	{
+		name: "links",
+		in:   `<p>See <a href="https://example.com/a">the docs</a> and <a href="https://example.com/b">more</a>, <a href="https://example.com/a">again</a>.</p><p><a href="https://example.com/">example.com</a> <a href="mailto:a@b.com">a@b.com</a> <a href="#top">top</a></p>`,
+		want: "See the docs [1] and more [2], again [1].\n\nexample.com a@b.com top\n\n[1] https://example.com/a\n[2] https://example.com/b\n",
+	},
+	{
+		name: "table",
+		in:   "<table><tr><th>Item</th><th>Price</th></tr><tr><td>Tea</td><td>$3</td></tr><tr><td></td><td>$4</td></tr></table><p>After</p>",
+		want: "Item | Price\nTea | $3\n$4\n\nAfter\n",
+	},
+	{
+		name: "layout table",
+		in:   `<table><tr><td><img src="logo.png" alt="Logo"></td></tr><tr><td><div>Sale today</div><div>Ends soon</div></td></tr></table>`,
+		want: "[Logo]\nSale today\nEnds soon\n",
+	},
+	{
+		name: "lists",
+		in:   "<p>Steps:</p><ol><li>one</li><li>two<ul><li>a</li><li>b</li></ul></li></ol><ul><li>x</li></ul>",
+		want: "Steps:\n\n1. one\n2. two\n  * a\n  * b\n\n* x\n",
+	},
+	{
+		name: "blockquote",
+		in:   "<p>Reply</p><blockquote><p>quoted</p><p>more</p></blockquote>",
+		want: "Reply\n\n> quoted\n>\n> more\n",
+	},
+	{
+		name: "pre",
+		in:   "<pre>  a  b\n\n  c</pre>",
+		want: "  a  b\n\n  c\n",
+	},
+	{
+		name: "hidden",
+		in:   `<div style="display: none">preheader&zwnj;&nbsp;&zwnj;</div><script>x()</script><div hidden>h</div>Body&#8203;text`,
+		want: "Bodytext\n",
+	},
+	{
+		name: "empty",
+		in:   `<html><body><img src="pixel.gif"></body></html>`,
+		want: "",
+	},
+}
+
+func TestConvert(t *testing.T) {
+	for _, tt := range convertTests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := Convert(buf, strings.NewReader(tt.in)); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Replace(tt.want, "\n", "\r\n", -1)
+			if got := buf.String(); got != want {
+				t.Errorf("Convert(%q)\n got: %q\nwant: %q", tt.in, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rights is a set of mailbox access rights, as defined in RFC 4314.
+type Rights uint16
+
+const (
+	RightLookup    Rights = 1 << iota // l: mailbox is visible to LIST
+	RightRead                         // r: SELECT, FETCH, SEARCH, COPY from
+	RightSeen                         // s: keep the \Seen flag
+	RightWrite                        // w: keep flags other than \Seen and \Deleted
+	RightInsert                       // i: APPEND, COPY into
+	RightPost                         // p: submit mail to the mailbox address
+	RightCreate                       // k: CREATE child mailboxes
+	RightDelete                       // x: DELETE or RENAME the mailbox
+	RightDeleteMsg                    // t: set the \Deleted flag
+	RightExpunge                      // e: EXPUNGE
+	RightAdmin                        // a: SETACL, GETACL, DELETEACL, LISTRIGHTS
+
+	RightsNone Rights = 0
+	RightsAll  Rights = RightAdmin<<1 - 1
+)
+
+// rightChars are the letters of each right, in bit order.
+const rightChars = "lrswipkxtea"
+
+// ACLIdentifierAnyone is the ACL identifier that matches every user.
+const ACLIdentifierAnyone = "anyone"
+
+// ACLEntry grants Rights to an Identifier.
+type ACLEntry struct {
+	Identifier string
+	Rights     Rights
+}
+
+// ParseRights parses an RFC 4314 rights string, such as "lrs".
+//
+// The obsolete RFC 2086 rights "c" and "d" are accepted and
+// mapped to the rights that replaced them.
+func ParseRights(s string) (r Rights, err error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case 'c':
+			r |= RightCreate | RightDelete
+			continue
+		case 'd':
+			r |= RightDeleteMsg | RightExpunge
+			continue
+		}
+		j := strings.IndexByte(rightChars, c)
+		if j < 0 {
+			return 0, fmt.Errorf("imap: unknown right %q", c)
+		}
+		r |= 1 << uint(j)
+	}
+	return r, nil
+}
+
+func (r Rights) String() string {
+	var b strings.Builder
+	for i := 0; i < len(rightChars); i++ {
+		if r&(1<<uint(i)) != 0 {
+			b.WriteByte(rightChars[i])
+		}
+	}
+	return b.String()
+}
@@ -5,6 +5,7 @@
 package imap
 
 import (
+	"errors"
 	"io"
 	"sort"
 	"time"
@@ -13,6 +14,10 @@ import (
 	"spilled.ink/imap/imapparser"
 )
 
+// ErrTooManyKeywords is reported by Append and Store when setting
+// a new keyword would give a mailbox more keywords than it may have.
+var ErrTooManyKeywords = errors.New("too many keywords in mailbox")
+
 // Session is an authenticated user session to the IMAP server.
 type Session interface {
 	Mailboxes() ([]MailboxSummary, error)
@@ -21,6 +26,24 @@ type Session interface {
 	DeleteMailbox(name []byte) error
 	RenameMailbox(old, new []byte) error
 	RegisterPushDevice(name string, device imapparser.ApplePushDevice) error
+
+	// GetACL reports the access control list of a mailbox (RFC 4314).
+	GetACL(mailbox []byte) ([]ACLEntry, error)
+
+	// SetACL adds, removes (mode StoreAdd, StoreRemove), or replaces
+	// the rights an identifier has on a mailbox.
+	SetACL(mailbox []byte, identifier string, mode imapparser.StoreMode, rights Rights) error
+
+	// DeleteACL removes an identifier from the access control list.
+	DeleteACL(mailbox []byte, identifier string) error
+
+	// ListRights reports the rights an identifier always has
+	// on a mailbox, and the rights that may be granted to it.
+	ListRights(mailbox []byte, identifier string) (required, grantable Rights, err error)
+
+	// MyRights reports the rights of the session user on a mailbox.
+	MyRights(mailbox []byte) (Rights, error)
+
 	Close()
 }
 
@@ -32,6 +55,12 @@ type Mailbox interface {
 
 	Info() (MailboxInfo, error)
 
+	// Status reports the parts of the MailboxInfo that STATUS
+	// needs: the message counts, UIDNext, UIDValidity and
+	// HighestModSequence. It is called for every mailbox a client
+	// polls, so it should not scan the messages.
+	Status() (MailboxInfo, error)
+
 	// Append appends a message to the mailbox.
 	Append(flags [][]byte, date time.Time, data io.ReadSeeker) (uid uint32, err error)
 
@@ -59,7 +88,9 @@ type Mailbox interface {
 	// If fn is non-nil it is called with the seqNum for each deleted
 	// message. The sequence numbers follow the amazing rules of the IMAP
 	// expunge command, that is, each is reported after the previous
-	// is removed and the sequence numbers recalculated.
+	// is removed and the sequence numbers recalculated. They are
+	// reported in descending order, so no message is renumbered by
+	// the removal of one reported before it.
 	Expunge(uidSeqs []imapparser.SeqRange, fn func(seqNum uint32)) error
 
 	Store(uid bool, seqs []imapparser.SeqRange, store *imapparser.Store) (StoreResults, error)
@@ -79,6 +110,18 @@ type Mailbox interface {
 	Close() error
 }
 
+// Namespaces describes how mailbox names are organized, RFC 2342.
+//
+// Each namespace is a mailbox name prefix, for example "" for
+// the mailboxes of the user or "Other Users/" for mailboxes
+// shared with them.
+type Namespaces struct {
+	Delimiter byte     // hierarchy delimiter, 0 for a flat namespace
+	Personal  []string // mailboxes owned by the user
+	Other     []string // mailboxes owned by other users
+	Shared    []string // mailboxes shared by all users
+}
+
 type MailboxSummary struct {
 	Name  string
 	Attrs ListAttrFlag
@@ -86,7 +129,15 @@ type MailboxSummary struct {
 
 type MailboxInfo struct {
 	Summary MailboxSummary
-	// TODO Flags
+
+	// Keywords are the keywords in use in the mailbox, reported
+	// by SELECT alongside the system flags.
+	Keywords []string
+
+	// KeywordsFull is set when the mailbox has all the keywords
+	// it may have, so SELECT does not offer new ones with \*.
+	KeywordsFull bool
+
 	NumMessages        uint32
 	NumRecent          uint32
 	NumUnseen          uint32
@@ -136,8 +187,77 @@ type Message interface {
 	SetSeen() error
 }
 
+// FetchCache is optionally implemented by a Message to provide
+// precomputed FETCH responses. Each method returns nil if the
+// value is not cached.
+//
+// The values are the output of imapformat.AppendEnvelope and
+// imapformat.AppendBodyStructure.
+type FetchCache interface {
+	CachedEnvelope() []byte
+	CachedBodyStructure() []byte
+}
+
+// HeaderFields is optionally implemented by a Message that loads
+// its headers on demand. Msg().Headers is empty until LoadHeaders
+// is called.
+//
+// Mail clients listing a mailbox fetch a few header fields of each
+// message, which HeaderField can report without loading the headers.
+type HeaderFields interface {
+	// HeaderField reports the first value of a header field,
+	// nil if the message does not have it.
+	// It reports ok=false if the field is only available by
+	// loading the headers.
+	HeaderField(key email.Key) (value []byte, ok bool)
+
+	// LoadHeaders loads Msg().Headers.
+	LoadHeaders() error
+}
+
+// ClientIDRecorder is optionally implemented by a Session to record
+// how a client identifies itself with the ID command, RFC 2971.
+// The keys of params are lower case.
+//
+// Clients may send ID before logging in, the server then calls
+// RecordClientID when the session starts.
+type ClientIDRecorder interface {
+	RecordClientID(params map[string]string) error
+}
+
+// Notifier is told when new mail arrives in a mailbox.
+//
+// The devices are those registered for push notifications of the
+// mailbox. A Notifier sends to the kinds of devices it supports.
 type Notifier interface {
-	Notify(userID int64, mailboxID int64, mailboxName string, devices []imapparser.ApplePushDevice)
+	Notify(userID int64, mailboxID int64, mailboxName string, devices PushDevices)
+}
+
+// UpdateNotifier is optionally implemented by a Notifier to be told
+// of changes to the messages already in a mailbox, made other than
+// by an IMAP command on it.
+type UpdateNotifier interface {
+	// NotifyFlags reports messages whose flags changed.
+	NotifyFlags(userID int64, mailboxID int64, uids []uint32)
+
+	// NotifyExpunge reports messages removed from a mailbox,
+	// by sequence number in the order of EXPUNGE responses.
+	NotifyExpunge(userID int64, mailboxID int64, seqNums []uint32)
+}
+
+// PushDevices are the devices registered for push notifications
+// of new mail in a mailbox.
+type PushDevices struct {
+	Apple []imapparser.ApplePushDevice // XAPPLEPUSHSERVICE
+	Web   []WebPushSubscription
+}
+
+// WebPushSubscription is a browser subscription to Web Push
+// (RFC 8030), the fields of a JavaScript PushSubscription.
+type WebPushSubscription struct {
+	Endpoint string // push service URL
+	P256DH   string // base64url P-256 public key of the client, RFC 8291
+	Auth     string // base64url authentication secret, RFC 8291
 }
 
 type ListAttrFlag int
@@ -0,0 +1,248 @@
+package imapformat
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"spilled.ink/email"
+	"spilled.ink/email/msgbuilder"
+	"spilled.ink/third_party/imf"
+)
+
+// fetchBuf accumulates a FETCH response value.
+// It records the first error encountered and keeps writing.
+type fetchBuf struct {
+	b   []byte
+	err error
+}
+
+func (f *fetchBuf) atom(s string)        { f.b = append(f.b, s...) }
+func (f *fetchBuf) num(n int64)          { f.b = strconv.AppendInt(f.b, n, 10) }
+func (f *fetchBuf) str(s string)         { f.b = AppendString(f.b, s) }
+func (f *fetchBuf) writeQuoted(s string) { f.b = AppendQuoted(f.b, s) }
+
+func (f *fetchBuf) setErr(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// CacheVersion is incremented whenever the output of
+// AppendEnvelope or AppendBodyStructure changes, so values
+// cached by an imap.FetchCache can be recomputed.
+const CacheVersion = 2
+
+// AppendEnvelope appends the FETCH ENVELOPE value for hdrs to b,
+// as described in RFC 3501 section 7.4.2.
+//
+// Addresses that cannot be parsed are left out of the envelope
+// and reported in the returned error.
+func AppendEnvelope(b []byte, hdrs *email.Header) ([]byte, error) {
+	from := hdrs.Get("From")
+	sender := hdrs.Get("Sender")
+	if len(bytes.TrimSpace(sender)) == 0 {
+		sender = from
+	}
+	replyTo := hdrs.Get("Reply-To")
+	if len(bytes.TrimSpace(replyTo)) == 0 {
+		replyTo = from
+	}
+
+	f := &fetchBuf{b: b}
+	f.atom("(")
+	f.writeNString(hdrs.Get("Date"))
+	f.atom(" ")
+	f.writeNString(hdrs.Get("Subject"))
+	f.atom(" ")
+	f.writeAddresses(from)
+	f.atom(" ")
+	f.writeAddresses(sender)
+	f.atom(" ")
+	f.writeAddresses(replyTo)
+	f.atom(" ")
+	f.writeAddresses(hdrs.Get("To"))
+	f.atom(" ")
+	f.writeAddresses(hdrs.Get("CC"))
+	f.atom(" ")
+	f.writeAddresses(hdrs.Get("BCC"))
+	f.atom(" ")
+	f.writeNString(hdrs.Get("In-Reply-To"))
+	f.atom(" ")
+	f.writeNString(hdrs.Get("Message-ID"))
+	f.atom(")")
+	return f.b, f.err
+}
+
+// writeNString writes a header value, or NIL if it is missing.
+func (f *fetchBuf) writeNString(v []byte) {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 {
+		f.atom("NIL")
+		return
+	}
+	f.writeQuoted(string(v))
+}
+
+// writeAddresses writes a parenthesized list of addresses,
+// or NIL if there are none. The members of a group are
+// written as individual addresses.
+func (f *fetchBuf) writeAddresses(addrBytes []byte) {
+	if len(bytes.TrimSpace(addrBytes)) == 0 {
+		f.atom("NIL")
+		return
+	}
+	addrs, err := imf.ParseAddressList(string(addrBytes))
+	if err != nil {
+		f.atom("NIL")
+		f.setErr(fmt.Errorf("cannot write address %q: %v", addrBytes, err))
+		return
+	}
+	wrote := false
+	for _, addr := range addrs {
+		i := strings.LastIndexByte(addr.Addr, '@')
+		if i == -1 {
+			f.setErr(fmt.Errorf("cannot write address %q", addr.Addr))
+			continue
+		}
+		mailboxName, hostName := addr.Addr[:i], addr.Addr[i+1:]
+
+		if !wrote {
+			f.atom("(")
+			wrote = true
+		}
+		f.atom("(")
+		if addr.Name == "" {
+			f.atom("NIL")
+		} else {
+			f.writeQuoted(addr.Name) // personal name
+		}
+		f.atom(" NIL ") // at-domain-list (source route)
+		f.writeQuoted(mailboxName)
+		f.atom(" ")
+		f.writeQuoted(hostName)
+		f.atom(")")
+	}
+	if wrote {
+		f.atom(")")
+	} else {
+		f.atom("NIL")
+	}
+}
+
+// AppendBodyStructure appends the FETCH BODYSTRUCTURE value for msg to b.
+//
+// If the MIME tree of msg cannot be built, AppendBodyStructure
+// returns nil. Other errors are reported after the value is written.
+func AppendBodyStructure(b []byte, msg *email.Msg) ([]byte, error) {
+	node, err := msgbuilder.BuildTree(msg)
+	if err != nil {
+		return nil, err
+	}
+	f := &fetchBuf{b: b}
+	f.atom("(")
+	f.writeBodyStructurePart(node)
+	f.atom(")")
+	return f.b, f.err
+}
+
+func (f *fetchBuf) writeBodyStructurePart(node *msgbuilder.TreeNode) {
+	partNum := -1
+	if node.Part != nil {
+		partNum = node.Part.PartNum
+	}
+	mediaType, ctParams, err := mime.ParseMediaType(node.Header.ContentType)
+	if err != nil {
+		f.setErr(fmt.Errorf("part %d: %v", partNum, err))
+		return
+	}
+	var ctParamKeys []string
+	for key := range ctParams {
+		ctParamKeys = append(ctParamKeys, key)
+	}
+	sort.Strings(ctParamKeys)
+	var bodyType, bodySubtype string
+	if i := strings.IndexByte(mediaType, '/'); i == -1 {
+		f.setErr(fmt.Errorf("part %d: bad mediatype: %s", partNum, mediaType))
+		return
+	} else {
+		bodyType, bodySubtype = mediaType[:i], mediaType[i+1:]
+	}
+
+	if len(node.Kids) > 0 {
+		// multipart
+		for i, kid := range node.Kids {
+			if i > 0 {
+				f.atom(" (")
+			} else {
+				f.atom("(")
+			}
+			f.writeBodyStructurePart(&kid)
+			f.atom(")")
+		}
+
+		// subtype
+		f.atom(" ")
+		f.str(strings.ToUpper(bodySubtype))
+		// body parameter parenthesized list
+		f.atom(" (boundary ")
+		f.str(ctParams["boundary"]) // TODO: all ctParamKeys?
+		f.atom(")")
+		// body disposition
+		if node.Header.ContentDisposition == "" {
+			f.atom(" NIL")
+		} else {
+			f.atom(" ()") // TODO
+		}
+		// body language
+		f.atom(" NIL")
+		// body location
+		f.atom(" NIL")
+		return
+	}
+
+	// body type
+	f.str(bodyType)
+	f.atom(" ")
+	// body subtype
+	f.str(bodySubtype)
+	// body parameter parnthesized list
+	f.atom(" (")
+	for i, key := range ctParamKeys {
+		if i > 0 {
+			f.atom(" ")
+		}
+		f.str(key)
+		f.atom(" ")
+		f.str(ctParams[key])
+	}
+	f.atom(")")
+	// body id
+	if node.Header.ContentID == "" {
+		f.atom(" NIL")
+	} else {
+		f.atom(" ")
+		f.str(node.Header.ContentID)
+	}
+	// body description
+	f.atom(" NIL")
+	// body encoding
+	f.atom(" ")
+	if node.Header.ContentTransferEncoding == "7bit" {
+		f.atom("NIL")
+	} else {
+		f.str(node.Header.ContentTransferEncoding)
+	}
+	f.atom(" ")
+	f.num(node.Part.ContentTransferSize) // body size
+	if bodyType == "text" {
+		// RFC 3501 7.4.2:
+		//	A body type of type TEXT contains, immediately after
+		//	the basic fields, the size of the body in text lines.
+		f.atom(" ")
+		f.num(node.Part.ContentTransferLines)
+	}
+}
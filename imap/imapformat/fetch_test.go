@@ -0,0 +1,83 @@
+package imapformat
+
+import (
+	"testing"
+
+	"spilled.ink/email"
+)
+
+func TestAppendEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		hdrs map[string]string
+		want string
+	}{
+		{
+			name: "empty",
+			want: `(NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL)`,
+		},
+		{
+			name: "sender defaults to from",
+			hdrs: map[string]string{
+				"Date":    "Thu, 11 Oct 2018 02:42:50 +0000",
+				"Subject": "NIL",
+				"From":    "Alice <alice@example.com>",
+				"To":      "bob@example.org, Carol <carol@example.net>",
+			},
+			want: `("Thu, 11 Oct 2018 02:42:50 +0000" "NIL" ` +
+				`(("Alice" NIL "alice" "example.com")) ` +
+				`(("Alice" NIL "alice" "example.com")) ` +
+				`(("Alice" NIL "alice" "example.com")) ` +
+				`((NIL NIL "bob" "example.org")("Carol" NIL "carol" "example.net")) ` +
+				`NIL NIL NIL NIL)`,
+		},
+		{
+			name: "groups and references",
+			hdrs: map[string]string{
+				"From":        "alice@example.com",
+				"Sender":      "list@example.com",
+				"Reply-To":    "list@example.com",
+				"To":          "undisclosed-recipients:;",
+				"CC":          "friends: bob@example.org, =?utf-8?q?Dav=C3=A9?= <dave@example.org>;",
+				"In-Reply-To": "<parent@example.com>",
+				"Message-ID":  "<child@example.com>",
+			},
+			want: `(NIL NIL ` +
+				`((NIL NIL "alice" "example.com")) ` +
+				`((NIL NIL "list" "example.com")) ` +
+				`((NIL NIL "list" "example.com")) ` +
+				`NIL ` +
+				`((NIL NIL "bob" "example.org")("Dav&AOk-" NIL "dave" "example.org")) ` +
+				`NIL "<parent@example.com>" "<child@example.com>")`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hdrs email.Header
+			for k, v := range test.hdrs {
+				hdrs.Add(email.Key(k), []byte(v))
+			}
+			got, err := AppendEnvelope(nil, &hdrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("\n got %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAppendEnvelopeBadAddress(t *testing.T) {
+	var hdrs email.Header
+	hdrs.Add("From", []byte("alice@example.com"))
+	hdrs.Add("To", []byte("<<not an address"))
+	got, err := AppendEnvelope(nil, &hdrs)
+	if err == nil {
+		t.Error("no error for bad address")
+	}
+	want := `(NIL NIL ((NIL NIL "alice" "example.com")) ((NIL NIL "alice" "example.com")) ((NIL NIL "alice" "example.com")) NIL NIL NIL NIL NIL)`
+	if string(got) != want {
+		t.Errorf("\n got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+// Package imapformat formats values as they are written in
+// IMAP responses.
+//
+// It is a leaf package so that message stores can compute and
+// cache FETCH values without depending on the IMAP server.
+package imapformat
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"spilled.ink/imap/imapparser/utf7mod"
+)
+
+// StringType is the form a string takes in a response.
+type StringType int
+
+const (
+	Literal StringType = iota
+	Quoted
+	Atom
+)
+
+// TypeOf reports how s is written in a response.
+func TypeOf(s string) StringType {
+	if s == "" {
+		return Quoted
+	}
+	strTypeVal := Atom
+	sCheck := s
+	for len(sCheck) > 0 {
+		r, sz := utf8.DecodeRuneInString(sCheck)
+		sCheck = sCheck[sz:]
+		if r == utf8.RuneError || r == '\r' || r == '\n' {
+			return Literal
+		}
+		if r == '"' {
+			// TODO: is this necessary? is "\"" a valid quoted IMAP string?
+			return Literal
+		}
+		switch {
+		case 'A' <= r && r <= 'Z',
+			'a' <= r && r <= 'z',
+			'0' <= r && r <= '9',
+			r == '-', r == '_', r == '.':
+			// easily-allowable in an atom
+		default:
+			strTypeVal = Quoted
+		}
+	}
+	return strTypeVal
+}
+
+// Encode encodes s as modified UTF-7.
+func Encode(s string) []byte {
+	b := make([]byte, 0, 128)
+	b, err := utf7mod.AppendEncode(b, []byte(s))
+	if err != nil {
+		panic(fmt.Sprintf("utf7: cannot encode string %q", s))
+	}
+	return b
+}
+
+// AppendString appends s as an atom, quoted string, or literal.
+func AppendString(dst []byte, s string) []byte {
+	switch TypeOf(s) {
+	case Atom:
+		return append(dst, s...)
+	case Literal:
+		dst = append(dst, '{')
+		dst = strconv.AppendInt(dst, int64(len(s)), 10)
+		dst = append(dst, "}\r\n"...)
+		return append(dst, Encode(s)...)
+	default:
+		if plainASCII(s) {
+			return strconv.AppendQuote(dst, s) // encodes as itself
+		}
+		return strconv.AppendQuote(dst, string(Encode(s)))
+	}
+}
+
+// plainASCII reports whether s is printable ASCII without
+// the '&' that starts a modified UTF-7 sequence.
+func plainASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '&' {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendQuoted appends s as a quoted string, or a literal if it
+// cannot be quoted. Unlike AppendString it never appends an atom,
+// which some grammar rules, such as those of ENVELOPE, do not allow.
+func AppendQuoted(dst []byte, s string) []byte {
+	if TypeOf(s) == Literal {
+		return AppendString(dst, s)
+	}
+	return strconv.AppendQuote(dst, string(Encode(s)))
+}
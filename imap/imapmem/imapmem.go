@@ -1,4 +1,11 @@
-package imaptest
+// Package imapmem is an imapserver.DataStore that keeps its users,
+// mailboxes and messages in memory.
+//
+// It needs no database, so it suits tests and programs that embed an
+// IMAP server, and it is the reference for what imapserver expects
+// of a DataStore: it passes the imaptest command suite. Nothing is
+// persisted, and message contents are held in buffers of a Filer.
+package imapmem
 
 import (
 	"errors"
@@ -18,7 +25,11 @@ import (
 	"spilled.ink/imap/imapserver"
 )
 
-type MemoryStore struct {
+// Store is an in-memory DataStore.
+//
+// Users are added with AddUser, and mail is delivered to them
+// with SendMsg. The zero value is ready to use once Filer is set.
+type Store struct {
 	Filer *iox.Filer
 
 	mu            sync.Mutex // guards users map, not the contents of *memoryUser
@@ -27,14 +38,22 @@ type MemoryStore struct {
 	notifiers     []imap.Notifier
 }
 
-func (s *MemoryStore) RegisterNotifier(n imap.Notifier) {
+func (s *Store) RegisterNotifier(n imap.Notifier) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.notifiers = append(s.notifiers, n)
 }
 
-func (s *MemoryStore) AddUser(uname, pass []byte) error {
+func (s *Store) Namespaces() imap.Namespaces {
+	return imap.Namespaces{
+		Delimiter: '/',
+		Personal:  []string{""},
+	}
+}
+
+// AddUser adds a user with the default mailboxes.
+func (s *Store) AddUser(uname, pass []byte) error {
 	s.mu.Lock()
 	username, password := string(uname), string(pass)
 	if s.users == nil {
@@ -43,7 +62,7 @@ func (s *MemoryStore) AddUser(uname, pass []byte) error {
 	}
 	if s.users[username] != nil {
 		s.mu.Unlock()
-		return fmt.Errorf("MemoryStore: user %q already exists", username)
+		return fmt.Errorf("imapmem: user %q already exists", username)
 	}
 	user := &memoryUser{
 		id:              int64(len(s.users) + 1),
@@ -58,7 +77,7 @@ func (s *MemoryStore) AddUser(uname, pass []byte) error {
 
 	_, session, err := s.Login(nil, uname, pass)
 	if err != nil {
-		return fmt.Errorf("MemoryStore: user %q initial session failed: %v", username, err)
+		return fmt.Errorf("imapmem: user %q initial session failed: %v", username, err)
 	}
 	defer session.Close()
 
@@ -83,7 +102,9 @@ func (s *MemoryStore) AddUser(uname, pass []byte) error {
 	return nil
 }
 
-func (s *MemoryStore) SendMsg(date time.Time, data io.Reader) error {
+// SendMsg delivers a message to the INBOX of the user it is
+// addressed to, and tells the registered notifiers.
+func (s *Store) SendMsg(date time.Time, data io.Reader) error {
 	f := s.Filer.BufferFile(0)
 	defer f.Close()
 	if _, err := io.Copy(f, data); err != nil {
@@ -92,18 +113,18 @@ func (s *MemoryStore) SendMsg(date time.Time, data io.Reader) error {
 	f.Seek(0, 0)
 	msg, err := msgcleaver.Cleave(s.Filer, f)
 	if err != nil {
-		return fmt.Errorf("MemoryStore.SendMsg: %v", err)
+		return fmt.Errorf("imapmem.SendMsg: %v", err)
 	}
 	to, err := mail.ParseAddress(string(msg.Headers.Get("To")))
 	if err != nil {
-		return fmt.Errorf("MemoryStore.SendMsg: %v", err)
+		return fmt.Errorf("imapmem.SendMsg: %v", err)
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	user := s.users[to.Address]
 	if user == nil {
-		return fmt.Errorf("MemoryStore.SendMsg: no such user %q", to.Address)
+		return fmt.Errorf("imapmem.SendMsg: no such user %q", to.Address)
 	}
 	inbox := user.mailboxes["INBOX"]
 	f.Seek(0, 0)
@@ -111,20 +132,20 @@ func (s *MemoryStore) SendMsg(date time.Time, data io.Reader) error {
 		return err
 	}
 	for _, n := range s.notifiers {
-		go n.Notify(user.id, inbox.ID(), "INBOX", nil)
+		go n.Notify(user.id, inbox.ID(), "INBOX", imap.PushDevices{})
 	}
 	return err
 }
 
-func (s *MemoryStore) Login(c *imapserver.Conn, username, password []byte) (int64, imap.Session, error) {
+func (s *Store) Login(c *imapserver.Conn, username, password []byte) (int64, imap.Session, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	user := s.users[string(username)]
 	if user == nil {
-		return 0, nil, fmt.Errorf("MemoryStore: no such user %q", string(username))
+		return 0, nil, fmt.Errorf("imapmem: no such user %q", string(username))
 	}
 	if user.password != string(password) {
-		return 0, nil, fmt.Errorf("MemoryStore: bad password for user %q", string(username))
+		return 0, nil, fmt.Errorf("imapmem: bad password for user %q", string(username))
 	}
 
 	session := &memorySession{
@@ -136,7 +157,8 @@ func (s *MemoryStore) Login(c *imapserver.Conn, username, password []byte) (int6
 	return user.id, session, nil
 }
 
-func (s *MemoryStore) Close() {
+// Close releases the contents of every message.
+func (s *Store) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -163,7 +185,7 @@ type memoryUser struct {
 
 type memorySession struct {
 	id     int64
-	server *MemoryStore
+	server *Store
 	user   *memoryUser
 }
 
@@ -195,19 +217,39 @@ func (s *memorySession) Mailbox(name []byte) (imap.Mailbox, error) {
 
 	m := s.user.mailboxes[string(name)]
 	if m == nil {
-		return nil, fmt.Errorf("MemoryStore: unknown mailbox %s", name)
+		return nil, fmt.Errorf("imapmem: unknown mailbox %s", name)
+	}
+	if m.attrs&imap.AttrNoselect != 0 {
+		return nil, fmt.Errorf("imapmem: mailbox %s is \\Noselect", name)
 	}
 	return m, nil
 }
 
+// CreateMailbox creates a mailbox and any of its superior names
+// that do not exist. Creating a \Noselect name makes it selectable.
 func (s *memorySession) CreateMailbox(n []byte, attrs imap.ListAttrFlag) error {
 	s.user.mu.Lock()
 	defer s.user.mu.Unlock()
 
 	name := string(n)
-	if s.user.mailboxes[name] != nil {
-		return errors.New("memory session: mailbox exists")
+	if m := s.user.mailboxes[name]; m != nil {
+		if m.attrs&imap.AttrNoselect == 0 {
+			return errors.New("memory session: mailbox exists")
+		}
+		m.attrs = attrs
+		return nil
+	}
+	delim := s.server.Namespaces().Delimiter
+	for _, parent := range imap.MailboxParents(name, delim) {
+		if s.user.mailboxes[parent] == nil {
+			s.newMailbox(parent, 0)
+		}
 	}
+	s.newMailbox(name, attrs)
+	return nil
+}
+
+func (s *memorySession) newMailbox(name string, attrs imap.ListAttrFlag) {
 	s.user.mailboxes[name] = &memoryMailbox{
 		server:      s.server,
 		user:        s.user,
@@ -219,20 +261,35 @@ func (s *memorySession) CreateMailbox(n []byte, attrs imap.ListAttrFlag) error {
 	}
 	s.user.nextMailboxID++
 	s.user.uidValidityNext++
-	return nil
 }
 
+// DeleteMailbox deletes a mailbox. A mailbox with inferior names
+// loses its messages and is kept as a \Noselect name, RFC 3501
+// section 6.3.4.
 func (s *memorySession) DeleteMailbox(n []byte) error {
 	s.user.mu.Lock()
 	defer s.user.mu.Unlock()
-	m := s.user.mailboxes[string(n)]
+	name := string(n)
+	m := s.user.mailboxes[name]
 	if m == nil {
 		return errors.New("memory session: mailbox does not exist")
 	}
+	var names []string
+	for other := range s.user.mailboxes {
+		names = append(names, other)
+	}
+	delim := s.server.Namespaces().Delimiter
+	hasKids := imap.HasInferiors(names, name, delim)
+	if hasKids && m.attrs&imap.AttrNoselect != 0 {
+		return errors.New("memory session: \\Noselect mailbox has inferior mailboxes")
+	}
 	for _, msg := range m.msgs {
 		msg.emailMsg.Close()
 	}
-	delete(s.user.mailboxes, string(n))
+	delete(s.user.mailboxes, name)
+	if hasKids {
+		s.newMailbox(name, imap.AttrNoselect)
+	}
 	return nil
 }
 
@@ -243,10 +300,10 @@ func (s *memorySession) RenameMailbox(oldName, newName []byte) error {
 
 	m := s.user.mailboxes[old]
 	if m == nil {
-		return errors.New("MemoryStore: source mailbox does not exist")
+		return errors.New("imapmem: source mailbox does not exist")
 	}
 	if s.user.mailboxes[new] != nil {
-		return errors.New("MemoryStore: destination mailbox exists")
+		return errors.New("imapmem: destination mailbox exists")
 	}
 	delete(s.user.mailboxes, old)
 	m.name = new
@@ -260,11 +317,78 @@ func (s *memorySession) RegisterPushDevice(mailbox string, device imapparser.App
 	return nil
 }
 
+// GetACL reports the ACL of a mailbox.
+// The memory store keeps ACLs but does not share mailboxes.
+func (s *memorySession) GetACL(name []byte) ([]imap.ACLEntry, error) {
+	s.user.mu.Lock()
+	defer s.user.mu.Unlock()
+
+	m := s.user.mailboxes[string(name)]
+	if m == nil {
+		return nil, fmt.Errorf("imapmem: unknown mailbox %s", name)
+	}
+	acl := []imap.ACLEntry{{Identifier: s.user.name, Rights: imap.RightsAll}}
+	for id, rights := range m.acl {
+		acl = append(acl, imap.ACLEntry{Identifier: id, Rights: rights})
+	}
+	sort.Slice(acl[1:], func(i, j int) bool { return acl[i+1].Identifier < acl[j+1].Identifier })
+	return acl, nil
+}
+
+func (s *memorySession) SetACL(name []byte, identifier string, mode imapparser.StoreMode, rights imap.Rights) error {
+	s.user.mu.Lock()
+	defer s.user.mu.Unlock()
+
+	m := s.user.mailboxes[string(name)]
+	if m == nil {
+		return fmt.Errorf("imapmem: unknown mailbox %s", name)
+	}
+	if identifier == s.user.name {
+		return errors.New("imapmem: cannot change the rights of the mailbox owner")
+	}
+	if m.acl == nil {
+		m.acl = make(map[string]imap.Rights)
+	}
+	switch mode {
+	case imapparser.StoreAdd:
+		rights |= m.acl[identifier]
+	case imapparser.StoreRemove:
+		rights = m.acl[identifier] &^ rights
+	}
+	if rights == imap.RightsNone {
+		delete(m.acl, identifier)
+	} else {
+		m.acl[identifier] = rights
+	}
+	return nil
+}
+
+func (s *memorySession) DeleteACL(name []byte, identifier string) error {
+	return s.SetACL(name, identifier, imapparser.StoreReplace, imap.RightsNone)
+}
+
+func (s *memorySession) ListRights(name []byte, identifier string) (required, grantable imap.Rights, err error) {
+	if _, err := s.Mailbox(name); err != nil {
+		return 0, 0, err
+	}
+	if identifier == s.user.name {
+		return imap.RightsAll, imap.RightsNone, nil
+	}
+	return imap.RightsNone, imap.RightsAll, nil
+}
+
+func (s *memorySession) MyRights(name []byte) (imap.Rights, error) {
+	if _, err := s.Mailbox(name); err != nil {
+		return 0, err
+	}
+	return imap.RightsAll, nil
+}
+
 func (s *memorySession) Close() {
 }
 
 type memoryMailbox struct {
-	server    *MemoryStore
+	server    *Store
 	user      *memoryUser
 	mailboxID int64
 
@@ -274,6 +398,7 @@ type memoryMailbox struct {
 	msgs        []memoryMsg
 	uidnext     uint32
 	uidValidity uint32
+	acl         map[string]imap.Rights // guarded by user.mu
 }
 
 func (m *memoryMailbox) ID() int64 {
@@ -293,6 +418,7 @@ func (m *memoryMailbox) Info() (imap.MailboxInfo, error) {
 		UIDNext:     m.uidnext,
 		UIDValidity: m.uidValidity,
 	}
+	keywords := make(map[string]bool)
 	for i, m := range m.msgs {
 		unseen := true
 		hasRecent := false
@@ -303,6 +429,10 @@ func (m *memoryMailbox) Info() (imap.MailboxInfo, error) {
 			case `\Seen`:
 				unseen = false
 			}
+			if flag != "" && flag[0] != '\\' && !keywords[flag] {
+				keywords[flag] = true
+				info.Keywords = append(info.Keywords, flag)
+			}
 		}
 		if unseen && info.FirstUnseenSeqNum == 0 {
 			info.FirstUnseenSeqNum = uint32(i + 1)
@@ -317,6 +447,7 @@ func (m *memoryMailbox) Info() (imap.MailboxInfo, error) {
 			info.HighestModSequence = m.summary.ModSeq
 		}
 	}
+	sort.Strings(info.Keywords)
 	return info, nil
 }
 
@@ -415,13 +546,10 @@ func (m *memoryMailbox) Expunge(uidSeqs []imapparser.SeqRange, fn func(seqNum ui
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	i := 0
-	delta := uint32(0)
-	for i < len(m.msgs) {
+	removed := false
+	for i := len(m.msgs) - 1; i >= 0; i-- {
 		msg := &m.msgs[i]
-		msg.summary.SeqNum -= delta
 		if uidSeqs != nil && !imapparser.SeqContains(uidSeqs, msg.summary.UID) {
-			i++
 			continue
 		}
 		if hasFlag(msg.emailMsg.Flags, `\Deleted`) {
@@ -431,15 +559,22 @@ func (m *memoryMailbox) Expunge(uidSeqs []imapparser.SeqRange, fn func(seqNum ui
 			if fn != nil {
 				fn(seqNum)
 			}
-			delta++
-		} else {
-			i++
+			removed = true
+		}
+	}
+	if removed {
+		for i := range m.msgs {
+			m.msgs[i].summary.SeqNum = uint32(i + 1)
 		}
 	}
 
 	return nil
 }
 
+func (m *memoryMailbox) Status() (imap.MailboxInfo, error) {
+	return m.Info()
+}
+
 func (m *memoryMailbox) HighestModSequence() (modSeq int64, err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -682,10 +817,11 @@ type memoryMsg struct {
 
 // Methods implementing imapparser.MatchMessage.
 
-func (msg *memoryMsg) UID() uint32     { return msg.summary.UID }
-func (msg *memoryMsg) SeqNum() uint32  { return msg.summary.SeqNum }
-func (msg *memoryMsg) ModSeq() int64   { return msg.summary.ModSeq }
-func (msg *memoryMsg) Date() time.Time { return msg.emailMsg.Date }
+func (msg *memoryMsg) UID() uint32         { return msg.summary.UID }
+func (msg *memoryMsg) SeqNum() uint32      { return msg.summary.SeqNum }
+func (msg *memoryMsg) ModSeq() int64       { return msg.summary.ModSeq }
+func (msg *memoryMsg) Date() time.Time     { return msg.emailMsg.Date }
+func (msg *memoryMsg) SentDate() time.Time { return msg.emailMsg.SentDate }
 func (msg *memoryMsg) Flag(name string) bool {
 	for _, flag := range msg.emailMsg.Flags {
 		if flag == name {
@@ -698,6 +834,20 @@ func (m *memoryMsg) Header(name string) string {
 	key := email.CanonicalKey([]byte(name))
 	return string(m.emailMsg.Headers.Get(key))
 }
+func (m *memoryMsg) Addresses(field string) string {
+	return m.Header(field)
+}
 func (msg *memoryMsg) RFC822Size() int64 {
 	return msg.emailMsg.EncodedSize
 }
+func (msg *memoryMsg) Attachments() (attachments []imapparser.Attachment) {
+	for _, part := range msg.emailMsg.Parts {
+		if part.IsAttachment {
+			attachments = append(attachments, imapparser.Attachment{
+				Name:        part.Name,
+				ContentType: part.ContentType,
+			})
+		}
+	}
+	return attachments
+}
@@ -0,0 +1,69 @@
+package imapparser
+
+import (
+	"fmt"
+	"strings"
+
+	"spilled.ink/email/charset"
+	"spilled.ink/imap/imapparser/utf7mod"
+)
+
+// SearchCharsets are the charsets listed in a BADCHARSET response.
+//
+// SEARCH CHARSET decodes any charset known to the email/charset
+// package, or UTF-7, but that is hundreds of labels. These are
+// the ones clients are seen to send.
+var SearchCharsets = []string{
+	"UTF-8", "US-ASCII", "UTF-7",
+	"ISO-8859-1", "ISO-8859-2", "ISO-8859-15",
+	"WINDOWS-1251", "WINDOWS-1252", "KOI8-R",
+	"SHIFT_JIS", "EUC-JP", "ISO-2022-JP",
+	"GB2312", "BIG5", "EUC-KR",
+}
+
+// BadCharsetError is the error of a SEARCH with a CHARSET that
+// cannot be decoded. The server responds to it with the response
+// code BADCHARSET, RFC 3501 section 7.1.
+type BadCharsetError struct {
+	Charset string
+}
+
+func (e BadCharsetError) Error() string {
+	return fmt.Sprintf("unsupported CHARSET %s", e.Charset)
+}
+
+// charsetDecoder returns the function converting the search strings
+// of SEARCH CHARSET name to UTF-8. It returns nil for UTF-8 and
+// US-ASCII, which are searched as they are, and reports false
+// if the charset is not known.
+func charsetDecoder(name string) (decode func([]byte) ([]byte, error), ok bool) {
+	switch strings.ToUpper(name) {
+	case "UTF-8", "US-ASCII":
+		return nil, true
+	case "UTF-7", "UNICODE-1-1-UTF-7", "CSUNICODE11UTF7":
+		return func(b []byte) ([]byte, error) {
+			return utf7mod.AppendDecodeUTF7(nil, b)
+		}, true
+	}
+	enc, _, ok := charset.Lookup(name)
+	if !ok {
+		return nil, false
+	}
+	if enc == nil {
+		return nil, true
+	}
+	return enc.NewDecoder().Bytes, true
+}
+
+// searchString returns the string argument of a search key,
+// p.Scanner.Value decoded from the CHARSET of the SEARCH.
+func (p *Parser) searchString() (string, error) {
+	if p.searchDecode == nil {
+		return string(p.Scanner.Value), nil
+	}
+	b, err := p.searchDecode(p.Scanner.Value)
+	if err != nil {
+		return "", fmt.Errorf("SEARCH string is not %s: %v", p.Command.Search.Charset, err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,96 @@
+package imapparser
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzParseCommand(f *testing.F) {
+	for _, test := range parseCommandTests {
+		f.Add(test.input, uint8(test.mode))
+	}
+	f.Fuzz(func(t *testing.T, input string, mode uint8) {
+		r := bufio.NewReader(strings.NewReader(input))
+		lit := filer.BufferFile(1024)
+		defer lit.Close()
+		p := &Parser{
+			Scanner: NewScanner(r, lit, nil),
+			Mode:    Mode(mode % 3),
+		}
+		// Parse commands until the input runs out.
+		for i := 0; i < 100; i++ {
+			if err := p.ParseCommand(); err != nil {
+				if p.Scanner.Error != nil {
+					return
+				}
+			}
+			if _, err := r.Peek(1); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzScanner(f *testing.F) {
+	for _, test := range scannerTests {
+		var expects []byte
+		for i := 0; i < len(test.output); i++ {
+			expects = append(expects, byte(test.expects[i]))
+		}
+		f.Add(test.input, expects)
+	}
+	f.Fuzz(func(t *testing.T, input string, expects []byte) {
+		r := bufio.NewReader(strings.NewReader(input))
+		lit := filer.BufferFile(1024)
+		defer lit.Close()
+		s := NewScanner(r, lit, nil)
+		for i := 0; i < 1000; i++ {
+			var expect Token
+			if i < len(expects) {
+				expect = Token(expects[i]) % (TokenEnd + 1)
+			}
+			if !s.Next(expect) {
+				return
+			}
+		}
+	})
+}
+
+// FuzzSequences checks that a scanned sequence-set formats as a
+// sequence-set that scans back to the same ranges, and that its
+// SeqSet holds the same numbers.
+func FuzzSequences(f *testing.F) {
+	for _, seed := range []string{"1", "*", "1:*", "*:5", "9:3", "2,4:7,9,12:*", "$", "4294967295", "1,1,2:2"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		r := bufio.NewReader(strings.NewReader(input))
+		lit := filer.BufferFile(1024)
+		defer lit.Close()
+		s := NewScanner(r, lit, nil)
+		if !s.Next(TokenSequences) {
+			return
+		}
+		seqs := append([]SeqRange(nil), s.Sequences...)
+
+		buf := new(strings.Builder)
+		FormatSeqs(buf, seqs)
+		if got := parseSeqs(t, buf.String()); !reflect.DeepEqual(got, seqs) {
+			t.Fatalf("%q scans as %v, formats as %q, scans as %v", input, seqs, buf.String(), got)
+		}
+
+		if IsSeqSaved(seqs) {
+			return
+		}
+		set := NewSeqSet(seqs)
+		for _, r := range seqs {
+			for _, v := range []uint32{r.Min - 1, r.Min, r.Min + 1, r.Max - 1, r.Max, r.Max + 1} {
+				if set.Contains(v) != (v != 0 && SeqContains(seqs, v)) {
+					t.Fatalf("%v.Contains(%d)=%v, SeqContains(%v)=%v", set, v, set.Contains(v), seqs, SeqContains(seqs, v))
+				}
+			}
+		}
+	})
+}
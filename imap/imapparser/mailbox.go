@@ -0,0 +1,38 @@
+package imapparser
+
+import (
+	"bytes"
+
+	"spilled.ink/imap/imapparser/utf7mod"
+)
+
+// DecodeMailbox appends to dst the mailbox name src as a client
+// sent it, in the form sessions look names up by.
+//
+// The name is decoded from modified UTF-7. INBOX is case-insensitive,
+// RFC 3501 section 5.1, so "Inbox" and "inbox/Lists" are spelled
+// "INBOX" and "INBOX/Lists". A trailing hierarchy delimiter, which
+// some clients send after a name, is removed.
+//
+// The delimiter delim may be 0 for a flat namespace.
+func DecodeMailbox(dst, src []byte, delim byte) ([]byte, error) {
+	start := len(dst)
+	dec, err := utf7mod.AppendDecode(dst, src)
+	if err != nil {
+		return dst, err
+	}
+	dst = dec
+	name := dst[start:]
+	if delim != 0 && len(name) > 1 && name[len(name)-1] == delim {
+		name = name[:len(name)-1]
+		dst = dst[:start+len(name)]
+	}
+	if len(name) >= 5 && bytes.EqualFold(name[:5], inbox) {
+		if len(name) == 5 || (delim != 0 && name[5] == delim) {
+			copy(name, inbox)
+		}
+	}
+	return dst, nil
+}
+
+var inbox = []byte("INBOX")
@@ -0,0 +1,45 @@
+package imapparser
+
+import "testing"
+
+func TestDecodeMailbox(t *testing.T) {
+	for _, test := range []struct {
+		src   string
+		delim byte
+		want  string
+	}{
+		{src: "INBOX", delim: '/', want: "INBOX"},
+		{src: "inbox", delim: '/', want: "INBOX"},
+		{src: "Inbox", delim: '/', want: "INBOX"},
+		{src: "iNbOx", delim: '/', want: "INBOX"},
+		{src: "Inbox/", delim: '/', want: "INBOX"},
+		{src: "inbox/Lists", delim: '/', want: "INBOX/Lists"},
+		{src: "inbox/Lists/", delim: '/', want: "INBOX/Lists"},
+		{src: "inbox.Lists", delim: '.', want: "INBOX.Lists"},
+		{src: "inbox.Lists", delim: '/', want: "inbox.Lists"},
+		{src: "Inboxes", delim: '/', want: "Inboxes"},
+		{src: "Archive/inbox", delim: '/', want: "Archive/inbox"},
+		{src: "Archive/", delim: '/', want: "Archive"},
+		{src: "Archive/", delim: 0, want: "Archive/"},
+		{src: "inbox", delim: 0, want: "INBOX"},
+		{src: "/", delim: '/', want: "/"},
+		{src: "", delim: '/', want: ""},
+		{src: "&ZeVnLIqe-/", delim: '/', want: "日本語"},
+		{src: "inbox/&U,BTFw-", delim: '/', want: "INBOX/台北"},
+	} {
+		got, err := DecodeMailbox([]byte("prefix:"), []byte(test.src), test.delim)
+		if err != nil {
+			t.Errorf("DecodeMailbox(%q, %q): %v", test.src, test.delim, err)
+			continue
+		}
+		if want := "prefix:" + test.want; string(got) != want {
+			t.Errorf("DecodeMailbox(%q, %q)=%q, want %q", test.src, test.delim, got, want)
+		}
+	}
+
+	if got, err := DecodeMailbox([]byte("prefix:"), []byte("&AA-"), '/'); err == nil {
+		t.Errorf("DecodeMailbox(invalid UTF-7)=%q, want error", got)
+	} else if string(got) != "prefix:" {
+		t.Errorf("DecodeMailbox(invalid UTF-7) dst=%q, want unchanged", got)
+	}
+}
@@ -7,18 +7,36 @@ import (
 	"fmt"
 	"math"
 	"strconv"
-	"strings"
-
-	"spilled.ink/imap/imapparser/utf7mod"
 )
 
 type Parser struct {
 	Scanner *Scanner
 	Mode    Mode
 
+	// Limits on SEARCH expressions, so a client cannot exhaust
+	// the stack or memory with one query. Zero values are
+	// replaced by defaults.
+	MaxSearchDepth int // nesting of NOT, OR, and lists, default 64
+	MaxSearchKeys  int // search keys in one command, default 1000
+
+	// Delimiter is the mailbox hierarchy delimiter, used to
+	// normalize mailbox names. See DecodeMailbox.
+	Delimiter byte
+
 	Command Command
+
+	searchKeys int // search keys parsed in the current command
+
+	// searchDecode converts search strings from the SEARCH
+	// CHARSET to UTF-8. It is nil for UTF-8 and US-ASCII.
+	searchDecode func([]byte) ([]byte, error)
 }
 
+const (
+	defaultMaxSearchDepth = 64
+	defaultMaxSearchKeys  = 1000
+)
+
 func (p *Parser) error(errctx string) error {
 	if p.Scanner.Error != nil {
 		return p.Scanner.Error
@@ -30,14 +48,10 @@ func (p *Parser) parseMailbox(cmd *Command) (bool, error) {
 	if !p.Scanner.Next(TokenString) {
 		return false, nil
 	}
-	if len(p.Scanner.Value) == 5 && strings.EqualFold("INBOX", string(p.Scanner.Value)) {
-		cmd.Mailbox = append(cmd.Mailbox, "INBOX"...)
-	} else {
-		var err error
-		cmd.Mailbox, err = utf7mod.AppendDecode(cmd.Mailbox, p.Scanner.Value)
-		if err != nil {
-			return false, err
-		}
+	var err error
+	cmd.Mailbox, err = DecodeMailbox(cmd.Mailbox, p.Scanner.Value, p.Delimiter)
+	if err != nil {
+		return false, err
 	}
 	return true, nil
 }
@@ -79,13 +93,14 @@ func (p *Parser) ParseCommand() (err error) {
 	defer func() {
 		if err != nil {
 			p.Scanner.Drain()
-			if p.Scanner.Error != nil {
-				// TODO: export ioErr?
-				if p.Scanner.ioErr != nil {
-					p.Command.reset()
-					err = p.Scanner.ioErr
-					return
-				}
+			// An I/O error may end a token early and surface
+			// as a parse error. Report the I/O error, so a
+			// timeout or closed connection is seen as one.
+			// TODO: export ioErr?
+			if p.Scanner.ioErr != nil {
+				p.Command.reset()
+				err = p.Scanner.ioErr
+				return
 			}
 			if len(p.Command.Tag) > 0 {
 				err = TaggedError{
@@ -153,7 +168,8 @@ func (p *Parser) ParseCommand() (err error) {
 	case "LOGIN", "AUTHENTICATE", "STARTTLS":
 		goodMode = p.Mode == ModeNonAuth
 	case "APPEND", "CREATE", "DELETE", "ENABLE", "EXAMINE", "IDLE", "LIST", "LSUB",
-		"RENAME", "SELECT", "STATUS", "SUBSCRIBE", "UNSUBSCRIBE",
+		"NAMESPACE", "RENAME", "SELECT", "STATUS", "SUBSCRIBE", "UNSUBSCRIBE",
+		"SETACL", "DELETEACL", "GETACL", "LISTRIGHTS", "MYRIGHTS",
 		"XAPPLEPUSHSERVICE":
 		goodMode = p.Mode == ModeAuth || p.Mode == ModeSelected
 	case "CHECK", "CLOSE", "EXPUNGE", "COPY", "MOVE", "FETCH", "STORE", "SEARCH":
@@ -165,7 +181,7 @@ func (p *Parser) ParseCommand() (err error) {
 
 	// Commands listed mostly in the order they appear in RFC 3501 section 6.
 	switch cmd.Name {
-	case "CAPABILITY", "NOOP", "LOGOUT", "STARTTLS":
+	case "CAPABILITY", "NOOP", "LOGOUT", "STARTTLS", "NAMESPACE":
 		// no arguments
 
 	case "COMPRESS": // RFC 4978
@@ -436,20 +452,17 @@ func (p *Parser) ParseCommand() (err error) {
 		case TokenUnknown, TokenEnd:
 			return fmt.Errorf("APPEND missing literal data")
 		case TokenListStart:
-			var err error
 			for {
 				if p.Scanner.NextOrEnd(TokenListEnd) {
 					break
 				}
 				if !p.Scanner.Next(TokenFlag) {
-					err = fmt.Errorf("APPEND expecting flag, got token %s", p.Scanner.Token)
-					continue // until we find list end
+					// The token is neither a flag nor list end,
+					// and nothing was consumed, so stop here.
+					return p.error(fmt.Sprintf("APPEND expecting flag, got token %s", p.Scanner.Token))
 				}
 				cmd.Append.Flags = appendValue(cmd.Append.Flags, p.Scanner.Value)
 			}
-			if err != nil {
-				return err
-			}
 			if p.Scanner.Token != TokenListEnd {
 				return fmt.Errorf("APPEND missing flag list end")
 			}
@@ -648,6 +661,26 @@ func (p *Parser) ParseCommand() (err error) {
 			return fmt.Errorf("%smissing mailbox name", cmd.Name)
 		}
 
+	case "SETACL", "DELETEACL", "GETACL", "LISTRIGHTS", "MYRIGHTS": // RFC 4314
+		if ok, err := p.parseMailbox(cmd); err != nil {
+			return fmt.Errorf("%s bad mailbox name: %v", cmd.Name, err)
+		} else if !ok {
+			return fmt.Errorf("%s missing mailbox name", cmd.Name)
+		}
+		switch cmd.Name {
+		case "SETACL", "DELETEACL", "LISTRIGHTS":
+			if !p.Scanner.Next(TokenString) {
+				return fmt.Errorf("%s missing identifier", cmd.Name)
+			}
+			cmd.ACL.Identifier = append(cmd.ACL.Identifier, p.Scanner.Value...)
+		}
+		if cmd.Name == "SETACL" {
+			if !p.Scanner.Next(TokenString) {
+				return errors.New("SETACL missing rights")
+			}
+			cmd.ACL.Rights = append(cmd.ACL.Rights, p.Scanner.Value...)
+		}
+
 	case "XAPPLEPUSHSERVICE":
 		aps := &ApplePushService{}
 		cmd.ApplePushService = aps
@@ -671,7 +704,11 @@ func (p *Parser) ParseCommand() (err error) {
 					if !p.Scanner.Next(TokenString) {
 						return fmt.Errorf("XAPPLEPUSHSERVICE mailbox is not a string")
 					}
-					aps.Mailboxes = append(aps.Mailboxes, string(p.Scanner.Value))
+					name, err := DecodeMailbox(nil, p.Scanner.Value, p.Delimiter)
+					if err != nil {
+						return fmt.Errorf("XAPPLEPUSHSERVICE bad mailbox name: %v", err)
+					}
+					aps.Mailboxes = append(aps.Mailboxes, string(name))
 				}
 			case "aps-version":
 				if !p.Scanner.Next(TokenNumber) {
@@ -725,6 +762,7 @@ var commands = map[string]string{
 	"EXAMINE":           "EXAMINE",
 	"LIST":              "LIST",
 	"LSUB":              "LSUB",
+	"NAMESPACE":         "NAMESPACE",
 	"RENAME":            "RENAME",
 	"SELECT":            "SELECT",
 	"STATUS":            "STATUS",
@@ -739,6 +777,11 @@ var commands = map[string]string{
 	"STORE":             "STORE",
 	"SEARCH":            "SEARCH",
 	"UID":               "UID",
+	"SETACL":            "SETACL",
+	"DELETEACL":         "DELETEACL",
+	"GETACL":            "GETACL",
+	"LISTRIGHTS":        "LISTRIGHTS",
+	"MYRIGHTS":          "MYRIGHTS",
 	"XAPPLEPUSHSERVICE": "XAPPLEPUSHSERVICE",
 }
 
@@ -782,6 +825,12 @@ var searchKeys = map[string]SearchKey{
 	"UNKEYWORD":  SearchKey("UNKEYWORD"),
 	"UNSEEN":     SearchKey("UNSEEN"),
 	"MODSEQ":     SearchKey("MODSEQ"),
+	"OLDER":      SearchKey("OLDER"),   // RFC 5032 WITHIN
+	"YOUNGER":    SearchKey("YOUNGER"), // RFC 5032 WITHIN
+
+	"X-ATTACHMENT":      SearchKey("X-ATTACHMENT"),
+	"X-ATTACHMENT-NAME": SearchKey("X-ATTACHMENT-NAME"),
+	"X-ATTACHMENT-TYPE": SearchKey("X-ATTACHMENT-TYPE"),
 }
 
 func (p *Parser) parseSelect(cmd *Command) error {
@@ -833,8 +882,8 @@ func (p *Parser) parseSelect(cmd *Command) error {
 				return fmt.Errorf("%s bad QRESYNC known UIDs sequence", cmd.Name)
 			}
 			cmd.Qresync.UIDs = append(cmd.Qresync.UIDs, p.Scanner.Sequences...)
-			if len(cmd.Qresync.UIDs) == 1 && (cmd.Qresync.UIDs[0] == SeqRange{}) {
-				return fmt.Errorf("%s bad QRESYNC known UIDs sequence, '*' is not allowed", cmd.Name)
+			if hasSeqStar(cmd.Qresync.UIDs) {
+				return fmt.Errorf("%s bad QRESYNC known UIDs sequence, '*' and '$' are not allowed", cmd.Name)
 			}
 			if p.Scanner.Next(TokenListEnd) {
 				return nil // parameter is optional
@@ -848,15 +897,15 @@ func (p *Parser) parseSelect(cmd *Command) error {
 				return fmt.Errorf("%s bad QRESYNC match list UIDs sequence", cmd.Name)
 			}
 			cmd.Qresync.KnownSeqNumMatch = append(cmd.Qresync.KnownSeqNumMatch, p.Scanner.Sequences...)
-			if len(cmd.Qresync.KnownSeqNumMatch) == 1 && (cmd.Qresync.KnownSeqNumMatch[0] == SeqRange{}) {
-				return fmt.Errorf("%s bad QRESYNC known seqnum match, '*' is not allowed", cmd.Name)
+			if hasSeqStar(cmd.Qresync.KnownSeqNumMatch) {
+				return fmt.Errorf("%s bad QRESYNC known seqnum match, '*' and '$' are not allowed", cmd.Name)
 			}
 			if !p.Scanner.Next(TokenSequences) {
 				return fmt.Errorf("%s bad QRESYNC match list UIDs sequence", cmd.Name)
 			}
 			cmd.Qresync.KnownUIDMatch = append(cmd.Qresync.KnownUIDMatch, p.Scanner.Sequences...)
-			if len(cmd.Qresync.KnownUIDMatch) == 1 && (cmd.Qresync.KnownUIDMatch[0] == SeqRange{}) {
-				return fmt.Errorf("%s bad QRESYNC known UIDs match, '*' is not allowed", cmd.Name)
+			if hasSeqStar(cmd.Qresync.KnownUIDMatch) {
+				return fmt.Errorf("%s bad QRESYNC known UIDs match, '*' and '$' are not allowed", cmd.Name)
 			}
 			if !p.Scanner.Next(TokenListEnd) {
 				return fmt.Errorf("%s missing QRESYNC match list end", cmd.Name)
@@ -875,6 +924,8 @@ func (p *Parser) parseSelect(cmd *Command) error {
 }
 
 func (p *Parser) parseSearchCommands() error {
+	p.searchKeys = 0
+	p.searchDecode = nil
 	if !p.Scanner.Next(TokenSearchKey) {
 		return p.error("missing search key")
 	}
@@ -884,14 +935,12 @@ func (p *Parser) parseSearchCommands() error {
 			return p.error("missing CHARSET value")
 		}
 		asciiUpper(p.Scanner.Value)
-		switch string(p.Scanner.Value) {
-		case "UTF-8":
-			p.Command.Search.Charset = "UTF-8"
-		case "US-ASCII":
-			p.Command.Search.Charset = "US-ASCII"
-		default:
-			return p.error("unsupported CHARSET")
+		decode, ok := charsetDecoder(string(p.Scanner.Value))
+		if !ok {
+			return BadCharsetError{Charset: string(p.Scanner.Value)}
 		}
+		p.Command.Search.Charset = string(p.Scanner.Value)
+		p.searchDecode = decode
 
 		if !p.Scanner.Next(TokenSearchKey) {
 			return p.error("missing search key")
@@ -919,6 +968,8 @@ func (p *Parser) parseSearchCommands() error {
 				val = "ALL"
 			case "COUNT":
 				val = "COUNT"
+			case "SAVE":
+				val = "SAVE" // SEARCHRES RFC 5182
 			case ")": // TODO: should this scan as a TokenSearchKey?
 				break returnLoop
 			default:
@@ -944,7 +995,7 @@ func (p *Parser) parseSearchCommands() error {
 	p.Command.Search.Op = rootOp
 
 	for {
-		op, err := p.parseSearchKey()
+		op, err := p.parseSearchKey(0)
 		if err != nil {
 			p.Command.Search.Op = nil
 			return err
@@ -969,7 +1020,23 @@ func (p *Parser) parseSearchCommands() error {
 
 // parseSearchKey parses a search-key.
 // It requires Scanner.Next(TokenSearchKey) already be successfully called.
-func (p *Parser) parseSearchKey() (*SearchOp, error) {
+func (p *Parser) parseSearchKey(depth int) (*SearchOp, error) {
+	maxDepth := p.MaxSearchDepth
+	if maxDepth == 0 {
+		maxDepth = defaultMaxSearchDepth
+	}
+	if depth > maxDepth {
+		return nil, parseErrorf("SEARCH keys nested more than %d deep", maxDepth)
+	}
+	maxKeys := p.MaxSearchKeys
+	if maxKeys == 0 {
+		maxKeys = defaultMaxSearchKeys
+	}
+	p.searchKeys++
+	if p.searchKeys > maxKeys {
+		return nil, parseErrorf("SEARCH has more than %d keys", maxKeys)
+	}
+
 	op := &SearchOp{}
 	if len(p.Scanner.Sequences) > 0 {
 		op.Key = "SEQSET"
@@ -988,13 +1055,19 @@ func (p *Parser) parseSearchKey() (*SearchOp, error) {
 
 	switch op.Key {
 	case "ALL", "ANSWERED", "DELETED", "FLAGGED", "NEW", "OLD", "RECENT", "SEEN",
-		"UNANSWERED", "UNDELETED", "UNFLAGGED", "UNSEEN", "DRAFT":
+		"UNANSWERED", "UNDELETED", "UNFLAGGED", "UNSEEN", "DRAFT",
+		"X-ATTACHMENT":
 		return op, nil
-	case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO":
+	case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO",
+		"X-ATTACHMENT-NAME", "X-ATTACHMENT-TYPE":
 		if !p.Scanner.Next(TokenString) {
 			return nil, p.error(fmt.Sprintf("search key %s missing string argument", op.Key))
 		}
-		op.Value = string(p.Scanner.Value)
+		v, err := p.searchString()
+		if err != nil {
+			return nil, err
+		}
+		op.Value = v
 		return op, nil
 	case "KEYWORD", "UNKEYWORD":
 		if !p.Scanner.Next(TokenAtom) { // flag-keyword
@@ -1018,7 +1091,11 @@ func (p *Parser) parseSearchKey() (*SearchOp, error) {
 		if !p.Scanner.Next(TokenString) {
 			return nil, fmt.Errorf("SEARCH HEADER missing field value")
 		}
-		b = append(b, p.Scanner.Value...)
+		v, err := p.searchString()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
 		op.Value = string(b)
 		return op, nil
 
@@ -1029,13 +1106,21 @@ func (p *Parser) parseSearchKey() (*SearchOp, error) {
 		op.Num = int64(p.Scanner.Number)
 		return op, nil
 
+	case "OLDER", "YOUNGER":
+		// RFC 5032: interval in seconds, nz-number
+		if !p.Scanner.Next(TokenNumber) || p.Scanner.Number == 0 {
+			return nil, fmt.Errorf("SEARCH %s invalid interval", op.Key)
+		}
+		op.Num = int64(p.Scanner.Number)
+		return op, nil
+
 	case "NOT":
 		// search-key
 		if !p.Scanner.Next(TokenSearchKey) {
 			return nil, fmt.Errorf("SEARCH key NOT missing term")
 		}
 		asciiUpper(p.Scanner.Value)
-		ch, err := p.parseSearchKey()
+		ch, err := p.parseSearchKey(depth + 1)
 		if err != nil {
 			return nil, err
 		}
@@ -1048,7 +1133,7 @@ func (p *Parser) parseSearchKey() (*SearchOp, error) {
 			return nil, fmt.Errorf("SEARCH key OR missing first term")
 		}
 		asciiUpper(p.Scanner.Value)
-		ch, err := p.parseSearchKey()
+		ch, err := p.parseSearchKey(depth + 1)
 		if err != nil {
 			return nil, err
 		}
@@ -1058,7 +1143,7 @@ func (p *Parser) parseSearchKey() (*SearchOp, error) {
 			return nil, fmt.Errorf("SEARCH key OR missing second term")
 		}
 		asciiUpper(p.Scanner.Value)
-		ch, err = p.parseSearchKey()
+		ch, err = p.parseSearchKey(depth + 1)
 		if err != nil {
 			return nil, err
 		}
@@ -1084,7 +1169,7 @@ func (p *Parser) parseSearchKey() (*SearchOp, error) {
 				break
 			}
 
-			ch, err := p.parseSearchKey()
+			ch, err := p.parseSearchKey(depth + 1)
 			if err != nil {
 				return nil, err
 			}
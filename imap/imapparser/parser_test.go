@@ -45,6 +45,16 @@ var parseCommandTests = []struct {
 		input:  "0 NOOP\r\n",
 		output: Command{Tag: []byte("0"), Name: "NOOP"},
 	},
+	{
+		input:  "0 NAMESPACE\r\n",
+		mode:   ModeAuth,
+		output: Command{Tag: []byte("0"), Name: "NAMESPACE"},
+	},
+	{
+		input:  "0 NAMESPACE INBOX\r\n",
+		mode:   ModeAuth,
+		errstr: "trailing arguments",
+	},
 	{
 		input:  "0 LOGIN\r\n",
 		mode:   ModeAuth,
@@ -240,6 +250,21 @@ var parseCommandTests = []struct {
 			},
 		},
 	},
+	{
+		input:  "A04 SELECT INBOX (QRESYNC (67890007 90060115194045000 41:*))\r\n",
+		mode:   ModeAuth,
+		errstr: "'*' and '$' are not allowed",
+	},
+	{
+		input:  "A05 SELECT INBOX (QRESYNC (67890007 90060115194045000 41:211 (1,*:4 41,43:45)))\r\n",
+		mode:   ModeAuth,
+		errstr: "'*' and '$' are not allowed",
+	},
+	{
+		input:  "A06 SELECT INBOX (QRESYNC (67890007 90060115194045000 $))\r\n",
+		mode:   ModeAuth,
+		errstr: "'*' and '$' are not allowed",
+	},
 
 	{
 		input: "0 EXAMINE INBOX (CONDSTORE)\r\n",
@@ -444,6 +469,30 @@ var parseCommandTests = []struct {
 		mode:   ModeSelected,
 		errstr: "unsupported CHARSET",
 	},
+	{
+		input: "3 SEARCH CHARSET ISO-8859-1 SUBJECT {3}\r\nd\xe9j\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:  []byte("3"),
+			Name: "SEARCH",
+			Search: Search{
+				Op:      &SearchOp{Key: "SUBJECT", Value: "déj"},
+				Charset: "ISO-8859-1",
+			},
+		},
+	},
+	{
+		input: "3 SEARCH CHARSET utf-7 HEADER X-Dest \"+ZeVnLIqe-\"\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:  []byte("3"),
+			Name: "SEARCH",
+			Search: Search{
+				Op:      &SearchOp{Key: "HEADER", Value: "X-Dest: 日本語"},
+				Charset: "UTF-7",
+			},
+		},
+	},
 	{
 		input:  "3 SEARCH NOT\r\n",
 		mode:   ModeSelected,
@@ -518,6 +567,22 @@ var parseCommandTests = []struct {
 			}},
 		},
 	},
+	{
+		input: "3 SEARCH X-ATTACHMENT X-ATTACHMENT-NAME report x-attachment-type \"image/*\"\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:  []byte("3"),
+			Name: "SEARCH",
+			Search: Search{Op: &SearchOp{
+				Key: "AND",
+				Children: []SearchOp{
+					{Key: "X-ATTACHMENT"},
+					{Key: "X-ATTACHMENT-NAME", Value: "report"},
+					{Key: "X-ATTACHMENT-TYPE", Value: "image/*"},
+				},
+			}},
+		},
+	},
 	{
 		input: "3 SEARCH RETURN (COUNT ALL) UNSEEN\r\n",
 		mode:  ModeSelected,
@@ -561,6 +626,46 @@ var parseCommandTests = []struct {
 			},
 		},
 	},
+	{
+		input: "A282 SEARCH RETURN (SAVE MIN) FLAGGED SINCE 1-Feb-1994 NOT FROM \"Smith\"\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:  []byte("A282"),
+			Name: "SEARCH",
+			Search: Search{
+				Return: []string{"SAVE", "MIN"},
+				Op: &SearchOp{
+					Key: "AND",
+					Children: []SearchOp{
+						{Key: "FLAGGED"},
+						{Key: "SINCE", Date: time.Date(1994, time.February, 1, 0, 0, 0, 0, time.UTC)},
+						{Key: "NOT", Children: []SearchOp{{Key: "FROM", Value: "Smith"}}},
+					},
+				},
+			},
+		},
+	},
+	{
+		input: "A283 SEARCH RETURN (SAVE) UID $ OR $ SMALLER 4096\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:  []byte("A283"),
+			Name: "SEARCH",
+			Search: Search{
+				Return: []string{"SAVE"},
+				Op: &SearchOp{
+					Key: "AND",
+					Children: []SearchOp{
+						{Key: "UID", Sequences: []SeqRange{SeqSaved}},
+						{Key: "OR", Children: []SearchOp{
+							{Key: "SEQSET", Sequences: []SeqRange{SeqSaved}},
+							{Key: "SMALLER", Num: 4096},
+						}},
+					},
+				},
+			},
+		},
+	},
 	{
 		input: "7 search new old recent seen\r\n",
 		mode:  ModeSelected,
@@ -686,6 +791,26 @@ var parseCommandTests = []struct {
 			}},
 		},
 	},
+	{
+		input: "t SEARCH UNSEEN YOUNGER 259200\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:  []byte("t"),
+			Name: "SEARCH",
+			Search: Search{Op: &SearchOp{
+				Key: "AND",
+				Children: []SearchOp{
+					{Key: "UNSEEN"},
+					{Key: "YOUNGER", Num: 259200},
+				},
+			}},
+		},
+	},
+	{
+		input:  "t SEARCH OLDER 0\r\n",
+		mode:   ModeSelected,
+		errstr: "SEARCH OLDER invalid interval",
+	},
 	{
 		input: "t SEARCH SMALLER 50\r\n",
 		mode:  ModeSelected,
@@ -1001,6 +1126,19 @@ var parseCommandTests = []struct {
 			},
 		},
 	},
+	{
+		input: "A004 STORE 1 FLAGS (\\SEEN \\flagged $Junk)\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:       []byte("A004"),
+			Name:      "STORE",
+			Sequences: []SeqRange{{1, 1}},
+			Store: Store{
+				Mode:  StoreReplace,
+				Flags: [][]byte{[]byte("\\Seen"), []byte("\\Flagged"), []byte("$Junk")},
+			},
+		},
+	},
 	{
 		input:  "TAG STORE 2:4 boo (\\Deleted)\r\n",
 		mode:   ModeSelected,
@@ -1031,6 +1169,17 @@ var parseCommandTests = []struct {
 			Mailbox:   []byte("MEETING"),
 		},
 	},
+	{
+		input: "A004 UID COPY $ MEETING\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:       []byte("A004"),
+			Name:      "COPY",
+			UID:       true,
+			Sequences: []SeqRange{SeqSaved},
+			Mailbox:   []byte("MEETING"),
+		},
+	},
 	{
 		input: "A003 UID MOVE 2:4 MEETING\r\n",
 		mode:  ModeSelected,
@@ -1059,6 +1208,120 @@ var parseCommandTests = []struct {
 			},
 		},
 	},
+	{
+		input: "A035 SETACL INBOX/Drafts john lrQswicdakxet\r\n",
+		mode:  ModeAuth,
+		output: Command{
+			Tag:     []byte("A035"),
+			Name:    "SETACL",
+			Mailbox: []byte("INBOX/Drafts"),
+			ACL: struct {
+				Identifier []byte
+				Rights     []byte
+			}{[]byte("john"), []byte("lrQswicdakxet")},
+		},
+	},
+	{
+		input: "A002 SETACL Shared \"bob@example.com\" +lrs\r\n",
+		mode:  ModeSelected,
+		output: Command{
+			Tag:     []byte("A002"),
+			Name:    "SETACL",
+			Mailbox: []byte("Shared"),
+			ACL: struct {
+				Identifier []byte
+				Rights     []byte
+			}{[]byte("bob@example.com"), []byte("+lrs")},
+		},
+	},
+	{
+		input: "A036 DELETEACL INBOX/Drafts john\r\n",
+		mode:  ModeAuth,
+		output: Command{
+			Tag:     []byte("A036"),
+			Name:    "DELETEACL",
+			Mailbox: []byte("INBOX/Drafts"),
+			ACL: struct {
+				Identifier []byte
+				Rights     []byte
+			}{Identifier: []byte("john")},
+		},
+	},
+	{
+		input: "A037 GETACL INBOX\r\n",
+		mode:  ModeAuth,
+		output: Command{
+			Tag:     []byte("A037"),
+			Name:    "GETACL",
+			Mailbox: []byte("INBOX"),
+		},
+	},
+	{
+		input: "a LISTRIGHTS ~/Mail/saved smith\r\n",
+		mode:  ModeAuth,
+		output: Command{
+			Tag:     []byte("a"),
+			Name:    "LISTRIGHTS",
+			Mailbox: []byte("~/Mail/saved"),
+			ACL: struct {
+				Identifier []byte
+				Rights     []byte
+			}{Identifier: []byte("smith")},
+		},
+	},
+	{
+		input: "A003 MYRIGHTS INBOX\r\n",
+		mode:  ModeAuth,
+		output: Command{
+			Tag:     []byte("A003"),
+			Name:    "MYRIGHTS",
+			Mailbox: []byte("INBOX"),
+		},
+	},
+	{
+		name:   "deeply nested search lists",
+		input:  "t SEARCH " + strings.Repeat("(", 1000) + "ALL" + strings.Repeat(")", 1000) + "\r\n",
+		mode:   ModeSelected,
+		errstr: "SEARCH keys nested more than 64 deep",
+	},
+	{
+		name:   "deeply nested search NOT",
+		input:  "t SEARCH " + strings.Repeat("NOT ", 1000) + "ALL\r\n",
+		mode:   ModeSelected,
+		errstr: "SEARCH keys nested more than 64 deep",
+	},
+	{
+		name:   "too many search keys",
+		input:  "t SEARCH" + strings.Repeat(" SEEN", 1001) + "\r\n",
+		mode:   ModeSelected,
+		errstr: "SEARCH has more than 1000 keys",
+	},
+	{
+		name:   "too many search keys in OR",
+		input:  "t SEARCH OR (" + strings.Repeat("SEEN ", 600) + ") (" + strings.Repeat("SEEN ", 600) + ")\r\n",
+		mode:   ModeSelected,
+		errstr: "SEARCH has more than 1000 keys",
+	},
+	{
+		input:  "t APPEND INBOX (\\Seen (x))\r\n",
+		mode:   ModeAuth,
+		errstr: "APPEND expecting flag",
+	},
+	{
+		input:  "t APPEND INBOX {3}\r\nabc {3}\r\nxyz\r\n",
+		mode:   ModeAuth,
+		errstr: "unexpected literal",
+	},
+	{
+		input:  "A004 SETACL INBOX john\r\n",
+		mode:   ModeAuth,
+		errstr: "SETACL missing rights",
+	},
+	{
+		input:  "A005 MYRIGHTS INBOX\r\n",
+		mode:   ModeNonAuth,
+		errstr: "bad mode",
+	},
 }
 
 func literal(contents string) *iox.BufferFile {
@@ -1110,6 +1373,76 @@ func TestParseCommand(t *testing.T) {
 	}
 }
 
+func TestCommandSummary(t *testing.T) {
+	tests := []struct {
+		mode  Mode
+		input string
+		want  string
+	}{
+		{ModeNonAuth, "a LOGIN fred secret\r\n", "LOGIN"},
+		{ModeSelected, "a SELECT \"Drafts\"\r\n", `SELECT mailbox="Drafts"`},
+		{ModeSelected, "a UID FETCH 1:5,7 (UID BODY.PEEK[HEADER.FIELDS (From)])\r\n", "UID FETCH seqs=1:5,7 items=(UID BODY.PEEK[HEADER.FIELDS (From)])"},
+		{ModeSelected, "a STORE 2 +FLAGS.SILENT (\\Seen \\Flagged)\r\n", "STORE seqs=2 store=+FLAGS.SILENT flags=2"},
+		{ModeSelected, "a UID SEARCH FROM \"secret\" OR SUBJECT \"x\" NOT TEXT \"y\"\r\n", "UID SEARCH search=(AND FROM (OR SUBJECT (NOT TEXT)))"},
+		{ModeSelected, "a RENAME old new\r\n", `RENAME rename="old","new"`},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		f := filer.BufferFile(1024)
+		defer f.Close()
+		p := &Parser{Scanner: NewScanner(r, f, nil), Mode: test.mode}
+		if err := p.ParseCommand(); err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if got := p.Command.Summary(); got != test.want {
+			t.Errorf("%q: Summary()=%q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestSearchLimits(t *testing.T) {
+	tests := []struct {
+		input  string
+		errstr string
+	}{
+		{input: "t SEARCH NOT (SEEN DELETED)\r\n"},
+		{input: "t SEARCH NOT (SEEN NOT DELETED)\r\n", errstr: "nested more than 2 deep"},
+		{input: "t SEARCH SEEN DELETED NEW OLD RECENT\r\n", errstr: "more than 4 keys"},
+		{input: "t SEARCH 1:3 OR SEEN DELETED OLD\r\n", errstr: "more than 4 keys"},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.input + test.input))
+		f := filer.BufferFile(1024)
+		p := &Parser{
+			Scanner:        NewScanner(r, f, nil),
+			Mode:           ModeSelected,
+			MaxSearchDepth: 2,
+			MaxSearchKeys:  4,
+		}
+		// Parse twice to check the key count is per-command.
+		for i := 0; i < 2; i++ {
+			err := p.ParseCommand()
+			if test.errstr == "" {
+				if err != nil {
+					t.Errorf("%q: %v", test.input, err)
+				}
+				continue
+			}
+			if err == nil || !strings.Contains(err.Error(), test.errstr) {
+				t.Errorf("%q: err=%v, want %q", test.input, err, test.errstr)
+				continue
+			}
+			if te, ok := err.(TaggedError); !ok {
+				t.Errorf("%q: err is %T, want TaggedError", test.input, err)
+			} else if _, ok := te.Err.(ParseError); !ok {
+				t.Errorf("%q: tagged err is %T, want ParseError", test.input, te.Err)
+			}
+		}
+		f.Close()
+	}
+}
+
 func equalSeqRange(s0, s1 []SeqRange) bool {
 	if len(s0) == 0 && len(s1) == 0 {
 		return true
@@ -1271,6 +1604,12 @@ func equalCommand(c0, c1 Command) bool {
 			return false
 		}
 	}
+	if !bytes.Equal(c0.ACL.Identifier, c1.ACL.Identifier) {
+		return false
+	}
+	if !bytes.Equal(c0.ACL.Rights, c1.ACL.Rights) {
+		return false
+	}
 	return true
 }
 
@@ -401,9 +401,13 @@ func (s *Scanner) readFlag() bool {
 			s.Error = fmt.Errorf("imapparser: invalid flag: \"%s\"", string(s.peekChar()))
 			return false
 		}
-		switch string(s.Value) {
-		case `\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`:
-			return true
+		// Flags are case-insensitive, system flags are
+		// reported in the case RFC 3501 gives them.
+		for _, flag := range systemFlags {
+			if strings.EqualFold(string(s.Value), flag) {
+				s.Value = append(s.Value[:0], flag...)
+				return true
+			}
 		}
 		s.Error = fmt.Errorf("imapparser: invalid flag: %q", string(s.Value))
 		s.Value = s.Value[:0]
@@ -412,6 +416,8 @@ func (s *Scanner) readFlag() bool {
 	return s.readAtom()
 }
 
+var systemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
 // readSeqNumber reads an IMAP seq-number.
 //
 // From RFC 3501 section 9:
@@ -532,6 +538,10 @@ func (s *Scanner) readSequence() bool {
 		s.Error = errors.New("imapparser: missing upper value of seq-number")
 		return false
 	}
+	if min == 0 {
+		// "*:5" is "5:*", the numbers from 5 to the largest.
+		min, max = max, min
+	}
 	if max < min && max != 0 {
 		min, max = max, min // normalize SeqRange
 	}
@@ -544,7 +554,17 @@ func (s *Scanner) readSequence() bool {
 // From RFC 3501 section 9:
 //
 //	sequence-set    = (seq-number / seq-range) *("," sequence-set)
+//
+// From RFC 5182 section 4:
+//
+//	sequence-set    =/ seq-last-command
+//	seq-last-command = "$"
 func (s *Scanner) readSequences() bool {
+	if s.peekChar() == '$' {
+		s.readChar()
+		s.Sequences = append(s.Sequences, SeqSaved)
+		return true
+	}
 	for {
 		if !s.readSequence() {
 			break
@@ -650,6 +670,12 @@ func (s *Scanner) readLiteral(limit int) bool {
 		return true
 	}
 
+	if s.Literal == nil {
+		// The literal buffer has been handed to a Command,
+		// as APPEND does, and no more literals are expected.
+		s.Error = fmt.Errorf("imapparser: unexpected literal")
+		return false
+	}
 	if _, err := io.CopyN(s.Literal, s.buf, int64(v)); err != nil {
 		s.Literal.Truncate(0)
 		s.Literal.Seek(0, 0)
@@ -1001,7 +1027,7 @@ func (s *Scanner) next(expect Token, allowEnd bool) bool {
 				s.readChar()
 				s.Value = append(s.Value, b)
 				s.Token = TokenSearchKey
-			} else if isDigit(b) || b == '*' {
+			} else if isDigit(b) || b == '*' || b == '$' {
 				if s.readSequences() {
 					s.Token = TokenSearchKey
 				}
@@ -113,6 +113,34 @@ var scannerTests = []struct {
 			{t: TokenEnd},
 		},
 	},
+	{
+		name:  "star first",
+		input: "*:5 3:* *:*\r\n",
+		expects: map[int]Token{
+			0: TokenSequences,
+			1: TokenSequences,
+			2: TokenSequences,
+		},
+		output: []tok{
+			{t: TokenSequences, s: []SeqRange{{Min: 5, Max: 0}}},
+			{t: TokenSequences, s: []SeqRange{{Min: 3, Max: 0}}},
+			{t: TokenSequences, s: []SeqRange{{Min: 0, Max: 0}}},
+			{t: TokenEnd},
+		},
+	},
+	{
+		name:  "saved search result",
+		input: "$ $\r\n",
+		expects: map[int]Token{
+			0: TokenSequences,
+			1: TokenSearchKey,
+		},
+		output: []tok{
+			{t: TokenSequences, s: []SeqRange{SeqSaved}},
+			{t: TokenSearchKey, s: []SeqRange{SeqSaved}},
+			{t: TokenEnd},
+		},
+	},
 	{
 		name:  "short literal",
 		input: "{4}\r\n💩\r\n",
@@ -13,17 +13,41 @@ type MatchMessage interface {
 	Header(name string) string
 	Date() time.Time
 	RFC822Size() int64
+
+	// SentDate reports the Date header field of the message for
+	// the SENTBEFORE, SENTON, and SENTSINCE search keys, in the
+	// zone it was written in. It is zero if the field is missing
+	// or cannot be parsed.
+	SentDate() time.Time
+
+	Attachments() []Attachment
+
+	// Addresses reports the addresses in the From, To, CC, or BCC
+	// field of the message for the FROM, TO, CC, and BCC search keys.
+	// It may report the decoded header value, or the addresses
+	// as "Name <user@domain>" separated by commas.
+	Addresses(field string) string
+}
+
+// Attachment describes a message attachment for the
+// non-standard X-ATTACHMENT search keys.
+type Attachment struct {
+	Name        string // file name
+	ContentType string // MIME type, "application/pdf"
 }
 
 type Matcher struct {
-	op *SearchOp
+	op  *SearchOp
+	now time.Time // OLDER and YOUNGER are relative to it
 }
 
 func NewMatcher(op *SearchOp) (*Matcher, error) {
 	// TODO: check keys are valid
-	return &Matcher{op: op}, nil
+	return &Matcher{op: op, now: timeNow()}, nil
 }
 
+var timeNow = time.Now
+
 func (m *Matcher) Match(msg MatchMessage) bool {
 	return m.match(msg, m.op)
 }
@@ -70,6 +94,10 @@ func (m *Matcher) match(msg MatchMessage, op *SearchOp) bool {
 		return !m.match(msg, &op.Children[0])
 	case "OLD":
 		return !msg.Flag(`\Recent`)
+	case "OLDER":
+		return msg.Date().Before(m.within(op.Num))
+	case "YOUNGER":
+		return !msg.Date().Before(m.within(op.Num))
 	case "ON":
 		// Ignore time.
 		year, month, day := msg.Date().Date()
@@ -79,11 +107,14 @@ func (m *Matcher) match(msg MatchMessage, op *SearchOp) bool {
 	case "SEEN":
 		return msg.Flag(`\Seen`)
 	case "SENTBEFORE":
-		// TODO
+		t, ok := sentDay(msg)
+		return ok && t.Before(op.Date)
 	case "SENTON":
-		// TODO
+		t, ok := sentDay(msg)
+		return ok && t.Equal(op.Date)
 	case "SENTSINCE":
-		// TODO
+		t, ok := sentDay(msg)
+		return ok && !t.Before(op.Date)
 	case "SINCE":
 		year, month, day := msg.Date().Date()
 		t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
@@ -102,13 +133,13 @@ func (m *Matcher) match(msg MatchMessage, op *SearchOp) bool {
 	case "SUBJECT":
 		return strings.Contains(msg.Header("Subject"), op.Value)
 	case "TO":
-		return strings.Contains(msg.Header("To"), op.Value)
+		return strings.Contains(msg.Addresses("To"), op.Value)
 	case "FROM":
-		return strings.Contains(msg.Header("From"), op.Value)
+		return strings.Contains(msg.Addresses("From"), op.Value)
 	case "CC":
-		return strings.Contains(msg.Header("CC"), op.Value)
+		return strings.Contains(msg.Addresses("CC"), op.Value)
 	case "BCC":
-		return strings.Contains(msg.Header("BCC"), op.Value)
+		return strings.Contains(msg.Addresses("BCC"), op.Value)
 	case "BODY":
 		// TODO
 	case "TEXT":
@@ -133,10 +164,68 @@ func (m *Matcher) match(msg MatchMessage, op *SearchOp) bool {
 		// TODO
 	case "UNSEEN":
 		return !msg.Flag(`\Seen`)
+	case "X-ATTACHMENT":
+		return len(msg.Attachments()) > 0
+	case "X-ATTACHMENT-NAME":
+		value := strings.ToLower(op.Value)
+		for _, a := range msg.Attachments() {
+			if strings.Contains(strings.ToLower(a.Name), value) {
+				return true
+			}
+		}
+		return false
+	case "X-ATTACHMENT-TYPE":
+		for _, a := range msg.Attachments() {
+			if MatchContentType(a.ContentType, op.Value) {
+				return true
+			}
+		}
+		return false
 	}
 	return false
 }
 
+// MatchContentType reports whether the MIME type contentType
+// matches pattern, ignoring case and parameters. A pattern of
+// "image/*" or "image" matches any image type.
+func MatchContentType(contentType, pattern string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	pattern = strings.TrimSuffix(pattern, "*")
+	if !strings.Contains(pattern, "/") {
+		pattern += "/"
+	}
+	if strings.HasSuffix(pattern, "/") {
+		return len(contentType) >= len(pattern) &&
+			strings.EqualFold(contentType[:len(pattern)], pattern)
+	}
+	return strings.EqualFold(contentType, pattern)
+}
+
+// within is the earliest date within an interval of seconds.
+func (m *Matcher) within(seconds int64) time.Time {
+	return m.now.Add(-time.Duration(seconds) * time.Second)
+}
+
+// sentDay is the day of the Date header field of msg, disregarding
+// time and timezone as RFC 3501 section 6.4.4 asks, at midnight UTC
+// like the dates of search keys.
+func sentDay(msg MatchMessage) (time.Time, bool) {
+	sent := msg.SentDate()
+	if sent.IsZero() {
+		return time.Time{}, false
+	}
+	year, month, day := sent.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC), true
+}
+
+// SeqContains reports whether seqNum is in sequences.
+//
+// A Max of 0 is '*'. SeqContains does not know the largest number
+// in use, so a range ending in '*' contains every number past its
+// Min, and "*" alone contains every number.
 func SeqContains(sequences []SeqRange, seqNum uint32) bool {
 	for _, seq := range sequences {
 		if seq.Min <= seqNum && (seq.Max == 0 || seq.Max >= seqNum) {
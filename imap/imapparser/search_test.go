@@ -1,6 +1,9 @@
 package imapparser
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 var seqContainsTests = []struct {
 	seqs    []SeqRange
@@ -37,3 +40,122 @@ func TestSeqContains(t *testing.T) {
 		}
 	}
 }
+
+type dateMsg time.Time
+
+func (m dateMsg) SeqNum() uint32                { return 1 }
+func (m dateMsg) UID() uint32                   { return 1 }
+func (m dateMsg) ModSeq() int64                 { return 1 }
+func (m dateMsg) Flag(name string) bool         { return false }
+func (m dateMsg) Header(name string) string     { return "" }
+func (m dateMsg) Date() time.Time               { return time.Time(m) }
+func (m dateMsg) SentDate() time.Time           { return time.Time(m) }
+func (m dateMsg) RFC822Size() int64             { return 0 }
+func (m dateMsg) Attachments() []Attachment     { return nil }
+func (m dateMsg) Addresses(field string) string { return "" }
+
+func TestMatchWithin(t *testing.T) {
+	now := time.Date(2019, time.March, 4, 12, 0, 0, 0, time.UTC)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	tests := []struct {
+		op   SearchOp
+		date time.Time
+		want bool
+	}{
+		{SearchOp{Key: "YOUNGER", Num: 3600}, now.Add(-59 * time.Minute), true},
+		{SearchOp{Key: "YOUNGER", Num: 3600}, now.Add(-61 * time.Minute), false},
+		{SearchOp{Key: "OLDER", Num: 3600}, now.Add(-59 * time.Minute), false},
+		{SearchOp{Key: "OLDER", Num: 3600}, now.Add(-61 * time.Minute), true},
+		{SearchOp{Key: "OLDER", Num: 86400}, now.AddDate(0, 0, -2), true},
+	}
+	for _, test := range tests {
+		m, err := NewMatcher(&test.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(dateMsg(test.date)); got != test.want {
+			t.Errorf("%s %d on %v: %v, want %v", test.op.Key, test.op.Num, test.date, got, test.want)
+		}
+	}
+}
+
+func TestMatchSent(t *testing.T) {
+	day := time.Date(2019, time.March, 4, 0, 0, 0, 0, time.UTC)
+	// Late on the 4th in California is the 5th in UTC.
+	pst := time.Date(2019, time.March, 4, 23, 30, 0, 0, time.FixedZone("", -8*60*60))
+
+	tests := []struct {
+		key  SearchKey
+		sent time.Time
+		want bool
+	}{
+		{"SENTON", pst, true},
+		{"SENTBEFORE", pst, false},
+		{"SENTSINCE", pst, true},
+		{"SENTBEFORE", day.AddDate(0, 0, -1), true},
+		{"SENTSINCE", day.AddDate(0, 0, -1), false},
+		{"SENTON", day.AddDate(0, 0, 1), false},
+		{"SENTSINCE", day.AddDate(0, 0, 1), true},
+		{"SENTON", time.Time{}, false},
+		{"SENTBEFORE", time.Time{}, false},
+		{"SENTSINCE", time.Time{}, false},
+	}
+	for _, test := range tests {
+		m, err := NewMatcher(&SearchOp{Key: test.key, Date: day})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(dateMsg(test.sent)); got != test.want {
+			t.Errorf("%s 4-Mar-2019 sent %v: %v, want %v", test.key, test.sent, got, test.want)
+		}
+	}
+}
+
+type attachMsg []Attachment
+
+func (m attachMsg) SeqNum() uint32                { return 1 }
+func (m attachMsg) UID() uint32                   { return 1 }
+func (m attachMsg) ModSeq() int64                 { return 1 }
+func (m attachMsg) Flag(name string) bool         { return false }
+func (m attachMsg) Header(name string) string     { return "" }
+func (m attachMsg) Date() time.Time               { return time.Time{} }
+func (m attachMsg) SentDate() time.Time           { return time.Time{} }
+func (m attachMsg) RFC822Size() int64             { return 0 }
+func (m attachMsg) Attachments() []Attachment     { return m }
+func (m attachMsg) Addresses(field string) string { return "" }
+
+func TestMatchAttachment(t *testing.T) {
+	report := attachMsg{
+		{Name: "Q3 Report.PDF", ContentType: "application/pdf"},
+		{Name: "chart.png", ContentType: "image/png; name=chart.png"},
+	}
+	tests := []struct {
+		op   SearchOp
+		msg  attachMsg
+		want bool
+	}{
+		{SearchOp{Key: "X-ATTACHMENT"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT"}, nil, false},
+		{SearchOp{Key: "X-ATTACHMENT-NAME", Value: "report"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT-NAME", Value: ".pdf"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT-NAME", Value: "invoice"}, report, false},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "application/pdf"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "Image/PNG"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "image/*"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "image"}, report, true},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "image/jpeg"}, report, false},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "application/p"}, report, false},
+		{SearchOp{Key: "X-ATTACHMENT-TYPE", Value: "video/*"}, report, false},
+	}
+	for _, test := range tests {
+		m, err := NewMatcher(&test.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(test.msg); got != test.want {
+			t.Errorf("%s %q: %v, want %v", test.op.Key, test.op.Value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package imapparser
+
+import (
+	"sort"
+	"strings"
+)
+
+// SeqSet is a normalized IMAP sequence-set. Its ranges are sorted,
+// do not overlap, and do not touch, so two SeqSets of the same
+// numbers are equal and print the same.
+//
+// A SeqSet follows SeqContains: a Max of 0 is '*' and reaches past
+// every number, a Min of 0 is read as 1. Only the last range of a
+// SeqSet can end in '*'.
+type SeqSet []SeqRange
+
+// seqInf is the end of a range ending in '*'.
+const seqInf = 1 << 32
+
+// span is a SeqRange as the inclusive interval [lo, hi].
+type span struct{ lo, hi uint64 }
+
+func toSpan(r SeqRange) span {
+	lo, hi := uint64(r.Min), uint64(r.Max)
+	if hi == 0 {
+		hi = seqInf
+	} else if lo > hi {
+		lo, hi = hi, lo
+	}
+	if lo == 0 {
+		lo = 1
+	}
+	return span{lo, hi}
+}
+
+func (sp span) seqRange() SeqRange {
+	r := SeqRange{Min: uint32(sp.lo)}
+	if sp.hi != seqInf {
+		r.Max = uint32(sp.hi)
+	}
+	return r
+}
+
+// NewSeqSet returns the SeqSet of the numbers in seqs.
+//
+// The saved search result, SeqSaved, is not a set of numbers and
+// must be replaced by the result before calling NewSeqSet. It is
+// skipped.
+func NewSeqSet(seqs []SeqRange) SeqSet {
+	spans := make([]span, 0, len(seqs))
+	for _, r := range seqs {
+		if r == SeqSaved {
+			continue
+		}
+		spans = append(spans, toSpan(r))
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].lo < spans[j].lo })
+
+	set := make(SeqSet, 0, len(spans))
+	cur := spans[0]
+	for _, sp := range spans[1:] {
+		if sp.lo <= cur.hi+1 {
+			if sp.hi > cur.hi {
+				cur.hi = sp.hi
+			}
+			continue
+		}
+		set = append(set, cur.seqRange())
+		cur = sp
+	}
+	return append(set, cur.seqRange())
+}
+
+// Contains reports whether v is in s.
+func (s SeqSet) Contains(v uint32) bool {
+	if v == 0 {
+		return false
+	}
+	i := sort.Search(len(s), func(i int) bool { return toSpan(s[i]).hi >= uint64(v) })
+	return i < len(s) && toSpan(s[i]).lo <= uint64(v)
+}
+
+// Union returns the numbers in s or t.
+func (s SeqSet) Union(t SeqSet) SeqSet {
+	seqs := make([]SeqRange, 0, len(s)+len(t))
+	seqs = append(seqs, s...)
+	seqs = append(seqs, t...)
+	return NewSeqSet(seqs)
+}
+
+// Intersect returns the numbers in both s and t.
+func (s SeqSet) Intersect(t SeqSet) SeqSet {
+	var set SeqSet
+	for i, j := 0, 0; i < len(s) && j < len(t); {
+		a, b := toSpan(s[i]), toSpan(t[j])
+		lo, hi := a.lo, a.hi
+		if b.lo > lo {
+			lo = b.lo
+		}
+		if b.hi < hi {
+			hi = b.hi
+		}
+		if lo <= hi {
+			set = append(set, span{lo, hi}.seqRange())
+		}
+		if a.hi < b.hi {
+			i++
+		} else {
+			j++
+		}
+	}
+	return set
+}
+
+// Each calls fn with the numbers in s, in order, until fn returns
+// false. last is the largest number in use, '*', and numbers past
+// it are not in use so fn is not called with them.
+//
+// A range n:* with n past last is last:n, RFC 3501 section 6.4.8,
+// so it holds last.
+func (s SeqSet) Each(last uint32, fn func(v uint32) bool) {
+	next := uint64(1)
+	for _, r := range s {
+		sp := toSpan(r)
+		if sp.hi == seqInf && sp.lo > uint64(last) {
+			sp.lo = uint64(last)
+		}
+		if sp.hi > uint64(last) {
+			sp.hi = uint64(last)
+		}
+		if sp.lo < next {
+			sp.lo = next // last, already called by an earlier range
+		}
+		for v := sp.lo; v <= sp.hi; v++ {
+			if !fn(uint32(v)) {
+				return
+			}
+		}
+		if sp.hi >= next {
+			next = sp.hi + 1
+		}
+	}
+}
+
+// String formats s as an IMAP sequence-set.
+func (s SeqSet) String() string {
+	buf := new(strings.Builder)
+	FormatSeqs(buf, s)
+	return buf.String()
+}
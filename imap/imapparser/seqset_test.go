@@ -0,0 +1,202 @@
+package imapparser
+
+import (
+	"bufio"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The SeqSet properties are checked against a model, the set of
+// numbers up to seqModelMax, on random sets of small numbers where
+// '*' is likely. Numbers past seqModelLast are in a set only if it
+// ends in '*'.
+const (
+	seqModelLast = 40
+	seqModelMax  = seqModelLast + 5
+)
+
+type seqModel [seqModelMax + 1]bool
+
+func modelOf(seqs []SeqRange) (m seqModel) {
+	for v := uint32(1); v <= seqModelMax; v++ {
+		m[v] = SeqContains(seqs, v)
+	}
+	return m
+}
+
+func randSeqs(rnd *rand.Rand) []SeqRange {
+	num := func() uint32 {
+		if rnd.Intn(8) == 0 {
+			return 0 // '*'
+		}
+		return uint32(1 + rnd.Intn(seqModelLast))
+	}
+	seqs := make([]SeqRange, rnd.Intn(5))
+	for i := range seqs {
+		min, max := num(), num()
+		if min == 0 || (max < min && max != 0) {
+			min, max = max, min // as the parser normalizes
+		}
+		seqs[i] = SeqRange{Min: min, Max: max}
+	}
+	return seqs
+}
+
+func checkNormalized(t *testing.T, s SeqSet) {
+	t.Helper()
+	for i, r := range s {
+		if r.Min == 0 || (r.Max != 0 && r.Max < r.Min) {
+			t.Fatalf("%v: range %d is not normalized", s, i)
+		}
+		if r.Max == 0 && i != len(s)-1 {
+			t.Fatalf("%v: '*' ends range %d of %d", s, i, len(s))
+		}
+		if i > 0 && uint64(r.Min) <= uint64(s[i-1].Max)+1 {
+			t.Fatalf("%v: ranges %d and %d overlap or touch", s, i-1, i)
+		}
+	}
+}
+
+func TestSeqSetProperties(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		a, b := randSeqs(rnd), randSeqs(rnd)
+		sa, sb := NewSeqSet(a), NewSeqSet(b)
+		checkNormalized(t, sa)
+
+		ma, mb := modelOf(a), modelOf(b)
+		var union, inter seqModel
+		for v := 1; v <= seqModelMax; v++ {
+			union[v] = ma[v] || mb[v]
+			inter[v] = ma[v] && mb[v]
+		}
+		if got := modelOf(sa); got != ma {
+			t.Fatalf("NewSeqSet(%v)=%v holds other numbers", a, sa)
+		}
+		for v := uint32(1); v <= seqModelMax; v++ {
+			if sa.Contains(v) != ma[v] {
+				t.Fatalf("%v.Contains(%d)=%v", sa, v, sa.Contains(v))
+			}
+		}
+		if got := NewSeqSet(sa); !reflect.DeepEqual(got, sa) {
+			t.Fatalf("NewSeqSet(%v)=%v, not idempotent", sa, got)
+		}
+
+		u := sa.Union(sb)
+		checkNormalized(t, u)
+		if modelOf(u) != union {
+			t.Fatalf("%v.Union(%v)=%v", sa, sb, u)
+		}
+		if !reflect.DeepEqual(u, sb.Union(sa)) {
+			t.Fatalf("%v.Union(%v) is not commutative", sa, sb)
+		}
+		x := sa.Intersect(sb)
+		checkNormalized(t, x)
+		if modelOf(x) != inter {
+			t.Fatalf("%v.Intersect(%v)=%v", sa, sb, x)
+		}
+		if !reflect.DeepEqual(x, sb.Intersect(sa)) {
+			t.Fatalf("%v.Intersect(%v) is not commutative", sa, sb)
+		}
+
+		var each []uint32
+		sa.Each(seqModelLast, func(v uint32) bool {
+			each = append(each, v)
+			return true
+		})
+		var want []uint32
+		for v := uint32(1); v <= seqModelLast; v++ {
+			if ma[v] {
+				want = append(want, v)
+			}
+		}
+		if !reflect.DeepEqual(each, want) {
+			t.Fatalf("%v.Each(%d)=%v, want %v", sa, seqModelLast, each, want)
+		}
+
+		if len(sa) > 0 {
+			if got := NewSeqSet(parseSeqs(t, sa.String())); !reflect.DeepEqual(got, sa) {
+				t.Fatalf("%q parses as %v, want %v", sa.String(), got, sa)
+			}
+		}
+	}
+}
+
+func TestSeqSetEachStop(t *testing.T) {
+	var got []uint32
+	NewSeqSet([]SeqRange{{Min: 3, Max: 0}}).Each(1<<32-1, func(v uint32) bool {
+		got = append(got, v)
+		return len(got) < 3
+	})
+	if want := []uint32{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Each=%v, want %v", got, want)
+	}
+}
+
+func TestSeqSetEachPastLast(t *testing.T) {
+	tests := []struct {
+		seqs []SeqRange
+		last uint32
+		want []uint32
+	}{
+		{[]SeqRange{{Min: 559, Max: 0}}, 5, []uint32{5}},
+		{[]SeqRange{{Min: 2, Max: 3}, {Min: 559, Max: 0}}, 5, []uint32{2, 3, 5}},
+		{[]SeqRange{{Min: 5, Max: 5}, {Min: 559, Max: 0}}, 5, []uint32{5}},
+		{[]SeqRange{{Min: 4, Max: 0}}, 5, []uint32{4, 5}},
+		{[]SeqRange{{Min: 559, Max: 600}}, 5, nil},
+		{[]SeqRange{{Min: 559, Max: 0}}, 0, nil},
+	}
+	for _, test := range tests {
+		s := NewSeqSet(test.seqs)
+		var got []uint32
+		s.Each(test.last, func(v uint32) bool {
+			got = append(got, v)
+			return true
+		})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v.Each(%d)=%v, want %v", s, test.last, got, test.want)
+		}
+	}
+}
+
+func TestSeqSetSaved(t *testing.T) {
+	if s := NewSeqSet([]SeqRange{SeqSaved}); s != nil {
+		t.Errorf("NewSeqSet($)=%v, want empty", s)
+	}
+	buf := new(strings.Builder)
+	FormatSeqs(buf, []SeqRange{SeqSaved})
+	if got := buf.String(); got != "$" {
+		t.Errorf("FormatSeqs($)=%q", got)
+	}
+}
+
+func TestAppendSeqRange(t *testing.T) {
+	var seqs []SeqRange
+	for _, v := range []uint32{1, 2, 3, 3, 5, 7, 8, 2} {
+		seqs = AppendSeqRange(seqs, v)
+	}
+	want := []SeqRange{{1, 3}, {5, 5}, {7, 8}, {2, 2}}
+	if !reflect.DeepEqual(seqs, want) {
+		t.Errorf("AppendSeqRange=%v, want %v", seqs, want)
+	}
+
+	// A range ending in '*' holds every number after it.
+	seqs = AppendSeqRange([]SeqRange{{Min: 4, Max: 0}}, 9)
+	if want := []SeqRange{{Min: 4, Max: 0}}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("AppendSeqRange(4:*, 9)=%v, want %v", seqs, want)
+	}
+}
+
+// parseSeqs scans an IMAP sequence-set.
+func parseSeqs(t testing.TB, input string) []SeqRange {
+	t.Helper()
+	f := filer.BufferFile(1024)
+	defer f.Close()
+	s := NewScanner(bufio.NewReader(strings.NewReader(input+"\r\n")), f, nil)
+	if !s.Next(TokenSequences) {
+		t.Fatalf("%q does not scan as a sequence-set: %v", input, s.Error)
+	}
+	return append([]SeqRange(nil), s.Sequences...)
+}
@@ -8,6 +8,7 @@
 package imapparser
 
 import (
+	"math"
 	"time"
 
 	"crawshaw.io/iox"
@@ -23,7 +24,8 @@ type Command struct {
 
 	// Name is one of:
 	//	SELECT, EXAMINE, SUBSCRIBE, UNSUBSCRIBE, DELETE,
-	//	STATUS, APPEND, COPY
+	//	STATUS, APPEND, COPY,
+	//	SETACL, DELETEACL, GETACL, LISTRIGHTS, MYRIGHTS
 	Mailbox []byte
 
 	// Name is one of: SELECT, EXAMINE
@@ -68,6 +70,11 @@ type Command struct {
 	Search Search // Name: SEARCH
 
 	ApplePushService *ApplePushService // Name: XAPPLEPUSHSERVICE
+
+	ACL struct { // Name: SETACL, DELETEACL, LISTRIGHTS (RFC 4314)
+		Identifier []byte
+		Rights     []byte // SETACL, with an optional leading + or -
+	}
 }
 
 type List struct {
@@ -137,6 +144,29 @@ type SeqRange struct {
 	Max uint32
 }
 
+// SeqSaved is the sequence-set "$" of RFC 5182 SEARCHRES,
+// referring to the result of the last SEARCH RETURN (SAVE).
+//
+// It is not a normalized SeqRange, so it cannot be confused
+// with a range written by the client.
+var SeqSaved = SeqRange{Min: math.MaxUint32, Max: 1}
+
+// IsSeqSaved reports whether seqs is the sequence-set "$".
+func IsSeqSaved(seqs []SeqRange) bool {
+	return len(seqs) == 1 && seqs[0] == SeqSaved
+}
+
+// hasSeqStar reports whether seqs has a '*' or is '$', so it does
+// not name fixed numbers.
+func hasSeqStar(seqs []SeqRange) bool {
+	for _, seq := range seqs {
+		if seq.Min == 0 || seq.Max == 0 || seq == SeqSaved {
+			return true
+		}
+	}
+	return false
+}
+
 type FetchItem struct {
 	Type    FetchItemType
 	Peek    bool             // BODY.PEEK
@@ -177,7 +207,7 @@ const (
 type Search struct {
 	Op      *SearchOp
 	Charset string
-	Return  []string // MIN, MAX, ALL, COUNT
+	Return  []string // MIN, MAX, ALL, COUNT, SAVE
 }
 
 type SearchOp struct {
@@ -192,6 +222,13 @@ type SearchOp struct {
 	//	- SEQSET: the search op is a match against sequence IDs
 	//	  This is a name for the implicit <sequence-set> grammar.
 	//
+	// Non-standard keys search message attachments:
+	//
+	//	- X-ATTACHMENT: the message has an attachment
+	//	- X-ATTACHMENT-NAME: an attachment file name contains Value
+	//	- X-ATTACHMENT-TYPE: an attachment has the MIME type Value,
+	//	  or is of the top-level type of a Value like "image/*"
+	//
 	Key SearchKey
 
 	// Children is set when Key is one of: AND, OR, NOT
@@ -201,10 +238,11 @@ type SearchOp struct {
 	// Value is set when Key is one of:
 	//	BCC, CC, FROM,
 	//      HEADER ("<field-name>: <string>"),
-	//	KEYWORD, SUBJECT, TEXT, TO
+	//	KEYWORD, SUBJECT, TEXT, TO,
+	//	X-ATTACHMENT-NAME, X-ATTACHMENT-TYPE
 	Value string
 
-	Num       int64      // Key is one of: LARGER (uint32), SMALLER (uint32), MODSEQ
+	Num       int64      // Key is one of: LARGER (uint32), SMALLER (uint32), MODSEQ, OLDER, YOUNGER (seconds)
 	Sequences []SeqRange // Key is one of: SEQSET, UID, UNDRAFT
 
 	Date time.Time // Key is one of: BEFORE, ON, SENTBEFORE, SENTON, SENTSINCE, SINCE
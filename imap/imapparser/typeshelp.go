@@ -15,6 +15,12 @@ func FormatSeqs(w io.Writer, seqs []SeqRange) error {
 				return err
 			}
 		}
+		if seq == SeqSaved {
+			if _, err := fmt.Fprint(w, "$"); err != nil {
+				return err
+			}
+			continue
+		}
 		if seq.Min == 0 && seq.Max == 0 {
 			if _, err := fmt.Fprint(w, "*"); err != nil {
 				return err
@@ -150,6 +156,77 @@ func (c Command) String() string {
 	return strings.TrimSuffix(buf.String(), ", ") + "}"
 }
 
+// Summary describes the command for logs. It has the command's
+// name, mailboxes, and the shape of its arguments, but none of the
+// data a client sends in a command: no passwords, no search strings,
+// and of a literal only its size.
+func (c *Command) Summary() string {
+	buf := new(strings.Builder)
+	if c.UID {
+		buf.WriteString("UID ")
+	}
+	buf.WriteString(c.Name)
+	if len(c.Mailbox) > 0 {
+		fmt.Fprintf(buf, " mailbox=%q", c.Mailbox)
+	}
+	if len(c.Rename.OldMailbox) > 0 || len(c.Rename.NewMailbox) > 0 {
+		fmt.Fprintf(buf, " rename=%q,%q", c.Rename.OldMailbox, c.Rename.NewMailbox)
+	}
+	if len(c.List.MailboxGlob) > 0 || len(c.List.ReferenceName) > 0 {
+		fmt.Fprintf(buf, " list=%q,%q", c.List.ReferenceName, c.List.MailboxGlob)
+	}
+	if len(c.Sequences) > 0 {
+		buf.WriteString(" seqs=")
+		FormatSeqs(buf, c.Sequences)
+	}
+	if len(c.Status.Items) > 0 {
+		fmt.Fprintf(buf, " status_items=%d", len(c.Status.Items))
+	}
+	if len(c.FetchItems) > 0 {
+		buf.WriteString(" items=(")
+		for i := range c.FetchItems {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(c.FetchItems[i].String())
+		}
+		buf.WriteByte(')')
+	}
+	if c.ChangedSince != 0 {
+		fmt.Fprintf(buf, " changedsince=%d", c.ChangedSince)
+	}
+	if c.Store.Mode != 0 {
+		fmt.Fprintf(buf, " store=%s", c.Store.Mode)
+		if c.Store.Silent {
+			buf.WriteString(".SILENT")
+		}
+		fmt.Fprintf(buf, " flags=%d", len(c.Store.Flags))
+	}
+	if c.Search.Op != nil {
+		buf.WriteString(" search=")
+		searchShape(buf, c.Search.Op)
+	}
+	if c.Literal != nil && c.Literal.Size() > 0 {
+		fmt.Fprintf(buf, " literal=%d", c.Literal.Size())
+	}
+	return buf.String()
+}
+
+// searchShape writes the keys of op, without their values.
+func searchShape(buf *strings.Builder, op *SearchOp) {
+	if len(op.Children) == 0 {
+		buf.WriteString(string(op.Key))
+		return
+	}
+	buf.WriteByte('(')
+	buf.WriteString(string(op.Key))
+	for i := range op.Children {
+		buf.WriteByte(' ')
+		searchShape(buf, &op.Children[i])
+	}
+	buf.WriteByte(')')
+}
+
 func clearBytes(b *[]byte) {
 	if *b != nil {
 		*b = (*b)[:0]
@@ -203,6 +280,8 @@ func (cmd *Command) reset() {
 	cmd.Search.Charset = ""
 	cmd.Search.Return = cmd.Search.Return[:0]
 	cmd.ApplePushService = nil // rarely used, release memory
+	clearBytes(&cmd.ACL.Identifier)
+	clearBytes(&cmd.ACL.Rights)
 }
 
 func clearItems(items []FetchItem) []FetchItem {
@@ -247,12 +326,17 @@ func appendItem(items []FetchItem, src *FetchItem) []FetchItem {
 	return items
 }
 
+// AppendSeqRange appends v to seqs, extending the last range
+// if v follows it.
 func AppendSeqRange(seqs []SeqRange, v uint32) []SeqRange {
 	if len(seqs) > 0 && v > 0 {
 		last := &seqs[len(seqs)-1]
-		if last.Min > last.Max {
+		if last.Max != 0 && last.Min > last.Max {
 			last.Min, last.Max = last.Max, last.Min // normalize
 		}
+		if last.Min <= v && (last.Max == 0 || v <= last.Max) {
+			return seqs // already in the last range
+		}
 		if last.Max > 0 && last.Max == v-1 {
 			last.Max++ // append v to last SeqRange
 			return seqs
@@ -51,23 +51,80 @@ func AppendDecode(dst, src []byte) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("utf7mod: decode: %v", err)
 		}
-		scratch = scratch[:n]
-		if len(scratch)%1 == 1 {
-			return nil, ErrInvalidUTF7
+		if dst, err = appendUTF16(dst, scratch[:n]); err != nil {
+			return nil, err
 		}
-		for len(scratch) > 0 {
-			r := rune(scratch[0])<<8 | rune(scratch[1])
-			scratch = scratch[2:]
-			if utf16.IsSurrogate(r) {
-				if len(scratch) == 0 {
-					return nil, ErrInvalidUTF7
-				}
-				r2 := rune(scratch[0])<<8 | rune(scratch[1])
-				scratch = scratch[2:]
-				r = utf16.DecodeRune(r, r2)
+	}
+	return dst, nil
+}
+
+// std64 is the base64 of the original UTF-7, which may end
+// without padding and with nonzero bits left over.
+var std64 = base64.StdEncoding.WithPadding(base64.NoPadding)
+
+// AppendDecodeUTF7 decodes the original UTF-7 of RFC 2152,
+// which some clients use for SEARCH CHARSET UTF-7.
+//
+// A shifted sequence starts with '+' and ends at the first
+// character that is not base64, absorbing a '-' found there.
+// "+-" is a literal '+'.
+func AppendDecodeUTF7(dst, src []byte) ([]byte, error) {
+	for len(src) > 0 {
+		c := src[0]
+		src = src[1:]
+		if c != '+' {
+			dst = append(dst, c)
+			continue
+		}
+		if len(src) > 0 && src[0] == '-' {
+			src = src[1:]
+			dst = append(dst, '+')
+			continue
+		}
+		i := 0
+		for i < len(src) && isBase64(src[i]) {
+			i++
+		}
+		scratch := make([]byte, std64.DecodedLen(i))
+		n, err := std64.Decode(scratch, src[:i])
+		src = src[i:]
+		if err != nil {
+			return nil, fmt.Errorf("utf7mod: decode UTF-7: %v", err)
+		}
+		if len(src) > 0 && src[0] == '-' {
+			src = src[1:]
+		}
+		// Leftover bits of the last base64 character
+		// may make an odd byte, it is not a character.
+		if dst, err = appendUTF16(dst, scratch[:n&^1]); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+func isBase64(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' ||
+		'0' <= c && c <= '9' || c == '+' || c == '/'
+}
+
+// appendUTF16 appends the UTF-8 of the UTF-16BE in b.
+func appendUTF16(dst, b []byte) ([]byte, error) {
+	if len(b)%2 == 1 {
+		return nil, ErrInvalidUTF7
+	}
+	for len(b) > 0 {
+		r := rune(b[0])<<8 | rune(b[1])
+		b = b[2:]
+		if utf16.IsSurrogate(r) {
+			if len(b) == 0 {
+				return nil, ErrInvalidUTF7
 			}
-			dst = appendRune(dst, r)
+			r2 := rune(b[0])<<8 | rune(b[1])
+			b = b[2:]
+			r = utf16.DecodeRune(r, r2)
 		}
+		dst = appendRune(dst, r)
 	}
 	return dst, nil
 }
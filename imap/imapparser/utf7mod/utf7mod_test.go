@@ -41,6 +41,39 @@ func TestAppendDecode(t *testing.T) {
 	}
 }
 
+func TestAppendDecodeInvalid(t *testing.T) {
+	for _, enc := range []string{
+		"&",
+		"&AA-",   // odd number of UTF-16 bytes
+		"&2D7d-", // odd number of UTF-16 bytes after a surrogate
+		"&2D4-",  // unpaired surrogate
+		"&*-",    // not modified base64
+	} {
+		if dec, err := AppendDecode(nil, []byte(enc)); err == nil {
+			t.Errorf("decode %q=%q, want error", enc, dec)
+		}
+	}
+}
+
+func TestAppendDecodeUTF7(t *testing.T) {
+	for _, test := range []struct{ enc, dec string }{
+		{enc: "Hi Mom -+Jjo--!", dec: "Hi Mom -\u263a-!"},
+		{enc: "+ZeVnLIqe-", dec: "日本語"},
+		{enc: "A+ImIDkQ.", dec: "A\u2262\u0391."},
+		{enc: "1 +- 1", dec: "1 + 1"},
+		{enc: "+2D3egA", dec: "🚀"},
+	} {
+		dec, err := AppendDecodeUTF7(nil, []byte(test.enc))
+		if err != nil {
+			t.Errorf("decode %q: %v", test.enc, err)
+			continue
+		}
+		if got := string(dec); got != test.dec {
+			t.Errorf("decode %q=%q, want %q", test.enc, got, test.dec)
+		}
+	}
+}
+
 func BenchmarkEncodeAlloc(b *testing.B) {
 	dst := make([]byte, 0, 1024)
 
@@ -0,0 +1,96 @@
+package imapserver
+
+import (
+	"spilled.ink/imap"
+	"spilled.ink/imap/imapparser"
+)
+
+// cmdACL implements the RFC 4314 access control list commands.
+func (c *Conn) cmdACL() {
+	cmd := &c.p.Command
+	identifier := string(cmd.ACL.Identifier)
+
+	switch cmd.Name {
+	case "SETACL":
+		mode := imapparser.StoreReplace
+		rights := string(cmd.ACL.Rights)
+		if len(rights) > 0 {
+			switch rights[0] {
+			case '+':
+				mode = imapparser.StoreAdd
+				rights = rights[1:]
+			case '-':
+				mode = imapparser.StoreRemove
+				rights = rights[1:]
+			}
+		}
+		r, err := imap.ParseRights(rights)
+		if err != nil {
+			c.respondln("BAD SETACL %v", err)
+			return
+		}
+		if err := c.session.SetACL(cmd.Mailbox, identifier, mode, r); err != nil {
+			c.respondln("NO SETACL %v", err)
+			return
+		}
+		c.respondln("OK SETACL completed")
+
+	case "DELETEACL":
+		if err := c.session.DeleteACL(cmd.Mailbox, identifier); err != nil {
+			c.respondln("NO DELETEACL %v", err)
+			return
+		}
+		c.respondln("OK DELETEACL completed")
+
+	case "GETACL":
+		acl, err := c.session.GetACL(cmd.Mailbox)
+		if err != nil {
+			c.respondln("NO GETACL %v", err)
+			return
+		}
+		c.writef("* ACL ")
+		c.writeStringBytes(cmd.Mailbox)
+		for _, entry := range acl {
+			c.writef(" ")
+			c.writeString(entry.Identifier)
+			c.writef(" ")
+			c.writeString(entry.Rights.String())
+		}
+		c.writef("\r\n")
+		c.respondln("OK GETACL completed")
+
+	case "LISTRIGHTS":
+		required, grantable, err := c.session.ListRights(cmd.Mailbox, identifier)
+		if err != nil {
+			c.respondln("NO LISTRIGHTS %v", err)
+			return
+		}
+		c.writef("* LISTRIGHTS ")
+		c.writeStringBytes(cmd.Mailbox)
+		c.writef(" ")
+		c.writeString(identifier)
+		c.writef(" ")
+		c.writeString(required.String())
+		// Each grantable right can be granted independently.
+		for r := imap.Rights(1); r <= imap.RightsAll; r <<= 1 {
+			if grantable&r != 0 {
+				c.writef(" %s", r)
+			}
+		}
+		c.writef("\r\n")
+		c.respondln("OK LISTRIGHTS completed")
+
+	case "MYRIGHTS":
+		rights, err := c.session.MyRights(cmd.Mailbox)
+		if err != nil {
+			c.respondln("NO MYRIGHTS %v", err)
+			return
+		}
+		c.writef("* MYRIGHTS ")
+		c.writeStringBytes(cmd.Mailbox)
+		c.writef(" ")
+		c.writeString(rights.String())
+		c.writef("\r\n")
+		c.respondln("OK MYRIGHTS completed")
+	}
+}
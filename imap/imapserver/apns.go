@@ -1,14 +1,21 @@
 package imapserver
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"spilled.ink/imap/imapparser"
@@ -23,16 +30,45 @@ import (
 //	openssl pkcs12 -in apns.mail.p12 -out apns.crt.pem -clcerts -nokeys
 //	openssl pkcs12 -in apns.mail.p12 -out apns.key.pem -nocerts -nodes
 type APNS struct {
-	Certificate tls.Certificate // create with tls.LoadX509KeyPair
-	GatewayAddr string          // default value: gateway.push.apple.com
-	UID         string          // default value extracted from Certificate
+	Certificate  tls.Certificate // create with tls.LoadX509KeyPair
+	GatewayAddr  string          // default value: gateway.push.apple.com
+	FeedbackAddr string          // default value: feedback.push.apple.com
+	UID          string          // default value extracted from Certificate
+
+	// Failed, if set, is called when APNS reports a device will not
+	// accept notifications, either because its token is invalid or
+	// because the feedback service lists it as unregistered.
+	Failed func(userID int64, device imapparser.ApplePushDevice)
+
+	mu sync.Mutex // guards Certificate, UID, and unregistered after start
+
+	// unregistered holds the tokens (lowercase hex) reported by the
+	// feedback service, until the next notification for the token.
+	unregistered map[string]time.Time
+
+	sent   int64 // accessed atomically
+	failed int64 // accessed atomically
 
 	ctx              context.Context
 	ctxCancel        func()
 	shutdownComplete chan struct{}
-	notify           chan imapparser.ApplePushDevice
+	notify           chan apnsPush
 }
 
+// APNSStats counts the notifications handled by an APNS.
+type APNSStats struct {
+	Sent   int64 // notifications written to the gateway
+	Failed int64 // notifications to invalid or unregistered devices
+}
+
+type apnsPush struct {
+	userID int64
+	device imapparser.ApplePushDevice
+}
+
+// feedbackInterval is how often the APNS feedback service is polled.
+var feedbackInterval = 1 * time.Hour
+
 // http://www.alvestrand.no/objectid/0.9.2342.19200300.100.1.1.html
 var oidUserID = []int{0, 9, 2342, 19200300, 100, 1, 1}
 
@@ -40,112 +76,196 @@ func (a *APNS) start() error {
 	if a.GatewayAddr == "" {
 		a.GatewayAddr = "gateway.push.apple.com:2195"
 	}
+	if a.FeedbackAddr == "" {
+		a.FeedbackAddr = "feedback.push.apple.com:2196"
+	}
 	if a.UID == "" {
-		leafCert, err := x509.ParseCertificate(a.Certificate.Certificate[0])
+		uid, err := certUID(a.Certificate)
 		if err != nil {
-			panic(err)
-		}
-
-		for _, n := range leafCert.Subject.Names {
-			if n.Type.Equal(oidUserID) {
-				if v, ok := n.Value.(string); ok {
-					a.UID = v
-					break
-				}
-			}
-		}
-		if a.UID == "" {
-			return errors.New("APNS: certificate has no UID")
+			return err
 		}
+		a.UID = uid
 	}
 
 	a.ctx, a.ctxCancel = context.WithCancel(context.Background())
 	a.shutdownComplete = make(chan struct{})
-	a.notify = make(chan imapparser.ApplePushDevice, 32)
+	a.notify = make(chan apnsPush, 32)
+	a.unregistered = make(map[string]time.Time)
 	go a.sender()
 	return nil
 }
+func certUID(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("APNS: no certificate")
+	}
+	leafCert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("APNS: %v", err)
+	}
+	for _, n := range leafCert.Subject.Names {
+		if n.Type.Equal(oidUserID) {
+			if v, ok := n.Value.(string); ok && v != "" {
+				return v, nil
+			}
+		}
+	}
+	return "", errors.New("APNS: certificate has no UID")
+}
+
+// SetCertificate replaces the certificate used to send notifications.
+// It is safe to call while the IMAP server is running.
+// The UID is updated to match the new certificate.
+func (a *APNS) SetCertificate(cert tls.Certificate) error {
+	uid, err := certUID(cert)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.Certificate = cert
+	a.UID = uid
+	a.mu.Unlock()
+	return nil
+}
+
+// Topic reports the UID of the certificate, the APNS topic.
+func (a *APNS) Topic() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.UID
+}
+
+// Stats reports the notifications sent and failed since start.
+func (a *APNS) Stats() APNSStats {
+	return APNSStats{
+		Sent:   atomic.LoadInt64(&a.sent),
+		Failed: atomic.LoadInt64(&a.failed),
+	}
+}
 
 func (a *APNS) shutdown() {
 	a.ctxCancel()
 	<-a.shutdownComplete
 }
 
-func (a *APNS) Notify(devices []imapparser.ApplePushDevice) {
+// Notify sends a new mail notification to each of the user's devices.
+//
+// A device the feedback service has reported as unregistered is
+// not sent a notification, it is reported to Failed instead.
+func (a *APNS) Notify(userID int64, devices []imapparser.ApplePushDevice) {
 	for _, device := range devices {
+		push := apnsPush{userID: userID, device: device}
+		if a.unregisteredToken(device.DeviceToken) {
+			a.reportFailure(push, "unregistered")
+			continue
+		}
 		select {
-		case a.notify <- device:
+		case a.notify <- push:
 		case <-a.ctx.Done():
 		}
 	}
 }
 
+func (a *APNS) unregisteredToken(token string) bool {
+	token = strings.ToLower(token)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, found := a.unregistered[token]; found {
+		delete(a.unregistered, token)
+		return true
+	}
+	return false
+}
+
+func (a *APNS) reportFailure(push apnsPush, reason string) {
+	atomic.AddInt64(&a.failed, 1)
+	log.Printf("APNS: user %d: %s device %v", push.userID, reason, push.device)
+	if a.Failed != nil {
+		a.Failed(push.userID, push.device)
+	}
+}
+
+func (a *APNS) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	a.mu.Lock()
+	if a.Certificate.Certificate != nil {
+		config.Certificates = []tls.Certificate{a.Certificate}
+	}
+	a.mu.Unlock()
+	return config
+}
+
 func (a *APNS) sender() {
+	feedback := time.NewTicker(feedbackInterval)
+	defer feedback.Stop()
+
 	for {
 		select {
 		case <-a.ctx.Done():
 			close(a.shutdownComplete)
 			return
-		case device := <-a.notify:
-			a.send(device)
+		case push := <-a.notify:
+			a.send(push)
+		case <-feedback.C:
+			if err := a.readFeedback(); err != nil {
+				log.Printf("APNS: feedback: %v", err)
+			}
 		}
 	}
 }
 
-func (a *APNS) send(device imapparser.ApplePushDevice) {
-	config := &tls.Config{}
-	if a.Certificate.Certificate != nil {
-		config.Certificates = []tls.Certificate{a.Certificate}
-	}
-	c, err := tls.Dial("tcp", a.GatewayAddr, config)
+// APNS binary provider protocol values.
+const (
+	apnsCmdNotification  = 1 // enhanced notification format
+	apnsCmdErrorResponse = 8
+	apnsStatusBadToken   = 8 // invalid token
+)
+
+func (a *APNS) send(push apnsPush) {
+	c, err := tls.Dial("tcp", a.GatewayAddr, a.tlsConfig())
 	if err != nil {
 		log.Printf("APNS: %v", err) // TODO better logging
 		return
 	}
 	defer c.Close()
 
-	buf := new(bytes.Buffer)
-	for {
-		buf.Reset()
-		buf.WriteByte(0)
-		buf.WriteByte(0)
-		buf.WriteByte(0x20)
-
-		token, err := hex.DecodeString(device.DeviceToken)
-		if err != nil {
-			log.Printf("APNS: bad token: %v: %v", device, err)
-			continue
+	// The gateway only replies to report an error, with the
+	// identifier of the failed notification, then closes the
+	// connection. Notifications sent after it are dropped.
+	errResp := make(chan [6]byte, 1)
+	go func() {
+		var resp [6]byte
+		if _, err := io.ReadFull(c, resp[:]); err == nil {
+			errResp <- resp
 		}
-		buf.Write(token)
-		buf.WriteByte(0)
+	}()
 
-		data := map[string]interface{}{
-			"aps": map[string]interface{}{
-				"account-id": device.AccountID,
-			},
-		}
-		jsonText, err := json.Marshal(data)
-		if err != nil {
-			panic("APNS: bad JSON: " + err.Error())
-		}
-		if len(jsonText) > 1<<8-1 {
-			log.Printf("APNS: JSON too big: %d", len(jsonText))
-			continue
-		}
-		buf.WriteByte(byte(len(jsonText)))
-		buf.Write(jsonText)
+	var pushes []apnsPush // indexed by notification identifier
+	buf := new(bytes.Buffer)
+	for {
+		id := uint32(len(pushes))
+		pushes = append(pushes, push)
 
-		if _, err := buf.WriteTo(c); err != nil {
+		buf.Reset()
+		if err := appendNotification(buf, id, push.device); err == errBadToken {
+			a.reportFailure(push, "bad token for")
+		} else if err != nil {
+			log.Printf("APNS: %v: %v", push.device, err)
+		} else if _, err := buf.WriteTo(c); err != nil {
 			log.Printf("APNS: failed to write: %v", err)
 			// Slow down. Don't overwhelm the gateway on error.
 			time.Sleep(1 * time.Second)
 			return
+		} else {
+			atomic.AddInt64(&a.sent, 1)
+			log.Printf("APNS push notification sent for %v", push.device)
 		}
-		log.Printf("APNS push notification sent for %v", device)
 
 		select {
-		case device = <-a.notify:
+		case push = <-a.notify:
 			// loop with new device
+		case resp := <-errResp:
+			a.errorResponse(resp, pushes)
+			return
 		case <-a.ctx.Done():
 			return
 		case <-time.After(5 * time.Second):
@@ -153,3 +273,90 @@ func (a *APNS) send(device imapparser.ApplePushDevice) {
 		}
 	}
 }
+
+func (a *APNS) errorResponse(resp [6]byte, pushes []apnsPush) {
+	status := resp[1]
+	id := binary.BigEndian.Uint32(resp[2:])
+	if resp[0] != apnsCmdErrorResponse || id >= uint32(len(pushes)) {
+		log.Printf("APNS: unexpected gateway response %x", resp)
+		return
+	}
+	if status == apnsStatusBadToken {
+		a.reportFailure(pushes[id], "invalid token for")
+		return
+	}
+	log.Printf("APNS: error status %d for %v", status, pushes[id].device)
+}
+
+var errBadToken = errors.New("bad device token")
+
+// appendNotification writes a notification in the enhanced format.
+func appendNotification(buf *bytes.Buffer, id uint32, device imapparser.ApplePushDevice) error {
+	token, err := hex.DecodeString(device.DeviceToken)
+	if err != nil || len(token) == 0 {
+		return errBadToken
+	}
+	data := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"account-id": device.AccountID,
+		},
+	}
+	jsonText, err := json.Marshal(data)
+	if err != nil {
+		panic("APNS: bad JSON: " + err.Error())
+	}
+	if len(jsonText) > 256 {
+		return fmt.Errorf("JSON too big: %d", len(jsonText))
+	}
+
+	var hdr [9]byte
+	hdr[0] = apnsCmdNotification
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(time.Now().Add(24*time.Hour).Unix()))
+	buf.Write(hdr[:])
+	binary.Write(buf, binary.BigEndian, uint16(len(token)))
+	buf.Write(token)
+	binary.Write(buf, binary.BigEndian, uint16(len(jsonText)))
+	buf.Write(jsonText)
+	return nil
+}
+
+// readFeedback reads the devices the APNS feedback service reports
+// as no longer accepting notifications. Each is reported to Failed
+// the next time it is sent a notification, so the user is known.
+func (a *APNS) readFeedback() error {
+	c, err := tls.Dial("tcp", a.FeedbackAddr, a.tlsConfig())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(1 * time.Minute))
+
+	r := bufio.NewReader(c)
+	var hdr [6]byte // time and token length
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		t := time.Unix(int64(binary.BigEndian.Uint32(hdr[:4])), 0)
+		token := make([]byte, binary.BigEndian.Uint16(hdr[4:]))
+		if _, err := io.ReadFull(r, token); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.unregistered[hex.EncodeToString(token)] = t
+		a.mu.Unlock()
+	}
+
+	// Forget tokens that have not been sent a notification in a long time.
+	a.mu.Lock()
+	for token, t := range a.unregistered {
+		if time.Since(t) > 30*24*time.Hour {
+			delete(a.unregistered, token)
+		}
+	}
+	a.mu.Unlock()
+	return nil
+}
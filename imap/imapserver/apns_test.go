@@ -0,0 +1,79 @@
+package imapserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"spilled.ink/imap/imapparser"
+)
+
+func TestAPNSNotification(t *testing.T) {
+	device := imapparser.ApplePushDevice{
+		AccountID:   "ACC37604-1111-494B-2222-FCA34566717E",
+		DeviceToken: "FD3ABAA234203CC2349587349587999BBBEC1CB40AEE23688E2665BBBB2A28D4",
+	}
+	buf := new(bytes.Buffer)
+	if err := appendNotification(buf, 7, device); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if b[0] != apnsCmdNotification {
+		t.Errorf("command %d", b[0])
+	}
+	if id := binary.BigEndian.Uint32(b[1:5]); id != 7 {
+		t.Errorf("identifier %d, want 7", id)
+	}
+	if exp := int64(binary.BigEndian.Uint32(b[5:9])); exp < time.Now().Unix() {
+		t.Errorf("expiry %d is in the past", exp)
+	}
+	tokenLen := int(binary.BigEndian.Uint16(b[9:11]))
+	if got := hex.EncodeToString(b[11 : 11+tokenLen]); got != "fd3abaa234203cc2349587349587999bbbec1cb40aee23688e2665bbbb2a28d4" {
+		t.Errorf("token %s", got)
+	}
+	b = b[11+tokenLen:]
+	payloadLen := int(binary.BigEndian.Uint16(b[:2]))
+	want := `{"aps":{"account-id":"ACC37604-1111-494B-2222-FCA34566717E"}}`
+	if got := string(b[2:]); got != want || payloadLen != len(want) {
+		t.Errorf("payload %q (%d bytes), want %q", got, payloadLen, want)
+	}
+
+	buf.Reset()
+	device.DeviceToken = "not hex"
+	if err := appendNotification(buf, 0, device); err != errBadToken {
+		t.Errorf("bad token: err=%v, want errBadToken", err)
+	}
+}
+
+func TestAPNSFailures(t *testing.T) {
+	var failed []string
+	a := &APNS{
+		Failed: func(userID int64, device imapparser.ApplePushDevice) {
+			failed = append(failed, device.DeviceToken)
+		},
+		unregistered: map[string]time.Time{"0a0b": time.Now()},
+	}
+
+	pushes := []apnsPush{
+		{userID: 1, device: imapparser.ApplePushDevice{DeviceToken: "01"}},
+		{userID: 1, device: imapparser.ApplePushDevice{DeviceToken: "02"}},
+	}
+	a.errorResponse([6]byte{apnsCmdErrorResponse, apnsStatusBadToken, 0, 0, 0, 1}, pushes)
+	a.errorResponse([6]byte{apnsCmdErrorResponse, 10, 0, 0, 0, 0}, pushes) // shutdown
+	a.errorResponse([6]byte{apnsCmdErrorResponse, apnsStatusBadToken, 0, 0, 0, 9}, pushes)
+
+	// A device reported by the feedback service fails without a send.
+	a.Notify(2, []imapparser.ApplePushDevice{{DeviceToken: "0A0B"}})
+
+	if len(failed) != 2 || failed[0] != "02" || failed[1] != "0A0B" {
+		t.Errorf("failed devices: %v, want [02 0A0B]", failed)
+	}
+	if len(a.unregistered) != 0 {
+		t.Errorf("unregistered tokens not cleared: %v", a.unregistered)
+	}
+	if stats := a.Stats(); stats.Failed != 2 || stats.Sent != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
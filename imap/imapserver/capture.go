@@ -0,0 +1,270 @@
+package imapserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugCapture records transcripts of IMAP sessions for debugging.
+// Its Writer method is a Server.Debug function.
+//
+// Capture is off until it is enabled for a user or a session,
+// and each enablement expires. Transcripts have the credentials
+// of LOGIN and AUTHENTICATE redacted, are rotated when they
+// reach MaxSize, and are deleted after Retention.
+type DebugCapture struct {
+	Dir       string        // transcripts are written here, as imap-<sessionID>.txt
+	MaxSize   int64         // a transcript is rotated at this size, default 16MB
+	MaxFiles  int           // rotated files kept for a session, default 4
+	Retention time.Duration // transcripts are deleted after this, default 7 days
+	Logf      func(format string, v ...interface{})
+
+	mu       sync.Mutex
+	users    map[int64]time.Time  // userID -> enabled until
+	sessions map[string]time.Time // sessionID -> enabled until
+	pruned   time.Time
+}
+
+// DebugTarget is a user or session capture is enabled for.
+type DebugTarget struct {
+	UserID    int64     `json:"user_id,omitempty"`
+	SessionID string    `json:"session_id,omitempty"`
+	Until     time.Time `json:"until"`
+}
+
+// EnableUser captures the sessions of a user for d.
+// Sessions are captured from their next command after login.
+func (dc *DebugCapture) EnableUser(userID int64, d time.Duration) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.users == nil {
+		dc.users = make(map[int64]time.Time)
+	}
+	dc.users[userID] = time.Now().Add(d)
+}
+
+// DisableUser stops capturing the sessions of a user.
+func (dc *DebugCapture) DisableUser(userID int64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.users, userID)
+}
+
+// EnableSession captures a session for d, from its next command.
+func (dc *DebugCapture) EnableSession(sessionID string, d time.Duration) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.sessions == nil {
+		dc.sessions = make(map[string]time.Time)
+	}
+	dc.sessions[sessionID] = time.Now().Add(d)
+}
+
+// DisableSession stops capturing a session.
+func (dc *DebugCapture) DisableSession(sessionID string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.sessions, sessionID)
+}
+
+// Enabled reports the users and sessions being captured.
+func (dc *DebugCapture) Enabled() []DebugTarget {
+	now := time.Now()
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.expireLocked(now)
+
+	targets := []DebugTarget{}
+	for userID, until := range dc.users {
+		targets = append(targets, DebugTarget{UserID: userID, Until: until})
+	}
+	for sessionID, until := range dc.sessions {
+		targets = append(targets, DebugTarget{SessionID: sessionID, Until: until})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Until.Before(targets[j].Until) })
+	return targets
+}
+
+func (dc *DebugCapture) expireLocked(now time.Time) {
+	for userID, until := range dc.users {
+		if now.After(until) {
+			delete(dc.users, userID)
+		}
+	}
+	for sessionID, until := range dc.sessions {
+		if now.After(until) {
+			delete(dc.sessions, sessionID)
+		}
+	}
+}
+
+func (dc *DebugCapture) enabled(sessionID string, userID int64, now time.Time) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if until, ok := dc.sessions[sessionID]; ok && now.Before(until) {
+		return true
+	}
+	if userID == 0 {
+		return false
+	}
+	until, ok := dc.users[userID]
+	return ok && now.Before(until)
+}
+
+// Writer returns a writer for the transcript of a session,
+// or nil if capture is not enabled for it. The userID is 0
+// before the session logs in.
+//
+// Writes are dropped once the capture is disabled or expires.
+func (dc *DebugCapture) Writer(sessionID string, userID int64) io.WriteCloser {
+	now := time.Now()
+	if !dc.enabled(sessionID, userID, now) {
+		return nil
+	}
+	dc.Prune(now)
+
+	if err := os.MkdirAll(dc.Dir, 0700); err != nil {
+		dc.logf("imapserver: debug capture: %v", err)
+		return nil
+	}
+	cf := &captureFile{
+		dc:        dc,
+		sessionID: sessionID,
+		userID:    userID,
+		name:      filepath.Join(dc.Dir, "imap-"+sessionID+".txt"),
+	}
+	if err := cf.open(); err != nil {
+		dc.logf("imapserver: debug capture: %v", err)
+		return nil
+	}
+	return cf
+}
+
+// Prune deletes transcripts last written more than Retention ago.
+// It runs at most once an hour.
+func (dc *DebugCapture) Prune(now time.Time) {
+	dc.mu.Lock()
+	if now.Sub(dc.pruned) < time.Hour {
+		dc.mu.Unlock()
+		return
+	}
+	dc.pruned = now
+	dc.expireLocked(now)
+	dc.mu.Unlock()
+
+	retention := dc.Retention
+	if retention <= 0 {
+		retention = 7 * 24 * time.Hour
+	}
+	infos, err := ioutil.ReadDir(dc.Dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dc.logf("imapserver: debug capture prune: %v", err)
+		}
+		return
+	}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), "imap-") || info.IsDir() {
+			continue
+		}
+		if now.Sub(info.ModTime()) > retention {
+			if err := os.Remove(filepath.Join(dc.Dir, info.Name())); err != nil {
+				dc.logf("imapserver: debug capture prune: %v", err)
+			}
+		}
+	}
+}
+
+func (dc *DebugCapture) logf(format string, v ...interface{}) {
+	if dc.Logf != nil {
+		dc.Logf(format, v...)
+	}
+}
+
+// captureFile is a session transcript, rotated by size.
+type captureFile struct {
+	dc        *DebugCapture
+	sessionID string
+	userID    int64
+	name      string
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (cf *captureFile) open() (err error) {
+	cf.f, err = os.OpenFile(cf.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := cf.f.Stat()
+	if err != nil {
+		cf.f.Close()
+		cf.f = nil
+		return err
+	}
+	cf.size = info.Size()
+	return nil
+}
+
+// rotate renames the transcript to name.1, shifting older
+// files up to name.MaxFiles, and starts a new one.
+func (cf *captureFile) rotate() error {
+	maxFiles := cf.dc.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = 4
+	}
+	if err := cf.f.Close(); err != nil {
+		return err
+	}
+	cf.f = nil
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", cf.name, i), fmt.Sprintf("%s.%d", cf.name, i+1))
+	}
+	if err := os.Rename(cf.name, cf.name+".1"); err != nil {
+		return err
+	}
+	return cf.open()
+}
+
+func (cf *captureFile) Write(p []byte) (int, error) {
+	if !cf.dc.enabled(cf.sessionID, cf.userID, time.Now()) {
+		return len(p), nil
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.f == nil {
+		return 0, fmt.Errorf("imapserver: debug capture %s closed", cf.name)
+	}
+	maxSize := cf.dc.MaxSize
+	if maxSize <= 0 {
+		maxSize = 16 << 20
+	}
+	if cf.size > 0 && cf.size+int64(len(p)) > maxSize {
+		if err := cf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := cf.f.Write(p)
+	cf.size += int64(n)
+	return n, err
+}
+
+func (cf *captureFile) Close() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.f == nil {
+		return nil
+	}
+	err := cf.f.Close()
+	cf.f = nil
+	return err
+}
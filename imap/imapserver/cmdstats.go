@@ -0,0 +1,108 @@
+package imapserver
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Command latency.
+//
+// Every command is counted in ConnStats.Commands. A command slower
+// than Server.SlowCommand is logged with a summary of what it asked
+// for and where its time went: reading and parsing it, waiting for
+// and holding a database connection, and writing the response.
+// The DataStore reports its database time with CmdTimesFromContext.
+
+// CommandStats counts the commands of one name.
+type CommandStats struct {
+	Count int64
+	Slow  int64         // slower than Server.SlowCommand
+	Total time.Duration // sum of the command latencies
+	Max   time.Duration
+}
+
+// CmdTimes collects the database time of the command being served.
+// It is safe for concurrent use.
+type CmdTimes struct {
+	dbWait int64 // atomic, nanoseconds waiting for a connection
+	dbExec int64 // atomic, nanoseconds holding a connection
+}
+
+type cmdTimesKey struct{}
+
+// CmdTimesFromContext returns the CmdTimes of the command served
+// with ctx, or nil.
+func CmdTimesFromContext(ctx context.Context) *CmdTimes {
+	t, _ := ctx.Value(cmdTimesKey{}).(*CmdTimes)
+	return t
+}
+
+// AddDB adds the time spent waiting for a database connection
+// and the time it was held. A nil *CmdTimes does nothing.
+func (t *CmdTimes) AddDB(wait, exec time.Duration) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.dbWait, int64(wait))
+	atomic.AddInt64(&t.dbExec, int64(exec))
+}
+
+func (t *CmdTimes) db() (wait, exec time.Duration) {
+	return time.Duration(atomic.LoadInt64(&t.dbWait)), time.Duration(atomic.LoadInt64(&t.dbExec))
+}
+
+// writeTime reports the time spent writing to the client.
+func (c *Conn) writeTime() time.Duration {
+	tc, _ := c.netConn.(*timeoutConn)
+	if tc == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&tc.spent))
+}
+
+// cmdTiming is the breakdown of a command's latency.
+type cmdTiming struct {
+	parse  time.Duration // reading and parsing the command
+	dbWait time.Duration
+	dbExec time.Duration
+	write  time.Duration
+}
+
+func (t cmdTiming) String() string {
+	return fmt.Sprintf("parse=%s db_wait=%s db_exec=%s write=%s", t.parse, t.dbWait, t.dbExec, t.write)
+}
+
+// countCommand adds a served command to ConnStats.Commands
+// and reports whether it was slow.
+func (server *Server) countCommand(name string, d time.Duration) (slow bool) {
+	slow = server.SlowCommand > 0 && d >= server.SlowCommand
+
+	server.cmdStatsMu.Lock()
+	defer server.cmdStatsMu.Unlock()
+	if server.cmdStats == nil {
+		server.cmdStats = make(map[string]CommandStats)
+	}
+	s := server.cmdStats[name]
+	s.Count++
+	if slow {
+		s.Slow++
+	}
+	s.Total += d
+	if d > s.Max {
+		s.Max = d
+	}
+	server.cmdStats[name] = s
+	return slow
+}
+
+func (server *Server) commandStats() map[string]CommandStats {
+	server.cmdStatsMu.Lock()
+	defer server.cmdStatsMu.Unlock()
+	stats := make(map[string]CommandStats, len(server.cmdStats))
+	for name, s := range server.cmdStats {
+		stats[name] = s
+	}
+	return stats
+}
@@ -0,0 +1,95 @@
+package imapserver
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// COMPRESS=DEFLATE, RFC 4978.
+//
+// The flate layer sits between the TLS connection and the
+// buffered reader and writer of the Conn. A debug transcript
+// tees the buffered side, so it records the commands and
+// responses as they are, not their compressed bytes.
+//
+// The window is the 32KB compress/flate always uses, the largest
+// RFC 1951 allows, so any client can inflate the responses.
+// Only Server.CompressLevel, trading CPU for bandwidth, is set.
+
+// CompressStats counts the bytes of connections using COMPRESS.
+// The ratio of Data to Wire is how well compression works.
+type CompressStats struct {
+	Conns   int64 // connections that started COMPRESS
+	InWire  int64 // compressed bytes read from clients
+	InData  int64 // the bytes they inflate to
+	OutData int64 // bytes of responses
+	OutWire int64 // the compressed bytes written to clients
+}
+
+func (s CompressStats) String() string {
+	return fmt.Sprintf("in %d/%d out %d/%d bytes", s.InWire, s.InData, s.OutWire, s.OutData)
+}
+
+// load reads the counts of s while they are being updated.
+func (s *CompressStats) load() CompressStats {
+	return CompressStats{
+		Conns:   atomic.LoadInt64(&s.Conns),
+		InWire:  atomic.LoadInt64(&s.InWire),
+		InData:  atomic.LoadInt64(&s.InData),
+		OutData: atomic.LoadInt64(&s.OutData),
+		OutWire: atomic.LoadInt64(&s.OutWire),
+	}
+}
+
+// countReader counts the bytes read from r in n and total.
+type countReader struct {
+	r        io.Reader
+	n, total *int64
+}
+
+func (cr countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	atomic.AddInt64(cr.total, int64(n))
+	return n, err
+}
+
+// countWriter counts the bytes written to w in n and total.
+type countWriter struct {
+	w        io.Writer
+	n, total *int64
+}
+
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	atomic.AddInt64(cw.total, int64(n))
+	return n, err
+}
+
+// startCompress puts a flate layer on the connection.
+// It is called with bwMu held, once the OK response is flushed.
+func (c *Conn) startCompress() {
+	stats, total := &c.compressStats, &c.server.compressStats
+	atomic.AddInt64(&total.Conns, 1)
+
+	level := c.server.CompressLevel
+	if level == 0 {
+		level = flate.BestSpeed
+	}
+	r := flate.NewReader(countReader{c.netConn, &stats.InWire, &total.InWire})
+	w, err := flate.NewWriter(countWriter{c.netConn, &stats.OutWire, &total.OutWire}, level)
+	if err != nil {
+		// CompressLevel was checked by serve.
+		panic(fmt.Sprintf("imapserver: %v", err))
+	}
+	c.compressing = true
+	c.compressFlush = w.Flush
+	c.compressClose = w.Close
+	c.initBufio(
+		countReader{r, &stats.InData, &total.InData},
+		countWriter{w, &stats.OutData, &total.OutData},
+	)
+}
@@ -4,24 +4,31 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
 	"time"
 )
 
 const debugLiteralWrite = 256 // number of bytes of the literal to write
 
+const debugMaxLine = 64 << 10 // longest client line kept whole
+
 // debugWriter writes a copy of an IMAP session.
-// It skips over long literals.
+// It skips over long literals and redacts credentials.
 //
 // There is no buffering in debugWriter because the imapserver
 // batches writes to it using the same bufio it uses to batch
 // network communication.
+//
+// A debugWriter follows a session from its start, but only
+// writes once it has a writer, set by attachDebug when
+// Server.Debug asks for a copy of the session.
 type debugWriter struct {
 	sessionID string
 	logf      func(format string, v ...interface{}) // used to report failed writing
 
 	mu         sync.Mutex
-	writer     io.Writer
+	writer     io.Writer // nil until capture starts
 	client     *debugWriterDirectional
 	server     *debugWriterDirectional
 	lastPrefix string
@@ -36,6 +43,7 @@ func newDebugWriter(sessionID string, logf func(format string, v ...interface{})
 	w.client = &debugWriterDirectional{
 		w:      w,
 		prefix: "C: ",
+		client: true,
 	}
 	w.server = &debugWriterDirectional{
 		w:      w,
@@ -44,17 +52,56 @@ func newDebugWriter(sessionID string, logf func(format string, v ...interface{})
 	return w
 }
 
+func (w *debugWriter) setWriter(writer io.Writer) {
+	w.mu.Lock()
+	w.writer = writer
+	w.lastPrefix = ""
+	w.mu.Unlock()
+}
+
+// capturing reports whether the session is being written.
+func (w *debugWriter) capturing() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer != nil
+}
+
+// attachDebug starts a copy of the session if Server.Debug asks
+// for one. It is called as the session starts and after each
+// command, so capture can be enabled for a session or a user
+// while the session is running.
+func (c *Conn) attachDebug() {
+	if c.debugW == nil || c.debugFile != nil {
+		return
+	}
+	if f := c.server.Debug(c.ID, c.userID); f != nil {
+		c.debugFile = f
+		c.debugW.setWriter(f)
+	}
+}
+
 type debugWriterDirectional struct {
 	w       *debugWriter
 	prefix  string
 	litHead int
 	litSkip int
+
+	// The client side is split into lines and literals
+	// as it is written, to find the credentials in it.
+	client    bool
+	line      []byte
+	litLeft   int  // bytes of the current literal still to come
+	redacting bool // the current command is being redacted
+	authSASL  bool // lines are SASL responses to an AUTHENTICATE
 }
 
 func (w *debugWriterDirectional) literalDataFollows(n int) {
 	w.w.mu.Lock()
 	defer w.w.mu.Unlock()
+	w.skipLiteral(n)
+}
 
+func (w *debugWriterDirectional) skipLiteral(n int) {
 	if n < debugLiteralWrite {
 		return // write the whole literal
 	}
@@ -67,8 +114,112 @@ func (w *debugWriterDirectional) Write(p []byte) (int, error) {
 	w.w.mu.Lock()
 	defer w.w.mu.Unlock()
 
-	n := len(p)
+	if w.client {
+		w.writeClient(p)
+	} else {
+		w.writeData(p)
+	}
+	return len(p), nil
+}
+
+// writeClient writes data sent by the client.
+//
+// Literals are found by the {n} or {n+} that ends the line
+// before them. The arguments of LOGIN and AUTHENTICATE, along
+// with any literals they include, and the SASL responses that
+// follow AUTHENTICATE are replaced by "[redacted]".
+func (w *debugWriterDirectional) writeClient(p []byte) {
+	for len(p) > 0 {
+		if w.litLeft > 0 {
+			n := len(p)
+			if n > w.litLeft {
+				n = w.litLeft
+			}
+			if !w.redacting {
+				w.writeData(p[:n])
+			}
+			w.litLeft -= n
+			p = p[n:]
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			w.appendLine(p)
+			return
+		}
+		w.appendLine(p[:i+1])
+		p = p[i+1:]
+		w.clientLine(w.line)
+		w.line = w.line[:0]
+	}
+}
+
+func (w *debugWriterDirectional) appendLine(p []byte) {
+	if n := debugMaxLine - len(w.line); len(p) > n {
+		p = p[:n]
+	}
+	w.line = append(w.line, p...)
+}
+
+func (w *debugWriterDirectional) clientLine(line []byte) {
+	litLen, hasLit := literalLen(line)
+
+	if !w.redacting {
+		fields := bytes.Fields(line)
+		if w.authSASL && len(fields) <= 1 {
+			w.writeWithPrefix([]byte("[redacted]\r\n"))
+			return
+		}
+		w.authSASL = false
+
+		if len(fields) >= 2 {
+			switch string(bytes.ToUpper(fields[1])) {
+			case "LOGIN":
+				w.redacting = true
+			case "AUTHENTICATE":
+				w.redacting = true
+				w.authSASL = true
+			}
+			if w.redacting {
+				w.writeWithPrefix([]byte(fmt.Sprintf("%s %s [redacted]\r\n", fields[0], fields[1])))
+			}
+		}
+	}
+	if w.redacting {
+		// A command ends on a line that does not introduce a literal.
+		w.redacting = hasLit
+		w.litLeft = litLen
+		return
+	}
 
+	w.writeData(line)
+	if hasLit {
+		w.litLeft = litLen
+		w.skipLiteral(litLen)
+	}
+}
+
+// literalLen reports the length of the literal announced
+// at the end of an IMAP line, "{n}\r\n" or "{n+}\r\n".
+func literalLen(line []byte) (int, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) < 3 || line[len(line)-1] != '}' {
+		return 0, false
+	}
+	i := bytes.LastIndexByte(line, '{')
+	if i == -1 {
+		return 0, false
+	}
+	num := bytes.TrimSuffix(line[i+1:len(line)-1], []byte("+"))
+	n, err := strconv.Atoi(string(num))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// writeData writes p, skipping the middle of long literals.
+func (w *debugWriterDirectional) writeData(p []byte) {
 	if w.litHead > 0 {
 		head := p
 		if len(head) > w.litHead {
@@ -76,11 +227,11 @@ func (w *debugWriterDirectional) Write(p []byte) (int, error) {
 		}
 		// TODO: prefix write head
 		if !w.writeWithPrefix(head) {
-			return n, nil
+			return
 		}
 		w.litHead -= len(head)
 		p = p[len(head):]
-		if w.litHead == 0 {
+		if w.litHead == 0 && w.w.writer != nil {
 			fmt.Fprintf(w.w.writer, "\n%s... skipping %d bytes of literal ...\n", w.prefix, w.litSkip)
 			w.w.lastPrefix = ""
 		}
@@ -88,14 +239,13 @@ func (w *debugWriterDirectional) Write(p []byte) (int, error) {
 	if w.litSkip > 0 {
 		if len(p) < w.litSkip {
 			w.litSkip -= len(p)
-			return n, nil
+			return
 		}
 		p = p[w.litSkip:]
 		w.litSkip = 0
 	}
 
 	w.writeWithPrefix(p)
-	return n, nil
 }
 
 func (w *debugWriterDirectional) writeWithPrefix(p []byte) bool {
@@ -131,6 +281,9 @@ func (w *debugWriterDirectional) writeWithPrefix(p []byte) bool {
 }
 
 func (w *debugWriterDirectional) write(p []byte) bool {
+	if w.w.writer == nil {
+		return true
+	}
 	if _, err := w.w.writer.Write(p); err != nil {
 		w.w.logf("session(%s): debugWriter failed: %v", w.w.sessionID, err)
 		return false
@@ -140,6 +293,9 @@ func (w *debugWriterDirectional) write(p []byte) bool {
 
 func (w *debugWriterDirectional) writePrefix() bool {
 	w.w.lastPrefix = w.prefix
+	if w.w.writer == nil {
+		return true
+	}
 	b := make([]byte, 0, 32)
 	b = time.Now().AppendFormat(b, "15:04:05.000 ")
 	b = append(b, w.prefix...)
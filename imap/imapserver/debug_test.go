@@ -0,0 +1,108 @@
+package imapserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugRedact(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newDebugWriter("s1", t.Logf, buf)
+
+	client := []string{
+		"a1 LOGIN bob secret1\r\n",
+		"a2 LOGIN {3}\r\n", "bob", " {7}\r\n", "secret2", "\r\n",
+		"a3 AUTHENTICATE PLAIN\r\n",
+		"c2VjcmV0Mw==\r\n",
+		"a4 SELECT INBOX\r\n",
+		"a5 APPEND INBOX {5+}\r\n", "hello", "\r\n",
+	}
+	for _, s := range client {
+		// Split writes, as a client's data arrives in pieces.
+		for len(s) > 3 {
+			w.client.Write([]byte(s[:3]))
+			s = s[3:]
+		}
+		w.client.Write([]byte(s))
+	}
+
+	got := buf.String()
+	for _, secret := range []string{"secret1", "secret2", "c2VjcmV0Mw=="} {
+		if strings.Contains(got, secret) {
+			t.Errorf("transcript contains %q:\n%s", secret, got)
+		}
+	}
+	for _, want := range []string{"a1 LOGIN [redacted]", "a2 LOGIN [redacted]", "a3 AUTHENTICATE [redacted]", "a4 SELECT INBOX", "hello"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("transcript missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestDebugCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapserver-debug-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dc := &DebugCapture{
+		Dir:      dir,
+		MaxSize:  100,
+		MaxFiles: 2,
+		Logf:     t.Logf,
+	}
+	if w := dc.Writer("S1", 7); w != nil {
+		t.Fatal("capture enabled by default")
+	}
+
+	dc.EnableUser(7, time.Hour)
+	if w := dc.Writer("S1", 0); w != nil {
+		t.Error("user capture enabled before login")
+	}
+	w := dc.Writer("S1", 7)
+	if w == nil {
+		t.Fatal("user capture not enabled")
+	}
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "imap-S1.txt")
+	for _, n := range []string{name, name + ".1", name + ".2"} {
+		info, err := os.Stat(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s is %d bytes, more than MaxSize", n, info.Size())
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than MaxFiles rotated files: %v", err)
+	}
+
+	dc.DisableUser(7)
+	before, _ := os.Stat(name)
+	w.Write(line)
+	after, _ := os.Stat(name)
+	if after.Size() != before.Size() {
+		t.Error("write after capture disabled")
+	}
+	w.Close()
+
+	dc.EnableSession("S2", -time.Second)
+	if w := dc.Writer("S2", 0); w != nil {
+		t.Error("expired session capture enabled")
+	}
+	if targets := dc.Enabled(); len(targets) != 0 {
+		t.Errorf("enabled targets: %+v", targets)
+	}
+}
@@ -0,0 +1,57 @@
+package imapserver
+
+import "strings"
+
+// An extension is an IMAP extension a client turns on for its
+// connection, with ENABLE (RFC 5161) or by using it.
+//
+// Responses that only a client aware of an extension understands,
+// such as the MODSEQ of an untagged FETCH, are sent once the
+// extension is enabled.
+type extension uint8
+
+const (
+	extCondstore extension = 1 << iota // RFC 7162 CONDSTORE
+)
+
+// enableable are the capabilities ENABLE turns on.
+//
+// QRESYNC and UTF8=ACCEPT are not implemented, so ENABLE ignores
+// them as it does any capability it does not know.
+var enableable = map[string]extension{
+	"CONDSTORE": extCondstore,
+}
+
+// isEnabled reports whether the client has enabled ext.
+func (c *Conn) isEnabled(ext extension) bool {
+	return c.enabled&ext != 0
+}
+
+// cmdEnable enables the capabilities of an ENABLE command
+// and lists them in the untagged ENABLED response.
+func (c *Conn) cmdEnable() {
+	var names []string
+	var exts extension
+	for _, param := range c.p.Command.Params {
+		name := strings.ToUpper(string(param))
+		ext := enableable[name]
+		if ext == 0 || exts&ext != 0 {
+			continue
+		}
+		exts |= ext
+		names = append(names, name)
+	}
+	if exts&extCondstore != 0 && c.mailbox != nil {
+		// ENABLE CONDSTORE is a CONDSTORE enabling command,
+		// reported for the selected mailbox. RFC 7162 3.1.
+		c.setCondStore()
+	}
+	c.enabled |= exts
+
+	c.writef("* ENABLED")
+	for _, name := range names {
+		c.writef(" %s", name)
+	}
+	c.writef("\r\n")
+	c.respondln("OK ENABLE completed")
+}
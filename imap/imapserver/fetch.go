@@ -3,14 +3,12 @@ package imapserver
 import (
 	"fmt"
 	"io"
-	"mime"
-	"net/mail"
 	"sort"
-	"strings"
 
 	"spilled.ink/email"
 	"spilled.ink/email/msgbuilder"
 	"spilled.ink/imap"
+	"spilled.ink/imap/imapformat"
 	"spilled.ink/imap/imapparser"
 )
 
@@ -44,22 +42,29 @@ func (c *Conn) cmdFetch() {
 		items = append(items, item)
 	}
 
+	w := getRespWriter()
+	defer w.release()
+
+	var hdrErr error
 	fn := func(m imap.Message) {
-		c.writef("* %d FETCH (", m.Summary().SeqNum)
-		for i := range cmd.FetchItems {
-			item := &cmd.FetchItems[i]
-			if i > 0 {
-				c.writef(" ")
+		if hf, ok := m.(imap.HeaderFields); ok && needHeaders(m, hf, cmd.FetchItems) {
+			if err := hf.LoadHeaders(); err != nil {
+				if hdrErr == nil {
+					hdrErr = err
+				}
+				return
 			}
-			c.writeItem(m, item)
 		}
-		c.writef(")\r\n")
+		c.writeFetch(w, m, cmd.FetchItems)
 	}
 	changedSince := cmd.ChangedSince
 	if changedSince == 0 {
 		changedSince = -1
 	}
 	err := c.mailbox.Fetch(cmd.UID, cmd.Sequences, changedSince, fn)
+	if err == nil {
+		err = hdrErr
+	}
 	if err != nil {
 		c.respondln("BAD FETCH error: %v", err)
 		return
@@ -71,261 +76,188 @@ func (c *Conn) cmdFetch() {
 	}
 }
 
+// writeFetch writes the untagged FETCH response for m.
+func (c *Conn) writeFetch(w *respWriter, m imap.Message, items []imapparser.FetchItem) {
+	w.atom("* ")
+	w.num(int64(m.Summary().SeqNum))
+	w.atom(" FETCH (")
+	for i := range items {
+		item := &items[i]
+		if i > 0 {
+			w.atom(" ")
+		}
+		c.writeItem(w, m, item)
+	}
+	w.atom(")\r\n")
+	w.flush(c.bw)
+}
+
+// needHeaders reports whether writing items for m needs
+// all of the message headers.
+func needHeaders(m imap.Message, hf imap.HeaderFields, items []imapparser.FetchItem) bool {
+	fc, _ := m.(imap.FetchCache)
+	for i := range items {
+		item := &items[i]
+		switch item.Type {
+		case imapparser.FetchFast, imapparser.FetchFlags, imapparser.FetchInternalDate,
+			imapparser.FetchRFC822Size, imapparser.FetchUID, imapparser.FetchModSeq:
+			continue
+		case imapparser.FetchAll, imapparser.FetchEnvelope:
+			if fc != nil && fc.CachedEnvelope() != nil {
+				continue
+			}
+		case imapparser.FetchBodyStructure:
+			if fc != nil && fc.CachedBodyStructure() != nil {
+				continue
+			}
+		case imapparser.FetchBody:
+			if item.Section.Name == "HEADER.FIELDS" && len(item.Section.Path) == 0 && hasHeaderFields(hf, item.Section.Headers) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func hasHeaderFields(hf imap.HeaderFields, names [][]byte) bool {
+	for _, name := range names {
+		if _, ok := hf.HeaderField(email.CanonicalKey(name)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// headerField reports the first value of a header field of m.
+func headerField(m imap.Message, key email.Key) []byte {
+	if hf, ok := m.(imap.HeaderFields); ok {
+		if v, ok := hf.HeaderField(key); ok {
+			return v
+		}
+	}
+	return m.Msg().Headers.Get(key)
+}
+
 func fetchItemType(t imapparser.FetchItemType) *imapparser.FetchItem {
 	return &imapparser.FetchItem{Type: t}
 }
 
-func (c *Conn) writeItem(m imap.Message, item *imapparser.FetchItem) {
+func (c *Conn) writeItem(w *respWriter, m imap.Message, item *imapparser.FetchItem) {
 	switch item.Type {
 	case imapparser.FetchAll:
-		c.writeItem(m, fetchItemType(imapparser.FetchFlags))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchInternalDate))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchRFC822Size))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchEnvelope))
+		c.writeItem(w, m, fetchItemType(imapparser.FetchFlags))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchInternalDate))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchRFC822Size))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchEnvelope))
 	case imapparser.FetchFull:
-		c.writeItem(m, fetchItemType(imapparser.FetchFlags))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchInternalDate))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchRFC822Size))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchEnvelope))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchBody))
+		c.writeItem(w, m, fetchItemType(imapparser.FetchFlags))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchInternalDate))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchRFC822Size))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchEnvelope))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchBody))
 	case imapparser.FetchFast:
-		c.writeItem(m, fetchItemType(imapparser.FetchFlags))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchInternalDate))
-		c.writef(" ")
-		c.writeItem(m, fetchItemType(imapparser.FetchRFC822Size))
+		c.writeItem(w, m, fetchItemType(imapparser.FetchFlags))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchInternalDate))
+		w.atom(" ")
+		c.writeItem(w, m, fetchItemType(imapparser.FetchRFC822Size))
 	case imapparser.FetchEnvelope:
-		hdrs := m.Msg().Headers
-		c.writef("ENVELOPE (")
-		c.writeStringBytes(hdrs.Get("Date"))
-		c.writef(" ")
-		c.writeStringBytes(hdrs.Get("Subject"))
-		c.writef(" ")
-		c.writeAddresses(hdrs.Get("From"))
-		c.writef(" ")
-		c.writeAddresses(hdrs.Get("Sender"))
-		c.writef(" ")
-		c.writeAddresses(hdrs.Get("Reply-To"))
-		c.writef(" ")
-		c.writeAddresses(hdrs.Get("To"))
-		c.writef(" ")
-		c.writeAddresses(hdrs.Get("CC"))
-		c.writef(" ")
-		c.writeAddresses(hdrs.Get("BCC"))
-		c.writef(" ")
-		c.writeStringBytes(hdrs.Get("In-Reply-To"))
-		c.writef(" ")
-		c.writeStringBytes(hdrs.Get("Message-ID"))
-		c.writef(")")
+		c.writeEnvelope(w, m)
 	case imapparser.FetchFlags:
-		c.writef("FLAGS (")
+		w.atom("FLAGS (")
 		for i, flag := range m.Msg().Flags {
 			if i > 0 {
-				c.writef(" ")
+				w.atom(" ")
 			}
 			if flag[0] == '\\' {
-				c.writef("%s", flag)
+				w.atom(flag)
 			} else {
-				c.writeString(flag)
+				w.str(flag)
 			}
 		}
-		c.writef(")")
+		w.atom(")")
 	case imapparser.FetchInternalDate:
-		c.writef("INTERNALDATE ")
-		c.writeString(m.Msg().Date.Format("02-Jan-2006 15:04:05 -0700"))
+		w.atom("INTERNALDATE ")
+		w.date(m.Msg().Date)
 	case imapparser.FetchRFC822Header:
-		c.writeBody(m, &imapparser.FetchItem{
+		c.writeBody(w, m, &imapparser.FetchItem{
 			Type: imapparser.FetchBody,
 			Section: imapparser.FetchItemSection{
 				Name: "HEADER",
 			},
 		})
 	case imapparser.FetchRFC822Size:
-		c.writef("RFC822.SIZE %d", m.Msg().EncodedSize)
+		w.atom("RFC822.SIZE ")
+		w.num(m.Msg().EncodedSize)
 	case imapparser.FetchRFC822Text:
-		c.writeBody(m, &imapparser.FetchItem{
+		c.writeBody(w, m, &imapparser.FetchItem{
 			Type: imapparser.FetchBody,
 			Section: imapparser.FetchItemSection{
 				Name: "TEXT",
 			},
 		})
 	case imapparser.FetchUID:
-		c.writef("UID %d", m.Summary().UID)
+		w.atom("UID ")
+		w.num(int64(m.Summary().UID))
 	case imapparser.FetchModSeq:
-		c.writef("MODSEQ (%d)", m.Summary().ModSeq)
+		w.atom("MODSEQ (")
+		w.num(m.Summary().ModSeq)
+		w.atom(")")
 	case imapparser.FetchBodyStructure:
-		c.writeBodyStructure(m)
+		c.writeBodyStructure(w, m)
 	case imapparser.FetchBody:
-		c.writeBody(m, item)
+		c.writeBody(w, m, item)
 	default:
 		panic(fmt.Sprintf("imapserver: impossible fetch item: %v", item))
 	}
 }
 
-func (c *Conn) writeAddresses(addrBytes []byte) {
-	addrs, err := mail.ParseAddressList(string(addrBytes))
+func (c *Conn) writeEnvelope(w *respWriter, m imap.Message) {
+	w.atom("ENVELOPE ")
+	if fc, ok := m.(imap.FetchCache); ok {
+		if env := fc.CachedEnvelope(); env != nil {
+			w.b = append(w.b, env...)
+			return
+		}
+	}
+	var err error
+	w.b, err = imapformat.AppendEnvelope(w.b, &m.Msg().Headers)
 	if err != nil {
-		c.writef("NIL")
-		c.server.Logf("%s", logMsg{
-			What: "FETCH",
-			ID:   c.ID,
-			Err:  fmt.Errorf("cannot write address %q: %v", addrBytes, err),
-		}.String())
-		return
+		c.logFetchErr("ENVELOPE", m.Msg(), 0, err)
 	}
-	for _, addr := range addrs {
-		i := strings.LastIndexByte(addr.Address, '@')
-		if i == -1 {
-			c.server.Logf("%s", logMsg{
-				What: "FETCH",
-				ID:   c.ID,
-				Err:  fmt.Errorf("cannot write address %q", addr.Address),
-			}.String())
-			continue
-		}
-		mailboxName, hostName := addr.Address[:i], addr.Address[i+1:]
+}
 
-		c.writef("(")
-		if addr.Name == "" {
-			c.writef("NIL")
-		} else {
-			c.writeString(addr.Name) // personal name
+func (c *Conn) writeBodyStructure(w *respWriter, m imap.Message) {
+	if fc, ok := m.(imap.FetchCache); ok {
+		if bs := fc.CachedBodyStructure(); bs != nil {
+			w.atom("BODYSTRUCTURE ")
+			w.b = append(w.b, bs...)
+			return
 		}
-		c.writef(" NIL ") // at-domain-list (source route)
-		c.writeString(mailboxName)
-		c.writef(" ")
-		c.writeString(hostName)
-		c.writef(")")
 	}
-}
-
-func (c *Conn) writeBodyStructure(m imap.Message) {
-	node, err := msgbuilder.BuildTree(m.Msg())
+	n := len(w.b)
+	w.atom("BODYSTRUCTURE ")
+	bs, err := imapformat.AppendBodyStructure(w.b, m.Msg())
 	if err != nil {
 		c.server.Logf("%s", logMsg{
 			What: "BODYSTRUCTURE",
 			ID:   c.ID,
 			Err:  err,
 		}.String())
-
-		return
 	}
-	c.writef("BODYSTRUCTURE (")
-	c.writeBodyStructurePart(node)
-	c.writef(")")
-}
-
-func (c *Conn) writeBodyStructurePart(node *msgbuilder.TreeNode) {
-	partNum := -1
-	if node.Part != nil {
-		partNum = node.Part.PartNum
-	}
-	mediaType, ctParams, err := mime.ParseMediaType(node.Header.ContentType)
-	if err != nil {
-		c.server.Logf("%s", logMsg{
-			What:    "BODYSTRUCTURE",
-			ID:      c.ID,
-			PartNum: partNum,
-			Err:     err,
-		}.String())
+	if bs == nil {
+		w.b = w.b[:n]
 		return
 	}
-	var ctParamKeys []string
-	for key := range ctParams {
-		ctParamKeys = append(ctParamKeys, key)
-	}
-	sort.Strings(ctParamKeys)
-	var bodyType, bodySubtype string
-	if i := strings.IndexByte(mediaType, '/'); i == -1 {
-		c.server.Logf("%s", logMsg{
-			What:    "BODYSTRUCTURE",
-			ID:      c.ID,
-			PartNum: partNum,
-			Err:     fmt.Errorf("bad mediatype: %s", mediaType),
-		}.String())
-		return
-	} else {
-		bodyType, bodySubtype = mediaType[:i], mediaType[i+1:]
-	}
-
-	if len(node.Kids) > 0 {
-		// multipart
-		for i, kid := range node.Kids {
-			if i > 0 {
-				c.writef(" (")
-			} else {
-				c.writef("(")
-			}
-			c.writeBodyStructurePart(&kid)
-			c.writef(")")
-		}
-
-		// subtype
-		c.writef(" ")
-		c.writeString(strings.ToUpper(bodySubtype))
-		// body parameter parenthesized list
-		c.writef(" (boundary ")
-		c.writeString(ctParams["boundary"]) // TODO: all ctParamKeys?
-		c.writef(")")
-		// body disposition
-		if node.Header.ContentDisposition == "" {
-			c.writef(" NIL")
-		} else {
-			c.writef(" ()") // TODO
-		}
-		// body language
-		c.writef(" NIL")
-		// body location
-		c.writef(" NIL")
-		return
-	}
-
-	// body type
-	c.writeString(bodyType)
-	c.writef(" ")
-	// body subtype
-	c.writeString(bodySubtype)
-	// body parameter parnthesized list
-	c.writef(" (")
-	for i, key := range ctParamKeys {
-		if i > 0 {
-			c.writef(" ")
-		}
-		c.writeString(key)
-		c.writef(" ")
-		c.writeString(ctParams[key])
-	}
-	c.writef(")")
-	// body id
-	if node.Header.ContentID == "" {
-		c.writef(" NIL")
-	} else {
-		c.writef(" ")
-		c.writeString(node.Header.ContentID)
-	}
-	// body description
-	c.writef(" NIL")
-	// body encoding
-	c.writef(" ")
-	if node.Header.ContentTransferEncoding == "7bit" {
-		c.writef("NIL")
-	} else {
-		c.writeString(node.Header.ContentTransferEncoding)
-	}
-	c.writef(" %d", node.Part.ContentTransferSize) // body size
-	if bodyType == "text" {
-		// RFC 3501 7.4.2:
-		//	A body type of type TEXT contains, immediately after
-		//	the basic fields, the size of the body in text lines.
-		c.writef(" %d", node.Part.ContentTransferLines)
-	}
+	w.b = bs
 }
 
 func (c *Conn) loadParts(m imap.Message, node *msgbuilder.TreeNode) error {
@@ -356,17 +288,23 @@ func (c *Conn) logFetchErr(what string, msg *email.Msg, partNum int, err error)
 	}.String())
 }
 
-func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
+func (c *Conn) writeBody(w *respWriter, m imap.Message, item *imapparser.FetchItem) {
 	// item.Type == imapparser.FetchBody
 	// BODY[<section>]<<origin octet>>
 
-	buf := c.server.Filer.BufferFile(0)
+	buf := c.filer.BufferFile(0)
 	defer buf.Close()
 
-	node, err := msgbuilder.BuildTree(m.Msg())
-	if err != nil {
-		c.logFetchErr("BODY", m.Msg(), 0, err)
-		return
+	// The message tree is not needed for the headers of the message,
+	// and building it needs all of them.
+	var node *msgbuilder.TreeNode
+	if len(item.Section.Path) > 0 || item.Section.Name == "" || item.Section.Name == "TEXT" {
+		var err error
+		node, err = msgbuilder.BuildTree(m.Msg())
+		if err != nil {
+			c.logFetchErr("BODY", m.Msg(), 0, err)
+			return
+		}
 	}
 	if len(item.Section.Path) > 0 {
 		// BODY[1.2.3]
@@ -399,7 +337,7 @@ func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
 				c.logFetchErr("BODY[]", m.Msg(), 0, err)
 				return
 			}
-			builder := &msgbuilder.Builder{Filer: c.server.Filer}
+			builder := &msgbuilder.Builder{Filer: c.filer}
 			var err error
 			if err = builder.Build(buf, m.Msg()); err != nil {
 				c.logFetchErr("BODY[]", m.Msg(), 0, err)
@@ -453,11 +391,10 @@ func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
 			return
 		}
 
-		hdrs := m.Msg().Headers
 		var hdr email.Header
 		for _, name := range item.Section.Headers {
 			key := email.CanonicalKey(name)
-			if v := hdrs.Get(key); len(v) != 0 {
+			if v := headerField(m, key); len(v) != 0 {
 				hdr.Add(key, v)
 			}
 		}
@@ -471,7 +408,7 @@ func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
 			c.logFetchErr("TEXT", m.Msg(), 0, err)
 			return
 		}
-		builder := &msgbuilder.Builder{Filer: c.server.Filer}
+		builder := &msgbuilder.Builder{Filer: c.filer}
 		if err := builder.WriteNode(buf, node); err != nil {
 			c.logFetchErr("TEXT", m.Msg(), 0, err)
 			return
@@ -491,6 +428,16 @@ func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
 		if !seen {
 			if err := m.SetSeen(); err != nil {
 				c.logFetchErr("BODY", m.Msg(), 0, fmt.Errorf("failed to set Seen flag"))
+			} else {
+				summary := m.Summary()
+				c.sendIdleUpdate(c.mailbox.ID(), idleUpdate{
+					typ:      idleFlagChange,
+					value:    summary.SeqNum,
+					skipSelf: true,
+					uid:      summary.UID,
+					flags:    addFlag(m.Msg().Flags, `\Seen`),
+					modSeq:   summary.ModSeq,
+				})
 			}
 		}
 	}
@@ -500,31 +447,31 @@ func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
 		return
 	}
 
-	c.writef("BODY[")
+	w.atom("BODY[")
 	for i, v := range item.Section.Path {
 		if i > 0 {
-			c.writef(".")
+			w.atom(".")
 		}
-		c.writef("%d", v)
+		w.num(int64(v))
 	}
 	if item.Section.Name != "" {
 		if len(item.Section.Path) > 0 {
-			c.writef(".")
+			w.atom(".")
 		}
-		c.writef(item.Section.Name)
+		w.atom(item.Section.Name)
 	}
 	switch item.Section.Name {
 	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
-		c.writef(" (")
+		w.atom(" (")
 		for i, name := range item.Section.Headers {
 			if i > 0 {
-				c.writef(" ")
+				w.atom(" ")
 			}
-			c.writeString(string(email.CanonicalKey(name)))
+			w.str(string(email.CanonicalKey(name)))
 		}
-		c.writef(")")
+		w.atom(")")
 	}
-	c.writef("]")
+	w.atom("]")
 
 	r := io.Reader(buf)
 	size := buf.Size()
@@ -541,10 +488,13 @@ func (c *Conn) writeBody(m imap.Message, item *imapparser.FetchItem) {
 		buf.Seek(start, 0)
 		size = l
 		r = io.LimitReader(buf, size)
-		c.writef("<%d> ", start)
+		w.atom("<")
+		w.num(start)
+		w.atom("> ")
 	} else {
-		c.writef(" ")
+		w.atom(" ")
 	}
+	w.flush(c.bw)
 	c.writeLiteral(r, size)
 }
 
@@ -561,3 +511,16 @@ func findPath(node *msgbuilder.TreeNode, path []uint16) *msgbuilder.TreeNode {
 	}
 	return node
 }
+
+// addFlag reports flags with flag added, sorted.
+// The flags slice is not modified.
+func addFlag(flags []string, flag string) []string {
+	for _, f := range flags {
+		if f == flag {
+			return flags
+		}
+	}
+	flags = append(append([]string(nil), flags...), flag)
+	sort.Strings(flags)
+	return flags
+}
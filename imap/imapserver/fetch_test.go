@@ -0,0 +1,83 @@
+package imapserver
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"spilled.ink/email"
+	"spilled.ink/imap"
+	"spilled.ink/imap/imapformat"
+	"spilled.ink/imap/imapparser"
+)
+
+// benchMsg is a message with a cached envelope and body
+// structure, as a FETCH of a stored mailbox sees it.
+type benchMsg struct {
+	summary imap.MessageSummary
+	msg     email.Msg
+	env, bs []byte
+}
+
+func (m *benchMsg) Summary() imap.MessageSummary { return m.summary }
+func (m *benchMsg) Msg() *email.Msg              { return &m.msg }
+func (m *benchMsg) LoadPart(partNum int) error   { return nil }
+func (m *benchMsg) SetSeen() error               { return nil }
+func (m *benchMsg) CachedEnvelope() []byte       { return m.env }
+func (m *benchMsg) CachedBodyStructure() []byte  { return m.bs }
+
+// BenchmarkFetchInbox writes the FETCH responses a mail client
+// asks for when it lists a mailbox of 100 messages.
+func BenchmarkFetchInbox(b *testing.B) {
+	var hdrs email.Header
+	hdrs.Add("Date", []byte("Thu, 11 Oct 2018 02:42:50 +0000"))
+	hdrs.Add("Subject", []byte("A Journey to the Stars"))
+	hdrs.Add("From", []byte("Alice <alice@example.com>"))
+	hdrs.Add("To", []byte("bob@example.org"))
+	env, err := imapformat.AppendEnvelope(nil, &hdrs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bs := []byte(`("text" "plain" ("charset" "utf-8") NIL NIL "7bit" 1024 20)`)
+
+	msgs := make([]*benchMsg, 100)
+	for i := range msgs {
+		msgs[i] = &benchMsg{
+			summary: imap.MessageSummary{SeqNum: uint32(i + 1), UID: uint32(i + 1000), ModSeq: int64(i + 5000)},
+			msg: email.Msg{
+				Date:        time.Date(2018, 10, 11, 2, 42, 50, 0, time.UTC),
+				Flags:       []string{`\Seen`, "$Forwarded"},
+				EncodedSize: 4096 + int64(i),
+			},
+			env: env,
+			bs:  bs,
+		}
+	}
+	var items []imapparser.FetchItem
+	for _, t := range []imapparser.FetchItemType{
+		imapparser.FetchUID,
+		imapparser.FetchFlags,
+		imapparser.FetchInternalDate,
+		imapparser.FetchRFC822Size,
+		imapparser.FetchModSeq,
+		imapparser.FetchEnvelope,
+		imapparser.FetchBodyStructure,
+	} {
+		items = append(items, imapparser.FetchItem{Type: t})
+	}
+
+	c := &Conn{
+		server: &Server{Logf: b.Logf},
+		bw:     bufio.NewWriter(ioutil.Discard),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := getRespWriter()
+		for _, m := range msgs {
+			c.writeFetch(w, m, items)
+		}
+		w.release()
+	}
+}
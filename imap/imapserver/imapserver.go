@@ -5,11 +5,15 @@
 //
 // Supported extension RFCs:
 //	RFC 2177 IDLE
+//	RFC 2342 NAMESPACE
 //	RFC 2971 ID
+//	RFC 4314 ACL
 //	RFC 4315 UIDPLUS
 // 	RFC 4731 ESEARCH
+//	RFC 5032 WITHIN
 //	RFC 4978 COMPRESS=DEFLATE
 //	RFC 5161 ENABLE
+//	RFC 5182 SEARCHRES
 //	RFC 5258 LIST-EXTENDED
 //	RFC 6154 SPECIAL-USE
 //	RFC 7162 CONDSTORE
@@ -39,18 +43,18 @@ import (
 	"io/ioutil"
 	"math"
 	"net"
-	"path"
 	"runtime/debug"
 	"runtime/trace"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unicode/utf8"
 
 	"crawshaw.io/iox"
 	"spilled.ink/imap"
+	"spilled.ink/imap/imapformat"
 	"spilled.ink/imap/imapparser"
-	"spilled.ink/imap/imapparser/utf7mod"
+	"spilled.ink/util/otlptrace"
 )
 
 var ErrServerClosed = errors.New("imapserver: Server closed")
@@ -63,12 +67,59 @@ type Server struct {
 	Filer      *iox.Filer
 	Logf       func(format string, v ...interface{})
 	DataStore  DataStore
-	Debug      func(sessionID string) io.WriteCloser
+	Debug      func(sessionID string, userID int64) io.WriteCloser // see DebugCapture
 	Version    string
 	APNS       *APNS
 	NotifyAPNS bool
 
+	// Limits on logged in connections, so one user or one
+	// address cannot take all of MaxConns. They are checked
+	// at login. Zero values are replaced by defaults.
+	MaxConnsPerUser int // default 64
+	MaxConnsPerIP   int // default 256
+
+	// Connection timeouts. Zero values are replaced by defaults.
+	PreAuthTimeout time.Duration // idle before login, default 1 minute
+	IdleTimeout    time.Duration // idle after login, default 30 minutes
+	CommandTimeout time.Duration // reading one command, default 10 minutes
+	WriteTimeout   time.Duration // each write, default 1 minute
+
+	// Finding dead connections, see keepalive.go. Zero values
+	// are replaced by defaults, negative values disable.
+	KeepAlive     time.Duration // TCP keepalive period, default 2 minutes
+	IdleHeartbeat time.Duration // "* OK still here" during IDLE, default 5 minutes
+	AckTimeout    time.Duration // writes unacknowledged by the client, Linux only, default 2 minutes
+
+	// LiteralMemSize is how many bytes of a literal, such as an
+	// APPENDed message, are held in memory before the rest is
+	// written to a temporary file. Zero uses the Filer's default.
+	LiteralMemSize int
+
+	// UserFiler, if set, provides the Filer of a logged in user,
+	// so the temporary files holding the user's mail are kept in
+	// a directory of its own. Filer is used before login.
+	UserFiler func(userID int64) *iox.Filer
+
+	// CompressLevel is the flate level of COMPRESS responses,
+	// default flate.BestSpeed. See compress.go.
+	CompressLevel int
+
+	// Tracer, if set, exports a span for each command.
+	// The DataStore can start child spans from Conn.Context.
+	Tracer *otlptrace.Exporter
+
+	// SlowCommand, if set, is the latency past which a command
+	// is logged with its timing breakdown. See cmdstats.go.
+	SlowCommand time.Duration
+
 	capabilities string
+	starttls     bool  // connections start in cleartext, see ServeSTARTTLS
+	reaped       int64 // atomic, IDLE connections found dead
+
+	compressStats CompressStats // atomic
+
+	cmdStatsMu sync.Mutex
+	cmdStats   map[string]CommandStats // by command name
 
 	ln net.Listener
 
@@ -80,8 +131,32 @@ type Server struct {
 	connsCond *sync.Cond
 	conns     map[*Conn]struct{}
 	users     map[int64]*user // connsMu guards map access, value contents independent
+	ipConns   map[string]int  // logged in connections by remote IP
 }
 
+// ConnStats reports the connections of a Server.
+type ConnStats struct {
+	Conns     int            // open connections, logged in or not
+	UserConns map[int64]int  // logged in connections by user ID
+	IPConns   map[string]int // logged in connections by remote IP
+	Reaped    int64          // dead IDLE connections dropped since the server started
+	Compress  CompressStats  // since the server started
+
+	// Commands counts the commands served by name
+	// since the server started.
+	Commands map[string]CommandStats
+}
+
+// DataStore is the storage of the users and mail a Server serves.
+// Package imapmem has an implementation that keeps them in memory.
+//
+// A DataStore is used by many connections at once, so its methods
+// and those of the sessions and mailboxes it returns are called
+// concurrently. The Server assumes the mailboxes of one user are
+// shared by their sessions: what one session changes, the others
+// see. The Server tells the other sessions of changes made by IMAP
+// commands itself, changes made otherwise are reported by the
+// DataStore to the Notifier it is given.
 type DataStore interface {
 	// Login authenticates a user and creates a session for them.
 	//
@@ -92,6 +167,15 @@ type DataStore interface {
 	// never does, and is used to associate sessions together.
 	Login(c *Conn, username, password []byte) (userID int64, s imap.Session, err error)
 
+	// Namespaces reports the mailbox namespaces and hierarchy
+	// delimiter used by the mailbox names of every session.
+	Namespaces() imap.Namespaces
+
+	// RegisterNotifier is called once, before the Server accepts
+	// connections. The DataStore calls Notify when new mail arrives
+	// in a mailbox, and, as the Notifier implements
+	// imap.UpdateNotifier, reports flags changed and messages
+	// expunged other than by an IMAP command.
 	RegisterNotifier(imap.Notifier)
 }
 
@@ -101,43 +185,64 @@ type user struct {
 	conns  map[*Conn]struct{}
 }
 
+// connList reports the connections of u, so updates can be
+// queued on them without holding u.mu.
+func (u *user) connList() []*Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	conns := make([]*Conn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
 type notifier struct {
 	server *Server
 }
 
-func (n *notifier) Notify(userID int64, mailboxID int64, mailboxName string, devices []imapparser.ApplePushDevice) {
-	if n.server.APNS != nil && len(devices) > 0 {
-		go n.server.APNS.Notify(devices)
+func (n *notifier) Notify(userID int64, mailboxID int64, mailboxName string, devices imap.PushDevices) {
+	if n.server.APNS != nil && len(devices.Apple) > 0 {
+		go n.server.APNS.Notify(userID, devices.Apple)
 	}
 	user := n.server.getUser(userID)
+	for _, c := range user.connList() {
+		c.queueUpdate(mailboxID, idleUpdate{
+			typ:     idleTotalCount,
+			recount: true,
+		})
+	}
+}
 
-	var update *idleUpdate
+// NotifyFlags implements imap.UpdateNotifier.
+func (n *notifier) NotifyFlags(userID int64, mailboxID int64, uids []uint32) {
+	n.notifyUpdates(userID, mailboxID, idleFlags, uids)
+}
 
-	user.mu.Lock()
-	defer user.mu.Unlock()
-	for c := range user.conns {
-		c.bwMu.Lock()
-		if c.mailbox != nil && c.mailbox.ID() == mailboxID && c.idleStarted {
-			if update == nil {
-				info, err := c.mailbox.Info()
-				if err != nil {
-					c.log(logMsg{What: "notify mailbox info", Err: err})
-					return
-				}
-				update = &idleUpdate{
-					typ:   idleTotalCount,
-					value: info.NumMessages,
-				}
-			}
-			c.updates = append(c.updates, *update)
-			if c.idling {
-				c.writeUpdates()
-			}
+// NotifyExpunge implements imap.UpdateNotifier.
+func (n *notifier) NotifyExpunge(userID int64, mailboxID int64, seqNums []uint32) {
+	n.notifyUpdates(userID, mailboxID, idleExpunge, seqNums)
+}
+
+func (n *notifier) notifyUpdates(userID int64, mailboxID int64, typ idleUpdateType, values []uint32) {
+	user := n.server.getUser(userID)
+	for _, c := range user.connList() {
+		for _, v := range values {
+			c.queueUpdate(mailboxID, idleUpdate{
+				typ:   typ,
+				value: v,
+			})
 		}
-		c.bwMu.Unlock()
 	}
 }
 
+// Shutdown stops the server accepting new connections and waits
+// for the existing connections to end.
+//
+// Connections left open, such as clients in IDLE, are served until
+// ctx is done, when they are sent a BYE and closed. A long context
+// lets another process take over the listener while the clients of
+// this one drain.
 func (server *Server) Shutdown(ctx context.Context) error {
 	server.shutdownCtx = ctx
 	close(server.shutdown)
@@ -152,13 +257,59 @@ func (server *Server) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// ServeTLS serves IMAP on ln, starting a TLS handshake
+// on each connection.
 func (server *Server) ServeTLS(ln net.Listener) error {
+	return server.serve(ln)
+}
+
+// ServeSTARTTLS serves IMAP on ln in cleartext, as on port 143.
+// Clients must upgrade the connection with STARTTLS before
+// they can log in (RFC 3501 section 6.2.1).
+func (server *Server) ServeSTARTTLS(ln net.Listener) error {
+	server.starttls = true
+	return server.serve(ln)
+}
+
+func (server *Server) serve(ln net.Listener) error {
 	if server.Rand == nil {
 		server.Rand = rand.Reader
 	}
 	if server.MaxConns == 0 {
 		server.MaxConns = 1 << 14
 	}
+	if server.MaxConnsPerUser == 0 {
+		server.MaxConnsPerUser = 64
+	}
+	if server.MaxConnsPerIP == 0 {
+		server.MaxConnsPerIP = 256
+	}
+	if server.PreAuthTimeout == 0 {
+		server.PreAuthTimeout = 1 * time.Minute
+	}
+	if server.IdleTimeout == 0 {
+		// RFC 3501 section 5.4, an autologout timer
+		// must be at least 30 minutes.
+		server.IdleTimeout = 30 * time.Minute
+	}
+	if server.CommandTimeout == 0 {
+		server.CommandTimeout = 10 * time.Minute
+	}
+	if server.WriteTimeout == 0 {
+		server.WriteTimeout = 1 * time.Minute
+	}
+	if server.KeepAlive == 0 {
+		server.KeepAlive = 2 * time.Minute
+	}
+	if server.IdleHeartbeat == 0 {
+		server.IdleHeartbeat = 5 * time.Minute
+	}
+	if server.AckTimeout == 0 {
+		server.AckTimeout = 2 * time.Minute
+	}
+	if server.CompressLevel < flate.HuffmanOnly || server.CompressLevel > flate.BestCompression {
+		return fmt.Errorf("imapserver: bad CompressLevel %d", server.CompressLevel)
+	}
 
 	server.capabilities = capabilityAuth
 	if server.APNS != nil {
@@ -174,6 +325,7 @@ func (server *Server) ServeTLS(ln net.Listener) error {
 	server.connsCond = sync.NewCond(&server.connsMu)
 	server.conns = make(map[*Conn]struct{})
 	server.users = make(map[int64]*user)
+	server.ipConns = make(map[string]int)
 	server.connsMu.Unlock()
 
 	server.shutdown = make(chan struct{})
@@ -221,6 +373,7 @@ acceptLoop:
 		select {
 		case <-server.shutdownCtx.Done():
 			server.connsMu.Lock()
+			server.sayBye()
 			for c := range server.conns {
 				c.close()
 			}
@@ -245,6 +398,37 @@ acceptLoop:
 	}
 }
 
+// sayBye tells the remaining clients the server is closing
+// their connections, RFC 3501 section 7.1.5.
+//
+// A client that is in the middle of a command may never read
+// the response, so writes are given only a brief time to finish.
+// Called with connsMu held.
+func (server *Server) sayBye() {
+	const byeTimeout = 100 * time.Millisecond
+	var wg sync.WaitGroup
+	for c := range server.conns {
+		c.netConn.SetWriteDeadline(time.Now().Add(byeTimeout))
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.bwMu.Lock()
+			defer c.bwMu.Unlock()
+			c.writef("* BYE server shutting down\r\n")
+			c.flush()
+		}(c)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(byeTimeout):
+	}
+}
+
 func (server *Server) genSessionID() (string, error) {
 	idb := make([]byte, 10)
 	if _, err := io.ReadFull(server.Rand, idb); err != nil {
@@ -256,7 +440,11 @@ func (server *Server) genSessionID() (string, error) {
 func (server *Server) getUser(userID int64) *user {
 	server.connsMu.Lock()
 	defer server.connsMu.Unlock()
+	return server.getUserLocked(userID)
+}
 
+// getUserLocked is getUser called with connsMu held.
+func (server *Server) getUserLocked(userID int64) *user {
 	u := server.users[userID]
 	if u == nil {
 		u = &user{
@@ -267,6 +455,67 @@ func (server *Server) getUser(userID int64) *user {
 	return u
 }
 
+// addLogin records c as logged in as userID, unless the user or
+// the remote address of c is at its limit of connections.
+func (server *Server) addLogin(c *Conn, userID int64) error {
+	ip := remoteIP(c.RemoteAddr())
+
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+
+	if server.ipConns[ip] >= server.MaxConnsPerIP {
+		return fmt.Errorf("too many connections from %s", ip)
+	}
+	u := server.getUserLocked(userID)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.conns) >= server.MaxConnsPerUser {
+		return errors.New("too many connections for user")
+	}
+	u.conns[c] = struct{}{}
+	server.ipConns[ip]++
+	c.userID = userID
+	c.remoteIP = ip
+	return nil
+}
+
+// ConnStats reports the current connections.
+func (server *Server) ConnStats() ConnStats {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+
+	stats := ConnStats{
+		Conns:     len(server.conns),
+		UserConns: make(map[int64]int),
+		IPConns:   make(map[string]int, len(server.ipConns)),
+		Reaped:    atomic.LoadInt64(&server.reaped),
+		Compress:  server.compressStats.load(),
+		Commands:  server.commandStats(),
+	}
+	for userID, u := range server.users {
+		u.mu.Lock()
+		if n := len(u.conns); n > 0 {
+			stats.UserConns[userID] = n
+		}
+		u.mu.Unlock()
+	}
+	for ip, n := range server.ipConns {
+		stats.IPConns[ip] = n
+	}
+	return stats
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func (server *Server) serveSession(netConn net.Conn) {
 	sessionID, err := server.genSessionID()
 	if err != nil {
@@ -278,20 +527,27 @@ func (server *Server) serveSession(netConn net.Conn) {
 		return
 	}
 
-	netConn = tls.Server(netConn, server.TLSConfig)
+	server.setKeepAlive(netConn)
+	if !server.starttls {
+		netConn = tls.Server(netConn, server.TLSConfig)
+	}
+	netConn = &timeoutConn{
+		Conn:    netConn,
+		timeout: server.WriteTimeout,
+	}
 	c := &Conn{
-		ID:      sessionID,
-		server:  server,
-		netConn: netConn,
-		br:      bufio.NewReader(netConn),
-		bw:      bufio.NewWriter(netConn),
+		ID:          sessionID,
+		server:      server,
+		tls:         !server.starttls,
+		netConn:     netConn,
+		br:          bufio.NewReader(netConn),
+		bw:          bufio.NewWriter(netConn),
+		updateReady: make(chan struct{}, 1),
 	}
 
 	if server.Debug != nil {
-		c.debugFile = server.Debug(sessionID)
-		if c.debugFile != nil {
-			c.debugW = newDebugWriter(sessionID, server.Logf, c.debugFile)
-		}
+		c.debugW = newDebugWriter(sessionID, server.Logf, nil)
+		c.attachDebug()
 	}
 	c.initBufio(c.netConn, c.netConn)
 
@@ -309,17 +565,27 @@ type Conn struct {
 	Context context.Context
 	ID      string
 
-	userID    int64
-	session   imap.Session
-	mailbox   imap.Mailbox
-	readOnly  bool
-	condstore bool // client has send a CONDSTORE-related command
+	userID   int64
+	remoteIP string // of a logged in connection
+	session  imap.Session
+	mailbox  imap.Mailbox
+	readOnly bool
+	enabled  extension         // by ENABLE or a CONDSTORE-related command
+	clientID map[string]string // parameters of the last ID command
+
+	// savedResult holds the UIDs saved by SEARCH RETURN (SAVE),
+	// referred to as "$" by later commands (RFC 5182).
+	// As UIDs are never reused, expunged messages drop out of it.
+	savedResult []imapparser.SeqRange
 
 	debugFile io.WriteCloser
 	debugW    *debugWriter
 
 	server  *Server
+	filer   *iox.Filer      // Server.Filer, or the user's once logged in
+	litf    *iox.BufferFile // holds the literals of commands
 	netConn net.Conn
+	tls     bool // TLS from the start or after STARTTLS
 	br      *bufio.Reader
 	p       *imapparser.Parser
 
@@ -328,9 +594,67 @@ type Conn struct {
 	respondBuf    bytes.Buffer
 	compressing   bool // COMPRESS active
 	compressFlush func() error
-	idleStarted   bool // c.mailbox.Idle has been called
-	idling        bool // IDLE in progress
-	updates       []idleUpdate
+	compressClose func() error
+	compressStats CompressStats // atomic
+
+	// updatesMu guards the pending mailbox updates.
+	// Other connections of the user add updates without
+	// holding bwMu, so a connection busy with a long
+	// command does not hold up the others.
+	updatesMu       sync.Mutex
+	idleStarted     bool  // IDLE has been run on the selected mailbox
+	updatesBox      int64 // ID of the selected mailbox, if idleStarted
+	updates         []idleUpdate
+	updatesResync   bool          // flags updates were dropped, resend all flags
+	updatesOverflow bool          // more than maxPendingUpdates
+	updateReady     chan struct{} // signaled when an update is queued
+}
+
+// useUserFiler switches the temporary files of a
+// logged in connection to the Filer of its user.
+func (c *Conn) useUserFiler() {
+	if c.server.UserFiler == nil {
+		return
+	}
+	filer := c.server.UserFiler(c.userID)
+	if filer == nil {
+		return
+	}
+	c.litf.Close()
+	c.filer = filer
+	c.litf = filer.BufferFile(c.server.LiteralMemSize)
+	c.p.Scanner.Literal = c.litf
+	c.p.Command.Literal = c.litf
+}
+
+// maxPendingUpdates bounds the updates queued for a client
+// that is not reading them.
+//
+// Past it, the queued flags updates are dropped and the flags of
+// every message are sent once the client reads again. EXPUNGE
+// responses cannot be dropped, as each renumbers the messages, so
+// if they alone fill the queue the client is logged out.
+const maxPendingUpdates = 4096
+
+// timeoutConn sets a write deadline on each write.
+//
+// Responses are written through a fixed-size bufio.Writer,
+// so a client that stops reading blocks the command writing
+// to it, and after the timeout the connection is closed.
+//
+// It also counts the time spent writing, for the slow command log.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	spent   int64 // atomic, nanoseconds in Write
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	start := time.Now()
+	c.Conn.SetWriteDeadline(start.Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.spent, int64(time.Since(start)))
+	return n, err
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
@@ -341,7 +665,7 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 func (c *Conn) initBufio(r io.Reader, w io.Writer) {
-	if c.debugFile == nil {
+	if c.debugW == nil {
 		c.br = bufio.NewReader(r)
 		c.bw = bufio.NewWriter(w)
 	} else {
@@ -383,14 +707,27 @@ func (c *Conn) respondln(format string, v ...interface{}) {
 	}
 }
 
+// bye sends an untagged BYE, RFC 3501 section 7.1.5,
+// and closes the connection.
+func (c *Conn) bye(msg string) {
+	c.writef("* BYE %s\r\n", msg)
+	c.flush()
+	c.close()
+}
+
 func (c *Conn) close() {
 	c.closeMailbox()
-	if c.debugFile != nil {
+	if c.debugW != nil && c.debugW.capturing() {
 		c.flush()
 		io.CopyN(ioutil.Discard, c.br, int64(c.br.Buffered()))
 		c.netConn.SetReadDeadline(time.Now())
 		io.Copy(ioutil.Discard, c.br)
 	}
+	if c.compressClose != nil {
+		// End the deflate stream before TLS close_notify.
+		c.compressClose()
+		c.compressClose = nil
+	}
 	c.netConn.Close()
 }
 
@@ -399,67 +736,19 @@ func (c *Conn) writeStringBytes(s []byte) {
 }
 
 func (c *Conn) writeString(s string) {
-	if s == "" {
-		c.writef(`""`)
-		return
-	}
-
-	type strType int
-
-	const (
-		strLiteral strType = iota
-		strQuote
-		strAtom
-	)
-
-	strTypeVal := strAtom
-	sCheck := s
-	for len(sCheck) > 0 {
-		r, sz := utf8.DecodeRuneInString(sCheck)
-		sCheck = sCheck[sz:]
-		if r == utf8.RuneError || r == '\r' || r == '\n' {
-			strTypeVal = strLiteral
-			break
-		}
-		if r == '"' {
-			// TODO: is this necessary? is "\"" a valid quoted IMAP string?
-			strTypeVal = strLiteral
-			break
-		}
-		switch {
-		case 'A' <= r && r <= 'Z',
-			'a' <= r && r <= 'z',
-			'0' <= r && r <= '9',
-			r == '-', r == '_', r == '.':
-			// easily-allowable in an atom
-		default:
-			strTypeVal = strQuote
-		}
-	}
-
-	if strTypeVal == strAtom {
+	switch imapformat.TypeOf(s) {
+	case imapformat.Atom:
 		c.bw.WriteString(s)
-		return
-	}
-
-	b := make([]byte, 0, 128)
-	b, err := utf7mod.AppendEncode(b, []byte(s))
-	if err != nil {
-		panic(fmt.Sprintf("utf7: cannot encode string %q", s))
-	}
-
-	switch strTypeVal {
-	case strLiteral:
+	case imapformat.Literal:
+		b := imapformat.Encode(s)
 		c.writef("{%d}\r\n", len(s))
 		c.flush()
 		if c.debugW != nil {
 			c.debugW.server.literalDataFollows(len(s))
 		}
 		c.bw.Write(b)
-	case strQuote:
-		c.writef("%q", b)
 	default:
-		panic("invalid strTypeVal")
+		c.bw.Write(imapformat.AppendString(nil, s))
 	}
 }
 
@@ -478,67 +767,219 @@ func (c *Conn) writeLiteral(r io.Reader, n int64) {
 	}
 }
 
+// writeUpdates writes the pending mailbox updates.
+// Called with bwMu held.
 func (c *Conn) writeUpdates() {
-	// Remove out of date EXISTS messages.
-	countCount := 0
-	for _, update := range c.updates {
-		if update.typ == idleTotalCount {
-			countCount++
-		}
-	}
-	if countCount > 1 {
-		orig := c.updates
-		c.updates = c.updates[:0]
-		for _, update := range orig {
-			if update.typ == idleTotalCount && countCount > 1 {
-				countCount--
-				continue
-			}
-			c.updates = append(c.updates, update)
-		}
+	c.updatesMu.Lock()
+	updates := c.updates
+	resync := c.updatesResync
+	overflow := c.updatesOverflow
+	c.updates = nil
+	c.updatesResync = false
+	c.updatesOverflow = false
+	c.updatesMu.Unlock()
+
+	if overflow {
+		// The client's view of the mailbox is too far behind.
+		// The connection goroutine may be reading, so leave the
+		// rest of the clean up to it.
+		c.writef("* BYE too many mailbox updates\r\n")
+		c.flush()
+		c.netConn.Close()
+		return
 	}
-
-	// Write out updates.
-	for _, update := range c.updates {
+	if c.mailbox == nil {
+		return
+	}
+	for _, update := range updates {
 		switch update.typ {
 		case idleExpunge:
 			c.writef("* %d EXPUNGE\r\n", update.value)
 		case idleTotalCount:
-			c.writef("* %d EXISTS\r\n", update.value)
+			value := update.value
+			if update.recount {
+				info, err := c.mailbox.Status()
+				if err != nil {
+					c.log(logMsg{What: "notify mailbox info", Err: err})
+					continue
+				}
+				value = info.NumMessages
+			}
+			c.writef("* %d EXISTS\r\n", value)
+		case idleFlags:
+			c.writeFlagsUpdate(update.value, update.value)
+		case idleFlagChange:
+			c.writef("* %d FETCH (UID %d ", update.value, update.uid)
+			if c.isEnabled(extCondstore) {
+				c.writef("MODSEQ (%d) ", update.modSeq)
+			}
+			c.writeFlags(update.flags)
+			c.writef(")\r\n")
 		}
 	}
-	if len(c.updates) > 0 {
+	if resync {
+		c.writeFlagsUpdate(1, 0)
+	}
+	if len(updates) > 0 || resync {
 		c.flush()
-		c.updates = c.updates[:0]
 	}
 }
 
+// queueUpdate adds an update for the client if it is idling on
+// mailboxID. It does not wait for a command in progress on c.
+func (c *Conn) queueUpdate(mailboxID int64, update idleUpdate) {
+	c.updatesMu.Lock()
+	if !c.idleStarted || c.updatesBox != mailboxID {
+		c.updatesMu.Unlock()
+		return
+	}
+	if update.typ == idleTotalCount {
+		// Only the latest EXISTS is sent.
+		updates := c.updates[:0]
+		for _, u := range c.updates {
+			if u.typ != idleTotalCount {
+				updates = append(updates, u)
+			}
+		}
+		c.updates = updates
+	}
+	switch update.typ {
+	case idleFlags:
+		for _, u := range c.updates {
+			if u.typ == idleFlags && u.value == update.value {
+				c.updatesMu.Unlock()
+				return
+			}
+		}
+	case idleFlagChange:
+		// The latest flags of a message replace those queued
+		// before, which may have an out of date sequence number.
+		updates := c.updates[:0]
+		for _, u := range c.updates {
+			if u.typ != idleFlagChange || u.uid != update.uid {
+				updates = append(updates, u)
+			}
+		}
+		c.updates = updates
+	}
+	if len(c.updates) >= maxPendingUpdates {
+		c.dropFlagsUpdates()
+	}
+	switch {
+	case c.updatesOverflow:
+	case update.isFlags() && c.updatesResync:
+		// The flags of every message are sent.
+	case len(c.updates) >= maxPendingUpdates:
+		c.updates = nil
+		c.updatesResync = false
+		c.updatesOverflow = true
+	default:
+		c.updates = append(c.updates, update)
+	}
+	c.updatesMu.Unlock()
+
+	select {
+	case c.updateReady <- struct{}{}:
+	default:
+	}
+}
+
+// dropFlagsUpdates drops the queued flags updates, to be replaced
+// by the flags of every message. Called with updatesMu held.
+func (c *Conn) dropFlagsUpdates() {
+	updates := c.updates[:0]
+	for _, u := range c.updates {
+		if !u.isFlags() {
+			updates = append(updates, u)
+		}
+	}
+	if len(updates) < len(c.updates) {
+		c.updatesResync = true
+	}
+	c.updates = updates
+}
+
+// writeFlagsUpdate writes the flags of the messages with UIDs from
+// min to max, after they are changed other than by a command of c.
+// A max of zero is the last message. Called with bwMu held.
+func (c *Conn) writeFlagsUpdate(min, max uint32) {
+	seqs := []imapparser.SeqRange{{Min: min, Max: max}}
+	err := c.mailbox.Fetch(true, seqs, 0, func(m imap.Message) {
+		summary := m.Summary()
+		c.writef("* %d FETCH (UID %d ", summary.SeqNum, summary.UID)
+		if c.isEnabled(extCondstore) {
+			c.writef("MODSEQ (%d) ", summary.ModSeq)
+		}
+		c.writeFlags(m.Msg().Flags)
+		c.writef(")\r\n")
+	})
+	if err != nil {
+		c.log(logMsg{What: "notify flags", Err: err})
+	}
+}
+
+// writeFlags writes a FLAGS response item.
+func (c *Conn) writeFlags(flags []string) {
+	c.writef("FLAGS (")
+	for i, flag := range flags {
+		if i > 0 {
+			c.writef(" ")
+		}
+		if flag != "" && flag[0] == '\\' {
+			c.writef("%s", flag)
+		} else {
+			c.writeString(flag)
+		}
+	}
+	c.writef(")")
+}
+
+// startUpdates queues updates for mailboxID from now on.
+func (c *Conn) startUpdates(mailboxID int64) {
+	c.updatesMu.Lock()
+	if !c.idleStarted || c.updatesBox != mailboxID {
+		c.idleStarted = true
+		c.updatesBox = mailboxID
+		c.updates = nil
+		c.updatesResync = false
+		c.updatesOverflow = false
+	}
+	c.updatesMu.Unlock()
+}
+
+// stopUpdates drops pending updates and queues no more.
+func (c *Conn) stopUpdates() {
+	c.updatesMu.Lock()
+	c.idleStarted = false
+	c.updatesBox = 0
+	c.updates = nil
+	c.updatesResync = false
+	c.updatesOverflow = false
+	c.updatesMu.Unlock()
+}
+
 func (srcConn *Conn) sendIdleUpdate(mailboxID int64, update idleUpdate) {
 	srcConn.server.connsMu.Lock()
 	user := srcConn.server.users[srcConn.userID]
 	srcConn.server.connsMu.Unlock()
 
-	user.mu.Lock()
-	defer user.mu.Unlock()
-	for c := range user.conns {
-		if srcConn == c {
-			// already holding lock
-			if !update.skipSelf && c.mailbox != nil && c.mailbox.ID() == mailboxID && c.idleStarted {
-				c.updates = append(c.updates, update)
-			}
+	for _, c := range user.connList() {
+		if srcConn == c && update.skipSelf {
 			continue
 		}
+		c.queueUpdate(mailboxID, update)
+	}
+}
 
-		c.bwMu.Lock()
-		if c.mailbox != nil && c.mailbox.ID() == mailboxID && c.idleStarted {
-			c.updates = append(c.updates, update)
-			if c.idling {
-				// TODO: if we are going to do this here while holding
-				// user.mu, we need to be sure the write has a reasonable timeout.
-				c.writeUpdates()
-			}
-		}
-		c.bwMu.Unlock()
+// recordClientID passes the parameters of the ID command
+// to the session, if it records them.
+func (c *Conn) recordClientID() {
+	r, ok := c.session.(imap.ClientIDRecorder)
+	if !ok {
+		return
+	}
+	if err := r.RecordClientID(c.clientID); err != nil {
+		c.log(logMsg{What: "ID", Err: err})
 	}
 }
 
@@ -553,13 +994,26 @@ type idleUpdateType int
 const (
 	idleTotalCount idleUpdateType = iota + 1
 	idleExpunge
+	idleFlags      // value is a UID
+	idleFlagChange // value is a sequence number
 )
 
 // idleUpdate is a change in the Mailbox state.
 type idleUpdate struct {
 	typ      idleUpdateType
 	value    uint32
+	recount  bool // idleTotalCount read from the mailbox when written
 	skipSelf bool
+
+	// New flags of a message, for idleFlagChange.
+	uid    uint32
+	flags  []string
+	modSeq int64
+}
+
+// isFlags reports whether u is a change to the flags of a message.
+func (u idleUpdate) isFlags() bool {
+	return u.typ == idleFlags || u.typ == idleFlagChange
 }
 
 func (c *Conn) serve() {
@@ -577,6 +1031,9 @@ func (c *Conn) serve() {
 		cancel()
 
 		c.close()
+		if c.compressing {
+			c.log(logMsg{What: "COMPRESS", Data: c.compressStats.load().String()})
+		}
 		if c.debugFile != nil {
 			if err := c.debugFile.Close(); err != nil {
 				c.server.Logf("%s", logMsg{
@@ -594,6 +1051,9 @@ func (c *Conn) serve() {
 			u.mu.Lock()
 			delete(u.conns, c)
 			u.mu.Unlock()
+			if c.server.ipConns[c.remoteIP]--; c.server.ipConns[c.remoteIP] <= 0 {
+				delete(c.server.ipConns, c.remoteIP)
+			}
 		}
 		c.server.connsCond.Signal()
 		c.server.connsMu.Unlock()
@@ -607,8 +1067,9 @@ func (c *Conn) serve() {
 			panic(r)
 		}
 	}()
-	litf := c.server.Filer.BufferFile(0)
-	defer litf.Close()
+	c.filer = c.server.Filer
+	c.litf = c.filer.BufferFile(c.server.LiteralMemSize)
+	defer func() { c.litf.Close() }()
 
 	c.bwMu.Lock()
 	c.writef("* OK IMAP4 spilled.ink ready\r\n")
@@ -622,28 +1083,73 @@ func (c *Conn) serve() {
 		defer c.bwMu.Unlock()
 		c.writef(msg)
 		c.flush()
-
-		if c.debugW != nil {
-			c.debugW.client.literalDataFollows(int(len))
-		}
 	}
 
 	c.p = &imapparser.Parser{
-		Scanner: imapparser.NewScanner(c.br, litf, contFn),
+		Scanner:   imapparser.NewScanner(c.br, c.litf, contFn),
+		Delimiter: c.server.DataStore.Namespaces().Delimiter,
 	}
 
+	// Commands are read and run one at a time, so a client
+	// pipelining commands has one in flight. The rest wait in
+	// the fixed-size read buffer and the socket, and a client
+	// that does not read its responses is cut off by WriteTimeout.
 	for {
-		c.br.Peek(1) // block until the client sends something
+		if !c.waitCmd() {
+			break
+		}
 		if !c.serveParseCmd() {
 			break
 		}
+		c.attachDebug()
 	}
 }
 
+// waitCmd blocks until the client sends something.
+// It reports false if the connection is closed or the
+// client is idle for too long.
+//
+// Once the client starts a command it has CommandTimeout
+// to send all of it, so a slow client cannot hold a
+// connection open sending a byte at a time.
+func (c *Conn) waitCmd() bool {
+	idleTimeout := c.server.IdleTimeout
+	cmdTimeout := c.server.CommandTimeout
+	if c.p.Mode == imapparser.ModeNonAuth {
+		idleTimeout = c.server.PreAuthTimeout
+		if cmdTimeout > idleTimeout {
+			cmdTimeout = idleTimeout
+		}
+	}
+
+	c.netConn.SetReadDeadline(time.Now().Add(idleTimeout))
+	if _, err := c.br.Peek(1); err != nil {
+		if isTimeout(err) {
+			c.bwMu.Lock()
+			c.bye("Autologout; idle for too long")
+			c.bwMu.Unlock()
+		}
+		return false
+	}
+	c.netConn.SetReadDeadline(time.Now().Add(cmdTimeout))
+	return true
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	if te, isTagged := err.(imapparser.TaggedError); isTagged {
+		err = te.Err
+	}
+	ne, _ := err.(net.Error)
+	return ne != nil && ne.Timeout()
+}
+
 const (
-	capability     = `IMAP4rev1 AUTH=PLAIN ENABLE ID`
-	capabilityAuth = `IMAP4rev1 COMPRESS=DEFLATE CONDSTORE ENABLE ` +
-		`ESEARCH ID IDLE LIST-EXTENDED MOVE SPECIAL-USE UIDPLUS`
+	capabilityNoTLS = `IMAP4rev1 STARTTLS LOGINDISABLED ENABLE ID`
+	capability      = `IMAP4rev1 AUTH=PLAIN ENABLE ID`
+	capabilityAuth  = `IMAP4rev1 ACL COMPRESS=DEFLATE CONDSTORE ENABLE ` +
+		`ESEARCH ID IDLE LIST-EXTENDED MOVE NAMESPACE RIGHTS=kxte SEARCHRES ` +
+		`SPECIAL-USE UIDPLUS WITHIN X-ATTACHMENT-SEARCH`
 )
 
 func (c *Conn) serveParseCmd() bool {
@@ -658,13 +1164,26 @@ func (c *Conn) serveParseCmd() bool {
 
 	trace.Log(c.Context, "session-id", c.ID)
 
-	if err := c.p.ParseCommand(); err == io.EOF {
+	err := c.p.ParseCommand()
+	var timing cmdTiming
+	timing.parse = time.Since(start)
+	if isTimeout(err) {
+		c.bwMu.Lock()
+		c.bye("command timed out")
+		c.bwMu.Unlock()
+		return false
+	} else if err == io.EOF {
 		return false
 	} else if ne, _ := err.(net.Error); ne != nil {
 		return false
 	} else if te, isTagged := err.(imapparser.TaggedError); isTagged {
 		c.bwMu.Lock()
-		fmt.Fprintf(c.bw, "%s BAD %v\r\n", te.Tag, te.Err)
+		if _, isBadCharset := te.Err.(imapparser.BadCharsetError); isBadCharset {
+			fmt.Fprintf(c.bw, "%s NO [BADCHARSET (%s)] %v\r\n", te.Tag,
+				strings.Join(imapparser.SearchCharsets, " "), te.Err)
+		} else {
+			fmt.Fprintf(c.bw, "%s BAD %v\r\n", te.Tag, te.Err)
+		}
 		c.flush()
 		c.bwMu.Unlock()
 		return true
@@ -694,15 +1213,45 @@ func (c *Conn) serveParseCmd() bool {
 		return false
 	}
 	trace.Logf(c.Context, "imap-request-cmd", "%v", c.p.Command)
-	// TODO: for long-lived connections we want a very long (possibly infinite)
-	//       read deadline. However we could (and should?) have a short write deadline.
+	ctx, span := c.server.Tracer.Start(c.Context, "imap "+c.p.Command.Name)
+	c.Context = ctx
+	span.SetAttr("imap.session_id", c.ID)
+	span.SetAttr("imap.command", c.p.Command.Name)
+	if len(c.p.Command.Mailbox) > 0 {
+		span.SetAttr("imap.mailbox", string(c.p.Command.Mailbox))
+	}
+	times := new(CmdTimes)
+	c.Context = context.WithValue(c.Context, cmdTimesKey{}, times)
+	written := c.writeTime()
 	response := c.serveCmd()
+	duration := time.Since(start)
+	if c.userID != 0 {
+		span.SetAttr("spilld.user_id", c.userID)
+	}
+	if i := strings.IndexByte(response, ' '); i > 0 {
+		span.SetAttr("imap.status", response[:i])
+		if status := response[:i]; status == "NO" || status == "BAD" {
+			span.SetError(errors.New(response))
+		}
+	}
+	span.End()
 	c.log(logMsg{
 		What:     c.p.Command.Name,
 		When:     start,
-		Duration: time.Since(start),
+		Duration: duration,
 		Data:     response,
 	})
+	if c.server.countCommand(c.p.Command.Name, duration) {
+		timing.dbWait, timing.dbExec = times.db()
+		timing.write = c.writeTime() - written
+		c.log(logMsg{
+			What:     "slow command",
+			When:     start,
+			Duration: duration,
+			Cmd:      c.p.Command.Summary(),
+			Data:     timing.String(),
+		})
+	}
 	return true
 }
 
@@ -714,9 +1263,14 @@ func (c *Conn) serveCmd() string {
 	c.writeUpdates()
 
 	cmd := &c.p.Command
+	if c.mailbox != nil && c.resolveSavedResult() {
+		return c.respondBuf.String()
+	}
 	switch cmd.Name {
 	case "CAPABILITY":
-		if c.p.Mode == imapparser.ModeNonAuth {
+		if !c.tls {
+			c.writef("* CAPABILITY %s\r\n", capabilityNoTLS)
+		} else if c.p.Mode == imapparser.ModeNonAuth {
 			c.writef("* CAPABILITY %s\r\n", capability)
 		} else {
 			c.writef("* CAPABILITY %s\r\n", c.server.capabilities)
@@ -728,13 +1282,8 @@ func (c *Conn) serveCmd() string {
 			c.respondln("NO [COMPRESSIONACTIVE] DEFLATE active")
 			return c.respondBuf.String()
 		}
-		c.compressing = true
-
 		c.respondln("OK DEFLATE active")
-		r := flate.NewReader(c.netConn)
-		w, _ := flate.NewWriter(c.netConn, 1)
-		c.compressFlush = w.Flush
-		c.initBufio(r, w)
+		c.startCompress()
 
 	case "LOGOUT":
 		c.writef("* BYE\r\n%s OK Completed\r\n", cmd.Tag)
@@ -749,6 +1298,10 @@ func (c *Conn) serveCmd() string {
 			c.respondln("BAD wrong mode")
 			return c.respondBuf.String()
 		}
+		if !c.tls {
+			c.respondln("NO [PRIVACYREQUIRED] STARTTLS required") // RFC 5530
+			return c.respondBuf.String()
+		}
 		userID, session, err := c.server.DataStore.Login(c, cmd.Auth.Username, cmd.Auth.Password)
 		if err == ErrBadCredentials {
 			c.respondln("NO bad credenttials")
@@ -758,29 +1311,49 @@ func (c *Conn) serveCmd() string {
 			return c.respondBuf.String()
 		}
 		trace.Logf(c.Context, "username", "%s", cmd.Auth.Username)
+		if err := c.server.addLogin(c, userID); err != nil {
+			session.Close()
+			c.log(logMsg{What: "login limit", Data: fmt.Sprintf("user %d", userID), Err: err})
+			c.respondln("NO [LIMIT] %v", err) // RFC 5530
+			return c.respondBuf.String()
+		}
 		c.p.Mode = imapparser.ModeAuth
-		c.userID = userID
 		c.session = session
-
-		u := c.server.getUser(userID)
-
-		u.mu.Lock()
-		u.conns[c] = struct{}{}
-		u.mu.Unlock()
+		c.useUserFiler()
+		if c.clientID != nil {
+			c.recordClientID()
+		}
 
 		c.respondln("OK [CAPABILITY %s] logged in", c.server.capabilities)
 
 	case "STARTTLS":
-		c.respondln("BAD already using TLS")
+		if c.tls {
+			c.respondln("BAD already using TLS")
+			return c.respondBuf.String()
+		}
+		if c.compressing {
+			c.respondln("BAD STARTTLS after COMPRESS")
+			return c.respondBuf.String()
+		}
+		c.respondln("OK begin TLS negotiation now")
+		if err := c.flush(); err != nil {
+			c.close()
+			return c.respondBuf.String()
+		}
+		// Anything the client pipelined after STARTTLS was sent
+		// in cleartext. It is dropped with the old read buffer.
+		oldConn := c.netConn.(*timeoutConn)
+		c.netConn = &timeoutConn{
+			Conn:    tls.Server(oldConn.Conn, c.server.TLSConfig),
+			timeout: c.server.WriteTimeout,
+			spent:   atomic.LoadInt64(&oldConn.spent),
+		}
+		c.tls = true
+		c.initBufio(c.netConn, c.netConn)
 	case "APPEND":
 		c.cmdAppend()
 	case "CREATE":
-		// TODO AttrListFlag
-		if err := c.session.CreateMailbox(c.p.Command.Mailbox, 0); err != nil {
-			c.respondln("NO DELETE failed %v", err)
-		} else {
-			c.respondln("OK DELETE completed")
-		}
+		c.cmdCreate()
 	case "DELETE":
 		if err := c.session.DeleteMailbox(c.p.Command.Mailbox); err != nil {
 			c.respondln("NO DELETE failed %v", err)
@@ -788,7 +1361,7 @@ func (c *Conn) serveCmd() string {
 			c.respondln("OK DELETE completed")
 		}
 	case "ENABLE":
-		c.respondln("OK completed")
+		c.cmdEnable()
 	case "EXAMINE":
 		c.cmdSelect()
 	case "ID":
@@ -804,23 +1377,73 @@ func (c *Conn) serveCmd() string {
 			ID:   c.ID,
 			Data: buf.String(),
 		})
+		c.clientID = make(map[string]string)
+		for i := 0; i+1 < len(c.p.Command.Params); i += 2 {
+			if v := c.p.Command.Params[i+1]; v != nil {
+				c.clientID[strings.ToLower(string(c.p.Command.Params[i]))] = string(v)
+			}
+		}
+		if c.session != nil {
+			c.recordClientID()
+		}
 		c.writef(`* ID ("name" "spilld" "vendor" "Spilled Ink"`)
 		c.writef(` "support-url" "https://github.com/spilledink"`)
 		c.writef(` "version" %q`, c.server.Version)
 		c.writef(")\r\n")
 		c.respondln("OK success")
 	case "IDLE":
-		c.idleStarted = true
-		c.idling = true
 		if c.mailbox != nil {
+			c.startUpdates(c.mailbox.ID())
 			c.writeUpdates()
 		}
 
+		// While the client idles, updates are written as they
+		// are queued, between the writes of other goroutines.
 		c.bwMu.Unlock()
+		idleDone := make(chan struct{})
+		writerDone := make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			var heartbeat <-chan time.Time
+			if c.server.IdleHeartbeat > 0 {
+				t := time.NewTicker(c.server.IdleHeartbeat)
+				defer t.Stop()
+				heartbeat = t.C
+			}
+			for {
+				select {
+				case <-c.updateReady:
+					c.bwMu.Lock()
+					c.writeUpdates()
+					c.bwMu.Unlock()
+				case <-heartbeat:
+					c.bwMu.Lock()
+					c.writef("* OK still here\r\n")
+					err := c.flush()
+					c.bwMu.Unlock()
+					if err != nil {
+						// Ends the read below.
+						c.netConn.Close()
+						return
+					}
+				case <-idleDone:
+					return
+				}
+			}
+		}()
+		c.netConn.SetReadDeadline(time.Now().Add(c.server.IdleTimeout))
 		sl, err := c.br.ReadSlice('\n')
+		close(idleDone)
+		<-writerDone
 		c.bwMu.Lock()
 
-		if err != nil {
+		if isReaped(err) {
+			atomic.AddInt64(&c.server.reaped, 1)
+			c.log(logMsg{What: "IDLE reaped", Err: err})
+			c.close()
+		} else if isTimeout(err) {
+			c.bye("Autologout; idle for too long")
+		} else if err != nil {
 			c.respondln("BAD IDLE terminated: %v", err)
 		} else {
 			if strings.EqualFold(string(sl), "DONE\r\n") {
@@ -829,10 +1452,10 @@ func (c *Conn) serveCmd() string {
 				c.respondln("BAD IDLE terminated: unrecognized response: %q", string(sl))
 			}
 		}
-
-		c.idling = false
 	case "LIST", "LSUB":
 		c.cmdList()
+	case "NAMESPACE":
+		c.cmdNamespace()
 	case "RENAME":
 		old, new := c.p.Command.Rename.OldMailbox, c.p.Command.Rename.NewMailbox
 		if err := c.session.RenameMailbox(old, new); err != nil {
@@ -885,6 +1508,8 @@ func (c *Conn) serveCmd() string {
 		c.cmdStore()
 	case "SEARCH":
 		c.cmdSearch()
+	case "SETACL", "DELETEACL", "GETACL", "LISTRIGHTS", "MYRIGHTS":
+		c.cmdACL()
 	case "XAPPLEPUSHSERVICE":
 		c.cmdXApplePushService()
 	}
@@ -901,10 +1526,62 @@ func (c *Conn) closeMailbox() {
 	}
 	c.readOnly = false
 	c.mailbox = nil
+	c.savedResult = nil
 	c.p.Mode = imapparser.ModeAuth
-	c.updates = c.updates[:0]
-	c.idling = false
-	c.idleStarted = false
+	c.stopUpdates()
+}
+
+// resolveSavedResult replaces the sequence-set "$" in the command
+// with the saved search result. It reports whether it responded to
+// the command, which happens when there are no messages to act on.
+func (c *Conn) resolveSavedResult() (responded bool) {
+	cmd := &c.p.Command
+	if cmd.Name == "SEARCH" {
+		replaceSavedOp(cmd.Search.Op, c.savedResult)
+		return false
+	}
+	if !imapparser.IsSeqSaved(cmd.Sequences) {
+		return false
+	}
+	if cmd.UID {
+		cmd.Sequences = append(cmd.Sequences[:0], c.savedResult...)
+	} else {
+		var seqs []imapparser.SeqRange
+		op := &imapparser.SearchOp{Key: "UID", Sequences: c.savedResult}
+		err := c.mailbox.Search(op, func(data imap.MessageSummary) {
+			seqs = imapparser.AppendSeqRange(seqs, data.SeqNum)
+		})
+		if err != nil {
+			c.respondln("NO %s error: %v", cmd.Name, err)
+			return true
+		}
+		cmd.Sequences = seqs
+	}
+	if len(cmd.Sequences) == 0 {
+		// An empty "$" is not an error, RFC 5182 section 2.1.
+		// Respond here as an empty UID EXPUNGE would expunge
+		// every deleted message.
+		c.respondln("OK %s completed, no messages", cmd.Name)
+		return true
+	}
+	return false
+}
+
+// replaceSavedOp replaces "$" in the search op with the saved UIDs.
+func replaceSavedOp(op *imapparser.SearchOp, saved []imapparser.SeqRange) {
+	if op == nil {
+		return
+	}
+	switch op.Key {
+	case "SEQSET", "UID":
+		if imapparser.IsSeqSaved(op.Sequences) {
+			op.Key = "UID"
+			op.Sequences = saved
+		}
+	}
+	for i := range op.Children {
+		replaceSavedOp(&op.Children[i], saved)
+	}
 }
 
 func (c *Conn) cmdAppend() {
@@ -936,7 +1613,10 @@ func (c *Conn) cmdAppend() {
 	}
 
 	uid, err := mailbox.Append(cmd.Append.Flags, date, cmd.Literal)
-	if err != nil {
+	if err == imap.ErrTooManyKeywords {
+		c.respondln("NO [LIMIT] APPEND %v", err)
+		return
+	} else if err != nil {
 		c.respondln("NO APPEND %v", err)
 		return
 	}
@@ -985,8 +1665,11 @@ func (c *Conn) cmdExpunge() {
 
 func (c *Conn) cmdList() {
 	cmd := &c.p.Command
+	delim := c.server.DataStore.Namespaces().Delimiter
 	if len(cmd.List.ReferenceName) == 0 && len(cmd.List.MailboxGlob) == 0 {
-		c.writef(`* %s (\Noselect) "/" ""`+"\r\n", cmd.Name)
+		c.writef(`* %s (\Noselect) `, cmd.Name)
+		c.writeDelimiter(delim)
+		c.writef(` ""`+"\r\n")
 		c.respondln("OK Success")
 		return
 	}
@@ -1026,7 +1709,9 @@ func (c *Conn) cmdList() {
 	}
 	hasKids := make(map[string]bool)
 	for _, s := range list {
-		hasKids[path.Dir(s.Name)] = true
+		for _, parent := range imap.MailboxParents(s.Name, delim) {
+			hasKids[parent] = true
+		}
 	}
 
 	for _, s := range list {
@@ -1042,13 +1727,73 @@ func (c *Conn) cmdList() {
 		if extAttr != "" {
 			spacer = " "
 		}
-		c.writef("* %s (%s%s%s) \"/\" ", cmd.Name, kidFlag, spacer, extAttr)
+		c.writef("* %s (%s%s%s) ", cmd.Name, kidFlag, spacer, extAttr)
+		c.writeDelimiter(delim)
+		c.writef(" ")
 		c.writeString(s.Name)
 		c.writef("\r\n")
 	}
 	c.respondln("OK Success")
 }
 
+// cmdCreate creates a mailbox. The session creates any missing
+// superior names of the mailbox, RFC 3501 section 6.3.3.
+func (c *Conn) cmdCreate() {
+	// TODO AttrListFlag
+	delim := c.server.DataStore.Namespaces().Delimiter
+	name, err := imap.CleanMailboxName(string(c.p.Command.Mailbox), delim)
+	if err != nil {
+		c.respondln("NO CREATE failed %v", err)
+		return
+	}
+	if err := c.session.CreateMailbox([]byte(name), 0); err != nil {
+		c.respondln("NO CREATE failed %v", err)
+		return
+	}
+	c.respondln("OK CREATE completed")
+}
+
+func (c *Conn) cmdNamespace() {
+	ns := c.server.DataStore.Namespaces()
+	c.writef("* NAMESPACE ")
+	c.writeNamespace(ns.Personal, ns.Delimiter)
+	c.writef(" ")
+	c.writeNamespace(ns.Other, ns.Delimiter)
+	c.writef(" ")
+	c.writeNamespace(ns.Shared, ns.Delimiter)
+	c.writef("\r\n")
+	c.respondln("OK NAMESPACE completed")
+}
+
+func (c *Conn) writeNamespace(prefixes []string, delim byte) {
+	if len(prefixes) == 0 {
+		c.writef("NIL")
+		return
+	}
+	c.writef("(")
+	for _, prefix := range prefixes {
+		c.writef("(")
+		c.writeString(prefix)
+		c.writef(" ")
+		c.writeDelimiter(delim)
+		c.writef(")")
+	}
+	c.writef(")")
+}
+
+// writeDelimiter writes a hierarchy delimiter as a quoted string,
+// or NIL if there is no hierarchy.
+func (c *Conn) writeDelimiter(delim byte) {
+	switch delim {
+	case 0:
+		c.writef("NIL")
+	case '"', '\\':
+		c.writef(`"\\%c"`, delim)
+	default:
+		c.writef(`"%c"`, delim)
+	}
+}
+
 func (c *Conn) cmdSelect() {
 	cmd := &c.p.Command
 
@@ -1056,6 +1801,14 @@ func (c *Conn) cmdSelect() {
 
 	var err error
 	c.readOnly = cmd.Name == "EXAMINE"
+	if !c.readOnly {
+		// RFC 4314 section 4: without a right that changes the
+		// mailbox, SELECT opens it read-only.
+		rights, err := c.session.MyRights(cmd.Mailbox)
+		if err == nil && rights&(imap.RightSeen|imap.RightWrite|imap.RightInsert|imap.RightDeleteMsg|imap.RightExpunge) == 0 {
+			c.readOnly = true
+		}
+	}
 	c.mailbox, err = c.session.Mailbox(cmd.Mailbox)
 	if err != nil {
 		c.p.Mode = imapparser.ModeAuth
@@ -1080,11 +1833,25 @@ func (c *Conn) cmdSelect() {
 
 	c.writef("* %d EXISTS\r\n", info.NumMessages)
 	c.writef("* %d RECENT\r\n", info.NumRecent)
-	c.writef(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen)` + "\r\n")
+	c.writef(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen`)
+	for _, keyword := range info.Keywords {
+		c.writef(" ")
+		c.writeString(keyword)
+	}
+	c.writef(")\r\n")
 	if c.readOnly {
 		c.writef(`* OK [PERMANENTFLAGS ()] No permanent flags permitted` + "\r\n")
 	} else {
-		c.writef(`* OK [PERMANENTFLAGS (\Answered \Flagged \Draft \Deleted \Seen)] Ok` + "\r\n")
+		c.writef(`* OK [PERMANENTFLAGS (\Answered \Flagged \Draft \Deleted \Seen`)
+		for _, keyword := range info.Keywords {
+			c.writef(" ")
+			c.writeString(keyword)
+		}
+		if info.KeywordsFull {
+			c.writef(`)] Ok` + "\r\n")
+		} else {
+			c.writef(` \*)] Ok` + "\r\n")
+		}
 	}
 	c.writef("* OK [HIGHESTMODSEQ %d]\r\n", info.HighestModSequence)
 	if info.FirstUnseenSeqNum > 0 {
@@ -1094,10 +1861,10 @@ func (c *Conn) cmdSelect() {
 	c.writef("* OK [UIDNEXT %d]\r\n", info.UIDNext)
 
 	if cmd.Condstore {
-		c.condstore = true
+		c.enabled |= extCondstore
 	}
 	store := ""
-	if c.condstore {
+	if c.isEnabled(extCondstore) {
 		store = ", CONDSTORE enabled"
 	}
 	if c.readOnly {
@@ -1115,7 +1882,7 @@ func (c *Conn) cmdStatus() {
 		c.respondln("BAD STATUS %v", err)
 		return
 	}
-	info, err := mailbox.Info()
+	info, err := mailbox.Status()
 	if err != nil {
 		c.respondln("BAD STATUS %v", err)
 		return
@@ -1231,10 +1998,10 @@ func (c *Conn) cmdCopyOrMove() {
 }
 
 func (c *Conn) setCondStore() {
-	if c.condstore {
+	if c.isEnabled(extCondstore) {
 		return
 	}
-	c.condstore = true
+	c.enabled |= extCondstore
 	modSeq, err := c.mailbox.HighestModSequence()
 	if err != nil {
 		c.server.Logf("%s", logMsg{
@@ -1253,7 +2020,10 @@ func (c *Conn) cmdStore() {
 	// TODO: if UnchangedSince == 0 but was set, always fail. Do in imapparser?
 
 	res, err := c.mailbox.Store(cmd.UID, cmd.Sequences, &cmd.Store)
-	if err != nil {
+	if err == imap.ErrTooManyKeywords {
+		c.respondln("NO [LIMIT] STORE %v", err)
+		return
+	} else if err != nil {
 		c.respondln("NO STORE %v", err)
 		return
 	}
@@ -1263,6 +2033,14 @@ func (c *Conn) cmdStore() {
 	}
 
 	for _, stored := range res.Stored {
+		c.sendIdleUpdate(c.mailbox.ID(), idleUpdate{
+			typ:      idleFlagChange,
+			value:    stored.SeqNum,
+			skipSelf: true,
+			uid:      stored.UID,
+			flags:    stored.Flags,
+			modSeq:   stored.ModSequence,
+		})
 		if cmd.Store.UnchangedSince == 0 && cmd.Store.Silent {
 			continue
 		}
@@ -1272,7 +2050,7 @@ func (c *Conn) cmdStore() {
 			needSpace = true
 			c.writef("UID %d", stored.UID)
 		}
-		if c.condstore {
+		if c.isEnabled(extCondstore) {
 			// Always return the MODSEQ value if we have entered CONDSTORE mode.
 			// See RFC 7162 Section 3.1.4.2.
 			if needSpace {
@@ -1285,18 +2063,7 @@ func (c *Conn) cmdStore() {
 			if needSpace {
 				c.writef(" ")
 			}
-			c.writef("FLAGS (")
-			for i, flag := range stored.Flags {
-				if i > 0 {
-					c.writef(" ")
-				}
-				if flag != "" && flag[0] == '\\' {
-					c.writef("%s", flag)
-				} else {
-					c.writeString(flag)
-				}
-			}
-			c.writef(")")
+			c.writeFlags(stored.Flags)
 		}
 		c.writef(")\r\n")
 	}
@@ -1331,47 +2098,72 @@ func hasModSeqOp(op *imapparser.SearchOp) bool {
 func (c *Conn) cmdSearch() {
 	cmd := &c.p.Command
 
+	var min, max, count, all, save bool // write parameters in a fixed order
+	for _, v := range cmd.Search.Return {
+		switch v {
+		case "MIN":
+			min = true
+		case "MAX":
+			max = true
+		case "COUNT":
+			count = true
+		case "ALL":
+			all = true
+		case "SAVE":
+			save = true
+		}
+	}
+
 	var maxModSeq, minResultModSeq, maxResultModSeq int64
 	var minResult, maxResult uint32 = math.MaxUint32, 0
+	var minUID, maxUID uint32
 	var results []uint32
+	var uids []imapparser.SeqRange
 	err := c.mailbox.Search(cmd.Search.Op, func(data imap.MessageSummary) {
 		num := data.UID
 		if !cmd.UID {
 			num = data.SeqNum
 		}
 		results = append(results, num)
+		if save {
+			uids = imapparser.AppendSeqRange(uids, data.UID)
+		}
 		if data.ModSeq > maxModSeq {
 			maxModSeq = data.ModSeq
 		}
 		if num < minResult {
 			minResult = num
 			minResultModSeq = data.ModSeq
+			minUID = data.UID
 		}
 		if num > maxResult {
 			maxResult = num
 			maxResultModSeq = data.ModSeq
+			maxUID = data.UID
 		}
 	})
 	if err != nil {
+		if save {
+			c.savedResult = nil // RFC 5182 section 2.1
+		}
 		c.respondln("BAD SEARCH error: %v", err)
 		return
 	}
-	if len(cmd.Search.Return) > 0 {
-		c.writef("* ESEARCH (TAG %q)", cmd.Tag) // RFC 4731
-
-		var min, max, count, all bool // write parameters in a fixed order
-		for _, v := range cmd.Search.Return {
-			switch v {
-			case "MIN":
-				min = true
-			case "MAX":
-				max = true
-			case "COUNT":
-				count = true
-			case "ALL":
-				all = true
+	if save {
+		if (min || max) && !all && !count {
+			// RFC 5182 section 2.4: save only what is returned.
+			uids = nil
+			if min && len(results) > 0 {
+				uids = imapparser.AppendSeqRange(uids, minUID)
+			}
+			if max && len(results) > 0 && maxUID != minUID {
+				uids = imapparser.AppendSeqRange(uids, maxUID)
 			}
 		}
+		c.savedResult = uids
+	}
+	if min || max || count || all {
+		c.writef("* ESEARCH (TAG %q)", cmd.Tag) // RFC 4731
 
 		if count {
 			c.writef(" COUNT %d", len(results))
@@ -1410,7 +2202,8 @@ func (c *Conn) cmdSearch() {
 			}
 		}
 		c.writef("\r\n")
-	} else if len(results) > 0 {
+	} else if len(cmd.Search.Return) == 0 && len(results) > 0 {
+		// Not RETURN (SAVE), which has no untagged response.
 		c.writef("* SEARCH")
 		for _, id := range results {
 			c.writef(" %d", id)
@@ -1440,6 +2233,6 @@ func (c *Conn) cmdXApplePushService() {
 			return
 		}
 	}
-	c.writef("* XAPPLEPUSHSERVICE aps-version \"2\" aps-topic %q\r\n", c.server.APNS.UID)
+	c.writef("* XAPPLEPUSHSERVICE aps-version \"2\" aps-topic %q\r\n", c.server.APNS.Topic())
 	c.respondln("OK XAPPLEPUSHSERVICE Registration success.")
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"crawshaw.io/iox"
+	"spilled.ink/imap/imapmem"
 	"spilled.ink/imap/imaptest"
 )
 
@@ -24,7 +25,7 @@ func Test(t *testing.T) {
 			test := test
 			t.Run(test.Name, func(t *testing.T) {
 				t.Parallel()
-				dataStore := &imaptest.MemoryStore{
+				dataStore := &imapmem.Store{
 					Filer: filer,
 				}
 				server, err := imaptest.InitTestServer(filer, dataStore, dataStore)
@@ -0,0 +1,46 @@
+package imapserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// Phones on flaky networks leave IDLE connections open long after
+// they are gone, each counting against MaxConns. Three things find
+// them: TCP keepalive probes the connection when nothing is sent,
+// IdleHeartbeat makes sure something is sent to a client in IDLE,
+// and AckTimeout has the kernel drop a connection whose writes the
+// client does not acknowledge. A connection dropped while in IDLE
+// is counted in ConnStats.Reaped.
+
+// setKeepAlive configures TCP keepalive and the acknowledgement
+// timeout of a new connection.
+func (server *Server) setKeepAlive(netConn net.Conn) {
+	tc, ok := netConn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if server.KeepAlive > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(server.KeepAlive)
+	} else {
+		tc.SetKeepAlive(false)
+	}
+	if server.AckTimeout > 0 {
+		if err := setAckTimeout(tc, server.AckTimeout); err != nil {
+			server.Logf("%s", logMsg{
+				What: "ack timeout",
+				Err:  err,
+			}.String())
+		}
+	}
+}
+
+// isReaped reports whether err, from reading a connection in IDLE,
+// means the connection is dead: the client did not close it and
+// the IdleTimeout deadline did not pass.
+func isReaped(err error) bool {
+	return err != nil && err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded)
+}
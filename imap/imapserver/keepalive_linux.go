@@ -0,0 +1,27 @@
+package imapserver
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+const tcpUserTimeout = 0x12 // TCP_USER_TIMEOUT from linux/tcp.h
+
+// setAckTimeout sets how long data written to tc may go
+// unacknowledged before the kernel closes the connection.
+func setAckTimeout(tc *net.TCPConn, d time.Duration) error {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		ms := int(d / time.Millisecond)
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, ms)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package imapserver
+
+import (
+	"net"
+	"time"
+)
+
+// setAckTimeout does nothing, only Linux has TCP_USER_TIMEOUT.
+func setAckTimeout(tc *net.TCPConn, d time.Duration) error {
+	return nil
+}
@@ -17,6 +17,7 @@ type logMsg struct {
 	MsgID    email.MsgID
 	PartNum  int
 	Err      error
+	Cmd      string // command summary, see imapparser.Command.Summary
 	Data     string
 }
 
@@ -51,6 +52,9 @@ func (l logMsg) String() string {
 	if l.Err != nil {
 		fmt.Fprintf(buf, `, "err": %q`, l.Err.Error())
 	}
+	if l.Cmd != "" {
+		fmt.Fprintf(buf, `, "cmd": %q`, l.Cmd)
+	}
 	if l.Data != "" {
 		fmt.Fprintf(buf, `, "data": "%s"`, l.Data)
 	}
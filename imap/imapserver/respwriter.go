@@ -0,0 +1,56 @@
+package imapserver
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"spilled.ink/imap/imapformat"
+)
+
+// respWriter builds a response by appending to a buffer.
+//
+// A FETCH of a mailbox listing is made of many small integers,
+// atoms, and punctuation. Writing them with fmt boxes every
+// argument, so respWriter appends them with strconv instead,
+// and its buffers are pooled across commands.
+type respWriter struct {
+	b []byte
+}
+
+var respWriterPool = sync.Pool{
+	New: func() interface{} { return &respWriter{b: make([]byte, 0, 4096)} },
+}
+
+func getRespWriter() *respWriter {
+	w := respWriterPool.Get().(*respWriter)
+	w.b = w.b[:0]
+	return w
+}
+
+// release returns w to the pool. A buffer grown by
+// a large response is dropped rather than kept.
+func (w *respWriter) release() {
+	if cap(w.b) > 64<<10 {
+		return
+	}
+	respWriterPool.Put(w)
+}
+
+func (w *respWriter) atom(s string) { w.b = append(w.b, s...) }
+func (w *respWriter) num(n int64)   { w.b = strconv.AppendInt(w.b, n, 10) }
+func (w *respWriter) str(s string)  { w.b = imapformat.AppendString(w.b, s) }
+
+// date appends t as a quoted IMAP date-time.
+func (w *respWriter) date(t time.Time) {
+	w.b = append(w.b, '"')
+	w.b = t.AppendFormat(w.b, "02-Jan-2006 15:04:05 -0700")
+	w.b = append(w.b, '"')
+}
+
+// flush writes the response so far to dst.
+func (w *respWriter) flush(dst io.Writer) {
+	dst.Write(w.b)
+	w.b = w.b[:0]
+}
@@ -0,0 +1,50 @@
+package imapserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueueUpdateResync(t *testing.T) {
+	c := &Conn{updateReady: make(chan struct{}, 1)}
+	c.startUpdates(1)
+
+	c.queueUpdate(2, idleUpdate{typ: idleExpunge, value: 7}) // not the selected mailbox
+	c.queueUpdate(1, idleUpdate{typ: idleExpunge, value: 9})
+	for i := 0; i < maxPendingUpdates; i++ {
+		c.queueUpdate(1, idleUpdate{typ: idleFlags, value: uint32(i + 1)})
+	}
+	c.queueUpdate(1, idleUpdate{typ: idleTotalCount, value: 5})
+	c.queueUpdate(1, idleUpdate{typ: idleTotalCount, value: 6})
+	c.queueUpdate(1, idleUpdate{typ: idleFlags, value: 1})
+
+	want := []idleUpdate{
+		{typ: idleExpunge, value: 9},
+		{typ: idleTotalCount, value: 6},
+	}
+	if !reflect.DeepEqual(c.updates, want) {
+		t.Errorf("updates = %v, want %v", c.updates, want)
+	}
+	if !c.updatesResync {
+		t.Error("flags updates dropped without a resync")
+	}
+	if c.updatesOverflow {
+		t.Error("flags updates overflowed the queue")
+	}
+
+	for i := 0; i < maxPendingUpdates; i++ {
+		c.queueUpdate(1, idleUpdate{typ: idleExpunge, value: 1})
+	}
+	if !c.updatesOverflow {
+		t.Error("EXPUNGE updates did not overflow the queue")
+	}
+	if len(c.updates) != 0 {
+		t.Errorf("%d updates queued after overflow", len(c.updates))
+	}
+
+	c.stopUpdates()
+	c.startUpdates(1)
+	if c.updatesResync || c.updatesOverflow || len(c.updates) != 0 {
+		t.Error("restarted updates kept the old queue state")
+	}
+}
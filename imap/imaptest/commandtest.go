@@ -1,176 +1,26 @@
 package imaptest
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"crawshaw.io/iox"
 	"spilled.ink/imap/imapserver"
 )
 
-func TestNonAuth(t *testing.T, server *TestServer) {
-	s := server.OpenSession(t)
-	defer s.Shutdown()
-	if line := s.read(); !strings.HasPrefix(line, "* OK") {
-		t.Fatalf("bad initial ok: %q", line)
-	}
-	s.write("t01 NOOP\r\n")
-	if got, want := s.read(), "t01 OK"; !strings.HasPrefix(got, want) {
-		t.Fatalf("NOOP resposne: %q, want prefix %q", got, want)
-	}
-	// TODO: CAPABILITY
-	// TODO: LOGOUT
-}
-
-func TestLogin(t *testing.T, server *TestServer) {
-	s := server.OpenSession(t)
-	defer s.Shutdown()
-	s.read() // initial * OK
-	s.login()
-}
-
 // TODO: TestAUTHENTICATE
 
-func TestList(t *testing.T, server *TestServer) {
-	s := server.OpenSession(t)
-	defer s.Shutdown()
-	s.read() // initial * OK
-	s.login()
-
-	s.write(`01 LIST "" ""` + "\r\n")
-	s.readExpectPrefix(`* LIST (\Noselect) "/" ""`)
-	s.readExpectPrefix(`01 OK`)
-
-	s.write(`01 LIST "" "*"` + "\r\n")
-	s.readExpectPrefix(`* LIST (\HasNoChildren) "/" INBOX`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Archive) "/" Archive`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Drafts) "/" Drafts`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Sent) "/" Sent`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Junk) "/" Spam`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren) "/" Subscriptions`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Flagged) "/" TestFlagged`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Trash) "/" Trash`)
-	s.readExpectPrefix(`01 OK`)
-
-	s.write(`01 LIST "" "%%"` + "\r\n")
-	s.readExpectPrefix(`* LIST (\HasNoChildren) "/" INBOX`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Archive) "/" Archive`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Drafts) "/" Drafts`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Sent) "/" Sent`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Junk) "/" Spam`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren) "/" Subscriptions`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Flagged) "/" TestFlagged`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Trash) "/" Trash`)
-	s.readExpectPrefix(`01 OK`)
-
-	s.write(`01 LIST "" "%%/%%"` + "\r\n")
-	s.readExpectPrefix(`01 OK`)
-
-	s.write(`01 LIST "" "*" RETURN (SPECIAL-USE)` + "\r\n")
-	s.readExpectPrefix(`* LIST (\HasNoChildren) "/" INBOX`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Archive) "/" Archive`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Drafts) "/" Drafts`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Sent) "/" Sent`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Junk) "/" Spam`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren) "/" Subscriptions`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Flagged) "/" TestFlagged`)
-	s.readExpectPrefix(`* LIST (\HasNoChildren \Trash) "/" Trash`)
-	s.readExpectPrefix(`01 OK`)
-
-}
-
-func TestSelect(t *testing.T, server *TestServer) {
-	s := server.OpenSession(t)
-	defer s.Shutdown()
-	s.read() // initial * OK
-	s.login()
-
-	s.write("01 SELECT INBOX\r\n")
-	s.readExpectPrefix(`* 4 EXISTS`)
-	s.readExpectPrefix(`* 0 RECENT`)
-	s.readExpectPrefix(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen`)
-	s.readExpectPrefix(`* OK [PERMANENTFLAGS (`)
-	s.readExpectPrefix(`* OK [HIGHESTMODSEQ`)
-	s.readExpectPrefix(`* OK [UNSEEN 1]`)
-	got := s.read()
-	var uidValidity int64
-	if _, err := fmt.Sscanf(got, "* OK [UIDVALIDITY %d]", &uidValidity); err != nil {
-		t.Errorf("could not parse UIDVALIDITY: %v", err)
-	} else if uidValidity < 1 {
-		t.Errorf("UIDVALIDITY must be positive integer, got %d", uidValidity)
-	}
-	s.readExpectPrefix(`* OK [UIDNEXT 6]`)
-	s.readExpectPrefix(`01 OK [READ-WRITE]`)
-}
-
-func TestStatus(t *testing.T, server *TestServer) {
-	s := server.OpenInbox(t)
-	defer s.Shutdown()
-
-	s.write("01 STATUS INBOX (MESSAGES RECENT UIDNEXT UNSEEN UIDVALIDITY)\r\n")
-	s.readExpectPrefix(`* STATUS INBOX (MESSAGES 4 RECENT 0 UIDNEXT 6 UNSEEN 4 UIDVALIDITY`)
-	s.readExpectPrefix(`01 OK`)
-}
-
-func TestSearch(t *testing.T, server *TestServer) {
-	s := server.OpenInbox(t)
-	defer s.Shutdown()
-
-	s.write("02 UID SEARCH 2:* NOT DELETED\r\n")
-	s.readExpectPrefix(`* SEARCH 3 4 5`)
-	s.readExpectPrefix(`02 OK`)
-
-	s.write("03 SEARCH 2:* NOT DELETED\r\n")
-	s.readExpectPrefix(`* SEARCH 2 3 4`)
-	s.readExpectPrefix(`03 OK`)
-
-	s.write("04 SEARCH 1:* HEADER Message-ID \"<10b54d5dbb3f40307b73ead99.70d312b03e.20181011024234.6b2a4592ab.dce69bc1@mail167.suw121.mcdlv.net>\"\r\n")
-	s.readExpectPrefix(`* SEARCH 1`)
-	s.readExpectPrefix(`04 OK`)
-
-	s.write("05 UID SEARCH 2:* UNSEEN UNDELETED\r\n")
-	s.readExpectPrefix(`* SEARCH 3 4 5`)
-	s.readExpectPrefix(`05 OK`)
-}
-
+// TestESearch searches by dates relative to today,
+// the rest of ESEARCH is tested by testdata/imaptest/esearch.txt.
 func TestESearch(t *testing.T, server *TestServer) {
 	s := server.OpenInbox(t)
 	defer s.Shutdown()
 
-	s.write("02 UID SEARCH RETURN (MIN MAX COUNT) 2:* NOT DELETED\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "02") COUNT 3 MIN 3 MAX 5`)
-	s.readExpectPrefix(`02 OK`)
-
-	s.write("03 SEARCH RETURN (COUNT) 42:*\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "03") COUNT 0`)
-	s.readExpectPrefix(`03 OK`)
-
-	s.write("04 UID SEARCH RETURN (MIN MAX COUNT ALL) 2:*\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "04") COUNT 3 MIN 3 MAX 5 ALL 3:5`)
-	s.readExpectPrefix(`04 OK`)
-
-	s.write("05 UID SEARCH RETURN () 2:*\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "05") ALL 3:5`)
-	s.readExpectPrefix(`05 OK`)
-
-	s.write("06 SEARCH RETURN () 1:*\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "06") ALL 1:4`)
-	s.readExpectPrefix(`06 OK`)
-
-	s.write("07 SEARCH RETURN (MIN MAX COUNT ALL) 1:* deleted\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "07") COUNT 0`)
-	s.readExpectPrefix(`07 OK`)
-
-	s.write("08 SEARCH RETURN (MIN COUNT) 1:* flagged\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "08") COUNT 1 MIN 1`)
-	s.readExpectPrefix(`08 OK`)
-
-	s.write("09 UID SEARCH RETURN (ALL) BEFORE 18-Dec-1997\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "09")`)
-	s.readExpectPrefix(`09 OK`)
-
 	tomorrow := time.Now().AddDate(0, 0, 2).Format("02-Jan-2006")
 	s.write("10 UID SEARCH RETURN (ALL) BEFORE " + tomorrow + "\r\n")
 	s.readExpectPrefix(`* ESEARCH (TAG "10") ALL 1,3:5`)
@@ -185,112 +35,6 @@ func TestESearch(t *testing.T, server *TestServer) {
 	s.write("11 UID SEARCH RETURN (ALL) SINCE " + yesterday + "\r\n")
 	s.readExpectPrefix(`* ESEARCH (TAG "11") ALL 1,3:5`)
 	s.readExpectPrefix(`11 OK`)
-
-	s.write("12 UID SEARCH RETURN (ALL) OLD\r\n")
-	s.readExpectPrefix(`* ESEARCH (TAG "12") ALL 1,3:5`)
-	s.readExpectPrefix(`12 OK`)
-}
-
-func TestUIDExpunge(t *testing.T, server *TestServer) {
-	s := server.OpenInbox(t)
-	defer s.Shutdown()
-
-	s.write("02 UID STORE 1:4 +FLAGS.SILENT (\\Deleted)\r\n")
-	s.readExpectPrefix(`02 OK`)
-
-	s.write("03 UID EXPUNGE 3,9\r\n")
-	s.readExpectPrefix(`* 2 EXPUNGE`)
-	s.readExpectPrefix(`03 OK`)
-
-	s.write("04 UID EXPUNGE 1:4\r\n")
-	s.readExpectPrefix(`* 1 EXPUNGE`)
-	s.readExpectPrefix(`* 1 EXPUNGE`)
-	s.readExpectPrefix(`04 OK`)
-}
-
-func TestFlags(t *testing.T, server *TestServer) {
-	s := server.OpenInbox(t)
-	defer s.Shutdown()
-
-	t.Run("STORE_Add", func(t *testing.T) {
-		s.t = t
-		s.write("02 STORE 1 +FLAGS.SILENT (silent_running)\r\n")
-		s.readExpectPrefix(`02 OK`)
-
-		s.write("03 STORE 1 +FLAGS (custom)\r\n")
-		s.readExpectPrefix(`* 1 FETCH (FLAGS (\Flagged custom silent_running))`)
-		s.readExpectPrefix(`03 OK`)
-	})
-	t.Run("STORE_Replace", func(t *testing.T) {
-		s.t = t
-		s.write("02 STORE 1 FLAGS (foo bar \\Deleted)\r\n")
-		s.readExpectPrefix(`* 1 FETCH (FLAGS (\Deleted bar foo))`)
-		s.readExpectPrefix(`02 OK`)
-	})
-	t.Run("STORE_Remove", func(t *testing.T) {
-		s.t = t
-
-		s.write("02 SEARCH 2 NOT DELETED\r\n")
-		s.readExpectPrefix(`* SEARCH 2`)
-		s.readExpectPrefix(`02 OK`)
-
-		s.write("03 STORE 2 FLAGS.SILENT (foo bar baz \\Deleted)\r\n")
-		s.readExpectPrefix(`03 OK`)
-
-		s.write("04 SEARCH 2 NOT DELETED\r\n")
-		s.readExpectPrefix(`04 OK`)
-
-		s.write("05 SEARCH 2 DELETED\r\n")
-		s.readExpectPrefix(`* SEARCH 2`)
-		s.readExpectPrefix(`05 OK`)
-
-		s.write("06 STORE 2 -FLAGS (foo)\r\n")
-		s.readExpectPrefix(`* 2 FETCH (FLAGS (\Deleted bar baz))`)
-		s.readExpectPrefix(`06 OK`)
-	})
-	t.Run("EXPUNGE", func(t *testing.T) {
-		s.t = t
-
-		idleInbox := server.Idle(t, "INBOX")
-		defer idleInbox.Shutdown()
-
-		s.write("02 EXPUNGE\r\n")
-		s.readExpectPrefix(`* 1 EXPUNGE`)
-		s.readExpectPrefix(`* 1 EXPUNGE`)
-		s.readExpectPrefix(`02 OK`)
-
-		idleInbox.readExpectPrefix(`* 1 EXPUNGE`)
-		idleInbox.readExpectPrefix(`* 1 EXPUNGE`)
-		idleInbox.readExpectPrefix(`* 2 EXISTS`)
-
-		s.write("03 EXPUNGE\r\n")
-		s.readExpectPrefix(`03 OK`)
-	})
-	t.Run("CLOSE", func(t *testing.T) {
-		s.t = t
-		s.write("02 STORE 2 FLAGS.SILENT (\\Deleted)\r\n")
-		s.readExpectPrefix(`02 OK STORE`)
-
-		idleInbox := server.Idle(t, "INBOX")
-		defer idleInbox.Shutdown()
-
-		s.write("03 CLOSE\r\n")
-		s.readExpectPrefix(`03 OK CLOSE`)
-
-		idleInbox.readExpectPrefix(`* 2 EXPUNGE`)
-		idleInbox.readExpectPrefix(`* 1 EXISTS`)
-
-		s.write("04 SELECT INBOX\r\n")
-		s.readExpectPrefix(`* 1 EXISTS`)
-		s.readExpectPrefix(`* 0 RECENT`)
-		s.readExpectPrefix(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen`)
-		s.readExpectPrefix(`* OK [PERMANENTFLAGS (`)
-		s.readExpectPrefix(`* OK [HIGHESTMODSEQ`)
-		s.readExpectPrefix(`* OK [UNSEEN 1]`)
-		s.readExpectPrefix(`* OK [UIDVALIDITY`)
-		s.readExpectPrefix(`* OK [UIDNEXT 6]`)
-		s.readExpectPrefix(`04 OK`)
-	})
 }
 
 func TestAppend(t *testing.T, server *TestServer) {
@@ -359,108 +103,6 @@ Hello Joe, do you think we can meet at 3:30 tomorrow?
 // TODO: CREATE
 // TODO: DELETE
 
-func TestCopy(t *testing.T, server *TestServer) {
-	s := server.OpenInbox(t)
-	defer s.Shutdown()
-
-	idleArchive := server.Idle(t, "Archive")
-	defer idleArchive.Shutdown()
-
-	s.write("01 UID COPY 2:5 Archive\r\n")
-	s.readExpect(`\* OK [COPYUID [0-9]+ 3:5 1:3]`)
-	s.readExpectPrefix(`01 OK`)
-
-	s.write("02 STATUS Archive (MESSAGES)\r\n")
-	s.readExpectPrefix("* STATUS Archive (MESSAGES 3)")
-	s.readExpectPrefix(`02 OK`)
-
-	idleArchive.readExpectPrefix("* 3 EXISTS")
-
-	s.selectCmd("Archive")
-	s.write("03 FETCH * (BODY[HEADER.FIELDS (Subject)]<0.14>)\r\n")
-	s.readExpectPrefix(`* 1 FETCH (BODY[HEADER.FIELDS (Subject)]<0> {2}`)
-	s.readExpectPrefix(``)
-	s.readExpectPrefix(`)`)
-	s.readExpectPrefix(`* 2 FETCH (BODY[HEADER.FIELDS (Subject)]<0> {14}`)
-	s.readExpectPrefix(`Subject: Hello)`)
-	s.readExpectPrefix(`* 3 FETCH (BODY[HEADER.FIELDS (Subject)]<0> {14}`)
-	s.readExpectPrefix(`Subject: Purch)`)
-	s.readExpectPrefix(`03 OK`)
-
-	s.write("04 UID COPY 42 INBOX\r\n") // nothing to copy
-	s.readExpectPrefix(`04 OK`)
-}
-
-func TestMove(t *testing.T, server *TestServer) {
-	s := server.OpenInbox(t)
-	defer s.Shutdown()
-
-	idleInbox := server.Idle(t, "INBOX")
-	defer idleInbox.Shutdown()
-	idleArchive := server.Idle(t, "Archive")
-	defer idleArchive.Shutdown()
-
-	s.write("01 UID MOVE 2:5 Archive\r\n")
-	s.readExpect(`\* OK [COPYUID [0-9]+ 3:5 1:3]`)
-	s.readExpectPrefix(`* 2 EXPUNGE`)
-	s.readExpectPrefix(`* 2 EXPUNGE`)
-	s.readExpectPrefix(`* 2 EXPUNGE`)
-	s.readExpectPrefix(`01 OK`)
-
-	idleInbox.readExpectPrefix("* 2 EXPUNGE")
-	idleInbox.readExpectPrefix("* 2 EXPUNGE")
-	idleInbox.readExpectPrefix("* 2 EXPUNGE")
-	idleInbox.readExpectPrefix("* 1 EXISTS")
-	idleArchive.readExpectPrefix("* 3 EXISTS")
-
-	s.write("01 SELECT Archive\r\n")
-	s.readExpectPrefix(`* 3 EXISTS`)
-	s.readExpectPrefix(`* 0 RECENT`)
-	s.readExpectPrefix(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen`)
-	s.readExpectPrefix(`* OK [PERMANENTFLAGS (`)
-	s.readExpectPrefix(`* OK [HIGHESTMODSEQ`)
-	s.readExpectPrefix(`* OK [UNSEEN 1]`)
-	s.readExpectPrefix(`* OK [UIDVALIDITY`)
-	s.readExpectPrefix(`* OK [UIDNEXT 4]`)
-	s.readExpectPrefix(`01 OK [READ-WRITE]`)
-
-	s.write("02 STATUS INBOX (MESSAGES)\r\n")
-	s.readExpectPrefix("* STATUS INBOX (MESSAGES 1)")
-	s.readExpectPrefix(`02 OK`)
-
-	// Test that status updates from MOVE to IDLE-listening
-	// connections do not block.
-	s.write("1 IDLE\r\n")
-	s.readExpectPrefix("+ idling")
-	s.write("DONE\r\n")
-	s.readExpectPrefix("1 OK")
-
-	s.write("03 MOVE 1,2:3 INBOX\r\n")
-	s.readExpect(`\* OK [COPYUID [0-9]+ 1:3 6:8]`)
-	s.readExpectPrefix(`* 1 EXPUNGE`)
-	s.readExpectPrefix(`* 1 EXPUNGE`)
-	s.readExpectPrefix(`* 1 EXPUNGE`)
-	s.readExpectPrefix(`* 0 EXISTS`) // because we IDLEd on this session
-	s.readExpectPrefix(`03 OK`)
-
-	idleArchive.readExpectPrefix("* 1 EXPUNGE")
-	idleArchive.readExpectPrefix("* 1 EXPUNGE")
-	idleArchive.readExpectPrefix("* 1 EXPUNGE")
-	idleArchive.readExpectPrefix("* 0 EXISTS")
-	idleInbox.readExpectPrefix("* 4 EXISTS")
-
-	s.write("02 STATUS INBOX (MESSAGES)\r\n")
-	s.readExpectPrefix("* STATUS INBOX (MESSAGES 4)")
-	s.readExpectPrefix(`02 OK`)
-
-	s.write("02 STATUS Archive (MESSAGES)\r\n")
-	s.readExpectPrefix("* STATUS Archive (MESSAGES 0)")
-	s.readExpectPrefix(`02 OK`)
-
-	// TODO s.selectCmd("INBOX")
-	// s.write("03 MOVE 2:3,1 Archive\r\n")
-}
-
 func TestConcurrency(t *testing.T, server *TestServer) {
 	// TODO: why does this work? some of these events should cause sqlite tx failures.
 	var sessions []*TestSession
@@ -582,6 +224,59 @@ func TestIdle(t *testing.T, server *TestServer) {
 	s.readExpectPrefix("+ idling")
 	s.write("DONE\r\n")
 	s.readExpectPrefix("1 OK")
+
+	// Flags changed by another session are sent as FETCH responses.
+	s.selectCmd("INBOX")
+	s.write("b STORE 6 +FLAGS (\\Flagged)\r\n")
+	s.readExpectPrefix(`* 6 FETCH (FLAGS (\Flagged \Seen))`)
+	s.readExpectPrefix("b OK")
+	idle1.readExpect(`^\* 6 FETCH \(UID [0-9]+ FLAGS \(\\Flagged \\Seen\)\)`)
+
+	idle2.write("1 NOOP\r\n")
+	idle2.readExpect(`^\* 6 FETCH \(UID [0-9]+ FLAGS \(\\Flagged \\Seen\)\)`)
+	idle2.readExpectPrefix("1 OK")
+}
+
+func TestTimeout(t *testing.T, server *TestServer) {
+	server, err := server.withConfig(func(s *imapserver.Server) {
+		s.PreAuthTimeout = 200 * time.Millisecond
+		s.IdleTimeout = 500 * time.Millisecond
+		s.CommandTimeout = 300 * time.Millisecond
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Init(t)
+	defer func() {
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	t.Run("PreAuth", func(t *testing.T) {
+		s := server.OpenSession(t)
+		defer s.Shutdown()
+		s.readExpectPrefix("* OK")
+		s.readExpectPrefix("* BYE Autologout")
+	})
+	t.Run("Auth", func(t *testing.T) {
+		s := server.OpenInbox(t)
+		defer s.Shutdown()
+		s.write("1 NOOP\r\n")
+		s.readExpectPrefix("1 OK")
+		s.readExpectPrefix("* BYE Autologout")
+	})
+	t.Run("Idle", func(t *testing.T) {
+		s := server.Idle(t, "INBOX")
+		defer s.Shutdown()
+		s.readExpectPrefix("* BYE Autologout")
+	})
+	t.Run("SlowCommand", func(t *testing.T) {
+		s := server.OpenInbox(t)
+		defer s.Shutdown()
+		s.write("1 NOO")
+		s.readExpectPrefix("* BYE command timed out")
+	})
 }
 
 func TestCompress(t *testing.T, server *TestServer) {
@@ -597,6 +292,11 @@ func TestCompress(t *testing.T, server *TestServer) {
 	s.readExpectPrefix("+ idling")
 	s.write("DONE\r\n")
 	s.readExpectPrefix("1 OK")
+
+	stats := server.s.ConnStats().Compress
+	if stats.Conns == 0 || stats.InWire == 0 || stats.InData == 0 || stats.OutWire == 0 || stats.OutData == 0 {
+		t.Errorf("Compress stats: %+v, want counts", stats)
+	}
 }
 
 func TestXApplePushService(t *testing.T, server *TestServer) {
@@ -620,3 +320,241 @@ func TestXApplePushService(t *testing.T, server *TestServer) {
 	s.readExpectPrefix(`* XAPPLEPUSHSERVICE aps-version "2" aps-topic "custom-topic"`)
 	s.readExpectPrefix("1 OK")
 }
+
+func TestSlowCommandLog(t *testing.T, server *TestServer) {
+	slowLog := make(chan string, 16)
+	server, err := server.withConfig(func(s *imapserver.Server) {
+		s.SlowCommand = time.Nanosecond // every command is slow
+		s.Logf = func(format string, v ...interface{}) {
+			if msg := fmt.Sprintf(format, v...); strings.Contains(msg, `"slow command"`) {
+				select {
+				case slowLog <- msg:
+				default:
+				}
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Init(t)
+	defer func() {
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	s := server.OpenInbox(t)
+	defer s.Shutdown()
+	s.write("1 UID SEARCH SUBJECT \"hush\"\r\n")
+	for line := s.read(); !strings.HasPrefix(line, "1 "); line = s.read() {
+	}
+
+	// The log has the shape of the command, not what it searches for.
+	want := `"cmd": "UID SEARCH search=SUBJECT"`
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-slowLog:
+			if strings.Contains(msg, "aaaabbbb") || strings.Contains(msg, "hush") {
+				t.Errorf("slow command log has client data: %s", msg)
+			}
+			if !strings.Contains(msg, want) {
+				continue
+			}
+			if !strings.Contains(msg, "parse=") || !strings.Contains(msg, "db_wait=") || !strings.Contains(msg, "write=") {
+				t.Errorf("slow command log missing timing: %s", msg)
+			}
+			if stats := server.s.ConnStats().Commands["SEARCH"]; stats.Count == 0 || stats.Slow == 0 {
+				t.Errorf("SEARCH stats %+v, want slow commands", stats)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("no slow command log with %s", want)
+		}
+	}
+}
+
+func TestIdleHeartbeat(t *testing.T, server *TestServer) {
+	server, err := server.withConfig(func(s *imapserver.Server) {
+		s.IdleHeartbeat = 100 * time.Millisecond
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Init(t)
+	defer func() {
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	s := server.Idle(t, "INBOX")
+	defer s.Shutdown()
+	s.readExpectPrefix("* OK still here")
+	s.readExpectPrefix("* OK still here")
+	s.write("DONE\r\n")
+	s.readExpectPrefix("1 OK")
+
+	if stats := server.s.ConnStats(); stats.Reaped != 0 {
+		t.Errorf("Reaped=%d before any connection died", stats.Reaped)
+	}
+
+	// A connection reset in IDLE is reaped.
+	s2 := server.Idle(t, "INBOX")
+	tc := s2.conn.(*tls.Conn).NetConn().(*net.TCPConn)
+	tc.SetLinger(0)
+	tc.Close()
+	for i := 0; server.s.ConnStats().Reaped != 1; i++ {
+		if i > 100 {
+			t.Fatalf("Reaped=%d, want 1", server.s.ConnStats().Reaped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUserFiler(t *testing.T, server *TestServer) {
+	var mu sync.Mutex
+	var userIDs []int64
+	server, err := server.withConfig(func(s *imapserver.Server) {
+		s.LiteralMemSize = 16
+		s.UserFiler = func(userID int64) *iox.Filer {
+			mu.Lock()
+			userIDs = append(userIDs, userID)
+			mu.Unlock()
+			return s.Filer
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Init(t)
+	defer func() {
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	s := server.OpenSession(t)
+	defer s.Shutdown()
+	s.read() // initial * OK
+	s.login()
+	msg := "Subject: spilled\r\nContent-Type: text/plain\r\n\r\n" +
+		"A literal longer than LiteralMemSize.\r\n"
+	s.write("1 APPEND INBOX {%d}\r\n", len(msg))
+	s.readExpectPrefix("+")
+	s.write("%s\r\n", msg)
+	s.readExpectPrefix("1 OK")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(userIDs) != 1 || userIDs[0] == 0 {
+		t.Errorf("UserFiler called for %v, want one user", userIDs)
+	}
+}
+
+func TestStartTLS(t *testing.T, server *TestServer) {
+	server, err := server.withStartTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Init(t)
+	defer func() {
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	s := server.OpenSession(t)
+	defer s.Shutdown()
+	s.readExpectPrefix("* OK")
+	s.write("1 CAPABILITY\r\n")
+	s.readExpect(`^\* CAPABILITY .*STARTTLS LOGINDISABLED`)
+	s.readExpectPrefix("1 OK")
+	s.write("2 LOGIN crawshaw@spilled.ink aaaabbbbccccdddd\r\n")
+	s.readExpectPrefix("2 NO [PRIVACYREQUIRED]")
+
+	s.write("3 STARTTLS\r\n")
+	s.readExpectPrefix("3 OK")
+	s.StartTLS()
+	s.write("4 CAPABILITY\r\n")
+	s.readExpect(`^\* CAPABILITY IMAP4rev1 AUTH=PLAIN`)
+	s.readExpectPrefix("4 OK")
+	s.write("5 STARTTLS\r\n")
+	s.readExpectPrefix("5 BAD")
+	s.login()
+	s.selectCmd("INBOX")
+}
+
+func TestConnLimits(t *testing.T, server *TestServer) {
+	server, err := server.withConfig(func(s *imapserver.Server) {
+		s.MaxConnsPerUser = 2
+		s.MaxConnsPerIP = 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Init(t)
+	defer func() {
+		if err := server.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	login := func() *TestSession {
+		s := server.OpenSession(t)
+		s.readExpectPrefix("* OK")
+		s.write("t02 LOGIN crawshaw@spilled.ink aaaabbbbccccdddd\r\n")
+		return s
+	}
+
+	s1 := login()
+	s1.readExpectPrefix("t02 OK")
+	s2 := login()
+	s2.readExpectPrefix("t02 OK")
+	s3 := login()
+	s3.readExpectPrefix("t02 NO [LIMIT]")
+
+	if stats := server.s.ConnStats(); len(stats.UserConns) != 1 {
+		t.Errorf("UserConns=%v, want one user", stats.UserConns)
+	}
+
+	// A rejected login can be retried once a connection closes.
+	s1.write("1 LOGOUT\r\n")
+	s1.readExpectPrefix("* BYE")
+	for i := 0; ; i++ {
+		stats := server.s.ConnStats()
+		n := 0
+		for _, v := range stats.UserConns {
+			n += v
+		}
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("UserConns=%v after LOGOUT, want 1 connection", stats.UserConns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s3.write("t03 LOGIN crawshaw@spilled.ink aaaabbbbccccdddd\r\n")
+	s3.readExpectPrefix("t03 OK")
+
+	ipServer, err := server.withConfig(func(s *imapserver.Server) {
+		s.MaxConnsPerIP = 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipServer.Init(t)
+	defer ipServer.Shutdown()
+	s4 := ipServer.OpenInbox(t)
+	s4.write("1 NOOP\r\n")
+	s4.readExpectPrefix("1 OK")
+	s5 := ipServer.OpenSession(t)
+	s5.readExpectPrefix("* OK")
+	s5.write("t02 LOGIN crawshaw@spilled.ink aaaabbbbccccdddd\r\n")
+	s5.readExpectPrefix("t02 NO [LIMIT] too many connections from")
+	if stats := ipServer.s.ConnStats(); len(stats.IPConns) != 1 || stats.Conns != 2 {
+		t.Errorf("ConnStats=%+v, want one IP and 2 connections", stats)
+	}
+}
@@ -0,0 +1,566 @@
+package imaptest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"spilled.ink/util/tlstest"
+)
+
+// DiffScript is a sequence of IMAP commands, without tags.
+//
+// TestDiff runs each script against a freshly seeded and selected
+// mailbox, so scripts may change the mailbox.
+type DiffScript struct {
+	Name string
+	Cmds []string
+}
+
+// DiffScripts are run by TestDiff.
+//
+// spilld regenerates the MIME framing of messages, so commands that
+// return whole multipart messages, their sizes or their boundaries
+// (BODY[], RFC822.SIZE, the BODYSTRUCTURE of multipart messages)
+// are expected to differ and are avoided.
+var DiffScripts = []DiffScript{
+	{"Fetch", []string{
+		"FETCH 1:* (UID FLAGS)",
+		"UID FETCH 1:* (FLAGS)",
+		"UID FETCH 2:4 (UID)",
+		"FETCH 2 (ENVELOPE)",
+		"FETCH 1:* (INTERNALDATE)",
+		"UID FETCH 4 (BODYSTRUCTURE)",
+		"UID FETCH 2 (BODY.PEEK[HEADER.FIELDS (FROM SUBJECT)])",
+		"UID FETCH 4 (BODY.PEEK[1])",
+		"UID FETCH 4 (BODY.PEEK[1]<10.20>)",
+		"UID FETCH 4 (FLAGS)",
+		"UID FETCH 4 (BODY[1])",
+		"UID FETCH 4 (FLAGS)",
+		"FETCH 5 (FLAGS)",
+		"UID FETCH 9 (FLAGS)",
+	}},
+	{"Search", []string{
+		"SEARCH ALL",
+		"UID SEARCH ALL",
+		"SEARCH FLAGGED",
+		"SEARCH UNSEEN",
+		"SEARCH NOT SEEN",
+		"SEARCH OR FLAGGED KEYWORD $Label1",
+		"SEARCH 2:* UNFLAGGED",
+		"UID SEARCH UID 2:*",
+		"UID SEARCH 1:2",
+		"SEARCH SUBJECT events",
+		"SEARCH FROM spaceapps",
+		"SEARCH HEADER Message-ID <",
+		"SEARCH BODY quoted-printable",
+		"SEARCH SENTBEFORE 1-Jan-2019",
+		"SEARCH SINCE 1-Jan-2019",
+		"SEARCH BEFORE 1-Jan-2019 NOT FLAGGED",
+	}},
+	{"Store", []string{
+		"STORE 1 +FLAGS (\\Seen)",
+		"STORE 1:2 -FLAGS (\\Flagged)",
+		"UID STORE 4 FLAGS ($Label1)",
+		"STORE 2 +FLAGS.SILENT (\\Answered)",
+		"FETCH 1:* (FLAGS)",
+		"UID STORE 1:* +FLAGS (\\Draft)",
+		"STORE 3 -FLAGS.SILENT (\\Draft $Label1)",
+		"FETCH 1:* (FLAGS)",
+		"STORE 2 +FLAGS (\\Deleted)",
+		"EXPUNGE",
+		"FETCH 1:* (UID FLAGS)",
+		"SEARCH DRAFT",
+	}},
+}
+
+// TestDiff runs DiffScripts against server and a reference IMAP
+// server and reports where their responses differ.
+//
+// The reference server is reached over TLS, certificates are not
+// checked. It is named by the environment:
+//
+//	IMAPTEST_REFERENCE       host:port
+//	IMAPTEST_REFERENCE_USER
+//	IMAPTEST_REFERENCE_PASS
+//
+// TestDiff is skipped if IMAPTEST_REFERENCE is not set.
+// Dovecot run in a container makes a good reference, its default
+// configuration accepts any user with the password "pass":
+//
+//	docker run --rm -p 10993:993 dovecot/dovecot
+//	IMAPTEST_REFERENCE=localhost:10993 \
+//	IMAPTEST_REFERENCE_USER=imaptest IMAPTEST_REFERENCE_PASS=pass \
+//	go test -run Test/Memory/Diff spilled.ink/imap/imapserver
+func TestDiff(t *testing.T, server *TestServer) {
+	refAddr := os.Getenv("IMAPTEST_REFERENCE")
+	if refAddr == "" {
+		t.Skip("IMAPTEST_REFERENCE not set")
+	}
+	server.Init(t)
+	spilld := DiffTarget{
+		Addr:      server.addr.String(),
+		User:      "crawshaw@spilled.ink",
+		Pass:      "aaaabbbbccccdddd",
+		TLSConfig: tlstest.ClientConfig,
+	}
+	ref := DiffTarget{
+		Addr:      refAddr,
+		User:      os.Getenv("IMAPTEST_REFERENCE_USER"),
+		Pass:      os.Getenv("IMAPTEST_REFERENCE_PASS"),
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	Diff(t, ref, spilld, DiffScripts)
+}
+
+// DiffTarget is an IMAP server reached by Diff.
+type DiffTarget struct {
+	Addr      string
+	User      string
+	Pass      string
+	TLSConfig *tls.Config
+}
+
+// Diff runs each script on servers a and b and reports as a test
+// error any difference between the normalized responses.
+//
+// Responses are normalized to remove variations allowed by the
+// IMAP RFCs or that depend on server state: the text of status
+// responses, UIDVALIDITY and MODSEQ values, \Recent, and the order
+// of FETCH items and flags.
+func Diff(t *testing.T, a, b DiffTarget, scripts []DiffScript) {
+	seed, err := diffSeedMsgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range scripts {
+		script := script
+		t.Run(script.Name, func(t *testing.T) {
+			mailbox := fmt.Sprintf("ImaptestDiff%d", time.Now().UnixNano())
+			gotA, err := runDiffScript(a, mailbox, seed, script)
+			if err != nil {
+				t.Fatalf("%s: %v", a.Addr, err)
+			}
+			gotB, err := runDiffScript(b, mailbox, seed, script)
+			if err != nil {
+				t.Fatalf("%s: %v", b.Addr, err)
+			}
+			if d := lineDiff(gotA, gotB); d != "" {
+				t.Errorf("responses differ (-%s +%s):\n%s", a.Addr, b.Addr, d)
+			}
+		})
+	}
+}
+
+type diffSeedMsg struct {
+	file  string
+	flags string
+	date  string
+	data  []byte
+}
+
+// diffSeedMsgs are appended to the mailbox for each DiffScript.
+// The second msg3.eml is expunged, so UIDs and sequence numbers
+// differ after the first message:
+//
+//	seq 1  UID 1  msg1.eml
+//	seq 2  UID 2  msg3.eml
+//	seq 3  UID 4  msg4.eml
+//	seq 4  UID 5  msg5.eml
+func diffSeedMsgs() ([]diffSeedMsg, error) {
+	dir, err := testdataDir()
+	if err != nil {
+		return nil, err
+	}
+	msgs := []diffSeedMsg{
+		{file: "msg1.eml", flags: `\Flagged`, date: "11-Oct-2018 02:42:50 +0000"},
+		{file: "msg3.eml", flags: `\Seen`, date: "02-Mar-2019 10:00:00 -0500"},
+		{file: "msg3.eml", flags: `\Deleted`, date: "02-Mar-2019 10:00:01 -0500"},
+		{file: "msg4.eml", flags: ``, date: "17-Dec-2018 23:59:59 +0100"},
+		{file: "msg5.eml", flags: `\Seen $Label1`, date: "01-Feb-2020 08:30:00 +0000"},
+	}
+	for i := range msgs {
+		msgs[i].data, err = ioutil.ReadFile(filepath.Join(dir, msgs[i].file))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func runDiffScript(target DiffTarget, mailbox string, seed []diffSeedMsg, script DiffScript) (transcript []string, err error) {
+	c, err := dialDiffClient(target)
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+
+	if _, err := c.cmdOK("LOGIN " + quote(target.User) + " " + quote(target.Pass)); err != nil {
+		return nil, err
+	}
+	if _, err := c.cmdOK("CREATE " + mailbox); err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.cmd("CLOSE")
+		if _, deleteErr := c.cmdOK("DELETE " + mailbox); err == nil {
+			err = deleteErr
+		}
+		c.cmd("LOGOUT")
+	}()
+	for _, msg := range seed {
+		if err := c.append(mailbox, msg); err != nil {
+			return nil, fmt.Errorf("seeding %s: %v", msg.file, err)
+		}
+	}
+	if _, err := c.cmdOK("SELECT " + mailbox); err != nil {
+		return nil, err
+	}
+	if _, err := c.cmdOK("EXPUNGE"); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range script.Cmds {
+		transcript = append(transcript, "C: "+cmd)
+		res, err := c.cmd(cmd)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range res {
+			if line = normalizeResponse(line); line != "" {
+				transcript = append(transcript, "S: "+line)
+			}
+		}
+	}
+	return transcript, nil
+}
+
+type diffClient struct {
+	conn *tls.Conn
+	br   *bufio.Reader
+	tag  int
+}
+
+func dialDiffClient(target DiffTarget) (*diffClient, error) {
+	conn, err := tls.Dial("tcp", target.Addr, target.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := &diffClient{
+		conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if greeting, err := c.readResponse(); err != nil {
+		conn.Close()
+		return nil, err
+	} else if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("bad greeting: %q", greeting)
+	}
+	return c, nil
+}
+
+func (c *diffClient) nextTag() string {
+	c.tag++
+	return fmt.Sprintf("d%03d", c.tag)
+}
+
+// cmd sends cmd and reads the responses to it.
+// The final tagged response is reduced to its tag and status.
+func (c *diffClient) cmd(cmd string) (res []string, err error) {
+	tag := c.nextTag()
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+	return c.readUntil(tag)
+}
+
+// cmdOK is cmd, reporting an error if the command did not succeed.
+func (c *diffClient) cmdOK(cmd string) (res []string, err error) {
+	res, err = c.cmd(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if last := res[len(res)-1]; !strings.HasSuffix(last, " OK") {
+		return nil, fmt.Errorf("%s: %s", cmd, last)
+	}
+	return res, nil
+}
+
+func (c *diffClient) append(mailbox string, msg diffSeedMsg) error {
+	tag := c.nextTag()
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err := fmt.Fprintf(c.conn, "%s APPEND %s (%s) %q {%d}\r\n", tag, mailbox, msg.flags, msg.date, len(msg.data))
+	if err != nil {
+		return err
+	}
+	if line, err := c.readResponse(); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "+") {
+		return fmt.Errorf("APPEND: %s", line)
+	}
+	if _, err := c.conn.Write(msg.data); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+		return err
+	}
+	res, err := c.readUntil(tag)
+	if err != nil {
+		return err
+	}
+	if last := res[len(res)-1]; !strings.HasSuffix(last, " OK") {
+		return fmt.Errorf("APPEND: %s", last)
+	}
+	return nil
+}
+
+func (c *diffClient) readUntil(tag string) (res []string, err error) {
+	for {
+		line, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.TrimPrefix(line, tag+" ")
+			if i := strings.IndexByte(status, ' '); i >= 0 {
+				status = status[:i]
+			}
+			return append(res, tag+" "+status), nil
+		}
+		res = append(res, line)
+	}
+}
+
+var literalSuffix = regexp.MustCompile(`\{([0-9]+)\}\r\n$`)
+
+// readResponse reads a response line, along with any literals
+// and the lines that follow them. The final CRLF is removed.
+func (c *diffClient) readResponse() (string, error) {
+	var res []byte
+	for {
+		line, err := c.br.ReadBytes('\n')
+		if err != nil {
+			return "", err
+		}
+		res = append(res, line...)
+		m := literalSuffix.FindSubmatch(line)
+		if m == nil {
+			break
+		}
+		n, err := strconv.Atoi(string(m[1]))
+		if err != nil {
+			return "", err
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.br, literal); err != nil {
+			return "", err
+		}
+		res = append(res, literal...)
+	}
+	return strings.TrimSuffix(string(res), "\r\n"), nil
+}
+
+var (
+	fetchResponse  = regexp.MustCompile(`(?s)^\* ([0-9]+) FETCH \((.*)\)$`)
+	statusResponse = regexp.MustCompile(`^\* (OK|NO|BAD) ?(\[[^\]]*\])?`)
+	normalizers    = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`UIDVALIDITY [0-9]+`), "UIDVALIDITY x"},
+		{regexp.MustCompile(`HIGHESTMODSEQ [0-9]+`), "HIGHESTMODSEQ x"},
+		{regexp.MustCompile(`MODSEQ \([0-9]+\)`), "MODSEQ (x)"},
+	}
+)
+
+// normalizeResponse removes the expected variations from an untagged
+// response. It reports "" for responses that are ignored.
+func normalizeResponse(line string) string {
+	switch {
+	case strings.HasPrefix(line, "* CAPABILITY "):
+		return ""
+	case strings.HasSuffix(line, " RECENT") && !strings.Contains(line, "("):
+		return ""
+	}
+	if m := statusResponse.FindStringSubmatch(line); m != nil {
+		// The human-readable text is up to the server.
+		if m[2] == "" {
+			return ""
+		}
+		line = m[0]
+	}
+	if m := fetchResponse.FindStringSubmatch(line); m != nil {
+		if items, ok := fetchItems(m[2]); ok {
+			line = "* " + m[1] + " FETCH (" + strings.Join(items, " ") + ")"
+		}
+	}
+	for _, n := range normalizers {
+		line = n.re.ReplaceAllString(line, n.repl)
+	}
+	return line
+}
+
+// fetchItems splits the contents of a FETCH response into its
+// "name value" items, sorted by name. Flags are sorted too.
+func fetchItems(s string) (items []string, ok bool) {
+	for s != "" {
+		n := tokenLen(s)
+		if n <= 0 || n >= len(s) || s[n] != ' ' {
+			return nil, false
+		}
+		name := s[:n]
+		s = s[n+1:]
+		n = tokenLen(s)
+		if n <= 0 {
+			return nil, false
+		}
+		value := s[:n]
+		s = strings.TrimPrefix(s[n:], " ")
+		if strings.EqualFold(name, "FLAGS") {
+			value = sortFlags(value)
+		}
+		items = append(items, name+" "+value)
+	}
+	sort.Strings(items)
+	return items, true
+}
+
+func sortFlags(list string) string {
+	var flags []string
+	for _, flag := range strings.Fields(strings.Trim(list, "()")) {
+		if !strings.EqualFold(flag, `\Recent`) {
+			flags = append(flags, flag)
+		}
+	}
+	sort.Strings(flags)
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+// tokenLen reports the length of the string, literal, list or
+// atom at the start of s, or -1 if it is malformed.
+// Atoms may include bracketed sections, as in BODY[HEADER.FIELDS (TO)].
+func tokenLen(s string) int {
+	if s == "" {
+		return -1
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+		return -1
+	case '{':
+		i := strings.Index(s, "}\r\n")
+		if i < 0 {
+			return -1
+		}
+		n, err := strconv.Atoi(s[1:i])
+		if err != nil || i+3+n > len(s) {
+			return -1
+		}
+		return i + 3 + n
+	case '(':
+		for i := 1; i < len(s); {
+			switch s[i] {
+			case ')':
+				return i + 1
+			case ' ':
+				i++
+			default:
+				n := tokenLen(s[i:])
+				if n <= 0 {
+					return -1
+				}
+				i += n
+			}
+		}
+		return -1
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ', ')':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// lineDiff reports the lines removed from a and added in b,
+// with the lines common to both for context.
+// It reports "" if a and b are the same.
+func lineDiff(a, b []string) string {
+	// lcs[i][j] is the length of the longest common
+	// subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	if lcs[0][0] == len(a) && len(a) == len(b) {
+		return ""
+	}
+
+	buf := new(strings.Builder)
+	printLine := func(prefix, line string) {
+		if strings.ContainsAny(line, "\r\n") {
+			line = strconv.Quote(line)
+		}
+		fmt.Fprintf(buf, "%s%s\n", prefix, line)
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			printLine("  ", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			printLine("- ", a[i])
+			i++
+		default:
+			printLine("+ ", b[j])
+			j++
+		}
+	}
+	return buf.String()
+}
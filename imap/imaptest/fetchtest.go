@@ -23,7 +23,7 @@ func TestFetch(t *testing.T, server *TestServer) {
 	t.Run("RFC822.SIZE", func(t *testing.T) {
 		s.t = t
 		s.write("02 UID FETCH 1,3,4 (RFC822.SIZE)\r\n")
-		s.readExpectPrefix("* 1 FETCH (RFC822.SIZE 1473573 UID 1)")
+		s.readExpectPrefix("* 1 FETCH (RFC822.SIZE 1473633 UID 1)")
 		s.readExpectPrefix("* 2 FETCH (RFC822.SIZE 598 UID 3)")
 		s.readExpectPrefix("* 3 FETCH (RFC822.SIZE 468 UID 4)")
 		s.readExpectPrefix(`02 OK`)
@@ -44,9 +44,32 @@ func TestFetch(t *testing.T, server *TestServer) {
 		s.write("02 UID FETCH 1 (ENVELOPE)\r\n")
 		// TODO: is UTF-7 encoding the subject line right?
 		// That's not how MIME header unicode encoding works.
-		s.readExpect(`\(ENVELOPE \(".*Oct 2018 .* Events\&AKDYPd6A-" .* organizers spaceapps.nyc\) .* \("David Crawshaw" NIL david zentus.com\) .* "<10b5.*mcdlv.net>"\) UID 1\)`)
+		s.readExpect(`\(ENVELOPE \("Thu, 11 Oct 2018 02:42:50 \+0000" ".* Events\&AKDYPd6A-" ` +
+			`\(\("Space Apps NYC Organizers" NIL "organizers" "spaceapps.nyc"\)\) ` + // from
+			`\(\("Space Apps NYC Organizers" NIL "organizers" "spaceapps.nyc"\)\) ` + // sender
+			`\(\("Space Apps NYC Organizers" NIL "organizers" "spaceapps.nyc"\)\) ` + // reply-to
+			`\(\("David Crawshaw" NIL "david" "zentus.com"\)\) NIL NIL NIL "<10b5.*mcdlv.net>"\) UID 1\)`)
 		s.readExpectPrefix(`02 OK`)
 	})
+	t.Run("HEADER.FIELDS", func(t *testing.T) {
+		s.t = t
+		// Common fields, some stores keep them apart from the headers.
+		s.write("02 UID FETCH 4 (BODY.PEEK[HEADER.FIELDS (FROM SUBJECT LIST-ID)])\r\n")
+		s.readExpectPrefix(`* 3 FETCH (UID 4 BODY[HEADER.FIELDS (From Subject List-ID)] {41}`)
+		s.readExpectPrefix(`From: joe@spilled.ink`)
+		s.readExpectPrefix(`Subject: Hello`)
+		s.read()
+		s.readExpectPrefix(`)`)
+		s.readExpectPrefix(`02 OK`)
+
+		s.write("03 UID FETCH 4 (BODY.PEEK[HEADER.FIELDS (DATE MIME-VERSION)])\r\n")
+		s.readExpectPrefix(`* 3 FETCH (UID 4 BODY[HEADER.FIELDS (Date MIME-Version)] {60}`)
+		s.readExpectPrefix(`Date: Fri, 13 Jul 2018 16:39:01 -0000`)
+		s.readExpectPrefix(`MIME-Version: 1.0`)
+		s.read()
+		s.readExpectPrefix(`)`)
+		s.readExpectPrefix(`03 OK`)
+	})
 	t.Run("INTERNALDATE", func(t *testing.T) {
 		s.t = t
 		s.write("02 UID FETCH 1 (INTERNALDATE)\r\n")
@@ -0,0 +1,266 @@
+package imaptest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"spilled.ink/imap/imapserver"
+)
+
+// A script is an IMAP conversation read from a file in the
+// testdata/imaptest directory at the repository root.
+//
+// Each line of a script is an action:
+//
+//	# comment           ignored, as are blank lines
+//	session NAME        open a connection named NAME, or switch to it
+//	select MAILBOX      SELECT MAILBOX, ignoring the untagged responses
+//	> LINE              send LINE, CRLF is added
+//	< PREFIX            the next response line starts with PREFIX
+//	= LINE              the next response line is LINE
+//	~ REGEXP            the next response line matches REGEXP
+//	{                   the expectations up to the closing }
+//	}                   match the next lines in any order
+//
+// Lines before the first session line use a session named main.
+// A new session starts before the server greeting, and is not
+// logged in. In LINE, PREFIX and REGEXP, ${user} and ${pass} are
+// replaced by the username and password of the script.
+//
+// Every script is run by a user of its own, created with the same
+// mailboxes and messages as the test user, so scripts may change
+// the mailboxes.
+type script struct {
+	name    string
+	actions []scriptAction
+}
+
+type scriptAction struct {
+	line   int    // line number in the script file
+	op     string // "session", "select", ">", "<", "=", "~", "{"
+	arg    string
+	expect []scriptAction // for "{"
+}
+
+// parseScript parses a script read from r.
+// The name of the script is used in error messages.
+func parseScript(name string, r io.Reader) (*script, error) {
+	sc := &script{name: name}
+	var group *scriptAction
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action := scriptAction{line: lineNum}
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			action.op, action.arg = line[:i], line[i+1:]
+		} else {
+			action.op = line
+		}
+		switch action.op {
+		case "session", "select":
+			if group != nil {
+				return nil, fmt.Errorf("%s:%d: %s inside { }", name, lineNum, action.op)
+			}
+			if action.arg == "" {
+				return nil, fmt.Errorf("%s:%d: %s needs a name", name, lineNum, action.op)
+			}
+		case ">":
+			if group != nil {
+				return nil, fmt.Errorf("%s:%d: send inside { }", name, lineNum)
+			}
+		case "<", "=":
+		case "~":
+			if _, err := regexp.Compile(action.arg); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, lineNum, err)
+			}
+		case "{":
+			if group != nil {
+				return nil, fmt.Errorf("%s:%d: nested {", name, lineNum)
+			}
+			sc.actions = append(sc.actions, action)
+			group = &sc.actions[len(sc.actions)-1]
+			continue
+		case "}":
+			if group == nil {
+				return nil, fmt.Errorf("%s:%d: } without {", name, lineNum)
+			}
+			group = nil
+			continue
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", name, lineNum, action.op)
+		}
+		if group != nil {
+			group.expect = append(group.expect, action)
+		} else {
+			sc.actions = append(sc.actions, action)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if group != nil {
+		return nil, fmt.Errorf("%s:%d: { is not closed", name, group.line)
+	}
+	return sc, nil
+}
+
+// loadScripts parses the scripts in the testdata/imaptest directory.
+func loadScripts() ([]*script, error) {
+	dir, err := testdataDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "imaptest", "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var scripts []*script
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		sc, err := parseScript(name, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, sc)
+	}
+	return scripts, nil
+}
+
+// TestScripts runs each script in testdata/imaptest.
+func TestScripts(t *testing.T, server *TestServer) {
+	scripts, err := loadScripts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no scripts in testdata/imaptest")
+	}
+	t.Run("Scripts", func(t *testing.T) {
+		for _, sc := range scripts {
+			sc := sc
+			t.Run(sc.name, func(t *testing.T) {
+				t.Parallel()
+				server.runScript(t, sc)
+			})
+		}
+	})
+}
+
+// addScriptUser adds a user to run script sc, with the same
+// mailboxes as the user added by InitTestServer.
+func (server *TestServer) addScriptUser(sc *script) (username, password string, err error) {
+	username = "script-" + strings.ToLower(sc.name) + "@spilled.ink"
+	password = "aaaabbbbccccdddd"
+	if err := server.extras.AddUser([]byte(username), []byte(password)); err != nil {
+		return "", "", fmt.Errorf("AddUser: %v", err)
+	}
+	c := &imapserver.Conn{Context: context.Background()}
+	_, session, err := server.dataStore.Login(c, []byte(username), []byte(password))
+	if err != nil {
+		return "", "", fmt.Errorf("login: %v", err)
+	}
+	defer session.Close()
+	if err := initUser(server.s.Filer, session); err != nil {
+		return "", "", fmt.Errorf("init user: %v", err)
+	}
+	return username, password, nil
+}
+
+func (server *TestServer) runScript(t *testing.T, sc *script) {
+	username, password, err := server.addScriptUser(sc)
+	if err != nil {
+		t.Fatalf("%s: %v", sc.name, err)
+	}
+	expand := strings.NewReplacer("${user}", username, "${pass}", password).Replace
+	expandRegexp := strings.NewReplacer(
+		"${user}", regexp.QuoteMeta(username),
+		"${pass}", regexp.QuoteMeta(password),
+	).Replace
+
+	sessions := make(map[string]*TestSession)
+	defer func() {
+		for _, s := range sessions {
+			s.Shutdown()
+		}
+	}()
+	var s *TestSession
+	open := func(name string) {
+		s = sessions[name]
+		if s == nil {
+			s = server.OpenSession(t)
+			s.SetName(name)
+			sessions[name] = s
+		}
+	}
+
+	// match reports whether the response line got
+	// meets the expectation a.
+	match := func(a scriptAction, got string) bool {
+		switch a.op {
+		case "<":
+			return strings.HasPrefix(got, expand(a.arg))
+		case "=":
+			return got == expand(a.arg)+"\r"
+		case "~":
+			return regexp.MustCompile(expandRegexp(a.arg)).MatchString(got)
+		}
+		panic("imaptest: bad script expectation " + a.op)
+	}
+
+	for _, a := range sc.actions {
+		if s == nil && a.op != "session" {
+			open("main")
+		}
+		switch a.op {
+		case "session":
+			open(a.arg)
+		case "select":
+			s.write("sel SELECT %s\r\n", expand(a.arg))
+			for {
+				got := s.read()
+				if strings.HasPrefix(got, "sel ") {
+					if !strings.HasPrefix(got, "sel OK") {
+						t.Fatalf("%s:%d: %sSELECT %s: %q", sc.name, a.line, s.prefix, a.arg, got)
+					}
+					break
+				}
+			}
+		case ">":
+			s.write("%s\r\n", expand(a.arg))
+		case "<", "=", "~":
+			if got := s.read(); !match(a, got) {
+				t.Fatalf("%s:%d: %sresponse %q, want %s %s", sc.name, a.line, s.prefix, got, a.op, a.arg)
+			}
+		case "{":
+			matched := make([]bool, len(a.expect))
+		lines:
+			for range a.expect {
+				got := s.read()
+				for i, e := range a.expect {
+					if !matched[i] && match(e, got) {
+						matched[i] = true
+						continue lines
+					}
+				}
+				t.Fatalf("%s:%d: %sresponse %q matches nothing in { }", sc.name, a.line, s.prefix, got)
+			}
+		}
+	}
+}
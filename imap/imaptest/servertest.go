@@ -30,30 +30,28 @@ type TestFn struct {
 }
 
 var Tests = []TestFn{
-	{"UIDExpunge", TestUIDExpunge},
-	{"Flags", TestFlags},
+	{"Scripts", TestScripts},
 	{"Append", TestAppend},
-	{"Copy", TestCopy},
-	{"Move", TestMove},
 	{"Immutable", TestImmutable},
 	{"FetchBody", TestFetchBody},
 	{"FetchModSeq", TestFetchModSeq},
 	{"UnchangedSince", TestUnchangedSince},
 	{"Concurrency", TestConcurrency},
 	{"Idle", TestIdle},
+	{"Timeout", TestTimeout},
+	{"IdleHeartbeat", TestIdleHeartbeat},
+	{"SlowCommandLog", TestSlowCommandLog},
+	{"ConnLimits", TestConnLimits},
+	{"StartTLS", TestStartTLS},
+	{"UserFiler", TestUserFiler},
+	{"Diff", TestDiff},
 }
 
 // TestImmutable is a collection of tests that do not change the state
 // of the IMAP server, so they can be run in parallel on the same server.
 func TestImmutable(t *testing.T, server *TestServer) {
 	immutableTests := []TestFn{
-		{"NonAuth", TestNonAuth},
-		{"Login", TestLogin},
-		{"Search", TestSearch},
 		{"ESearch", TestESearch},
-		{"Status", TestStatus},
-		{"Select", TestSelect},
-		{"List", TestList},
 		{"Fetch", TestFetch},
 		{"Compress", TestCompress},
 		{"XApplePushService", TestXApplePushService},
@@ -104,13 +102,62 @@ func InitTestServer(filer *iox.Filer, dataStore imapserver.DataStore, extras Dat
 			TLSConfig: tlstest.ServerConfig,
 			DataStore: dataStore,
 			Filer:     filer,
-			/*Debug: func(sessionID string) io.WriteCloser {
+			/*Debug: func(sessionID string, userID int64) io.WriteCloser {
 				// TODO: ditch connLog and use this log instead
 				return os.Stdout
 			},*/
 		},
 	}
+	if err := s.serve(); err != nil {
+		return nil, fmt.Errorf("imaptest.InitTestServer: %v", err)
+	}
+	return s, nil
+}
+
+// withConfig starts another server on the data store of server.
+// The new server is modified by fn before it starts serving.
+func (server *TestServer) withConfig(fn func(*imapserver.Server)) (*TestServer, error) {
+	s := &TestServer{
+		dataStore: server.dataStore,
+		extras:    server.extras,
+		s: &imapserver.Server{
+			TLSConfig: tlstest.ServerConfig,
+			DataStore: server.dataStore,
+			Filer:     server.s.Filer,
+		},
+	}
+	fn(s.s)
+	if err := s.serve(); err != nil {
+		return nil, fmt.Errorf("imaptest: %v", err)
+	}
+	return s, nil
+}
+
+// withStartTLS starts another server on the data store of server
+// that serves cleartext connections, upgraded with STARTTLS.
+func (server *TestServer) withStartTLS() (*TestServer, error) {
+	s := &TestServer{
+		dataStore: server.dataStore,
+		extras:    server.extras,
+		s: &imapserver.Server{
+			TLSConfig: tlstest.ServerConfig,
+			DataStore: server.dataStore,
+			Filer:     server.s.Filer,
+		},
+		starttls: true,
+	}
+	if err := s.serve(); err != nil {
+		return nil, fmt.Errorf("imaptest: %v", err)
+	}
+	return s, nil
+}
+
+func (s *TestServer) serve() error {
+	logf := s.s.Logf // set by a withConfig test to watch the log
 	s.s.Logf = func(format string, v ...interface{}) {
+		if logf != nil {
+			logf(format, v...)
+		}
 		if s.t == nil {
 			panic(fmt.Sprintf("imaptest.TestServer: imapserver called logf before TestServer.Init: "+format, v...))
 		}
@@ -119,11 +166,15 @@ func InitTestServer(filer *iox.Filer, dataStore imapserver.DataStore, extras Dat
 
 	ln, err := net.Listen("tcp", ":0")
 	if err != nil {
-		return nil, fmt.Errorf("imaptest.InitTestServer: %v", err)
+		return err
 	}
 	s.addr = ln.Addr()
 	go func() {
-		if err := s.s.ServeTLS(ln); err != nil {
+		serve := s.s.ServeTLS
+		if s.starttls {
+			serve = s.s.ServeSTARTTLS
+		}
+		if err := serve(ln); err != nil {
 			if err != imapserver.ErrServerClosed {
 				if s.t == nil {
 					panic(fmt.Sprintf("bad imap test server exit: %v", err))
@@ -132,8 +183,7 @@ func InitTestServer(filer *iox.Filer, dataStore imapserver.DataStore, extras Dat
 			}
 		}
 	}()
-
-	return s, nil
+	return nil
 }
 
 func initUser(filer *iox.Filer, s imap.Session) error {
@@ -146,14 +196,10 @@ func initUser(filer *iox.Filer, s imap.Session) error {
 		return err
 	}
 
-	dir, err := os.Getwd()
+	dir, err := testdataDir()
 	if err != nil {
 		return err
 	}
-	for len(dir) > 1 && filepath.Base(dir) != "spilled.ink" {
-		dir = filepath.Dir(dir)
-	}
-	dir = filepath.Join(dir, "testdata")
 
 	msgFiles := []string{
 		"msg1.eml",
@@ -209,6 +255,18 @@ func initUser(filer *iox.Filer, s imap.Session) error {
 	return nil
 }
 
+// testdataDir finds the testdata directory at the repository root.
+func testdataDir() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for len(dir) > 1 && filepath.Base(dir) != "spilled.ink" {
+		dir = filepath.Dir(dir)
+	}
+	return filepath.Join(dir, "testdata"), nil
+}
+
 func crlf(input string) string { return strings.Replace(input, "\n", "\r", -1) }
 
 type TestServer struct {
@@ -217,6 +275,7 @@ type TestServer struct {
 	extras    DataStoreExtras
 	s         *imapserver.Server
 	addr      net.Addr
+	starttls  bool // sessions start in cleartext
 	sessions  []*TestSession
 }
 
@@ -250,7 +309,11 @@ func (server *TestServer) OpenSession(t *testing.T) *TestSession {
 		server: server,
 	}
 	var err error
-	s.conn, err = tls.Dial("tcp", s.server.addr.String(), tlstest.ClientConfig)
+	if server.starttls {
+		s.conn, err = net.Dial("tcp", s.server.addr.String())
+	} else {
+		s.conn, err = tls.Dial("tcp", s.server.addr.String(), tlstest.ClientConfig)
+	}
 	if err != nil {
 		t.Fatalf("imaptest.OpenSession: %v", err)
 	}
@@ -302,6 +365,24 @@ func (s *TestSession) Compress() {
 	s.bw = bufio.NewWriter(io.MultiWriter(w, &s.connLog))
 }
 
+// StartTLS starts TLS on the connection after a STARTTLS command.
+func (s *TestSession) StartTLS() {
+	host, _, err := net.SplitHostPort(s.server.addr.String())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	config := tlstest.ClientConfig.Clone()
+	config.ServerName = host
+	conn := tls.Client(s.conn, config)
+	s.conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		s.t.Fatalf("%sStartTLS: %v", s.prefix, err)
+	}
+	s.conn = conn
+	s.br = bufio.NewReader(io.TeeReader(s.conn, &s.connLog))
+	s.bw = bufio.NewWriter(io.MultiWriter(s.conn, &s.connLog))
+}
+
 func (s TestSession) Flush() error {
 	if err := s.bw.Flush(); err != nil {
 		return err
@@ -0,0 +1,58 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mailbox names are a hierarchy of levels separated by the
+// delimiter of the namespace, RFC 3501 section 5.1.1.
+// "a/b/c" is inferior to "a/b", its parent, which is inferior to "a".
+
+// CleanMailboxName returns the name CREATE makes of name.
+//
+// A trailing delimiter declares that the client intends to create
+// names under name, and is removed. A name with an empty level,
+// "/a" or "a//b", is reported as an error.
+func CleanMailboxName(name string, delim byte) (string, error) {
+	if delim == 0 {
+		return name, nil
+	}
+	if len(name) > 1 && name[len(name)-1] == delim {
+		name = name[:len(name)-1]
+	}
+	for _, level := range strings.Split(name, string(delim)) {
+		if level == "" {
+			return "", fmt.Errorf("mailbox name %q has an empty level", name)
+		}
+	}
+	return name, nil
+}
+
+// MailboxParents returns the superior names of a mailbox name,
+// outermost first: "a" and "a/b" for "a/b/c".
+func MailboxParents(name string, delim byte) (parents []string) {
+	if delim == 0 {
+		return nil
+	}
+	for i := 1; i < len(name); i++ {
+		if name[i] == delim {
+			parents = append(parents, name[:i])
+		}
+	}
+	return parents
+}
+
+// HasInferiors reports whether any of names is inferior to name.
+func HasInferiors(names []string, name string, delim byte) bool {
+	if delim == 0 {
+		return false
+	}
+	prefix := name + string(delim)
+	for _, n := range names {
+		if strings.HasPrefix(n, prefix) {
+			return true
+		}
+	}
+	return false
+}
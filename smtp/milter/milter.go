@@ -0,0 +1,497 @@
+// Package milter implements the MTA side of the Sendmail milter
+// protocol, version 6, for consulting mail filters such as rspamd
+// and clamav-milter.
+//
+// A Session carries one message: it is opened when the message
+// starts, given the SMTP events in order, and closed when the
+// message is done. The filter answers each event with a Response.
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client connects to a milter.
+type Client struct {
+	Network string        // "tcp" or "unix"
+	Addr    string        // "127.0.0.1:11332" or a socket path
+	Timeout time.Duration // per event, default 30s
+
+	// FailOpen set to true means mail is accepted without this
+	// filter when it cannot be reached or fails. Otherwise the
+	// SMTP client is told to try again later.
+	FailOpen bool
+}
+
+// Commands sent by the MTA.
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// Replies sent by the filter.
+const (
+	replyAddRcpt    = '+'
+	replyDelRcpt    = '-'
+	replyAccept     = 'a'
+	replyReplBody   = 'b'
+	replyContinue   = 'c'
+	replyDiscard    = 'd'
+	replyAddHeader  = 'h'
+	replyInsHeader  = 'i'
+	replyChgHeader  = 'm'
+	replyProgress   = 'p'
+	replyQuarantine = 'q'
+	replyReject     = 'r'
+	replySkip       = 's'
+	replyTempFail   = 't'
+	replyReplyCode  = 'y'
+)
+
+// Actions the MTA allows, SMFIF_*.
+const (
+	actAddHeaders = 1 << 0
+	actChgBody    = 1 << 1
+	actAddRcpt    = 1 << 2
+	actChgHeaders = 1 << 4
+	actQuarantine = 1 << 5
+
+	actions = actAddHeaders | actChgBody | actAddRcpt | actChgHeaders | actQuarantine
+)
+
+// Protocol steps the filter may skip, SMFIP_*.
+const (
+	optNoConnect = 1 << 0
+	optNoHelo    = 1 << 1
+	optNoMail    = 1 << 2
+	optNoRcpt    = 1 << 3
+	optNoBody    = 1 << 4
+	optNoHeaders = 1 << 5
+	optNoEOH     = 1 << 6
+	optNoData    = 1 << 9
+
+	// No reply is sent for these events.
+	optNRHeader  = 1 << 7
+	optNRConnect = 1 << 12
+	optNRHelo    = 1 << 13
+	optNRMail    = 1 << 14
+	optNRRcpt    = 1 << 15
+	optNRData    = 1 << 16
+	optNREOH     = 1 << 18
+	optNRBody    = 1 << 19
+
+	protocol = optNoConnect | optNoHelo | optNoMail | optNoRcpt | optNoBody |
+		optNoHeaders | optNoEOH | optNoData | optNRHeader | optNRConnect |
+		optNRHelo | optNRMail | optNRRcpt | optNRData | optNREOH | optNRBody
+)
+
+const version = 6
+
+// maxChunk is the largest body chunk sent to a filter.
+const maxChunk = 65535
+
+// Action is a filter's verdict.
+type Action int
+
+const (
+	Continue Action = iota
+	Accept          // accept the message, skip the remaining events
+	Reject          // permanent failure
+	TempFail        // temporary failure
+	Discard         // accept the message but drop it
+)
+
+func (a Action) String() string {
+	switch a {
+	case Continue:
+		return "continue"
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	case TempFail:
+		return "tempfail"
+	case Discard:
+		return "discard"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// Response is a filter's answer to an event. Modifications are
+// only sent in answer to the end of the body.
+type Response struct {
+	Action Action
+	Reply  string // SMTP reply for Reject or TempFail, "550 5.7.1 no"
+
+	HeaderMods []HeaderMod
+	Body       []byte // replacement body, nil if unchanged
+	AddRcpts   []string
+	Quarantine string // if set, quarantine the message for this reason
+}
+
+// HeaderMod is a change to the message header.
+type HeaderMod struct {
+	Op    HeaderOp
+	Index int // Insert: position; Change: occurrence of Name, from 1
+	Name  string
+	Value string // Change: empty deletes the header
+}
+
+type HeaderOp int
+
+const (
+	HeaderAdd HeaderOp = iota
+	HeaderInsert
+	HeaderChange
+)
+
+// Session is a connection to a filter for one message.
+type Session struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	actions  uint32 // filter wants to do
+	protocol uint32 // filter does not want
+	done     bool   // the filter accepted or rejected the message
+}
+
+// Open connects to the filter and negotiates the protocol.
+func (c *Client) Open() (*Session, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	conn, err := net.DialTimeout(c.Network, c.Addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("milter: %v", err)
+	}
+	s := &Session{
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		timeout: timeout,
+	}
+	if err := s.negotiate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("milter: %s: %v", c.Addr, err)
+	}
+	return s, nil
+}
+
+func (s *Session) negotiate() error {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[0:], version)
+	binary.BigEndian.PutUint32(b[4:], actions)
+	binary.BigEndian.PutUint32(b[8:], protocol)
+	if err := s.write(cmdOptNeg, b[:]); err != nil {
+		return err
+	}
+	code, data, err := s.read()
+	if err != nil {
+		return err
+	}
+	if code != cmdOptNeg || len(data) < 12 {
+		return fmt.Errorf("bad option negotiation reply %q", code)
+	}
+	if v := binary.BigEndian.Uint32(data[0:]); v < 2 {
+		return fmt.Errorf("unsupported protocol version %d", v)
+	}
+	s.actions = binary.BigEndian.Uint32(data[4:]) & actions
+	s.protocol = binary.BigEndian.Uint32(data[8:]) & protocol
+	return nil
+}
+
+func (s *Session) write(code byte, data []byte) error {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)+1))
+	hdr[4] = code
+	if _, err := s.conn.Write(append(hdr[:], data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Session) read() (code byte, data []byte, err error) {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.br, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > 1<<24 {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(s.br, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// event sends an event and reads the reply, unless the filter
+// asked to skip the event (skip) or not reply to it (noReply).
+func (s *Session) event(code byte, data []byte, skip, noReply uint32) (*Response, error) {
+	if s.done || s.protocol&skip != 0 {
+		return &Response{}, nil
+	}
+	if err := s.write(code, data); err != nil {
+		return nil, fmt.Errorf("milter: %v", err)
+	}
+	if s.protocol&noReply != 0 {
+		return &Response{}, nil
+	}
+	return s.response()
+}
+
+// response reads replies up to the one ending the event.
+func (s *Session) response() (*Response, error) {
+	res := &Response{}
+	for {
+		code, data, err := s.read()
+		if err != nil {
+			return nil, fmt.Errorf("milter: %v", err)
+		}
+		switch code {
+		case replyContinue, replySkip:
+			return res, nil
+		case replyAccept:
+			res.Action = Accept
+			s.done = true
+			return res, nil
+		case replyReject:
+			res.Action = Reject
+			s.done = true
+			return res, nil
+		case replyTempFail:
+			res.Action = TempFail
+			s.done = true
+			return res, nil
+		case replyDiscard:
+			res.Action = Discard
+			s.done = true
+			return res, nil
+		case replyReplyCode:
+			res.Reply = strings.TrimSpace(cstring(data))
+			if strings.HasPrefix(res.Reply, "4") {
+				res.Action = TempFail
+			} else {
+				res.Action = Reject
+			}
+			s.done = true
+			return res, nil
+		case replyProgress:
+			// The filter needs more time.
+		case replyAddHeader:
+			strs := cstrings(data)
+			if len(strs) < 2 {
+				return nil, errors.New("milter: bad add header reply")
+			}
+			res.HeaderMods = append(res.HeaderMods, HeaderMod{Op: HeaderAdd, Name: strs[0], Value: strs[1]})
+		case replyInsHeader, replyChgHeader:
+			if len(data) < 4 {
+				return nil, errors.New("milter: bad header reply")
+			}
+			strs := cstrings(data[4:])
+			if len(strs) < 2 {
+				return nil, errors.New("milter: bad header reply")
+			}
+			mod := HeaderMod{
+				Op:    HeaderInsert,
+				Index: int(binary.BigEndian.Uint32(data)),
+				Name:  strs[0],
+				Value: strs[1],
+			}
+			if code == replyChgHeader {
+				mod.Op = HeaderChange
+			}
+			res.HeaderMods = append(res.HeaderMods, mod)
+		case replyReplBody:
+			if res.Body == nil {
+				res.Body = []byte{}
+			}
+			res.Body = append(res.Body, data...)
+		case replyAddRcpt:
+			res.AddRcpts = append(res.AddRcpts, strings.Trim(cstring(data), "<>"))
+		case replyDelRcpt:
+			// Not negotiated, ignored.
+		case replyQuarantine:
+			res.Quarantine = cstring(data)
+			if res.Quarantine == "" {
+				res.Quarantine = "quarantined by filter"
+			}
+		default:
+			return nil, fmt.Errorf("milter: unknown reply %q", code)
+		}
+	}
+}
+
+func cstring(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+func cstrings(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	var strs []string
+	for _, b := range bytes.Split(data, []byte{0}) {
+		strs = append(strs, string(b))
+	}
+	return strs
+}
+
+func join(strs ...string) []byte {
+	var buf []byte
+	for _, s := range strs {
+		buf = append(buf, s...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// Macros sends sendmail macros, "j" or "{auth_authen}",
+// for the event code that follows.
+func (s *Session) macros(code byte, kv ...string) error {
+	if s.done || len(kv) == 0 {
+		return nil
+	}
+	return s.write(cmdMacro, append([]byte{code}, join(kv...)...))
+}
+
+// Connect reports the SMTP client's address. hostname is its
+// name, or the address in brackets if it has none. mtaName is the
+// name of this server, the "j" macro.
+func (s *Session) Connect(hostname string, addr net.Addr, mtaName string) (*Response, error) {
+	if err := s.macros(cmdConnect, "j", mtaName); err != nil {
+		return nil, fmt.Errorf("milter: %v", err)
+	}
+	data := join(hostname)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		family := byte('4')
+		if a.IP.To4() == nil {
+			family = '6'
+		}
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(a.Port))
+		data = append(data, family)
+		data = append(data, port[:]...)
+		data = append(data, join(a.IP.String())...)
+	default:
+		host, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			data = append(data, 'U')
+			break
+		}
+		port, _ := strconv.Atoi(portStr)
+		var portb [2]byte
+		binary.BigEndian.PutUint16(portb[:], uint16(port))
+		data = append(data, '4')
+		data = append(data, portb[:]...)
+		data = append(data, join(host)...)
+	}
+	return s.event(cmdConnect, data, optNoConnect, optNRConnect)
+}
+
+func (s *Session) Helo(name string) (*Response, error) {
+	return s.event(cmdHelo, join(name), optNoHelo, optNRHelo)
+}
+
+func (s *Session) Mail(from string) (*Response, error) {
+	if err := s.macros(cmdMail, "{mail_addr}", from); err != nil {
+		return nil, fmt.Errorf("milter: %v", err)
+	}
+	return s.event(cmdMail, join("<"+from+">"), optNoMail, optNRMail)
+}
+
+func (s *Session) Rcpt(to string) (*Response, error) {
+	if err := s.macros(cmdRcpt, "{rcpt_addr}", to); err != nil {
+		return nil, fmt.Errorf("milter: %v", err)
+	}
+	return s.event(cmdRcpt, join("<"+to+">"), optNoRcpt, optNRRcpt)
+}
+
+func (s *Session) Data() (*Response, error) {
+	return s.event(cmdData, nil, optNoData, optNRData)
+}
+
+func (s *Session) Header(name, value string) (*Response, error) {
+	return s.event(cmdHeader, join(name, value), optNoHeaders, optNRHeader)
+}
+
+func (s *Session) EOH() (*Response, error) {
+	return s.event(cmdEOH, nil, optNoEOH, optNREOH)
+}
+
+// Body sends the message body, in chunks.
+func (s *Session) Body(body []byte) (*Response, error) {
+	for len(body) > 0 {
+		n := len(body)
+		if n > maxChunk {
+			n = maxChunk
+		}
+		res, err := s.event(cmdBody, body[:n], optNoBody, optNRBody)
+		if err != nil || res.Action != Continue {
+			return res, err
+		}
+		body = body[n:]
+	}
+	return &Response{}, nil
+}
+
+// EOB ends the message. The response carries the filter's
+// modifications, if it has not already decided.
+func (s *Session) EOB() (*Response, error) {
+	if s.done {
+		return &Response{}, nil
+	}
+	if err := s.write(cmdEOB, nil); err != nil {
+		return nil, fmt.Errorf("milter: %v", err)
+	}
+	res, err := s.response()
+	if err != nil {
+		return nil, err
+	}
+	s.done = true
+	if s.actions&actAddHeaders == 0 && s.actions&actChgHeaders == 0 {
+		res.HeaderMods = nil
+	}
+	if s.actions&actChgBody == 0 {
+		res.Body = nil
+	}
+	if s.actions&actAddRcpt == 0 {
+		res.AddRcpts = nil
+	}
+	if s.actions&actQuarantine == 0 {
+		res.Quarantine = ""
+	}
+	return res, nil
+}
+
+// Close ends the session.
+func (s *Session) Close() error {
+	s.write(cmdQuit, nil)
+	return s.conn.Close()
+}
@@ -0,0 +1,194 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// filter is a fake milter. It negotiates every action, replies
+// to each event with reply[code] or continue, and records the
+// events it sees.
+type filter struct {
+	ln     net.Listener
+	reply  map[byte][][]byte // event code -> reply packets
+	events chan byte
+}
+
+func newFilter(t *testing.T, reply map[byte][][]byte) *filter {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &filter{ln: ln, reply: reply, events: make(chan byte, 100)}
+	go f.serve()
+	return f
+}
+
+func (f *filter) client() *Client {
+	return &Client{Network: "tcp", Addr: f.ln.Addr().String(), Timeout: 5 * time.Second}
+}
+
+func (f *filter) serve() {
+	conn, err := f.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	send := func(pkt []byte) {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(pkt)))
+		conn.Write(append(hdr[:], pkt...))
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return
+		}
+		code := buf[0]
+		switch code {
+		case cmdOptNeg:
+			var b [13]byte
+			b[0] = cmdOptNeg
+			binary.BigEndian.PutUint32(b[1:], version)
+			binary.BigEndian.PutUint32(b[5:], actions)
+			send(b[:])
+			continue
+		case cmdMacro:
+			continue
+		case cmdQuit:
+			f.events <- code
+			return
+		}
+		f.events <- code
+		if pkts, ok := f.reply[code]; ok {
+			for _, pkt := range pkts {
+				send(pkt)
+			}
+			continue
+		}
+		send([]byte{replyContinue})
+	}
+}
+
+func (f *filter) close() []byte {
+	f.ln.Close()
+	var events []byte
+	for {
+		select {
+		case code := <-f.events:
+			events = append(events, code)
+		case <-time.After(100 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	f := newFilter(t, map[byte][][]byte{
+		cmdEOB: {
+			append([]byte{replyAddHeader}, join("X-Spam", "yes")...),
+			append([]byte{replyChgHeader, 0, 0, 0, 1}, join("Subject", "[SPAM] hi")...),
+			append([]byte{replyQuarantine}, join("spam")...),
+			append([]byte{replyAddRcpt}, join("<archive@example.com>")...),
+			{replyAccept},
+		},
+	})
+	s, err := f.client().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	steps := []func() (*Response, error){
+		func() (*Response, error) { return s.Connect("[192.0.2.1]", addr, "mx.example.com") },
+		func() (*Response, error) { return s.Helo("mail.example.org") },
+		func() (*Response, error) { return s.Mail("from@example.org") },
+		func() (*Response, error) { return s.Rcpt("to@example.com") },
+		func() (*Response, error) { return s.Data() },
+		func() (*Response, error) { return s.Header("Subject", "hi") },
+		func() (*Response, error) { return s.EOH() },
+		func() (*Response, error) { return s.Body([]byte("hello\r\n")) },
+	}
+	for i, step := range steps {
+		res, err := step()
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res.Action != Continue {
+			t.Fatalf("step %d: action %v, want continue", i, res.Action)
+		}
+	}
+	res, err := s.EOB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Response{
+		Action: Accept,
+		HeaderMods: []HeaderMod{
+			{Op: HeaderAdd, Name: "X-Spam", Value: "yes"},
+			{Op: HeaderChange, Index: 1, Name: "Subject", Value: "[SPAM] hi"},
+		},
+		AddRcpts:   []string{"archive@example.com"},
+		Quarantine: "spam",
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("EOB response:\n%+v\nwant:\n%+v", res, want)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	events := string(f.close())
+	if wantEvents := "CHMRTLNBEQ"; events != wantEvents {
+		t.Errorf("filter events %q, want %q", events, wantEvents)
+	}
+}
+
+func TestSessionReject(t *testing.T) {
+	f := newFilter(t, map[byte][][]byte{
+		cmdRcpt: {append([]byte{replyReplyCode}, join("550 5.7.1 no such user")...)},
+	})
+	s, err := f.client().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := s.Mail("from@example.org"); err != nil || res.Action != Continue {
+		t.Fatalf("Mail: %+v, %v", res, err)
+	}
+	res, err := s.Rcpt("to@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != Reject || res.Reply != "550 5.7.1 no such user" {
+		t.Errorf("Rcpt: %+v, want reject", res)
+	}
+	// The filter has decided, later events are not sent.
+	if res, err := s.Data(); err != nil || res.Action != Continue {
+		t.Errorf("Data: %+v, %v", res, err)
+	}
+	s.Close()
+	if events, want := string(f.close()), "MRQ"; events != want {
+		t.Errorf("filter events %q, want %q", events, want)
+	}
+}
+
+func TestOpenFails(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	c := &Client{Network: "tcp", Addr: addr, Timeout: time.Second}
+	if _, err := c.Open(); err == nil {
+		t.Error("Open of closed address succeeded")
+	}
+}
@@ -0,0 +1,372 @@
+package smtpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// DefaultIdleTimeout is how long an unused connection is kept open
+// when Client.IdleTimeout is zero. It is well under the five minutes
+// RFC 5321 section 4.5.3.2.7 lets a server wait for the next command.
+const DefaultIdleTimeout = 60 * time.Second
+
+// DefaultMaxMsgsPerConn is the number of messages sent on a connection
+// before it is closed when Client.MaxMsgsPerConn is zero. Large
+// providers limit the messages they accept on one connection.
+const DefaultMaxMsgsPerConn = 100
+
+// resetTimeout bounds the RSET that checks an idle connection
+// is still open before it is reused.
+const resetTimeout = 30 * time.Second
+
+// PoolStats counts the connections made by a Client.
+type PoolStats struct {
+	Dialed    int64   // new connections
+	Reused    int64   // messages sent on an idle connection
+	Stale     int64   // idle connections the server had closed
+	Expired   int64   // idle connections closed after the IdleTimeout
+	ReuseRate float64 // Reused / (Dialed + Reused)
+	Open      int     // connections open now, idle or in use
+	Idle      int     // connections idle now
+}
+
+// conn is a connection to an MX host.
+type conn struct {
+	host      string // "mx.example.com:25", the pool key
+	nc        net.Conn
+	c         *smtp.Client
+	msgs      int         // messages sent
+	idleTimer *time.Timer // set while idle
+
+	tls      bool // STARTTLS succeeded, connections without TLS are not reused
+	verified bool // the certificate is valid for the host name
+}
+
+// hostConns are the connections to an MX host.
+type hostConns struct {
+	open    int     // idle or in use
+	idle    []*conn // most recently used last
+	waiters []chan struct{}
+}
+
+// hostConns reports the connections to host. c.mu must be held.
+func (c *Client) hostConns(host string) *hostConns {
+	if c.hosts == nil {
+		c.hosts = make(map[string]*hostConns)
+	}
+	h := c.hosts[host]
+	if h == nil {
+		h = &hostConns{}
+		c.hosts[host] = h
+	}
+	return h
+}
+
+// wake lets the first goroutine waiting for a connection to
+// host try again. c.mu must be held.
+func (c *Client) wake(host string, h *hostConns) {
+	if len(h.waiters) > 0 {
+		close(h.waiters[0])
+		h.waiters = h.waiters[1:]
+	}
+	if h.open == 0 && len(h.waiters) == 0 && c.hosts[host] == h {
+		delete(c.hosts, host)
+	}
+}
+
+// getConn finds a connection to an MX host for a message.
+//
+// An idle connection is reused if the server still answers.
+// Otherwise a new connection is made, once the host has fewer
+// than MaxConnsPerHost open. The connection counts against the
+// limit of NewClient until it is returned with putConn.
+//
+// With tlsOptional, a new connection to a server that does not
+// offer STARTTLS is used without TLS.
+func (c *Client) getConn(ctx context.Context, host string, tlsOptional bool) (pc *conn, err error) {
+	for {
+		c.mu.Lock()
+		h := c.hostConns(host)
+		if n := len(h.idle); n > 0 {
+			pc = h.idle[n-1]
+			h.idle = h.idle[:n-1]
+			pc.idleTimer.Stop()
+			pc.idleTimer = nil
+			c.mu.Unlock()
+			break
+		}
+		if c.MaxConnsPerHost <= 0 || h.open < c.MaxConnsPerHost {
+			h.open++
+			c.mu.Unlock()
+			break
+		}
+		wait := make(chan struct{})
+		h.waiters = append(h.waiters, wait)
+		c.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			c.mu.Lock()
+			woken := true
+			for i, w := range h.waiters {
+				if w == wait {
+					h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+					woken = false
+					break
+				}
+			}
+			if woken {
+				c.wake(host, h) // pass it on
+			}
+			c.mu.Unlock()
+			return nil, context.Canceled
+		}
+	}
+
+	select {
+	case c.limiter <- struct{}{}:
+	case <-ctx.Done():
+		if pc == nil {
+			c.closed(host)
+		} else {
+			c.release(pc, true)
+		}
+		return nil, context.Canceled
+	}
+
+	if pc != nil {
+		pc.nc.SetDeadline(time.Now().Add(resetTimeout))
+		err := pc.c.Reset()
+		pc.nc.SetDeadline(time.Time{})
+		if err == nil {
+			c.mu.Lock()
+			c.stats.Reused++
+			c.mu.Unlock()
+			return pc, nil
+		}
+		// Closed by the server, replace it.
+		pc.c.Close()
+		c.mu.Lock()
+		c.stats.Stale++
+		c.mu.Unlock()
+	}
+
+	pc, err = c.dial(ctx, host, tlsOptional)
+	if err != nil {
+		<-c.limiter
+		c.closed(host)
+		return nil, err
+	}
+	c.mu.Lock()
+	c.stats.Dialed++
+	c.mu.Unlock()
+	return pc, nil
+}
+
+func (c *Client) dial(ctx context.Context, host string, tlsOptional bool) (*conn, error) {
+	hostname, _, _ := net.SplitHostPort(host)
+	dialer := &net.Dialer{
+		Resolver:  c.Resolver,
+		LocalAddr: c.LocalAddr,
+	}
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	stop := watch(ctx, nc)
+	mxConn, err := smtp.NewClient(nc, hostname)
+	if err != nil {
+		stop()
+		nc.Close()
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		// TODO: do better for servers we know we can trust:
+		// https://starttls-everywhere.org/
+		InsecureSkipVerify: true,
+	}
+	if err = mxConn.Hello(c.LocalHostname); err == nil {
+		if ok, _ := mxConn.Extension("STARTTLS"); ok || !tlsOptional {
+			err = mxConn.StartTLS(tlsConfig)
+		}
+	}
+	if !stop() && err == nil {
+		err = context.Canceled
+	}
+	if err != nil {
+		mxConn.Close()
+		return nil, err
+	}
+	pc := &conn{host: host, nc: nc, c: mxConn}
+	if state, ok := mxConn.TLSConnectionState(); ok {
+		pc.tls = true
+		pc.verified = c.verify(state, hostname) == nil
+	}
+	return pc, nil
+}
+
+// verify checks the certificate of a TLS connection to hostname.
+// Connections are made without verification, as most MX hosts
+// have no valid certificate, but REQUIRETLS mail needs one.
+func (c *Client) verify(state tls.ConnectionState, hostname string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       strings.TrimSuffix(hostname, "."),
+		Roots:         c.rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// putConn returns a connection from getConn. A reusable connection
+// is kept idle for the next message to its host, unless it has sent
+// MaxMsgsPerConn messages. Other connections are closed.
+func (c *Client) putConn(pc *conn, reusable bool) {
+	<-c.limiter
+	c.release(pc, reusable)
+}
+
+func (c *Client) release(pc *conn, reusable bool) {
+	idleTimeout := c.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	maxMsgs := c.MaxMsgsPerConn
+	if maxMsgs == 0 {
+		maxMsgs = DefaultMaxMsgsPerConn
+	}
+
+	c.mu.Lock()
+	h := c.hostConns(pc.host)
+	if reusable && pc.tls && idleTimeout > 0 && pc.msgs < maxMsgs {
+		h.idle = append(h.idle, pc)
+		pc.idleTimer = time.AfterFunc(idleTimeout, func() { c.expire(pc) })
+		c.wake(pc.host, h)
+		c.mu.Unlock()
+		return
+	}
+	h.open--
+	c.wake(pc.host, h)
+	c.mu.Unlock()
+
+	if reusable {
+		quit(pc)
+	} else {
+		pc.c.Close()
+	}
+}
+
+// closed records that a connection to host was not made or was closed.
+func (c *Client) closed(host string) {
+	c.mu.Lock()
+	h := c.hostConns(host)
+	h.open--
+	c.wake(host, h)
+	c.mu.Unlock()
+}
+
+// expire closes a connection that has been idle for the IdleTimeout.
+func (c *Client) expire(pc *conn) {
+	c.mu.Lock()
+	h := c.hosts[pc.host]
+	if h == nil || !removeIdle(h, pc) {
+		c.mu.Unlock()
+		return // reused as the timer fired
+	}
+	pc.idleTimer = nil
+	h.open--
+	c.stats.Expired++
+	c.wake(pc.host, h)
+	c.mu.Unlock()
+
+	quit(pc)
+}
+
+func removeIdle(h *hostConns, pc *conn) bool {
+	for i, idle := range h.idle {
+		if idle == pc {
+			h.idle = append(h.idle[:i], h.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// CloseIdle closes the idle connections.
+// Connections in use are closed when their message is sent.
+func (c *Client) CloseIdle() {
+	var idle []*conn
+	c.mu.Lock()
+	for host, h := range c.hosts {
+		for _, pc := range h.idle {
+			pc.idleTimer.Stop()
+			pc.idleTimer = nil
+			h.open--
+		}
+		idle = append(idle, h.idle...)
+		h.idle = nil
+		c.wake(host, h)
+	}
+	c.mu.Unlock()
+
+	for _, pc := range idle {
+		quit(pc)
+	}
+}
+
+// PoolStats reports the connections made since the Client was created.
+func (c *Client) PoolStats() PoolStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	if n := stats.Dialed + stats.Reused; n > 0 {
+		stats.ReuseRate = float64(stats.Reused) / float64(n)
+	}
+	for _, h := range c.hosts {
+		stats.Open += h.open
+		stats.Idle += len(h.idle)
+	}
+	return stats
+}
+
+// quit politely closes a connection.
+func quit(pc *conn) {
+	pc.nc.SetDeadline(time.Now().Add(resetTimeout))
+	if err := pc.c.Quit(); err != nil {
+		pc.c.Close()
+	}
+}
+
+// watch closes nc if ctx is done before stop is called.
+// Stop reports whether nc is still open.
+func watch(ctx context.Context, nc net.Conn) (stop func() bool) {
+	done := make(chan struct{})
+	open := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+			open <- false
+		case <-done:
+			open <- true
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-open
+	}
+}
@@ -2,13 +2,19 @@ package smtpclient
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"net"
 	"net/smtp"
 	"net/textproto"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"spilled.ink/email/dsn"
 )
 
 type Client struct {
@@ -16,7 +22,34 @@ type Client struct {
 	LocalAddr     net.Addr // address on this host to send from
 	Resolver      *net.Resolver
 
-	limiter chan struct{} // per open connection
+	// LookupMX, if set, is used instead of Resolver to find the
+	// MX records of recipient domains, for example to cache them.
+	LookupMX func(ctx context.Context, domain string) (mxs []*net.MX, ttl int, err error)
+
+	// Connections to an MX host are reused for later messages to
+	// it, so large providers are not asked to accept a connection
+	// for every message.
+	//
+	// MaxConnsPerHost limits the connections open to each MX host,
+	// idle or in use. Zero means no limit beyond that of NewClient,
+	// which counts only the connections in use.
+	//
+	// IdleTimeout is how long an unused connection is kept open,
+	// zero means DefaultIdleTimeout, negative disables reuse.
+	//
+	// MaxMsgsPerConn is the number of messages sent on a connection
+	// before it is closed, zero means DefaultMaxMsgsPerConn.
+	MaxConnsPerHost int
+	IdleTimeout     time.Duration
+	MaxMsgsPerConn  int
+
+	limiter chan struct{}  // per connection in use
+	port    string         // of MX hosts, "25" unless testing
+	rootCAs *x509.CertPool // nil for the system roots, set when testing
+
+	mu    sync.Mutex
+	hosts map[string]*hostConns // keyed by "host:port"
+	stats PoolStats
 }
 
 func NewClient(localHostname string, maxConcurrent int) *Client {
@@ -24,33 +57,89 @@ func NewClient(localHostname string, maxConcurrent int) *Client {
 		Resolver:      net.DefaultResolver,
 		LocalHostname: localHostname,
 		limiter:       make(chan struct{}, maxConcurrent),
+		port:          "25",
 	}
 }
 
+// Envelope is the SMTP envelope of a message.
+type Envelope struct {
+	From       string
+	Recipients []Recipient
+	SMTPUTF8   bool // addresses or headers use UTF-8, RFC 6531
+
+	// Delivery status notification parameters, RFC 3461.
+	Ret   dsn.Ret
+	EnvID string
+
+	// RequireTLS is the RFC 8689 REQUIRETLS parameter. The message
+	// is only sent to MX hosts with a verified TLS certificate that
+	// support REQUIRETLS, others fail it permanently with 5.7.10.
+	//
+	// The MX host name itself is not authenticated, as that needs
+	// DNSSEC or MTA-STS.
+	RequireTLS bool
+
+	// TLSOptional is set by a "TLS-Required: No" header, RFC 8689
+	// section 5. The message is sent without TLS to servers that
+	// do not offer STARTTLS. It is ignored with RequireTLS.
+	TLSOptional bool
+}
+
+// Recipient is an envelope recipient.
+type Recipient struct {
+	Addr string
+
+	// Delivery status notification parameters, RFC 3461.
+	Notify dsn.Notify // 0 if not given
+	ORcpt  string     // "rfc822;bob@example.com"
+}
+
 type Delivery struct {
 	Recipient string
 	Code      int
 	Details   string
 	Date      time.Time
 	Error     error
+
+	RemoteMTA string // host name of the server the delivery was made to
+	RemoteDSN bool   // server accepted the RFC 3461 DSN parameters
 }
 
 func (d Delivery) Success() bool     { return d.Code == 250 && d.Error == nil }
 func (d Delivery) PermFailure() bool { return d.Code >= 500 }
 func (d Delivery) TempFailure() bool { return (d.Code >= 400 && d.Code < 500) || d.Error != nil }
 
-func (c *Client) Send(ctx context.Context, from string, recipients []string, contents io.ReaderAt, contentSize int64) (results []Delivery, err error) {
-	mxDomain := make(map[string]string) // domain name -> MX record (a local lookup cache)
-	spools := make(map[string][]string) // MX spool -> recipients
+func (c *Client) lookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	if c.LookupMX != nil {
+		mxs, _, err := c.LookupMX(ctx, domain)
+		return mxs, err
+	}
+	return c.Resolver.LookupMX(ctx, domain)
+}
+
+// Send delivers a message to each of the recipients' MX servers.
+//
+// If env.SMTPUTF8 is set, the addresses or headers of the message may
+// use UTF-8 (RFC 6531). Servers that do not support SMTPUTF8 are sent
+// the IDNA ASCII form of each domain, and recipients that cannot be
+// written in ASCII fail permanently.
+//
+// The DSN parameters of env are passed on to servers that support them.
+func (c *Client) Send(ctx context.Context, env *Envelope, contents io.ReaderAt, contentSize int64) (results []Delivery, err error) {
+	mxDomain := make(map[string]string)    // domain name -> MX record (a local lookup cache)
+	spools := make(map[string][]Recipient) // MX spool -> recipients
 
-	for _, to := range recipients {
-		domain := to[strings.LastIndexByte(to, '@')+1:]
+	for _, to := range env.Recipients {
+		domain := to.Addr[strings.LastIndexByte(to.Addr, '@')+1:]
+		if d, err := idna.Lookup.ToASCII(domain); err == nil {
+			domain = d
+		}
 		mxAddr := mxDomain[domain]
 		if mxAddr != "" {
 			spools[mxAddr] = append(spools[mxAddr], to)
 			continue
 		}
-		mxs, err := c.Resolver.LookupMX(ctx, domain)
+		mxs, err := c.lookupMX(ctx, domain)
 		if err != nil {
 			continue
 		}
@@ -84,7 +173,7 @@ func (c *Client) Send(ctx context.Context, from string, recipients []string, con
 	go func() {
 		for mxAddr, rcpts := range spools {
 			r := io.NewSectionReader(contents, 0, contentSize)
-			results := c.send(ctx, mxAddr+":25", from, rcpts, r)
+			results := c.send(ctx, mxAddr+":"+c.port, env, rcpts, r)
 			for _, res := range results {
 				resultsCh <- res
 			}
@@ -98,10 +187,12 @@ func (c *Client) Send(ctx context.Context, from string, recipients []string, con
 	return results, nil
 }
 
-func (c *Client) send(ctx context.Context, mxAddr string, from string, recipients []string, r io.Reader) (results []Delivery) {
+func (c *Client) send(ctx context.Context, mxAddr string, env *Envelope, recipients []Recipient, r io.Reader) (results []Delivery) {
+	host, _, _ := net.SplitHostPort(mxAddr)
 	results = make([]Delivery, len(recipients))
 	for i, rcpt := range recipients {
-		results[i].Recipient = rcpt
+		results[i].Recipient = rcpt.Addr
+		results[i].RemoteMTA = host
 	}
 	allErr := func(err error) []Delivery {
 		for i := range results {
@@ -112,54 +203,92 @@ func (c *Client) send(ctx context.Context, mxAddr string, from string, recipient
 		return results
 	}
 
-	select {
-	case c.limiter <- struct{}{}:
-	case <-ctx.Done():
-		return allErr(context.Canceled)
-	}
-	defer func() { <-c.limiter }()
-
-	dialer := &net.Dialer{
-		Resolver:  c.Resolver,
-		LocalAddr: c.LocalAddr,
-	}
-	tcpConn, err := dialer.DialContext(ctx, "tcp", mxAddr)
-	if err != nil {
-		return allErr(err)
-	}
-	host, _, _ := net.SplitHostPort(mxAddr)
-	mxConn, err := smtp.NewClient(tcpConn, host)
+	pc, err := c.getConn(ctx, mxAddr, env.TLSOptional && !env.RequireTLS)
 	if err != nil {
 		return allErr(err)
 	}
-
-	done := make(chan struct{})
-	go func() {
-		select {
-		case <-ctx.Done():
-		case <-done:
+	mxConn := pc.c
+	reusable := false
+	stop := watch(ctx, pc.nc)
+	defer func() {
+		if !stop() {
+			reusable = false
 		}
-		mxConn.Close()
+		c.putConn(pc, reusable)
 	}()
-	defer func() { close(done) }()
 
-	tlsConfig := &tls.Config{
-		// TODO: do better for servers we know we can trust:
-		// https://starttls-everywhere.org/
-		InsecureSkipVerify: true,
+	from := env.From
+	hasUTF8, _ := mxConn.Extension("SMTPUTF8")
+	downgrade := env.SMTPUTF8 && !hasUTF8
+	if downgrade {
+		var err error
+		if from, err = asciiAddr(from); err != nil {
+			for i := range results {
+				results[i].Code = 553
+				results[i].Details = err.Error()
+			}
+			reusable = true
+			return results
+		}
 	}
-	if err := mxConn.Hello(c.LocalHostname); err != nil {
-		return allErr(err)
+	hasDSN, _ := mxConn.Extension("DSN")
+	if env.RequireTLS {
+		reason := ""
+		if ok, _ := mxConn.Extension("REQUIRETLS"); !ok {
+			reason = "not supported by " + host
+		}
+		if !pc.verified {
+			reason = "no verified TLS certificate for " + host
+		}
+		if reason != "" {
+			for i := range results {
+				results[i].Code = 550
+				results[i].Details = "5.7.10 REQUIRETLS " + reason
+			}
+			reusable = true
+			return results
+		}
 	}
-	if err := mxConn.StartTLS(tlsConfig); err != nil {
-		return allErr(err)
+
+	mailCmd := "MAIL FROM:<" + from + ">"
+	if ok, _ := mxConn.Extension("8BITMIME"); ok {
+		mailCmd += " BODY=8BITMIME"
+	}
+	if env.SMTPUTF8 && hasUTF8 {
+		mailCmd += " SMTPUTF8"
+	}
+	if hasDSN && env.Ret != dsn.RetDefault {
+		mailCmd += " RET=" + string(env.Ret)
 	}
-	if err := mxConn.Mail(from); err != nil {
+	if hasDSN && env.EnvID != "" {
+		mailCmd += " ENVID=" + dsn.EncodeXtext(env.EnvID)
+	}
+	if env.RequireTLS {
+		mailCmd += " REQUIRETLS"
+	}
+	if _, _, err := cmd(mxConn, 250, mailCmd); err != nil {
 		return allErr(err)
 	}
 	deliverAttempt := 0
-	for i, to := range recipients {
-		if rcptErr := mxConn.Rcpt(to); rcptErr != nil {
+	for i, rcpt := range recipients {
+		to := rcpt.Addr
+		if downgrade {
+			var asciiErr error
+			if to, asciiErr = asciiAddr(to); asciiErr != nil {
+				results[i].Code = 553
+				results[i].Details = asciiErr.Error()
+				continue
+			}
+		}
+		rcptCmd := "RCPT TO:<" + to + ">"
+		if hasDSN && rcpt.Notify != 0 {
+			rcptCmd += " NOTIFY=" + rcpt.Notify.String()
+		}
+		if hasDSN && rcpt.ORcpt != "" {
+			addrType := rcpt.ORcpt[:strings.IndexByte(rcpt.ORcpt, ';')+1]
+			rcptCmd += " ORCPT=" + addrType + dsn.EncodeXtext(rcpt.ORcpt[len(addrType):])
+		}
+		if _, _, rcptErr := cmd(mxConn, 25, rcptCmd); rcptErr != nil {
 			if tperr, _ := rcptErr.(*textproto.Error); tperr != nil {
 				results[i].Code = tperr.Code
 				results[i].Details = tperr.Msg
@@ -168,12 +297,14 @@ func (c *Client) send(ctx context.Context, mxAddr string, from string, recipient
 			err = rcptErr
 			break
 		}
+		results[i].RemoteDSN = hasDSN
 		deliverAttempt++
 	}
 	if err != nil {
 		return allErr(err)
 	}
 	if deliverAttempt == 0 {
+		reusable = true
 		return results
 	}
 
@@ -187,9 +318,8 @@ func (c *Client) send(ctx context.Context, mxAddr string, from string, recipient
 	if err := w.Close(); err != nil {
 		return allErr(err)
 	}
-	if err := mxConn.Quit(); err != nil {
-		return allErr(err)
-	}
+	pc.msgs++
+	reusable = true
 	for i := range results {
 		if results[i].Code == 0 && results[i].Error == nil {
 			results[i].Code = 250
@@ -197,3 +327,43 @@ func (c *Client) send(ctx context.Context, mxAddr string, from string, recipient
 	}
 	return results
 }
+
+// cmd sends an SMTP command and reads the response.
+// It is used for commands with parameters net/smtp does not support.
+func cmd(c *smtp.Client, expectCode int, line string) (int, string, error) {
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.Text.ReadResponse(expectCode)
+}
+
+// asciiAddr converts addr to the form used with servers that do not
+// support SMTPUTF8. The domain is IDNA encoded. A local part that
+// is not ASCII cannot be converted.
+func asciiAddr(addr string) (string, error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", fmt.Errorf("5.6.7 invalid address %q", addr)
+	}
+	local, domain := addr[:i], addr[i+1:]
+	if !isASCII(local) {
+		return "", fmt.Errorf("5.6.7 address %q requires SMTPUTF8", addr)
+	}
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("5.6.7 address %q: %v", addr, err)
+	}
+	return local + "@" + domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,235 @@
+package smtpclient
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"spilled.ink/smtp/smtpserver"
+	"spilled.ink/util/tlstest"
+)
+
+// memMsg counts the messages a server receives.
+type memMsg struct {
+	mu   *sync.Mutex
+	msgs *int
+}
+
+func (m memMsg) AddRecipient(addr []byte, params smtpserver.RcptParams) (bool, error) {
+	return !bytes.HasPrefix(addr, []byte("nobody@")), nil
+}
+func (m memMsg) Write(line []byte) error { return nil }
+func (m memMsg) Cancel()                 {}
+func (m memMsg) Close() error {
+	m.mu.Lock()
+	*m.msgs++
+	m.mu.Unlock()
+	return nil
+}
+
+// countListener counts the connections accepted.
+type countListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (ln *countListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&ln.accepted, 1)
+	}
+	return c, err
+}
+
+func startServer(t *testing.T, requireTLS bool) (*countListener, *smtpserver.Server, func() int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &countListener{Listener: l}
+	var mu sync.Mutex
+	msgs := 0
+	server := &smtpserver.Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, from []byte, _ smtpserver.MailParams, _ uint64) (smtpserver.Msg, error) {
+			return memMsg{mu: &mu, msgs: &msgs}, nil
+		},
+		Logf:        func(format string, v ...interface{}) {},
+		TLSConfig:   tlstest.ServerConfig,
+		MaxSessions: 16,
+		RequireTLS:  requireTLS,
+	}
+	go server.ServeSTARTTLS(ln)
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return msgs
+	}
+	return ln, server, count
+}
+
+func testClient(ln net.Listener) *Client {
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	c := NewClient("client.testing", 8)
+	c.port = port
+	c.LookupMX = func(ctx context.Context, domain string) ([]*net.MX, int, error) {
+		return []*net.MX{{Host: host, Pref: 10}}, 300, nil
+	}
+	return c
+}
+
+func send(t *testing.T, c *Client, to string) []Delivery {
+	t.Helper()
+	return sendEnv(t, c, &Envelope{
+		From:       "from@spilled.ink",
+		Recipients: []Recipient{{Addr: to}},
+	})
+}
+
+func sendEnv(t *testing.T, c *Client, env *Envelope) []Delivery {
+	t.Helper()
+	const body = "Subject: hello\r\n\r\nhello\r\n"
+	res, err := c.Send(context.Background(), env, strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestConnReuse(t *testing.T) {
+	ln, server, count := startServer(t, false)
+	defer server.Shutdown(context.Background())
+
+	c := testClient(ln)
+	c.MaxMsgsPerConn = 3
+	for i := 0; i < 5; i++ {
+		to := "bob@example.com"
+		if i == 1 {
+			to = "nobody@example.com" // refused, connection still reused
+		}
+		res := send(t, c, to)
+		if len(res) != 1 {
+			t.Fatalf("send %d: %d results", i, len(res))
+		}
+		if to == "nobody@example.com" {
+			if !res[0].PermFailure() {
+				t.Errorf("send %d: %+v, want permanent failure", i, res[0])
+			}
+		} else if !res[0].Success() {
+			t.Errorf("send %d: %+v", i, res[0])
+		}
+	}
+	if got := count(); got != 4 {
+		t.Errorf("server received %d messages, want 4", got)
+	}
+
+	// The first connection is closed after three messages,
+	// the refused one does not count.
+	stats := c.PoolStats()
+	if stats.Dialed != 2 || stats.Reused != 3 || stats.Idle != 1 {
+		t.Errorf("stats: %+v, want 2 dialed, 3 reused, 1 idle", stats)
+	}
+	if accepted := atomic.LoadInt64(&ln.accepted); accepted != 2 {
+		t.Errorf("server accepted %d connections, want 2", accepted)
+	}
+
+	c.CloseIdle()
+	if stats := c.PoolStats(); stats.Open != 0 || stats.Idle != 0 {
+		t.Errorf("after CloseIdle: %+v", stats)
+	}
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	ln, server, _ := startServer(t, false)
+	defer server.Shutdown(context.Background())
+
+	c := testClient(ln)
+	c.IdleTimeout = 20 * time.Millisecond
+	send(t, c, "bob@example.com")
+	time.Sleep(100 * time.Millisecond)
+	send(t, c, "bob@example.com")
+
+	stats := c.PoolStats()
+	if stats.Dialed != 2 || stats.Reused != 0 || stats.Expired != 1 {
+		t.Errorf("stats: %+v, want 2 dialed, 1 expired", stats)
+	}
+	c.CloseIdle()
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	ln, server, count := startServer(t, false)
+	defer server.Shutdown(context.Background())
+
+	c := testClient(ln)
+	c.MaxConnsPerHost = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := send(t, c, "bob@example.com"); !res[0].Success() {
+				t.Errorf("send: %+v", res[0])
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := count(); got != 10 {
+		t.Errorf("server received %d messages, want 10", got)
+	}
+	if accepted := atomic.LoadInt64(&ln.accepted); accepted > 2 {
+		t.Errorf("server accepted %d connections, want at most 2", accepted)
+	}
+	stats := c.PoolStats()
+	if stats.Dialed+stats.Reused != 10 || stats.Open > 2 {
+		t.Errorf("stats: %+v", stats)
+	}
+	c.CloseIdle()
+}
+
+func TestRequireTLS(t *testing.T) {
+	env := &Envelope{
+		From:       "from@spilled.ink",
+		Recipients: []Recipient{{Addr: "bob@example.com"}},
+		RequireTLS: true,
+	}
+
+	ln, server, count := startServer(t, true)
+	defer server.Shutdown(context.Background())
+
+	c := testClient(ln)
+	c.rootCAs = tlstest.ClientConfig.RootCAs
+	if res := sendEnv(t, c, env); !res[0].Success() {
+		t.Errorf("verified send: %+v", res[0])
+	}
+	if got := count(); got != 1 {
+		t.Errorf("server received %d messages, want 1", got)
+	}
+	c.CloseIdle()
+
+	c = testClient(ln) // system roots, the test certificate is not verified
+	res := sendEnv(t, c, env)
+	if !res[0].PermFailure() || !strings.HasPrefix(res[0].Details, "5.7.10 ") {
+		t.Errorf("unverified send: %+v, want 5.7.10 failure", res[0])
+	}
+	c.CloseIdle()
+
+	ln2, server2, count2 := startServer(t, false)
+	defer server2.Shutdown(context.Background())
+	c = testClient(ln2)
+	c.rootCAs = tlstest.ClientConfig.RootCAs
+	res = sendEnv(t, c, env)
+	if !res[0].PermFailure() || !strings.Contains(res[0].Details, "not supported") {
+		t.Errorf("send without server support: %+v, want 5.7.10 failure", res[0])
+	}
+	if got := count2(); got != 0 {
+		t.Errorf("server without REQUIRETLS received %d messages", got)
+	}
+	c.CloseIdle()
+}
@@ -75,7 +75,7 @@ type greyMsg struct {
 	buf    []byte
 }
 
-func (g *greyMsg) AddRecipient(addr []byte) (bool, error) {
+func (g *greyMsg) AddRecipient(addr []byte, params smtpserver.RcptParams) (bool, error) {
 	g.buf = append(g.buf, addr...)
 	addr = g.buf[len(g.buf)-len(addr) : len(g.buf) : len(g.buf)]
 	g.rawMsg.Recipients = append(g.rawMsg.Recipients, addr)
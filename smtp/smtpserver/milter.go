@@ -0,0 +1,335 @@
+package smtpserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"spilled.ink/smtp/milter"
+)
+
+// milterConn is an open milter session for the current message.
+type milterConn struct {
+	client  *milter.Client
+	session *milter.Session
+}
+
+// milterStart opens a session with each of the server's milters
+// and reports the connection, HELO and MAIL FROM.
+//
+// A non-empty return value is the SMTP reply rejecting the message.
+func (s *session) milterStart(from []byte) (reply string) {
+	for _, client := range s.server.Milters {
+		ms, err := client.Open()
+		if err != nil {
+			if reply := s.milterErr(client, err); reply != "" {
+				return reply
+			}
+			continue
+		}
+		s.milters = append(s.milters, milterConn{client: client, session: ms})
+	}
+	remoteHost := "[" + s.remoteAddr + "]"
+	if host, _, err := net.SplitHostPort(s.remoteAddr); err == nil {
+		remoteHost = "[" + host + "]"
+	}
+	return s.milterEach(func(ms *milter.Session) (*milter.Response, error) {
+		res, err := ms.Connect(remoteHost, s.c.RemoteAddr(), s.server.Hostname)
+		if err != nil || res.Action != milter.Continue {
+			return res, err
+		}
+		if res, err = ms.Helo(s.helo); err != nil || res.Action != milter.Continue {
+			return res, err
+		}
+		return ms.Mail(string(from))
+	})
+}
+
+// milterRcpt reports a recipient to the milters.
+func (s *session) milterRcpt(to []byte) (reply string) {
+	return s.milterEach(func(ms *milter.Session) (*milter.Response, error) {
+		return ms.Rcpt(string(to))
+	})
+}
+
+// milterData passes the message data to each milter in turn,
+// applying the changes each one asks for.
+func (s *session) milterData(data []byte) (newData []byte, addRcpts []string, reply string) {
+	for i := 0; i < len(s.milters); i++ {
+		mc := s.milters[i]
+		res, err := milterMsg(mc.session, data)
+		if err != nil {
+			if reply := s.milterErr(mc.client, err); reply != "" {
+				return nil, nil, reply
+			}
+			continue
+		}
+		if reply := s.milterReply(res); reply != "" {
+			return nil, nil, reply
+		}
+		data = applyMilter(data, res)
+		addRcpts = append(addRcpts, res.AddRcpts...)
+		if res.Quarantine != "" {
+			s.log("milter quarantine", logs{"milter": mc.client.Addr, "reason": res.Quarantine})
+		}
+	}
+	return data, addRcpts, ""
+}
+
+func milterMsg(ms *milter.Session, data []byte) (*milter.Response, error) {
+	res, err := ms.Data()
+	if err != nil || res.Action != milter.Continue {
+		return res, err
+	}
+	hdr, body := splitMsg(data)
+	for _, f := range hdr {
+		res, err := ms.Header(f.name, f.value)
+		if err != nil || res.Action != milter.Continue {
+			return res, err
+		}
+	}
+	if res, err = ms.EOH(); err != nil || res.Action != milter.Continue {
+		return res, err
+	}
+	if res, err = ms.Body(body); err != nil || res.Action != milter.Continue {
+		return res, err
+	}
+	return ms.EOB()
+}
+
+// milterEach calls fn for each open milter session.
+func (s *session) milterEach(fn func(ms *milter.Session) (*milter.Response, error)) (reply string) {
+	for i := 0; i < len(s.milters); i++ {
+		mc := s.milters[i]
+		res, err := fn(mc.session)
+		if err != nil {
+			if reply := s.milterErr(mc.client, err); reply != "" {
+				return reply
+			}
+			mc.session.Close()
+			s.milters = append(s.milters[:i], s.milters[i+1:]...)
+			i--
+			continue
+		}
+		if reply := s.milterReply(res); reply != "" {
+			return reply
+		}
+	}
+	return ""
+}
+
+// milterReply converts a milter's verdict into an SMTP reply.
+// Discard is reported as success and recorded so the message
+// is dropped when the data is done.
+func (s *session) milterReply(res *milter.Response) string {
+	switch res.Action {
+	case milter.Reject:
+		if res.Reply != "" {
+			return res.Reply + "\r\n"
+		}
+		return "550 5.7.1 Message rejected by filter\r\n"
+	case milter.TempFail:
+		if res.Reply != "" {
+			return res.Reply + "\r\n"
+		}
+		return "451 4.7.1 Temporary failure, please try again later.\r\n"
+	case milter.Discard:
+		s.milterDiscard = true
+	}
+	return ""
+}
+
+func (s *session) milterErr(client *milter.Client, err error) string {
+	s.log("milter failed", logs{"milter": client.Addr, "err": err.Error(), "fail_open": client.FailOpen})
+	if client.FailOpen {
+		return ""
+	}
+	return "451 4.7.1 Temporary failure, please try again later.\r\n"
+}
+
+// milterClose ends any milter sessions for the current message.
+func (s *session) milterClose() {
+	for _, mc := range s.milters {
+		mc.session.Close()
+	}
+	s.milters = nil
+	s.milterDiscard = false
+}
+
+type headerField struct {
+	name  string
+	value string // without the leading space, continuation lines joined by CRLF
+	raw   string // the original field, "" if added by a milter
+}
+
+// splitMsg splits message data into header fields and body.
+func splitMsg(data []byte) (hdr []headerField, body []byte) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			i = len(data) - 1
+		}
+		line := data[:i+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return hdr, data[i+1:]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(hdr) > 0 {
+			f := &hdr[len(hdr)-1]
+			f.raw += string(line)
+			f.value += "\r\n" + strings.TrimRight(string(line), "\r\n")
+		} else {
+			f := headerField{raw: string(line)}
+			if j := bytes.IndexByte(line, ':'); j > 0 {
+				f.name = string(line[:j])
+				f.value = strings.TrimRight(string(line[j+1:]), "\r\n")
+				f.value = strings.TrimPrefix(f.value, " ")
+			} else {
+				f.name = strings.TrimRight(string(line), "\r\n")
+			}
+			hdr = append(hdr, f)
+		}
+		data = data[i+1:]
+	}
+	return hdr, nil
+}
+
+// quarantineHeader marks a message a milter quarantined.
+// Incoming copies are removed, see quarantineFilter.
+const quarantineHeader = "X-Quarantine"
+
+// quarantineFilter drops the X-Quarantine fields of message data
+// as it is read line by line, so the header a delivered message
+// carries is always the verdict of one of the server's milters.
+type quarantineFilter struct {
+	inBody bool
+	drop   bool // the current field is dropped
+}
+
+// keep reports whether line is kept in the message.
+func (f *quarantineFilter) keep(line []byte) bool {
+	if f.inBody {
+		return true
+	}
+	if len(bytes.TrimRight(line, "\r\n")) == 0 {
+		f.inBody = true
+		return true
+	}
+	if line[0] == ' ' || line[0] == '\t' {
+		return !f.drop // continuation of the previous field
+	}
+	f.drop = false
+	if i := bytes.IndexByte(line, ':'); i > 0 {
+		name := bytes.TrimRight(line[:i], " \t")
+		f.drop = strings.EqualFold(string(name), quarantineHeader)
+	}
+	return !f.drop
+}
+
+// applyMilter applies a milter's modifications to message data.
+func applyMilter(data []byte, res *milter.Response) []byte {
+	if len(res.HeaderMods) == 0 && res.Body == nil && res.Quarantine == "" {
+		return data
+	}
+	hdr, body := splitMsg(data)
+	for _, mod := range res.HeaderMods {
+		f := headerField{name: mod.Name, value: mod.Value}
+		switch mod.Op {
+		case milter.HeaderAdd:
+			hdr = append(hdr, f)
+		case milter.HeaderInsert:
+			i := mod.Index
+			if i > len(hdr) {
+				i = len(hdr)
+			}
+			if i < 0 {
+				i = 0
+			}
+			hdr = append(hdr[:i], append([]headerField{f}, hdr[i:]...)...)
+		case milter.HeaderChange:
+			n, found := 0, false
+			for i := range hdr {
+				if !strings.EqualFold(hdr[i].name, mod.Name) {
+					continue
+				}
+				n++
+				if n != mod.Index && !(mod.Index == 0 && n == 1) {
+					continue
+				}
+				found = true
+				if mod.Value == "" {
+					hdr = append(hdr[:i], hdr[i+1:]...)
+				} else {
+					hdr[i] = f
+				}
+				break
+			}
+			if !found && mod.Value != "" {
+				hdr = append(hdr, f)
+			}
+		}
+	}
+	if res.Quarantine != "" {
+		hdr = append(hdr, headerField{name: quarantineHeader, value: res.Quarantine})
+	}
+	if res.Body != nil {
+		body = res.Body
+	}
+
+	buf := new(bytes.Buffer)
+	for _, f := range hdr {
+		if f.raw != "" {
+			buf.WriteString(f.raw)
+			continue
+		}
+		buf.WriteString(f.name)
+		buf.WriteString(": ")
+		buf.WriteString(f.value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// filterData runs the message data through the milters and
+// writes the result to s.msg. If the message is not to be
+// queued, it writes the SMTP reply, ends the message, and
+// reports false.
+func (s *session) filterData(data []byte, res io.Writer) bool {
+	data, addRcpts, reply := s.milterData(data)
+	if reply == "" && s.milterDiscard {
+		s.log("milter discard", nil)
+		reply = "250 2.0.0 OK: queued\r\n"
+	}
+	for _, rcpt := range addRcpts {
+		if reply != "" {
+			break
+		}
+		if _, err := s.msg.AddRecipient([]byte(rcpt), RcptParams{}); err != nil {
+			s.log("milter AddRecipient failed", logs{"rcpt": rcpt, "err": err.Error()})
+			reply = "451 4.3.0 Error processing recipients\r\n"
+		}
+	}
+	for reply == "" && len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			i = len(data) - 1
+		}
+		if err := s.msg.Write(data[:i+1]); err != nil {
+			reply = "550 Write error\r\n"
+		}
+		data = data[i+1:]
+	}
+	if reply == "" {
+		return true
+	}
+	s.milterClose()
+	s.msg.Cancel()
+	s.msg = nil
+	s.numRcpts = 0
+	s.smtputf8 = false
+	fmt.Fprint(res, reply)
+	return false
+}
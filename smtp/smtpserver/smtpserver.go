@@ -15,10 +15,18 @@ import (
 	"net"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unicode"
+	"unicode/utf8"
+
+	"spilled.ink/email"
+	"spilled.ink/email/dsn"
+	"spilled.ink/email/trace"
+	"spilled.ink/smtp/milter"
+	"spilled.ink/util/otlptrace"
 )
 
 // ErrServerClosed is returned by Serve when the Shutdown method is called.
@@ -28,14 +36,53 @@ var ErrServerClosed = errors.New("smtpd: Server closed")
 // a temporary failure to the SMTP client.
 var ErrTempFailure451 = errors.New("smtpd: Temporary failure ")
 
+// A ReplyError can be returned by NewMessage or the Msg Close method
+// to refuse a message with a particular reply, such as a policy
+// violation. The session continues, the client may try again.
+type ReplyError struct {
+	Code   int    // reply code, 550
+	Status string // enhanced status code, RFC 3463, "5.7.1"
+	Msg    string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.Status, e.Msg)
+}
+
 type Msg interface {
-	AddRecipient(addr []byte) (bool, error)
+	AddRecipient(addr []byte, params RcptParams) (bool, error)
 	Write(line []byte) error
 	Cancel()
 	Close() error
 }
 
-type NewMessageFunc func(remoteAddr net.Addr, from []byte, authToken uint64) (Msg, error)
+type NewMessageFunc func(remoteAddr net.Addr, from []byte, params MailParams, authToken uint64) (Msg, error)
+
+// MailParams are the ESMTP parameters of the MAIL command.
+type MailParams struct {
+	// SMTPUTF8 reports that the envelope addresses or the message
+	// headers may contain UTF-8, RFC 6531.
+	SMTPUTF8 bool
+
+	// Delivery status notification parameters, RFC 3461.
+	Ret   dsn.Ret // RET, how much of the message to return
+	EnvID string  // ENVID, xtext decoded
+
+	// Size is the client's estimate of the message size in bytes,
+	// the RFC 1870 SIZE parameter, or 0 if not given.
+	Size int64
+
+	// RequireTLS is the RFC 8689 REQUIRETLS parameter: the message
+	// must only be relayed over TLS with a verified certificate.
+	RequireTLS bool
+}
+
+// RcptParams are the ESMTP parameters of the RCPT command.
+type RcptParams struct {
+	// Delivery status notification parameters, RFC 3461.
+	Notify dsn.Notify // NOTIFY, when to notify the sender
+	ORcpt  string     // ORCPT, xtext decoded: "rfc822;bob@example.com"
+}
 
 // Server is an SMTP server.
 // Callers must provide a NewMessage function to process messages.
@@ -51,6 +98,16 @@ type Server struct {
 	TLSConfig     *tls.Config
 	Logf          func(format string, v ...interface{})
 
+	// MaxMsgsPerConn is the number of messages a client can send
+	// on a connection before it is asked to reconnect.
+	// Zero means no limit.
+	MaxMsgsPerConn int
+
+	// RequireTLS advertises the RFC 8689 REQUIRETLS extension on
+	// TLS sessions. Set it only if NewMessage honors the
+	// MailParams.RequireTLS of the messages it relays.
+	RequireTLS bool
+
 	// AllowNoTLS set to true means a non-TLS SMTP session
 	// can send mail without calling STARTTLS.
 	// https://twitter.com/infinite_scream
@@ -68,6 +125,19 @@ type Server struct {
 	// server becoming an open relay.
 	MustAuth bool
 
+	// Milters are mail filters consulted about each message
+	// before it is passed to NewMessage's Msg. With milters the
+	// message data is held in memory until the filters are done.
+	//
+	// A milter quarantines a message with an X-Quarantine field.
+	// Any X-Quarantine fields of incoming messages are removed,
+	// with or without milters.
+	Milters []*milter.Client
+
+	// Tracer, if set, exports a span for each mail transaction,
+	// from MAIL to the end of DATA or RSET.
+	Tracer *otlptrace.Exporter
+
 	servingTLS bool
 
 	randLock sync.Mutex // used after initialization to access Rand
@@ -239,9 +309,40 @@ type session struct {
 	tlsConfig  tls.Config
 	tls        bool
 	numRcpts   int
+	numMsgs    int // messages queued on this connection
 	msg        Msg
+	smtputf8   bool // MAIL SMTPUTF8 parameter
 	authToken  uint64
 	remoteAddr string
+
+	helo          string       // HELO or EHLO argument
+	esmtp         bool         // the client sent EHLO
+	rcpts         []string     // recipients accepted for msg
+	milters       []milterConn // open milter sessions for msg
+	milterDiscard bool         // a milter asked to drop msg
+
+	txn *otlptrace.Span // span of the mail transaction of msg
+}
+
+// received is the Received header field of the message being sent.
+func (s *session) received() email.HeaderEntry {
+	r := &trace.Received{
+		Helo:  s.helo,
+		Addr:  s.c.RemoteAddr(),
+		By:    s.server.Hostname,
+		ESMTP: s.esmtp,
+		Auth:  s.authToken != 0,
+		ID:    fmt.Sprintf("%d.%d", s.id, s.numMsgs),
+		Date:  time.Now(),
+	}
+	if len(s.rcpts) == 1 {
+		r.For = s.rcpts[0]
+	}
+	if c, ok := s.c.(*tls.Conn); ok {
+		state := c.ConnectionState()
+		r.TLS = &state
+	}
+	return r.Entry()
 }
 
 // TODO: outlook needs TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384
@@ -276,10 +377,12 @@ func (s *session) serve() {
 	}()
 	defer func() {
 		s.c.Close()
+		s.milterClose()
 		if s.msg != nil {
 			s.msg.Cancel()
 			s.msg = nil
 		}
+		s.endTxn("") // the session ended in the transaction
 	}()
 
 	res := new(bytes.Buffer)
@@ -319,6 +422,9 @@ func (s *session) serve() {
 
 		res.Reset()
 		moreSession := s.serveCmd(verb, arg, res)
+		if s.msg == nil {
+			s.endTxn(res.String())
+		}
 
 		if res.Len() > 0 {
 			s.bw.Write(res.Bytes())
@@ -347,8 +453,8 @@ const (
 	sessionEnd      = moreSession(false)
 )
 
-var fromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>`)
-var rcptRE = regexp.MustCompile(`[Tt][Oo]:<(.*)>`)
+var fromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<([^>]*)>(.*)`)
+var rcptRE = regexp.MustCompile(`[Tt][Oo]:<([^>]*)>(.*)`)
 var dotCRLF = []byte(".\r\n")
 
 func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
@@ -364,6 +470,8 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 		return sessionEnd
 
 	case "HELO", "EHLO":
+		s.helo = string(arg)
+		s.esmtp = verb == "EHLO"
 		if !s.server.AllowNoTLS && !s.tls {
 			fmt.Fprintf(res, "250-%s good morrow, TLS required\r\n", s.server.Hostname)
 			fmt.Fprintf(res, "250 STARTTLS\r\n")
@@ -378,6 +486,10 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 		}
 		fmt.Fprintf(res, "250-SIZE %d\r\n", s.server.MaxSize)
 		fmt.Fprintf(res, "250-8BITMIME\r\n")
+		fmt.Fprintf(res, "250-DSN\r\n")
+		if s.tls && s.server.RequireTLS {
+			fmt.Fprintf(res, "250-REQUIRETLS\r\n")
+		}
 		fmt.Fprintf(res, "250-ENHANCEDSTATUSCODES\r\n")
 		fmt.Fprintf(res, "250 SMTPUTF8\r\n")
 		// TODO: DNS, PIPELINING, CHUNKING ???
@@ -404,6 +516,9 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			fmt.Fprintf(res, "451 authentication not supported\r\n") // TODO: determine correct error code
 			return sessionContinue
 		}
+		if !s.hasTLS(res) {
+			return sessionContinue
+		}
 
 		var identity, user, pass []byte
 
@@ -447,6 +562,10 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			return sessionEnd
 		default:
 		}
+		if max := s.server.MaxMsgsPerConn; max > 0 && s.numMsgs >= max {
+			fmt.Fprintf(res, "421 4.7.0 Too many messages on this connection, reconnect to send more\r\n")
+			return sessionEnd
+		}
 		m := fromRE.FindSubmatch(arg)
 		if m == nil {
 			fmt.Fprintf(res, "501 5.1.7 Syntax error (bad sender address)\r\n")
@@ -461,13 +580,49 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			fmt.Fprintf(res, "501 5.1.0 invalid sender address\r\n")
 			return sessionContinue
 		}
-		var err error
-		s.msg, err = s.server.NewMessage(s.c.RemoteAddr(), from, s.authToken)
+		params, err := parseMailParams(m[2])
+		if err != nil {
+			fmt.Fprintf(res, "555 5.5.4 %v\r\n", err)
+			return sessionContinue
+		}
+		if !s.validAddr(from, params.SMTPUTF8, res) {
+			return sessionContinue
+		}
+		if params.RequireTLS && !(s.tls && s.server.RequireTLS) {
+			// RFC 8689 section 4.1.
+			fmt.Fprintf(res, "530 5.7.10 REQUIRETLS not available\r\n")
+			return sessionContinue
+		}
+		if params.Size > int64(s.server.MaxSize) {
+			fmt.Fprintf(res, "552 5.3.4 Message size exceeds fixed maximum message size\r\n")
+			return sessionContinue
+		}
+		s.rcpts = s.rcpts[:0]
+		s.msg, err = s.server.NewMessage(s.c.RemoteAddr(), from, params, s.authToken)
+		if replyErr, ok := err.(*ReplyError); ok {
+			s.msg = nil
+			fmt.Fprintf(res, "%s\r\n", replyErr)
+			return sessionContinue
+		}
 		if err != nil {
 			s.log("NewMessage failed", logs{"err": err.Error()})
 			fmt.Fprintf(res, "451 denied\r\n")
 			return sessionEnd
 		}
+		s.smtputf8 = params.SMTPUTF8
+		if reply := s.milterStart(from); reply != "" {
+			s.milterClose()
+			s.msg.Cancel()
+			s.msg = nil
+			s.smtputf8 = false
+			fmt.Fprint(res, reply)
+			return sessionContinue
+		}
+		_, s.txn = s.server.Tracer.Start(context.Background(), "smtp transaction")
+		s.txn.SetAttr("smtp.session_id", s.id)
+		s.txn.SetAttr("smtp.remote_addr", s.remoteAddr)
+		s.txn.SetAttr("smtp.from", string(from))
+		s.txn.SetAttr("smtp.auth", s.authToken != 0)
 		fmt.Fprintf(res, "250 2.1.0 OK\r\n")
 
 	case "RCPT":
@@ -478,8 +633,10 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			fmt.Fprintf(res, "503 5.5.1 Error: MAIL command not called\r\n")
 			return sessionContinue
 		}
-		if s.numRcpts+1 >= s.server.MaxRecipients {
-			fmt.Fprintf(res, "452 Too many recipients\r\n")
+		if s.numRcpts >= s.server.MaxRecipients {
+			// RFC 5321 section 4.5.3.1.10, the client
+			// sends the rest in another transaction.
+			fmt.Fprintf(res, "452 4.5.3 Too many recipients\r\n")
 			return sessionContinue
 		}
 		s.numRcpts++
@@ -497,13 +654,26 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			fmt.Fprintf(res, "501 5.1.0 invalid recipient address\r\n")
 			return sessionContinue
 		}
-		if added, err := s.msg.AddRecipient(to); err != nil {
+		if !s.validAddr(to, s.smtputf8, res) {
+			return sessionContinue
+		}
+		params, err := parseRcptParams(m[2])
+		if err != nil {
+			fmt.Fprintf(res, "555 5.5.4 %v\r\n", err)
+			return sessionContinue
+		}
+		if reply := s.milterRcpt(to); reply != "" {
+			fmt.Fprint(res, reply)
+			return sessionContinue
+		}
+		if added, err := s.msg.AddRecipient(to, params); err != nil {
 			s.log("AddRecipient failed", logs{"err": err.Error()})
 			fmt.Fprintf(res, "550 Error: bad recipient, error processing\r\n")
 			return sessionEnd
 		} else if !added {
 			fmt.Fprintf(res, "550 Error: bad recipient\r\n")
 		} else {
+			s.rcpts = append(s.rcpts, string(to))
 			fmt.Fprintf(res, "250 2.1.0 OK\r\n")
 		}
 
@@ -518,6 +688,20 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 		fmt.Fprint(s.bw, "354 Go ahead\r\n")
 		s.bw.Flush()
 		var n int
+		var buf *bytes.Buffer // message data held for milters
+		if len(s.milters) > 0 {
+			buf = new(bytes.Buffer)
+		}
+		for _, line := range trace.Lines(s.received()) {
+			if buf != nil {
+				buf.Write(line)
+			} else if err := s.msg.Write(line); err != nil {
+				fmt.Fprint(res, "550 Write error\r\n")
+				return sessionEnd
+			}
+		}
+		tooBig := false
+		var qf quarantineFilter
 		for {
 			/*if s.server.ReadTimeout != 0 {
 				s.c.SetReadDeadline(time.Now().Add(s.server.ReadTimeout))
@@ -534,17 +718,45 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			}
 			n += len(sl)
 			if n > s.server.MaxSize {
-				fmt.Fprint(res, "552 Too much mail data.\r\n")
-				return sessionEnd
+				// Read to the end of the data,
+				// so the session can go on.
+				tooBig = true
+			}
+			if tooBig || !qf.keep(sl) {
+				continue
+			}
+			if buf != nil {
+				buf.Write(sl)
+				continue
 			}
 			if err := s.msg.Write(sl); err != nil {
 				fmt.Fprint(res, "550 Write error\r\n")
 				return sessionEnd
 			}
 		}
+		if tooBig {
+			s.msg.Cancel()
+			s.milterClose()
+			s.msg = nil
+			s.numRcpts = 0
+			s.smtputf8 = false
+			fmt.Fprint(res, "552 5.3.4 Too much mail data, message exceeds fixed maximum message size\r\n")
+			return sessionContinue
+		}
+		if buf != nil {
+			if !s.filterData(buf.Bytes(), res) {
+				return sessionContinue
+			}
+		}
 		err := s.msg.Close()
+		s.milterClose()
 		s.msg = nil
 		s.numRcpts = 0
+		s.smtputf8 = false
+		if replyErr, ok := err.(*ReplyError); ok {
+			fmt.Fprintf(res, "%s\r\n", replyErr)
+			return sessionContinue
+		}
 		if err != nil {
 			if err == ErrTempFailure451 {
 				fmt.Fprint(res, "451 Temporary failure, please try again later.\r\n")
@@ -553,6 +765,7 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 			}
 			return sessionEnd
 		}
+		s.numMsgs++
 		fmt.Fprint(res, "250 2.0.0 OK: queued\r\n")
 
 	case "RSET":
@@ -562,8 +775,11 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 		if s.msg != nil {
 			s.msg.Cancel()
 		}
+		s.milterClose()
 		s.msg = nil
 		s.numRcpts = 0
+		s.smtputf8 = false
+		fmt.Fprintf(res, "250 2.0.0 OK\r\n")
 
 	default:
 		fmt.Fprintf(res, "502 5.5.2 Error: command not recognized\r\n")
@@ -572,6 +788,27 @@ func (s *session) serveCmd(verb string, arg []byte, res io.Writer) moreSession {
 	return sessionContinue
 }
 
+// endTxn ends the span of the mail transaction, if there is one,
+// with the reply that ended it, or "" if the session ended first.
+func (s *session) endTxn(reply string) {
+	if s.txn == nil {
+		return
+	}
+	s.txn.SetAttr("smtp.rcpts", len(s.rcpts))
+	reply = strings.TrimSpace(reply)
+	switch {
+	case reply == "":
+		s.txn.SetError(errors.New("session ended in the mail transaction"))
+	case reply[0] == '4' || reply[0] == '5':
+		s.txn.SetError(errors.New(reply))
+		s.txn.SetAttr("smtp.reply", reply)
+	default:
+		s.txn.SetAttr("smtp.reply", reply)
+	}
+	s.txn.End()
+	s.txn = nil
+}
+
 func (s *session) serveAuthPlain(arg []byte, res io.Writer) (identity, user, pass []byte) {
 	arg = arg[len("PLAIN"):]
 	if len(arg) > 0 && arg[0] == ' ' {
@@ -664,6 +901,106 @@ func (s *session) serveAuthLogin(res io.Writer) (user, pass []byte, err error) {
 	return user, pass, nil
 }
 
+// parseMailParams parses the parameters that follow a MAIL FROM address.
+func parseMailParams(arg []byte) (params MailParams, err error) {
+	for _, param := range strings.Fields(string(arg)) {
+		keyword, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			keyword, value = param[:i], param[i+1:]
+		}
+		switch strings.ToUpper(keyword) {
+		case "SMTPUTF8":
+			if value != "" {
+				return params, fmt.Errorf("SMTPUTF8 takes no value")
+			}
+			params.SMTPUTF8 = true
+		case "BODY":
+			// RFC 6152 8BITMIME, we pass message bodies through as is.
+			switch strings.ToUpper(value) {
+			case "7BIT", "8BITMIME":
+			default:
+				return params, fmt.Errorf("unsupported BODY=%s", value)
+			}
+		case "RET":
+			if params.Ret, err = dsn.ParseRet(value); err != nil {
+				return params, err
+			}
+		case "ENVID":
+			if params.EnvID, err = dsn.DecodeXtext(value); err != nil {
+				return params, err
+			}
+		case "SIZE":
+			// Advisory, also checked when the message is sent.
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return params, fmt.Errorf("bad SIZE=%s", value)
+			}
+			params.Size = size
+		case "REQUIRETLS":
+			if value != "" {
+				return params, fmt.Errorf("REQUIRETLS takes no value")
+			}
+			params.RequireTLS = true
+		case "AUTH":
+		default:
+			return params, fmt.Errorf("unsupported MAIL parameter %s", keyword)
+		}
+	}
+	return params, nil
+}
+
+// parseRcptParams parses the parameters that follow a RCPT TO address.
+func parseRcptParams(arg []byte) (params RcptParams, err error) {
+	for _, param := range strings.Fields(string(arg)) {
+		keyword, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			keyword, value = param[:i], param[i+1:]
+		}
+		switch strings.ToUpper(keyword) {
+		case "NOTIFY":
+			if params.Notify, err = dsn.ParseNotify(value); err != nil {
+				return params, err
+			}
+		case "ORCPT":
+			if params.ORcpt, err = dsn.DecodeXtext(value); err != nil {
+				return params, err
+			}
+			if strings.IndexByte(params.ORcpt, ';') < 1 {
+				return params, fmt.Errorf("ORCPT missing address type")
+			}
+		default:
+			return params, fmt.Errorf("unsupported RCPT parameter %s", keyword)
+		}
+	}
+	return params, nil
+}
+
+// validAddr reports whether a MAIL or RCPT address is valid UTF-8
+// and only uses UTF-8 when the client asked for SMTPUTF8.
+func (s *session) validAddr(addr []byte, smtputf8 bool, res io.Writer) bool {
+	if isASCII(addr) {
+		return true
+	}
+	if !utf8.Valid(addr) {
+		fmt.Fprintf(res, "501 5.1.7 invalid UTF-8 in address\r\n")
+		return false
+	}
+	if !smtputf8 {
+		fmt.Fprintf(res, "553 5.6.7 non-ASCII address requires SMTPUTF8\r\n")
+		return false
+	}
+	return true
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *session) hasNoArg(arg []byte, res io.Writer) bool {
 	if len(arg) > 0 {
 		fmt.Fprintf(res, "501 Syntax error (no parameters allowed)\r\n")
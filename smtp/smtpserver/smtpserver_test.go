@@ -5,9 +5,12 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/smtp"
 	"net/textproto"
 	"reflect"
@@ -15,6 +18,9 @@ import (
 	"testing"
 	"time"
 
+	"spilled.ink/email/dsn"
+	"spilled.ink/smtp/milter"
+	"spilled.ink/util/otlptrace"
 	"spilled.ink/util/tlstest"
 )
 
@@ -71,13 +77,15 @@ func TestNoTLS(t *testing.T) {
 type memMsg struct {
 	from       string
 	recipients []string
+	rcptParams []RcptParams
 	body       bytes.Buffer
 	cancelled  bool
 	closed     bool
 }
 
-func (m *memMsg) AddRecipient(addr []byte) (bool, error) {
+func (m *memMsg) AddRecipient(addr []byte, params RcptParams) (bool, error) {
 	m.recipients = append(m.recipients, string(addr))
+	m.rcptParams = append(m.rcptParams, params)
 	return true, nil
 }
 
@@ -104,7 +112,7 @@ func TestSend(t *testing.T) {
 	errCh := make(chan error)
 	server := &Server{
 		Hostname: "testing",
-		NewMessage: func(_ net.Addr, addr []byte, authToken uint64) (Msg, error) {
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
 			msg.from = string(addr)
 			return msg, nil
 		},
@@ -169,6 +177,207 @@ func TestSend(t *testing.T) {
 	}
 }
 
+func TestSMTPUTF8(t *testing.T) {
+	msg := new(memMsg)
+	var params MailParams
+	ln := listen(t)
+	errCh := make(chan error)
+	server := &Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, addr []byte, p MailParams, authToken uint64) (Msg, error) {
+			msg.from = string(addr)
+			params = p
+			return msg, nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go func() {
+		errCh <- server.ServeSTARTTLS(ln)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); !ok {
+		t.Error("SMTPUTF8 not advertised")
+	}
+	cmd := func(wantCode int, line string) {
+		t.Helper()
+		id, err := c.Text.Cmd("%s", line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		if _, _, err := c.Text.ReadResponse(wantCode); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+
+	cmd(553, "MAIL FROM:<jörg@example.com>")
+	cmd(555, "MAIL FROM:<jorg@example.com> XUNKNOWN=1")
+	cmd(501, "MAIL FROM:<j\xffrg@example.com> SMTPUTF8")
+
+	const from = "jörg@bücher.example"
+	cmd(250, "MAIL FROM:<"+from+"> BODY=8BITMIME SMTPUTF8")
+	if !params.SMTPUTF8 {
+		t.Error("MailParams.SMTPUTF8 not set")
+	}
+	const to = "用户@例子.广告"
+	if err := c.Rcpt(to); err != nil {
+		t.Error(err)
+	}
+	cmd(250, "RSET")
+	cmd(250, "MAIL FROM:<jorg@example.com>")
+	cmd(553, "RCPT TO:<"+to+">")
+
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	server.Shutdown(context.Background())
+	if err := <-errCh; err != ErrServerClosed {
+		t.Errorf("ServeSTARTTLS: %v, want ErrServerClosed", err)
+	}
+
+	if msg.from != "jorg@example.com" {
+		t.Errorf("from=%q", msg.from)
+	}
+	if want := []string{to}; !reflect.DeepEqual(msg.recipients, want) {
+		t.Errorf("recipients: %v, want %v", msg.recipients, want)
+	}
+}
+
+func TestDSN(t *testing.T) {
+	msg := new(memMsg)
+	var params MailParams
+	ln := listen(t)
+	errCh := make(chan error)
+	server := &Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, addr []byte, p MailParams, authToken uint64) (Msg, error) {
+			msg.from = string(addr)
+			params = p
+			return msg, nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go func() {
+		errCh <- server.ServeSTARTTLS(ln)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("DSN"); !ok {
+		t.Error("DSN not advertised")
+	}
+	cmd := func(wantCode int, line string) {
+		t.Helper()
+		id, err := c.Text.Cmd("%s", line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		if _, _, err := c.Text.ReadResponse(wantCode); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+
+	cmd(555, "MAIL FROM:<from@example.com> RET=SOME")
+	cmd(555, "MAIL FROM:<from@example.com> ENVID=a+2")
+	cmd(250, "MAIL FROM:<from@example.com> RET=hdrs ENVID=QQ+2B314159")
+	if params.Ret != dsn.RetHdrs || params.EnvID != "QQ+314159" {
+		t.Errorf("MailParams=%+v", params)
+	}
+	cmd(555, "RCPT TO:<to1@example.com> NOTIFY=NEVER,DELAY")
+	cmd(555, "RCPT TO:<to1@example.com> ORCPT=to1@example.com")
+	cmd(250, "RCPT TO:<to1@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;To1+2Bx@example.com")
+	cmd(250, "RCPT TO:<to2@example.com>")
+
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	server.Shutdown(context.Background())
+	if err := <-errCh; err != ErrServerClosed {
+		t.Errorf("ServeSTARTTLS: %v, want ErrServerClosed", err)
+	}
+
+	want := []RcptParams{
+		{Notify: dsn.NotifySuccess | dsn.NotifyFailure, ORcpt: "rfc822;To1+x@example.com"},
+		{},
+	}
+	if !reflect.DeepEqual(msg.rcptParams, want) {
+		t.Errorf("RcptParams=%+v, want %+v", msg.rcptParams, want)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	var params MailParams
+	ln := listen(t)
+	server := &Server{
+		Hostname:   "testing",
+		RequireTLS: true,
+		AllowNoTLS: true,
+		NewMessage: func(_ net.Addr, addr []byte, p MailParams, authToken uint64) (Msg, error) {
+			params = p
+			return new(memMsg), nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go server.ServeSTARTTLS(ln)
+	defer server.Shutdown(context.Background())
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cmd := func(wantCode int, line string) {
+		t.Helper()
+		id, err := c.Text.Cmd("%s", line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		if _, _, err := c.Text.ReadResponse(wantCode); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+
+	if ok, _ := c.Extension("REQUIRETLS"); ok {
+		t.Error("REQUIRETLS advertised without TLS")
+	}
+	cmd(530, "MAIL FROM:<from@example.com> REQUIRETLS")
+
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("REQUIRETLS"); !ok {
+		t.Error("REQUIRETLS not advertised")
+	}
+	cmd(555, "MAIL FROM:<from@example.com> REQUIRETLS=yes")
+	cmd(250, "MAIL FROM:<from@example.com> REQUIRETLS")
+	if !params.RequireTLS {
+		t.Errorf("MailParams=%+v, want RequireTLS", params)
+	}
+}
+
 func TestMaxSize(t *testing.T) {
 	msg := new(memMsg)
 	ln := listen(t)
@@ -176,7 +385,7 @@ func TestMaxSize(t *testing.T) {
 	server := &Server{
 		Hostname: "testing",
 		MaxSize:  20,
-		NewMessage: func(_ net.Addr, addr []byte, authToken uint64) (Msg, error) {
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
 			msg.from = string(addr)
 			return msg, nil
 		},
@@ -201,7 +410,36 @@ func TestMaxSize(t *testing.T) {
 		t.Error("write succeeded, expected failure")
 	} else if !strings.Contains(err.Error(), "Too much") {
 		t.Errorf("failure does not mention 'Too much': %v", err)
+	} else if te, ok := err.(*textproto.Error); !ok || te.Code != 552 || !strings.HasPrefix(te.Msg, "5.3.4 ") {
+		t.Errorf("failure is not 552 5.3.4: %v", err)
+	}
+
+	// The session goes on, a SIZE too large is refused up front.
+	id, err := c.Text.Cmd("MAIL FROM:<from@example.com> SIZE=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	if te, ok := err.(*textproto.Error); !ok || te.Code != 552 {
+		t.Errorf("MAIL SIZE=100: %v, want 552", err)
+	}
+	if err := c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err = c.Data()
+	if err != nil {
+		t.Fatal(err)
 	}
+	w.Write([]byte("small\r\n"))
+	if err := w.Close(); err != nil {
+		t.Errorf("small message after a large one: %v", err)
+	}
+	c.Quit()
 	server.Shutdown(context.Background())
 }
 
@@ -211,7 +449,7 @@ func TestMaxRecipients(t *testing.T) {
 	server := &Server{
 		Hostname:      "testing",
 		MaxRecipients: 3,
-		NewMessage: func(_ net.Addr, addr []byte, authToken uint64) (Msg, error) {
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
 			msg.from = string(addr)
 			return msg, nil
 		},
@@ -224,22 +462,241 @@ func TestMaxRecipients(t *testing.T) {
 	c, err := smtp.Dial(ln.Addr().String())
 	c.StartTLS(&tls.Config{InsecureSkipVerify: true})
 	c.Mail("from@example.com")
+	accepted := 0
 	for i := 0; i < 5; i++ {
 		e := c.Rcpt("to@example.from")
-		if err == nil {
+		if e == nil {
+			accepted++
+		} else if err == nil {
 			err = e
 		}
 	}
+	if accepted != 3 {
+		t.Errorf("%d recipients accepted, want 3", accepted)
+	}
 	if err == nil {
 		t.Error("RCPT succeeded, expected failure")
 	} else if !strings.Contains(err.Error(), "Too many recipients") {
 		t.Errorf("RCPT failure does not mention 'recipients': %v", err)
+	} else if te, ok := err.(*textproto.Error); !ok || te.Code != 452 || !strings.HasPrefix(te.Msg, "4.5.3 ") {
+		t.Errorf("RCPT failure is not 452 4.5.3: %v", err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
 	server.Shutdown(ctx)
 }
 
+func TestMaxMsgsPerConn(t *testing.T) {
+	msg := new(memMsg)
+	ln := listen(t)
+	server := &Server{
+		Hostname:       "testing",
+		MaxMsgsPerConn: 2,
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
+			*msg = memMsg{from: string(addr)}
+			return msg, nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go server.ServeSTARTTLS(ln)
+	defer server.Shutdown(context.Background())
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	for i := 0; i < 2; i++ {
+		if err := c.Mail("from@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt("to@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello\r\n"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Mail("from@example.com")
+	if te, ok := err.(*textproto.Error); !ok || te.Code != 421 {
+		t.Errorf("third MAIL: %v, want 421", err)
+	}
+}
+
+// rejectMsg is refused by its Close method.
+type rejectMsg struct{ memMsg }
+
+func (m *rejectMsg) Close() error {
+	m.closed = true
+	return &ReplyError{Code: 550, Status: "5.7.1", Msg: "From header not allowed"}
+}
+
+func TestReplyError(t *testing.T) {
+	ln := listen(t)
+	server := &Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
+			if string(addr) == "spoof@example.com" {
+				return nil, &ReplyError{Code: 550, Status: "5.7.1", Msg: "Sender address not allowed"}
+			}
+			return &rejectMsg{memMsg{from: string(addr)}}, nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go server.ServeSTARTTLS(ln)
+	defer server.Shutdown(context.Background())
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+
+	err = c.Mail("spoof@example.com")
+	if te, ok := err.(*textproto.Error); !ok || te.Code != 550 || te.Msg != "5.7.1 Sender address not allowed" {
+		t.Errorf("MAIL: %v, want 550 5.7.1", err)
+	}
+
+	// The session goes on.
+	if err := c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("From: spoof@example.com\r\n\r\nhello\r\n"))
+	err = w.Close()
+	if te, ok := err.(*textproto.Error); !ok || te.Code != 550 || !strings.HasPrefix(te.Msg, "5.7.1 ") {
+		t.Errorf("DATA: %v, want 550 5.7.1", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Errorf("RSET after refused DATA: %v", err)
+	}
+}
+
+func TestReceived(t *testing.T) {
+	msg := new(memMsg)
+	ln := listen(t)
+	server := &Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
+			msg.from = string(addr)
+			return msg, nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go server.ServeSTARTTLS(ln)
+	defer server.Shutdown(context.Background())
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const data = "Subject: hi\r\n\r\nhello\r\n"
+	w.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	body := msg.body.String()
+	if !strings.HasSuffix(body, data) {
+		t.Fatalf("message data not after the trace header:\n%s", body)
+	}
+	hdr := strings.Replace(strings.TrimSuffix(body, data), "\r\n ", " ", -1)
+	if !strings.HasPrefix(hdr, "Received: from localhost ([127.0.0.1]) by testing with ESMTPS (TLS1.") ||
+		!strings.Contains(hdr, " for <to@example.com> tls TLS_") ||
+		strings.Count(hdr, "\r\n") != 1 {
+		t.Errorf("trace header:\n%s", hdr)
+	}
+}
+
+func TestStripQuarantine(t *testing.T) {
+	msg := new(memMsg)
+	ln := listen(t)
+	server := &Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
+			msg.from = string(addr)
+			return msg, nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+	}
+	go server.ServeSTARTTLS(ln)
+	defer server.Shutdown(context.Background())
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: hi\r\n" +
+		"X-Quarantine: spoofed\r\n" +
+		"\tverdict\r\n" +
+		"x-quarantine : again\r\n" +
+		"X-Quarantined: kept\r\n" +
+		"\r\n" +
+		"X-Quarantine: in the body\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	const want = "Subject: hi\r\n" +
+		"X-Quarantined: kept\r\n" +
+		"\r\n" +
+		"X-Quarantine: in the body\r\n"
+	if body := msg.body.String(); !strings.HasSuffix(body, want) {
+		t.Errorf("message data:\n%s\nwant suffix:\n%s", body, want)
+	}
+}
+
 func TestTLS(t *testing.T) {
 	msg := new(memMsg)
 	ln := listen(t)
@@ -247,7 +704,7 @@ func TestTLS(t *testing.T) {
 	server := &Server{
 		Hostname: "localhost",
 		MaxSize:  20,
-		NewMessage: func(_ net.Addr, addr []byte, authToken uint64) (Msg, error) {
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
 			msg.from = string(addr)
 			return msg, nil
 		},
@@ -289,7 +746,7 @@ func TestAuth(t *testing.T) {
 	server := &Server{
 		Hostname: "localhost",
 		MaxSize:  20,
-		NewMessage: func(_ net.Addr, addr []byte, authToken uint64) (Msg, error) {
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
 			msgAuthToken = authToken
 			msg.from = string(addr)
 			return msg, nil
@@ -321,6 +778,18 @@ func TestAuth(t *testing.T) {
 		return c
 	}
 
+	t.Run("before STARTTLS", func(t *testing.T) {
+		c, err := smtp.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Text.Writer.W.WriteString("AUTH LOGIN\r\n")
+		c.Text.Writer.W.Flush()
+		if _, _, err := c.Text.ReadCodeLine(530); err != nil {
+			t.Errorf("AUTH before STARTTLS: %v, want 530", err)
+		}
+	})
 	t.Run("noauth", func(t *testing.T) {
 		c := newClient(t)
 		defer c.Close()
@@ -409,3 +878,169 @@ func TestAuth(t *testing.T) {
 		}
 	})
 }
+
+func TestApplyMilter(t *testing.T) {
+	const msg = "From: a@example.org\r\n" +
+		"Subject: hi\r\n" +
+		"Received: from x\r\n" +
+		"\tby y\r\n" +
+		"\r\n" +
+		"hello\r\n"
+	tests := []struct {
+		name string
+		res  milter.Response
+		want string
+	}{
+		{
+			name: "unchanged",
+			want: msg,
+		},
+		{
+			name: "add and change",
+			res: milter.Response{HeaderMods: []milter.HeaderMod{
+				{Op: milter.HeaderAdd, Name: "X-Spam", Value: "yes"},
+				{Op: milter.HeaderChange, Index: 1, Name: "subject", Value: "[SPAM] hi"},
+			}},
+			want: "From: a@example.org\r\n" +
+				"subject: [SPAM] hi\r\n" +
+				"Received: from x\r\n" +
+				"\tby y\r\n" +
+				"X-Spam: yes\r\n" +
+				"\r\n" +
+				"hello\r\n",
+		},
+		{
+			name: "insert delete and body",
+			res: milter.Response{
+				HeaderMods: []milter.HeaderMod{
+					{Op: milter.HeaderInsert, Index: 0, Name: "X-Scanned", Value: "ok"},
+					{Op: milter.HeaderChange, Index: 1, Name: "Received"},
+				},
+				Body: []byte("bye\r\n"),
+			},
+			want: "X-Scanned: ok\r\n" +
+				"From: a@example.org\r\n" +
+				"Subject: hi\r\n" +
+				"\r\n" +
+				"bye\r\n",
+		},
+		{
+			name: "quarantine",
+			res:  milter.Response{Quarantine: "virus"},
+			want: "From: a@example.org\r\n" +
+				"Subject: hi\r\n" +
+				"Received: from x\r\n" +
+				"\tby y\r\n" +
+				"X-Quarantine: virus\r\n" +
+				"\r\n" +
+				"hello\r\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(applyMilter([]byte(msg), &test.res))
+			if got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	type span struct {
+		Name       string
+		Attributes []struct {
+			Key   string
+			Value map[string]interface{}
+		}
+		Status *struct{ Code int }
+	}
+	spansCh := make(chan []span, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct{ Spans []span }
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		spansCh <- req.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer collector.Close()
+	tracer := otlptrace.NewExporter(collector.URL)
+	go tracer.Run()
+
+	ln := listen(t)
+	server := &Server{
+		Hostname: "testing",
+		NewMessage: func(_ net.Addr, addr []byte, _ MailParams, authToken uint64) (Msg, error) {
+			return new(memMsg), nil
+		},
+		Logf:      t.Logf,
+		TLSConfig: tlstest.ServerConfig,
+		Tracer:    tracer,
+	}
+	go server.ServeSTARTTLS(ln)
+
+	time.Sleep(5 * time.Millisecond)
+	c, err := smtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	if err := c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	server.Shutdown(context.Background())
+	tracer.Shutdown(context.Background())
+
+	var spans []span
+	select {
+	case spans = <-spansCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans exported")
+	}
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	for i, wantReply := range []string{"250 2.0.0 OK: queued", "250 2.0.0 OK"} {
+		sp := spans[i]
+		if sp.Name != "smtp transaction" {
+			t.Errorf("span %d name %q", i, sp.Name)
+		}
+		if sp.Status != nil {
+			t.Errorf("span %d status %+v, want OK", i, sp.Status)
+		}
+		attrs := make(map[string]interface{})
+		for _, a := range sp.Attributes {
+			for _, v := range a.Value {
+				attrs[a.Key] = v
+			}
+		}
+		if got := attrs["smtp.reply"]; got != wantReply {
+			t.Errorf("span %d reply %q, want %q", i, got, wantReply)
+		}
+		if got := attrs["smtp.from"]; got != "from@example.com" {
+			t.Errorf("span %d from %q", i, got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package apppass lets users manage the app-specific passwords
+// their mail clients log in to IMAP and SMTP with.
+//
+// Protocol logins only accept app passwords, so this is where
+// the account password and, if the user has enabled it, the
+// TOTP second factor are checked, see db.Authenticator.AuthUser.
+package apppass
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"spilled.ink/spilldb/db"
+)
+
+// Handler serves the app passwords of the logged in user:
+//
+//	POST /apppass/list                   lists the devices
+//	POST /apppass/add?name=<name>        creates an app password
+//	POST /apppass/revoke?device=<id>     revokes an app password
+//
+// Every request carries the form fields username, password, and,
+// for users with two-factor authentication, totp. A request
+// without a needed code is refused with 401 and the body
+// "totp required", so a login form can ask for one.
+type Handler struct {
+	Auth *db.Authenticator
+}
+
+// Created is the JSON response to an add request.
+// The password is only ever reported here.
+type Created struct {
+	DeviceID int64  `json:"device_id"`
+	Password string `json:"password"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, "/apppass/")
+	if action != "list" && action != "add" && action != "revoke" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+	code := r.PostFormValue("totp")
+	userID, err := h.Auth.AuthUser(ctx, remoteAddr, username, []byte(password), code)
+	if err == db.ErrTOTPRequired {
+		http.Error(w, "totp required", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn := h.Auth.DB.Get(ctx)
+	if conn == nil {
+		return
+	}
+	defer h.Auth.DB.Put(conn)
+
+	var res interface{}
+	switch action {
+	case "list":
+		devices, err := db.Devices(conn, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res = devices
+	case "add":
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+		password, err := db.NewAppPassword()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deviceID, err := db.AddDevice(conn, userID, name, password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res = Created{DeviceID: deviceID, Password: password}
+	case "revoke":
+		deviceID, err := strconv.ParseInt(r.FormValue("device"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad device", http.StatusBadRequest)
+			return
+		}
+		if err := db.RevokeDevice(conn, userID, deviceID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		res = struct{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
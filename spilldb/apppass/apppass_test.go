@@ -0,0 +1,125 @@
+package apppass
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"spilled.ink/spilldb/db"
+	"spilled.ink/util/totp"
+)
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apppass-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	const username = "foo@spilled.ink"
+	const password = "agenericpassword"
+	conn := dbpool.Get(nil)
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := db.SetupTOTP(conn, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	enableCode, err := totp.Code(secret, now.Add(-30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableTOTP(conn, userID, enableCode, now.Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+
+	auth := &db.Authenticator{
+		DB:    dbpool,
+		Logf:  func(format string, v ...interface{}) {},
+		Where: "test",
+	}
+	ts := httptest.NewServer(&Handler{Auth: auth})
+	defer ts.Close()
+
+	post := func(action string, form url.Values) (int, string) {
+		t.Helper()
+		res, err := http.PostForm(ts.URL+"/apppass/"+action, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(b)
+	}
+	login := url.Values{"username": {username}, "password": {password}}
+
+	if code, body := post("list", login); code != http.StatusUnauthorized || !strings.Contains(body, "totp required") {
+		t.Errorf("no code: %d %q, want totp required", code, body)
+	}
+	login.Set("totp", "000000")
+	if code, _ := post("list", login); code != http.StatusUnauthorized {
+		t.Errorf("bad code: %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	code, err := totp.Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login.Set("totp", code)
+	login.Set("name", "laptop")
+	status, body := post("add", login)
+	if status != http.StatusOK {
+		t.Fatalf("add: %d %s", status, body)
+	}
+	var created Created
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new app password logs in to a protocol.
+	gotUserID, err := auth.AuthDevice(context.Background(), "10.0.0.1", username, []byte(created.Password))
+	if err != nil || gotUserID != userID {
+		t.Errorf("AuthDevice with new app password = %d, %v; want %d", gotUserID, err, userID)
+	}
+
+	// The TOTP code has been used and a login needs the next one.
+	login.Set("device", strconv.FormatInt(created.DeviceID, 10))
+	if status, _ := post("revoke", login); status != http.StatusUnauthorized {
+		t.Errorf("revoke with a used code: %d, want %d", status, http.StatusUnauthorized)
+	}
+	code, err = totp.Code(secret, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	login.Set("totp", code)
+	if status, body := post("revoke", login); status != http.StatusOK {
+		t.Fatalf("revoke: %d %s", status, body)
+	}
+	if _, err := auth.AuthDevice(context.Background(), "10.0.0.1", username, []byte(created.Password)); err != db.ErrBadCredentials {
+		t.Errorf("AuthDevice with revoked app password: %v, want ErrBadCredentials", err)
+	}
+}
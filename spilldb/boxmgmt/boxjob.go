@@ -0,0 +1,111 @@
+package boxmgmt
+
+import (
+	"context"
+	"time"
+
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/spillbox"
+)
+
+// boxJob runs a task on every user mailbox at an interval until it
+// is shut down. It is embedded in the periodic mailbox jobs, such as
+// the Compressor.
+type boxJob struct {
+	ctx      context.Context
+	cancelFn func()
+	done     chan struct{}
+
+	bm *BoxMgmt
+}
+
+func newBoxJob(bm *BoxMgmt) boxJob {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return boxJob{
+		ctx:      ctx,
+		cancelFn: cancelFn,
+		done:     make(chan struct{}),
+		bm:       bm,
+	}
+}
+
+// boxTask is the work of a job on one mailbox.
+// It returns the data to log, nil if there is nothing to report.
+type boxTask func(ctx context.Context, box *spillbox.Box) (data map[string]interface{}, err error)
+
+// jobSpec describes a periodic mailbox job.
+type jobSpec struct {
+	What     string // the db.Log What and Where of its runs
+	Where    string
+	Interval time.Duration
+	Logf     func(format string, v ...interface{})
+	Enabled  func() bool // if set, runs are skipped while it reports false
+	Task     boxTask
+}
+
+func (j *boxJob) run(spec jobSpec) error {
+	defer func() { close(j.done) }()
+
+	t := time.NewTicker(spec.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-j.ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		if spec.Enabled != nil && !spec.Enabled() {
+			continue
+		}
+
+		if err := j.runUsers(spec); err != nil {
+			if err == context.Canceled {
+				return nil
+			}
+			spec.Logf("%s", db.Log{
+				What:  spec.What,
+				Where: spec.Where,
+				When:  time.Now(),
+				Err:   err,
+			})
+		}
+	}
+}
+
+func (j *boxJob) Shutdown(ctx context.Context) error {
+	j.cancelFn()
+	<-j.done
+	return nil
+}
+
+func (j *boxJob) runUsers(spec jobSpec) error {
+	userIDs, err := j.bm.UserIDs(j.ctx)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		start := time.Now()
+		u, err := j.bm.Open(j.ctx, userID)
+		if err != nil {
+			return err
+		}
+		data, err := spec.Task(j.ctx, u.Box)
+		if err == context.Canceled {
+			return err
+		}
+		if data == nil && err == nil {
+			continue
+		}
+		// A failure in one mailbox should not stop the others.
+		spec.Logf("%s", db.Log{
+			What:     spec.What,
+			Where:    spec.Where,
+			When:     start,
+			Duration: time.Since(start),
+			UserID:   userID,
+			Err:      err,
+			Data:     data,
+		})
+	}
+	return nil
+}
@@ -8,18 +8,47 @@ package boxmgmt
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"crawshaw.io/iox"
 	"crawshaw.io/sqlite/sqlitex"
 	"spilled.ink/imap"
+	"spilled.ink/spilldb/db"
 	"spilled.ink/spilldb/spillbox"
 )
 
 type BoxMgmt struct {
+	// BlobKey, if set, is the 32-byte server master key.
+	// Mailboxes are opened with blob sealing, each user's
+	// key is wrapped by this one in the spilld database.
+	BlobKey []byte
+
+	// ObjectStore, if set, is where the Offloader moves large
+	// blobs. See spillbox.Box.OffloadBlobs.
+	ObjectStore spillbox.ObjectStore
+
+	// Replicate records the changes to every mailbox opened
+	// for a standby to fetch. See spillbox.Box.EnableReplication.
+	Replicate bool
+
+	// WriteTimeout is how long a writer waits for a mailbox's
+	// write connection, see spillbox.Box.WriteTimeout.
+	WriteTimeout time.Duration
+
+	// BusyTimeout, if set, is how long mailbox connections retry
+	// while the database is locked by another process.
+	BusyTimeout time.Duration
+
+	// Logf logs the repairs made to mailboxes when they are opened.
+	Logf func(format string, v ...interface{})
+
 	filer      *iox.Filer
 	spilldPool *sqlitex.Pool
 	dbdir      string
@@ -35,6 +64,7 @@ func New(filer *iox.Filer, spilldPool *sqlitex.Pool, dbdir string) (*BoxMgmt, er
 		spilldPool: spilldPool,
 		dbdir:      dbdir,
 		users:      make(map[int64]*User),
+		Logf:       func(format string, v ...interface{}) {},
 	}
 	return bm, nil
 }
@@ -51,6 +81,7 @@ func (bm *BoxMgmt) RegisterNotifier(n imap.Notifier) {
 
 // Open returns an existing user's database connection.
 // It returns a cached connection if the user db is already open.
+// A mailbox is repaired the first time it is opened, see Repair.
 // TODO: rename. We don't track openness as a resource so the name is confusing.
 func (bm *BoxMgmt) Open(ctx context.Context, userID int64) (*User, error) {
 	bm.mu.Lock()
@@ -64,25 +95,138 @@ func (bm *BoxMgmt) Open(ctx context.Context, userID int64) (*User, error) {
 		userID: userID,
 	}
 
-	dbfile := "file::memory:?mode=memory"
-	if bm.dbdir != "" {
-		dir := filepath.Join(bm.dbdir, "users")
-		os.MkdirAll(dir, 0770)
-		dbfile = filepath.Join(dir, fmt.Sprintf("spilld_user%d.db", userID))
-	}
-	box, err := spillbox.New(userID, bm.filer, dbfile, 4)
+	box, err := spillbox.New(userID, bm.filer, bm.dbfile(userID), 4)
 	if err != nil {
 		return nil, err
 	}
+	box.CompressThreshold = spillbox.DefaultCompressThreshold
+	box.ObjectStore = bm.ObjectStore
+	box.WriteTimeout = bm.WriteTimeout
+	if bm.BusyTimeout > 0 {
+		box.SetBusyTimeout(bm.BusyTimeout)
+	}
+	if bm.BlobKey != nil {
+		if err := bm.setBlobKey(ctx, box, userID); err != nil {
+			box.Close()
+			return nil, err
+		}
+	}
+	if bm.Replicate {
+		if err := box.EnableReplication(ctx); err != nil {
+			box.Close()
+			return nil, err
+		}
+	}
 	for _, n := range bm.notifiers {
 		box.RegisterNotifier(n)
 	}
+	// Errors are logged by repair, a mailbox that
+	// cannot be repaired is still served.
+	bm.repair(ctx, userID, box)
 
 	u.Box = box
 	bm.users[userID] = u
 	return u, nil
 }
 
+// UserIDs lists the users with a mailbox.
+func (bm *BoxMgmt) UserIDs(ctx context.Context) (userIDs []int64, err error) {
+	conn := bm.spilldPool.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer bm.spilldPool.Put(conn)
+
+	stmt := conn.Prep("SELECT UserID FROM Users;")
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		userIDs = append(userIDs, stmt.GetInt64("UserID"))
+	}
+	return userIDs, nil
+}
+
+func (bm *BoxMgmt) dbfile(userID int64) string {
+	if bm.dbdir == "" {
+		return "file::memory:?mode=memory"
+	}
+	dir := filepath.Join(bm.dbdir, "users")
+	os.MkdirAll(dir, 0770)
+	return filepath.Join(dir, fmt.Sprintf("spilld_user%d.db", userID))
+}
+
+// Backup writes a snapshot of a user's mailbox to a new
+// directory, see spillbox.Box.Backup. It is safe to call
+// while the mailbox is in use.
+func (bm *BoxMgmt) Backup(ctx context.Context, userID int64, dir string) error {
+	if bm.dbdir == "" {
+		return fmt.Errorf("boxmgmt.Backup: no database directory")
+	}
+	u, err := bm.Open(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0770); err != nil {
+		return fmt.Errorf("boxmgmt.Backup: %v", err)
+	}
+	return u.Box.Backup(ctx, filepath.Join(dir, filepath.Base(bm.dbfile(userID))))
+}
+
+// Restore replaces a user's mailbox with a backup made by Backup.
+// See spillbox.Restore.
+//
+// The mailbox is closed first, but no other process may have it
+// open, so spilld should not be running.
+func (bm *BoxMgmt) Restore(ctx context.Context, userID int64, dir string) error {
+	if bm.dbdir == "" {
+		return fmt.Errorf("boxmgmt.Restore: no database directory")
+	}
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if u := bm.users[userID]; u != nil {
+		delete(bm.users, userID)
+		if err := u.Box.Close(); err != nil {
+			return fmt.Errorf("boxmgmt.Restore: %v", err)
+		}
+	}
+	dbfile := bm.dbfile(userID)
+	backupfile := filepath.Join(dir, filepath.Base(dbfile))
+	return spillbox.Restore(ctx, bm.filer, userID, dbfile, backupfile)
+}
+
+// ReadKeyFile reads a BlobKey, written as 64 hex digits.
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("boxmgmt: blob key: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("boxmgmt: blob key %s: %v", path, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("boxmgmt: blob key %s is %d bytes, want 32", path, len(key))
+	}
+	return key, nil
+}
+
+func (bm *BoxMgmt) setBlobKey(ctx context.Context, box *spillbox.Box, userID int64) error {
+	conn := bm.spilldPool.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	key, err := db.UserBlobKey(conn, userID, bm.BlobKey)
+	bm.spilldPool.Put(conn)
+	if err != nil {
+		return fmt.Errorf("boxmgmt: %v", err)
+	}
+	return box.SetBlobKey(key)
+}
+
 func (bm *BoxMgmt) Close() error {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
@@ -0,0 +1,44 @@
+package boxmgmt
+
+import (
+	"context"
+	"time"
+
+	"spilled.ink/spilldb/spillbox"
+)
+
+// Compressor periodically compresses large text parts in user mailboxes.
+type Compressor struct {
+	Logf      func(format string, v ...interface{})
+	Threshold int64 // see spillbox.Box.CompressParts
+
+	boxJob
+}
+
+func NewCompressor(bm *BoxMgmt) *Compressor {
+	return &Compressor{
+		Logf:      func(format string, v ...interface{}) {},
+		Threshold: spillbox.DefaultCompressThreshold,
+		boxJob:    newBoxJob(bm),
+	}
+}
+
+func (c *Compressor) Run() error {
+	return c.run(jobSpec{
+		What:     "compress",
+		Where:    "compressor",
+		Interval: 6 * time.Hour,
+		Logf:     c.Logf,
+		Task:     c.compress,
+	})
+}
+
+func (c *Compressor) compress(ctx context.Context, box *spillbox.Box) (map[string]interface{}, error) {
+	stats, err := box.CompressParts(ctx, c.Threshold)
+	return map[string]interface{}{
+		"parts_compressed": stats.Parts,
+		"bytes_before":     stats.BytesBefore,
+		"bytes_after":      stats.BytesAfter,
+		"bytes_saved":      stats.Saved(),
+	}, err
+}
@@ -0,0 +1,49 @@
+package boxmgmt
+
+import (
+	"context"
+	"time"
+
+	"spilled.ink/spilldb/spillbox"
+)
+
+// DefaultOffloadThreshold is the stored size of a blob, in bytes,
+// above which the Offloader moves it to the object store.
+const DefaultOffloadThreshold = 1 << 20
+
+// Offloader periodically moves large blobs in user mailboxes
+// to the ObjectStore of the BoxMgmt. It does nothing if there
+// is no ObjectStore.
+type Offloader struct {
+	Logf      func(format string, v ...interface{})
+	Threshold int64 // see spillbox.Box.OffloadBlobs
+
+	boxJob
+}
+
+func NewOffloader(bm *BoxMgmt) *Offloader {
+	return &Offloader{
+		Logf:      func(format string, v ...interface{}) {},
+		Threshold: DefaultOffloadThreshold,
+		boxJob:    newBoxJob(bm),
+	}
+}
+
+func (o *Offloader) Run() error {
+	return o.run(jobSpec{
+		What:     "offload",
+		Where:    "offloader",
+		Interval: time.Hour,
+		Logf:     o.Logf,
+		Enabled:  func() bool { return o.bm.ObjectStore != nil },
+		Task:     o.offload,
+	})
+}
+
+func (o *Offloader) offload(ctx context.Context, box *spillbox.Box) (map[string]interface{}, error) {
+	stats, err := box.OffloadBlobs(ctx, o.Threshold)
+	return map[string]interface{}{
+		"blobs_offloaded": stats.Blobs,
+		"bytes_offloaded": stats.Bytes,
+	}, err
+}
@@ -0,0 +1,75 @@
+package boxmgmt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/spillbox"
+)
+
+// Repair completes or fails the messages of a user's mailbox left
+// half inserted by a crash, see spillbox.Box.Repair. Failed
+// messages spilld delivered are marked DeliveryReceived again,
+// so the local sender cleaves and inserts them anew.
+//
+// Mailboxes are repaired when they are opened. It reports the
+// number of deliveries to be run again.
+func (bm *BoxMgmt) Repair(ctx context.Context, userID int64) (stats spillbox.RepairStats, redeliver int, err error) {
+	u, err := bm.Open(ctx, userID)
+	if err != nil {
+		return stats, 0, err
+	}
+	return bm.repair(ctx, userID, u.Box)
+}
+
+func (bm *BoxMgmt) repair(ctx context.Context, userID int64, box *spillbox.Box) (stats spillbox.RepairStats, redeliver int, err error) {
+	start := time.Now()
+	defer func() {
+		if stats.Stuck == 0 && err == nil {
+			return
+		}
+		bm.Logf("%s", db.Log{
+			What:     "repair",
+			Where:    "boxmgmt",
+			When:     start,
+			Duration: time.Since(start),
+			UserID:   userID,
+			Err:      err,
+			Data: map[string]interface{}{
+				"stuck":      stats.Stuck,
+				"completed":  stats.Completed,
+				"failed":     stats.Failed,
+				"redelivery": redeliver,
+			},
+		})
+	}()
+
+	stats, err = box.Repair(ctx)
+	if err != nil || len(stats.Redeliver) == 0 {
+		return stats, 0, err
+	}
+
+	conn := bm.spilldPool.Get(ctx)
+	if conn == nil {
+		return stats, 0, context.Canceled
+	}
+	defer bm.spilldPool.Put(conn)
+
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryReceived
+		WHERE StagingID = $stagingID AND UserID = $userID
+		AND DeliveryState = $deliveryDone;`)
+	for _, stagingID := range stats.Redeliver {
+		stmt.Reset()
+		stmt.SetInt64("$deliveryReceived", int64(db.DeliveryReceived))
+		stmt.SetInt64("$deliveryDone", int64(db.DeliveryDone))
+		stmt.SetInt64("$stagingID", stagingID)
+		stmt.SetInt64("$userID", userID)
+		if _, err := stmt.Step(); err != nil {
+			return stats, redeliver, fmt.Errorf("boxmgmt.Repair: staging ID %d: %v", stagingID, err)
+		}
+		redeliver += conn.Changes()
+	}
+	return stats, redeliver, nil
+}
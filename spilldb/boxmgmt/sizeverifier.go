@@ -0,0 +1,46 @@
+package boxmgmt
+
+import (
+	"context"
+	"time"
+
+	"spilled.ink/spilldb/spillbox"
+)
+
+// SizeVerifier periodically checks the RFC822.SIZE of new messages
+// in user mailboxes, see spillbox.Box.VerifySizes.
+type SizeVerifier struct {
+	Logf func(format string, v ...interface{})
+
+	boxJob
+}
+
+func NewSizeVerifier(bm *BoxMgmt) *SizeVerifier {
+	return &SizeVerifier{
+		Logf:   func(format string, v ...interface{}) {},
+		boxJob: newBoxJob(bm),
+	}
+}
+
+func (v *SizeVerifier) Run() error {
+	return v.run(jobSpec{
+		What:     "verify-sizes",
+		Where:    "sizeverifier",
+		Interval: time.Hour,
+		Logf:     v.Logf,
+		Task:     v.verify,
+	})
+}
+
+func (v *SizeVerifier) verify(ctx context.Context, box *spillbox.Box) (map[string]interface{}, error) {
+	stats, err := box.VerifySizes(ctx, false)
+	if stats.Msgs == 0 && err == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"msgs":   stats.Msgs,
+		"fixed":  stats.Fixed,
+		"failed": stats.Failed,
+		"delta":  stats.Delta,
+	}, err
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// AuditEvent is a security-relevant event on a user account.
+type AuditEvent string
+
+const (
+	AuditLogin         AuditEvent = "login"          // device password login, Detail is the protocol
+	AuditLoginFailed   AuditEvent = "login-failed"   // bad password for a known user
+	AuditMailboxDelete AuditEvent = "mailbox-delete" // Detail is the mailbox name
+	AuditExpunge       AuditEvent = "expunge"        // Detail is the mailbox and count
+	AuditPassword      AuditEvent = "password"       // app password added or revoked
+	AuditTOTP          AuditEvent = "totp"           // two-factor authentication enabled or disabled
+	AuditPushRegister  AuditEvent = "push-register"  // Detail is the mailbox
+)
+
+// DefaultAuditRetention is how long the Janitor keeps audit entries.
+const DefaultAuditRetention = 365 * 24 * time.Hour
+
+// AuditEntry is a row of the AuditLog.
+type AuditEntry struct {
+	UserID int64
+	Time   time.Time
+	Event  AuditEvent
+	Addr   string // remote address of the client, if any
+	Client string // device or client name, if known
+	Detail string
+}
+
+// Audit appends an entry to the AuditLog.
+// A zero Time is the present.
+func Audit(conn *sqlite.Conn, e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	stmt := conn.Prep(`INSERT INTO AuditLog (UserID, Time, Event, Addr, Client, Detail)
+		VALUES ($userID, $time, $event, $addr, $client, $detail);`)
+	stmt.SetInt64("$userID", e.UserID)
+	stmt.SetInt64("$time", e.Time.Unix())
+	stmt.SetText("$event", string(e.Event))
+	stmt.SetText("$addr", e.Addr)
+	stmt.SetText("$client", e.Client)
+	stmt.SetText("$detail", e.Detail)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.Audit: %v", err)
+	}
+	return nil
+}
+
+// AuditQuery selects entries for FindAudit.
+// Zero fields match everything.
+type AuditQuery struct {
+	UserID int64
+	Event  AuditEvent
+	Since  time.Time
+	Limit  int // default 100
+}
+
+// FindAudit finds AuditLog entries, most recent first.
+func FindAudit(conn *sqlite.Conn, q AuditQuery) (entries []AuditEntry, err error) {
+	var where []string
+	if q.UserID != 0 {
+		where = append(where, "UserID = $userID")
+	}
+	if q.Event != "" {
+		where = append(where, "Event = $event")
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "Time >= $since")
+	}
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	stmt := conn.Prep(`SELECT UserID, Time, Event, Addr, Client, Detail
+		FROM AuditLog ` + whereClause + `
+		ORDER BY Time DESC, AuditID DESC
+		LIMIT $limit;`)
+	if q.UserID != 0 {
+		stmt.SetInt64("$userID", q.UserID)
+	}
+	if q.Event != "" {
+		stmt.SetText("$event", string(q.Event))
+	}
+	if !q.Since.IsZero() {
+		stmt.SetInt64("$since", q.Since.Unix())
+	}
+	stmt.SetInt64("$limit", int64(limit))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("db.FindAudit: %v", err)
+		} else if !hasNext {
+			break
+		}
+		entries = append(entries, AuditEntry{
+			UserID: stmt.GetInt64("UserID"),
+			Time:   time.Unix(stmt.GetInt64("Time"), 0),
+			Event:  AuditEvent(stmt.GetText("Event")),
+			Addr:   stmt.GetText("Addr"),
+			Client: stmt.GetText("Client"),
+			Detail: stmt.GetText("Detail"),
+		})
+	}
+	return entries, nil
+}
+
+// pruneAuditLog removes the entries older than the retention period.
+func pruneAuditLog(conn *sqlite.Conn, now time.Time, retention time.Duration) (int, error) {
+	stmt := conn.Prep(`DELETE FROM AuditLog WHERE Time < $cutoff;`)
+	stmt.SetInt64("$cutoff", now.Add(-retention).Unix())
+	if _, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("db.pruneAuditLog: %v", err)
+	}
+	return conn.Changes(), nil
+}
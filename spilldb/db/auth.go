@@ -1,12 +1,12 @@
 package db
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"time"
 
+	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 
 	"golang.org/x/crypto/bcrypt"
@@ -16,18 +16,27 @@ import (
 type Authenticator struct {
 	DB       *sqlitex.Pool
 	Throttle throttle.Throttle
+	Lockout  *Lockout // if set, locks out repeated failures
 	Logf     func(format string, v ...interface{})
 	Where    string
 }
 
 var errAuthFailed = errors.New("authenticator: internal error")
 var errPassDeleted = errors.New("authenticator: password deleted")
+var errLockedOut = errors.New("authenticator: locked out")
 var ErrBadCredentials = errors.New("authenticator: bad credentials")
 
 func (a *Authenticator) AuthDevice(ctx context.Context, remoteAddr, username string, password []byte) (userID int64, err error) {
+	userID, _, err = a.AuthDeviceID(ctx, remoteAddr, username, password)
+	return userID, err
+}
+
+// AuthDeviceID is AuthDevice, also reporting the device
+// whose password was used.
+func (a *Authenticator) AuthDeviceID(ctx context.Context, remoteAddr, username string, password []byte) (userID, deviceID int64, err error) {
 	conn := a.DB.Get(ctx)
 	if conn == nil {
-		return 0, context.Canceled
+		return 0, 0, context.Canceled
 	}
 	defer a.DB.Put(conn)
 
@@ -46,47 +55,42 @@ func (a *Authenticator) AuthDevice(ctx context.Context, remoteAddr, username str
 		a.Logf("%s", log.String())
 	}()
 
-	password = bytes.ToUpper(password)
-	password = bytes.Replace(password, []byte(" "), []byte(""), -1)
+	password = normalizeAppPassword(password)
 
-	if remoteAddr != "" && a.Throttle.Throttle(remoteAddr) {
-		log.Data["throttle"] = "remote_addr"
-	} else if a.Throttle.Throttle(username) {
-		log.Data["throttle"] = "username"
+	record, err := a.limit(conn, log, remoteAddr, username, start)
+	if err != nil {
+		return 0, 0, err
 	}
-	defer func() {
-		if err != nil {
-			if remoteAddr != "" {
-				a.Throttle.Add(remoteAddr)
-			}
-			a.Throttle.Add(username)
-		}
-	}()
+	defer func() { record(err) }()
 
 	var devices int
-	var deviceID int64
-	stmt := conn.Prep(`SELECT DeviceID, UserID, AppPassHash, Deleted FROM Devices
+	var knownUserID int64
+	var deviceName string
+	stmt := conn.Prep(`SELECT DeviceID, UserID, DeviceName, AppPassHash, Deleted FROM Devices
 		WHERE UserID IN (SELECT UserID FROM UserAddresses WHERE Address = $username);`)
 	stmt.SetText("$username", username)
 	for {
 		if hasNext, err := stmt.Step(); err != nil {
 			log.Err = err
-			return 0, errAuthFailed
+			return 0, 0, errAuthFailed
 		} else if !hasNext {
 			break
 		}
 		devices++
+		knownUserID = stmt.GetInt64("UserID")
 
 		passHash := []byte(stmt.GetText("AppPassHash"))
 		if err := bcrypt.CompareHashAndPassword(passHash, password); err == nil {
 			deleted := stmt.GetInt64("Deleted") != 0
 			deviceID = stmt.GetInt64("DeviceID")
 			userID = stmt.GetInt64("UserID")
+			deviceName = stmt.GetText("DeviceName")
 			stmt.Reset()
 
 			if deleted {
 				log.Err = errPassDeleted
-				return 0, ErrBadCredentials
+				a.auditFailure(conn, log, knownUserID, remoteAddr)
+				return 0, 0, ErrBadCredentials
 			}
 			break
 		}
@@ -94,10 +98,11 @@ func (a *Authenticator) AuthDevice(ctx context.Context, remoteAddr, username str
 	log.Data["device_id"] = deviceID
 	if devices == 0 {
 		log.Err = errors.New("unknown username")
-		return 0, ErrBadCredentials
+		return 0, 0, ErrBadCredentials
 	} else if userID == 0 {
 		log.Err = errors.New("bad password")
-		return 0, ErrBadCredentials
+		a.auditFailure(conn, log, knownUserID, remoteAddr)
+		return 0, 0, ErrBadCredentials
 	}
 	log.UserID = userID
 
@@ -109,8 +114,85 @@ func (a *Authenticator) AuthDevice(ctx context.Context, remoteAddr, username str
 	stmt.SetText("$addr", remoteAddr)
 	if _, err := stmt.Step(); err != nil {
 		log.Err = fmt.Errorf("device update failed: %v", err)
-		return 0, errAuthFailed
+		return 0, 0, errAuthFailed
+	}
+	err = Audit(conn, AuditEntry{
+		UserID: userID,
+		Event:  AuditLogin,
+		Addr:   remoteAddr,
+		Client: deviceName,
+		Detail: a.Where,
+	})
+	if err != nil {
+		log.Err = err
+		return 0, 0, errAuthFailed
 	}
 
-	return userID, nil
+	return userID, deviceID, nil
+}
+
+// limit applies the Throttle and Lockout to a login attempt.
+// It refuses the attempt with ErrBadCredentials during a lockout,
+// otherwise record must be called with the result of the attempt.
+// Only ErrBadCredentials counts toward a lockout and only success
+// clears it.
+func (a *Authenticator) limit(conn *sqlite.Conn, log *Log, remoteAddr, username string, now time.Time) (record func(err error), err error) {
+	if remoteAddr != "" && a.Throttle.Throttle(remoteAddr) {
+		log.Data["throttle"] = "remote_addr"
+	} else if a.Throttle.Throttle(username) {
+		log.Data["throttle"] = "username"
+	}
+	throttle := func(err error) {
+		if err != nil {
+			if remoteAddr != "" {
+				a.Throttle.Add(remoteAddr)
+			}
+			a.Throttle.Add(username)
+		}
+	}
+	if a.Lockout == nil {
+		return throttle, nil
+	}
+
+	until, err := a.Lockout.lockedUntil(conn, remoteAddr, username, now)
+	if err != nil {
+		log.Err = err
+		throttle(errAuthFailed)
+		return nil, errAuthFailed
+	}
+	if !until.IsZero() {
+		log.Data["locked_until"] = until.Unix()
+		log.Err = errLockedOut
+		throttle(ErrBadCredentials)
+		return nil, ErrBadCredentials
+	}
+	return func(err error) {
+		if err == ErrBadCredentials {
+			until, lerr := a.Lockout.fail(conn, remoteAddr, username, now)
+			if lerr != nil {
+				log.Err = lerr
+			} else if !until.IsZero() {
+				log.Data["lockout"] = until.Unix()
+			}
+		} else if err == nil {
+			if lerr := a.Lockout.succeed(conn, remoteAddr, username); lerr != nil {
+				log.Err = lerr
+			}
+		}
+		throttle(err)
+	}, nil
+}
+
+// auditFailure records a failed login to a known user's account.
+// An error is only logged, the login has already failed.
+func (a *Authenticator) auditFailure(conn *sqlite.Conn, log *Log, userID int64, remoteAddr string) {
+	err := Audit(conn, AuditEntry{
+		UserID: userID,
+		Event:  AuditLoginFailed,
+		Addr:   remoteAddr,
+		Detail: a.Where,
+	})
+	if err != nil {
+		log.Data["audit_err"] = err.Error()
+	}
 }
@@ -7,10 +7,12 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"crawshaw.io/iox"
 
 	"spilled.ink/spilldb/db"
+	"spilled.ink/util/totp"
 )
 
 func TestAuthenticator(t *testing.T) {
@@ -69,3 +71,489 @@ func TestAuthenticator(t *testing.T) {
 		t.Errorf("AuthDevice with bad password want log to mention it, got %s", log)
 	}
 }
+
+func TestAuthenticatorLockout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	const username = "foo@spilled.ink"
+	const devPassword = "AAAABBBBCCCCDDDD"
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddDevice(conn, userID, "testdevice", devPassword); err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+
+	ctx := context.Background()
+	var log string
+	a := &db.Authenticator{
+		Logf: func(format string, v ...interface{}) {
+			log = fmt.Sprintf(format, v...)
+		},
+		Where:   "test",
+		DB:      dbpool,
+		Lockout: &db.Lockout{Threshold: 3},
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.AuthDevice(ctx, "10.0.0.1:1234", username, []byte("bad")); err != db.ErrBadCredentials {
+			t.Fatalf("attempt %d: want ErrBadCredentials, got %v", i, err)
+		}
+	}
+	if !strings.Contains(log, "lockout") {
+		t.Errorf("third failure does not log a lockout: %s", log)
+	}
+
+	// The right password from a new port is refused during the lockout.
+	if _, err := a.AuthDevice(ctx, "10.0.0.1:5678", username, []byte(devPassword)); err != db.ErrBadCredentials {
+		t.Errorf("locked out login: want ErrBadCredentials, got %v", err)
+	} else if !strings.Contains(log, "locked_until") {
+		t.Errorf("locked out login does not log it: %s", log)
+	}
+
+	// Other remote addresses are not affected.
+	if authUserID, err := a.AuthDevice(ctx, "10.0.0.2:1234", username, []byte(devPassword)); err != nil {
+		t.Errorf("login from other address: %v", err)
+	} else if authUserID != userID {
+		t.Errorf("login from other address matched userID %d, want %d", authUserID, userID)
+	}
+
+	want := db.LockoutStats{Failures: 3, Lockouts: 1, Refused: 1}
+	if got := a.Lockout.Stats(); got != want {
+		t.Errorf("Stats()=%+v, want %+v", got, want)
+	}
+}
+
+func TestAppPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	const username = "foo@spilled.ink"
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := db.NewAppPassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pwd) != 19 || strings.Count(pwd, " ") != 3 {
+		t.Errorf("NewAppPassword()=%q, want four groups of four letters", pwd)
+	}
+	deviceID, err := db.AddDevice(conn, userID, "laptop", pwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+
+	a := &db.Authenticator{
+		Logf:  func(format string, v ...interface{}) {},
+		Where: "test",
+		DB:    dbpool,
+	}
+	ctx := context.Background()
+	login := strings.ToUpper(strings.Replace(pwd, " ", "", -1))
+	if _, err := a.AuthDevice(ctx, "", username, []byte(login)); err != nil {
+		t.Fatalf("AuthDevice with app password: %v", err)
+	}
+
+	conn = dbpool.Get(nil)
+	err = db.RevokeDevice(conn, userID, deviceID)
+	dbpool.Put(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthDevice(ctx, "", username, []byte(login)); err != db.ErrBadCredentials {
+		t.Errorf("AuthDevice with revoked app password: want ErrBadCredentials, got %v", err)
+	}
+}
+
+func TestDeviceClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+	const username = "foo@spilled.ink"
+	const devPassword = "AAAABBBBCCCCDDDD"
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceID, err := db.AddDevice(conn, userID, "phone", devPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &db.Authenticator{
+		Logf:  func(format string, v ...interface{}) {},
+		Where: "test",
+		DB:    dbpool,
+	}
+	_, authDeviceID, err := a.AuthDeviceID(context.Background(), "", username, []byte(devPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authDeviceID != deviceID {
+		t.Errorf("AuthDeviceID reports device %d, want %d", authDeviceID, deviceID)
+	}
+
+	c := db.ParseClientID(map[string]string{
+		"name":       "Mail",
+		"version":    "12.4",
+		"os":         "iOS",
+		"os-version": "12.4  (16G77)",
+	})
+	if c.Name != "Mail" || c.Version != "12.4" || c.OS != "iOS 12.4 (16G77)" {
+		t.Errorf("ParseClientID: %+v", c)
+	}
+	first := time.Date(2019, time.July, 1, 9, 0, 0, 0, time.UTC)
+	c.DeviceID = deviceID
+	c.LastSeen = first
+	c.LastAddr = "10.0.0.1:1234"
+	if err := db.RecordDeviceClient(conn, c); err != nil {
+		t.Fatal(err)
+	}
+	c.LastSeen = first.Add(time.Hour)
+	c.LastAddr = "10.0.0.2:5678"
+	if err := db.RecordDeviceClient(conn, c); err != nil {
+		t.Fatal(err)
+	}
+	upgraded := c
+	upgraded.Version = "13.0"
+	upgraded.LastSeen = first.Add(2 * time.Hour)
+	if err := db.RecordDeviceClient(conn, upgraded); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := db.DeviceClients(conn, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 {
+		t.Fatalf("DeviceClients reports %d clients, want 2: %+v", len(clients), clients)
+	}
+	if got := clients[0]; got.Version != "13.0" || got.DeviceName != "phone" {
+		t.Errorf("most recent client: %+v", got)
+	}
+	got := clients[1]
+	if !got.FirstSeen.Equal(first) || !got.LastSeen.Equal(c.LastSeen) || got.LastAddr != c.LastAddr {
+		t.Errorf("client seen twice: %+v", got)
+	}
+}
+
+func TestAuditLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	const username = "foo@spilled.ink"
+	const devPassword = "AAAABBBBCCCCDDDD"
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddDevice(conn, userID, "laptop", devPassword); err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+
+	a := &db.Authenticator{
+		Logf:  func(format string, v ...interface{}) {},
+		Where: "imap",
+		DB:    dbpool,
+	}
+	ctx := context.Background()
+	if _, err := a.AuthDevice(ctx, "10.0.0.1:1234", username, []byte("bad")); err != db.ErrBadCredentials {
+		t.Fatalf("AuthDevice with bad password: want ErrBadCredentials, got %v", err)
+	}
+	if _, err := a.AuthDevice(ctx, "10.0.0.2:1234", username, []byte(devPassword)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn = dbpool.Get(nil)
+	defer dbpool.Put(conn)
+	entries, err := db.FindAudit(conn, db.AuditQuery{UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(map[db.AuditEvent]db.AuditEntry)
+	for _, e := range entries {
+		events[e.Event] = e
+	}
+	if len(entries) != 3 {
+		t.Errorf("%d audit entries, want 3: %+v", len(entries), entries)
+	}
+	if e := events[db.AuditPassword]; e.Client != "laptop" {
+		t.Errorf("password entry: %+v", e)
+	}
+	if e := events[db.AuditLoginFailed]; e.Addr != "10.0.0.1:1234" || e.Detail != "imap" {
+		t.Errorf("failed login entry: %+v", e)
+	}
+	if e := events[db.AuditLogin]; e.Addr != "10.0.0.2:1234" || e.Client != "laptop" {
+		t.Errorf("login entry: %+v", e)
+	}
+
+	logins, err := db.FindAudit(conn, db.AuditQuery{UserID: userID, Event: db.AuditLogin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 {
+		t.Errorf("%d login entries, want 1", len(logins))
+	}
+	later, err := db.FindAudit(conn, db.AuditQuery{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(later) != 0 {
+		t.Errorf("entries in the future: %+v", later)
+	}
+}
+
+func TestAuthUserTOTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	const username = "foo@spilled.ink"
+	const password = "agenericpassword"
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+
+	ctx := context.Background()
+	a := &db.Authenticator{
+		Logf:  func(format string, v ...interface{}) {},
+		Where: "test",
+		DB:    dbpool,
+	}
+	const addr = "10.0.0.1:1234"
+
+	if got, err := a.AuthUser(ctx, addr, username, []byte(password), ""); err != nil || got != userID {
+		t.Fatalf("AuthUser without 2FA = %d, %v; want %d", got, err, userID)
+	}
+
+	conn = dbpool.Get(nil)
+	secret, err := db.SetupTOTP(conn, userID)
+	dbpool.Put(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not enabled until a code is confirmed.
+	if _, err := a.AuthUser(ctx, addr, username, []byte(password), ""); err != nil {
+		t.Errorf("AuthUser before EnableTOTP: %v", err)
+	}
+	// Confirm with the code of the previous step,
+	// so the current one is still unused.
+	now := time.Now()
+	enableCode, err := totp.Code(secret, now.Add(-30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = dbpool.Get(nil)
+	err = db.EnableTOTP(conn, userID, enableCode, now.Add(-30*time.Second))
+	dbpool.Put(conn)
+	if err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+
+	if _, err := a.AuthUser(ctx, addr, username, []byte(password), ""); err != db.ErrTOTPRequired {
+		t.Errorf("AuthUser without code: want ErrTOTPRequired, got %v", err)
+	}
+	// The code used to enable TOTP cannot be replayed.
+	if _, err := a.AuthUser(ctx, addr, username, []byte(password), enableCode); err != db.ErrBadCredentials {
+		t.Errorf("AuthUser with replayed code: want ErrBadCredentials, got %v", err)
+	}
+	code, err := totp.Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthUser(ctx, addr, username, []byte("wrongpassword"), code); err != db.ErrBadCredentials {
+		t.Errorf("AuthUser with bad password: want ErrBadCredentials, got %v", err)
+	}
+	if got, err := a.AuthUser(ctx, addr, username, []byte(password), code); err != nil || got != userID {
+		t.Errorf("AuthUser with code = %d, %v; want %d", got, err, userID)
+	}
+
+	conn = dbpool.Get(nil)
+	err = db.DisableTOTP(conn, userID)
+	dbpool.Put(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthUser(ctx, addr, username, []byte(password), ""); err != nil {
+		t.Errorf("AuthUser after DisableTOTP: %v", err)
+	}
+}
+
+func TestAuthUserLockout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imapdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	const username = "foo@spilled.ink"
+	const password = "agenericpassword"
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: username,
+		Password:  password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := db.SetupTOTP(conn, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	enableCode, err := totp.Code(secret, now.Add(-30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableTOTP(conn, userID, enableCode, now.Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	dbpool.Put(conn)
+
+	ctx := context.Background()
+	a := &db.Authenticator{
+		Logf:    func(format string, v ...interface{}) {},
+		Where:   "test",
+		DB:      dbpool,
+		Lockout: &db.Lockout{Threshold: 3},
+	}
+	const addr = "10.0.0.1:1234"
+
+	// Guessing codes with the right password locks out the
+	// login, asking for a code in between does not reset it.
+	for i := 0; i < 3; i++ {
+		if _, err := a.AuthUser(ctx, addr, username, []byte(password), "000000"); err != db.ErrBadCredentials {
+			t.Fatalf("guess %d: want ErrBadCredentials, got %v", i, err)
+		}
+		if i == 0 {
+			if _, err := a.AuthUser(ctx, addr, username, []byte(password), ""); err != db.ErrTOTPRequired {
+				t.Fatalf("no code: want ErrTOTPRequired, got %v", err)
+			}
+		}
+	}
+	code, err := totp.Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthUser(ctx, addr, username, []byte(password), code); err != db.ErrBadCredentials {
+		t.Errorf("locked out login: want ErrBadCredentials, got %v", err)
+	}
+	if got, err := a.AuthUser(ctx, "10.0.0.2:1234", username, []byte(password), code); err != nil || got != userID {
+		t.Errorf("login from other address = %d, %v; want %d", got, err, userID)
+	}
+	want := db.LockoutStats{Failures: 3, Lockouts: 1, Refused: 1}
+	if got := a.Lockout.Stats(); got != want {
+		t.Errorf("Stats()=%+v, want %+v", got, want)
+	}
+
+	conn = dbpool.Get(nil)
+	defer dbpool.Put(conn)
+	failures, err := db.FindAudit(conn, db.AuditQuery{UserID: userID, Event: db.AuditLoginFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 3 {
+		t.Errorf("%d failed login entries, want 3", len(failures))
+	}
+}
+
+func TestNewAppPassword(t *testing.T) {
+	counts := make(map[rune]int)
+	const n = 2000
+	for i := 0; i < n; i++ {
+		password, err := db.NewAppPassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := strings.Split(password, " ")
+		if len(groups) != 4 {
+			t.Fatalf("%q is not four groups", password)
+		}
+		for _, g := range groups {
+			if len(g) != 4 {
+				t.Fatalf("%q has a group of %d letters", password, len(g))
+			}
+			for _, c := range g {
+				if c < 'a' || c > 'z' {
+					t.Fatalf("%q has %q", password, c)
+				}
+				counts[c]++
+			}
+		}
+	}
+	// Each letter is expected n*16/26 times. Taking a byte
+	// modulo 26 would make w-z appear 9/10 as often as the
+	// others, together about 4500 times instead of 4923.
+	wz := counts['w'] + counts['x'] + counts['y'] + counts['z']
+	if wz < 4923-325 || wz > 4923+325 {
+		t.Errorf("w-z appear %d times, want about 4923", wz)
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email/bimi"
+)
+
+// SetBIMI sets the BIMI record and logo of a domain.
+// The logo must meet the profile checked by bimi.ValidateLogo.
+func SetBIMI(conn *sqlite.Conn, rec bimi.Record, logo []byte) error {
+	rec.Domain = strings.ToLower(rec.Domain)
+	if rec.Selector == "" {
+		rec.Selector = bimi.DefaultSelector
+	}
+	if err := rec.Validate(); err != nil {
+		return fmt.Errorf("db.SetBIMI: %v", err)
+	}
+	if err := bimi.ValidateLogo(logo); err != nil {
+		return fmt.Errorf("db.SetBIMI: %v", err)
+	}
+	stmt := conn.Prep(`INSERT INTO BIMIRecords (DomainName, Selector, LogoURL, AuthorityURL, Logo)
+		VALUES ($domain, $selector, $logoURL, $authorityURL, $logo)
+		ON CONFLICT (DomainName) DO UPDATE SET
+			Selector = $selector, LogoURL = $logoURL,
+			AuthorityURL = $authorityURL, Logo = $logo;`)
+	stmt.SetText("$domain", rec.Domain)
+	stmt.SetText("$selector", rec.Selector)
+	stmt.SetText("$logoURL", rec.LogoURL)
+	if rec.AuthorityURL != "" {
+		stmt.SetText("$authorityURL", rec.AuthorityURL)
+	} else {
+		stmt.SetNull("$authorityURL")
+	}
+	stmt.SetBytes("$logo", logo)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.SetBIMI: %v", err)
+	}
+	return nil
+}
+
+// RemoveBIMI removes the BIMI record of a domain.
+func RemoveBIMI(conn *sqlite.Conn, domain string) error {
+	stmt := conn.Prep("DELETE FROM BIMIRecords WHERE DomainName = $domain;")
+	stmt.SetText("$domain", strings.ToLower(domain))
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.RemoveBIMI: %v", err)
+	}
+	return nil
+}
+
+// FindBIMI finds the BIMI record and logo of a domain.
+// A domain without one reports a nil record.
+func FindBIMI(conn *sqlite.Conn, domain string) (rec *bimi.Record, logo []byte, err error) {
+	stmt := conn.Prep(`SELECT DomainName, Selector, LogoURL, ifnull(AuthorityURL, '') AS AuthorityURL, Logo
+		FROM BIMIRecords WHERE DomainName = $domain;`)
+	stmt.SetText("$domain", strings.ToLower(domain))
+	if hasNext, err := stmt.Step(); err != nil {
+		return nil, nil, fmt.Errorf("db.FindBIMI: %v", err)
+	} else if !hasNext {
+		return nil, nil, nil
+	}
+	rec = &bimi.Record{
+		Domain:       stmt.GetText("DomainName"),
+		Selector:     stmt.GetText("Selector"),
+		LogoURL:      stmt.GetText("LogoURL"),
+		AuthorityURL: stmt.GetText("AuthorityURL"),
+	}
+	logo = make([]byte, stmt.GetLen("Logo"))
+	stmt.GetBytes("Logo", logo)
+	stmt.Reset()
+	return rec, logo, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"crawshaw.io/sqlite"
+)
+
+// UserBlobKey returns the key a user's message blobs are sealed
+// with, creating it on first use.
+//
+// User keys are stored in UserBlobKeys wrapped by masterKey, a
+// 32-byte AES-256 key kept outside the database.
+func UserBlobKey(conn *sqlite.Conn, userID int64, masterKey []byte) (key []byte, err error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("db.UserBlobKey: master key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("db.UserBlobKey: %v", err)
+	}
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(userID))
+
+	stmt := conn.Prep(`SELECT WrappedKey FROM UserBlobKeys WHERE UserID = $userID;`)
+	stmt.SetInt64("$userID", userID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return nil, fmt.Errorf("db.UserBlobKey: %v", err)
+	} else if hasNext {
+		wrapped := make([]byte, stmt.GetLen("WrappedKey"))
+		stmt.GetBytes("WrappedKey", wrapped)
+		stmt.Reset()
+
+		if len(wrapped) < aead.NonceSize() {
+			return nil, fmt.Errorf("db.UserBlobKey: user %d: short wrapped key", userID)
+		}
+		nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+		key, err := aead.Open(nil, nonce, ciphertext, ad)
+		if err != nil {
+			return nil, fmt.Errorf("db.UserBlobKey: user %d: wrong master key: %v", userID, err)
+		}
+		return key, nil
+	}
+
+	key = make([]byte, 32)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("db.UserBlobKey: %v", err)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("db.UserBlobKey: %v", err)
+	}
+	wrapped := aead.Seal(nonce, nonce, key, ad)
+
+	stmt = conn.Prep(`INSERT INTO UserBlobKeys (UserID, WrappedKey) VALUES ($userID, $wrappedKey);`)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetBytes("$wrappedKey", wrapped)
+	if _, err := stmt.Step(); err != nil {
+		return nil, fmt.Errorf("db.UserBlobKey: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// DeviceClient is a mail client that logged in with a device password.
+type DeviceClient struct {
+	DeviceID   int64
+	DeviceName string // filled in by DeviceClients
+	Name       string // IMAP ID "name", "" if not sent
+	Version    string
+	OS         string // IMAP ID "os" and "os-version"
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	LastAddr   string
+}
+
+// maxClientField bounds the ID values stored, RFC 2971 allows 1024 bytes.
+const maxClientField = 128
+
+// ParseClientID fills in the Name, Version, and OS of a client
+// from the parameters of the IMAP ID command.
+// The keys of params are lower case.
+func ParseClientID(params map[string]string) (c DeviceClient) {
+	c.Name = clientField(params["name"])
+	c.Version = clientField(params["version"])
+	c.OS = clientField(strings.TrimSpace(params["os"] + " " + params["os-version"]))
+	return c
+}
+
+func clientField(v string) string {
+	v = strings.Join(strings.Fields(v), " ")
+	if len(v) > maxClientField {
+		v = v[:maxClientField]
+	}
+	return v
+}
+
+// RecordDeviceClient records that a client was seen at c.LastSeen
+// from c.LastAddr.
+func RecordDeviceClient(conn *sqlite.Conn, c DeviceClient) error {
+	stmt := conn.Prep(`INSERT INTO DeviceClients (DeviceID, Name, Version, OS, FirstSeen, LastSeen, LastAddr)
+		VALUES ($deviceID, $name, $version, $os, $time, $time, $addr)
+		ON CONFLICT (DeviceID, Name, Version, OS) DO UPDATE SET
+			LastSeen = excluded.LastSeen,
+			LastAddr = excluded.LastAddr;`)
+	stmt.SetInt64("$deviceID", c.DeviceID)
+	stmt.SetText("$name", c.Name)
+	stmt.SetText("$version", c.Version)
+	stmt.SetText("$os", c.OS)
+	stmt.SetInt64("$time", c.LastSeen.Unix())
+	stmt.SetText("$addr", c.LastAddr)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.RecordDeviceClient: %v", err)
+	}
+	return nil
+}
+
+// DeviceClients lists the clients that have used the device
+// passwords of a user, most recently seen first.
+func DeviceClients(conn *sqlite.Conn, userID int64) ([]DeviceClient, error) {
+	stmt := conn.Prep(`SELECT DeviceClients.DeviceID, DeviceName,
+		Name, Version, OS, FirstSeen, LastSeen, LastAddr
+		FROM DeviceClients
+		INNER JOIN Devices ON Devices.DeviceID = DeviceClients.DeviceID
+		WHERE UserID = $userID
+		ORDER BY LastSeen DESC, DeviceClients.DeviceID;`)
+	stmt.SetInt64("$userID", userID)
+	var clients []DeviceClient
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("db.DeviceClients: %v", err)
+		} else if !hasNext {
+			break
+		}
+		clients = append(clients, DeviceClient{
+			DeviceID:   stmt.GetInt64("DeviceID"),
+			DeviceName: stmt.GetText("DeviceName"),
+			Name:       stmt.GetText("Name"),
+			Version:    stmt.GetText("Version"),
+			OS:         stmt.GetText("OS"),
+			FirstSeen:  time.Unix(stmt.GetInt64("FirstSeen"), 0),
+			LastSeen:   time.Unix(stmt.GetInt64("LastSeen"), 0),
+			LastAddr:   stmt.GetText("LastAddr"),
+		})
+	}
+	return clients, nil
+}
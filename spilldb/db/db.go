@@ -13,6 +13,7 @@ import (
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"golang.org/x/crypto/bcrypt"
+	"spilled.ink/spilldb/migrate"
 	"spilled.ink/third_party/imf"
 )
 
@@ -21,14 +22,17 @@ var ErrUserUnavailable = &UserError{UserMsg: "Username unavailable."}
 type DeliveryState int
 
 const (
-	DeliveryUnknown   = 0
-	DeliveryReceiving = 7 // incoming email, being received
-	DeliveryToProcess = 6 // incoming email, needs to be processed
-	DeliveryReceived  = 1 // incoming email, ready to deliver
-	DeliveryStaging   = 2 // message created, but sendmsg not invoked yet
-	DeliverySending   = 3 // sendmsg invoked, deliverer will pick it up
-	DeliveryDone      = 4 // no more work to do, message sent
-	DeliveryFailed    = 5 // no more work to do, (maybe partially) failed
+	DeliveryUnknown     = 0
+	DeliveryReceiving   = 7  // incoming email, being received
+	DeliveryToProcess   = 6  // incoming email, needs to be processed
+	DeliveryReceived    = 1  // incoming email, ready to deliver
+	DeliveryStaging     = 2  // message created, but sendmsg not invoked yet
+	DeliverySending     = 3  // sendmsg invoked, deliverer will pick it up
+	DeliveryDone        = 4  // no more work to do, message sent
+	DeliveryFailed      = 5  // no more work to do, (maybe partially) failed
+	DeliveryHeld        = 8  // submitted, held for the sender's undo send window
+	DeliveryCancelled   = 9  // held, then withdrawn by the sender
+	DeliveryQuarantined = 10 // incoming email that could not be parsed, see Quarantine
 )
 
 func (d DeliveryState) String() string {
@@ -49,6 +53,12 @@ func (d DeliveryState) String() string {
 		return "DeliveryDone"
 	case DeliveryFailed:
 		return "DeliveryFailed"
+	case DeliveryHeld:
+		return "DeliveryHeld"
+	case DeliveryCancelled:
+		return "DeliveryCancelled"
+	case DeliveryQuarantined:
+		return "DeliveryQuarantined"
 	default:
 		return fmt.Sprintf("DeliveryState(%d)", int(d))
 	}
@@ -80,17 +90,55 @@ func Init(conn *sqlite.Conn) (err error) {
 	if err := sqlitex.ExecTransient(conn, "PRAGMA cache_size = -50000;", nil); err != nil {
 		return err
 	}
-	if err := sqlitex.ExecScript(conn, createSQL); err != nil {
-		return err
+	return migrate.Init(conn, createSQL, migrations)
+}
+
+// Migrate brings the schema of the spilld database at dbfile up to
+// date, as Open does, and reports the steps it applied.
+//
+// If dryRun is set, the steps are reported but not applied.
+// If backupfile is set and there are steps to apply, the database
+// is first copied there with VACUUM INTO.
+func Migrate(dbfile, backupfile string, dryRun bool) ([]migrate.Step, error) {
+	flags := sqlite.SQLITE_OPEN_READWRITE |
+		sqlite.SQLITE_OPEN_WAL |
+		sqlite.SQLITE_OPEN_URI |
+		sqlite.SQLITE_OPEN_NOMUTEX
+	conn, err := sqlite.OpenConn(dbfile, flags)
+	if err != nil {
+		return nil, fmt.Errorf("db.Migrate: %v", err)
 	}
-	return nil
+	defer conn.Close()
+
+	steps, err := migrate.Pending(conn, migrations)
+	if err != nil {
+		return nil, fmt.Errorf("db.Migrate: %v", err)
+	}
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+	if backupfile != "" {
+		stmt, _, err := conn.PrepareTransient("VACUUM INTO $path;")
+		if err != nil {
+			return nil, fmt.Errorf("db.Migrate: backup: %v", err)
+		}
+		stmt.SetText("$path", backupfile)
+		_, err = stmt.Step()
+		stmt.Finalize()
+		if err != nil {
+			return nil, fmt.Errorf("db.Migrate: backup: %v", err)
+		}
+	}
+	if err := Init(conn); err != nil {
+		return nil, fmt.Errorf("db.Migrate: %v", err)
+	}
+	return steps, nil
 }
 
 func CollectMsgsToSend(conn *sqlite.Conn, userID, limit, minReadyDate int64) (stagingIDs []int64, err error) {
 	stmt := conn.Prep(`SELECT Msgs.StagingID, ReadyDate FROM Msgs
 		INNER JOIN MsgRecipients ON Msgs.StagingID = MsgRecipients.StagingID
-		INNER JOIN UserAddresses ON MsgRecipients.Recipient = UserAddresses.Address
-		WHERE UserAddresses.UserID = $userID
+		WHERE MsgRecipients.UserID = $userID
 			AND DeliveryState = $deliveryState
 			AND ReadyDate > $minReadyDate
 		ORDER BY Msgs.StagingID
@@ -112,6 +160,62 @@ func CollectMsgsToSend(conn *sqlite.Conn, userID, limit, minReadyDate int64) (st
 	return stagingIDs, nil
 }
 
+// CollectLocalRecipients reports the local users who have yet to
+// receive the message stagingID.
+func CollectLocalRecipients(conn *sqlite.Conn, stagingID int64) (userIDs []int64, err error) {
+	stmt := conn.Prep(`SELECT DISTINCT UserID FROM MsgRecipients
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryState
+		AND UserID IS NOT NULL
+		ORDER BY UserID;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliveryState", int64(DeliveryReceived))
+
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasRow {
+			break
+		}
+		userIDs = append(userIDs, stmt.GetInt64("UserID"))
+	}
+
+	return userIDs, nil
+}
+
+// StorageShares splits size bytes evenly across n users.
+// Any remainder is charged one byte at a time to the first users.
+func StorageShares(size int64, n int) []int64 {
+	if n <= 0 {
+		return nil
+	}
+	shares := make([]int64, n)
+	for i := range shares {
+		shares[i] = size / int64(n)
+		if int64(i) < size%int64(n) {
+			shares[i]++
+		}
+	}
+	return shares
+}
+
+// AddUserStorage adds n bytes to the storage charged to userID.
+// A negative n releases storage.
+func AddUserStorage(conn *sqlite.Conn, userID, n int64) error {
+	stmt := conn.Prep(`INSERT INTO UserStorage (UserID, Bytes) VALUES ($userID, max($n, 0))
+		ON CONFLICT (UserID) DO UPDATE SET Bytes = max(Bytes + $n, 0);`)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$n", n)
+	_, err := stmt.Step()
+	return err
+}
+
+// UserStorage reports the bytes of storage charged to userID.
+func UserStorage(conn *sqlite.Conn, userID int64) (int64, error) {
+	stmt := conn.Prep("SELECT ifnull(max(Bytes), 0) FROM UserStorage WHERE UserID = $userID;")
+	stmt.SetInt64("$userID", userID)
+	return sqlitex.ResultInt64(stmt)
+}
+
 func LoadMsg(conn *sqlite.Conn, filer *iox.Filer, stagingID int64, raw bool) (*iox.BufferFile, error) {
 	tableName := "MsgFull"
 	if raw {
@@ -137,7 +241,9 @@ func LoadMsg(conn *sqlite.Conn, filer *iox.Filer, stagingID int64, raw bool) (*i
 }
 
 func AddDevice(conn *sqlite.Conn, userID int64, deviceName, appPassword string) (deviceID int64, err error) {
-	appPassHash, err := bcrypt.GenerateFromPassword([]byte(appPassword), bcrypt.DefaultCost)
+	defer sqlitex.Save(conn)(&err)
+
+	appPassHash, err := bcrypt.GenerateFromPassword(normalizeAppPassword([]byte(appPassword)), bcrypt.DefaultCost)
 	if err != nil {
 		return 0, err
 	}
@@ -151,7 +257,17 @@ func AddDevice(conn *sqlite.Conn, userID int64, deviceName, appPassword string)
 	if _, err := stmt.Step(); err != nil {
 		return 0, err
 	}
-	return conn.LastInsertRowID(), nil
+	deviceID = conn.LastInsertRowID()
+	err = Audit(conn, AuditEntry{
+		UserID: userID,
+		Event:  AuditPassword,
+		Client: deviceName,
+		Detail: fmt.Sprintf("added device %d", deviceID),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deviceID, nil
 }
 
 type UserDetails struct {
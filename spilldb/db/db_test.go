@@ -157,3 +157,298 @@ func TestAddUser(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-route-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+
+	aliceID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: "alice@example.com",
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: "bob@example.com",
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []struct {
+		addr      string
+		userID    int64
+		forwardTo string
+		tag       string
+	}{
+		{"sales@example.com", aliceID, "", "sales"},
+		{"team@example.com", 0, "sales@example.com", ""},
+		{"away@example.com", 0, "bob@elsewhere.org", ""},
+		{"loop1@example.com", 0, "loop2@example.com", ""},
+		{"loop2@example.com", 0, "loop1@example.com", ""},
+		{"@example.org", bobID, "", ""},
+	}
+	for _, r := range routes {
+		if err := db.AddRoute(conn, r.addr, r.userID, r.forwardTo, r.tag); err != nil {
+			t.Fatalf("AddRoute(%q): %v", r.addr, err)
+		}
+	}
+	if err := db.AddRoute(conn, "Alice@example.com", bobID, "", ""); err == nil {
+		t.Error("AddRoute succeeded for a user address")
+	}
+
+	tests := []struct {
+		addr string
+		want db.Route
+	}{
+		{"alice@example.com", db.Route{UserID: aliceID}},
+		{"Alice@Example.com", db.Route{UserID: aliceID}},
+		{"alice+receipts@example.com", db.Route{UserID: aliceID, Tag: "receipts"}},
+		{"sales@example.com", db.Route{UserID: aliceID, Tag: "sales"}},
+		{"sales+eu@example.com", db.Route{UserID: aliceID, Tag: "eu"}},
+		{"team@example.com", db.Route{UserID: aliceID, Tag: "sales"}},
+		{"away@example.com", db.Route{ForwardTo: "bob@elsewhere.org"}},
+		{"anyone@example.org", db.Route{UserID: bobID}},
+		{"nobody@example.com", db.Route{}},
+		{"carol@elsewhere.org", db.Route{}},
+	}
+	for _, test := range tests {
+		got, err := db.ResolveAddress(conn, test.addr)
+		if err != nil {
+			t.Errorf("ResolveAddress(%q): %v", test.addr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ResolveAddress(%q)=%+v, want %+v", test.addr, got, test.want)
+		}
+	}
+
+	if _, err := db.ResolveAddress(conn, "loop1@example.com"); err == nil {
+		t.Error("ResolveAddress of a forwarding loop succeeded")
+	}
+
+	if err := db.RemoveRoute(conn, "@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.ResolveAddress(conn, "anyone@example.org"); err != nil {
+		t.Fatal(err)
+	} else if !got.IsZero() {
+		t.Errorf("catch-all still routes after removal: %+v", got)
+	}
+}
+
+func TestStorageShares(t *testing.T) {
+	tests := []struct {
+		size int64
+		n    int
+		want []int64
+	}{
+		{size: 100, n: 1, want: []int64{100}},
+		{size: 100, n: 4, want: []int64{25, 25, 25, 25}},
+		{size: 101, n: 3, want: []int64{34, 34, 33}},
+		{size: 2, n: 3, want: []int64{1, 1, 0}},
+		{size: 100, n: 0, want: nil},
+	}
+	for _, test := range tests {
+		got := db.StorageShares(test.size, test.n)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("StorageShares(%d, %d)=%v, want %v", test.size, test.n, got, test.want)
+		}
+	}
+}
+
+func TestUserBlobKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-blobkey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: "foo@spilled.ink",
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey := []byte(strings.Repeat("k", 32))
+
+	key, err := db.UserBlobKey(conn, userID, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("key is %d bytes, want 32", len(key))
+	}
+	key2, err := db.UserBlobKey(conn, userID, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(key2) {
+		t.Error("second UserBlobKey returned a different key")
+	}
+
+	otherKey := []byte(strings.Repeat("o", 32))
+	if _, err := db.UserBlobKey(conn, userID, otherKey); err == nil {
+		t.Error("UserBlobKey unwrapped the key with the wrong master key")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-quarantine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: "alice@example.com",
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := conn.Prep(`INSERT INTO Msgs (StagingID, Sender, DateReceived) VALUES (7, 'bob@example.org', 1000);`)
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	stmt = conn.Prep(`INSERT INTO MsgRaw (StagingID, Content) VALUES (7, 'not a message');`)
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	stmt = conn.Prep(`INSERT INTO MsgRecipients (StagingID, Recipient, FullAddress, DeliveryState, UserID)
+		VALUES (7, 'alice@example.com', '', $deliveryToProcess, $userID);`)
+	stmt.SetInt64("$deliveryToProcess", db.DeliveryToProcess)
+	stmt.SetInt64("$userID", userID)
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Quarantine(conn, 7, errors.New("bad MIME boundary")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.CountQuarantined(conn); err != nil || n != 1 {
+		t.Errorf("CountQuarantined=%d, %v, want 1", n, err)
+	}
+	msgs, err := db.QuarantinedMsgs(conn, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []db.QuarantinedMsg{{
+		StagingID:    7,
+		Sender:       "bob@example.org",
+		DateReceived: time.Unix(1000, 0),
+		ParseError:   "bad MIME boundary",
+		Size:         int64(len("not a message")),
+		UserIDs:      []int64{userID},
+	}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("QuarantinedMsgs=%+v, want %+v", msgs, want)
+	}
+	if msgs, err := db.QuarantinedMsgs(conn, userID+1); err != nil || len(msgs) != 0 {
+		t.Errorf("QuarantinedMsgs of another user=%+v, %v", msgs, err)
+	}
+
+	if released, err := db.ReleaseQuarantined(conn, 7); err != nil || !released {
+		t.Fatalf("ReleaseQuarantined=%v, %v", released, err)
+	}
+	if released, err := db.ReleaseQuarantined(conn, 7); err != nil || released {
+		t.Errorf("second ReleaseQuarantined=%v, %v, want false", released, err)
+	}
+	if n, err := db.CountQuarantined(conn); err != nil || n != 0 {
+		t.Errorf("CountQuarantined after release=%d, %v, want 0", n, err)
+	}
+}
+
+func TestVERP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-verp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: "alice@example.com",
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := conn.Prep(`INSERT INTO Msgs (StagingID, Sender, DateReceived, UserID)
+		VALUES (7, 'alice@example.com', 1000, $userID);`)
+	stmt.SetInt64("$userID", userID)
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := db.BounceToken(conn, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := db.BounceToken(conn, 7); err != nil || again != token {
+		t.Errorf("second BounceToken=%q, %v, want %q", again, err, token)
+	}
+
+	sender := db.VERPSender("alice+news@example.com", token)
+	if want := "alice+bounce-" + token + "@example.com"; sender != want {
+		t.Errorf("VERPSender=%q, want %q", sender, want)
+	}
+	got, ok := db.ParseVERP(strings.ToUpper(sender))
+	if !ok || got != token {
+		t.Errorf("ParseVERP(%q)=%q, %v, want %q", sender, got, ok, token)
+	}
+	for _, addr := range []string{"alice@example.com", "alice+news@example.com", "alice+bounce-@example.com"} {
+		if got, ok := db.ParseVERP(addr); ok {
+			t.Errorf("ParseVERP(%q)=%q, want none", addr, got)
+		}
+	}
+
+	route, err := db.ResolveAddress(conn, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.UserID != userID {
+		t.Errorf("return path routes to user %d, want %d", route.UserID, userID)
+	}
+
+	stagingID, sentBy, err := db.FindBounceToken(conn, got)
+	if err != nil || stagingID != 7 || sentBy != userID {
+		t.Errorf("FindBounceToken=%d, %d, %v, want 7, %d", stagingID, sentBy, err, userID)
+	}
+	if stagingID, _, err := db.FindBounceToken(conn, "nosuchtoken"); err != nil || stagingID != 0 {
+		t.Errorf("FindBounceToken(unknown)=%d, %v, want 0", stagingID, err)
+	}
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// ErrNotHeld is reported by CancelHeld for a message that is not
+// held, either because it has already been released to be sent or
+// because it does not belong to the user.
+var ErrNotHeld = errors.New("db: message is not held for sending")
+
+// HeldMsg is a submitted message held for its sender's undo send
+// window, in the DeliveryHeld state.
+type HeldMsg struct {
+	StagingID int64
+	UserID    int64
+	Sender    string
+	HoldUntil time.Time
+}
+
+// SendDelay reports how long mail submitted by a user is held
+// before it is sent. A user without their own delay has def.
+func SendDelay(conn *sqlite.Conn, userID int64, def time.Duration) (time.Duration, error) {
+	stmt := conn.Prep("SELECT SendDelay FROM Users WHERE UserID = $userID AND SendDelay IS NOT NULL;")
+	stmt.SetInt64("$userID", userID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, err
+	} else if !hasNext {
+		return def, nil
+	}
+	delay := time.Duration(stmt.GetInt64("SendDelay")) * time.Second
+	stmt.Reset()
+	return delay, nil
+}
+
+// SetSendDelay sets how long mail submitted by a user is held.
+// A negative delay gives the user the server default.
+func SetSendDelay(conn *sqlite.Conn, userID int64, delay time.Duration) error {
+	stmt := conn.Prep("UPDATE Users SET SendDelay = $delay WHERE UserID = $userID;")
+	stmt.SetInt64("$userID", userID)
+	if delay < 0 {
+		stmt.SetNull("$delay")
+	} else {
+		stmt.SetInt64("$delay", int64(delay/time.Second))
+	}
+	_, err := stmt.Step()
+	return err
+}
+
+// HoldMsg holds the recipients of a message being received until
+// the time until, when it is released by ReleaseHeld.
+func HoldMsg(conn *sqlite.Conn, stagingID int64, until time.Time) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryHeld
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryReceiving;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliveryHeld", int64(DeliveryHeld))
+	stmt.SetInt64("$deliveryReceiving", int64(DeliveryReceiving))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep("UPDATE Msgs SET HoldUntil = $until WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$until", until.Unix())
+	_, err = stmt.Step()
+	return err
+}
+
+// ReleaseHeld ends the hold on a message. Recipients routed to a
+// local user are marked DeliveryToProcess, the rest DeliverySending.
+// It reports whether the message had any held recipients.
+func ReleaseHeld(conn *sqlite.Conn, stagingID int64) (released bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = CASE
+			WHEN UserID IS NULL THEN $deliverySending
+			ELSE $deliveryToProcess END
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryHeld;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliverySending", int64(DeliverySending))
+	stmt.SetInt64("$deliveryToProcess", int64(DeliveryToProcess))
+	stmt.SetInt64("$deliveryHeld", int64(DeliveryHeld))
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	released = conn.Changes() > 0
+
+	stmt = conn.Prep("UPDATE Msgs SET HoldUntil = NULL WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	return released, nil
+}
+
+// CancelHeld withdraws a held message submitted by userID, marking
+// its recipients DeliveryCancelled so it cannot be released.
+// The message is then either removed with RemoveCancelled, or
+// held again with RestoreCancelled.
+func CancelHeld(conn *sqlite.Conn, userID, stagingID int64) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryCancelled
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryHeld
+		AND EXISTS (SELECT 1 FROM Msgs WHERE StagingID = $stagingID AND UserID = $userID);`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$deliveryCancelled", int64(DeliveryCancelled))
+	stmt.SetInt64("$deliveryHeld", int64(DeliveryHeld))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if conn.Changes() == 0 {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// RestoreCancelled holds a message withdrawn by CancelHeld again.
+func RestoreCancelled(conn *sqlite.Conn, stagingID int64) error {
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryHeld
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryCancelled;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliveryHeld", int64(DeliveryHeld))
+	stmt.SetInt64("$deliveryCancelled", int64(DeliveryCancelled))
+	_, err := stmt.Step()
+	return err
+}
+
+// RemoveCancelled deletes a message withdrawn by CancelHeld.
+func RemoveCancelled(conn *sqlite.Conn, stagingID int64) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`SELECT count(*) FROM MsgRecipients
+		WHERE StagingID = $stagingID AND DeliveryState <> $deliveryCancelled;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliveryCancelled", int64(DeliveryCancelled))
+	if n, err := sqlitex.ResultInt64(stmt); err != nil {
+		return err
+	} else if n > 0 {
+		return ErrNotHeld
+	}
+	for _, table := range []string{"MsgRecipients", "MsgRaw", "Msgs"} {
+		stmt := conn.Prep("DELETE FROM " + table + " WHERE StagingID = $stagingID;")
+		stmt.SetInt64("$stagingID", stagingID)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HeldMsgs reports the messages held for userID, or if userID
+// is 0, for every user, in the order they are released.
+func HeldMsgs(conn *sqlite.Conn, userID int64) (msgs []HeldMsg, err error) {
+	stmt := conn.Prep(`SELECT StagingID, UserID, Sender, HoldUntil FROM Msgs
+		WHERE HoldUntil IS NOT NULL
+		AND ($userID = 0 OR UserID = $userID)
+		AND StagingID IN (SELECT StagingID FROM MsgRecipients
+			WHERE DeliveryState = $deliveryHeld)
+		ORDER BY HoldUntil, StagingID;`)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$deliveryHeld", int64(DeliveryHeld))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		msgs = append(msgs, HeldMsg{
+			StagingID: stmt.GetInt64("StagingID"),
+			UserID:    stmt.GetInt64("UserID"),
+			Sender:    stmt.GetText("Sender"),
+			HoldUntil: time.Unix(stmt.GetInt64("HoldUntil"), 0),
+		})
+	}
+	return msgs, nil
+}
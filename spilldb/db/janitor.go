@@ -11,6 +11,10 @@ import (
 type Janitor struct {
 	Logf func(format string, v ...interface{})
 
+	// AuditRetention is how long AuditLog entries are kept.
+	// Zero means DefaultAuditRetention.
+	AuditRetention time.Duration
+
 	ctx      context.Context
 	cancelFn func()
 	done     chan struct{}
@@ -77,7 +81,8 @@ func (j *Janitor) clean() error {
 	}
 	defer j.pool.Put(conn)
 
-	var msgsRemoved int
+	var msgsRemoved, failedLoginsRemoved, auditRemoved int
+	var err error
 	defer func() {
 		l := Log{
 			What:     "cleanup",
@@ -85,11 +90,24 @@ func (j *Janitor) clean() error {
 			When:     start,
 			Duration: time.Since(start),
 			Data: map[string]interface{}{
-				"msgs_removed": msgsRemoved,
+				"msgs_removed":          msgsRemoved,
+				"failed_logins_removed": failedLoginsRemoved,
+				"audit_removed":         auditRemoved,
 			},
+			Err: err,
 		}
 		j.Logf("%s", l)
 	}()
 
+	// A failed prune is logged and retried next time.
+	failedLoginsRemoved, err = pruneFailedLogins(conn, start)
+	if err != nil {
+		return nil
+	}
+	retention := j.AuditRetention
+	if retention == 0 {
+		retention = DefaultAuditRetention
+	}
+	auditRemoved, err = pruneAuditLog(conn, start, retention)
 	return nil
 }
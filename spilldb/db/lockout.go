@@ -0,0 +1,174 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// Lockout slows down password guessing.
+//
+// Failed logins are counted for each remote IP and username in the
+// FailedLogins table, so the count survives a restart. After
+// Threshold consecutive failures the pair is locked out, and every
+// further failure doubles the lockout, starting at BaseDelay and
+// capped at MaxDelay. Attempts made while locked out are refused
+// without checking the password.
+//
+// Failures are forgotten a day after the last one.
+type Lockout struct {
+	Threshold int           // failures before lockout, default 5
+	BaseDelay time.Duration // first lockout, default 1 minute
+	MaxDelay  time.Duration // longest lockout, default 1 hour
+
+	failures int64 // accessed atomically
+	lockouts int64 // accessed atomically
+	refused  int64 // accessed atomically
+}
+
+// LockoutStats counts Lockout events since the process started.
+type LockoutStats struct {
+	Failures int64 // failed logins
+	Lockouts int64 // failures that locked out a remote IP and username
+	Refused  int64 // logins refused during a lockout
+}
+
+func (l *Lockout) Stats() LockoutStats {
+	return LockoutStats{
+		Failures: atomic.LoadInt64(&l.failures),
+		Lockouts: atomic.LoadInt64(&l.lockouts),
+		Refused:  atomic.LoadInt64(&l.refused),
+	}
+}
+
+// failuresForgotten is how long after the last failed
+// login the failures of a remote IP and username are reset.
+const failuresForgotten = 24 * time.Hour
+
+func (l *Lockout) threshold() int {
+	if l.Threshold > 0 {
+		return l.Threshold
+	}
+	return 5
+}
+
+func (l *Lockout) delay(failures int) time.Duration {
+	base, max := l.BaseDelay, l.MaxDelay
+	if base <= 0 {
+		base = time.Minute
+	}
+	if max <= 0 {
+		max = time.Hour
+	}
+	d := base
+	for i := l.threshold(); i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// lockoutKey normalizes a remote address and username.
+func lockoutKey(remoteAddr, username string) (ip, user string) {
+	ip = remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	return ip, strings.ToLower(username)
+}
+
+// lockedUntil reports when the lockout of remoteAddr and username
+// ends. It reports the zero time if they are not locked out.
+func (l *Lockout) lockedUntil(conn *sqlite.Conn, remoteAddr, username string, now time.Time) (time.Time, error) {
+	ip, user := lockoutKey(remoteAddr, username)
+	stmt := conn.Prep(`SELECT LockedUntil FROM FailedLogins
+		WHERE RemoteIP = $ip AND Username = $user AND LockedUntil > $now;`)
+	stmt.SetText("$ip", ip)
+	stmt.SetText("$user", user)
+	stmt.SetInt64("$now", now.Unix())
+	if hasNext, err := stmt.Step(); err != nil {
+		return time.Time{}, fmt.Errorf("db.Lockout: %v", err)
+	} else if !hasNext {
+		return time.Time{}, nil
+	}
+	until := time.Unix(stmt.GetInt64("LockedUntil"), 0)
+	stmt.Reset()
+
+	atomic.AddInt64(&l.refused, 1)
+	return until, nil
+}
+
+// fail records a failed login. If it starts a lockout,
+// fail reports when the lockout ends.
+func (l *Lockout) fail(conn *sqlite.Conn, remoteAddr, username string, now time.Time) (lockedUntil time.Time, err error) {
+	atomic.AddInt64(&l.failures, 1)
+
+	ip, user := lockoutKey(remoteAddr, username)
+	stmt := conn.Prep(`SELECT Failures, LastFailure FROM FailedLogins
+		WHERE RemoteIP = $ip AND Username = $user;`)
+	stmt.SetText("$ip", ip)
+	stmt.SetText("$user", user)
+	failures := 0
+	if hasNext, err := stmt.Step(); err != nil {
+		return time.Time{}, fmt.Errorf("db.Lockout: %v", err)
+	} else if hasNext {
+		last := time.Unix(stmt.GetInt64("LastFailure"), 0)
+		if now.Sub(last) < failuresForgotten {
+			failures = int(stmt.GetInt64("Failures"))
+		}
+		stmt.Reset()
+	}
+	failures++
+
+	stmt = conn.Prep(`INSERT OR REPLACE INTO FailedLogins
+		(RemoteIP, Username, Failures, LastFailure, LockedUntil)
+		VALUES ($ip, $user, $failures, $now, $lockedUntil);`)
+	stmt.SetText("$ip", ip)
+	stmt.SetText("$user", user)
+	stmt.SetInt64("$failures", int64(failures))
+	stmt.SetInt64("$now", now.Unix())
+	if failures >= l.threshold() {
+		lockedUntil = now.Add(l.delay(failures))
+		stmt.SetInt64("$lockedUntil", lockedUntil.Unix())
+		atomic.AddInt64(&l.lockouts, 1)
+	} else {
+		stmt.SetNull("$lockedUntil")
+	}
+	if _, err := stmt.Step(); err != nil {
+		return time.Time{}, fmt.Errorf("db.Lockout: %v", err)
+	}
+	return lockedUntil, nil
+}
+
+// succeed clears the failures of remoteAddr and username.
+func (l *Lockout) succeed(conn *sqlite.Conn, remoteAddr, username string) error {
+	ip, user := lockoutKey(remoteAddr, username)
+	stmt := conn.Prep(`DELETE FROM FailedLogins
+		WHERE RemoteIP = $ip AND Username = $user;`)
+	stmt.SetText("$ip", ip)
+	stmt.SetText("$user", user)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.Lockout: %v", err)
+	}
+	return nil
+}
+
+// pruneFailedLogins removes failed logins that are
+// no longer locked out and are old enough to forget.
+func pruneFailedLogins(conn *sqlite.Conn, now time.Time) (int, error) {
+	stmt := conn.Prep(`DELETE FROM FailedLogins
+		WHERE LastFailure < $forgotten
+		AND (LockedUntil IS NULL OR LockedUntil < $now);`)
+	stmt.SetInt64("$forgotten", now.Add(-failuresForgotten).Unix())
+	stmt.SetInt64("$now", now.Unix())
+	if _, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("db.pruneFailedLogins: %v", err)
+	}
+	return conn.Changes(), nil
+}
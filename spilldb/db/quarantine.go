@@ -0,0 +1,121 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// QuarantinedMsg is an incoming message that could not be parsed.
+// Its raw bytes are kept in MsgRaw until it is reparsed or removed.
+type QuarantinedMsg struct {
+	StagingID    int64
+	Sender       string
+	DateReceived time.Time
+	ParseError   string
+	Size         int64   // of the raw message
+	UserIDs      []int64 // local recipients
+}
+
+// Quarantine moves a message that failed to parse out of the
+// DeliveryToProcess state, so it is not retried until it is released
+// by ReleaseQuarantined. A quarantined message has its parse error
+// updated.
+func Quarantine(conn *sqlite.Conn, stagingID int64, parseErr error) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep("UPDATE Msgs SET ParseError = $parseError WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetText("$parseError", parseErr.Error())
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.Quarantine: %v", err)
+	}
+	stmt = conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryQuarantined
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryToProcess;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliveryQuarantined", DeliveryQuarantined)
+	stmt.SetInt64("$deliveryToProcess", DeliveryToProcess)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.Quarantine: %v", err)
+	}
+	return nil
+}
+
+// ReleaseQuarantined returns a quarantined message to the
+// DeliveryToProcess state. It reports whether the message was
+// quarantined.
+func ReleaseQuarantined(conn *sqlite.Conn, stagingID int64) (released bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryToProcess
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryQuarantined;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$deliveryQuarantined", DeliveryQuarantined)
+	stmt.SetInt64("$deliveryToProcess", DeliveryToProcess)
+	if _, err := stmt.Step(); err != nil {
+		return false, fmt.Errorf("db.ReleaseQuarantined: %v", err)
+	}
+	if conn.Changes() == 0 {
+		return false, nil
+	}
+	stmt = conn.Prep("UPDATE Msgs SET ParseError = NULL WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	if _, err := stmt.Step(); err != nil {
+		return false, fmt.Errorf("db.ReleaseQuarantined: %v", err)
+	}
+	return true, nil
+}
+
+// QuarantinedMsgs lists the quarantined messages addressed to a
+// user, or with a userID of 0, all of them, oldest first.
+func QuarantinedMsgs(conn *sqlite.Conn, userID int64) (msgs []QuarantinedMsg, err error) {
+	stmt := conn.Prep(`SELECT Msgs.StagingID, Sender, DateReceived, ParseError,
+			ifnull(length(MsgRaw.Content), 0) AS Size,
+			group_concat(DISTINCT MsgRecipients.UserID) AS UserIDs
+		FROM Msgs
+		INNER JOIN MsgRecipients ON MsgRecipients.StagingID = Msgs.StagingID
+		LEFT JOIN MsgRaw ON MsgRaw.StagingID = Msgs.StagingID
+		WHERE MsgRecipients.DeliveryState = $deliveryQuarantined
+		AND ($userID = 0 OR MsgRecipients.UserID = $userID)
+		GROUP BY Msgs.StagingID
+		ORDER BY Msgs.StagingID;`)
+	stmt.SetInt64("$deliveryQuarantined", DeliveryQuarantined)
+	stmt.SetInt64("$userID", userID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("db.QuarantinedMsgs: %v", err)
+		} else if !hasNext {
+			break
+		}
+		m := QuarantinedMsg{
+			StagingID:    stmt.GetInt64("StagingID"),
+			Sender:       stmt.GetText("Sender"),
+			DateReceived: time.Unix(stmt.GetInt64("DateReceived"), 0),
+			ParseError:   stmt.GetText("ParseError"),
+			Size:         stmt.GetInt64("Size"),
+		}
+		for _, s := range strings.Split(stmt.GetText("UserIDs"), ",") {
+			if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+				m.UserIDs = append(m.UserIDs, id)
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// CountQuarantined reports the number of quarantined messages.
+func CountQuarantined(conn *sqlite.Conn) (int64, error) {
+	stmt := conn.Prep(`SELECT count(DISTINCT StagingID) FROM MsgRecipients
+		WHERE DeliveryState = $deliveryQuarantined;`)
+	stmt.SetInt64("$deliveryQuarantined", DeliveryQuarantined)
+	n, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("db.CountQuarantined: %v", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Route is where mail for an address goes.
+//
+// A local route has a UserID. A route that leaves the server has
+// a ForwardTo address. A zero Route means the address is unknown.
+type Route struct {
+	UserID    int64
+	ForwardTo string // external address
+	Tag       string // subaddress or alias tag, may be empty
+}
+
+func (r Route) IsZero() bool { return r.UserID == 0 && r.ForwardTo == "" }
+
+// maxRouteHops bounds the chain of aliases forwarding to aliases.
+const maxRouteHops = 8
+
+// ResolveAddress finds the route for mail sent to addr.
+//
+// Addresses are resolved in order against:
+//
+//   - the addresses of users,
+//   - aliases in AddressRoutes,
+//   - both of the above with any "+tag" suffix removed,
+//   - the catch-all route of the domain, "@domain".
+//
+// The tag of a subaddress takes precedence over the tag of an alias.
+// Aliases that forward to a local address are followed, so a
+// forwarding route always leaves the server.
+func ResolveAddress(conn *sqlite.Conn, addr string) (Route, error) {
+	route, err := resolveAddress(conn, strings.ToLower(addr))
+	if err != nil {
+		return Route{}, fmt.Errorf("db.ResolveAddress: %v", err)
+	}
+	return route, nil
+}
+
+func resolveAddress(conn *sqlite.Conn, addr string) (route Route, err error) {
+	for hop := 0; hop < maxRouteHops; hop++ {
+		r, err := resolveOne(conn, addr)
+		if err != nil {
+			return Route{}, err
+		}
+		if route.Tag == "" {
+			route.Tag = r.Tag
+		}
+		if r.UserID != 0 || r.ForwardTo == "" {
+			route.UserID = r.UserID
+			route.ForwardTo = ""
+			if r.UserID == 0 {
+				route.Tag = ""
+			}
+			return route, nil
+		}
+		route.ForwardTo = r.ForwardTo
+		addr = strings.ToLower(r.ForwardTo)
+		if !isLocalRoute(conn, addr) {
+			return Route{ForwardTo: r.ForwardTo}, nil
+		}
+	}
+	return Route{}, fmt.Errorf("routing loop for %q", addr)
+}
+
+// isLocalRoute reports whether addr has a route on this server.
+func isLocalRoute(conn *sqlite.Conn, addr string) bool {
+	r, err := resolveOne(conn, addr)
+	return err == nil && !r.IsZero()
+}
+
+// resolveOne resolves addr without following forwarding routes.
+func resolveOne(conn *sqlite.Conn, addr string) (Route, error) {
+	at := strings.LastIndexByte(addr, '@')
+	if at <= 0 {
+		return Route{}, nil
+	}
+	local, domain := addr[:at], addr[at:]
+
+	r, err := lookupRoute(conn, addr)
+	if err != nil || !r.IsZero() {
+		return r, err
+	}
+	if i := strings.IndexByte(local, '+'); i > 0 {
+		r, err := lookupRoute(conn, local[:i]+domain)
+		if err != nil {
+			return Route{}, err
+		}
+		if !r.IsZero() {
+			r.Tag = local[i+1:]
+			return r, nil
+		}
+	}
+	return lookupRoute(conn, domain)
+}
+
+func lookupRoute(conn *sqlite.Conn, addr string) (Route, error) {
+	stmt := conn.Prep(`SELECT UserID FROM UserAddresses WHERE Address = $addr;`)
+	stmt.SetText("$addr", addr)
+	if hasNext, err := stmt.Step(); err != nil {
+		return Route{}, err
+	} else if hasNext {
+		userID := stmt.GetInt64("UserID")
+		stmt.Reset()
+		return Route{UserID: userID}, nil
+	}
+
+	stmt = conn.Prep(`SELECT UserID, ForwardTo, Tag FROM AddressRoutes WHERE Address = $addr;`)
+	stmt.SetText("$addr", addr)
+	if hasNext, err := stmt.Step(); err != nil {
+		return Route{}, err
+	} else if !hasNext {
+		return Route{}, nil
+	}
+	r := Route{
+		UserID:    stmt.GetInt64("UserID"),
+		ForwardTo: stmt.GetText("ForwardTo"),
+		Tag:       stmt.GetText("Tag"),
+	}
+	stmt.Reset()
+	if r.UserID != 0 {
+		r.ForwardTo = ""
+	}
+	return r, nil
+}
+
+// AddRoute adds an alias or, if addr is "@domain", a catch-all route.
+// Exactly one of userID and forwardTo must be set.
+func AddRoute(conn *sqlite.Conn, addr string, userID int64, forwardTo, tag string) error {
+	if strings.LastIndexByte(addr, '@') == -1 {
+		return &UserError{UserMsg: "Invalid email address, missing @domain."}
+	}
+	if (userID == 0) == (forwardTo == "") {
+		return fmt.Errorf("db.AddRoute: %q needs one of a user or a forwarding address", addr)
+	}
+	if forwardTo != "" && strings.LastIndexByte(forwardTo, '@') <= 0 {
+		return &UserError{UserMsg: fmt.Sprintf("Invalid forwarding address %q.", forwardTo)}
+	}
+	addr = strings.ToLower(addr)
+
+	stmt := conn.Prep(`SELECT count(*) FROM UserAddresses WHERE Address = $addr;`)
+	stmt.SetText("$addr", addr)
+	if count, err := sqlitex.ResultInt(stmt); err != nil {
+		return fmt.Errorf("db.AddRoute: %v", err)
+	} else if count > 0 {
+		return &UserError{UserMsg: fmt.Sprintf("Address %q is already assigned.", addr)}
+	}
+
+	stmt = conn.Prep(`INSERT INTO AddressRoutes (Address, UserID, ForwardTo, Tag)
+		VALUES ($addr, $userID, $forwardTo, $tag);`)
+	stmt.SetText("$addr", addr)
+	if userID != 0 {
+		stmt.SetInt64("$userID", userID)
+		stmt.SetNull("$forwardTo")
+	} else {
+		stmt.SetNull("$userID")
+		stmt.SetText("$forwardTo", forwardTo)
+	}
+	if tag != "" {
+		stmt.SetText("$tag", tag)
+	} else {
+		stmt.SetNull("$tag")
+	}
+	if _, err := stmt.Step(); err != nil {
+		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return &UserError{UserMsg: fmt.Sprintf("Address %q is already assigned.", addr)}
+		}
+		return fmt.Errorf("db.AddRoute: %v", err)
+	}
+	return nil
+}
+
+// RemoveRoute removes the alias or catch-all route for addr.
+func RemoveRoute(conn *sqlite.Conn, addr string) error {
+	stmt := conn.Prep(`DELETE FROM AddressRoutes WHERE Address = $addr;`)
+	stmt.SetText("$addr", strings.ToLower(addr))
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.RemoveRoute: %v", err)
+	}
+	if conn.Changes() == 0 {
+		return fmt.Errorf("db.RemoveRoute: unknown address")
+	}
+	return nil
+}
+
+// CollectRecipientTags reports the tags of the addresses userID
+// was sent the message stagingID on, for messages yet to be received.
+// The tag of a VERP return path is not reported.
+func CollectRecipientTags(conn *sqlite.Conn, stagingID, userID int64) (tags []string, err error) {
+	stmt := conn.Prep(`SELECT DISTINCT Tag FROM MsgRecipients
+		WHERE StagingID = $stagingID AND UserID = $userID
+		AND DeliveryState = $deliveryState AND Tag IS NOT NULL
+		AND Tag NOT LIKE $verpTag
+		ORDER BY Tag;`)
+	stmt.SetText("$verpTag", verpPrefix+"%")
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$deliveryState", int64(DeliveryReceived))
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasRow {
+			break
+		}
+		tags = append(tags, stmt.GetText("Tag"))
+	}
+	return tags, nil
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// CanSendAs reports whether a user may send mail from addr.
+//
+// A user may send from their own addresses, subaddresses of them
+// ("user+tag@domain"), and the send-as addresses they have added.
+func CanSendAs(conn *sqlite.Conn, userID int64, addr string) (bool, error) {
+	addr = strings.ToLower(addr)
+	addrs := []string{addr}
+	if at := strings.LastIndexByte(addr, '@'); at > 0 {
+		if i := strings.IndexByte(addr[:at], '+'); i > 0 {
+			addrs = append(addrs, addr[:i]+addr[at:])
+		}
+	}
+	for _, addr := range addrs {
+		stmt := conn.Prep(`SELECT count(*) FROM UserAddresses
+			WHERE Address = $addr AND UserID = $userID;`)
+		stmt.SetText("$addr", addr)
+		stmt.SetInt64("$userID", userID)
+		if count, err := sqlitex.ResultInt(stmt); err != nil {
+			return false, fmt.Errorf("db.CanSendAs: %v", err)
+		} else if count > 0 {
+			return true, nil
+		}
+	}
+
+	stmt := conn.Prep(`SELECT count(*) FROM SendAsAddresses
+		WHERE Address = $addr AND UserID = $userID;`)
+	stmt.SetText("$addr", addr)
+	stmt.SetInt64("$userID", userID)
+	count, err := sqlitex.ResultInt(stmt)
+	if err != nil {
+		return false, fmt.Errorf("db.CanSendAs: %v", err)
+	}
+	return count > 0, nil
+}
+
+// PrimaryAddress reports the address a user sends mail from by
+// default, or "" if the user has no addresses.
+func PrimaryAddress(conn *sqlite.Conn, userID int64) (string, error) {
+	stmt := conn.Prep(`SELECT Address FROM UserAddresses WHERE UserID = $userID
+		ORDER BY ifnull(PrimaryAddr, 0) DESC, Address LIMIT 1;`)
+	stmt.SetInt64("$userID", userID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", fmt.Errorf("db.PrimaryAddress: %v", err)
+	} else if !hasNext {
+		return "", nil
+	}
+	addr := stmt.GetText("Address")
+	stmt.Reset()
+	return addr, nil
+}
+
+// AddSendAs approves addr for a user to send mail as.
+func AddSendAs(conn *sqlite.Conn, userID int64, addr string) error {
+	if strings.LastIndexByte(addr, '@') <= 0 {
+		return &UserError{UserMsg: "Invalid email address, missing @domain."}
+	}
+	stmt := conn.Prep(`INSERT INTO SendAsAddresses (Address, UserID, Added)
+		VALUES ($addr, $userID, $added);`)
+	stmt.SetText("$addr", strings.ToLower(addr))
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$added", time.Now().Unix())
+	if _, err := stmt.Step(); err != nil {
+		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return &UserError{UserMsg: fmt.Sprintf("Address %q is already a send-as address.", addr)}
+		}
+		return fmt.Errorf("db.AddSendAs: %v", err)
+	}
+	return nil
+}
+
+// RemoveSendAs withdraws a send-as address of a user.
+func RemoveSendAs(conn *sqlite.Conn, userID int64, addr string) error {
+	stmt := conn.Prep(`DELETE FROM SendAsAddresses
+		WHERE Address = $addr AND UserID = $userID;`)
+	stmt.SetText("$addr", strings.ToLower(addr))
+	stmt.SetInt64("$userID", userID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.RemoveSendAs: %v", err)
+	}
+	if conn.Changes() == 0 {
+		return &UserError{UserMsg: fmt.Sprintf("Address %q is not a send-as address.", addr)}
+	}
+	return nil
+}
+
+// SendAsAddresses lists the send-as addresses of a user.
+func SendAsAddresses(conn *sqlite.Conn, userID int64) (addrs []string, err error) {
+	stmt := conn.Prep(`SELECT Address FROM SendAsAddresses
+		WHERE UserID = $userID ORDER BY Address;`)
+	stmt.SetInt64("$userID", userID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("db.SendAsAddresses: %v", err)
+		} else if !hasNext {
+			break
+		}
+		addrs = append(addrs, stmt.GetText("Address"))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,307 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"golang.org/x/crypto/bcrypt"
+	"spilled.ink/util/totp"
+)
+
+// Protocol logins (IMAP, MSA) only ever accept the app-specific
+// passwords of a user's Devices, never the account password.
+// So turning on two-factor authentication changes nothing for
+// them: a device is authorized once, when its password is made.
+// TOTP codes are checked by Authenticator.AuthUser, the account
+// password login, which is throttled and locked out like AuthDevice.
+
+var ErrTOTPRequired = errors.New("db: TOTP code required")
+
+// NewAppPassword generates an app-specific password for AddDevice.
+// It is sixteen letters, in groups of four for reading aloud.
+func NewAppPassword() (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	// Bytes at or above the largest multiple of len(letters)
+	// are rejected, so every letter is equally likely.
+	const limit = 256 - 256%len(letters)
+
+	buf := new(strings.Builder)
+	b := make([]byte, 32)
+	n := 0
+	for n < 16 {
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("db.NewAppPassword: %v", err)
+		}
+		for _, c := range b {
+			if int(c) >= limit || n == 16 {
+				continue
+			}
+			if n > 0 && n%4 == 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteByte(letters[int(c)%len(letters)])
+			n++
+		}
+	}
+	return buf.String(), nil
+}
+
+// normalizeAppPassword puts an app password in the form it
+// is hashed in, ignoring case and the spaces between groups.
+func normalizeAppPassword(password []byte) []byte {
+	password = bytes.ToUpper(password)
+	return bytes.Replace(password, []byte(" "), []byte(""), -1)
+}
+
+type Device struct {
+	DeviceID       int64
+	DeviceName     string
+	Deleted        bool // revoked
+	Created        time.Time
+	LastAccessTime time.Time // zero if never used
+	LastAccessAddr string
+}
+
+// Devices lists the app-specific passwords of a user.
+func Devices(conn *sqlite.Conn, userID int64) ([]Device, error) {
+	stmt := conn.Prep(`SELECT DeviceID, DeviceName, Deleted, Created,
+		LastAccessTime, LastAccessAddr
+		FROM Devices WHERE UserID = $userID ORDER BY DeviceID;`)
+	stmt.SetInt64("$userID", userID)
+	var devices []Device
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("db.Devices: %v", err)
+		} else if !hasNext {
+			break
+		}
+		d := Device{
+			DeviceID:       stmt.GetInt64("DeviceID"),
+			DeviceName:     stmt.GetText("DeviceName"),
+			Deleted:        stmt.GetInt64("Deleted") != 0,
+			Created:        time.Unix(stmt.GetInt64("Created"), 0),
+			LastAccessAddr: stmt.GetText("LastAccessAddr"),
+		}
+		if t := stmt.GetInt64("LastAccessTime"); t != 0 {
+			d.LastAccessTime = time.Unix(t, 0)
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// RevokeDevice stops the app-specific password of a device working.
+// The record is kept so the device's last access remains visible.
+func RevokeDevice(conn *sqlite.Conn, userID, deviceID int64) error {
+	stmt := conn.Prep(`UPDATE Devices SET Deleted = TRUE
+		WHERE UserID = $userID AND DeviceID = $deviceID;`)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$deviceID", deviceID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.RevokeDevice: %v", err)
+	}
+	if conn.Changes() == 0 {
+		return fmt.Errorf("db.RevokeDevice: unknown device %d", deviceID)
+	}
+	return Audit(conn, AuditEntry{
+		UserID: userID,
+		Event:  AuditPassword,
+		Detail: fmt.Sprintf("revoked device %d", deviceID),
+	})
+}
+
+// SetupTOTP generates a new TOTP secret for a user.
+// The secret is not used until it is confirmed with EnableTOTP.
+func SetupTOTP(conn *sqlite.Conn, userID int64) (secret string, err error) {
+	secret, err = totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	stmt := conn.Prep(`INSERT OR REPLACE INTO UserTOTP (UserID, Secret, Enabled)
+		VALUES ($userID, $secret, FALSE);`)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetText("$secret", secret)
+	if _, err := stmt.Step(); err != nil {
+		return "", fmt.Errorf("db.SetupTOTP: %v", err)
+	}
+	return secret, nil
+}
+
+// EnableTOTP turns on two-factor authentication for a user once
+// they show a working code for the secret from SetupTOTP.
+func EnableTOTP(conn *sqlite.Conn, userID int64, code string, now time.Time) error {
+	if err := checkTOTP(conn, userID, code, now, false); err != nil {
+		return err
+	}
+	stmt := conn.Prep(`UPDATE UserTOTP SET Enabled = TRUE WHERE UserID = $userID;`)
+	stmt.SetInt64("$userID", userID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.EnableTOTP: %v", err)
+	}
+	return Audit(conn, AuditEntry{UserID: userID, Event: AuditTOTP, Detail: "enabled"})
+}
+
+// DisableTOTP turns off two-factor authentication for a user.
+func DisableTOTP(conn *sqlite.Conn, userID int64) error {
+	stmt := conn.Prep(`DELETE FROM UserTOTP WHERE UserID = $userID;`)
+	stmt.SetInt64("$userID", userID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.DisableTOTP: %v", err)
+	}
+	return Audit(conn, AuditEntry{UserID: userID, Event: AuditTOTP, Detail: "disabled"})
+}
+
+// TOTPEnabled reports whether a user has two-factor authentication.
+func TOTPEnabled(conn *sqlite.Conn, userID int64) (bool, error) {
+	stmt := conn.Prep(`SELECT Enabled FROM UserTOTP WHERE UserID = $userID;`)
+	stmt.SetInt64("$userID", userID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return false, fmt.Errorf("db.TOTPEnabled: %v", err)
+	} else if !hasNext {
+		return false, nil
+	}
+	enabled := stmt.GetInt64("Enabled") != 0
+	stmt.Reset()
+	return enabled, nil
+}
+
+// checkTOTP verifies code against the secret of userID.
+// A code is accepted once, a replayed code is refused.
+func checkTOTP(conn *sqlite.Conn, userID int64, code string, now time.Time, enabled bool) error {
+	stmt := conn.Prep(`SELECT Secret, Enabled, LastStep FROM UserTOTP WHERE UserID = $userID;`)
+	stmt.SetInt64("$userID", userID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.checkTOTP: %v", err)
+	} else if !hasNext {
+		return fmt.Errorf("db.checkTOTP: no TOTP secret for user %d", userID)
+	}
+	secret := stmt.GetText("Secret")
+	isEnabled := stmt.GetInt64("Enabled") != 0
+	lastStep := stmt.GetInt64("LastStep")
+	stmt.Reset()
+
+	if isEnabled != enabled {
+		return fmt.Errorf("db.checkTOTP: user %d TOTP enabled=%v", userID, isEnabled)
+	}
+	step, ok := totp.Verify(secret, code, now)
+	if !ok || step <= lastStep {
+		return ErrBadCredentials
+	}
+
+	stmt = conn.Prep(`UPDATE UserTOTP SET LastStep = $step WHERE UserID = $userID;`)
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$step", step)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("db.checkTOTP: %v", err)
+	}
+	return nil
+}
+
+// AuthUser checks the account password of a user, for logins to
+// the account itself rather than through a protocol.
+//
+// If the user has two-factor authentication, a valid TOTP code
+// is also required. With no code it reports ErrTOTPRequired,
+// so a login form can ask for one. A bad password or code is
+// ErrBadCredentials and counts toward the Throttle and Lockout
+// as a bad device password does.
+func (a *Authenticator) AuthUser(ctx context.Context, remoteAddr, username string, password []byte, code string) (userID int64, err error) {
+	conn := a.DB.Get(ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer a.DB.Put(conn)
+
+	start := time.Now()
+	log := &Log{
+		Where: a.Where,
+		What:  "auth_user",
+		When:  start,
+		Data: map[string]interface{}{
+			"remote_addr": remoteAddr,
+			"username":    username,
+		},
+	}
+	defer func() {
+		log.Duration = time.Since(start)
+		a.Logf("%s", log.String())
+	}()
+
+	record, err := a.limit(conn, log, remoteAddr, username, start)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { record(err) }()
+
+	userID, knownUserID, err := checkUser(conn, username, password, code, start)
+	if err != nil {
+		log.Err = err
+		if err == ErrBadCredentials && knownUserID != 0 {
+			a.auditFailure(conn, log, knownUserID, remoteAddr)
+		}
+		if err != ErrBadCredentials && err != ErrTOTPRequired {
+			return 0, errAuthFailed
+		}
+		return 0, err
+	}
+	log.UserID = userID
+
+	err = Audit(conn, AuditEntry{
+		UserID: userID,
+		Event:  AuditLogin,
+		Addr:   remoteAddr,
+		Client: "account",
+		Detail: a.Where,
+	})
+	if err != nil {
+		log.Err = err
+		return 0, errAuthFailed
+	}
+	return userID, nil
+}
+
+// checkUser checks the account password and TOTP code of a user.
+// If the username exists, knownUserID reports it even when the
+// credentials are bad.
+func checkUser(conn *sqlite.Conn, username string, password []byte, code string, now time.Time) (userID, knownUserID int64, err error) {
+	stmt := conn.Prep(`SELECT Users.UserID, PassHash, Locked FROM Users
+		INNER JOIN UserAddresses ON Users.UserID = UserAddresses.UserID
+		WHERE Address = $username;`)
+	stmt.SetText("$username", strings.ToLower(username))
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, 0, fmt.Errorf("db.AuthUser: %v", err)
+	} else if !hasNext {
+		return 0, 0, ErrBadCredentials
+	}
+	knownUserID = stmt.GetInt64("UserID")
+	passHash := []byte(stmt.GetText("PassHash"))
+	locked := stmt.GetInt64("Locked") != 0
+	stmt.Reset()
+
+	if err := bcrypt.CompareHashAndPassword(passHash, password); err != nil {
+		return 0, knownUserID, ErrBadCredentials
+	}
+	if locked {
+		return 0, knownUserID, ErrBadCredentials
+	}
+
+	enabled, err := TOTPEnabled(conn, knownUserID)
+	if err != nil {
+		return 0, knownUserID, err
+	}
+	if enabled {
+		if code == "" {
+			return 0, knownUserID, ErrTOTPRequired
+		}
+		if err := checkTOTP(conn, knownUserID, code, now, true); err != nil {
+			return 0, knownUserID, err
+		}
+	}
+	return knownUserID, knownUserID, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// Mail a user sends is given a VERP return path, a variable
+// envelope return path naming the message:
+//
+//	bob+bounce-<token>@example.com
+//
+// A bounce comes back to bob@example.com with the token in its
+// subaddress tag. The token is random, so a notification cannot be
+// forged for a message without having seen its envelope, and it is
+// stored in Msgs.BounceToken to find the message it names.
+
+// verpPrefix starts the tag of a VERP return path.
+const verpPrefix = "bounce-"
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// BounceToken returns the VERP token of the message stagingID,
+// creating it the first time it is asked for.
+func BounceToken(conn *sqlite.Conn, stagingID int64) (string, error) {
+	stmt := conn.Prep("SELECT ifnull(BounceToken, '') AS BounceToken FROM Msgs WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", fmt.Errorf("db.BounceToken: %v", err)
+	} else if !hasNext {
+		return "", fmt.Errorf("db.BounceToken: no message %d", stagingID)
+	}
+	token := stmt.GetText("BounceToken")
+	stmt.Reset()
+	if token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("db.BounceToken: %v", err)
+	}
+	token = strings.ToLower(tokenEncoding.EncodeToString(b))
+	stmt = conn.Prep("UPDATE Msgs SET BounceToken = $token WHERE StagingID = $stagingID;")
+	stmt.SetText("$token", token)
+	stmt.SetInt64("$stagingID", stagingID)
+	if _, err := stmt.Step(); err != nil {
+		return "", fmt.Errorf("db.BounceToken: %v", err)
+	}
+	return token, nil
+}
+
+// FindBounceToken finds the message and sending user of a VERP token.
+// It reports a stagingID of 0 if no message has the token.
+func FindBounceToken(conn *sqlite.Conn, token string) (stagingID, userID int64, err error) {
+	stmt := conn.Prep(`SELECT StagingID, ifnull(UserID, 0) AS UserID
+		FROM Msgs WHERE BounceToken = $token;`)
+	stmt.SetText("$token", strings.ToLower(token))
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, 0, fmt.Errorf("db.FindBounceToken: %v", err)
+	} else if !hasNext {
+		return 0, 0, nil
+	}
+	stagingID = stmt.GetInt64("StagingID")
+	userID = stmt.GetInt64("UserID")
+	stmt.Reset()
+	return stagingID, userID, nil
+}
+
+// VERPSender returns the return path of sender carrying token.
+// Any subaddress tag of sender is replaced.
+func VERPSender(sender, token string) string {
+	at := strings.LastIndexByte(sender, '@')
+	if at <= 0 {
+		return sender
+	}
+	local, domain := sender[:at], sender[at:]
+	if i := strings.IndexByte(local, '+'); i > 0 {
+		local = local[:i]
+	}
+	return local + "+" + verpPrefix + token + domain
+}
+
+// ParseVERP reports the token of a VERP return path.
+func ParseVERP(addr string) (token string, ok bool) {
+	at := strings.LastIndexByte(addr, '@')
+	if at <= 0 {
+		return "", false
+	}
+	local := addr[:at]
+	i := strings.IndexByte(local, '+')
+	if i <= 0 {
+		return "", false
+	}
+	tag := strings.ToLower(local[i+1:])
+	if !strings.HasPrefix(tag, verpPrefix) || len(tag) == len(verpPrefix) {
+		return "", false
+	}
+	return tag[len(verpPrefix):], true
+}
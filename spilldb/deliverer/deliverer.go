@@ -2,11 +2,13 @@
 package deliverer
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/textproto"
 	"strings"
 	"sync"
 	"time"
@@ -14,13 +16,26 @@ import (
 	"crawshaw.io/iox"
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email/bimi"
 	"spilled.ink/email/dkim"
+	"spilled.ink/email/dsn"
 	"spilled.ink/email/msgcleaver"
 	"spilled.ink/smtp/smtpclient"
 	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/dkimkeys"
+	"spilled.ink/spilldb/webhook"
+	"spilled.ink/util/dnscache"
 )
 
 type Deliverer struct {
+	// Released, if set, is called when a held message is released,
+	// to process its local recipients. See Hold.
+	Released func(stagingID int64)
+
+	// DKIMKey is the master key DKIM private keys are sealed with.
+	// See package dkimkeys.
+	DKIMKey []byte
+
 	ctx      context.Context
 	cancelFn func()
 	done     chan struct{}
@@ -29,11 +44,17 @@ type Deliverer struct {
 	filer  *iox.Filer
 	client *smtpclient.Client
 
-	newmsg chan struct{}
+	limiter rateLimiter
+	newmsg  chan struct{}
+
+	holdMu sync.Mutex
+	held   *timerWheel
 }
 
 // NewDeliverer creates a Deliverer that periodically scans the DB and delivers emails.
-func NewDeliverer(dbpool *sqlitex.Pool, filer *iox.Filer) *Deliverer {
+//
+// If resolver is non-nil, it is used for MX lookups.
+func NewDeliverer(dbpool *sqlitex.Pool, filer *iox.Filer, resolver *dnscache.Resolver) *Deliverer {
 	// TODO: principled source for constants
 	const localHostname = "mx.spilledinkmail.com"
 	const localAddr = "172.31.24.137"
@@ -48,6 +69,10 @@ func NewDeliverer(dbpool *sqlitex.Pool, filer *iox.Filer) *Deliverer {
 		filer:  filer,
 		client: smtpclient.NewClient(localHostname, 100),
 		newmsg: make(chan struct{}, 1),
+		held:   newTimerWheel(time.Now(), holdTick, holdSlots),
+	}
+	if resolver != nil {
+		d.client.LookupMX = resolver.LookupMX
 	}
 	if ip := net.ParseIP(localAddr); isLocalAddr(ip) {
 		d.client.LocalAddr = &net.TCPAddr{IP: ip}
@@ -95,6 +120,19 @@ func (d *Deliverer) Deliver(stagingID int64) {
 func (d *Deliverer) Shutdown() {
 	d.cancelFn()
 	<-d.done
+	d.client.CloseIdle()
+}
+
+// SetRateLimit limits the messages sent to each domain.
+// It is safe to call while the Deliverer is running.
+func (d *Deliverer) SetRateLimit(rl RateLimit) {
+	d.limiter.set(rl)
+}
+
+// Client is the SMTP client messages are sent with.
+// Its connection limits may be set before Run.
+func (d *Deliverer) Client() *smtpclient.Client {
+	return d.client
 }
 
 func (d *Deliverer) recordDelivery(stagingID int64, res []smtpclient.Delivery) error {
@@ -142,83 +180,263 @@ func (d *Deliverer) recordDelivery(stagingID int64, res []smtpclient.Delivery) e
 	return nil
 }
 
-func (d *Deliverer) deliver(stagingID int64, from string, recipients []string, contents *iox.BufferFile) error {
+// Delivery is retried for retryWindow, after delayWarning the sender
+// is sent a delay notification.
+const (
+	retryWindow  = 36 * time.Hour
+	delayWarning = 4 * time.Hour
+)
+
+func (d *Deliverer) deliver(data *deliveryData) error {
+	stagingID := data.stagingID
+	env, err := d.deferRateLimited(data)
+	if err != nil || len(env.Recipients) == 0 {
+		return err
+	}
+	if data.returnPath != "" {
+		env.From = data.returnPath
+	}
 	// TODO: remove error return value from Send
-	res, _ := d.client.Send(d.ctx, from, recipients, contents, contents.Size())
+	res, _ := d.client.Send(d.ctx, env, data.contents, data.contents.Size())
 
 	if err := d.recordDelivery(stagingID, res); err != nil {
 		return err
 	}
 
 	conn := d.dbpool.Get(d.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
 	defer d.dbpool.Put(conn)
 
 	// Determine permenant delivery failures by looking at the delivery logs.
-	stmt := conn.Prep("SELECT Code, Date FROM Deliveries WHERE StagingID = $stagingID AND Recipient = $recipient ORDER BY Date;")
-	for _, d := range res {
-		if d.Success() {
+	var notices []dsn.Recipient
+	var bounces []webhook.Payload
+	now := time.Now()
+	stmt := conn.Prep("SELECT min(Date) FROM Deliveries WHERE StagingID = $stagingID AND Recipient = $recipient;")
+	for _, r := range res {
+		rcpt := data.recipient(r.Recipient)
+		notice := dsn.Recipient{
+			FinalRecipient:    r.Recipient,
+			OriginalRecipient: rcpt.ORcpt,
+			RemoteMTA:         r.RemoteMTA,
+			LastAttempt:       now,
+		}
+		if r.Success() {
+			// A server that accepted the DSN parameters
+			// takes over the reporting of success.
+			if !r.RemoteDSN && rcpt.Notify.Wants(dsn.ActionRelayed) {
+				notice.Action = dsn.ActionRelayed
+				notices = append(notices, notice)
+			}
 			continue
 		}
+		if r.Error != nil {
+			notice.Diagnostic = r.Error.Error()
+		} else {
+			notice.Diagnostic = fmt.Sprintf("%d %s", r.Code, r.Details)
+			notice.Status = enhancedStatus(r.Details)
+		}
+
+		stmt.Reset()
 		stmt.SetInt64("$stagingID", stagingID)
-		stmt.SetText("$recipient", d.Recipient)
-		var delivery smtpclient.Delivery
-		var pastDeliveries []smtpclient.Delivery
-		for {
-			if hasNext, err := stmt.Step(); err != nil {
+		stmt.SetText("$recipient", r.Recipient)
+		firstDate, err := sqlitex.ResultInt64(stmt)
+		if err != nil {
+			return err
+		}
+		firstAttempt := time.Unix(firstDate, 0)
+
+		if r.PermFailure() || now.Sub(firstAttempt) > retryWindow {
+			if err := setRecipientState(conn, stagingID, r.Recipient, db.DeliveryFailed); err != nil {
 				return err
-			} else if !hasNext {
-				break
 			}
-			pastDeliveries = append(pastDeliveries, smtpclient.Delivery{
-				Recipient: d.Recipient,
-				Code:      int(stmt.GetInt64("Code")),
-				Date:      time.Unix(stmt.GetInt64("Date"), 0),
+			bounces = append(bounces, webhook.Payload{
+				Event:      webhook.EventBounce,
+				Time:       now,
+				StagingID:  stagingID,
+				From:       data.env.From,
+				Recipient:  r.Recipient,
+				Diagnostic: notice.Diagnostic,
 			})
+			if rcpt.Notify.Wants(dsn.ActionFailed) {
+				notice.Action = dsn.ActionFailed
+				notices = append(notices, notice)
+			}
+			continue
+		}
+		if now.Sub(firstAttempt) > delayWarning && !data.delayed[r.Recipient] && rcpt.Notify.Wants(dsn.ActionDelayed) {
+			if err := setRecipientDelayed(conn, stagingID, r.Recipient); err != nil {
+				return err
+			}
+			data.delayed[r.Recipient] = true
+			notice.Action = dsn.ActionDelayed
+			notice.WillRetryUntil = firstAttempt.Add(retryWindow)
+			notices = append(notices, notice)
 		}
-		const retryWindow = 36 * time.Hour
-		permFailure := delivery.PermFailure()
-		if len(pastDeliveries) > 0 && delivery.Date.Sub(pastDeliveries[0].Date) > retryWindow {
-			permFailure = true
+	}
+
+	if len(bounces) > 0 {
+		if err := enqueueBounces(conn, stagingID, bounces); err != nil {
+			return fmt.Errorf("bounce webhook: %v", err)
 		}
-		if !permFailure {
-			continue
+	}
+
+	if len(notices) > 0 && data.env.From != "" {
+		if err := d.notify(conn, data, notices); err != nil {
+			return fmt.Errorf("delivery status notification: %v", err)
 		}
+	}
+	return nil
+}
 
-		// TODO: handle permFailure
-		log.Printf("TODO: handle perm failure of %v", stagingID)
+// deferRateLimited takes a rate limit token for each recipient domain
+// of a message. Recipients at domains without a token are left in the
+// queue until the domain has capacity again, and the envelope returned
+// is for the remaining recipients.
+func (d *Deliverer) deferRateLimited(data *deliveryData) (*smtpclient.Envelope, error) {
+	localIP := ""
+	if addr, ok := d.client.LocalAddr.(*net.TCPAddr); ok {
+		localIP = addr.IP.String()
 	}
 
-	// Determine if the message has been completely sent, mark it as such.
-	for _, d := range res {
-		if !d.Success() {
-			continue
+	now := time.Now()
+	waits := make(map[string]time.Duration) // domain -> wait
+	env := data.env
+	env.Recipients = nil
+	var deferred []smtpclient.Recipient
+	for _, rcpt := range data.env.Recipients {
+		dom := strings.ToLower(domain(rcpt.Addr))
+		wait, ok := waits[dom]
+		if !ok {
+			wait = d.limiter.take(dom, localIP, now)
+			waits[dom] = wait
+		}
+		if wait > 0 {
+			deferred = append(deferred, rcpt)
+		} else {
+			env.Recipients = append(env.Recipients, rcpt)
+		}
+	}
+	if len(deferred) == 0 {
+		return &env, nil
+	}
+
+	conn := d.dbpool.Get(d.ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer d.dbpool.Put(conn)
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeferUntil = $deferUntil
+		WHERE StagingID = $stagingID AND Recipient = $recipient;`)
+	for _, rcpt := range deferred {
+		// Round up, so the token is there when the message is.
+		wait := waits[strings.ToLower(domain(rcpt.Addr))] + time.Second
+		stmt.Reset()
+		stmt.SetInt64("$deferUntil", now.Add(wait).Unix())
+		stmt.SetInt64("$stagingID", data.stagingID)
+		stmt.SetText("$recipient", rcpt.Addr)
+		if _, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("rate limit: %v", err)
 		}
 	}
+	return &env, nil
+}
+
+// enqueueBounces tells the webhooks of the user who sent a message
+// about the recipients it could not be delivered to.
+func enqueueBounces(conn *sqlite.Conn, stagingID int64, bounces []webhook.Payload) (err error) {
+	stmt := conn.Prep("SELECT ifnull(UserID, 0) FROM Msgs WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	userID, err := sqlitex.ResultInt64(stmt)
+	if err != nil || userID == 0 {
+		return err // not sent by a local user
+	}
 
+	defer sqlitex.Save(conn)(&err)
+	for _, p := range bounces {
+		p.UserID = userID
+		if err := webhook.Enqueue(conn, p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func setRecipientState(conn *sqlite.Conn, stagingID int64, recipient string, state db.DeliveryState) error {
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryState
+		WHERE StagingID = $stagingID AND Recipient = $recipient;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetText("$recipient", recipient)
+	stmt.SetInt64("$deliveryState", int64(state))
+	_, err := stmt.Step()
+	return err
+}
+
+func setRecipientDelayed(conn *sqlite.Conn, stagingID int64, recipient string) error {
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DSNDelayed = TRUE
+		WHERE StagingID = $stagingID AND Recipient = $recipient;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetText("$recipient", recipient)
+	_, err := stmt.Step()
+	return err
+}
+
+// enhancedStatus reports the RFC 3463 status code
+// at the beginning of an SMTP response, if any.
+func enhancedStatus(details string) string {
+	code := details
+	if i := strings.IndexByte(code, ' '); i >= 0 {
+		code = code[:i]
+	}
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || (parts[0] != "4" && parts[0] != "5") {
+		return ""
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 || len(p) > 3 || strings.Trim(p, "0123456789") != "" {
+			return ""
+		}
+	}
+	return code
+}
+
 type deliveryData struct {
 	stagingID  int64
-	from       string
-	recipients []string
+	env        smtpclient.Envelope
+	returnPath string // MAIL FROM sent in place of env.From, if set
+	arrival    time.Time
+	delayed    map[string]bool // recipients sent a delay notification
 	contents   *iox.BufferFile
 }
 
-func (d *Deliverer) collectToDeliver() (deliveries []deliveryData, more bool, err error) {
+func (data *deliveryData) recipient(addr string) smtpclient.Recipient {
+	for _, rcpt := range data.env.Recipients {
+		if rcpt.Addr == addr {
+			return rcpt
+		}
+	}
+	return smtpclient.Recipient{Addr: addr}
+}
+
+func (d *Deliverer) collectToDeliver() (deliveries []*deliveryData, more bool, err error) {
 	conn := d.dbpool.Get(d.ctx)
 	if conn == nil {
 		return nil, false, context.Canceled
 	}
 	defer d.dbpool.Put(conn)
 
-	toDeliver := make(map[int64]deliveryData) // stagingID -> delivery data
+	toDeliver := make(map[int64]*deliveryData) // stagingID -> delivery data
 
 	const limit = 300
 	// TODO: consider the ordering of messages. LIFO, FIFO?
 	// Definitely process all local deliveries first.
-	stmt := conn.Prep("SELECT StagingID, Recipient FROM MsgRecipients WHERE DeliveryState = $deliverySending ORDER BY StagingID LIMIT $limit;")
+	stmt := conn.Prep(`SELECT StagingID, Recipient, DSNNotify, DSNORcpt, DSNDelayed
+		FROM MsgRecipients WHERE DeliveryState = $deliverySending
+		AND ifnull(DeferUntil, 0) <= $now
+		ORDER BY StagingID LIMIT $limit;`)
 	stmt.SetInt64("$deliverySending", int64(db.DeliverySending))
+	stmt.SetInt64("$now", time.Now().Unix())
 	stmt.SetInt64("$limit", limit)
 	count := 0
 	for {
@@ -229,8 +447,19 @@ func (d *Deliverer) collectToDeliver() (deliveries []deliveryData, more bool, er
 		}
 		stagingID := stmt.GetInt64("StagingID")
 		d := toDeliver[stagingID]
-		d.recipients = append(d.recipients, stmt.GetText("Recipient"))
-		toDeliver[stagingID] = d
+		if d == nil {
+			d = &deliveryData{delayed: make(map[string]bool)}
+			toDeliver[stagingID] = d
+		}
+		addr := stmt.GetText("Recipient")
+		d.env.Recipients = append(d.env.Recipients, smtpclient.Recipient{
+			Addr:   addr,
+			Notify: dsn.Notify(stmt.GetInt64("DSNNotify")),
+			ORcpt:  stmt.GetText("DSNORcpt"),
+		})
+		if stmt.GetInt64("DSNDelayed") != 0 {
+			d.delayed[addr] = true
+		}
 		count++
 	}
 	for stagingID := range toDeliver {
@@ -249,6 +478,12 @@ func (d *Deliverer) collectToDeliver() (deliveries []deliveryData, more bool, er
 			f.Close()
 			return nil, false, err
 		}
+		tlsOptional, err := tlsRequiredNo(f)
+		if err != nil {
+			f.Close()
+			return nil, false, err
+		}
+		toDeliver[stagingID].env.TLSOptional = tlsOptional
 
 		// It is very messy to be doing message modification here.
 		// Do it earlier, in a Processor-like object for incoming
@@ -258,8 +493,17 @@ func (d *Deliverer) collectToDeliver() (deliveries []deliveryData, more bool, er
 			return nil, false, err
 		}
 		if signer != nil {
+			var src io.Reader = f
+			header, err := bimiSelector(conn, signer.Domain)
+			if err != nil {
+				f.Close()
+				return nil, false, err
+			}
+			if header != "" {
+				src = io.MultiReader(strings.NewReader("BIMI-Selector: "+header+"\r\n"), f)
+			}
 			dst := d.filer.BufferFile(0)
-			err := msgcleaver.Sign(d.filer, signer, dst, f)
+			err = msgcleaver.Sign(d.filer, signer, dst, src)
 			f.Close()
 			if err != nil {
 				dst.Close()
@@ -272,20 +516,33 @@ func (d *Deliverer) collectToDeliver() (deliveries []deliveryData, more bool, er
 			f = dst
 		}
 
-		d := toDeliver[stagingID]
-		d.contents = f
-		toDeliver[stagingID] = d
+		toDeliver[stagingID].contents = f
 	}
 
-	deliveries = make([]deliveryData, 0, len(toDeliver))
-	stmt = conn.Prep("SELECT Sender FROM Msgs WHERE StagingID = $stagingID;")
+	deliveries = make([]*deliveryData, 0, len(toDeliver))
+	stmt = conn.Prep(`SELECT Sender, DateReceived, SMTPUTF8, DSNRet, DSNEnvID, RequireTLS,
+		ifnull(UserID, 0) AS UserID
+		FROM Msgs WHERE StagingID = $stagingID;`)
 	for stagingID, d := range toDeliver {
 		d.stagingID = stagingID
 
 		stmt.Reset()
 		stmt.SetInt64("$stagingID", stagingID)
-		d.from, err = sqlitex.ResultText(stmt)
-		if err != nil {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, false, err
+		} else if !hasNext {
+			return nil, false, fmt.Errorf("deliverer: missing message %d", stagingID)
+		}
+		d.env.From = stmt.GetText("Sender")
+		d.env.SMTPUTF8 = stmt.GetInt64("SMTPUTF8") != 0
+		d.env.Ret = dsn.Ret(stmt.GetText("DSNRet"))
+		d.env.EnvID = stmt.GetText("DSNEnvID")
+		d.env.RequireTLS = stmt.GetInt64("RequireTLS") != 0
+		d.arrival = time.Unix(stmt.GetInt64("DateReceived"), 0)
+		userID := stmt.GetInt64("UserID")
+		stmt.Reset()
+
+		if d.returnPath, err = verpReturnPath(conn, stagingID, userID, d.env.From); err != nil {
 			return nil, false, err
 		}
 
@@ -294,6 +551,42 @@ func (d *Deliverer) collectToDeliver() (deliveries []deliveryData, more bool, er
 	return deliveries, count == limit, nil
 }
 
+// verpReturnPath returns the VERP return path of a message a local
+// user sends, see db.VERPSender. It returns "" for a message with
+// no sender, or a sender whose bounces would not reach the user.
+func verpReturnPath(conn *sqlite.Conn, stagingID, userID int64, sender string) (string, error) {
+	if userID == 0 || sender == "" {
+		return "", nil
+	}
+	route, err := db.ResolveAddress(conn, sender)
+	if err != nil {
+		return "", err
+	}
+	if route.UserID != userID {
+		return "", nil
+	}
+	token, err := db.BounceToken(conn, stagingID)
+	if err != nil {
+		return "", err
+	}
+	return db.VERPSender(sender, token), nil
+}
+
+// tlsRequiredNo reports whether a message has a "TLS-Required: No"
+// header, RFC 8689 section 5, and seeks f back to the start.
+func tlsRequiredNo(f io.ReadSeeker) (bool, error) {
+	hdr, _ := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, err
+	}
+	for _, v := range hdr["Tls-Required"] {
+		if strings.EqualFold(strings.TrimSpace(v), "no") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (d *Deliverer) findSigner(conn *sqlite.Conn, stagingID int64) (*dkim.Signer, error) {
 	stmt := conn.Prep("SELECT Sender FROM Msgs WHERE StagingID = $stagingID;")
 	stmt.SetInt64("$stagingID", stagingID)
@@ -301,40 +594,50 @@ func (d *Deliverer) findSigner(conn *sqlite.Conn, stagingID int64) (*dkim.Signer
 	if err != nil {
 		return nil, err
 	}
+	if senderAddr == "" {
+		return nil, nil // null reverse-path, a delivery status notification
+	}
 	i := strings.LastIndexByte(senderAddr, '@')
 	if i == -1 || i == len(senderAddr)-1 {
 		return nil, fmt.Errorf("signer: bad sender: %q", senderAddr)
 	}
 	domain := senderAddr[i+1:]
 
-	stmt = conn.Prep("SELECT Selector, PrivateKey FROM DKIMRecords WHERE DomainName = $domain AND Current = TRUE;")
-	stmt.SetText("$domain", domain)
+	return dkimkeys.Signer(conn, domain, time.Now(), d.DKIMKey)
+}
+
+// bimiSelector reports the BIMI-Selector header value for mail signed
+// by domain, or "" if the domain has no BIMI record.
+func bimiSelector(conn *sqlite.Conn, domain string) (string, error) {
+	stmt := conn.Prep("SELECT Selector FROM BIMIRecords WHERE DomainName = $domain;")
+	stmt.SetText("$domain", strings.ToLower(domain))
 	if hasNext, err := stmt.Step(); err != nil {
-		return nil, err
+		return "", err
 	} else if !hasNext {
-		return nil, nil
+		return "", nil
 	}
-	selector := stmt.GetText("Selector")
-	key := []byte(stmt.GetText("PrivateKey"))
+	rec := bimi.Record{Domain: domain, Selector: stmt.GetText("Selector")}
 	stmt.Reset()
-
-	signer, err := dkim.NewSigner(key)
-	if err != nil {
-		return nil, err
-	}
-	signer.Domain = domain
-	signer.Selector = selector
-	return signer, nil
+	return rec.SelectorHeader(), nil
 }
 
 func (d *Deliverer) Run() error {
 	defer func() { close(d.done) }()
 
+	if err := d.loadHeld(); err != nil {
+		return err
+	}
+
 	ticker := time.NewTicker(2 * time.Second)
+	holdTicker := time.NewTicker(holdTick)
+	defer holdTicker.Stop()
 	for {
 		select {
 		case <-d.ctx.Done():
 			return nil
+		case now := <-holdTicker.C:
+			d.releaseHeld(now)
+			continue
 		case <-d.newmsg:
 		case <-ticker.C:
 		}
@@ -359,8 +662,8 @@ func (d *Deliverer) Run() error {
 		var wg sync.WaitGroup
 		for _, data := range deliveries {
 			wg.Add(1)
-			go func(data deliveryData) {
-				err := d.deliver(data.stagingID, data.from, data.recipients, data.contents)
+			go func(data *deliveryData) {
+				err := d.deliver(data)
 				if err != nil {
 					// TODO plumb logging
 					log.Printf("deliver %v: %v", data.stagingID, err)
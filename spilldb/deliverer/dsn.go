@@ -0,0 +1,83 @@
+package deliverer
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email/dsn"
+	"spilled.ink/spilldb/db"
+)
+
+// notify sends the sender of a message a delivery status notification.
+//
+// Notifications to local users are staged for local delivery.
+// Senders of mail forwarded by an alias may be remote, in which case
+// the notification is sent back to them. It has a null reverse-path,
+// so it never bounces itself.
+func (d *Deliverer) notify(conn *sqlite.Conn, data *deliveryData, rcpts []dsn.Recipient) (err error) {
+	hostname := d.client.LocalHostname
+	report := &dsn.Report{
+		From:         "MAILER-DAEMON@" + hostname,
+		To:           data.env.From,
+		ReportingMTA: hostname,
+		EnvID:        data.env.EnvID,
+		ArrivalDate:  data.arrival,
+		Recipients:   rcpts,
+		Original:     io.NewSectionReader(data.contents, 0, data.contents.Size()),
+		Ret:          data.env.Ret,
+		Rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	buf := d.filer.BufferFile(0)
+	defer buf.Close()
+	if err := dsn.Write(buf, report); err != nil {
+		return err
+	}
+
+	defer sqlitex.Save(conn)(&err)
+
+	route, err := db.ResolveAddress(conn, data.env.From)
+	if err != nil {
+		return err
+	}
+
+	stmt := conn.Prep("INSERT INTO Msgs (Sender, DateReceived) VALUES ('', $time);")
+	stmt.SetInt64("$time", time.Now().Unix())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stagingID := conn.LastInsertRowID()
+
+	stmt = conn.Prep("INSERT INTO MsgRaw (StagingID, Content) VALUES ($stagingID, $content);")
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetZeroBlob("$content", buf.Size())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	b, err := conn.OpenBlob("", "MsgRaw", "Content", stagingID, true)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(b, io.NewSectionReader(buf, 0, buf.Size()))
+	b.Close()
+	if err != nil {
+		return err
+	}
+
+	stmt = conn.Prep(`INSERT INTO MsgRecipients (StagingID, Recipient, FullAddress, DeliveryState, DSNNotify, UserID)
+		VALUES ($stagingID, $recipient, '', $deliveryState, $dsnNotify, $userID);`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetText("$recipient", data.env.From)
+	stmt.SetInt64("$dsnNotify", int64(dsn.NotifyNever))
+	if route.UserID != 0 {
+		stmt.SetInt64("$deliveryState", int64(db.DeliveryToProcess))
+		stmt.SetInt64("$userID", route.UserID)
+	} else {
+		stmt.SetInt64("$deliveryState", int64(db.DeliverySending))
+		stmt.SetNull("$userID")
+	}
+	_, err = stmt.Step()
+	return err
+}
@@ -0,0 +1,154 @@
+package deliverer
+
+import (
+	"log"
+	"time"
+
+	"spilled.ink/spilldb/db"
+)
+
+// Held messages are timed on a wheel of holdSlots ticks of
+// holdTick, one rotation covering a little over eight minutes.
+// Longer holds wait in their slot for the rotations in between.
+const (
+	holdTick  = time.Second
+	holdSlots = 512
+)
+
+// Hold schedules the release of a message held by the MSA for
+// its sender's undo send window. See db.HoldMsg.
+func (d *Deliverer) Hold(stagingID int64, until time.Time) {
+	d.holdMu.Lock()
+	d.held.add(stagingID, until)
+	d.holdMu.Unlock()
+}
+
+// loadHeld schedules the messages held when the server stopped.
+func (d *Deliverer) loadHeld() error {
+	conn := d.dbpool.Get(d.ctx)
+	if conn == nil {
+		return nil
+	}
+	msgs, err := db.HeldMsgs(conn, 0)
+	d.dbpool.Put(conn)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		d.Hold(msg.StagingID, msg.HoldUntil)
+	}
+	return nil
+}
+
+// releaseHeld releases the held messages that are due.
+// A message that fails to be released is tried again next tick.
+func (d *Deliverer) releaseHeld(now time.Time) {
+	d.holdMu.Lock()
+	due := d.held.advance(now)
+	d.holdMu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	conn := d.dbpool.Get(d.ctx)
+	if conn == nil {
+		return
+	}
+	defer d.dbpool.Put(conn)
+
+	for _, stagingID := range due {
+		released, err := db.ReleaseHeld(conn, stagingID)
+		if err != nil {
+			log.Printf("deliverer: release held %d: %v", stagingID, err)
+			d.Hold(stagingID, now.Add(holdTick))
+			continue
+		}
+		if !released {
+			continue // cancelled
+		}
+		d.Deliver(stagingID)
+		if d.Released != nil {
+			d.Released(stagingID)
+		}
+	}
+}
+
+// timerWheel is a hashed timing wheel of held messages.
+//
+// Each slot holds the timers that fall due in one tick of a
+// rotation. Adding or removing a timer takes constant time, and
+// advancing the wheel visits one slot for each tick passed.
+type timerWheel struct {
+	tick  time.Duration
+	slots []map[int64]time.Time // staging ID -> due
+	pos   int                   // slot of the current tick
+	end   time.Time             // end of the current tick
+	slot  map[int64]int         // slot of each timer
+}
+
+func newTimerWheel(now time.Time, tick time.Duration, n int) *timerWheel {
+	w := &timerWheel{
+		tick:  tick,
+		slots: make([]map[int64]time.Time, n),
+		end:   now.Add(tick),
+		slot:  make(map[int64]int),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[int64]time.Time)
+	}
+	return w
+}
+
+// add sets a timer for id, replacing any it has.
+func (w *timerWheel) add(id int64, due time.Time) {
+	w.remove(id)
+	ticks := 0
+	if d := due.Sub(w.end); d > 0 {
+		ticks = int((d + w.tick - 1) / w.tick)
+	}
+	i := (w.pos + ticks) % len(w.slots)
+	w.slots[i][id] = due
+	w.slot[id] = i
+}
+
+func (w *timerWheel) remove(id int64) {
+	if i, ok := w.slot[id]; ok {
+		delete(w.slots[i], id)
+		delete(w.slot, id)
+	}
+}
+
+// advance moves the wheel to now and reports the timers due.
+func (w *timerWheel) advance(now time.Time) (due []int64) {
+	for steps := 0; ; steps++ {
+		if steps == len(w.slots) {
+			// Every slot has been visited, the clock jumped.
+			// Start the wheel at now and put back what is left.
+			left := make(map[int64]time.Time, len(w.slot))
+			for _, slot := range w.slots {
+				for id, t := range slot {
+					left[id] = t
+				}
+			}
+			*w = *newTimerWheel(now, w.tick, len(w.slots))
+			for id, t := range left {
+				w.add(id, t)
+			}
+			steps = -1
+			continue
+		}
+		for id, t := range w.slots[w.pos] {
+			if !t.After(now) {
+				due = append(due, id)
+				delete(w.slots[w.pos], id)
+				delete(w.slot, id)
+			}
+		}
+		if now.Before(w.end) {
+			break
+		}
+		w.pos = (w.pos + 1) % len(w.slots)
+		w.end = w.end.Add(w.tick)
+	}
+	return due
+}
@@ -0,0 +1,55 @@
+package deliverer
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	start := time.Unix(1000, 0)
+	w := newTimerWheel(start, time.Second, 8)
+
+	advance := func(d time.Duration, want ...int64) {
+		t.Helper()
+		due := w.advance(start.Add(d))
+		sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+		if len(due) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(due, want) {
+			t.Errorf("advance(%v) due %v, want %v", d, due, want)
+		}
+	}
+
+	w.add(1, start.Add(3*time.Second))
+	w.add(2, start.Add(3500*time.Millisecond))
+	w.add(3, start.Add(20*time.Second)) // more than a rotation away
+	w.add(4, start.Add(5*time.Second))
+	w.add(5, start) // already due
+	w.remove(4)
+
+	advance(0, 5)
+	advance(2 * time.Second)
+	advance(3*time.Second, 1)
+	advance(4*time.Second, 2)
+	advance(12 * time.Second)
+	advance(19 * time.Second)
+	advance(20*time.Second, 3)
+	if len(w.slot) != 0 {
+		t.Errorf("%d timers left", len(w.slot))
+	}
+
+	// Replacing a timer moves it.
+	w.add(6, start.Add(21*time.Second))
+	w.add(6, start.Add(25*time.Second))
+	advance(22 * time.Second)
+	advance(25*time.Second, 6)
+
+	// A clock jump past a whole rotation.
+	w.add(7, start.Add(30*time.Second))
+	w.add(8, start.Add(time.Hour+time.Second))
+	advance(time.Hour, 7)
+	advance(time.Hour+time.Second, 8)
+}
@@ -0,0 +1,133 @@
+package deliverer
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the messages sent to each destination domain
+// from each sending IP address. A message over the limit stays
+// queued and is sent once the domain has capacity again.
+type RateLimit struct {
+	MsgsPerHour  int            // per domain, 0 means no limit
+	DomainLimits map[string]int // overrides MsgsPerHour, keyed by lower case domain
+
+	// Warmup ramps up the limits of a new sending IP address,
+	// so receivers see its volume grow with its reputation.
+	Warmup Warmup
+}
+
+// Warmup is a schedule of limits for the first days of sending.
+//
+// On the day of Start, every domain is sent at most MsgsPerHour
+// messages an hour. The limit doubles each day after until it
+// reaches the domain's own limit, when the warm-up is over.
+type Warmup struct {
+	Start       time.Time
+	MsgsPerHour int // 0 means no warm-up
+}
+
+// limit reports the messages an hour domain may be sent at now.
+func (rl *RateLimit) limit(domain string, now time.Time) int {
+	limit := rl.MsgsPerHour
+	if l, ok := rl.DomainLimits[domain]; ok {
+		limit = l
+	}
+	w := rl.Warmup
+	if w.MsgsPerHour <= 0 || now.Before(w.Start) {
+		return limit
+	}
+	day := int(now.Sub(w.Start) / (24 * time.Hour))
+	warm := w.MsgsPerHour
+	for i := 0; i < day && (limit <= 0 || warm < limit); i++ {
+		warm *= 2
+	}
+	if limit > 0 && warm > limit {
+		return limit
+	}
+	return warm
+}
+
+// rateLimiter is a token bucket for each domain and sending IP.
+// A bucket holds at most a tenth of an hour's messages, so a
+// domain's hourly limit is spread over the hour.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rl      RateLimit
+	buckets map[string]*bucket // "domain ip" -> bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (r *rateLimiter) set(rl RateLimit) {
+	domainLimits := make(map[string]int, len(rl.DomainLimits))
+	for domain, limit := range rl.DomainLimits {
+		domainLimits[strings.ToLower(domain)] = limit
+	}
+	rl.DomainLimits = domainLimits
+
+	r.mu.Lock()
+	r.rl = rl
+	r.mu.Unlock()
+}
+
+// take takes a token to send a message to domain from localIP.
+// If there is none, it reports how long until there is.
+func (r *rateLimiter) take(domain, localIP string, now time.Time) (wait time.Duration) {
+	domain = strings.ToLower(domain)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limit := r.rl.limit(domain, now)
+	if limit <= 0 {
+		return 0
+	}
+	perSec := float64(limit) / time.Hour.Seconds()
+	burst := float64(limit) / 10
+	if burst < 1 {
+		burst = 1
+	}
+
+	if r.buckets == nil {
+		r.buckets = make(map[string]*bucket)
+	}
+	if now.Sub(r.pruned) > time.Hour {
+		// A bucket refills in six minutes, one unused
+		// for an hour is the same as a new bucket.
+		for key, b := range r.buckets {
+			if now.Sub(b.last) > time.Hour {
+				delete(r.buckets, key)
+			}
+		}
+		r.pruned = now
+	}
+	key := domain + " " + localIP
+	b := r.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		r.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * perSec
+		b.last = now
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / perSec * float64(time.Second))
+}
+
+// domain is the domain of an email address.
+func domain(addr string) string {
+	return addr[strings.LastIndexByte(addr, '@')+1:]
+}
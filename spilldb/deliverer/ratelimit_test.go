@@ -0,0 +1,80 @@
+package deliverer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var r rateLimiter
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		if wait := r.take("example.com", "", now); wait != 0 {
+			t.Fatalf("unlimited rate limiter deferred a message for %v", wait)
+		}
+	}
+
+	r.set(RateLimit{
+		MsgsPerHour:  60,
+		DomainLimits: map[string]int{"Example.ORG": 10},
+	})
+	for i := 0; i < 6; i++ {
+		if wait := r.take("example.com", "192.0.2.1", now); wait != 0 {
+			t.Fatalf("message %d under the burst deferred for %v", i, wait)
+		}
+	}
+	if wait := r.take("example.com", "192.0.2.1", now); wait != time.Minute {
+		t.Errorf("message over the burst deferred for %v, want 1m", wait)
+	}
+	if wait := r.take("example.com", "192.0.2.1", now.Add(time.Minute)); wait != 0 {
+		t.Errorf("message after a minute deferred for %v", wait)
+	}
+	if wait := r.take("example.com", "192.0.2.2", now); wait != 0 {
+		t.Error("limit shared by sending IPs")
+	}
+	if wait := r.take("example.net", "192.0.2.1", now); wait != 0 {
+		t.Error("limit shared by domains")
+	}
+
+	if wait := r.take("EXAMPLE.org", "192.0.2.1", now); wait != 0 {
+		t.Fatalf("first message to example.org deferred for %v", wait)
+	}
+	if wait := r.take("example.org", "192.0.2.1", now); wait != 6*time.Minute {
+		t.Errorf("second message to example.org deferred for %v, want 6m", wait)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := RateLimit{
+		MsgsPerHour:  1000,
+		DomainLimits: map[string]int{"example.org": 300},
+		Warmup:       Warmup{Start: start, MsgsPerHour: 50},
+	}
+	tests := []struct {
+		domain string
+		day    int
+		want   int
+	}{
+		{"example.com", -1, 1000}, // before the warm-up
+		{"example.com", 0, 50},
+		{"example.com", 1, 100},
+		{"example.com", 4, 800},
+		{"example.com", 5, 1000},
+		{"example.com", 30, 1000},
+		{"example.org", 2, 200},
+		{"example.org", 3, 300},
+	}
+	for _, test := range tests {
+		now := start.Add(time.Duration(test.day)*24*time.Hour + time.Hour)
+		if got := rl.limit(test.domain, now); got != test.want {
+			t.Errorf("limit(%s) on day %d = %d, want %d", test.domain, test.day, got, test.want)
+		}
+	}
+
+	rl.MsgsPerHour = 0
+	if got := rl.limit("example.com", start.Add(48*time.Hour)); got != 200 {
+		t.Errorf("unlimited domain on day 2: %d, want 200", got)
+	}
+}
@@ -0,0 +1,86 @@
+// Package deliveryhook runs operator code on incoming mail
+// before it is delivered to a local user.
+//
+// A Hook sees each delivery: the parsed message and its envelope,
+// once for every local user the message is for. It can change the
+// message headers, add flags, pick the mailbox, or reject the
+// delivery. Hooks run in process, or as external programs with Exec.
+//
+// Hooks run after the message has been accepted over SMTP, so a
+// rejected delivery is dropped, not bounced to the sender.
+package deliveryhook
+
+import (
+	"context"
+	"fmt"
+
+	"spilled.ink/email"
+)
+
+// Envelope describes how a message arrived.
+type Envelope struct {
+	StagingID  int64
+	Sender     string   // SMTP MAIL FROM
+	Recipients []string // SMTP RCPT TO addresses routed to UserID
+	UserID     int64
+	DKIM       string // "PASS", or why verification failed
+}
+
+// Delivery is a message on its way to a user's mailbox.
+type Delivery struct {
+	Envelope Envelope
+
+	// Msg is the message. Hooks may change Msg.Headers,
+	// which are a copy for this delivery, but not its parts.
+	Msg *email.Msg
+
+	// Raw is the message as received, for hooks that scan it.
+	// It is shared by every hook, seek to the start to read it.
+	Raw email.Buffer
+
+	// Flags are the IMAP flags the message is stored with.
+	Flags []string
+
+	// Mailbox is the name of the mailbox to deliver to.
+	// If empty or no such mailbox exists, the message is
+	// filed as usual.
+	Mailbox string
+}
+
+// Hook inspects and changes deliveries.
+//
+// A Hook rejects a delivery by returning a *RejectError. Any other
+// error stops the delivery, which is tried again later.
+type Hook interface {
+	Deliver(ctx context.Context, d *Delivery) error
+}
+
+// Func is a function used as a Hook.
+type Func func(ctx context.Context, d *Delivery) error
+
+func (fn Func) Deliver(ctx context.Context, d *Delivery) error { return fn(ctx, d) }
+
+// Chain is a Hook that runs hooks in order.
+// It stops at the first error.
+type Chain []Hook
+
+func (c Chain) Deliver(ctx context.Context, d *Delivery) error {
+	for _, h := range c {
+		if err := h.Deliver(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RejectError is reported by a Hook to refuse a delivery.
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	if e.Reason == "" {
+		return "deliveryhook: rejected"
+	}
+	return fmt.Sprintf("deliveryhook: rejected: %s", e.Reason)
+}
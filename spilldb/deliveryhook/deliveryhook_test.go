@@ -0,0 +1,121 @@
+package deliveryhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"crawshaw.io/iox"
+	"spilled.ink/email"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	hook := func(name string, err error) Hook {
+		return Func(func(ctx context.Context, d *Delivery) error {
+			order = append(order, name)
+			d.Flags = append(d.Flags, name)
+			return err
+		})
+	}
+	c := Chain{
+		hook("a", nil),
+		hook("b", &RejectError{Reason: "virus"}),
+		hook("c", nil),
+	}
+	d := &Delivery{}
+	err := c.Deliver(context.Background(), d)
+	if _, ok := err.(*RejectError); !ok {
+		t.Fatalf("err=%v, want a RejectError", err)
+	}
+	if got := strings.Join(order, ","); got != "a,b" {
+		t.Errorf("hooks ran %q, want %q", got, "a,b")
+	}
+}
+
+// TestHelperProcess is the program run by TestExec.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("DELIVERYHOOK_HELPER") != "1" {
+		return
+	}
+	r := bufio.NewReader(os.Stdin)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var req ExecRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	raw, _ := ioutil.ReadAll(r)
+
+	res := ExecResponse{Action: "accept"}
+	if strings.Contains(string(raw), "EICAR") {
+		res = ExecResponse{Action: "reject", Reason: "virus found"}
+	} else {
+		res.RemoveHeaders = []string{"x-spam"}
+		res.AddHeaders = []ExecHeader{{Key: "X-Scanned-By", Value: req.Sender}}
+		res.Flags = []string{`\Flagged`}
+		res.Mailbox = "Archive"
+	}
+	json.NewEncoder(os.Stdout).Encode(res)
+	os.Exit(0)
+}
+
+func TestExec(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	hook := &Exec{
+		Path: os.Args[0],
+		Args: []string{"-test.run=TestHelperProcess"},
+	}
+	os.Setenv("DELIVERYHOOK_HELPER", "1")
+	defer os.Unsetenv("DELIVERYHOOK_HELPER")
+
+	newDelivery := func(body string) *Delivery {
+		raw := filer.BufferFile(0)
+		raw.Write([]byte("Subject: hi\r\nX-Spam: yes\r\n\r\n" + body))
+		msg := &email.Msg{}
+		msg.Headers.Add("Subject", []byte("hi"))
+		msg.Headers.Add("X-Spam", []byte("yes"))
+		return &Delivery{
+			Envelope: Envelope{Sender: "alice@example.com"},
+			Msg:      msg,
+			Raw:      raw,
+			Flags:    []string{`\Recent`},
+		}
+	}
+
+	d := newDelivery("hello")
+	defer d.Raw.Close()
+	if err := hook.Deliver(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Msg.Headers.Get("X-Spam"); got != nil {
+		t.Errorf("X-Spam=%q, want removed", got)
+	}
+	if got := string(d.Msg.Headers.Get("X-Scanned-By")); got != "alice@example.com" {
+		t.Errorf("X-Scanned-By=%q, want alice@example.com", got)
+	}
+	if got := strings.Join(d.Flags, " "); got != `\Recent \Flagged` {
+		t.Errorf("flags=%q", got)
+	}
+	if d.Mailbox != "Archive" {
+		t.Errorf("mailbox=%q, want Archive", d.Mailbox)
+	}
+
+	d = newDelivery("X5O!P%@AP EICAR test")
+	defer d.Raw.Close()
+	err := hook.Deliver(context.Background(), d)
+	if rejectErr, ok := err.(*RejectError); !ok || rejectErr.Reason != "virus found" {
+		t.Errorf("err=%v, want rejection for virus", err)
+	}
+}
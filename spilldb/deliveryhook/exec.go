@@ -0,0 +1,138 @@
+package deliveryhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"spilled.ink/email"
+)
+
+// Exec is a Hook that runs an external program for each delivery.
+//
+// The program reads a JSON ExecRequest on the first line of its
+// standard input, followed by the raw message. It writes a JSON
+// ExecResponse to its standard output. A program that exits with
+// an error fails the delivery, which is tried again later.
+type Exec struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration // default 30s
+}
+
+// ExecRequest describes a delivery to an Exec program.
+type ExecRequest struct {
+	StagingID  int64        `json:"staging_id"`
+	Sender     string       `json:"sender"`
+	Recipients []string     `json:"recipients"`
+	UserID     int64        `json:"user_id"`
+	DKIM       string       `json:"dkim"`
+	Headers    []ExecHeader `json:"headers"`
+	Flags      []string     `json:"flags"`
+	Mailbox    string       `json:"mailbox,omitempty"`
+}
+
+// ExecResponse is the decision of an Exec program.
+type ExecResponse struct {
+	Action        string       `json:"action"` // "accept" or "reject"
+	Reason        string       `json:"reason,omitempty"`
+	RemoveHeaders []string     `json:"remove_headers,omitempty"`
+	AddHeaders    []ExecHeader `json:"add_headers,omitempty"`
+	Flags         []string     `json:"flags,omitempty"` // added to the message
+	Mailbox       string       `json:"mailbox,omitempty"`
+}
+
+type ExecHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (e *Exec) Deliver(ctx context.Context, d *Delivery) error {
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req := ExecRequest{
+		StagingID:  d.Envelope.StagingID,
+		Sender:     d.Envelope.Sender,
+		Recipients: d.Envelope.Recipients,
+		UserID:     d.Envelope.UserID,
+		DKIM:       d.Envelope.DKIM,
+		Flags:      d.Flags,
+		Mailbox:    d.Mailbox,
+	}
+	for _, entry := range d.Msg.Headers.Entries {
+		req.Headers = append(req.Headers, ExecHeader{
+			Key:   string(entry.Key),
+			Value: string(entry.Value),
+		})
+	}
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("deliveryhook: %s: %v", e.Path, err)
+	}
+	stdin := []io.Reader{bytes.NewReader(reqJSON), strings.NewReader("\n")}
+	if d.Raw != nil {
+		if _, err := d.Raw.Seek(0, 0); err != nil {
+			return fmt.Errorf("deliveryhook: %s: %v", e.Path, err)
+		}
+		stdin = append(stdin, d.Raw)
+	}
+
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	cmd.Stdin = io.MultiReader(stdin...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return fmt.Errorf("deliveryhook: %s: %v", e.Path, err)
+	}
+
+	var res ExecResponse
+	if err := json.Unmarshal(out, &res); err != nil {
+		return fmt.Errorf("deliveryhook: %s: bad response: %v", e.Path, err)
+	}
+	switch res.Action {
+	case "accept":
+	case "reject":
+		return &RejectError{Reason: res.Reason}
+	default:
+		return fmt.Errorf("deliveryhook: %s: unknown action %q", e.Path, res.Action)
+	}
+
+	for _, key := range res.RemoveHeaders {
+		d.Msg.Headers.Del(email.CanonicalKey([]byte(key)))
+	}
+	for _, h := range res.AddHeaders {
+		d.Msg.Headers.Add(email.CanonicalKey([]byte(h.Key)), []byte(h.Value))
+	}
+	for _, flag := range res.Flags {
+		if !hasFlag(d.Flags, flag) {
+			d.Flags = append(d.Flags, flag)
+		}
+	}
+	if res.Mailbox != "" {
+		d.Mailbox = res.Mailbox
+	}
+	return nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+// Package dkimkeys manages the keys outgoing mail is DKIM signed with.
+//
+// Keys are kept in the DKIMRecords table of the spilld database,
+// one for each domain and selector. A key is published in DNS by
+// dnsdb from when it is generated until it is retired, and signs
+// mail from its ActiveFrom time until a newer key becomes active.
+//
+// Rotation generates a key that becomes active after an overlap,
+// giving its DNS record time to reach resolvers, and retires the
+// key it replaces one overlap after that, so mail signed with the
+// old key can still be verified while it is in flight.
+//
+// Private keys are sealed with the server master key when one is
+// given, as user blob keys are, see db.UserBlobKey.
+package dkimkeys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email/dkim"
+)
+
+// KeyBits is the size of generated RSA keys.
+const KeyBits = 2048
+
+// Key is a DKIM key of a domain.
+type Key struct {
+	Domain     string
+	Selector   string
+	Algorithm  string // "rsa"
+	PublicKey  string // base64, the p= field of the TXT record
+	Created    time.Time
+	ActiveFrom time.Time // zero if the key is published but never signs
+	Retire     time.Time // when publishing stops, zero if never
+	Sealed     bool      // private key sealed with the master key
+}
+
+// Name is the DNS name the TXT record of k is published at.
+func (k Key) Name() string {
+	return k.Selector + "._domainkey." + k.Domain
+}
+
+// TXT is the TXT record value published for k.
+func (k Key) TXT() string {
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", k.Algorithm, k.PublicKey)
+}
+
+// Generate creates a key for domain that signs mail from
+// activeFrom. If selector is empty, the next unused "siN" is
+// chosen. If masterKey is set, the private key is sealed with it.
+func Generate(conn *sqlite.Conn, domain, selector string, activeFrom time.Time, masterKey []byte) (k Key, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	domain = strings.ToLower(domain)
+	if selector == "" {
+		if selector, err = nextSelector(conn, domain); err != nil {
+			return Key{}, fmt.Errorf("dkimkeys.Generate: %v", err)
+		}
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return Key{}, fmt.Errorf("dkimkeys.Generate: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return Key{}, fmt.Errorf("dkimkeys.Generate: %v", err)
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	})
+
+	k = Key{
+		Domain:     domain,
+		Selector:   selector,
+		Algorithm:  "rsa",
+		PublicKey:  base64.StdEncoding.EncodeToString(pub),
+		Created:    time.Now(),
+		ActiveFrom: activeFrom,
+		Sealed:     len(masterKey) > 0,
+	}
+	privText := string(privPEM)
+	if k.Sealed {
+		if privText, err = seal(masterKey, k, privPEM); err != nil {
+			return Key{}, fmt.Errorf("dkimkeys.Generate: %v", err)
+		}
+	}
+
+	stmt := conn.Prep(`INSERT INTO DKIMRecords (DomainName, Selector, Algorithm,
+			PublicKey, PrivateKey, Sealed, Created, ActiveFrom)
+		VALUES ($domain, $selector, $algorithm,
+			$publicKey, $privateKey, $sealed, $created, $activeFrom);`)
+	stmt.SetText("$domain", k.Domain)
+	stmt.SetText("$selector", k.Selector)
+	stmt.SetText("$algorithm", k.Algorithm)
+	stmt.SetText("$publicKey", k.PublicKey)
+	stmt.SetText("$privateKey", privText)
+	stmt.SetBool("$sealed", k.Sealed)
+	stmt.SetInt64("$created", k.Created.Unix())
+	stmt.SetInt64("$activeFrom", activeFrom.Unix())
+	if _, err := stmt.Step(); err != nil {
+		return Key{}, fmt.Errorf("dkimkeys.Generate: %s: %v", k.Name(), err)
+	}
+	return k, nil
+}
+
+// nextSelector picks the selector "siN" after the highest
+// a domain has used.
+func nextSelector(conn *sqlite.Conn, domain string) (string, error) {
+	stmt := conn.Prep("SELECT Selector FROM DKIMRecords WHERE DomainName = $domain;")
+	stmt.SetText("$domain", domain)
+	max := 0
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return "", err
+		} else if !hasNext {
+			break
+		}
+		sel := stmt.GetText("Selector")
+		if n, err := strconv.Atoi(strings.TrimPrefix(sel, "si")); err == nil && strings.HasPrefix(sel, "si") && n > max {
+			max = n
+		}
+	}
+	return "si" + strconv.Itoa(max+1), nil
+}
+
+// Keys lists the keys of domain, or of every domain if it is "",
+// oldest first.
+func Keys(conn *sqlite.Conn, domain string) (keys []Key, err error) {
+	stmt := conn.Prep(`SELECT DomainName, Selector, Algorithm, PublicKey, Sealed,
+			Created, ifnull(ActiveFrom, -1) AS ActiveFrom, Retire
+		FROM DKIMRecords
+		WHERE $domain = '' OR DomainName = $domain
+		ORDER BY DomainName, ActiveFrom = -1, ActiveFrom, Selector;`)
+	stmt.SetText("$domain", strings.ToLower(domain))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("dkimkeys.Keys: %v", err)
+		} else if !hasNext {
+			break
+		}
+		k := Key{
+			Domain:    stmt.GetText("DomainName"),
+			Selector:  stmt.GetText("Selector"),
+			Algorithm: stmt.GetText("Algorithm"),
+			PublicKey: stmt.GetText("PublicKey"),
+			Sealed:    stmt.GetInt64("Sealed") != 0,
+		}
+		if t := stmt.GetInt64("Created"); t != 0 {
+			k.Created = time.Unix(t, 0)
+		}
+		if t := stmt.GetInt64("ActiveFrom"); t != -1 {
+			k.ActiveFrom = time.Unix(t, 0)
+		}
+		if t := stmt.GetInt64("Retire"); t != 0 {
+			k.Retire = time.Unix(t, 0)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Signer returns a signer for the mail of domain sent at now, using
+// the key that most recently became active. It returns nil if the
+// domain has no active key.
+func Signer(conn *sqlite.Conn, domain string, now time.Time, masterKey []byte) (*dkim.Signer, error) {
+	domain = strings.ToLower(domain)
+	stmt := conn.Prep(`SELECT Selector, PrivateKey, Sealed FROM DKIMRecords
+		WHERE DomainName = $domain AND ActiveFrom <= $now
+		AND (Retire IS NULL OR Retire > $now)
+		ORDER BY ActiveFrom DESC, Selector DESC LIMIT 1;`)
+	stmt.SetText("$domain", domain)
+	stmt.SetInt64("$now", now.Unix())
+	if hasNext, err := stmt.Step(); err != nil {
+		return nil, fmt.Errorf("dkimkeys.Signer: %v", err)
+	} else if !hasNext {
+		return nil, nil
+	}
+	k := Key{
+		Domain:   domain,
+		Selector: stmt.GetText("Selector"),
+		Sealed:   stmt.GetInt64("Sealed") != 0,
+	}
+	privKey := []byte(stmt.GetText("PrivateKey"))
+	stmt.Reset()
+
+	if k.Sealed {
+		var err error
+		if privKey, err = open(masterKey, k, string(privKey)); err != nil {
+			return nil, fmt.Errorf("dkimkeys.Signer: %s: %v", k.Name(), err)
+		}
+	}
+	signer, err := dkim.NewSigner(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("dkimkeys.Signer: %s: %v", k.Name(), err)
+	}
+	signer.Domain = domain
+	signer.Selector = k.Selector
+	return signer, nil
+}
+
+// Rotate generates a key for domain that becomes active at
+// now+overlap, and retires the keys it replaces one overlap after.
+func Rotate(conn *sqlite.Conn, domain string, now time.Time, overlap time.Duration, masterKey []byte) (k Key, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	activeFrom := now.Add(overlap)
+	k, err = Generate(conn, domain, "", activeFrom, masterKey)
+	if err != nil {
+		return Key{}, err
+	}
+	stmt := conn.Prep(`UPDATE DKIMRecords SET Retire = $retire
+		WHERE DomainName = $domain AND Selector <> $selector
+		AND (Retire IS NULL OR Retire > $retire);`)
+	stmt.SetText("$domain", k.Domain)
+	stmt.SetText("$selector", k.Selector)
+	stmt.SetInt64("$retire", activeFrom.Add(overlap).Unix())
+	if _, err := stmt.Step(); err != nil {
+		return Key{}, fmt.Errorf("dkimkeys.Rotate: %v", err)
+	}
+	return k, nil
+}
+
+// Remove deletes a key. Mail it signed can no longer be verified.
+func Remove(conn *sqlite.Conn, domain, selector string) error {
+	stmt := conn.Prep("DELETE FROM DKIMRecords WHERE DomainName = $domain AND Selector = $selector;")
+	stmt.SetText("$domain", strings.ToLower(domain))
+	stmt.SetText("$selector", selector)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("dkimkeys.Remove: %v", err)
+	}
+	if conn.Changes() == 0 {
+		return fmt.Errorf("dkimkeys.Remove: no key %s._domainkey.%s", selector, domain)
+	}
+	return nil
+}
+
+// seal encrypts a private key with masterKey, bound to the
+// domain and selector it is stored under.
+func seal(masterKey []byte, k Key, privKey []byte) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, privKey, []byte(k.Name()))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open(masterKey []byte, k Key, sealed string) ([]byte, error) {
+	if len(masterKey) == 0 {
+		return nil, errors.New("key is sealed and there is no master key")
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("short sealed key")
+	}
+	nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+	privKey, err := aead.Open(nil, nonce, ciphertext, []byte(k.Name()))
+	if err != nil {
+		return nil, fmt.Errorf("wrong master key: %v", err)
+	}
+	return privKey, nil
+}
+
+func newAEAD(masterKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("master key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,105 @@
+package dkimkeys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"spilled.ink/spilldb/db"
+)
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkimkeys-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+
+	masterKey := []byte(strings.Repeat("k", 32))
+	start := time.Now()
+
+	k1, err := Generate(conn, "Example.com", "", start, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.Selector != "si1" || k1.Domain != "example.com" {
+		t.Errorf("first key %s, want si1._domainkey.example.com", k1.Name())
+	}
+	if !strings.HasPrefix(k1.TXT(), "v=DKIM1; k=rsa; p=") {
+		t.Errorf("TXT=%q", k1.TXT())
+	}
+
+	signer, err := Signer(conn, "example.com", start, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer == nil || signer.Selector != "si1" {
+		t.Fatalf("signer=%+v, want si1", signer)
+	}
+	if _, err := Signer(conn, "example.com", start, []byte(strings.Repeat("o", 32))); err == nil {
+		t.Error("key opened with the wrong master key")
+	}
+	if signer, err := Signer(conn, "example.org", start, masterKey); err != nil || signer != nil {
+		t.Errorf("example.org signer=%v, %v, want none", signer, err)
+	}
+
+	keys, err := Keys(conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	every := 30 * 24 * time.Hour
+	if due := rotationDue(keys, start, every); len(due) != 0 {
+		t.Errorf("new key due for rotation: %v", due)
+	}
+	now := start.Add(every)
+	if due := rotationDue(keys, now, every); len(due) != 1 || due[0] != "example.com" {
+		t.Fatalf("rotation due %v, want example.com", due)
+	}
+
+	overlap := 72 * time.Hour
+	k2, err := Rotate(conn, "example.com", now, overlap, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k2.Selector != "si2" {
+		t.Errorf("rotated selector %q, want si2", k2.Selector)
+	}
+	keys, err = Keys(conn, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due := rotationDue(keys, now, every); len(due) != 0 {
+		t.Errorf("rotation due %v with a key pending", due)
+	}
+
+	for _, tt := range []struct {
+		at   time.Time
+		want string
+	}{
+		{now, "si1"},
+		{now.Add(overlap), "si2"},
+		{now.Add(2 * overlap), "si2"},
+	} {
+		signer, err := Signer(conn, "example.com", tt.at, masterKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer == nil || signer.Selector != tt.want {
+			t.Errorf("signer at %v: %+v, want %s", tt.at.Sub(now), signer, tt.want)
+		}
+	}
+	if len(keys) != 2 || keys[0].Retire.Unix() != now.Add(2*overlap).Unix() || !keys[1].Retire.IsZero() {
+		t.Errorf("keys after rotation: %+v", keys)
+	}
+}
@@ -0,0 +1,154 @@
+package dkimkeys
+
+import (
+	"context"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/spilldb/db"
+)
+
+// DefaultOverlap is the Rotator overlap when none is set.
+const DefaultOverlap = 72 * time.Hour
+
+// Rotator periodically rotates the DKIM keys of every domain and
+// removes the keys that have been retired.
+type Rotator struct {
+	Logf func(format string, v ...interface{})
+
+	// Every is how long a key signs mail before it is replaced.
+	// Zero disables rotation.
+	Every time.Duration
+
+	// Overlap is how long a new key is published before it
+	// becomes active, and the key it replaces is published
+	// after. Zero means DefaultOverlap.
+	Overlap time.Duration
+
+	// MasterKey, if set, seals the keys generated.
+	MasterKey []byte
+
+	ctx      context.Context
+	cancelFn func()
+	done     chan struct{}
+
+	pool *sqlitex.Pool
+}
+
+func NewRotator(pool *sqlitex.Pool) *Rotator {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	r := &Rotator{
+		Logf:     func(format string, v ...interface{}) {},
+		ctx:      ctx,
+		cancelFn: cancelFn,
+		done:     make(chan struct{}),
+		pool:     pool,
+	}
+	return r
+}
+
+func (r *Rotator) Run() error {
+	defer func() { close(r.done) }()
+
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+	for {
+		if err := r.rotate(time.Now()); err != nil {
+			if err == context.Canceled {
+				return nil
+			}
+			r.Logf("%s", db.Log{
+				What:  "rotate",
+				Where: "dkimkeys",
+				When:  time.Now(),
+				Err:   err,
+			})
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (r *Rotator) Shutdown(ctx context.Context) error {
+	r.cancelFn()
+	<-r.done
+	return nil
+}
+
+func (r *Rotator) rotate(now time.Time) error {
+	conn := r.pool.Get(r.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer r.pool.Put(conn)
+
+	keys, err := Keys(conn, "")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !k.Retire.IsZero() && !k.Retire.After(now) {
+			if err := Remove(conn, k.Domain, k.Selector); err != nil {
+				return err
+			}
+			r.Logf("dkimkeys: removed retired key %s", k.Name())
+		}
+	}
+	if r.Every <= 0 {
+		return nil
+	}
+	overlap := r.Overlap
+	if overlap <= 0 {
+		overlap = DefaultOverlap
+	}
+	for _, domain := range rotationDue(keys, now, r.Every) {
+		k, err := Rotate(conn, domain, now, overlap, r.MasterKey)
+		if err != nil {
+			return err
+		}
+		r.Logf("dkimkeys: rotating %s, publish %s TXT %q, active from %s",
+			domain, k.Name(), k.TXT(), k.ActiveFrom.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// rotationDue reports the domains whose signing key has been
+// active for every, and that have no key waiting to replace it.
+func rotationDue(keys []Key, now time.Time, every time.Duration) (domains []string) {
+	type state struct {
+		active  time.Time // ActiveFrom of the signing key
+		pending bool
+	}
+	states := make(map[string]*state)
+	var order []string
+	for _, k := range keys {
+		if k.ActiveFrom.IsZero() || (!k.Retire.IsZero() && !k.Retire.After(now)) {
+			continue
+		}
+		st := states[k.Domain]
+		if st == nil {
+			st = new(state)
+			states[k.Domain] = st
+			order = append(order, k.Domain)
+		}
+		if k.ActiveFrom.After(now) {
+			st.pending = true
+		} else if k.ActiveFrom.After(st.active) {
+			st.active = k.ActiveFrom
+		}
+	}
+	for _, domain := range order {
+		st := states[domain]
+		if st.pending || st.active.IsZero() {
+			continue
+		}
+		if !st.active.Add(every).After(now) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
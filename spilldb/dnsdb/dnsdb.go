@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"regexp"
+	"time"
 
 	"crawshaw.io/sqlite/sqlitex"
 	"spilled.ink/third_party/dns"
@@ -38,13 +39,17 @@ func (s *DNS) lookup(ctx context.Context, queries []query) (result []string, err
 	}
 	defer s.DB.Put(conn)
 
+	// Keys are published until they are retired, see package dkimkeys.
 	stmt := conn.Prep(`SELECT Algorithm, PublicKey FROM DKIMRecords
-		WHERE DomainName = $domain AND Selector = $selector;`)
+		WHERE DomainName = $domain AND Selector = $selector
+		AND (Retire IS NULL OR Retire > $now);`)
 
+	now := time.Now().Unix()
 	for _, q := range queries {
 		stmt.Reset()
 		stmt.SetText("$domain", q.domain)
 		stmt.SetText("$selector", q.selector)
+		stmt.SetInt64("$now", now)
 		if has, err := stmt.Step(); err != nil {
 			return nil, fmt.Errorf("dnsdb: %s._domainkey.%s: %v", q.selector, q.domain, err)
 		} else if !has {
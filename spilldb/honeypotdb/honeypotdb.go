@@ -111,10 +111,10 @@ func (h *Honeypot) Auth(identity, user, pass []byte, remoteAddr string) uint64 {
 	return token
 }
 
-func (h *Honeypot) NewMessage(remoteAddr net.Addr, from []byte, token uint64) (smtpserver.Msg, error) {
+func (h *Honeypot) NewMessage(remoteAddr net.Addr, from []byte, params smtpserver.MailParams, token uint64) (smtpserver.Msg, error) {
 	if token == 0 {
 		// This is a real message.
-		return h.wrappedNewMsgFn(remoteAddr, from, 0)
+		return h.wrappedNewMsgFn(remoteAddr, from, params, 0)
 	}
 
 	h.mu.Lock()
@@ -142,7 +142,7 @@ type msg struct {
 	from       string
 }
 
-func (m *msg) AddRecipient(addr []byte) (bool, error) {
+func (m *msg) AddRecipient(addr []byte, params smtpserver.RcptParams) (bool, error) {
 	// Pretend to be an open relay.
 	m.rcpts = append(m.rcpts, string(addr))
 	time.Sleep(time.Second / 2) // malicious client delay
@@ -0,0 +1,438 @@
+package imapdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/imap"
+	"spilled.ink/imap/imapparser"
+)
+
+// Mailboxes shared by other users appear under otherUsersRoot,
+// named "Other Users/<owner address>/<mailbox name>".
+const (
+	otherUsersRoot   = "Other Users"
+	otherUsersPrefix = otherUsersRoot + "/"
+)
+
+func isOtherUsersName(name string) bool {
+	return strings.HasPrefix(name, otherUsersPrefix)
+}
+
+// sharedMailbox opens a mailbox of another user.
+//
+// Mailboxes the session user has no rights on are reported
+// as not found, so their existence is not revealed.
+func (s *session) sharedMailbox(name string) (*mailbox, error) {
+	notFound := fmt.Errorf("mailbox not found: %s", name)
+
+	owner := strings.TrimPrefix(name, otherUsersPrefix)
+	i := strings.IndexByte(owner, '/')
+	if i <= 0 {
+		return nil, notFound
+	}
+	owner, boxName := owner[:i], owner[i+1:]
+
+	ctx := s.c.Context
+	conn := s.dbpool.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+
+	ownerID, err := addressUserID(conn, owner)
+	if err != nil {
+		return nil, err
+	}
+	if ownerID == 0 {
+		return nil, notFound
+	}
+	if ownerID == s.userID {
+		m, err := s.Mailbox([]byte(boxName))
+		if err != nil {
+			return nil, err
+		}
+		return m.(*mailbox), nil
+	}
+
+	user, err := s.boxmgmt.Open(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	boxConn, put := getRO(ctx, user.Box)
+	if boxConn == nil {
+		return nil, context.Canceled
+	}
+	defer put()
+
+	stmt := boxConn.Prep("SELECT MailboxID, Subscribed FROM Mailboxes WHERE Name = $name;")
+	stmt.SetText("$name", boxName)
+	if hasNext, err := stmt.Step(); err != nil {
+		return nil, err
+	} else if !hasNext {
+		return nil, notFound
+	}
+	m := &mailbox{
+		s:          s,
+		user:       user,
+		ownerID:    ownerID,
+		mailboxID:  stmt.GetInt64("MailboxID"),
+		name:       boxName,
+		subscribed: stmt.GetInt64("Subscribed") != 0,
+	}
+	stmt.Reset()
+
+	m.rights, err = s.rightsOn(conn, ownerID, m.mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	if m.rights == imap.RightsNone {
+		return nil, notFound
+	}
+	return m, nil
+}
+
+// sharedMailboxes lists the mailboxes of other users
+// that the session user has the lookup right on.
+func (s *session) sharedMailboxes() (mailboxes []imap.MailboxSummary, err error) {
+	ctx := s.c.Context
+	conn := s.dbpool.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+
+	type shared struct{ ownerID, mailboxID int64 }
+	var found []shared
+	seen := make(map[shared]bool)
+	stmt := conn.Prep(`SELECT UserID, MailboxID, Rights FROM MailboxACLs
+		WHERE UserID <> $userID AND (Identifier = $anyone
+		OR Identifier IN (SELECT Address FROM UserAddresses WHERE UserID = $userID))
+		ORDER BY UserID, MailboxID;`)
+	stmt.SetInt64("$userID", s.userID)
+	stmt.SetText("$anyone", imap.ACLIdentifierAnyone)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		rights, err := imap.ParseRights(stmt.GetText("Rights"))
+		if err != nil {
+			stmt.Reset()
+			return nil, err
+		}
+		sh := shared{stmt.GetInt64("UserID"), stmt.GetInt64("MailboxID")}
+		if rights&imap.RightLookup != 0 && !seen[sh] {
+			seen[sh] = true
+			found = append(found, sh)
+		}
+	}
+
+	owners := make(map[int64]string)
+	for _, sh := range found {
+		owner, ok := owners[sh.ownerID]
+		if !ok {
+			if owner, err = primaryAddress(conn, sh.ownerID); err != nil {
+				return nil, err
+			}
+			owners[sh.ownerID] = owner
+			if owner != "" {
+				mailboxes = append(mailboxes, imap.MailboxSummary{
+					Name:  otherUsersPrefix + owner,
+					Attrs: imap.AttrNoselect,
+				})
+			}
+		}
+		if owner == "" {
+			continue
+		}
+		name, err := s.mailboxName(sh.ownerID, sh.mailboxID)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue // deleted
+		}
+		mailboxes = append(mailboxes, imap.MailboxSummary{
+			Name: otherUsersPrefix + owner + "/" + name,
+		})
+	}
+	if len(mailboxes) == 0 {
+		return nil, nil
+	}
+	mailboxes = append(mailboxes, imap.MailboxSummary{
+		Name:  otherUsersRoot,
+		Attrs: imap.AttrNoselect,
+	})
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].Name < mailboxes[j].Name })
+	return mailboxes, nil
+}
+
+func (s *session) mailboxName(ownerID, mailboxID int64) (string, error) {
+	ctx := s.c.Context
+	user, err := s.boxmgmt.Open(ctx, ownerID)
+	if err != nil {
+		return "", err
+	}
+	conn, put := getRO(ctx, user.Box)
+	if conn == nil {
+		return "", context.Canceled
+	}
+	defer put()
+
+	stmt := conn.Prep("SELECT Name FROM Mailboxes WHERE MailboxID = $mailboxID AND Name IS NOT NULL;")
+	stmt.SetInt64("$mailboxID", mailboxID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", err
+	} else if !hasNext {
+		return "", nil
+	}
+	name := stmt.GetText("Name")
+	stmt.Reset()
+	return name, nil
+}
+
+// rightsOn reports the rights of the session user on a mailbox
+// of ownerID, combining the entries for all of its addresses
+// and the "anyone" entry.
+func (s *session) rightsOn(conn *sqlite.Conn, ownerID, mailboxID int64) (rights imap.Rights, err error) {
+	if ownerID == s.userID {
+		return imap.RightsAll, nil
+	}
+	stmt := conn.Prep(`SELECT Rights FROM MailboxACLs
+		WHERE UserID = $ownerID AND MailboxID = $mailboxID
+		AND (Identifier = $anyone
+		OR Identifier IN (SELECT Address FROM UserAddresses WHERE UserID = $userID));`)
+	stmt.SetInt64("$ownerID", ownerID)
+	stmt.SetInt64("$mailboxID", mailboxID)
+	stmt.SetText("$anyone", imap.ACLIdentifierAnyone)
+	stmt.SetInt64("$userID", s.userID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, err
+		} else if !hasNext {
+			break
+		}
+		r, err := imap.ParseRights(stmt.GetText("Rights"))
+		if err != nil {
+			stmt.Reset()
+			return 0, err
+		}
+		rights |= r
+	}
+	return rights, nil
+}
+
+// need reports an error if the session user lacks a right on m.
+func (m *mailbox) need(rights imap.Rights) error {
+	if missing := rights &^ m.rights; missing != 0 {
+		return fmt.Errorf("permission denied, missing rights %q", missing.String())
+	}
+	return nil
+}
+
+// ownerIdentifier is the identifier listed with every right
+// on a mailbox of ownerID.
+func (s *session) ownerIdentifier(conn *sqlite.Conn, ownerID int64) (string, error) {
+	if ownerID == s.userID {
+		return s.name, nil
+	}
+	return primaryAddress(conn, ownerID)
+}
+
+func (s *session) GetACL(name []byte) (acl []imap.ACLEntry, err error) {
+	m, err := s.adminMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := s.c.Context
+	conn := s.dbpool.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+
+	owner, err := s.ownerIdentifier(conn, m.ownerID)
+	if err != nil {
+		return nil, err
+	}
+	acl = append(acl, imap.ACLEntry{Identifier: owner, Rights: imap.RightsAll})
+
+	stmt := conn.Prep(`SELECT Identifier, Rights FROM MailboxACLs
+		WHERE UserID = $ownerID AND MailboxID = $mailboxID
+		ORDER BY Identifier;`)
+	stmt.SetInt64("$ownerID", m.ownerID)
+	stmt.SetInt64("$mailboxID", m.mailboxID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		rights, err := imap.ParseRights(stmt.GetText("Rights"))
+		if err != nil {
+			stmt.Reset()
+			return nil, err
+		}
+		acl = append(acl, imap.ACLEntry{
+			Identifier: stmt.GetText("Identifier"),
+			Rights:     rights,
+		})
+	}
+	return acl, nil
+}
+
+func (s *session) SetACL(name []byte, identifier string, mode imapparser.StoreMode, rights imap.Rights) (err error) {
+	m, err := s.adminMailbox(name)
+	if err != nil {
+		return err
+	}
+	identifier = strings.ToLower(identifier)
+
+	ctx := s.c.Context
+	conn := s.dbpool.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	if userID, err := addressUserID(conn, identifier); err != nil {
+		return err
+	} else if userID == m.ownerID {
+		return fmt.Errorf("cannot change the rights of the mailbox owner")
+	}
+
+	var cur imap.Rights
+	stmt := conn.Prep(`SELECT Rights FROM MailboxACLs
+		WHERE UserID = $ownerID AND MailboxID = $mailboxID AND Identifier = $identifier;`)
+	stmt.SetInt64("$ownerID", m.ownerID)
+	stmt.SetInt64("$mailboxID", m.mailboxID)
+	stmt.SetText("$identifier", identifier)
+	if hasNext, err := stmt.Step(); err != nil {
+		return err
+	} else if hasNext {
+		cur, err = imap.ParseRights(stmt.GetText("Rights"))
+		stmt.Reset()
+		if err != nil {
+			return err
+		}
+	}
+	switch mode {
+	case imapparser.StoreAdd:
+		rights |= cur
+	case imapparser.StoreRemove:
+		rights = cur &^ rights
+	}
+
+	if rights == imap.RightsNone {
+		stmt = conn.Prep(`DELETE FROM MailboxACLs
+			WHERE UserID = $ownerID AND MailboxID = $mailboxID AND Identifier = $identifier;`)
+	} else {
+		stmt = conn.Prep(`INSERT OR REPLACE INTO MailboxACLs (UserID, MailboxID, Identifier, Rights)
+			VALUES ($ownerID, $mailboxID, $identifier, $rights);`)
+		stmt.SetText("$rights", rights.String())
+	}
+	stmt.SetInt64("$ownerID", m.ownerID)
+	stmt.SetInt64("$mailboxID", m.mailboxID)
+	stmt.SetText("$identifier", identifier)
+	_, err = stmt.Step()
+	return err
+}
+
+func (s *session) DeleteACL(name []byte, identifier string) error {
+	return s.SetACL(name, identifier, imapparser.StoreReplace, imap.RightsNone)
+}
+
+func (s *session) ListRights(name []byte, identifier string) (required, grantable imap.Rights, err error) {
+	m, err := s.adminMailbox(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx := s.c.Context
+	conn := s.dbpool.Get(ctx)
+	if conn == nil {
+		return 0, 0, context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+
+	userID, err := addressUserID(conn, strings.ToLower(identifier))
+	if err != nil {
+		return 0, 0, err
+	}
+	if userID == m.ownerID {
+		return imap.RightsAll, imap.RightsNone, nil
+	}
+	return imap.RightsNone, imap.RightsAll, nil
+}
+
+func (s *session) MyRights(name []byte) (imap.Rights, error) {
+	mbox, err := s.Mailbox(name)
+	if err != nil {
+		return 0, err
+	}
+	return mbox.(*mailbox).rights, nil
+}
+
+// adminMailbox opens a mailbox whose ACL the session user may administer.
+func (s *session) adminMailbox(name []byte) (*mailbox, error) {
+	mbox, err := s.Mailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	m := mbox.(*mailbox)
+	if err := m.need(imap.RightAdmin); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// deleteACL removes the ACL of a deleted mailbox.
+func (s *session) deleteACL(m *mailbox) error {
+	ctx := s.c.Context
+	conn := s.dbpool.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+
+	stmt := conn.Prep("DELETE FROM MailboxACLs WHERE UserID = $ownerID AND MailboxID = $mailboxID;")
+	stmt.SetInt64("$ownerID", m.ownerID)
+	stmt.SetInt64("$mailboxID", m.mailboxID)
+	_, err := stmt.Step()
+	return err
+}
+
+// addressUserID reports the user with an address, or 0.
+func addressUserID(conn *sqlite.Conn, addr string) (userID int64, err error) {
+	stmt := conn.Prep("SELECT UserID FROM UserAddresses WHERE Address = $addr;")
+	stmt.SetText("$addr", strings.ToLower(addr))
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, err
+	} else if hasNext {
+		userID = stmt.GetInt64("UserID")
+		stmt.Reset()
+	}
+	return userID, nil
+}
+
+// primaryAddress reports the primary address of a user, or "".
+func primaryAddress(conn *sqlite.Conn, userID int64) (addr string, err error) {
+	stmt := conn.Prep(`SELECT Address FROM UserAddresses WHERE UserID = $userID
+		ORDER BY ifnull(PrimaryAddr, 0) DESC, Address LIMIT 1;`)
+	stmt.SetInt64("$userID", userID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", err
+	} else if hasNext {
+		addr = stmt.GetText("Address")
+		stmt.Reset()
+	}
+	return addr, nil
+}
@@ -2,17 +2,14 @@
 package imapdb
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
-	"os"
-	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,11 +19,14 @@ import (
 	"spilled.ink/email"
 	"spilled.ink/email/msgcleaver"
 	"spilled.ink/imap"
+	"spilled.ink/imap/imapformat"
 	"spilled.ink/imap/imapparser"
 	"spilled.ink/imap/imapserver"
 	"spilled.ink/spilldb/boxmgmt"
 	"spilled.ink/spilldb/db"
 	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/third_party/imf"
+	"spilled.ink/util/otlptrace"
 )
 
 func NewBackend(dbpool *sqlitex.Pool, filer *iox.Filer, boxmgmt *boxmgmt.BoxMgmt, logf func(format string, v ...interface{})) imapserver.DataStore {
@@ -43,30 +43,15 @@ func NewBackend(dbpool *sqlitex.Pool, filer *iox.Filer, boxmgmt *boxmgmt.BoxMgmt
 	}
 }
 
-func New(tlsConfig *tls.Config, dbpool *sqlitex.Pool, filer *iox.Filer, boxmgmt *boxmgmt.BoxMgmt, logf func(format string, v ...interface{})) *imapserver.Server {
-	debugDir := "/tmp/smsmtpd_imap_debug"
-	os.MkdirAll(debugDir, 0700)
-	debugFn := func(sessionID string) io.WriteCloser {
-		name := filepath.Join(debugDir, "imap-"+sessionID+".txt")
-		f, err := os.Create(name)
-		if err != nil {
-			logf("%s", db.Log{
-				What:  "imapdb",
-				Where: "debug-file-create",
-				When:  time.Now(),
-				Err:   err,
-			}.String())
-			return nil
-		}
-		return f
-	}
+func New(tlsConfig *tls.Config, dbpool *sqlitex.Pool, filer *iox.Filer, boxmgmt *boxmgmt.BoxMgmt, lockout *db.Lockout, logf func(format string, v ...interface{})) *imapserver.Server {
+	backend := NewBackend(dbpool, filer, boxmgmt, logf).(*backend)
+	backend.auth.Lockout = lockout
 
 	s := &imapserver.Server{
-		DataStore: NewBackend(dbpool, filer, boxmgmt, logf),
+		DataStore: backend,
 		Filer:     filer,
 		Logf:      logf,
 		TLSConfig: tlsConfig,
-		Debug:     debugFn,
 	}
 
 	return s
@@ -86,7 +71,7 @@ func (b *backend) Login(c *imapserver.Conn, username, password []byte) (int64, i
 	if addr := c.RemoteAddr(); addr != nil {
 		remoteAddr = addr.String()
 	}
-	userID, err := b.auth.AuthDevice(ctx, remoteAddr, string(username), password)
+	userID, deviceID, err := b.auth.AuthDeviceID(ctx, remoteAddr, string(username), password)
 	if err == db.ErrBadCredentials {
 		return 0, nil, imapserver.ErrBadCredentials
 	} else if err != nil {
@@ -99,42 +84,74 @@ func (b *backend) Login(c *imapserver.Conn, username, password []byte) (int64, i
 	}
 
 	s := &session{
-		c:         c,
-		userID:    userID,
-		name:      string(username),
-		user:      user,
-		filer:     b.filer,
-		logf:      b.logf,
-		mailboxes: make(map[int64]*mailbox),
+		c:          c,
+		dbpool:     b.dbpool,
+		boxmgmt:    b.boxmgmt,
+		userID:     userID,
+		deviceID:   deviceID,
+		remoteAddr: remoteAddr,
+		name:       string(username),
+		user:       user,
+		filer:      b.filer,
+		logf:       b.logf,
+		mailboxes:  make(map[int64]*mailbox),
 	}
 
 	return userID, s, nil
 }
 
+func (b *backend) Namespaces() imap.Namespaces {
+	return imap.Namespaces{
+		Delimiter: spillbox.Delimiter,
+		Personal:  []string{""},
+		Other:     []string{otherUsersPrefix},
+	}
+}
+
 func (b *backend) RegisterNotifier(n imap.Notifier) {
 	b.boxmgmt.RegisterNotifier(n)
 }
 
 type session struct {
-	c      *imapserver.Conn
-	userID int64
-	name   string
-	user   *boxmgmt.User
-	filer  *iox.Filer
-	logf   func(format string, v ...interface{})
+	c       *imapserver.Conn
+	dbpool  *sqlitex.Pool
+	boxmgmt *boxmgmt.BoxMgmt
+	userID  int64
+	name    string
+	user    *boxmgmt.User
+	filer   *iox.Filer
+	logf    func(format string, v ...interface{})
+
+	deviceID   int64  // device password the session logged in with
+	remoteAddr string // of the client
 
 	mu        sync.Mutex
 	mailboxes map[int64]*mailbox
 }
 
+// RecordClientID implements imap.ClientIDRecorder.
+func (s *session) RecordClientID(params map[string]string) error {
+	conn := s.dbpool.Get(s.c.Context)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer s.dbpool.Put(conn)
+
+	client := db.ParseClientID(params)
+	client.DeviceID = s.deviceID
+	client.LastSeen = time.Now()
+	client.LastAddr = s.remoteAddr
+	return db.RecordDeviceClient(conn, client)
+}
+
 func (s *session) Mailboxes() (mailboxes []imap.MailboxSummary, err error) {
 	// TODO: subscribed
 	ctx := s.c.Context
-	conn := s.user.Box.PoolRO.Get(ctx)
+	conn, put := getRO(ctx, s.user.Box)
 	if conn == nil {
 		return nil, context.Canceled
 	}
-	defer s.user.Box.PoolRO.Put(conn)
+	defer put()
 
 	stmt := conn.Prep(`SELECT MailboxID, Name, Attrs, Subscribed
 		FROM Mailboxes WHERE Name IS NOT NULL ORDER BY Name;`)
@@ -159,24 +176,57 @@ func (s *session) Mailboxes() (mailboxes []imap.MailboxSummary, err error) {
 		}
 		return ni < nj
 	})
-	return mailboxes, nil
+
+	labels, err := spillbox.Labels(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		mailboxes = append(mailboxes, imap.MailboxSummary{
+			Name:  spillbox.LabelMailboxPrefix + label.Label,
+			Attrs: imap.AttrNoinferiors,
+		})
+	}
+
+	shared, err := s.sharedMailboxes()
+	if err != nil {
+		return nil, err
+	}
+	return append(mailboxes, shared...), nil
 }
 
 func (s *session) Mailbox(name []byte) (imap.Mailbox, error) {
+	return s.mailbox(name, false)
+}
+
+// mailbox finds the named mailbox. A \Noselect name, which only
+// holds a place in the hierarchy, is found if noselect is set.
+func (s *session) mailbox(name []byte, noselect bool) (imap.Mailbox, error) {
+	if isOtherUsersName(string(name)) {
+		return s.sharedMailbox(string(name))
+	}
+	if strings.HasPrefix(string(name), spillbox.LabelMailboxPrefix) {
+		return s.labelMailbox(string(name))
+	}
+
 	ctx := s.c.Context
-	conn := s.user.Box.PoolRO.Get(ctx)
+	conn, put := getRO(ctx, s.user.Box)
 	if conn == nil {
 		return nil, context.Canceled
 	}
-	defer s.user.Box.PoolRO.Put(conn)
+	defer put()
 
-	stmt := conn.Prep("SELECT MailboxID, Name, Subscribed FROM Mailboxes WHERE Name = $name;")
+	stmt := conn.Prep("SELECT MailboxID, Name, Subscribed, ifnull(Attrs, 0) AS Attrs FROM Mailboxes WHERE Name = $name;")
 	stmt.SetBytes("$name", name)
 	if hasNext, err := stmt.Step(); err != nil {
 		return nil, err
 	} else if !hasNext {
 		return nil, fmt.Errorf("mailbox not found: %s", name)
 	}
+	if !noselect && imap.ListAttrFlag(stmt.GetInt64("Attrs"))&imap.AttrNoselect != 0 {
+		stmt.Reset()
+		return nil, fmt.Errorf("mailbox cannot be selected: %s", name)
+	}
 	b := s.getMailbox(stmt)
 	stmt.Reset()
 
@@ -191,6 +241,9 @@ func (s *session) getMailbox(stmt *sqlite.Stmt) *mailbox {
 	if m == nil {
 		m = &mailbox{
 			s:          s,
+			user:       s.user,
+			ownerID:    s.userID,
+			rights:     imap.RightsAll,
 			mailboxID:  stmt.GetInt64("MailboxID"),
 			name:       stmt.GetText("Name"),
 			subscribed: stmt.GetInt64("Subscribed") != 0,
@@ -202,27 +255,87 @@ func (s *session) getMailbox(stmt *sqlite.Stmt) *mailbox {
 	return m
 }
 
-func (s *session) CreateMailbox(nameb []byte, attr imap.ListAttrFlag) (err error) {
+// labelMailbox opens the read-only mailbox of the messages
+// of the conversations with a label.
+func (s *session) labelMailbox(name string) (*mailbox, error) {
+	label := strings.TrimPrefix(name, spillbox.LabelMailboxPrefix)
+	if !spillbox.IsLabelKeyword(label) {
+		return nil, fmt.Errorf("mailbox not found: %s", name)
+	}
+
 	ctx := s.c.Context
-	conn := s.user.Box.PoolRW.Get(ctx)
+	conn, put := getRO(ctx, s.user.Box)
 	if conn == nil {
-		return context.Canceled
+		return nil, context.Canceled
+	}
+	defer put()
+
+	labelID, err := spillbox.FindLabel(conn, label)
+	if err != nil {
+		return nil, err
+	}
+	if labelID == 0 {
+		return nil, fmt.Errorf("mailbox not found: %s", name)
+	}
+	mailboxID := spillbox.LabelMailboxID(labelID)
+
+	s.mu.Lock()
+	m := s.mailboxes[mailboxID]
+	if m == nil {
+		m = &mailbox{
+			s:         s,
+			user:      s.user,
+			ownerID:   s.userID,
+			rights:    imap.RightLookup | imap.RightRead,
+			mailboxID: mailboxID,
+			labelID:   labelID,
+			name:      name,
+		}
+		s.mailboxes[mailboxID] = m
+	}
+	s.mu.Unlock()
+
+	return m, nil
+}
+
+func (s *session) CreateMailbox(nameb []byte, attr imap.ListAttrFlag) (err error) {
+	if isOtherUsersName(string(nameb)) || string(nameb) == otherUsersRoot {
+		return fmt.Errorf("cannot create mailboxes under %q", otherUsersRoot)
 	}
-	defer s.user.Box.PoolRW.Put(conn)
+
+	ctx := s.c.Context
+	conn, put, err := getRW(ctx, s.user.Box)
+	if err != nil {
+		return err
+	}
+	defer put()
 	defer sqlitex.Save(conn)(&err)
 
 	return spillbox.CreateMailbox(conn, string(nameb), attr)
 }
 
 func (s *session) DeleteMailbox(nameb []byte) error {
+	mbox, err := s.mailbox(nameb, true)
+	if err != nil {
+		return err
+	}
+	m := mbox.(*mailbox)
+	if err := m.need(imap.RightDelete); err != nil {
+		return err
+	}
+
 	ctx := s.c.Context
-	conn := s.user.Box.PoolRW.Get(ctx)
-	if conn == nil {
-		return context.Canceled
+	conn, put, err := getRW(ctx, m.user.Box)
+	if err != nil {
+		return err
 	}
-	defer s.user.Box.PoolRW.Put(conn)
+	defer put()
 
-	return spillbox.DeleteMailbox(conn, string(nameb))
+	if err := spillbox.DeleteMailbox(conn, m.name); err != nil {
+		return err
+	}
+	s.audit(m, db.AuditMailboxDelete, m.name)
+	return s.deleteACL(m)
 }
 
 func (s *session) RenameMailbox(old, new []byte) error {
@@ -234,102 +347,249 @@ func (s *session) RenameMailbox(old, new []byte) error {
 
 func (s *session) RegisterPushDevice(mailbox string, device imapparser.ApplePushDevice) error {
 	ctx := s.c.Context
-	return s.user.Box.RegisterPushDevice(ctx, mailbox, device)
+	if err := s.user.Box.RegisterPushDevice(ctx, mailbox, device); err != nil {
+		return err
+	}
+	s.audit(nil, db.AuditPushRegister, mailbox)
+	return nil
 }
 
 func (s *session) Close() {
 }
 
+// audit records an event in the AuditLog of the owner of m,
+// or of the session user if m is nil.
+// A failure is logged, it does not fail the command.
+func (s *session) audit(m *mailbox, event db.AuditEvent, detail string) {
+	userID := s.userID
+	if m != nil && m.ownerID != s.userID {
+		userID = m.ownerID
+		detail += " by " + s.name
+	}
+	conn := s.dbpool.Get(s.c.Context)
+	if conn == nil {
+		return
+	}
+	defer s.dbpool.Put(conn)
+
+	err := db.Audit(conn, db.AuditEntry{
+		UserID: userID,
+		Event:  event,
+		Addr:   s.remoteAddr,
+		Detail: detail,
+	})
+	if err != nil {
+		s.logf("%s", db.Log{
+			Where:  "imapdb",
+			What:   "audit",
+			When:   time.Now(),
+			UserID: s.userID,
+			Err:    err,
+		}.String())
+	}
+}
+
 type mailbox struct {
-	s *session
+	s       *session
+	user    *boxmgmt.User // owner of the mailbox
+	ownerID int64
+	rights  imap.Rights // of the session user
 
 	mailboxID  int64
+	labelID    spillbox.LabelID // of a label mailbox, zero otherwise
 	seqNum     uint32
 	name       string
 	subscribed bool
+
+	seqMu sync.Mutex
+	seqs  *seqIndex // guarded by seqMu, see seqIndex
 }
 
 func (m *mailbox) ID() int64 { return m.mailboxID }
 
+// labelMsgsSQL is the messages of a label mailbox. It has the
+// columns of Msgs used by queries of mailbox messages, with the
+// UID and MailboxID of the label mailbox.
+var labelMsgsSQL = fmt.Sprintf(`(SELECT Msgs.MsgID, Seed,
+		LabelMsgs.UID AS UID, $mailboxID AS MailboxID,
+		Date, HdrsBlobID, State, SysFlags, ModSequence, EncodedSize, Skeleton
+		FROM LabelMsgs
+		INNER JOIN Msgs ON Msgs.MsgID = LabelMsgs.MsgID
+		WHERE LabelMsgs.LabelID = $mailboxID - %d)`, spillbox.LabelMailboxID(0))
+
+// msgs is the table of the messages of m in queries, which
+// select them with "MailboxID = $mailboxID".
+//
+// A label mailbox has the messages of other mailboxes, so the
+// ModSequence of its messages come from several sequences.
+// A CHANGEDSINCE on it may miss changes.
+func (m *mailbox) msgs() string {
+	if m.labelID != 0 {
+		return labelMsgsSQL
+	}
+	return "Msgs"
+}
+
 func (m *mailbox) Info() (info imap.MailboxInfo, err error) {
+	if err := m.need(imap.RightRead); err != nil {
+		return imap.MailboxInfo{}, err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRO.Get(ctx)
+	conn, put := getRO(ctx, m.user.Box)
 	if conn == nil {
 		return imap.MailboxInfo{}, context.Canceled
 	}
-	defer m.s.user.Box.PoolRO.Put(conn)
+	defer put()
 	defer sqlitex.Save(conn)(&err)
 
+	info, err = m.status(conn)
+	if err != nil {
+		return imap.MailboxInfo{}, err
+	}
+	info.KeywordsFull, err = spillbox.KeywordsFull(conn, m.mailboxID, m.user.Box.KeywordLimit())
+	if err != nil {
+		return imap.MailboxInfo{}, fmt.Errorf("imapdb.Info: KeywordsFull: %v", err)
+	}
+
+	if info.NumUnseen > 0 {
+		index, err := m.seqIndex(conn)
+		if err != nil {
+			return imap.MailboxInfo{}, err
+		}
+		stmt := conn.Prep(`SELECT UID FROM ` + m.msgs() + `
+			WHERE MailboxID = $mailboxID
+			AND State = 1
+			AND (SysFlags & $flagSeen) = 0
+			ORDER BY UID LIMIT 1;`)
+		stmt.SetInt64("$mailboxID", m.mailboxID)
+		stmt.SetInt64("$flagSeen", spillbox.FlagSeen)
+		if hasNext, err := stmt.Step(); err != nil {
+			return imap.MailboxInfo{}, err
+		} else if hasNext {
+			info.FirstUnseenSeqNum = index.seqNum(uint32(stmt.GetInt64("UID")))
+			stmt.Reset()
+		}
+	}
+
+	stmt := conn.Prep(`SELECT DISTINCT Keyword FROM MsgKeywords
+		WHERE MsgID IN (SELECT MsgID FROM ` + m.msgs() + `
+			WHERE MailboxID = $mailboxID
+			AND State = 1)
+		ORDER BY Keyword;`)
+	stmt.SetInt64("$mailboxID", m.mailboxID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return imap.MailboxInfo{}, fmt.Errorf("imapdb.Info: Keywords: %v", err)
+		} else if !hasNext {
+			break
+		}
+		if flag := stmt.GetText("Keyword"); !strings.HasPrefix(flag, `\`) {
+			info.Keywords = append(info.Keywords, flag)
+		}
+	}
+
+	return info, nil
+}
+
+func (m *mailbox) Status() (info imap.MailboxInfo, err error) {
+	if err := m.need(imap.RightRead); err != nil {
+		return imap.MailboxInfo{}, err
+	}
+	ctx := m.s.c.Context
+	conn, put := getRO(ctx, m.user.Box)
+	if conn == nil {
+		return imap.MailboxInfo{}, context.Canceled
+	}
+	defer put()
+	defer sqlitex.Save(conn)(&err)
+
+	return m.status(conn)
+}
+
+// status reports the parts of the MailboxInfo of m that STATUS uses.
+//
+// They are read from the MailboxCounts row of the mailbox. A label
+// mailbox, or a mailbox without a row, has them counted from its
+// messages.
+func (m *mailbox) status(conn *sqlite.Conn) (info imap.MailboxInfo, err error) {
 	info.Summary = imap.MailboxSummary{
 		Name: m.name,
 		// TODO Subscribed
 		// TODO: ListAttrFlag
 	}
+	info.NumRecent = 0 // TODO
 
-	stmt := conn.Prep(`SELECT count(*) FROM Msgs
-		WHERE MailboxID = $id
-		AND State = $msgReady;`)
-	stmt.SetInt64("$msgReady", int64(spillbox.MsgReady))
-	stmt.SetInt64("$id", m.mailboxID)
-	msgCount, err := sqlitex.ResultInt(stmt)
-	if err != nil {
-		return imap.MailboxInfo{}, fmt.Errorf("imapdb: mailbox info: %v", err)
+	var stmt *sqlite.Stmt
+	if m.labelID != 0 {
+		stmt = conn.Prep(`SELECT NextUID, UIDValidity, FALSE AS Counted,
+			0 AS NumMessages, 0 AS NumUnseen, 0 AS HighestModSequence
+			FROM Labels WHERE LabelID = $id;`)
+		stmt.SetInt64("$id", int64(m.labelID))
+	} else {
+		stmt = conn.Prep(`SELECT NextUID, UIDValidity,
+			MailboxCounts.MailboxID IS NOT NULL AS Counted,
+			NumMessages, NumUnseen, HighestModSequence
+			FROM Mailboxes
+			LEFT JOIN MailboxCounts ON MailboxCounts.MailboxID = Mailboxes.MailboxID
+			WHERE Mailboxes.MailboxID = $id;`)
+		stmt.SetInt64("$id", m.mailboxID)
 	}
-	info.NumMessages = uint32(msgCount)
-
-	stmt = conn.Prep(`SELECT NextUID, UIDValidity FROM Mailboxes WHERE MailboxID = $id;`)
-	stmt.SetInt64("$id", m.mailboxID)
 	if hasNext, err := stmt.Step(); err != nil {
-		return imap.MailboxInfo{}, err
+		return imap.MailboxInfo{}, fmt.Errorf("imapdb: mailbox info: %v", err)
 	} else if !hasNext {
 		return imap.MailboxInfo{}, fmt.Errorf("missing mailbox db info")
 	}
 	info.UIDNext = uint32(stmt.GetInt64("NextUID"))
 	info.UIDValidity = uint32(stmt.GetInt64("UIDValidity"))
+	counted := stmt.GetInt64("Counted") != 0
+	info.NumMessages = uint32(stmt.GetInt64("NumMessages"))
+	info.NumUnseen = uint32(stmt.GetInt64("NumUnseen"))
+	info.HighestModSequence = stmt.GetInt64("HighestModSequence")
 	stmt.Reset()
-
-	info.NumRecent = 0 // TODO
-
-	const withSeqNumSQL = `WITH SeqNumMsgs AS (
-			SELECT row_number() OVER win AS SeqNum, Flags
-			FROM Msgs
-			WHERE MailboxID = $mailboxID
-			AND State = 1
-			WINDOW win AS (ORDER BY UID)
-			ORDER BY UID
-		) `
-	stmt = conn.Prep(withSeqNumSQL + `SELECT SeqNum FROM SeqNumMsgs
-		WHERE json_extract(Flags, "$.\\Seen") IS NULL LIMIT 1;`)
-	stmt.SetInt64("$mailboxID", m.mailboxID)
-	if hasNext, err := stmt.Step(); err != nil {
-		return imap.MailboxInfo{}, err
-	} else if hasNext {
-		info.FirstUnseenSeqNum = uint32(stmt.GetInt64("SeqNum"))
-		stmt.Reset()
+	if counted {
+		return info, nil
 	}
 
-	stmt = conn.Prep(`SELECT count(*) FROM Msgs
+	stmt = conn.Prep(`SELECT count(*) AS NumMessages,
+		coalesce(sum((SysFlags & $flagSeen) = 0), 0) AS NumUnseen
+		FROM ` + m.msgs() + `
 		WHERE MailboxID = $mailboxID
-		AND State = 1
-		AND json_extract(Flags, "$.\\Seen") IS NULL;`)
+		AND State = $msgReady;`)
+	stmt.SetInt64("$msgReady", int64(spillbox.MsgReady))
+	stmt.SetInt64("$flagSeen", spillbox.FlagSeen)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
-	numUnseen, err := sqlitex.ResultInt64(stmt)
-	if err != nil {
-		return imap.MailboxInfo{}, fmt.Errorf("imapdb.Info: NumUnseen: %v", err)
+	if _, err := stmt.Step(); err != nil {
+		return imap.MailboxInfo{}, fmt.Errorf("imapdb: mailbox info: %v", err)
 	}
-	info.NumUnseen = uint32(numUnseen)
+	info.NumMessages = uint32(stmt.GetInt64("NumMessages"))
+	info.NumUnseen = uint32(stmt.GetInt64("NumUnseen"))
+	stmt.Reset()
 
-	stmt = conn.Prep("SELECT max(ModSequence) FROM Msgs WHERE MailboxID = $mailboxID;")
+	stmt = conn.Prep("SELECT max(ModSequence) FROM " + m.msgs() + " WHERE MailboxID = $mailboxID;")
 	stmt.SetInt64("$mailboxID", m.mailboxID)
 	info.HighestModSequence, err = sqlitex.ResultInt64(stmt)
 	if err != nil {
-		return imap.MailboxInfo{}, fmt.Errorf("imapdb.Info: HighestModSequence: %v", err)
+		return imap.MailboxInfo{}, fmt.Errorf("imapdb: mailbox info: HighestModSequence: %v", err)
 	}
-
 	return info, nil
 }
 
 func (m *mailbox) Append(flags [][]byte, date time.Time, data io.ReadSeeker) (uid uint32, err error) {
+	if err := m.need(imap.RightInsert); err != nil {
+		return 0, err
+	}
+	ctx := m.s.c.Context
+	span := m.startOp(ctx, "append")
+	defer func() { endOp(span, -1, err) }()
+
+	var msgFlags []string
+	for _, flag := range flags {
+		msgFlags = append(msgFlags, string(flag))
+	}
+	if err := m.registerKeywords(ctx, msgFlags); err != nil {
+		return 0, err
+	}
+
 	var msg *email.Msg
 	msg, err = msgcleaver.Cleave(m.s.filer, data)
 	if err != nil {
@@ -337,14 +597,11 @@ func (m *mailbox) Append(flags [][]byte, date time.Time, data io.ReadSeeker) (ui
 	}
 	msg.MailboxID = m.mailboxID
 	msg.Date = date
-	for _, flag := range flags {
-		msg.Flags = append(msg.Flags, string(flag))
-	}
+	msg.Flags = msgFlags
 	sort.Strings(msg.Flags)
 
-	ctx := m.s.c.Context
 	// TODO: InsertMsg elides duplicates. That's not what we want?
-	done, err := m.s.user.Box.InsertMsg(ctx, msg, 0)
+	done, err := m.user.Box.InsertMsg(ctx, msg, 0)
 	if err != nil {
 		return 0, err
 	}
@@ -352,11 +609,11 @@ func (m *mailbox) Append(flags [][]byte, date time.Time, data io.ReadSeeker) (ui
 		return 0, errors.New("imapdb: missing message content")
 	}
 
-	conn := m.s.user.Box.PoolRO.Get(ctx)
+	conn, put := getRO(ctx, m.user.Box)
 	if conn == nil {
 		return 0, context.Canceled
 	}
-	defer m.s.user.Box.PoolRO.Put(conn)
+	defer put()
 
 	stmt := conn.Prep("SELECT UID FROM Msgs WHERE MsgID = $msgID")
 	stmt.SetInt64("$msgID", int64(msg.MsgID))
@@ -368,23 +625,47 @@ func (m *mailbox) Append(flags [][]byte, date time.Time, data io.ReadSeeker) (ui
 	return uint32(uid64), nil
 }
 
-func (m *mailbox) Search(op *imapparser.SearchOp, fn func(imap.MessageSummary)) error {
+// registerKeywords registers the keywords in flags with m,
+// see spillbox.RegisterKeywords.
+func (m *mailbox) registerKeywords(ctx context.Context, flags []string) error {
+	conn, put, err := getRW(ctx, m.user.Box)
+	if err != nil {
+		return err
+	}
+	defer put()
+
+	return spillbox.RegisterKeywords(conn, m.mailboxID, flags, m.user.Box.KeywordLimit())
+}
+
+func (m *mailbox) Search(op *imapparser.SearchOp, fn func(imap.MessageSummary)) (err error) {
+	if err := m.need(imap.RightRead); err != nil {
+		return err
+	}
 	matcher, err := imapparser.NewMatcher(op)
 	if err != nil {
 		return err
 	}
 
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRO.Get(ctx)
+	span := m.startOp(ctx, "search")
+	rows := 0
+	defer func() { endOp(span, rows, err) }()
+	searchFn := fn
+	fn = func(summary imap.MessageSummary) {
+		rows++
+		searchFn(summary)
+	}
+	conn, put := getRO(ctx, m.user.Box)
 	if conn == nil {
 		return context.Canceled
 	}
-	defer m.s.user.Box.PoolRO.Put(conn)
+	defer put()
 
 	// allMsgs is the baseline set of messagse assuming no criteria.
-	const allMsgs = `SELECT row_number() OVER win AS SeqNum, MsgID, UID,
-		Date, HdrsBlobID, State, Flags, ModSequence, EncodedSize
-		FROM Msgs
+	allMsgs := `SELECT row_number() OVER win AS SeqNum, MsgID, UID,
+		Date, HdrsBlobID, State, SysFlags, ModSequence, EncodedSize,
+		` + spillbox.KeywordsColumn + `
+		FROM ` + m.msgs() + ` AS Msgs
 		WHERE MailboxID = $mailboxID
 		AND State = $msgReady
 		WINDOW win AS (ORDER BY UID)
@@ -403,7 +684,7 @@ func (m *mailbox) Search(op *imapparser.SearchOp, fn func(imap.MessageSummary))
 			break
 		}
 
-		mMsg := &matchMessage{logf: m.s.logf, userID: m.s.userID, conn: conn, stmt: stmt}
+		mMsg := &matchMessage{logf: m.s.logf, userID: m.s.userID, box: m.user.Box, conn: conn, stmt: stmt}
 		if !matcher.Match(mMsg) {
 			continue
 		}
@@ -417,12 +698,14 @@ func (m *mailbox) Search(op *imapparser.SearchOp, fn func(imap.MessageSummary))
 }
 
 type matchMessage struct {
-	logf   func(format string, v ...interface{})
-	userID int64
-	conn   *sqlite.Conn
-	stmt   *sqlite.Stmt
-	flags  map[string]int // decoded from JSON: {"flag": 1}
-	hdrs   *email.Header
+	logf     func(format string, v ...interface{})
+	userID   int64
+	box      *spillbox.Box
+	conn     *sqlite.Conn
+	stmt     *sqlite.Stmt
+	keywords []string // split from the Keywords column
+	hdrs     *email.Header
+	atts     []imapparser.Attachment
 }
 
 func (m *matchMessage) SeqNum() uint32    { return uint32(m.stmt.GetInt64("SeqNum")) }
@@ -431,30 +714,39 @@ func (m *matchMessage) ModSeq() int64     { return m.stmt.GetInt64("ModSequence"
 func (m *matchMessage) RFC822Size() int64 { return m.stmt.GetInt64("EncodedSize") }
 func (m *matchMessage) Date() time.Time   { return time.Unix(m.stmt.GetInt64("Date"), 0) }
 
+// SentDate parses the Date header field, it is not kept in Msgs.
+func (m *matchMessage) SentDate() time.Time {
+	date := m.Header("Date")
+	if date == "" {
+		return time.Time{}
+	}
+	t, err := imf.ParseDate(date)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
 func (m *matchMessage) Flag(name string) bool {
-	if m.flags == nil {
-		flags := make(map[string]int)
-		flagsStr := m.stmt.GetText("Flags")
-		if err := json.Unmarshal([]byte(flagsStr), &flags); err != nil {
-			m.logf("%s", db.Log{
-				Where:  "imapdb",
-				What:   "match-msg-flag-decode",
-				When:   time.Now(),
-				UserID: m.userID,
-				Err:    err,
-			}.String())
-			return false
+	if bit := spillbox.SysFlag(name); bit != 0 {
+		return m.stmt.GetInt64("SysFlags")&bit != 0
+	}
+	if m.keywords == nil {
+		m.keywords = strings.Fields(m.stmt.GetText("Keywords"))
+	}
+	for _, keyword := range m.keywords {
+		if keyword == name {
+			return true
 		}
-		m.flags = flags
 	}
-	return m.flags[name] != 0
+	return false
 }
 
 func (m *matchMessage) Header(name string) string {
 	if m.hdrs == nil {
 		msgID := email.MsgID(m.stmt.GetInt64("MsgID"))
 		var err error
-		m.hdrs, err = spillbox.LoadMsgHdrs(m.conn, msgID)
+		m.hdrs, err = m.box.LoadMsgHdrs(m.conn, msgID)
 		if err != nil {
 			m.logf("%s", db.Log{
 				Where:  "imapdb",
@@ -469,43 +761,132 @@ func (m *matchMessage) Header(name string) string {
 	return string(m.hdrs.Get(email.CanonicalKey([]byte(name))))
 }
 
+// Addresses reports the addresses of a message from MsgAddresses,
+// so FROM, TO, CC, and BCC searches do not decode the headers.
+func (m *matchMessage) Addresses(field string) string {
+	var role spillbox.AddressRole
+	switch strings.ToUpper(field) {
+	case "FROM":
+		role = spillbox.RoleFrom
+	case "TO":
+		role = spillbox.RoleTo
+	case "CC":
+		role = spillbox.RoleCC
+	case "BCC":
+		role = spillbox.RoleBCC
+	default:
+		return m.Header(field)
+	}
+	msgID := email.MsgID(m.stmt.GetInt64("MsgID"))
+	addrs, err := spillbox.MsgAddresses(m.conn, msgID, role)
+	if err != nil {
+		m.logf("%s", db.Log{
+			Where:  "imapdb",
+			What:   "match-msg-addresses",
+			When:   time.Now(),
+			UserID: m.userID,
+			Err:    err,
+		}.String())
+		return ""
+	}
+	var b strings.Builder
+	for i, addr := range addrs {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if addr.Name != "" {
+			b.WriteString(addr.Name)
+			b.WriteString(" <")
+			b.WriteString(addr.Addr)
+			b.WriteString(">")
+		} else {
+			b.WriteString(addr.Addr)
+		}
+	}
+	return b.String()
+}
+
+func (m *matchMessage) Attachments() []imapparser.Attachment {
+	if m.atts == nil {
+		msgID := email.MsgID(m.stmt.GetInt64("MsgID"))
+		atts, err := spillbox.MsgAttachments(m.conn, msgID)
+		if err != nil {
+			m.logf("%s", db.Log{
+				Where:  "imapdb",
+				What:   "match-msg-attachments",
+				When:   time.Now(),
+				UserID: m.userID,
+				Err:    err,
+			}.String())
+			return nil
+		}
+		m.atts = make([]imapparser.Attachment, 0, len(atts))
+		for _, att := range atts {
+			m.atts = append(m.atts, imapparser.Attachment{
+				Name:        att.Name,
+				ContentType: att.ContentType,
+			})
+		}
+	}
+	return m.atts
+}
+
 func (m *mailbox) Fetch(useUID bool, seqs []imapparser.SeqRange, changedSince int64, fn func(imap.Message)) (err error) {
+	if err := m.need(imap.RightRead); err != nil {
+		return err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRO.Get(ctx)
+	span := m.startOp(ctx, "fetch")
+	rows := 0
+	defer func() { endOp(span, rows, err) }()
+	fetchFn := fn
+	fn = func(msg imap.Message) {
+		rows++
+		fetchFn(msg)
+	}
+	conn, put := getRO(ctx, m.user.Box)
 	if conn == nil {
 		return context.Canceled
 	}
-	defer m.s.user.Box.PoolRO.Put(conn)
-
-	const withSeqNumSQL = `WITH SeqNumMsgs AS (
-		SELECT row_number() OVER win AS SeqNum,
-		MsgID, Seed, UID, ModSequence, Date, State, Flags, EncodedSize
-		FROM Msgs
-		WHERE MailboxID = $mailboxID
-		AND State = 1    -- spillbox.MsgReady
-		WINDOW win AS (ORDER BY UID)
-		ORDER BY UID
-	) `
+	defer put()
+	defer sqlitex.Save(conn)(&err)
 
-	var stmt *sqlite.Stmt
-	if useUID {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs
-			WHERE UID >= $min AND UID <= $max AND ModSequence > $changedSince;`)
-	} else {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs
-			WHERE SeqNum >= $min AND SeqNum <= $max AND ModSequence > $changedSince;`)
+	index, err := m.seqIndex(conn)
+	if err != nil {
+		return err
 	}
+
+	stmt := conn.Prep(`WITH SeqNumMsgs AS (
+			SELECT $seqBase + row_number() OVER win AS SeqNum,
+			MsgID, Seed, UID, ModSequence, Date, State, SysFlags, EncodedSize,
+			Skeleton, ` + spillbox.KeywordsColumn + `
+			FROM ` + m.msgs() + ` AS Msgs
+			WHERE MailboxID = $mailboxID
+			AND State = 1    -- spillbox.MsgReady
+			AND UID >= $min AND UID <= $max
+			WINDOW win AS (ORDER BY UID)
+		)
+		SELECT SeqNumMsgs.*,
+		MsgFetchCache.Envelope AS CachedEnvelope,
+		MsgFetchCache.BodyStructure AS CachedBodyStructure
+		FROM SeqNumMsgs
+		LEFT JOIN MsgFetchCache ON MsgFetchCache.MsgID = SeqNumMsgs.MsgID
+			AND MsgFetchCache.Version = $fetchCacheVersion
+		WHERE ModSequence > $changedSince
+		ORDER BY UID;`)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
 	stmt.SetInt64("$changedSince", changedSince)
+	stmt.SetInt64("$fetchCacheVersion", imapformat.CacheVersion)
 
 	for _, seq := range seqs {
-		min, max := int64(seq.Min), int64(seq.Max)
-		if max == 0 {
-			max = math.MaxUint32
+		min, max, base, ok := index.seqNumRange(useUID, seq)
+		if !ok {
+			continue
 		}
 		stmt.Reset()
 		stmt.SetInt64("$min", min)
 		stmt.SetInt64("$max", max)
+		stmt.SetInt64("$seqBase", base)
 
 		for {
 			if hasNext, err := stmt.Step(); err != nil {
@@ -525,20 +906,15 @@ func (m *mailbox) Fetch(useUID bool, seqs []imapparser.SeqRange, changedSince in
 
 func (m *mailbox) fetchMsg(conn *sqlite.Conn, stmt *sqlite.Stmt, fn func(imap.Message)) (err error) {
 	msgID := email.MsgID(stmt.GetInt64("MsgID"))
-	hdrs, err := spillbox.LoadMsgHdrs(conn, msgID)
-	if err != nil {
-		stmt.Reset()
-		return fmt.Errorf("%v headers: %v", msgID, err)
-	}
-
 	msg := &message{
-		s:    m.s,
-		conn: conn,
+		s:        m.s,
+		box:      m.user.Box,
+		conn:     conn,
+		keepSeen: m.rights&imap.RightSeen != 0,
 		msg: email.Msg{
 			MsgID:       msgID,
 			Seed:        stmt.GetInt64("Seed"),
 			Date:        time.Unix(stmt.GetInt64("Date"), 0),
-			Headers:     *hdrs,
 			EncodedSize: stmt.GetInt64("EncodedSize"),
 		},
 		summary: imap.MessageSummary{
@@ -546,17 +922,17 @@ func (m *mailbox) fetchMsg(conn *sqlite.Conn, stmt *sqlite.Stmt, fn func(imap.Me
 			UID:    uint32(stmt.GetInt64("UID")),
 			ModSeq: stmt.GetInt64("ModSequence"),
 		},
+		envelope:      getCached(stmt, "CachedEnvelope"),
+		bodyStructure: getCached(stmt, "CachedBodyStructure"),
 	}
 
-	flags := make(map[string]int)
-	if err := json.NewDecoder(stmt.GetReader("Flags")).Decode(&flags); err != nil {
+	msg.msg.Flags = spillbox.MsgFlags(stmt)
+
+	msg.msg.Skeleton, err = spillbox.DecodeSkeleton(stmt, "Skeleton")
+	if err != nil {
 		stmt.Reset()
-		return fmt.Errorf("%v flags: %v", msgID, err)
-	}
-	for flag := range flags {
-		msg.msg.Flags = append(msg.msg.Flags, flag)
+		return fmt.Errorf("%v %v", msgID, err)
 	}
-	sort.Strings(msg.msg.Flags)
 
 	msg.msg.Parts, err = spillbox.LoadPartsSummary(conn, msgID)
 	if err != nil {
@@ -572,61 +948,93 @@ func (m *mailbox) fetchMsg(conn *sqlite.Conn, stmt *sqlite.Stmt, fn func(imap.Me
 }
 
 func (m *mailbox) Expunge(uidSeqs []imapparser.SeqRange, fn func(seqNum uint32)) (err error) {
+	if err := m.need(imap.RightExpunge); err != nil {
+		return err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRW.Get(ctx)
-	if conn == nil {
-		return context.Canceled
+	span := m.startOp(ctx, "expunge")
+	rows := -1
+	defer func() { endOp(span, rows, err) }()
+	if expungeFn := fn; expungeFn != nil {
+		rows = 0
+		fn = func(seqNum uint32) {
+			rows++
+			expungeFn(seqNum)
+		}
 	}
-	defer m.s.user.Box.PoolRW.Put(conn)
+	conn, put, err := getRW(ctx, m.user.Box)
+	if err != nil {
+		return err
+	}
+	defer put()
 	defer sqlitex.Save(conn)(&err)
 
 	stmt := conn.Prep(`SELECT COUNT(*) FROM Msgs WHERE
 			MailboxID = $mailboxID
 			AND State = 1
-			AND json_extract(Flags, "$.\\Deleted") == 1;`)
+			AND (SysFlags & $flagDeleted) != 0;`)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
+	stmt.SetInt64("$flagDeleted", spillbox.FlagDeleted)
 	if count, err := sqlitex.ResultInt(stmt); err != nil {
 		return err
 	} else if count == 0 {
 		return nil
 	}
 
+	index, err := m.seqIndex(conn)
+	if err != nil {
+		return err
+	}
+
+	// Messages are reported from the highest sequence number down,
+	// so expunging one does not renumber those still to be reported.
+	var msgIDs []int64
 	var expunged []uint32
-	stmt = conn.Prep(`WITH SeqNumMsgs AS (
-			SELECT row_number() OVER win AS SeqNum,
-			MsgID, UID, Flags
-			FROM Msgs
-			WHERE MailboxID = $mailboxID
-			AND State = 1
-			WINDOW win AS (ORDER BY UID)
-		)
-		SELECT SeqNum, MsgID, UID FROM SeqNumMsgs
-		WHERE json_extract(Flags, "$.\\Deleted") == 1
-		ORDER BY SeqNum;`)
+	stmt = conn.Prep(`SELECT MsgID, UID FROM Msgs
+		WHERE MailboxID = $mailboxID
+		AND State = 1
+		AND (SysFlags & $flagDeleted) != 0
+		ORDER BY UID DESC;`)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
+	stmt.SetInt64("$flagDeleted", spillbox.FlagDeleted)
 	for {
 		if hasNext, err := stmt.Step(); err != nil {
 			return err
 		} else if !hasNext {
 			break
 		}
-		seqNum := uint32(stmt.GetInt64("SeqNum"))
-		msgID := stmt.GetInt64("MsgID")
-		uid := stmt.GetInt64("UID")
-		if uidSeqs != nil && !imapparser.SeqContains(uidSeqs, uint32(uid)) {
+		uid := uint32(stmt.GetInt64("UID"))
+		if uidSeqs != nil && !imapparser.SeqContains(uidSeqs, uid) {
 			continue
 		}
+		msgIDs = append(msgIDs, stmt.GetInt64("MsgID"))
+		expunged = append(expunged, index.seqNum(uid))
+	}
+	if len(msgIDs) == 0 {
+		return nil
+	}
 
-		upstmt := conn.Prep("UPDATE Msgs SET State = $msgExpunged, Expunged = $now WHERE MsgID = $msgID;")
-		upstmt.SetInt64("$msgExpunged", int64(spillbox.MsgExpunged))
-		upstmt.SetInt64("$now", time.Now().Unix())
-		upstmt.SetInt64("$msgID", msgID)
-		if _, err := upstmt.Step(); err != nil {
-			return err
-		}
-
-		expunged = append(expunged, seqNum-uint32(len(expunged)))
+	// Expunged messages are kept with the mod-sequence of their
+	// expunge until GC, for QRESYNC VANISHED (EARLIER).
+	modSeq, err := spillbox.NextMsgModSeq(conn, m.mailboxID)
+	if err != nil {
+		return err
+	}
+	msgIDsJSON, err := json.Marshal(msgIDs)
+	if err != nil {
+		return err
+	}
+	stmt = conn.Prep(`UPDATE Msgs SET
+		State = $msgExpunged, Expunged = $now, ModSequence = $modSeq
+		WHERE MsgID IN (SELECT value FROM json_each($msgIDs));`)
+	stmt.SetInt64("$msgExpunged", int64(spillbox.MsgExpunged))
+	stmt.SetInt64("$now", time.Now().Unix())
+	stmt.SetInt64("$modSeq", modSeq)
+	stmt.SetText("$msgIDs", string(msgIDsJSON))
+	if _, err := stmt.Step(); err != nil {
+		return err
 	}
+	m.s.audit(m, db.AuditExpunge, fmt.Sprintf("%s: %d messages", m.name, len(expunged)))
 
 	for _, seqNum := range expunged {
 		if fn != nil {
@@ -648,29 +1056,49 @@ if _, err := stmt.Step(); err != nil {
 */
 
 func (m *mailbox) HighestModSequence() (int64, error) {
+	if err := m.need(imap.RightRead); err != nil {
+		return 0, err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRW.Get(ctx)
-	if conn == nil {
-		return 0, context.Canceled
+	conn, put, err := getRW(ctx, m.user.Box)
+	if err != nil {
+		return 0, err
 	}
-	defer m.s.user.Box.PoolRW.Put(conn)
+	defer put()
 
-	stmt := conn.Prep("SELECT max(ModSequence) FROM Msgs WHERE MailboxID = $mailboxID;")
-	stmt.SetInt64("$mailboxID", m.mailboxID)
-	modSeq, err := sqlitex.ResultInt64(stmt)
+	info, err := m.status(conn)
 	if err != nil {
 		return 0, fmt.Errorf("imapdb.HighestModSequence: %v", err)
 	}
-	return modSeq, nil
+	return info.HighestModSequence, nil
 }
 
 func (m *mailbox) Store(useUID bool, seqs []imapparser.SeqRange, store *imapparser.Store) (res imap.StoreResults, err error) {
+	if err := m.need(storeRights(store)); err != nil {
+		return imap.StoreResults{}, err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRW.Get(ctx)
-	if conn == nil {
-		return imap.StoreResults{}, context.Canceled
+	span := m.startOp(ctx, "store")
+	defer func() { endOp(span, len(res.Stored), err) }()
+	conn, put, err := getRW(ctx, m.user.Box)
+	if err != nil {
+		return imap.StoreResults{}, err
+	}
+	defer put()
+
+	// Keywords set or cleared label conversations, see spillbox/label.go.
+	type relabel struct {
+		msgID email.MsgID
+		label string
+		set   bool
 	}
-	defer m.s.user.Box.PoolRW.Put(conn)
+	var relabels []relabel
+	labels := new(spillbox.LabelUpdates)
+	defer func() {
+		if err == nil {
+			m.user.Box.NotifyLabelUpdates(labels)
+		}
+	}()
 	defer sqlitex.Save(conn)(&err)
 
 	newModSeq, err := spillbox.NextMsgModSeq(conn, m.mailboxID)
@@ -678,40 +1106,55 @@ func (m *mailbox) Store(useUID bool, seqs []imapparser.SeqRange, store *imappars
 		return imap.StoreResults{}, err
 	}
 
-	newFlags := make(map[string]bool)
+	var storeFlags []string
 	for _, flag := range store.Flags {
 		if string(flag) == `\Recent` {
 			continue // cannot be set by client
 		}
-		newFlags[string(flag)] = true
+		storeFlags = append(storeFlags, string(flag))
 	}
-
-	const withSeqNumSQL = `WITH SeqNumMsgs AS (
-		SELECT row_number() OVER win AS SeqNum,
-		MsgID, UID, Flags, ModSequence
-		FROM Msgs
-		WHERE MailboxID = $mailboxID
-		AND State = 1    -- spillbox.MsgReady
-		WINDOW win AS (ORDER BY UID)
-	) `
-
-	var stmt *sqlite.Stmt
-	if useUID {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs WHERE UID >= $min AND UID <= $max ORDER BY UID;`)
+	if store.Mode == imapparser.StoreRemove {
+		err = spillbox.CanonicalKeywords(conn, m.mailboxID, storeFlags)
 	} else {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs WHERE SeqNum >= $min AND SeqNum <= $max ORDER BY UID;`)
+		err = spillbox.RegisterKeywords(conn, m.mailboxID, storeFlags, m.user.Box.KeywordLimit())
+	}
+	if err != nil {
+		return imap.StoreResults{}, err
+	}
+	newFlags := make(map[string]bool)
+	for _, flag := range storeFlags {
+		newFlags[flag] = true
+	}
+
+	index, err := m.seqIndex(conn)
+	if err != nil {
+		return imap.StoreResults{}, err
 	}
+
+	// The window materializes the messages before they are updated.
+	stmt := conn.Prep(`WITH SeqNumMsgs AS (
+			SELECT $seqBase + row_number() OVER win AS SeqNum,
+			MsgID, UID, SysFlags, ModSequence,
+			` + spillbox.KeywordsColumn + `
+			FROM Msgs
+			WHERE MailboxID = $mailboxID
+			AND State = 1    -- spillbox.MsgReady
+			AND UID >= $min AND UID <= $max
+			WINDOW win AS (ORDER BY UID)
+		)
+		SELECT * FROM SeqNumMsgs ORDER BY UID;`)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
 	defer stmt.Reset()
 
 	for _, seq := range seqs {
-		min, max := int64(seq.Min), int64(seq.Max)
-		if max == 0 {
-			max = math.MaxUint32
+		min, max, base, ok := index.seqNumRange(useUID, seq)
+		if !ok {
+			continue
 		}
 		stmt.Reset()
 		stmt.SetInt64("$min", min)
 		stmt.SetInt64("$max", max)
+		stmt.SetInt64("$seqBase", base)
 
 		for {
 			if hasNext, err := stmt.Step(); err != nil {
@@ -725,9 +1168,15 @@ func (m *mailbox) Store(useUID bool, seqs []imapparser.SeqRange, store *imappars
 			modSeq := stmt.GetInt64("ModSequence")
 
 			msgID := email.MsgID(stmt.GetInt64("MsgID"))
-			flags, err := decodeFlags(stmt.GetReader("Flags"))
-			if err != nil {
-				return imap.StoreResults{}, err
+			flags := make(map[string]bool)
+			for _, flag := range spillbox.MsgFlags(stmt) {
+				flags[flag] = true
+			}
+			oldLabels := make(map[string]bool)
+			for flag := range flags {
+				if spillbox.IsLabelKeyword(flag) {
+					oldLabels[flag] = true
+				}
 			}
 			changed := false
 			switch store.Mode {
@@ -779,13 +1228,19 @@ func (m *mailbox) Store(useUID bool, seqs []imapparser.SeqRange, store *imappars
 				continue
 			}
 
-			stmt := conn.Prep("UPDATE Msgs SET Flags = $flags, ModSequence = $modSeq WHERE MsgID = $msgID;")
-			stmt.SetBytes("$flags", encodeFlagStrings(flaglist))
-			stmt.SetInt64("$modSeq", newModSeq)
-			stmt.SetInt64("$msgID", int64(msgID))
-			if _, err := stmt.Step(); err != nil {
+			if err := spillbox.SetMsgFlags(conn, msgID, flaglist, newModSeq); err != nil {
 				return imap.StoreResults{}, err
 			}
+			for _, flag := range flaglist {
+				if spillbox.IsLabelKeyword(flag) && !oldLabels[flag] {
+					relabels = append(relabels, relabel{msgID, flag, true})
+				}
+			}
+			for flag := range oldLabels {
+				if !flags[flag] {
+					relabels = append(relabels, relabel{msgID, flag, false})
+				}
+			}
 
 			res.Stored = append(res.Stored, imap.StoreResult{
 				SeqNum:      seqNum,
@@ -796,9 +1251,34 @@ func (m *mailbox) Store(useUID bool, seqs []imapparser.SeqRange, store *imappars
 		}
 	}
 
+	for _, r := range relabels {
+		if err := spillbox.LabelConvo(conn, r.msgID, r.label, r.set, labels); err != nil {
+			return imap.StoreResults{}, err
+		}
+	}
+
 	return res, nil
 }
 
+// storeRights reports the rights needed to change flags.
+func storeRights(store *imapparser.Store) (rights imap.Rights) {
+	if store.Mode == imapparser.StoreReplace {
+		return imap.RightSeen | imap.RightWrite | imap.RightDeleteMsg
+	}
+	for _, flag := range store.Flags {
+		switch string(flag) {
+		case `\Recent`:
+		case `\Seen`:
+			rights |= imap.RightSeen
+		case `\Deleted`:
+			rights |= imap.RightDeleteMsg
+		default:
+			rights |= imap.RightWrite
+		}
+	}
+	return rights
+}
+
 func setEq(s1, s2 map[string]bool) bool {
 	if len(s1) != len(s2) {
 		return false
@@ -819,49 +1299,40 @@ func setEq(s1, s2 map[string]bool) bool {
 	return true
 }
 
-func decodeFlags(r io.Reader) (map[string]bool, error) {
-	flagInts := make(map[string]int)
-	if err := json.NewDecoder(r).Decode(&flagInts); err != nil {
-		return nil, err
+// needTransfer checks the rights to copy or move messages
+// from m to dst. Messages do not move between users.
+func (m *mailbox) needTransfer(dst imap.Mailbox, rights imap.Rights) error {
+	dstMailbox := dst.(*mailbox)
+	if dstMailbox.ownerID != m.ownerID {
+		return fmt.Errorf("cannot transfer messages to mailbox of another user")
 	}
-	flags := make(map[string]bool)
-	for flag := range flagInts {
-		flags[flag] = true
+	if m.labelID != 0 || dstMailbox.labelID != 0 {
+		return fmt.Errorf("cannot transfer messages to or from a label mailbox, set the label keyword instead")
 	}
-	return flags, nil
-}
-
-func encodeFlags(buf *bytes.Buffer, flags [][]byte) {
-	buf.WriteByte('{')
-	for i, flag := range flags {
-		if i > 0 {
-			buf.WriteString(", ")
-		}
-		fmt.Fprintf(buf, "%q: 1", flag)
-	}
-	buf.WriteByte('}')
-}
-
-func encodeFlagStrings(flags []string) []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte('{')
-	for i, flag := range flags {
-		if i > 0 {
-			buf.WriteString(", ")
-		}
-		fmt.Fprintf(buf, "%q: 1", flag)
+	if err := m.need(rights); err != nil {
+		return err
 	}
-	buf.WriteByte('}')
-	return buf.Bytes()
+	return dstMailbox.need(imap.RightInsert)
 }
 
 func (m *mailbox) Copy(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox, fn func(srcUID, dstUID uint32)) (err error) {
+	if err := m.needTransfer(dst, imap.RightRead); err != nil {
+		return err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRO.Get(ctx)
+	span := m.startOp(ctx, "copy")
+	rows := 0
+	defer func() { endOp(span, rows, err) }()
+	copyFn := fn
+	fn = func(srcUID, dstUID uint32) {
+		rows++
+		copyFn(srcUID, dstUID)
+	}
+	conn, put := getRO(ctx, m.user.Box)
 	if conn == nil {
 		return context.Canceled
 	}
-	defer m.s.user.Box.PoolRO.Put(conn)
+	defer put()
 	defer sqlitex.Save(conn)(&err)
 
 	dstMailbox := dst.(*mailbox)
@@ -870,32 +1341,38 @@ func (m *mailbox) Copy(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox
 	if err != nil {
 		return err
 	}
+	learnSpam, isSpam, err := m.learnSpam(conn, dstMailbox)
+	if err != nil {
+		return err
+	}
 
-	const withSeqNumSQL = `WITH SeqNumMsgs AS (
-		SELECT row_number() OVER win AS SeqNum,
-		MsgID, Seed, RawHash, UID, Date, HdrsBlobID, State, Flags
-		FROM Msgs
-		WHERE MailboxID = $mailboxID
-		AND State = 1    -- spillbox.MsgReady
-		WINDOW win AS (ORDER BY UID)
-	) `
-
-	var stmt *sqlite.Stmt
-	if useUID {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs WHERE UID >= $min AND UID <= $max ORDER BY UID;`)
-	} else {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs WHERE SeqNum >= $min AND SeqNum <= $max ORDER BY UID;`)
+	index, err := m.seqIndex(conn)
+	if err != nil {
+		return err
 	}
+
+	stmt := conn.Prep(`WITH SeqNumMsgs AS (
+			SELECT $seqBase + row_number() OVER win AS SeqNum,
+			MsgID, Seed, RawHash, UID, Date, HdrsBlobID, State, SysFlags, ConvoID,
+			EnvelopeFrom, EnvelopeTo
+			FROM Msgs
+			WHERE MailboxID = $mailboxID
+			AND State = 1    -- spillbox.MsgReady
+			AND UID >= $min AND UID <= $max
+			WINDOW win AS (ORDER BY UID)
+		)
+		SELECT * FROM SeqNumMsgs ORDER BY UID;`)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
 
 	for _, seq := range seqs {
-		min, max := int64(seq.Min), int64(seq.Max)
-		if max == 0 {
-			max = math.MaxUint32
+		min, max, base, ok := index.seqNumRange(useUID, seq)
+		if !ok {
+			continue
 		}
 		stmt.Reset()
 		stmt.SetInt64("$min", min)
 		stmt.SetInt64("$max", max)
+		stmt.SetInt64("$seqBase", base)
 
 		for {
 			if hasNext, err := stmt.Step(); err != nil {
@@ -907,6 +1384,9 @@ func (m *mailbox) Copy(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox
 				stmt.Reset()
 				return err
 			}
+			if learnSpam {
+				m.trainSpam(conn, email.MsgID(stmt.GetInt64("MsgID")), isSpam)
+			}
 		}
 	}
 
@@ -925,25 +1405,48 @@ func (m *mailbox) copyMsg(conn *sqlite.Conn, selStmt *sqlite.Stmt, newModSeq int
 	// TODO: keeping this in sync with spillbox.InsertMsg is a little annoying.
 	// Can we de-duplicate somehow without decoding and re-encoding headers+flags?
 	stmt := conn.Prep(`INSERT INTO Msgs (
-			MsgID, Seed, MailboxID, ModSequence, RawHash, State, HdrsBlobID, Date, Flags, UID
+			MsgID, Seed, MailboxID, ModSequence, RawHash, State, HdrsBlobID, Date, SysFlags, UID, ConvoID,
+			EnvelopeFrom, EnvelopeTo
 		) VALUES (
-			$msgID, $seed, $mailboxID, $modSeq, $rawHash, $state, $hdrsBlobID, $date, $flags, $uid
+			$msgID, $seed, $mailboxID, $modSeq, $rawHash, $state, $hdrsBlobID, $date, $sysFlags, $uid, $convoID,
+			$envelopeFrom, $envelopeTo
 		);`)
 	stmt.SetText("$rawHash", selStmt.GetText("RawHash"))
 	stmt.SetInt64("$seed", selStmt.GetInt64("Seed"))
 	stmt.SetInt64("$state", int64(spillbox.MsgReady))
 	stmt.SetInt64("$hdrsBlobID", selStmt.GetInt64("HdrsBlobID"))
-	stmt.SetText("$flags", selStmt.GetText("Flags"))
+	stmt.SetInt64("$sysFlags", selStmt.GetInt64("SysFlags"))
 	stmt.SetInt64("$date", selStmt.GetInt64("Date"))
 	stmt.SetInt64("$mailboxID", dst.mailboxID)
 	stmt.SetInt64("$modSeq", newModSeq)
 	stmt.SetInt64("$uid", int64(dstUID))
+	if convoID := selStmt.GetInt64("ConvoID"); convoID != 0 {
+		stmt.SetInt64("$convoID", convoID)
+	} else {
+		stmt.SetNull("$convoID")
+	}
+	if selStmt.GetLen("EnvelopeTo") > 0 {
+		stmt.SetText("$envelopeFrom", selStmt.GetText("EnvelopeFrom"))
+		stmt.SetText("$envelopeTo", selStmt.GetText("EnvelopeTo"))
+	} else {
+		stmt.SetNull("$envelopeFrom")
+		stmt.SetNull("$envelopeTo")
+	}
 	msgIDint64, err := spillbox.InsertRandID(stmt, "$msgID")
 	if err != nil {
 		return err
 	}
 	msgID := email.MsgID(msgIDint64)
 
+	stmt = conn.Prep(`UPDATE Msgs SET (EncodedSize, SizeVerified, VirusScan, Skeleton) =
+		(SELECT EncodedSize, SizeVerified, VirusScan, Skeleton FROM Msgs WHERE MsgID = $srcMsgID)
+		WHERE MsgID = $msgID;`)
+	stmt.SetInt64("$srcMsgID", int64(srcMsgID))
+	stmt.SetInt64("$msgID", int64(msgID))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
 	parts, err := spillbox.LoadPartsSummary(conn, srcMsgID)
 	if err != nil {
 		return err
@@ -953,6 +1456,21 @@ func (m *mailbox) copyMsg(conn *sqlite.Conn, selStmt *sqlite.Stmt, newModSeq int
 			return err
 		}
 	}
+	if err := spillbox.CopyKeywords(conn, srcMsgID, msgID); err != nil {
+		return err
+	}
+	if err := spillbox.CopyInvites(conn, srcMsgID, msgID); err != nil {
+		return err
+	}
+	if err := spillbox.CopyFetchCache(conn, srcMsgID, msgID); err != nil {
+		return err
+	}
+	if err := spillbox.CopyHeaderFields(conn, srcMsgID, msgID); err != nil {
+		return err
+	}
+	if err := spillbox.CopyUnsubscribe(conn, srcMsgID, msgID); err != nil {
+		return err
+	}
 
 	fn(uint32(srcUID), dstUID)
 
@@ -960,12 +1478,23 @@ func (m *mailbox) copyMsg(conn *sqlite.Conn, selStmt *sqlite.Stmt, newModSeq int
 }
 
 func (m *mailbox) Move(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox, fn func(seqNum, srcUID, dstUID uint32)) (err error) {
+	if err := m.needTransfer(dst, imap.RightRead|imap.RightDeleteMsg|imap.RightExpunge); err != nil {
+		return err
+	}
 	ctx := m.s.c.Context
-	conn := m.s.user.Box.PoolRO.Get(ctx)
+	span := m.startOp(ctx, "move")
+	rows := 0
+	defer func() { endOp(span, rows, err) }()
+	moveFn := fn
+	fn = func(seqNum, srcUID, dstUID uint32) {
+		rows++
+		moveFn(seqNum, srcUID, dstUID)
+	}
+	conn, put := getRO(ctx, m.user.Box)
 	if conn == nil {
 		return context.Canceled
 	}
-	defer m.s.user.Box.PoolRO.Put(conn)
+	defer put()
 	defer sqlitex.Save(conn)(&err)
 
 	dstMailbox := dst.(*mailbox)
@@ -974,39 +1503,43 @@ func (m *mailbox) Move(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox
 	if err != nil {
 		return err
 	}
+	learnSpam, isSpam, err := m.learnSpam(conn, dstMailbox)
+	if err != nil {
+		return err
+	}
 
-	const withSeqNumSQL = `WITH SeqNumMsgs AS (
-		SELECT row_number() OVER win AS SeqNum,
-		MsgID, Date, UID
-		FROM Msgs
-		WHERE MailboxID = $mailboxID
-		AND State = 1    -- spillbox.MsgReady
-		WINDOW win AS (ORDER BY UID)
-	) `
-
-	var stmt *sqlite.Stmt
-	if useUID {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs WHERE UID >= $min AND UID <= $max ORDER BY UID;`)
-	} else {
-		stmt = conn.Prep(withSeqNumSQL + `SELECT * FROM SeqNumMsgs WHERE SeqNum >= $min AND SeqNum <= $max ORDER BY UID;`)
+	// The sequence numbers of seqs are those before the move.
+	// Each message moved is reported as expunged, which numbers
+	// the messages after it one lower.
+	index, err := m.seqIndex(conn)
+	if err != nil {
+		return err
 	}
+
+	stmt := conn.Prep(`WITH SeqNumMsgs AS (
+			SELECT $seqBase + row_number() OVER win AS SeqNum,
+			MsgID, Date, UID
+			FROM Msgs
+			WHERE MailboxID = $mailboxID
+			AND State = 1    -- spillbox.MsgReady
+			AND UID >= $min AND UID <= $max
+			WINDOW win AS (ORDER BY UID)
+		)
+		SELECT * FROM SeqNumMsgs ORDER BY UID;`)
 	stmt.SetInt64("$mailboxID", m.mailboxID)
 
 	var expunged []uint32
 
 	rangeSeqDelta := int64(0)
 	for _, seq := range seqs {
-		min, max := int64(seq.Min), int64(seq.Max)
-		if max == 0 {
-			max = math.MaxUint32
-		}
-		if !useUID {
-			min = min - rangeSeqDelta
-			max = max - rangeSeqDelta
+		min, max, base, ok := index.seqNumRange(useUID, seq)
+		if !ok {
+			continue
 		}
 		stmt.Reset()
 		stmt.SetInt64("$min", min)
 		stmt.SetInt64("$max", max)
+		stmt.SetInt64("$seqBase", base-rangeSeqDelta)
 
 		seqDelta := uint32(0)
 		for {
@@ -1036,6 +1569,9 @@ func (m *mailbox) Move(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox
 			if _, err := stmt.Step(); err != nil {
 				return err
 			}
+			if learnSpam {
+				m.trainSpam(conn, email.MsgID(msgID), isSpam)
+			}
 
 			// Tombstone for old message.
 			stmt = conn.Prep(`INSERT INTO Msgs (
@@ -1067,21 +1603,161 @@ func (m *mailbox) Move(useUID bool, seqs []imapparser.SeqRange, dst imap.Mailbox
 	return nil
 }
 
+// learnSpam reports whether messages moving from m to dst should
+// train the spam classifier, and if so, whether they are spam.
+//
+// Users teach the classifier by moving mail in and out of Junk.
+func (m *mailbox) learnSpam(conn *sqlite.Conn, dst *mailbox) (learn, isSpam bool, err error) {
+	srcJunk, err := spillbox.IsJunkMailbox(conn, m.mailboxID)
+	if err != nil {
+		return false, false, err
+	}
+	dstJunk, err := spillbox.IsJunkMailbox(conn, dst.mailboxID)
+	if err != nil {
+		return false, false, err
+	}
+	return srcJunk != dstJunk, dstJunk, nil
+}
+
+// trainSpam trains the spam classifier on msgID.
+// Errors are logged, they do not stop the mail from moving.
+func (m *mailbox) trainSpam(conn *sqlite.Conn, msgID email.MsgID, isSpam bool) {
+	if err := m.user.Box.TrainSpam(conn, msgID, isSpam); err != nil {
+		m.s.logf("%s", db.Log{
+			Where:  "imapdb",
+			What:   "train-spam",
+			When:   time.Now(),
+			UserID: m.s.userID,
+			Err:    err,
+		}.String())
+	}
+}
+
+// getRO gets a read-only connection to box. The returned put
+// returns it, adding the time spent waiting for the connection and
+// holding it to the imapserver.CmdTimes of the command being served.
+func getRO(ctx context.Context, box *spillbox.Box) (conn *sqlite.Conn, put func()) {
+	start := time.Now()
+	conn = box.PoolRO.Get(ctx)
+	got := time.Now()
+	return conn, func() {
+		box.PoolRO.Put(conn)
+		imapserver.CmdTimesFromContext(ctx).AddDB(got.Sub(start), time.Since(got))
+	}
+}
+
+// getRW is getRO for the read-write connection of box.
+func getRW(ctx context.Context, box *spillbox.Box) (conn *sqlite.Conn, put func(), err error) {
+	start := time.Now()
+	conn, err = box.GetRW(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	got := time.Now()
+	return conn, func() {
+		box.PutRW(conn)
+		imapserver.CmdTimesFromContext(ctx).AddDB(got.Sub(start), time.Since(got))
+	}, nil
+}
+
+// startOp starts the span of a database operation on the mailbox,
+// a child of the span of the IMAP command being served.
+func (m *mailbox) startOp(ctx context.Context, op string) *otlptrace.Span {
+	_, span := otlptrace.Start(ctx, "imapdb "+op)
+	span.SetAttr("db.system", "sqlite")
+	span.SetAttr("spilld.user_id", m.ownerID)
+	span.SetAttr("imap.mailbox", m.name)
+	return span
+}
+
+// endOp ends the span of a database operation that affected rows
+// messages, or an unknown number if rows is negative.
+func endOp(span *otlptrace.Span, rows int, err error) {
+	if rows >= 0 {
+		span.SetAttr("db.rows", rows)
+	}
+	span.SetError(err)
+	span.End()
+}
+
 func (m *mailbox) Close() error {
 	return nil
 }
 
 type message struct {
-	s       *session
-	conn    *sqlite.Conn
-	summary imap.MessageSummary
-	msg     email.Msg
+	s        *session
+	box      *spillbox.Box // owner of the message
+	conn     *sqlite.Conn
+	keepSeen bool // session user has the seen right
+	summary  imap.MessageSummary
+	msg      email.Msg
+
+	// MsgFetchCache values, nil if not cached
+	envelope      []byte
+	bodyStructure []byte
+
+	hdrsLoaded bool                 // msg.Headers is loaded
+	fields     map[email.Key][]byte // MsgHeaderFields, loaded on demand
+}
+
+func getCached(stmt *sqlite.Stmt, col string) []byte {
+	n := stmt.GetLen(col)
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	stmt.GetBytes(col, b)
+	return b
 }
 
 func (msg *message) Summary() imap.MessageSummary { return msg.summary }
 
+func (msg *message) CachedEnvelope() []byte      { return msg.envelope }
+func (msg *message) CachedBodyStructure() []byte { return msg.bodyStructure }
+
 func (msg *message) Msg() *email.Msg { return &msg.msg }
 
+func (msg *message) HeaderField(key email.Key) (value []byte, ok bool) {
+	if msg.hdrsLoaded {
+		return msg.msg.Headers.Get(key), true
+	}
+	if msg.fields == nil {
+		if msg.conn == nil {
+			return nil, false
+		}
+		fields, err := spillbox.LoadHeaderFields(msg.conn, msg.msg.MsgID)
+		if err != nil {
+			msg.s.logf("%s", db.Log{
+				Where:  "imapdb",
+				What:   "fetch-header-fields",
+				When:   time.Now(),
+				UserID: msg.s.userID,
+				Err:    err,
+			}.String())
+			fields = make(map[email.Key][]byte) // use the headers
+		}
+		msg.fields = fields
+	}
+	value, ok = msg.fields[key]
+	return value, ok
+}
+
+func (msg *message) LoadHeaders() error {
+	if msg.hdrsLoaded {
+		return nil
+	}
+	if msg.conn == nil {
+		return fmt.Errorf("imapdb: message connection invalidated")
+	}
+	hdrs, err := msg.box.LoadMsgHdrs(msg.conn, msg.msg.MsgID)
+	if err != nil {
+		return fmt.Errorf("%v headers: %v", msg.msg.MsgID, err)
+	}
+	msg.msg.Headers = *hdrs
+	msg.hdrsLoaded = true
+	return nil
+}
+
 func (msg *message) LoadPart(partNum int) (err error) {
 	part := &msg.msg.Parts[partNum]
 	if part.Content != nil {
@@ -1090,15 +1766,18 @@ func (msg *message) LoadPart(partNum int) (err error) {
 	if msg.conn == nil {
 		return fmt.Errorf("imapdb: message connection invalidated")
 	}
-	return spillbox.LoadPartContent(msg.conn, msg.s.filer, part)
+	return msg.box.LoadPartContent(msg.conn, part)
 }
 
 func (msg *message) SetSeen() error {
 	if msg.conn == nil {
 		return fmt.Errorf("imapdb: message connection invalidated")
 	}
-	stmt := msg.conn.Prep(`UPDATE Msgs SET Flags = json_patch(Flags, json_object($flagname, 1)) WHERE MsgID = $msgID;`)
-	stmt.SetText("$flagname", `\Seen`)
+	if !msg.keepSeen {
+		return nil // reading does not mark the message seen, RFC 4314 section 4
+	}
+	stmt := msg.conn.Prep(`UPDATE Msgs SET SysFlags = SysFlags | $flagSeen WHERE MsgID = $msgID;`)
+	stmt.SetInt64("$flagSeen", spillbox.FlagSeen)
 	stmt.SetInt64("$msgID", int64(msg.msg.MsgID))
 	_, err := stmt.Step()
 	return err
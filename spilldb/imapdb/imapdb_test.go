@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime/trace"
 	"strings"
 	"testing"
@@ -15,12 +17,15 @@ import (
 
 	"crawshaw.io/iox"
 	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
 	"spilled.ink/email/msgcleaver"
 	"spilled.ink/imap"
+	"spilled.ink/imap/imapparser"
 	"spilled.ink/imap/imapserver"
 	"spilled.ink/imap/imaptest"
 	"spilled.ink/spilldb/boxmgmt"
 	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/spillbox"
 )
 
 const tracing = false
@@ -78,6 +83,321 @@ func Test(t *testing.T) {
 	})
 }
 
+func TestLabels(t *testing.T) {
+	filer := iox.NewFiler(0)
+	filer.Logf = t.Logf
+	defer filer.Shutdown(context.Background())
+
+	ds, err := newDataStore(filer, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if err := ds.AddUser([]byte("label@spilled.ink"), []byte("aaaabbbbccccdddd")); err != nil {
+		t.Fatal(err)
+	}
+	send := func(msgID, inReplyTo string) {
+		msg := "To: label@spilled.ink\r\n" +
+			"Message-ID: <" + msgID + ">\r\n"
+		if inReplyTo != "" {
+			msg += "In-Reply-To: <" + inReplyTo + ">\r\n"
+		}
+		msg += "Content-Type: text/plain\r\n\r\nHello.\r\n"
+		if err := ds.SendMsg(time.Now(), strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("1@example.com", "")
+	send("2@example.com", "1@example.com")
+
+	ctx := context.Background()
+	userID, err := ds.getUserID("label@spilled.ink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ds.backend.boxmgmt.Open(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := user.Box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { user.Box.PutRW(conn) }()
+
+	firstMsgID, err := sqlitex.ResultInt64(conn.Prep("SELECT min(MsgID) FROM Msgs WHERE State = 1;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labeled := func() (flagged, listed int64) {
+		t.Helper()
+		flagged, err := sqlitex.ResultInt64(conn.Prep(`SELECT count(*) FROM Msgs
+			INNER JOIN MsgKeywords ON MsgKeywords.MsgID = Msgs.MsgID
+			WHERE State = 1 AND Keyword = 'work';`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed, err = sqlitex.ResultInt64(conn.Prep("SELECT count(*) FROM LabelMsgs;"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return flagged, listed
+	}
+
+	u := new(spillbox.LabelUpdates)
+	if err := spillbox.LabelConvo(conn, email.MsgID(firstMsgID), "work", true, u); err != nil {
+		t.Fatal(err)
+	}
+	if flagged, listed := labeled(); flagged != 2 || listed != 2 {
+		t.Errorf("after labeling: %d messages flagged, %d listed, want 2, 2", flagged, listed)
+	}
+
+	// A reply joins the label.
+	user.Box.PutRW(conn)
+	send("3@example.com", "2@example.com")
+	if conn, err = user.Box.GetRW(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if flagged, listed := labeled(); flagged != 3 || listed != 3 {
+		t.Errorf("after reply: %d messages flagged, %d listed, want 3, 3", flagged, listed)
+	}
+
+	if err := spillbox.LabelConvo(conn, email.MsgID(firstMsgID), "work", false, u); err != nil {
+		t.Fatal(err)
+	}
+	if flagged, listed := labeled(); flagged != 0 || listed != 0 {
+		t.Errorf("after clearing: %d messages flagged, %d listed, want 0, 0", flagged, listed)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	filer := iox.NewFiler(0)
+	filer.Logf = t.Logf
+	defer filer.Shutdown(context.Background())
+
+	ds, err := newDataStore(filer, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if err := ds.AddUser([]byte("keywords@spilled.ink"), []byte("aaaabbbbccccdddd")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userID, err := ds.getUserID("keywords@spilled.ink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ds.backend.boxmgmt.Open(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := user.Box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Box.PutRW(conn)
+
+	stmt := conn.Prep("SELECT MailboxID FROM Mailboxes WHERE Name = 'INBOX';")
+	mailboxID, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := []string{`\Seen`, "Work", "$Important"}
+	if err := spillbox.RegisterKeywords(conn, mailboxID, flags, 2); err != nil {
+		t.Fatal(err)
+	}
+	flags = []string{"WORK", "$important"}
+	if err := spillbox.RegisterKeywords(conn, mailboxID, flags, 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Work", "$Important"}; strings.Join(flags, " ") != strings.Join(want, " ") {
+		t.Errorf("registered keywords are %q, want %q", flags, want)
+	}
+	if full, err := spillbox.KeywordsFull(conn, mailboxID, 2); err != nil {
+		t.Fatal(err)
+	} else if !full {
+		t.Error("KeywordsFull = false, want true")
+	}
+
+	flags = []string{"work", "home"}
+	if err := spillbox.RegisterKeywords(conn, mailboxID, flags, 2); err != imap.ErrTooManyKeywords {
+		t.Errorf("registering past the limit: %v, want ErrTooManyKeywords", err)
+	}
+
+	flags = []string{"HOME", "WORK"}
+	if err := spillbox.CanonicalKeywords(conn, mailboxID, flags); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"HOME", "Work"}; strings.Join(flags, " ") != strings.Join(want, " ") {
+		t.Errorf("canonical keywords are %q, want %q", flags, want)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	filer := iox.NewFiler(0)
+	filer.Logf = t.Logf
+	defer filer.Shutdown(context.Background())
+
+	ds, err := newDataStore(filer, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if err := ds.AddUser([]byte("envelope@spilled.ink"), []byte("aaaabbbbccccdddd")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userID, err := ds.getUserID("envelope@spilled.ink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ds.backend.boxmgmt.Open(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := msgcleaver.Cleave(filer, strings.NewReader("From: list@example.com\r\n"+
+		"To: envelope@spilled.ink\r\n"+
+		"Subject: forwarded\r\n"+
+		"Content-Type: text/plain\r\n\r\nHello.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+	msg.Date = time.Now()
+	msg.EnvelopeFrom = "bounces+1234@example.com"
+	msg.EnvelopeTo = []string{"envelope+lists@spilled.ink"}
+	if _, err := user.Box.InsertMsg(ctx, msg, ds.nextStagingID); err != nil {
+		t.Fatal(err)
+	}
+	ds.nextStagingID++
+
+	conn, err := user.Box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Box.PutRW(conn)
+
+	from, to, err := spillbox.LoadEnvelope(conn, msg.MsgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != msg.EnvelopeFrom {
+		t.Errorf("envelope from %q, want %q", from, msg.EnvelopeFrom)
+	}
+	if strings.Join(to, " ") != strings.Join(msg.EnvelopeTo, " ") {
+		t.Errorf("envelope to %q, want %q", to, msg.EnvelopeTo)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	filer := iox.NewFiler(0)
+	filer.Logf = t.Logf
+	defer filer.Shutdown(context.Background())
+
+	ds, err := newDataStore(filer, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if err := ds.AddUser([]byte("repair@spilled.ink"), []byte("aaaabbbbccccdddd")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	userID, err := ds.getUserID("repair@spilled.ink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ds.backend.boxmgmt.Open(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgIDs []email.MsgID
+	var stagingIDs []int64
+	for _, subject := range []string{"complete", "incomplete"} {
+		msg, err := msgcleaver.Cleave(filer, strings.NewReader("From: bob@example.com\r\n"+
+			"To: repair@spilled.ink\r\n"+
+			"Subject: "+subject+"\r\n"+
+			"Content-Type: text/plain\r\n\r\nHello.\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer msg.Close()
+		msg.Date = time.Now()
+		if _, err := user.Box.InsertMsg(ctx, msg, ds.nextStagingID); err != nil {
+			t.Fatal(err)
+		}
+		msgIDs = append(msgIDs, msg.MsgID)
+		stagingIDs = append(stagingIDs, ds.nextStagingID)
+		ds.nextStagingID++
+	}
+
+	// Leave both messages as an interrupted InsertMsg would,
+	// the second without the content of its parts.
+	conn, err := user.Box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := conn.Prep("UPDATE Msgs SET State = $msgFetching WHERE MsgID = $msgID;")
+	for _, msgID := range msgIDs {
+		stmt.Reset()
+		stmt.SetInt64("$msgFetching", int64(spillbox.MsgFetching))
+		stmt.SetInt64("$msgID", int64(msgID))
+		if _, err := stmt.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt = conn.Prep(`UPDATE blobs.Blobs SET Content = NULL
+		WHERE BlobID IN (SELECT BlobID FROM MsgParts WHERE MsgID = $msgID);`)
+	stmt.SetInt64("$msgID", int64(msgIDs[1]))
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	user.Box.PutRW(conn)
+
+	stats, err := user.Box.Repair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := spillbox.RepairStats{
+		Stuck:     2,
+		Completed: 1,
+		Failed:    1,
+		Redeliver: stagingIDs[1:],
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Repair=%+v, want %+v", stats, want)
+	}
+
+	conn, err = user.Box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Box.PutRW(conn)
+	stmt = conn.Prep("SELECT State FROM Msgs WHERE MsgID = $msgID;")
+	for i, wantState := range []spillbox.MsgState{spillbox.MsgReady, spillbox.MsgExpunged} {
+		stmt.Reset()
+		stmt.SetInt64("$msgID", int64(msgIDs[i]))
+		state, err := sqlitex.ResultInt64(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := spillbox.MsgState(state); got != wantState {
+			t.Errorf("message %d state %v, want %v", i, got, wantState)
+		}
+	}
+
+	if stats, err := user.Box.Repair(ctx); err != nil || stats.Stuck != 0 {
+		t.Errorf("second Repair=%+v, %v, want nothing stuck", stats, err)
+	}
+}
+
 type dataStore struct {
 	backend       *backend
 	dbpool        *sqlitex.Pool
@@ -88,6 +408,10 @@ func (ds *dataStore) Login(c *imapserver.Conn, username, password []byte) (int64
 	return ds.backend.Login(c, username, password)
 }
 
+func (ds *dataStore) Namespaces() imap.Namespaces {
+	return ds.backend.Namespaces()
+}
+
 func (ds *dataStore) RegisterNotifier(notifier imap.Notifier) {
 	ds.backend.RegisterNotifier(notifier)
 }
@@ -186,3 +510,38 @@ func newDataStore(filer *iox.Filer, logf func(format string, v ...interface{}))
 	}
 	return ds, nil
 }
+
+func TestSeqIndex(t *testing.T) {
+	x := &seqIndex{uids: []uint32{3, 4, 8, 10, 11}}
+
+	tests := []struct {
+		useUID         bool
+		seq            imapparser.SeqRange
+		min, max, base int64
+		ok             bool
+	}{
+		{false, imapparser.SeqRange{Min: 1, Max: 1}, 3, 3, 0, true},
+		{false, imapparser.SeqRange{Min: 2, Max: 4}, 4, 10, 1, true},
+		{false, imapparser.SeqRange{Min: 4, Max: 0}, 10, 11, 3, true},
+		{false, imapparser.SeqRange{Min: 3, Max: 9}, 8, 11, 2, true},
+		{false, imapparser.SeqRange{Min: 6, Max: 7}, 0, 0, 0, false},
+		{true, imapparser.SeqRange{Min: 5, Max: 10}, 5, 10, 2, true},
+		{false, imapparser.SeqRange{Min: 9, Max: 0}, 11, 11, 4, true},
+		{true, imapparser.SeqRange{Min: 11, Max: 0}, 11, math.MaxUint32, 4, true},
+		{true, imapparser.SeqRange{Min: 559, Max: 0}, 11, 11, 4, true},
+	}
+	for _, test := range tests {
+		min, max, base, ok := x.seqNumRange(test.useUID, test.seq)
+		if min != test.min || max != test.max || base != test.base || ok != test.ok {
+			t.Errorf("seqNumRange(%v, %v) = %d, %d, %d, %v, want %d, %d, %d, %v",
+				test.useUID, test.seq, min, max, base, ok,
+				test.min, test.max, test.base, test.ok)
+		}
+	}
+
+	for uid, want := range map[uint32]uint32{3: 1, 8: 3, 9: 4, 11: 5} {
+		if got := x.seqNum(uid); got != want {
+			t.Errorf("seqNum(%d) = %d, want %d", uid, got, want)
+		}
+	}
+}
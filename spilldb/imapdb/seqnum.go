@@ -0,0 +1,122 @@
+package imapdb
+
+import (
+	"math"
+	"sort"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/imap/imapparser"
+)
+
+// seqIndex is the UIDs of the messages of a mailbox in sequence
+// number order: uids[i] has sequence number i+1.
+//
+// Commands name messages by sequence number, and responses report
+// them. Numbering the messages with row_number() in every query
+// scans the whole mailbox, so a mailbox keeps its seqIndex and
+// reloads it only when MailboxCounts.SeqVersion says a message has
+// joined or left it.
+type seqIndex struct {
+	version   int64 // MailboxCounts.SeqVersion uids was loaded at
+	versioned bool  // a label mailbox, or one without MailboxCounts, is reloaded every time
+	uids      []uint32
+}
+
+// seqNum reports the sequence number of uid, or the sequence number
+// the first message after it has if it is not in the mailbox.
+func (x *seqIndex) seqNum(uid uint32) uint32 {
+	i := sort.Search(len(x.uids), func(i int) bool { return x.uids[i] >= uid })
+	return uint32(i + 1)
+}
+
+// uidRange reports the range of UIDs of the messages with the
+// sequence numbers of seq. A Max of zero is the last message, and
+// n:* with n past the last message is the last message, RFC 3501
+// section 6.4.8. If no message has one of the sequence numbers,
+// ok is false.
+func (x *seqIndex) uidRange(seq imapparser.SeqRange) (min, max uint32, ok bool) {
+	n := uint32(len(x.uids))
+	lo, hi := seq.Min, seq.Max
+	if hi == 0 && lo > n {
+		lo = n
+	}
+	if hi == 0 || hi > n {
+		hi = n
+	}
+	if lo == 0 {
+		lo = 1
+	}
+	if lo > hi {
+		return 0, 0, false
+	}
+	return x.uids[lo-1], x.uids[hi-1], true
+}
+
+// seqIndex loads the sequence numbers of m, if they have changed
+// since they were last loaded.
+//
+// conn must be in a transaction that lasts as long as the
+// sequence numbers are used, so they match what the conn reads.
+func (m *mailbox) seqIndex(conn *sqlite.Conn) (*seqIndex, error) {
+	m.seqMu.Lock()
+	defer m.seqMu.Unlock()
+
+	version, versioned := int64(0), false
+	if m.labelID == 0 {
+		stmt := conn.Prep("SELECT SeqVersion FROM MailboxCounts WHERE MailboxID = $mailboxID;")
+		stmt.SetInt64("$mailboxID", m.mailboxID)
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if hasNext {
+			version, versioned = stmt.GetInt64("SeqVersion"), true
+			stmt.Reset()
+		}
+	}
+	if x := m.seqs; x != nil && versioned && x.versioned && x.version == version {
+		return x, nil
+	}
+
+	x := &seqIndex{version: version, versioned: versioned}
+	stmt := conn.Prep(`SELECT UID FROM ` + m.msgs() + `
+		WHERE MailboxID = $mailboxID
+		AND State = 1    -- spillbox.MsgReady
+		ORDER BY UID;`)
+	stmt.SetInt64("$mailboxID", m.mailboxID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		x.uids = append(x.uids, uint32(stmt.GetInt64("UID")))
+	}
+	m.seqs = x
+	return x, nil
+}
+
+// seqNumRange reports the UIDs of the messages named by seq, and
+// the number of messages before them. If useUID is false, seq is a
+// range of sequence numbers. If no message is in the range, ok is
+// false.
+//
+// Queries select the messages between min and max by UID, and
+// number them from base+1.
+func (x *seqIndex) seqNumRange(useUID bool, seq imapparser.SeqRange) (min, max, base int64, ok bool) {
+	if useUID {
+		min, max = int64(seq.Min), int64(seq.Max)
+		if max == 0 {
+			max = math.MaxUint32
+			// n:* past the largest UID is that UID.
+			if n := len(x.uids); n > 0 && min > int64(x.uids[n-1]) {
+				min, max = int64(x.uids[n-1]), int64(x.uids[n-1])
+			}
+		}
+	} else {
+		lo, hi, ok := x.uidRange(seq)
+		if !ok {
+			return 0, 0, 0, false
+		}
+		min, max = int64(lo), int64(hi)
+	}
+	return min, max, int64(x.seqNum(uint32(min))) - 1, true
+}
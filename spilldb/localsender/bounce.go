@@ -0,0 +1,164 @@
+package localsender
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"crawshaw.io/iox"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/email/dsn"
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/spilldb/webhook"
+)
+
+// recordBounce correlates a delivery status notification sent to
+// the VERP return path of a user's message with that message.
+//
+// Recipients the notification reports as failed are marked
+// DeliveryFailed and reported to webhooks, and the Sent copy of the
+// message is given the keyword $Bounced, or $Delayed if delivery is
+// still being retried. The notification itself is delivered as usual.
+func (p *LocalSender) recordBounce(box *spillbox.Box, userID int64, rcpts []string, raw email.Buffer) error {
+	var token string
+	for _, rcpt := range rcpts {
+		if t, ok := db.ParseVERP(rcpt); ok {
+			token = t
+			break
+		}
+	}
+	if token == "" {
+		return nil
+	}
+
+	if _, err := raw.Seek(0, 0); err != nil {
+		return err
+	}
+	report, err := dsn.Parse(raw)
+	if _, seekErr := raw.Seek(0, 0); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		return err
+	}
+
+	conn := p.dbpool.Get(p.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer p.dbpool.Put(conn)
+
+	stagingID, sender, err := findBounced(conn, token, userID)
+	if err != nil || stagingID == 0 {
+		return err
+	}
+
+	keyword := ""
+	if err := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+
+		now := time.Now()
+		for _, r := range report.Recipients {
+			switch r.Action {
+			case dsn.ActionDelayed:
+				if keyword == "" {
+					keyword = spillbox.KeywordDelayed
+				}
+			case dsn.ActionFailed:
+				keyword = spillbox.KeywordBounced
+				failed, err := setRecipientFailed(conn, stagingID, r.FinalRecipient)
+				if err != nil {
+					return err
+				} else if !failed {
+					continue
+				}
+				err = webhook.Enqueue(conn, webhook.Payload{
+					Event:      webhook.EventBounce,
+					Time:       now,
+					UserID:     userID,
+					StagingID:  stagingID,
+					From:       sender,
+					Recipient:  r.FinalRecipient,
+					Diagnostic: r.Diagnostic,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}(); err != nil {
+		return fmt.Errorf("bounce of staging ID %d: %v", stagingID, err)
+	}
+	if keyword == "" {
+		return nil
+	}
+
+	messageID, err := originalMessageID(conn, p.filer, stagingID)
+	if err != nil {
+		return fmt.Errorf("bounce of staging ID %d: %v", stagingID, err)
+	}
+	if messageID == "" {
+		return nil
+	}
+	if _, err := box.FlagSent(p.ctx, messageID, keyword); err != nil {
+		return fmt.Errorf("bounce of staging ID %d: %v", stagingID, err)
+	}
+	return nil
+}
+
+// findBounced finds the message a VERP token names, if it was sent
+// by userID, and its sender.
+func findBounced(conn *sqlite.Conn, token string, userID int64) (stagingID int64, sender string, err error) {
+	stagingID, sentBy, err := db.FindBounceToken(conn, token)
+	if err != nil || stagingID == 0 || sentBy != userID {
+		return 0, "", err
+	}
+	stmt := conn.Prep("SELECT Sender FROM Msgs WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	if sender, err = sqlitex.ResultText(stmt); err != nil {
+		return 0, "", err
+	}
+	return stagingID, sender, nil
+}
+
+// setRecipientFailed marks a recipient the remote server accepted
+// as DeliveryFailed. It reports false if the recipient is unknown
+// or its delivery has already failed.
+func setRecipientFailed(conn *sqlite.Conn, stagingID int64, recipient string) (bool, error) {
+	stmt := conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryFailed
+		WHERE StagingID = $stagingID AND Recipient = $recipient COLLATE NOCASE
+		AND DeliveryState = $deliveryDone;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetText("$recipient", recipient)
+	stmt.SetInt64("$deliveryFailed", int64(db.DeliveryFailed))
+	stmt.SetInt64("$deliveryDone", int64(db.DeliveryDone))
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	return conn.Changes() > 0, nil
+}
+
+// originalMessageID reports the Message-ID of the message stagingID,
+// without angle brackets.
+func originalMessageID(conn *sqlite.Conn, filer *iox.Filer, stagingID int64) (string, error) {
+	buf, err := db.LoadMsg(conn, filer, stagingID, true)
+	if err != nil {
+		return "", err
+	}
+	defer buf.Close()
+	hdr, err := textproto.NewReader(bufio.NewReader(buf)).ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return "", err
+	}
+	id := strings.TrimSpace(hdr.Get("Message-Id"))
+	id = strings.TrimPrefix(id, "<")
+	id = strings.TrimSuffix(id, ">")
+	return id, nil
+}
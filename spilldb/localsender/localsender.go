@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"sync"
 	"time"
 
@@ -13,12 +14,23 @@ import (
 	"crawshaw.io/sqlite/sqlitex"
 	"spilled.ink/email"
 	"spilled.ink/email/msgcleaver"
+	"spilled.ink/email/trace"
 	"spilled.ink/spilldb/boxmgmt"
 	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/deliveryhook"
 	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/spilldb/webhook"
 )
 
 type LocalSender struct {
+	// Hook, if set, runs on every delivery to a user.
+	// A delivery it rejects is marked DeliveryFailed.
+	Hook deliveryhook.Hook
+
+	// Fidelity keeps delivered messages byte-identical
+	// where possible, see msgcleaver.CleaveFidelity.
+	Fidelity bool
+
 	ctx      context.Context
 	cancelFn func()
 	done     chan struct{}
@@ -99,16 +111,16 @@ func (p *LocalSender) Run() error {
 		}
 
 		var wg sync.WaitGroup
-		for _, userID := range toSend {
+		for _, stagingID := range toSend {
 			wg.Add(1)
-			go func(userID int64) {
+			go func(stagingID int64) {
 				defer wg.Done()
-				err := p.sendForUser(userID)
+				err := p.sendMsg(stagingID)
 				if err != nil {
 					// TODO plumb logging
-					log.Printf("localsend %v: %v", userID, err)
+					log.Printf("localsend: %v", err)
 				}
-			}(userID)
+			}(stagingID)
 		}
 		wg.Wait()
 	}
@@ -133,6 +145,10 @@ func (p *LocalSender) loadMaxReadyDate() error {
 	return nil
 }
 
+// collectToSend finds messages waiting for delivery to local users.
+//
+// Work is collected by message rather than by user so that a message
+// addressed to several local users is loaded and cleaved only once.
 func (p *LocalSender) collectToSend() (toSend []int64, more bool, err error) {
 	conn := p.dbpool.Get(p.ctx)
 	if conn == nil {
@@ -142,12 +158,13 @@ func (p *LocalSender) collectToSend() (toSend []int64, more bool, err error) {
 
 	const limit = 8
 
-	stmt := conn.Prep(`SELECT DISTINCT UserID
+	stmt := conn.Prep(`SELECT DISTINCT StagingID
 		FROM MsgRecipients
-		INNER JOIN UserAddresses ON UserAddresses.Address = MsgRecipients.Recipient
-		WHERE DeliveryState = $deliveryState
-		ORDER BY UserID LIMIT $limit;`)
+		WHERE DeliveryState = $deliveryState AND UserID IS NOT NULL
+		AND ifnull(DeferUntil, 0) <= $now
+		ORDER BY StagingID LIMIT $limit;`)
 	stmt.SetInt64("$deliveryState", int64(db.DeliveryReceived))
+	stmt.SetInt64("$now", time.Now().Unix())
 	stmt.SetInt64("$limit", limit)
 
 	for {
@@ -156,25 +173,35 @@ func (p *LocalSender) collectToSend() (toSend []int64, more bool, err error) {
 		} else if !hasNext {
 			break
 		}
-		userID := stmt.GetInt64("UserID")
-		toSend = append(toSend, userID)
+		stagingID := stmt.GetInt64("StagingID")
+		toSend = append(toSend, stagingID)
 	}
 
 	more = len(toSend) == limit
 	return toSend, more, nil
 }
 
-func (p *LocalSender) collectMsgsToSend(userID int64) ([]int64, error) {
+func (p *LocalSender) collectRecipients(stagingID int64) ([]int64, error) {
+	conn := p.dbpool.Get(p.ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer p.dbpool.Put(conn)
+
+	return db.CollectLocalRecipients(conn, stagingID)
+}
+
+func (p *LocalSender) collectTags(userID, stagingID int64) ([]string, error) {
 	conn := p.dbpool.Get(p.ctx)
 	if conn == nil {
 		return nil, context.Canceled
 	}
 	defer p.dbpool.Put(conn)
 
-	return db.CollectMsgsToSend(conn, userID, 10, 0)
+	return db.CollectRecipientTags(conn, stagingID, userID)
 }
 
-func (p *LocalSender) setMsgsSent(userID int64, stagingIDs []int64) (err error) {
+func (p *LocalSender) setMsgSent(userID, stagingID, share int64, event webhook.Payload) (err error) {
 	conn := p.dbpool.Get(p.ctx)
 	if conn == nil {
 		return context.Canceled
@@ -186,94 +213,383 @@ func (p *LocalSender) setMsgsSent(userID int64, stagingIDs []int64) (err error)
 		SET DeliveryState = $deliveryDone
 		WHERE StagingID = $stagingID
 		AND DeliveryState = $deliveryReceived
-		AND Recipient IN (SELECT Address FROM UserAddresses WHERE UserID = $userID);`)
+		AND UserID = $userID;`)
 	stmt.SetInt64("$deliveryReceived", int64(db.DeliveryReceived))
 	stmt.SetInt64("$deliveryDone", int64(db.DeliveryDone))
 	stmt.SetInt64("$userID", userID)
-
-	for _, stagingID := range stagingIDs {
-		stmt.Reset()
-		stmt.SetInt64("$stagingID", stagingID)
-		if _, err := stmt.Step(); err != nil {
-			return err
-		}
+	stmt.SetInt64("$stagingID", stagingID)
+	if _, err := stmt.Step(); err != nil {
+		return err
 	}
 
-	return nil
+	if err := db.AddUserStorage(conn, userID, share); err != nil {
+		return err
+	}
+	return webhook.Enqueue(conn, event)
 }
 
-func (p *LocalSender) loadMsg(stagingID int64) (*iox.BufferFile, time.Time, error) {
+func (p *LocalSender) setMsgRejected(userID, stagingID int64) error {
 	conn := p.dbpool.Get(p.ctx)
 	if conn == nil {
-		return nil, time.Time{}, context.Canceled
+		return context.Canceled
 	}
 	defer p.dbpool.Put(conn)
 
-	stmt := conn.Prep("SELECT DateReceived FROM Msgs WHERE StagingID = $stagingID;")
+	stmt := conn.Prep(`UPDATE MsgRecipients
+		SET DeliveryState = $deliveryFailed
+		WHERE StagingID = $stagingID
+		AND DeliveryState = $deliveryReceived
+		AND UserID = $userID;`)
+	stmt.SetInt64("$deliveryReceived", int64(db.DeliveryReceived))
+	stmt.SetInt64("$deliveryFailed", int64(db.DeliveryFailed))
+	stmt.SetInt64("$userID", userID)
 	stmt.SetInt64("$stagingID", stagingID)
-	dateInt, err := sqlitex.ResultInt64(stmt)
+	_, err := stmt.Step()
+	return err
+}
+
+// A delivery that fails is retried after a delay that doubles with
+// each attempt, up to maxRetryDelay. After maxAttempts the recipients
+// are marked DeliveryFailed, so a message that can never be delivered
+// does not hold up the queue.
+const (
+	maxAttempts   = 8
+	minRetryDelay = time.Minute
+	maxRetryDelay = 2 * time.Hour
+)
+
+func retryDelay(attempts int64) time.Duration {
+	d := minRetryDelay
+	for i := int64(1); i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// setMsgDeferred records a failed attempt to deliver stagingID
+// to userID and defers the next one, or gives up on the delivery
+// once it has had maxAttempts.
+func (p *LocalSender) setMsgDeferred(userID, stagingID int64, deliveryErr error) (err error) {
+	// Do not use the context here, a failure
+	// while shutting down is not an attempt.
+	if p.ctx.Err() != nil {
+		return nil
+	}
+	conn := p.dbpool.Get(nil)
+	defer p.dbpool.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := time.Now()
+	stmt := conn.Prep(`INSERT INTO Deliveries (StagingID, Recipient, Code, Date, Details)
+		SELECT StagingID, Recipient, 451, $date, $details FROM MsgRecipients
+		WHERE StagingID = $stagingID
+		AND DeliveryState = $deliveryReceived
+		AND UserID = $userID;`)
+	stmt.SetInt64("$date", now.Unix())
+	stmt.SetText("$details", "local delivery: "+deliveryErr.Error())
+	stmt.SetInt64("$deliveryReceived", int64(db.DeliveryReceived))
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$stagingID", stagingID)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	stmt = conn.Prep(`SELECT ifnull(max(Attempts), 0) FROM (
+		SELECT count(*) AS Attempts FROM Deliveries
+		INNER JOIN MsgRecipients USING (StagingID, Recipient)
+		WHERE StagingID = $stagingID
+		AND DeliveryState = $deliveryReceived
+		AND UserID = $userID
+		GROUP BY Recipient);`)
+	stmt.SetInt64("$deliveryReceived", int64(db.DeliveryReceived))
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$stagingID", stagingID)
+	attempts, err := sqlitex.ResultInt64(stmt)
 	if err != nil {
-		return nil, time.Time{}, err
+		return err
+	}
+
+	if attempts >= maxAttempts {
+		log.Printf("localsend(user %d): staging ID %d: giving up after %d attempts: %v", userID, stagingID, attempts, deliveryErr)
+		stmt = conn.Prep(`UPDATE MsgRecipients
+			SET DeliveryState = $deliveryFailed
+			WHERE StagingID = $stagingID
+			AND DeliveryState = $deliveryReceived
+			AND UserID = $userID;`)
+		stmt.SetInt64("$deliveryFailed", int64(db.DeliveryFailed))
+	} else {
+		stmt = conn.Prep(`UPDATE MsgRecipients
+			SET DeferUntil = $deferUntil
+			WHERE StagingID = $stagingID
+			AND DeliveryState = $deliveryReceived
+			AND UserID = $userID;`)
+		stmt.SetInt64("$deferUntil", now.Add(retryDelay(attempts)).Unix())
 	}
-	date := time.Unix(dateInt, 0)
+	stmt.SetInt64("$deliveryReceived", int64(db.DeliveryReceived))
+	stmt.SetInt64("$userID", userID)
+	stmt.SetInt64("$stagingID", stagingID)
+	_, err = stmt.Step()
+	return err
+}
+
+// msgInfo is what sendMsg needs to know about a message
+// beyond its content.
+type msgInfo struct {
+	date   time.Time
+	sender string
+	dkim   string
+}
+
+func (p *LocalSender) loadMsg(stagingID int64) (*iox.BufferFile, msgInfo, error) {
+	conn := p.dbpool.Get(p.ctx)
+	if conn == nil {
+		return nil, msgInfo{}, context.Canceled
+	}
+	defer p.dbpool.Put(conn)
+
+	stmt := conn.Prep("SELECT DateReceived, Sender, DKIM FROM Msgs WHERE StagingID = $stagingID;")
+	stmt.SetInt64("$stagingID", stagingID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return nil, msgInfo{}, err
+	} else if !hasNext {
+		return nil, msgInfo{}, fmt.Errorf("no message")
+	}
+	info := msgInfo{
+		date:   time.Unix(stmt.GetInt64("DateReceived"), 0),
+		sender: stmt.GetText("Sender"),
+		dkim:   stmt.GetText("DKIM"),
+	}
+	stmt.Reset()
 	buf, err := db.LoadMsg(conn, p.filer, stagingID, false)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, msgInfo{}, err
 	}
-	return buf, date, err
+	return buf, info, err
 }
 
-func (p *LocalSender) sendForUser(userID int64) (err error) {
-	log.Printf("localsend: sending messages for user %v", userID)
+func (p *LocalSender) collectUserRecipients(userID, stagingID int64) (rcpts []string, err error) {
+	conn := p.dbpool.Get(p.ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer p.dbpool.Put(conn)
 
-	user, err := p.boxmgmt.Open(p.ctx, userID)
+	stmt := conn.Prep(`SELECT Recipient FROM MsgRecipients
+		WHERE StagingID = $stagingID AND UserID = $userID
+		ORDER BY Recipient;`)
+	stmt.SetInt64("$stagingID", stagingID)
+	stmt.SetInt64("$userID", userID)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		rcpts = append(rcpts, stmt.GetText("Recipient"))
+	}
+	return rcpts, nil
+}
+
+// sendMsg delivers the message stagingID to all of its local recipients.
+//
+// The message is cleaved once and the resulting parts are inserted
+// into each recipient's spillbox in turn.
+func (p *LocalSender) sendMsg(stagingID int64) (err error) {
+	userIDs, err := p.collectRecipients(stagingID)
 	if err != nil {
-		return err
+		return fmt.Errorf("staging ID %d: %v", stagingID, err)
+	}
+	if len(userIDs) == 0 {
+		return nil
 	}
 
-	stagingIDs, err := p.collectMsgsToSend(userID)
+	// A message that cannot be prepared is a failed attempt
+	// to deliver it to each of its recipients.
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, userID := range userIDs {
+			if derr := p.setMsgDeferred(userID, stagingID, err); derr != nil {
+				log.Printf("localsend(user %d): staging ID %d: %v", userID, stagingID, derr)
+			}
+		}
+		err = fmt.Errorf("staging ID %d: %v", stagingID, err)
+	}()
+
+	src, info, err := p.loadMsg(stagingID)
 	if err != nil {
 		return err
 	}
+	defer src.Close() // kept for hooks
+	cleave := msgcleaver.Cleave
+	if p.Fidelity {
+		cleave = msgcleaver.CleaveFidelity
+	}
+	// This is final delivery, so the envelope sender is recorded
+	// in a Return-Path field, RFC 5321 section 4.4.
+	msg, err := cleave(p.filer, trace.NewReader(src, trace.ReturnPath(info.sender)))
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+	msg.Date = info.date
 
-	for _, stagingID := range stagingIDs {
-		if err := p.sendMsg(userID, user, stagingID); err != nil {
+	shares := db.StorageShares(msg.EncodedSize, len(userIDs))
+	for i, userID := range userIDs {
+		if err := p.sendMsgToUser(userID, stagingID, msg, src, info, shares[i]); err != nil {
 			// TODO plumb logging
-			log.Printf("localsend(user %d): %v", userID, err)
-			// continue, don't let a bad message block others
+			log.Printf("localsend(user %d): staging ID %d: %v", userID, stagingID, err)
+			if err := p.setMsgDeferred(userID, stagingID, err); err != nil {
+				log.Printf("localsend(user %d): staging ID %d: %v", userID, stagingID, err)
+			}
+			// continue, don't let a bad mailbox block other recipients
 		}
 	}
 	return nil
 }
 
-func (p *LocalSender) sendMsg(userID int64, user *boxmgmt.User, stagingID int64) (err error) {
-	src, date, err := p.loadMsg(stagingID)
+func (p *LocalSender) sendMsgToUser(userID, stagingID int64, msg *email.Msg, raw email.Buffer, info msgInfo, share int64) error {
+	user, err := p.boxmgmt.Open(p.ctx, userID)
 	if err != nil {
-		src.Close()
-		return fmt.Errorf("staging ID %d: %v", stagingID, err)
+		return err
 	}
-	msg, err := msgcleaver.Cleave(p.filer, src)
-	src.Close()
+	tags, err := p.collectTags(userID, stagingID)
 	if err != nil {
-		return fmt.Errorf("staging ID %d: %v", stagingID, err)
+		return err
+	}
+
+	// The cleaved msg is shared by all recipients.
+	// Clear the fields InsertMsg fills out for the previous user.
+	msg.MsgID = 0
+	msg.MailboxID = 0
+	msg.Tags = tags
+	for i := range msg.Parts {
+		msg.Parts[i].BlobID = 0
 	}
-	log.Printf("localsender setting date=%v", date)
-	msg.Date = date
-	err = insertMsg(p.ctx, user.Box, msg, stagingID)
-	msg.Close()
+	flags := recentFlag
+
+	rcpts, err := p.collectUserRecipients(userID, stagingID)
 	if err != nil {
-		return fmt.Errorf("staging ID %d: %v", stagingID, err)
+		return err
+	}
+	msg.EnvelopeFrom = info.sender
+	msg.EnvelopeTo = rcpts
+
+	if p.Hook != nil {
+		// Hooks change the headers of this delivery only.
+		hdrs := msg.Headers
+		msg.Headers = copyHeader(hdrs)
+		defer func() { msg.Headers = hdrs }()
+
+		d := &deliveryhook.Delivery{
+			Envelope: deliveryhook.Envelope{
+				StagingID:  stagingID,
+				Sender:     info.sender,
+				Recipients: rcpts,
+				UserID:     userID,
+				DKIM:       info.dkim,
+			},
+			Msg:   msg,
+			Raw:   raw,
+			Flags: append([]string(nil), flags...),
+		}
+		if err := p.Hook.Deliver(p.ctx, d); err != nil {
+			if rejectErr, ok := err.(*deliveryhook.RejectError); ok {
+				log.Printf("localsend(user %d): staging ID %d: %v", userID, stagingID, rejectErr)
+				return p.setMsgRejected(userID, stagingID)
+			}
+			return err
+		}
+		flags = d.Flags
+		if d.Mailbox != "" {
+			mailboxID, err := findMailbox(p.ctx, user.Box, d.Mailbox)
+			if err != nil {
+				return err
+			}
+			msg.MailboxID = mailboxID
+		}
 	}
 
-	stagingIDsDone := []int64{stagingID}
-	if err := p.setMsgsSent(userID, stagingIDsDone); err != nil {
+	if err := insertMsg(p.ctx, user.Box, msg, flags, stagingID); err != nil {
 		return err
 	}
-	return nil
+
+	if info.sender == "" {
+		// A notification with the null return path may be
+		// a bounce of mail this user sent.
+		if err := p.recordBounce(user.Box, userID, rcpts, raw); err != nil {
+			log.Printf("localsend(user %d): staging ID %d: %v", userID, stagingID, err)
+		}
+	}
+
+	mailbox, junk, err := filedIn(p.ctx, user.Box, msg.MailboxID)
+	if err != nil {
+		return err
+	}
+	subject := string(msg.Headers.Get("Subject"))
+	if s, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = s
+	}
+	event := webhook.Payload{
+		Event:     webhook.EventDelivered,
+		UserID:    userID,
+		StagingID: stagingID,
+		MsgID:     int64(msg.MsgID),
+		Mailbox:   mailbox,
+		From:      info.sender,
+		Subject:   subject,
+	}
+	if junk {
+		event.Event = webhook.EventSpam
+	}
+	return p.setMsgSent(userID, stagingID, share, event)
+}
+
+func copyHeader(hdr email.Header) email.Header {
+	c := email.Header{
+		Entries: append([]email.HeaderEntry(nil), hdr.Entries...),
+		Index:   make(map[email.Key][][]byte),
+	}
+	for _, entry := range c.Entries {
+		c.Index[entry.Key] = append(c.Index[entry.Key], entry.Value)
+	}
+	return c
+}
+
+func findMailbox(ctx context.Context, c *spillbox.Box, name string) (int64, error) {
+	conn := c.PoolRO.Get(ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer c.PoolRO.Put(conn)
+	return spillbox.FindMailbox(conn, name)
+}
+
+// filedIn reports the name of the mailbox a message was filed in
+// and whether it is a \Junk mailbox.
+func filedIn(ctx context.Context, c *spillbox.Box, mailboxID int64) (name string, junk bool, err error) {
+	conn := c.PoolRO.Get(ctx)
+	if conn == nil {
+		return "", false, context.Canceled
+	}
+	defer c.PoolRO.Put(conn)
+	stmt := conn.Prep("SELECT Name FROM Mailboxes WHERE MailboxID = $mailboxID;")
+	stmt.SetInt64("$mailboxID", mailboxID)
+	if name, err = sqlitex.ResultText(stmt); err != nil {
+		return "", false, err
+	}
+	if junk, err = spillbox.IsJunkMailbox(conn, mailboxID); err != nil {
+		return "", false, err
+	}
+	return name, junk, nil
 }
 
-func insertMsg(ctx context.Context, c *spillbox.Box, msg *email.Msg, stagingID int64) (err error) {
-	msg.Flags = recentFlag
+func insertMsg(ctx context.Context, c *spillbox.Box, msg *email.Msg, flags []string, stagingID int64) (err error) {
+	msg.Flags = flags
 	done, err := c.InsertMsg(ctx, msg, stagingID)
 	if err != nil {
 		return err
@@ -0,0 +1,227 @@
+// Package migrate versions the schema of an SQLite database.
+//
+// A database schema is described by a script of CREATE ... IF NOT
+// EXISTS statements, which creates the tables of a new database and
+// any tables and indexes added since an existing one was created.
+// Changes the script cannot make to an existing database, such as
+// new columns or rewritten triggers, are made by Steps.
+//
+// Steps are numbered. The SchemaMigrations table records the steps
+// applied to a database, and a new database has every step recorded
+// as applied when it is created by the script.
+//
+// A database created before this package was used has no steps
+// recorded, so every step runs on it. Steps should check what they
+// change, as AddColumns does, so they are harmless on a database
+// that already has the change.
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Step is one change to the schema of a database.
+type Step struct {
+	Version int    // from 1, increasing, never reused
+	Name    string // describes the change
+	SQL     string // script run by the step
+
+	// Fn, if set, is run before SQL.
+	Fn func(conn *sqlite.Conn) error
+}
+
+const createSQL = `CREATE TABLE IF NOT EXISTS SchemaMigrations (
+	Version INTEGER PRIMARY KEY,
+	Name    TEXT NOT NULL,
+	Applied INTEGER NOT NULL -- time.Unix
+);`
+
+// Init creates the schema of the database on conn with the script
+// createSQL, or brings the schema of an existing database up to date
+// by running its pending steps before createSQL.
+//
+// Init runs in a single transaction. If a step fails, the database
+// is left as it was.
+func Init(conn *sqlite.Conn, createSQL string, steps []Step) (err error) {
+	if err := check(steps); err != nil {
+		return err
+	}
+	defer sqlitex.Save(conn)(&err)
+
+	empty, err := isEmpty(conn)
+	if err != nil {
+		return err
+	}
+	var pending []Step
+	if empty {
+		if err := sqlitex.ExecScript(conn, createSQL); err != nil {
+			return err
+		}
+		if err := createTable(conn); err != nil {
+			return err
+		}
+		pending = steps
+	} else {
+		if pending, err = pendingSteps(conn, steps); err != nil {
+			return err
+		}
+		if err := createTable(conn); err != nil {
+			return err
+		}
+		for _, step := range pending {
+			if err := apply(conn, step); err != nil {
+				return fmt.Errorf("migrate: step %d, %s: %v", step.Version, step.Name, err)
+			}
+		}
+		if err := sqlitex.ExecScript(conn, createSQL); err != nil {
+			return err
+		}
+	}
+
+	stmt := conn.Prep(`INSERT INTO SchemaMigrations (Version, Name, Applied)
+		VALUES ($version, $name, $applied);`)
+	now := time.Now().Unix()
+	for _, step := range pending {
+		stmt.Reset()
+		stmt.SetInt64("$version", int64(step.Version))
+		stmt.SetText("$name", step.Name)
+		stmt.SetInt64("$applied", now)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending reports the steps Init would apply to the database on conn.
+// A new database has none.
+func Pending(conn *sqlite.Conn, steps []Step) ([]Step, error) {
+	if err := check(steps); err != nil {
+		return nil, err
+	}
+	empty, err := isEmpty(conn)
+	if err != nil || empty {
+		return nil, err
+	}
+	return pendingSteps(conn, steps)
+}
+
+// Version reports the last step applied to the database on conn,
+// 0 if none.
+func Version(conn *sqlite.Conn) (int, error) {
+	if ok, err := hasTable(conn, "SchemaMigrations"); err != nil || !ok {
+		return 0, err
+	}
+	version, err := sqlitex.ResultInt64(conn.Prep("SELECT coalesce(max(Version), 0) FROM SchemaMigrations;"))
+	return int(version), err
+}
+
+func check(steps []Step) error {
+	for i, step := range steps {
+		if step.Version != i+1 {
+			return fmt.Errorf("migrate: step %q has version %d, want %d", step.Name, step.Version, i+1)
+		}
+	}
+	return nil
+}
+
+func pendingSteps(conn *sqlite.Conn, steps []Step) ([]Step, error) {
+	applied := make(map[int]bool)
+	if ok, err := hasTable(conn, "SchemaMigrations"); err != nil {
+		return nil, err
+	} else if ok {
+		stmt := conn.Prep("SELECT Version FROM SchemaMigrations;")
+		for {
+			if hasNext, err := stmt.Step(); err != nil {
+				return nil, err
+			} else if !hasNext {
+				break
+			}
+			applied[int(stmt.GetInt64("Version"))] = true
+		}
+	}
+	for version := range applied {
+		if version > len(steps) {
+			return nil, fmt.Errorf("migrate: database has schema version %d, newer than this program's %d", version, len(steps))
+		}
+	}
+
+	var pending []Step
+	for _, step := range steps {
+		if !applied[step.Version] {
+			pending = append(pending, step)
+		}
+	}
+	return pending, nil
+}
+
+func apply(conn *sqlite.Conn, step Step) error {
+	if step.Fn != nil {
+		if err := step.Fn(conn); err != nil {
+			return err
+		}
+	}
+	if step.SQL != "" {
+		if err := sqlitex.ExecScript(conn, step.SQL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createTable(conn *sqlite.Conn) error {
+	return sqlitex.ExecTransient(conn, createSQL, nil)
+}
+
+// isEmpty reports whether the main database has no tables.
+func isEmpty(conn *sqlite.Conn) (bool, error) {
+	n, err := sqlitex.ResultInt64(conn.Prep(`SELECT count(*) FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%';`))
+	return n == 0, err
+}
+
+func hasTable(conn *sqlite.Conn, table string) (bool, error) {
+	stmt := conn.Prep("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = $name;")
+	stmt.SetText("$name", table)
+	n, err := sqlitex.ResultInt64(stmt)
+	return n > 0, err
+}
+
+// AddColumns returns a Step.Fn that adds columns to a table of the
+// main database. Each column is given as it is in CREATE TABLE,
+// "Name TYPE [constraints]". Columns the table already has are
+// skipped, as is a table that does not exist: the schema script
+// creates it with the columns.
+func AddColumns(table string, columns ...string) func(conn *sqlite.Conn) error {
+	return func(conn *sqlite.Conn) error {
+		have := make(map[string]bool)
+		stmt := conn.Prep("SELECT name FROM pragma_table_info($table);")
+		stmt.SetText("$table", table)
+		for {
+			if hasNext, err := stmt.Step(); err != nil {
+				return err
+			} else if !hasNext {
+				break
+			}
+			have[strings.ToLower(stmt.GetText("name"))] = true
+		}
+		if len(have) == 0 {
+			return nil // no table
+		}
+		for _, col := range columns {
+			name := strings.Fields(col)[0]
+			if have[strings.ToLower(name)] {
+				continue
+			}
+			if err := sqlitex.ExecTransient(conn, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, col), nil); err != nil {
+				return fmt.Errorf("adding %s.%s: %v", table, name, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+const schemaV1 = `CREATE TABLE IF NOT EXISTS Msgs (
+	MsgID INTEGER PRIMARY KEY,
+	Body  TEXT
+);`
+
+const schemaV2 = `CREATE TABLE IF NOT EXISTS Msgs (
+	MsgID INTEGER PRIMARY KEY,
+	Body  TEXT,
+	Size  INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS MsgsSize ON Msgs (Size);`
+
+var steps = []Step{
+	{
+		Version: 1,
+		Name:    "Msgs.Size",
+		Fn:      AddColumns("Msgs", "Size INTEGER NOT NULL DEFAULT 0"),
+		SQL:     "UPDATE Msgs SET Size = length(Body);",
+	},
+}
+
+func TestInit(t *testing.T) {
+	conn, err := sqlite.OpenConn("file::memory:?mode=memory", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A database from before versioning.
+	if err := sqlitex.ExecScript(conn, schemaV1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.Exec(conn, "INSERT INTO Msgs (Body) VALUES ('hello');", nil); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := Pending(conn, steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("pending=%v, want step 1", pending)
+	}
+
+	if err := Init(conn, schemaV2, steps); err != nil {
+		t.Fatal(err)
+	}
+	size, err := sqlitex.ResultInt64(conn.Prep("SELECT Size FROM Msgs;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 5 {
+		t.Errorf("Size=%d, want 5", size)
+	}
+	if v, err := Version(conn); err != nil || v != 1 {
+		t.Errorf("Version=%d, %v, want 1", v, err)
+	}
+	if pending, err := Pending(conn, steps); err != nil || len(pending) != 0 {
+		t.Errorf("pending after Init: %v, %v", pending, err)
+	}
+
+	// Running Init again is a no-op.
+	if err := Init(conn, schemaV2, steps); err != nil {
+		t.Fatal(err)
+	}
+
+	// A program older than the database refuses it.
+	if err := Init(conn, schemaV2, nil); err == nil {
+		t.Error("Init with fewer steps than applied succeeded")
+	}
+}
+
+func TestInitNew(t *testing.T) {
+	conn, err := sqlite.OpenConn("file::memory:?mode=memory", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if pending, err := Pending(conn, steps); err != nil || len(pending) != 0 {
+		t.Errorf("new database pending: %v, %v", pending, err)
+	}
+	if err := Init(conn, schemaV2, steps); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := Version(conn); err != nil || v != 1 {
+		t.Errorf("Version=%d, %v, want 1", v, err)
+	}
+}
+
+func TestInitBadSteps(t *testing.T) {
+	conn, err := sqlite.OpenConn("file::memory:?mode=memory", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	bad := []Step{{Version: 2, Name: "skipped 1"}}
+	if err := Init(conn, schemaV2, bad); err == nil {
+		t.Error("steps out of order accepted")
+	}
+}
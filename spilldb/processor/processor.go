@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"crawshaw.io/iox"
@@ -23,9 +24,14 @@ import (
 	"spilled.ink/email/msgcleaver"
 	"spilled.ink/html/htmlembed"
 	"spilled.ink/spilldb/db"
+	"spilled.ink/util/dnscache"
 )
 
 type Processor struct {
+	// Fidelity keeps received messages byte-identical
+	// where possible, see msgcleaver.CleaveFidelity.
+	Fidelity bool
+
 	ctx      context.Context
 	cancelFn func()
 	done     chan struct{}
@@ -40,11 +46,29 @@ type Processor struct {
 
 	maxReadyDateMu sync.Mutex
 	maxReadyDate   int64
+
+	processed   int64 // accessed atomically
+	quarantined int64 // accessed atomically
+}
+
+// Stats are counts of the messages a Processor has handled.
+type Stats struct {
+	Processed   int64 // messages ready for local delivery
+	Quarantined int64 // messages that failed to parse, see db.Quarantine
 }
 
-func NewProcessor(dbpool *sqlitex.Pool, filer *iox.Filer, httpc *webfetch.Client, localSend func(stagingID int64)) *Processor {
+func (p *Processor) Stats() Stats {
+	return Stats{
+		Processed:   atomic.LoadInt64(&p.processed),
+		Quarantined: atomic.LoadInt64(&p.quarantined),
+	}
+}
+
+// NewProcessor creates a Processor. If resolver is non-nil,
+// it is used for the DNS lookups of DKIM verification.
+func NewProcessor(dbpool *sqlitex.Pool, filer *iox.Filer, httpc *webfetch.Client, resolver *dnscache.Resolver, localSend func(stagingID int64)) *Processor {
 	ctx, cancelFn := context.WithCancel(context.Background())
-	return &Processor{
+	p := &Processor{
 		ctx:      ctx,
 		cancelFn: cancelFn,
 		done:     make(chan struct{}),
@@ -57,6 +81,10 @@ func NewProcessor(dbpool *sqlitex.Pool, filer *iox.Filer, httpc *webfetch.Client
 
 		newmsg: make(chan struct{}, 1),
 	}
+	if resolver != nil {
+		p.dkim.LookupTXT = resolver.LookupTXT
+	}
+	return p
 }
 
 func (p *Processor) Process(stagingID int64) {
@@ -197,9 +225,13 @@ func (p *Processor) process(stagingID int64) (err error) {
 	}
 	rawMsg.Seek(0, 0)
 
-	msg, err := msgcleaver.Cleave(p.filer, rawMsg)
+	cleave := msgcleaver.Cleave
+	if p.Fidelity {
+		cleave = msgcleaver.CleaveFidelity
+	}
+	msg, err := cleave(p.filer, rawMsg)
 	if err != nil {
-		return err
+		return p.quarantine(stagingID, err)
 	}
 	defer msg.Close()
 	htmlPart := findBodyHTML(msg)
@@ -227,6 +259,7 @@ func (p *Processor) process(stagingID int64) (err error) {
 		htmlPart.Content = html.HTML
 
 		msg.EncodedSize = 0
+		msg.Skeleton = nil
 
 		for _, asset := range html.Assets {
 			if asset.LoadError != nil {
@@ -261,6 +294,7 @@ func (p *Processor) process(stagingID int64) (err error) {
 		return err
 	}
 
+	atomic.AddInt64(&p.processed, 1)
 	if p.localSend != nil {
 		p.localSend(stagingID)
 	}
@@ -268,6 +302,23 @@ func (p *Processor) process(stagingID int64) (err error) {
 	return nil
 }
 
+// quarantine sets aside a message that cannot be parsed, keeping
+// its raw bytes so it can be reparsed after the parser is fixed.
+func (p *Processor) quarantine(stagingID int64, parseErr error) error {
+	conn := p.dbpool.Get(p.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer p.dbpool.Put(conn)
+
+	if err := db.Quarantine(conn, stagingID, parseErr); err != nil {
+		return err
+	}
+	atomic.AddInt64(&p.quarantined, 1)
+	log.Printf("processor: staging ID %d quarantined: %v", stagingID, parseErr)
+	return nil
+}
+
 func (p *Processor) processSave(stagingID int64, dkimStatus string, data email.Buffer) (err error) {
 	conn := p.dbpool.Get(p.ctx)
 	if conn == nil {
@@ -304,8 +355,10 @@ func (p *Processor) processSave(stagingID int64, dkimStatus string, data email.B
 		return err
 	}
 
-	stmt = conn.Prep("UPDATE MsgRecipients SET DeliveryState = $deliveryState WHERE StagingID = $stagingID;")
+	stmt = conn.Prep(`UPDATE MsgRecipients SET DeliveryState = $deliveryState
+		WHERE StagingID = $stagingID AND DeliveryState = $deliveryToProcess;`)
 	stmt.SetInt64("$deliveryState", db.DeliveryReceived)
+	stmt.SetInt64("$deliveryToProcess", db.DeliveryToProcess)
 	stmt.SetInt64("$stagingID", stagingID)
 	if _, err := stmt.Step(); err != nil {
 		return err
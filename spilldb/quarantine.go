@@ -0,0 +1,89 @@
+package spilldb
+
+import (
+	"context"
+
+	"spilled.ink/email/msgcleaver"
+	"spilled.ink/spilldb/db"
+)
+
+// QuarantineStats report on incoming messages that could not be
+// parsed, so that parser regressions are noticed.
+type QuarantineStats struct {
+	Processed   int64 // messages parsed since the server started
+	Quarantined int64 // messages that failed to parse since then
+	Pending     int64 // quarantined messages waiting to be reparsed
+}
+
+func (s *Server) QuarantineStats() QuarantineStats {
+	ps := s.Processor.Stats()
+	stats := QuarantineStats{
+		Processed:   ps.Processed,
+		Quarantined: ps.Quarantined,
+	}
+	conn := s.DB.Get(nil)
+	defer s.DB.Put(conn)
+	if n, err := db.CountQuarantined(conn); err == nil {
+		stats.Pending = n
+	}
+	return stats
+}
+
+// Reparse runs the quarantined messages of a user, or with a userID
+// of 0 of every user, through the cleaver again. Messages that now
+// parse are released to be processed and delivered, the rest stay
+// quarantined with their latest parse error.
+func (s *Server) Reparse(ctx context.Context, userID int64) (released, failed int, err error) {
+	conn := s.DB.Get(ctx)
+	if conn == nil {
+		return 0, 0, context.Canceled
+	}
+	msgs, err := db.QuarantinedMsgs(conn, userID)
+	s.DB.Put(conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, m := range msgs {
+		ok, err := s.ReparseMsg(ctx, m.StagingID)
+		if err != nil {
+			return released, failed, err
+		}
+		if ok {
+			released++
+		} else {
+			failed++
+		}
+	}
+	return released, failed, nil
+}
+
+// ReparseMsg runs a quarantined message through the cleaver again,
+// releasing it if it now parses. It reports whether it parsed.
+func (s *Server) ReparseMsg(ctx context.Context, stagingID int64) (bool, error) {
+	conn := s.DB.Get(ctx)
+	if conn == nil {
+		return false, context.Canceled
+	}
+	defer s.DB.Put(conn)
+
+	raw, err := db.LoadMsg(conn, s.Filer, stagingID, true)
+	if err != nil {
+		return false, err
+	}
+	defer raw.Close()
+
+	msg, parseErr := msgcleaver.Cleave(s.Filer, raw)
+	if parseErr != nil {
+		return false, db.Quarantine(conn, stagingID, parseErr)
+	}
+	msg.Close()
+
+	released, err := db.ReleaseQuarantined(conn, stagingID)
+	if err != nil {
+		return false, err
+	}
+	if released {
+		s.Processor.Process(stagingID)
+	}
+	return true, nil
+}
@@ -0,0 +1,46 @@
+package spilldb
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter counts the messages sent by each remote IP address
+// over fixed one hour windows.
+type rateLimiter struct {
+	mu          sync.Mutex
+	msgsPerHour int // 0 means no limit
+	window      time.Time
+	counts      map[string]int // remote IP -> msgs in window
+}
+
+func (r *rateLimiter) setLimit(msgsPerHour int) {
+	r.mu.Lock()
+	r.msgsPerHour = msgsPerHour
+	r.mu.Unlock()
+}
+
+// allow reports whether remoteAddr may send another message.
+func (r *rateLimiter) allow(remoteAddr net.Addr, now time.Time) bool {
+	ip := remoteAddr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.msgsPerHour <= 0 {
+		return true
+	}
+	if now.Sub(r.window) >= time.Hour || r.counts == nil {
+		r.window = now
+		r.counts = make(map[string]int)
+	}
+	if r.counts[ip] >= r.msgsPerHour {
+		return false
+	}
+	r.counts[ip]++
+	return true
+}
@@ -0,0 +1,35 @@
+package spilldb
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var r rateLimiter
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1025}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1025}
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if !r.allow(a, now) {
+			t.Fatal("unlimited rate limiter denied a message")
+		}
+	}
+
+	r.setLimit(2)
+	if !r.allow(a, now) || !r.allow(a, now.Add(time.Second)) {
+		t.Fatal("message under the limit denied")
+	}
+	a.Port = 1026 // same IP, new connection
+	if r.allow(a, now.Add(2*time.Second)) {
+		t.Error("message over the limit allowed")
+	}
+	if !r.allow(b, now.Add(2*time.Second)) {
+		t.Error("limit shared by different IPs")
+	}
+	if !r.allow(a, now.Add(time.Hour)) {
+		t.Error("limit not reset after an hour")
+	}
+}
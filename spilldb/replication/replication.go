@@ -0,0 +1,248 @@
+// Package replication copies user mailboxes to a standby spilld.
+//
+// The primary serves the changes recorded by its mailboxes, see
+// spillbox.Box.EnableReplication, with a Handler. A Standby polls
+// the primary and applies the changes to its own mailboxes.
+// Requests carry a shared bearer token.
+//
+// Only mailboxes are replicated. The spilld database, with its
+// users, devices, and blob keys, is copied to the standby by the
+// operator, as is any mailbox seeded from a backup.
+package replication
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"spilled.ink/spilldb/boxmgmt"
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/spillbox"
+)
+
+// batchSize is the most ReplLog entries sent in one response.
+const batchSize = 256
+
+// Handler serves the changes of the mailboxes on a primary:
+//
+//	GET /replication/users
+//	GET /replication/user/{userID}?after={seq}
+//
+// The first lists user IDs, the second the spillbox.ReplEvents
+// of a user after the standby's position.
+type Handler struct {
+	BoxMgmt *boxmgmt.BoxMgmt
+	Token   string
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, h.Token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	var res interface{}
+	switch {
+	case r.URL.Path == "/replication/users":
+		userIDs, err := h.BoxMgmt.UserIDs(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res = userIDs
+	case strings.HasPrefix(r.URL.Path, "/replication/user/"):
+		userID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/replication/user/"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad user ID", http.StatusBadRequest)
+			return
+		}
+		after, err := strconv.ParseInt(r.FormValue("after"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad after", http.StatusBadRequest)
+			return
+		}
+		u, err := h.BoxMgmt.Open(ctx, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		events, err := u.Box.ReplEvents(ctx, after, batchSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res = events
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	got := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Standby keeps the mailboxes of a standby spilld up to date
+// with the primary.
+type Standby struct {
+	Primary  string // base URL of the primary's Handler
+	Token    string
+	Client   *http.Client // default http.DefaultClient
+	Interval time.Duration
+	Logf     func(format string, v ...interface{})
+
+	ctx      context.Context
+	cancelFn func()
+	done     chan struct{}
+
+	bm *boxmgmt.BoxMgmt
+}
+
+func NewStandby(bm *boxmgmt.BoxMgmt, primary, token string) *Standby {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &Standby{
+		Primary:  strings.TrimSuffix(primary, "/"),
+		Token:    token,
+		Interval: 5 * time.Second,
+		Logf:     func(format string, v ...interface{}) {},
+		ctx:      ctx,
+		cancelFn: cancelFn,
+		done:     make(chan struct{}),
+		bm:       bm,
+	}
+}
+
+func (s *Standby) Run() error {
+	defer func() { close(s.done) }()
+
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	for {
+		if err := s.sync(); err != nil {
+			if err == context.Canceled {
+				return nil
+			}
+			s.Logf("%s", db.Log{
+				What:  "sync",
+				Where: "replication",
+				When:  time.Now(),
+				Err:   err,
+			})
+		}
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Standby) Shutdown(ctx context.Context) error {
+	s.cancelFn()
+	<-s.done
+	return nil
+}
+
+func (s *Standby) sync() error {
+	var userIDs []int64
+	if err := s.get("/replication/users", &userIDs); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := s.syncUser(userID); err != nil {
+			if err == context.Canceled {
+				return err
+			}
+			s.Logf("%s", db.Log{
+				What:   "sync",
+				Where:  "replication",
+				When:   time.Now(),
+				UserID: userID,
+				Err:    err,
+			})
+		}
+	}
+	return nil
+}
+
+// syncUser applies the changes to a mailbox until it is caught up.
+func (s *Standby) syncUser(userID int64) error {
+	u, err := s.bm.Open(s.ctx, userID)
+	if err != nil {
+		return err
+	}
+	for {
+		applied, err := u.Box.ReplApplied(s.ctx)
+		if err != nil {
+			return err
+		}
+		var events []spillbox.ReplEvent
+		path := fmt.Sprintf("/replication/user/%d?after=%d", userID, applied)
+		if err := s.get(path, &events); err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if err := u.Box.ApplyReplEvents(s.ctx, events); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Standby) get(path string, v interface{}) error {
+	u, err := url.Parse(s.Primary + path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(s.ctx)
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return context.Canceled
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("replication: %s: %s: %s", path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("replication: %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package replication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerUnauthorized(t *testing.T) {
+	tests := []struct {
+		token, auth string
+	}{
+		{"", ""},
+		{"", "Bearer "},
+		{"secret", ""},
+		{"secret", "Bearer wrong"},
+		{"secret", "secret"},
+	}
+	for _, test := range tests {
+		h := &Handler{Token: test.token}
+		req := httptest.NewRequest("GET", "/replication/users", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q, Authorization %q: status %d, want %d", test.token, test.auth, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
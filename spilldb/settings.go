@@ -0,0 +1,128 @@
+package spilldb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bounds the resources used by the network servers.
+// A zero value uses the server's default.
+//
+// Limits are read when a server starts serving.
+type Limits struct {
+	MaxMsgSize      int // bytes
+	MaxSMTPSessions int // concurrent sessions per SMTP or MSA listener
+	MaxRecipients   int // per message
+	MaxSMTPMsgs     int // per SMTP or MSA connection, 0 means no limit
+	MaxIMAPConns    int // concurrent connections per IMAP listener
+
+	// Logged in connections per IMAP listener.
+	MaxIMAPConnsPerUser int
+	MaxIMAPConnsPerIP   int
+
+	// Finding dead IMAP connections, see imapserver.Server.
+	IMAPKeepAlive     time.Duration // TCP keepalive period
+	IMAPIdleHeartbeat time.Duration // "* OK still here" during IDLE
+	IMAPAckTimeout    time.Duration // unacknowledged writes before a drop
+
+	// IMAPLiteralMemSize is how many bytes of an IMAP literal are
+	// held in memory before it is written to a temporary file.
+	IMAPLiteralMemSize int
+
+	// IMAPSlowCommand is the latency past which an IMAP command
+	// is logged with its timing, see imapserver.Server.SlowCommand.
+	IMAPSlowCommand time.Duration
+
+	// Failed logins from an IP address for a username before the
+	// pair is locked out, and the longest lockout. See db.Lockout.
+	MaxLoginFailures int
+	MaxLoginLockout  time.Duration
+
+	// SendDelay is how long mail submitted to the MSA is held
+	// before it is sent, so the sender can withdraw it with
+	// CancelSend. Users can have their own, see db.SetSendDelay.
+	SendDelay time.Duration
+}
+
+// LogLevel is the verbosity of a Server.
+type LogLevel int32
+
+const (
+	LogQuiet LogLevel = iota // only errors that stop a server
+	LogInfo                  // server events, the default
+	LogDebug                 // verbose, IMAP transcripts are separate, see Server.IMAPDebug
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogQuiet:
+		return "quiet"
+	case LogInfo:
+		return "info"
+	case LogDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+// ParseLogLevel parses "quiet", "info", or "debug".
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "quiet":
+		return LogQuiet, nil
+	case "", "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	}
+	return 0, fmt.Errorf("spilldb: unknown log level %q", s)
+}
+
+// SetLogLevel sets the verbosity of the server.
+// It is safe to call while the server is running.
+//
+// Logf is called at any level, it is up to the
+// owner of Logf to consult LogLevel.
+func (s *Server) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32((*int32)(&s.logLevel), int32(level))
+}
+
+func (s *Server) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32((*int32)(&s.logLevel)))
+}
+
+// SetRateLimit limits the messages the SMTP servers accept from
+// each remote IP address in an hour. Zero means no limit.
+// It is safe to call while the server is running.
+func (s *Server) SetRateLimit(msgsPerHour int) {
+	s.rateLimit.setLimit(msgsPerHour)
+}
+
+// SetAPNSCert sets the certificate used for Apple push notifications.
+//
+// If the IMAP servers are already running with APNS, the new
+// certificate is used for subsequent notifications. APNS cannot
+// be enabled or disabled on running servers.
+func (s *Server) SetAPNSCert(cert *tls.Certificate) error {
+	s.apnsMu.Lock()
+	defer s.apnsMu.Unlock()
+
+	if s.serving {
+		if cert != nil && len(s.apns) == 0 {
+			return fmt.Errorf("spilldb: APNS cannot be enabled while serving")
+		}
+		if cert == nil && len(s.apns) > 0 {
+			return fmt.Errorf("spilldb: APNS cannot be disabled while serving")
+		}
+	}
+	for _, apns := range s.apns {
+		if err := apns.SetCertificate(*cert); err != nil {
+			return fmt.Errorf("spilldb: %v", err)
+		}
+	}
+	s.APNSCert = cert
+	return nil
+}
@@ -0,0 +1,120 @@
+package smtpdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+	"spilled.ink/smtp/smtpserver"
+	"spilled.ink/spilldb/db"
+	"spilled.ink/third_party/imf"
+)
+
+// SenderPolicy is what the MSA does with mail submitted by a user
+// from an address they may not send as, see db.CanSendAs.
+type SenderPolicy int
+
+const (
+	SenderReject  SenderPolicy = iota // refuse the message
+	SenderRewrite                     // send it from the user's primary address
+)
+
+func (p SenderPolicy) String() string {
+	switch p {
+	case SenderReject:
+		return "reject"
+	case SenderRewrite:
+		return "rewrite"
+	}
+	return fmt.Sprintf("SenderPolicy(%d)", int(p))
+}
+
+func errSenderNotAllowed(what, addr string) error {
+	return &smtpserver.ReplyError{
+		Code:   550,
+		Status: "5.7.1",
+		Msg:    fmt.Sprintf("%s address %q is not one of your addresses", what, addr),
+	}
+}
+
+// checkFrom reports the addresses in the From header of a message
+// the user may not send as. The reader is left at an unknown offset.
+func checkFrom(conn *sqlite.Conn, userID int64, r io.Reader) (name string, denied []string, err error) {
+	hdr, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return "", nil, fmt.Errorf("reading header: %v", err)
+	}
+	for _, v := range hdr["From"] {
+		addrs, err := imf.ParseAddressList(v)
+		if err != nil {
+			return "", []string{strings.TrimSpace(v)}, nil
+		}
+		for _, a := range addrs {
+			if name == "" {
+				name = a.Name
+			}
+			ok, err := db.CanSendAs(conn, userID, a.Addr)
+			if err != nil {
+				return "", nil, err
+			}
+			if !ok {
+				denied = append(denied, a.Addr)
+			}
+		}
+	}
+	return name, denied, nil
+}
+
+// rewriteFrom copies a message from src to dst, replacing any
+// From header fields with a single field for the address from.
+func rewriteFrom(dst io.Writer, src io.Reader, from email.Address) error {
+	br := bufio.NewReader(src)
+	bw := bufio.NewWriter(dst)
+	wroteFrom := false
+	inFrom := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header, copy the body.
+			if !wroteFrom {
+				fmt.Fprintf(bw, "From: %s\r\n", imf.FormatAddress(&from))
+				wroteFrom = true
+			}
+			bw.Write(line)
+			if _, err := io.Copy(bw, br); err != nil {
+				return err
+			}
+			break
+		}
+		if inFrom && (line[0] == ' ' || line[0] == '\t') {
+			continue // continuation of a From field
+		}
+		inFrom = false
+		if len(line) > 5 && strings.EqualFold(string(line[:5]), "from:") {
+			inFrom = true
+			if !wroteFrom {
+				fmt.Fprintf(bw, "From: %s\r\n", imf.FormatAddress(&from))
+				wroteFrom = true
+			}
+			continue
+		}
+		bw.Write(line)
+		if err == io.EOF {
+			break
+		}
+	}
+	if !wroteFrom {
+		fmt.Fprintf(bw, "From: %s\r\n", imf.FormatAddress(&from))
+	}
+	return bw.Flush()
+}
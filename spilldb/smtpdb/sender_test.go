@@ -0,0 +1,45 @@
+package smtpdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"spilled.ink/email"
+)
+
+func TestRewriteFrom(t *testing.T) {
+	from := email.Address{Name: "Alice", Addr: "alice@example.com"}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "simple",
+			in:   "Subject: hi\r\nFrom: mallory@example.org\r\nTo: bob@example.net\r\n\r\nFrom: the body\r\n",
+			want: "Subject: hi\r\nFrom: \"Alice\" <alice@example.com>\r\nTo: bob@example.net\r\n\r\nFrom: the body\r\n",
+		},
+		{
+			name: "folded",
+			in:   "FROM: a@example.org,\r\n\tb@example.org\r\nFrom: c@example.org\r\nTo: bob@example.net\r\n\r\nbody\r\n",
+			want: "From: \"Alice\" <alice@example.com>\r\nTo: bob@example.net\r\n\r\nbody\r\n",
+		},
+		{
+			name: "missing",
+			in:   "To: bob@example.net\r\n\r\nbody\r\n",
+			want: "To: bob@example.net\r\nFrom: \"Alice\" <alice@example.com>\r\n\r\nbody\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := rewriteFrom(buf, strings.NewReader(tt.in), from); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,11 +13,27 @@ import (
 	"crawshaw.io/iox"
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/email/dsn"
 	"spilled.ink/smtp/smtpserver"
 	"spilled.ink/spilldb/db"
 )
 
 type MsgMaker struct {
+	// SendDelay is how long mail submitted by a user without
+	// their own db.SendDelay is held before it is sent, so that
+	// it can be cancelled. Zero sends mail at once.
+	SendDelay time.Duration
+
+	// HoldFn, if set, is called in place of the done function
+	// for a message held by a send delay. Without it no mail is held.
+	HoldFn func(stagingID int64, until time.Time)
+
+	// SenderPolicy is applied to mail submitted by a user from
+	// an address, in MAIL FROM or the From header, that they may
+	// not send as.
+	SenderPolicy SenderPolicy
+
 	ctx       context.Context
 	dbpool    *sqlitex.Pool
 	filer     *iox.Filer
@@ -25,7 +41,7 @@ type MsgMaker struct {
 	auth      *db.Authenticator
 }
 
-func New(ctx context.Context, dbpool *sqlitex.Pool, filer *iox.Filer, doneFn func(stagingID int64)) *MsgMaker {
+func New(ctx context.Context, dbpool *sqlitex.Pool, filer *iox.Filer, lockout *db.Lockout, doneFn func(stagingID int64)) *MsgMaker {
 	logf := log.Printf // TODO
 	p := &MsgMaker{
 		ctx:       ctx,
@@ -33,9 +49,10 @@ func New(ctx context.Context, dbpool *sqlitex.Pool, filer *iox.Filer, doneFn fun
 		filer:     filer,
 		msgDoneFn: doneFn,
 		auth: &db.Authenticator{
-			DB:    dbpool,
-			Logf:  logf,
-			Where: "smtp",
+			DB:      dbpool,
+			Logf:    logf,
+			Where:   "smtp",
+			Lockout: lockout,
 		},
 	}
 	return p
@@ -49,7 +66,7 @@ func (p *MsgMaker) Auth(identity, user, password []byte, remoteAddr string) uint
 	return uint64(userID)
 }
 
-func (p *MsgMaker) NewMessage(remoteAddr net.Addr, from []byte, authToken uint64) (smtpserver.Msg, error) {
+func (p *MsgMaker) NewMessage(remoteAddr net.Addr, from []byte, params smtpserver.MailParams, authToken uint64) (smtpserver.Msg, error) {
 	conn := p.dbpool.Get(p.ctx)
 	if conn == nil {
 		return nil, context.Canceled
@@ -58,26 +75,44 @@ func (p *MsgMaker) NewMessage(remoteAddr net.Addr, from []byte, authToken uint64
 
 	if authToken != 0 {
 		// Confirm the sender is allowed to use this source address.
-		stmt := conn.Prep(`SELECT UserID FROM UserAddresses WHERE Address = $address;`)
-		stmt.SetBytes("$address", from)
-		if hasNext, err := stmt.Step(); err != nil {
+		ok, err := db.CanSendAs(conn, int64(authToken), string(from))
+		if err != nil {
 			return nil, err
-		} else if !hasNext {
-			// TODO: log invalid address
-			return nil, fmt.Errorf("bad sender address")
 		}
-		userID := stmt.GetInt64("UserID")
-		stmt.Reset()
-		if userID != int64(authToken) {
-			// TODO: log that user does not own address
-			return nil, fmt.Errorf("bad sender address")
+		if !ok {
+			if p.SenderPolicy != SenderRewrite {
+				log.Printf("user %d: MAIL FROM %q refused", authToken, from)
+				return nil, errSenderNotAllowed("Sender", string(from))
+			}
+			primary, err := db.PrimaryAddress(conn, int64(authToken))
+			if err != nil {
+				return nil, err
+			}
+			if primary == "" {
+				return nil, errSenderNotAllowed("Sender", string(from))
+			}
+			log.Printf("user %d: MAIL FROM %q rewritten to %q", authToken, from, primary)
+			from = []byte(primary)
 		}
 	}
 
-	stmt := conn.Prep("INSERT INTO Msgs (UserID, Sender, DateReceived) VALUES ($userID, $sender, $time);")
+	stmt := conn.Prep(`INSERT INTO Msgs (UserID, Sender, DateReceived, SMTPUTF8, DSNRet, DSNEnvID, RequireTLS)
+		VALUES ($userID, $sender, $time, $smtputf8, $dsnRet, $dsnEnvID, $requireTLS);`)
 	stmt.SetInt64("$userID", int64(authToken))
 	stmt.SetBytes("$sender", from)
 	stmt.SetInt64("$time", time.Now().Unix())
+	stmt.SetBool("$smtputf8", params.SMTPUTF8)
+	stmt.SetBool("$requireTLS", params.RequireTLS)
+	if params.Ret != dsn.RetDefault {
+		stmt.SetText("$dsnRet", string(params.Ret))
+	} else {
+		stmt.SetNull("$dsnRet")
+	}
+	if params.EnvID != "" {
+		stmt.SetText("$dsnEnvID", params.EnvID)
+	} else {
+		stmt.SetNull("$dsnEnvID")
+	}
 	if _, err := stmt.Step(); err != nil {
 		return nil, err
 	}
@@ -88,6 +123,11 @@ func (p *MsgMaker) NewMessage(remoteAddr net.Addr, from []byte, authToken uint64
 		msgDoneFn: p.msgDoneFn,
 		stagingID: conn.LastInsertRowID(),
 		auth:      authToken != 0,
+		userID:    int64(authToken),
+		sendDelay: p.SendDelay,
+		holdFn:    p.HoldFn,
+		policy:    p.SenderPolicy,
+		sender:    string(from),
 	}
 	return m, nil
 }
@@ -100,10 +140,20 @@ type smtpMsg struct {
 	stagingID int64
 	f         *iox.BufferFile
 	auth      bool
+	userID    int64
+	sendDelay time.Duration
+	holdFn    func(stagingID int64, until time.Time)
+	policy    SenderPolicy
+	sender    string
 	err       error
 }
 
-func (m *smtpMsg) AddRecipient(addr []byte) (bool, error) {
+func (m *smtpMsg) AddRecipient(addr []byte, params smtpserver.RcptParams) (bool, error) {
+	if err := email.CheckAddrSpec(string(addr)); err != nil {
+		log.Printf("invalid recipient: %v", err)
+		return false, nil
+	}
+
 	conn := m.dbpool.Get(m.ctx)
 	if conn == nil {
 		return false, context.Canceled
@@ -139,31 +189,60 @@ func (m *smtpMsg) AddRecipient(addr []byte) (bool, error) {
 	// Unauthenticated message sends or messages sent to a local domain
 	// must go to valid local recipients.
 	// Otherwise you can send anywhere.
+	recipient := string(addr)
+	var route db.Route
 	if !m.auth || localDomain {
-		stmt := conn.Prep(`SELECT UserID From UserAddresses WHERE Address = $address;`)
-		stmt.SetBytes("$address", addr)
-		if hasRow, err := stmt.Step(); err != nil {
-			log.Printf("accountaddresses err: %v", err)
+		var err error
+		route, err = db.ResolveAddress(conn, recipient)
+		if err != nil {
+			log.Printf("resolve recipient: %v", err)
 			return false, err
-		} else if !hasRow {
+		}
+		if route.IsZero() {
 			log.Printf("invalid recipient: %q", addr)
 			return false, nil
 		}
-		userID := stmt.GetInt64("UserID")
-		stmt.Reset()
-
-		if userID == 0 {
-			log.Printf("invalid recipient user: %q", addr)
-			return false, nil
+		if route.ForwardTo != "" {
+			// TODO: rewrite the sender with SRS so forwarded
+			// mail passes SPF checks at the destination.
+			recipient = route.ForwardTo
+			if params.ORcpt == "" {
+				params.ORcpt = "rfc822;" + string(addr)
+			}
 		}
 	}
 
-	stmt := conn.Prep("INSERT INTO MsgRecipients (StagingID, Recipient, FullAddress, DeliveryState) VALUES ($stagingID, $address, '', $deliveryState);")
+	stmt := conn.Prep(`INSERT INTO MsgRecipients (StagingID, Recipient, FullAddress, DeliveryState, DSNNotify, DSNORcpt, UserID, Tag)
+		VALUES ($stagingID, $address, '', $deliveryState, $dsnNotify, $dsnORcpt, $userID, $tag);`)
 	stmt.SetInt64("$stagingID", m.stagingID)
 	stmt.SetInt64("$deliveryState", int64(db.DeliveryReceiving))
-	stmt.SetBytes("$address", addr)
+	stmt.SetText("$address", recipient)
+	if params.Notify != 0 {
+		stmt.SetInt64("$dsnNotify", int64(params.Notify))
+	} else {
+		stmt.SetNull("$dsnNotify")
+	}
+	if params.ORcpt != "" {
+		stmt.SetText("$dsnORcpt", params.ORcpt)
+	} else {
+		stmt.SetNull("$dsnORcpt")
+	}
+	if route.UserID != 0 {
+		stmt.SetInt64("$userID", route.UserID)
+	} else {
+		stmt.SetNull("$userID")
+	}
+	if route.Tag != "" {
+		stmt.SetText("$tag", route.Tag)
+	} else {
+		stmt.SetNull("$tag")
+	}
 	_, err := stmt.Step()
 	if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_PRIMARYKEY {
+		if route.ForwardTo != "" {
+			// Another alias already forwards to this address.
+			return true, nil
+		}
 		log.Printf("stagingID %d: could not add recipient: %s", m.stagingID, addr)
 		return false, nil
 	} else if err != nil {
@@ -191,8 +270,10 @@ func (m *smtpMsg) Cancel() {
 	if m.err == nil {
 		m.err = context.Canceled
 	}
-	m.f.Close()
-	m.f = nil
+	if m.f != nil {
+		m.f.Close()
+		m.f = nil
+	}
 	m.removeMsg()
 }
 
@@ -245,6 +326,12 @@ func (m *smtpMsg) Close() (err error) {
 	}
 	defer m.dbpool.Put(conn)
 
+	if m.auth {
+		if m.err = m.checkFrom(conn); m.err != nil {
+			return m.err
+		}
+	}
+
 	if m.err = saveMsg(conn, m.stagingID, m.f); m.err != nil {
 		return m.err
 	}
@@ -253,45 +340,48 @@ func (m *smtpMsg) Close() (err error) {
 		return m.err
 	}
 
-	if !m.auth {
-		// All recipients are local, because we are never an open relay.
-		// Incoming message for us locally.
-		stmt := conn.Prep(`UPDATE MsgRecipients
-			SET DeliveryState = $deliveryToProcess
-			WHERE StagingID = $stagingID;`)
-		stmt.SetInt64("$stagingID", m.stagingID)
-		stmt.SetInt64("$deliveryToProcess", int64(db.DeliveryToProcess))
-		if _, m.err = stmt.Step(); m.err != nil {
+	// Mail submitted by a user may be held for an undo send
+	// window, during which the user can withdraw it.
+	if m.auth && m.holdFn != nil {
+		var delay time.Duration
+		if delay, m.err = db.SendDelay(conn, m.userID, m.sendDelay); m.err != nil {
 			return m.err
 		}
-	} else {
-		// Received a client mail submission.
-		// Some recipients may be local, some remote.
-		stmt := conn.Prep(`UPDATE MsgRecipients
-			SET DeliveryState = $deliveryToProcess
-			WHERE StagingID = $stagingID
-			AND Recipient IN (
-				SELECT Recipient FROM MsgRecipients
-				INNER JOIN UserAddresses ON Address = Recipient
-				WHERE StagingID = $stagingID
-			);`)
-		stmt.SetInt64("$stagingID", m.stagingID)
-		stmt.SetInt64("$deliveryToProcess", int64(db.DeliveryToProcess))
-		if _, m.err = stmt.Step(); m.err != nil {
-			return m.err
+		if delay > 0 {
+			until := time.Now().Add(delay)
+			if m.err = db.HoldMsg(conn, m.stagingID, until); m.err != nil {
+				return m.err
+			}
+			m.holdFn(m.stagingID, until)
+			return nil
 		}
+	}
 
-		// Mark the remaining recipients for external delivery.
-		stmt = conn.Prep(`UPDATE MsgRecipients
-			SET DeliveryState = $deliverySending
-			WHERE StagingID = $stagingID
-			AND DeliveryState = $deliveryReceiving;`)
-		stmt.SetInt64("$stagingID", m.stagingID)
-		stmt.SetInt64("$deliverySending", int64(db.DeliverySending))
-		stmt.SetInt64("$deliveryReceiving", int64(db.DeliveryReceiving))
-		if _, m.err = stmt.Step(); m.err != nil {
-			return m.err
-		}
+	// Recipients routed to a local user are processed for local
+	// delivery. The rest are forwarded by an alias, or, for a client
+	// mail submission, addressed to remote users.
+	// We are never an open relay: AddRecipient only accepts remote
+	// recipients from authenticated users or forwarding routes.
+	stmt := conn.Prep(`UPDATE MsgRecipients
+		SET DeliveryState = $deliveryToProcess
+		WHERE StagingID = $stagingID
+		AND UserID IS NOT NULL;`)
+	stmt.SetInt64("$stagingID", m.stagingID)
+	stmt.SetInt64("$deliveryToProcess", int64(db.DeliveryToProcess))
+	if _, m.err = stmt.Step(); m.err != nil {
+		return m.err
+	}
+
+	// Mark the remaining recipients for external delivery.
+	stmt = conn.Prep(`UPDATE MsgRecipients
+		SET DeliveryState = $deliverySending
+		WHERE StagingID = $stagingID
+		AND DeliveryState = $deliveryReceiving;`)
+	stmt.SetInt64("$stagingID", m.stagingID)
+	stmt.SetInt64("$deliverySending", int64(db.DeliverySending))
+	stmt.SetInt64("$deliveryReceiving", int64(db.DeliveryReceiving))
+	if _, m.err = stmt.Step(); m.err != nil {
+		return m.err
 	}
 
 	if m.msgDoneFn != nil {
@@ -300,6 +390,38 @@ func (m *smtpMsg) Close() (err error) {
 	return nil
 }
 
+// checkFrom applies the sender policy to the From header of
+// a message submitted by a user, replacing m.f if it is rewritten.
+func (m *smtpMsg) checkFrom(conn *sqlite.Conn) error {
+	if _, err := m.f.Seek(0, 0); err != nil {
+		return err
+	}
+	name, denied, err := checkFrom(conn, m.userID, m.f)
+	if err != nil {
+		return err
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	if m.policy != SenderRewrite || m.sender == "" {
+		log.Printf("stagingID %d: From %q refused", m.stagingID, denied)
+		return errSenderNotAllowed("From", denied[0])
+	}
+	log.Printf("stagingID %d: From %q rewritten to %q", m.stagingID, denied, m.sender)
+
+	if _, err := m.f.Seek(0, 0); err != nil {
+		return err
+	}
+	f := m.filer.BufferFile(0)
+	if err := rewriteFrom(f, m.f, email.Address{Name: name, Addr: m.sender}); err != nil {
+		f.Close()
+		return err
+	}
+	m.f.Close()
+	m.f = f
+	return nil
+}
+
 func saveMsg(conn *sqlite.Conn, stagingID int64, f *iox.BufferFile) error {
 	if _, err := f.Seek(0, 0); err != nil {
 		return err
@@ -0,0 +1,132 @@
+package spillbox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// Attachment is a message part stored as an attachment.
+type Attachment struct {
+	MsgID       email.MsgID
+	PartNum     int
+	Name        string // file name
+	ContentType string // MIME type, "application/pdf"
+	MailboxID   int64
+	Date        time.Time // message date
+}
+
+// MsgAttachments lists the attachments of a message.
+func MsgAttachments(conn *sqlite.Conn, msgID email.MsgID) (attachments []Attachment, err error) {
+	stmt := conn.Prep(`SELECT PartNum, Name, ContentType, MailboxID, Date
+		FROM MsgParts
+		INNER JOIN Msgs ON Msgs.MsgID = MsgParts.MsgID
+		WHERE MsgParts.MsgID = $msgID AND IsAttachment
+		ORDER BY PartNum;`)
+	stmt.SetInt64("$msgID", int64(msgID))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.MsgAttachments(%s): %v", msgID, err)
+		} else if !hasNext {
+			break
+		}
+		attachments = append(attachments, Attachment{
+			MsgID:       msgID,
+			PartNum:     int(stmt.GetInt64("PartNum")),
+			Name:        stmt.GetText("Name"),
+			ContentType: stmt.GetText("ContentType"),
+			MailboxID:   stmt.GetInt64("MailboxID"),
+			Date:        time.Unix(stmt.GetInt64("Date"), 0),
+		})
+	}
+	return attachments, nil
+}
+
+// AttachmentQuery selects attachments for FindAttachments.
+// Zero fields match everything.
+type AttachmentQuery struct {
+	Name        string // file name contains, ignoring ASCII case
+	ContentType string // MIME type, or "image/*" for any image
+	MailboxID   int64
+	Since       time.Time // message date
+	Limit       int       // default 100
+}
+
+// FindAttachments finds the attachments of ready messages,
+// most recent first.
+func FindAttachments(conn *sqlite.Conn, q AttachmentQuery) (attachments []Attachment, err error) {
+	where := []string{"IsAttachment", "State = $msgReady"}
+	if q.Name != "" {
+		where = append(where, `Name LIKE $name ESCAPE '\'`)
+	}
+	var typeLo, typeHi string
+	if q.ContentType != "" {
+		typeLo = strings.ToLower(strings.TrimSuffix(q.ContentType, "*"))
+		if !strings.Contains(typeLo, "/") {
+			typeLo += "/"
+		}
+		if strings.HasSuffix(typeLo, "/") {
+			// Every type/subtype sorts between "type/" and "type0".
+			typeHi = strings.TrimSuffix(typeLo, "/") + "0"
+			where = append(where, "ContentType >= $typeLo AND ContentType < $typeHi")
+		} else {
+			where = append(where, "ContentType = $typeLo")
+		}
+	}
+	if q.MailboxID != 0 {
+		where = append(where, "MailboxID = $mailboxID")
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "Date >= $since")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	stmt := conn.Prep(`SELECT MsgParts.MsgID, PartNum, Name, ContentType, MailboxID, Date
+		FROM MsgParts
+		INNER JOIN Msgs ON Msgs.MsgID = MsgParts.MsgID
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY Date DESC, MsgParts.MsgID, PartNum
+		LIMIT $limit;`)
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	if q.Name != "" {
+		stmt.SetText("$name", "%"+likeEscaper.Replace(q.Name)+"%")
+	}
+	if typeLo != "" {
+		stmt.SetText("$typeLo", typeLo)
+	}
+	if typeHi != "" {
+		stmt.SetText("$typeHi", typeHi)
+	}
+	if q.MailboxID != 0 {
+		stmt.SetInt64("$mailboxID", q.MailboxID)
+	}
+	if !q.Since.IsZero() {
+		stmt.SetInt64("$since", q.Since.Unix())
+	}
+	stmt.SetInt64("$limit", int64(limit))
+
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.FindAttachments: %v", err)
+		} else if !hasNext {
+			break
+		}
+		attachments = append(attachments, Attachment{
+			MsgID:       email.MsgID(stmt.GetInt64("MsgID")),
+			PartNum:     int(stmt.GetInt64("PartNum")),
+			Name:        stmt.GetText("Name"),
+			ContentType: stmt.GetText("ContentType"),
+			MailboxID:   stmt.GetInt64("MailboxID"),
+			Date:        time.Unix(stmt.GetInt64("Date"), 0),
+		})
+	}
+	return attachments, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
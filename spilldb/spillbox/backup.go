@@ -0,0 +1,494 @@
+package spillbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"crawshaw.io/iox"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Backups.
+//
+// A backup is a pair of database files, named like the files of
+// a Box: dbfile and its _blobs.db sibling. Backup copies them with
+// the SQLite online backup API, backupStepPages at a time, from a
+// private connection holding a read transaction on both databases.
+// The transaction is started while Backup holds the PoolRW
+// connection, so the pair is consistent, and writers and readers
+// carry on while the pages are copied.
+//
+// A backup holds the content of every blob. Blobs moved to an
+// ObjectStore are fetched into the blobs database of the backup,
+// which refers to no objects and queues none for deletion. Until
+// they are copied, the objects are pinned by a row in
+// blobs.BackupPins: deleteObjects leaves the queue in
+// blobs.DeletedObjects alone while a pin has not expired, so
+// objects the mailbox stops using during the backup survive it.
+//
+// Restore replaces the files of a closed Box with a backup.
+// Clients may have seen messages the backup does not have, or
+// cached UIDs that are given to different messages after the
+// restore, so every mailbox gets a new UIDVALIDITY to force
+// clients to resynchronize. The objects of the replaced databases
+// are queued for deletion in the restored box.
+
+// backupStepPages is the number of pages Backup copies at a time.
+const backupStepPages = 1024
+
+// backupPinTime is how long the pin of a Backup lasts,
+// in case it is not removed.
+const backupPinTime = 24 * time.Hour
+
+// Backup writes a snapshot of the box to dbfile and its blobs
+// database. The files must not exist.
+func (box *Box) Backup(ctx context.Context, dbfile string) (err error) {
+	for _, path := range []string{dbfile, blobsDBFile(dbfile)} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("spillbox.Backup: %s exists", path)
+		}
+	}
+	defer func() {
+		if err != nil {
+			removeDB(dbfile)
+			err = fmt.Errorf("spillbox.Backup: %v", err)
+		}
+	}()
+
+	src, pinID, err := box.openSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := box.unpinObjects(pinID); err == nil {
+			err = uerr
+		}
+	}()
+	err = backupDB(ctx, src, "main", dbfile)
+	if err == nil {
+		err = backupDB(ctx, src, "blobs", blobsDBFile(dbfile))
+	}
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return box.inlineObjects(ctx, blobsDBFile(dbfile))
+}
+
+// openSnapshot opens a private connection to the box databases
+// with a read transaction on both, and pins the objects of the box.
+func (box *Box) openSnapshot(ctx context.Context) (src *sqlite.Conn, pinID int64, err error) {
+	src, err = box.openPrivate()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if err != nil {
+			src.Close()
+		}
+	}()
+
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer box.PutRW(conn)
+
+	stmt := conn.Prep("INSERT INTO blobs.BackupPins (Expires) VALUES ($expires);")
+	stmt.SetInt64("$expires", time.Now().Add(backupPinTime).Unix())
+	if _, err := stmt.Step(); err != nil {
+		return nil, 0, err
+	}
+	pinID = conn.LastInsertRowID()
+
+	// A read transaction starts on a database when it is first
+	// read, so read both before letting writers go.
+	err = sqlitex.ExecTransient(src, "BEGIN;", nil)
+	if err == nil {
+		err = sqlitex.ExecTransient(src, `SELECT
+			(SELECT count(*) FROM main.sqlite_master),
+			(SELECT count(*) FROM blobs.sqlite_master);`, nil)
+	}
+	if err != nil {
+		deletePin(conn, pinID)
+		return nil, 0, err
+	}
+	return src, pinID, nil
+}
+
+// openPrivate opens a read-only connection to the box databases
+// outside the shared cache of the box pools, so its reads do not
+// lock tables against the write connection.
+func (box *Box) openPrivate() (*sqlite.Conn, error) {
+	flags := sqlite.SQLITE_OPEN_READONLY |
+		sqlite.SQLITE_OPEN_WAL |
+		sqlite.SQLITE_OPEN_URI |
+		sqlite.SQLITE_OPEN_NOMUTEX
+	conn, err := sqlite.OpenConn(box.dbfile, flags)
+	if err != nil {
+		return nil, err
+	}
+	if err := attachBlobs(conn, blobsDBFile(box.dbfile)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// unpinObjects removes the pin of a Backup. It is done even if
+// the Backup was canceled, GetRW gives up after WriteTimeout.
+func (box *Box) unpinObjects(pinID int64) error {
+	conn, err := box.GetRW(context.Background())
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+	return deletePin(conn, pinID)
+}
+
+func deletePin(conn *sqlite.Conn, pinID int64) error {
+	stmt := conn.Prep("DELETE FROM blobs.BackupPins WHERE PinID = $pinID;")
+	stmt.SetInt64("$pinID", pinID)
+	_, err := stmt.Step()
+	return err
+}
+
+// objectsPinned reports whether a Backup may be copying objects.
+func objectsPinned(conn *sqlite.Conn) (bool, error) {
+	stmt := conn.Prep("SELECT count(*) FROM blobs.BackupPins WHERE Expires > $now;")
+	stmt.SetInt64("$now", time.Now().Unix())
+	n, err := sqlitex.ResultInt(stmt)
+	return n > 0, err
+}
+
+// backupDB copies the schema database of src to a new database file.
+func backupDB(ctx context.Context, src *sqlite.Conn, schema, path string) (err error) {
+	flags := sqlite.SQLITE_OPEN_READWRITE |
+		sqlite.SQLITE_OPEN_CREATE |
+		sqlite.SQLITE_OPEN_URI |
+		sqlite.SQLITE_OPEN_NOMUTEX
+	dst, err := sqlite.OpenConn(path, flags)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	b, err := src.BackupInit(schema, "main", dst)
+	if err != nil {
+		return fmt.Errorf("%s: %v", schema, err)
+	}
+	for more := true; more; {
+		if err := ctx.Err(); err != nil {
+			b.Finish()
+			return err
+		}
+		if more, err = b.Step(backupStepPages); err != nil {
+			b.Finish()
+			return fmt.Errorf("%s: %v", schema, err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		return fmt.Errorf("%s: %v", schema, err)
+	}
+	return nil
+}
+
+// inlineObjects fetches the offloaded content of the blobs
+// database of a backup into it, and clears its object state.
+func (box *Box) inlineObjects(ctx context.Context, blobsfile string) (err error) {
+	flags := sqlite.SQLITE_OPEN_READWRITE |
+		sqlite.SQLITE_OPEN_URI |
+		sqlite.SQLITE_OPEN_NOMUTEX
+	dst, err := sqlite.OpenConn(blobsfile, flags)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	type remoteRef struct {
+		blobID int64
+		key    string
+		size   int64
+		sha256 string
+	}
+	var remotes []remoteRef
+	stmt := dst.Prep(`SELECT BlobID, ObjectKey, Size, SHA256
+		FROM RemoteBlobs INNER JOIN Blobs USING (BlobID);`)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		remotes = append(remotes, remoteRef{
+			blobID: stmt.GetInt64("BlobID"),
+			key:    stmt.GetText("ObjectKey"),
+			size:   stmt.GetInt64("Size"),
+			sha256: stmt.GetText("SHA256"),
+		})
+	}
+	for _, r := range remotes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := box.inlineObject(ctx, dst, r.blobID, r.key, r.size, r.sha256); err != nil {
+			return fmt.Errorf("blob %d: %v", r.blobID, err)
+		}
+	}
+
+	for _, table := range []string{"RemoteBlobs", "DeletedObjects", "BackupPins"} {
+		if err := sqlitex.ExecTransient(dst, "DELETE FROM "+table+";", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (box *Box) inlineObject(ctx context.Context, dst *sqlite.Conn, blobID int64, key string, size int64, sum string) (err error) {
+	rc, err := box.fetchObject(ctx, blobID, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	defer sqlitex.Save(dst)(&err)
+
+	stmt := dst.Prep("UPDATE Blobs SET Content = zeroblob($size) WHERE BlobID = $blobID;")
+	stmt.SetInt64("$size", size)
+	stmt.SetInt64("$blobID", blobID)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	blob, err := dst.OpenBlob("main", "Blobs", "Content", blobID, true)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(blob, io.TeeReader(io.LimitReader(rc, size), h))
+	blob.Close()
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("object %s is %d bytes, want %d", key, n, size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("object %s has SHA256 %s, want %s", key, got, sum)
+	}
+	stmt = dst.Prep("DELETE FROM RemoteBlobs WHERE BlobID = $blobID;")
+	stmt.SetInt64("$blobID", blobID)
+	_, err = stmt.Step()
+	return err
+}
+
+// Restore replaces the box databases at dbfile with the backup
+// at backupfile. No Box may have dbfile open.
+//
+// The backup is copied, checked, has its UIDVALIDITY values
+// raised above those of both the backup and the databases it
+// replaces, and has the objects of the replaced databases queued
+// for deletion before it is moved into place. If the backup fails
+// its check, the databases at dbfile are left as they were.
+func Restore(ctx context.Context, filer *iox.Filer, userID int64, dbfile, backupfile string) (err error) {
+	var minUIDValidity int64
+	var objectKeys []string
+	if _, err := os.Stat(dbfile); err == nil {
+		if minUIDValidity, objectKeys, err = replacedState(filer, userID, dbfile); err != nil {
+			return fmt.Errorf("spillbox.Restore: current database: %v", err)
+		}
+	}
+
+	dir, name := filepath.Split(dbfile)
+	tmpfile := filepath.Join(dir, "restore-"+name)
+	defer func() {
+		if err != nil {
+			removeDB(tmpfile)
+		}
+	}()
+	if err := copyFile(tmpfile, backupfile); err != nil {
+		return fmt.Errorf("spillbox.Restore: %v", err)
+	}
+	if err := copyFile(blobsDBFile(tmpfile), blobsDBFile(backupfile)); err != nil {
+		return fmt.Errorf("spillbox.Restore: %v", err)
+	}
+
+	box, err := New(userID, filer, tmpfile, 1)
+	if err != nil {
+		return fmt.Errorf("spillbox.Restore: %v", err)
+	}
+	conn := box.PoolRW.Get(ctx)
+	if conn == nil {
+		box.Close()
+		return context.Canceled
+	}
+	err = checkIntegrity(conn)
+	if err == nil {
+		err = bumpUIDValidity(conn, minUIDValidity)
+	}
+	for _, key := range objectKeys {
+		if err == nil {
+			err = box.queueObjectDelete(conn, key)
+		}
+	}
+	box.PoolRW.Put(conn)
+	if cerr := box.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("spillbox.Restore: %v", err)
+	}
+
+	removeDB(dbfile)
+	if err := os.Rename(tmpfile, dbfile); err != nil {
+		return fmt.Errorf("spillbox.Restore: %v", err)
+	}
+	if err := os.Rename(blobsDBFile(tmpfile), blobsDBFile(dbfile)); err != nil {
+		return fmt.Errorf("spillbox.Restore: %v", err)
+	}
+	return nil
+}
+
+// replacedState reports the largest UIDVALIDITY of the box at
+// dbfile and the object keys it uses or has queued for deletion.
+func replacedState(filer *iox.Filer, userID int64, dbfile string) (maxUIDValidity int64, objectKeys []string, err error) {
+	box, err := New(userID, filer, dbfile, 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer box.Close()
+	conn := box.PoolRW.Get(nil)
+	defer box.PoolRW.Put(conn)
+	stmt := conn.Prep(`SELECT max(
+		coalesce((SELECT max(UIDValidity) FROM Mailboxes), 0),
+		coalesce((SELECT max(UIDValidity) FROM MailboxSequencing), 0));`)
+	if maxUIDValidity, err = sqlitex.ResultInt64(stmt); err != nil {
+		return 0, nil, err
+	}
+	stmt = conn.Prep(`SELECT ObjectKey FROM blobs.RemoteBlobs
+		UNION SELECT ObjectKey FROM blobs.DeletedObjects;`)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, nil, err
+		} else if !hasNext {
+			break
+		}
+		objectKeys = append(objectKeys, stmt.GetText("ObjectKey"))
+	}
+	return maxUIDValidity, objectKeys, nil
+}
+
+// checkIntegrity runs the SQLite integrity check on both databases.
+func checkIntegrity(conn *sqlite.Conn) error {
+	for _, schema := range []string{"main", "blobs"} {
+		var problems []string
+		fn := func(stmt *sqlite.Stmt) error {
+			if msg := stmt.ColumnText(0); msg != "ok" {
+				problems = append(problems, msg)
+			}
+			return nil
+		}
+		if err := sqlitex.Exec(conn, fmt.Sprintf("PRAGMA %s.integrity_check;", schema), fn); err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%s integrity check: %s", schema, strings.Join(problems, "; "))
+		}
+	}
+	return nil
+}
+
+// bumpUIDValidity gives every mailbox a new UIDVALIDITY, greater
+// than any in the database and greater than min.
+func bumpUIDValidity(conn *sqlite.Conn, min int64) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`SELECT max($min,
+		coalesce((SELECT max(UIDValidity) FROM Mailboxes), 0),
+		coalesce((SELECT max(UIDValidity) FROM MailboxSequencing), 0));`)
+	stmt.SetInt64("$min", min)
+	next, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return err
+	}
+
+	var mailboxIDs []int64
+	stmt = conn.Prep("SELECT MailboxID FROM Mailboxes ORDER BY MailboxID;")
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		mailboxIDs = append(mailboxIDs, stmt.GetInt64("MailboxID"))
+	}
+	for _, mailboxID := range mailboxIDs {
+		next++
+		stmt := conn.Prep("UPDATE Mailboxes SET UIDValidity = $uidValidity WHERE MailboxID = $mailboxID;")
+		stmt.SetInt64("$uidValidity", next)
+		stmt.SetInt64("$mailboxID", mailboxID)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+
+	stmt = conn.Prep(`UPDATE MailboxSequencing
+		SET UIDValidity = (SELECT UIDValidity FROM Mailboxes WHERE Name = MailboxSequencing.Name)
+		WHERE Name IN (SELECT Name FROM Mailboxes);`)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	// Names of removed mailboxes only need to stay ahead.
+	stmt = conn.Prep(`UPDATE MailboxSequencing SET UIDValidity = $next
+		WHERE Name NOT IN (SELECT Name FROM Mailboxes WHERE Name IS NOT NULL);`)
+	stmt.SetInt64("$next", next)
+	_, err = stmt.Step()
+	return err
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// removeDB removes a box's databases and their WAL files.
+func removeDB(dbfile string) {
+	for _, path := range []string{dbfile, blobsDBFile(dbfile)} {
+		os.Remove(path)
+		os.Remove(path + "-wal")
+		os.Remove(path + "-shm")
+	}
+}
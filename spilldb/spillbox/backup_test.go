@@ -0,0 +1,244 @@
+package spillbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// insertOffloadedMsgs delivers messages to box, one of them large,
+// and moves the large blobs to its object store.
+func insertOffloadedMsgs(t *testing.T, box *Box) {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 6000)
+	rnd.Read(big)
+	for i := 0; i < 3; i++ {
+		body := fmt.Sprintf("Hello %d.\n", i)
+		if i == 0 {
+			body = base64.StdEncoding.EncodeToString(big) + "\n"
+		}
+		insertTestMsg(t, box, fmt.Sprintf("From: a%d@example.com\nTo: user@spilled.ink\nSubject: msg %d\n\n%s", i, i, body))
+	}
+	stats, err := box.OffloadBlobs(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs == 0 {
+		t.Fatal("OffloadBlobs moved nothing")
+	}
+}
+
+// readBlobs reads the content of every blob of box.
+func readBlobs(t *testing.T, box *Box) map[int64][]byte {
+	t.Helper()
+	conn, err := box.GetRW(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.PutRW(conn)
+
+	var blobIDs []int64
+	fn := func(stmt *sqlite.Stmt) error {
+		blobIDs = append(blobIDs, stmt.GetInt64("BlobID"))
+		return nil
+	}
+	if err := sqlitex.Exec(conn, "SELECT BlobID FROM blobs.Blobs WHERE Content IS NOT NULL;", fn); err != nil {
+		t.Fatal(err)
+	}
+	blobs := make(map[int64][]byte)
+	for _, blobID := range blobIDs {
+		content, err := box.readBlob(context.Background(), conn, blobID)
+		if err != nil {
+			t.Fatalf("blob %d: %v", blobID, err)
+		}
+		blobs[blobID] = content
+	}
+	return blobs
+}
+
+func maxUIDValidity(t *testing.T, box *Box) int64 {
+	t.Helper()
+	conn := box.PoolRO.Get(nil)
+	defer box.PoolRO.Put(conn)
+	v, err := sqlitex.ResultInt64(conn.Prep("SELECT max(UIDValidity) FROM Mailboxes;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestBackupRestore(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	store := newMemStore()
+	box.ObjectStore = store
+	insertOffloadedMsgs(t, box)
+
+	const msgsQuery = "SELECT * FROM Msgs ORDER BY MsgID;"
+	wantMsgs := dumpRows(t, box, msgsQuery)
+	wantBlobs := readBlobs(t, box)
+	oldKeys := store.keys()
+	uidValidity := maxUIDValidity(t, box)
+
+	dir, err := ioutil.TempDir("", "spillbox-backup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backupfile := filepath.Join(dir, "spillbox.db")
+
+	if err := box.Backup(ctx, backupfile); err != nil {
+		t.Fatal(err)
+	}
+	if err := box.Backup(ctx, backupfile); err == nil {
+		t.Error("second Backup to the same file succeeded")
+	}
+	if pins := dumpRows(t, box, "SELECT * FROM blobs.BackupPins;"); pins != "" {
+		t.Errorf("Backup left pins:\n%s", pins)
+	}
+
+	// The backup does not need the object store.
+	for _, key := range oldKeys {
+		store.Delete(ctx, key)
+	}
+
+	if err := box.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(ctx, box.filer, 1, box.dbfile, backupfile); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := New(1, box.filer, box.dbfile, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if got := dumpRows(t, restored, msgsQuery); got != wantMsgs {
+		t.Errorf("restored Msgs:\n%s\nwant:\n%s", got, wantMsgs)
+	}
+	if got := readBlobs(t, restored); !reflect.DeepEqual(got, wantBlobs) {
+		t.Errorf("restored blobs differ, %d blobs, want %d", len(got), len(wantBlobs))
+	}
+	if remote := dumpRows(t, restored, "SELECT * FROM blobs.RemoteBlobs;"); remote != "" {
+		t.Errorf("restored box refers to objects:\n%s", remote)
+	}
+	// The objects of the replaced box are cleaned up.
+	queued := dumpRows(t, restored, "SELECT ObjectKey FROM blobs.DeletedObjects ORDER BY ObjectKey;")
+	for _, key := range oldKeys {
+		if !strings.Contains(queued, key) {
+			t.Errorf("object %s of the replaced box is not queued for deletion:\n%s", key, queued)
+		}
+	}
+	if got := maxUIDValidity(t, restored); got <= uidValidity {
+		t.Errorf("restored UIDVALIDITY %d, want more than %d", got, uidValidity)
+	}
+}
+
+func TestRestoreBadBackup(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	insertTestMsg(t, box, "From: a@example.com\nTo: user@spilled.ink\nSubject: kept\n\nHello.\n")
+	const msgsQuery = "SELECT * FROM Msgs ORDER BY MsgID;"
+	want := dumpRows(t, box, msgsQuery)
+
+	dir, err := ioutil.TempDir("", "spillbox-backup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backupfile := filepath.Join(dir, "spillbox.db")
+	if err := box.Backup(ctx, backupfile); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(backupfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the header so the file opens, damage the pages.
+	for i := 100; i < len(b); i += 7 {
+		b[i] ^= 0xff
+	}
+	if err := ioutil.WriteFile(backupfile, b, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	box.Close()
+	if err := Restore(ctx, box.filer, 1, box.dbfile, backupfile); err == nil {
+		t.Fatal("Restore of a damaged backup succeeded")
+	}
+	kept, err := New(1, box.filer, box.dbfile, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kept.Close()
+	if got := dumpRows(t, kept, msgsQuery); got != want {
+		t.Errorf("failed Restore changed Msgs:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBackupPinsObjects(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	store := newMemStore()
+	box.ObjectStore = store
+	const key = "1/stale"
+	if err := store.Put(ctx, key, bytes.NewReader([]byte("stale")), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.PutRW(conn)
+	if err := box.queueObjectDelete(conn, key); err != nil {
+		t.Fatal(err)
+	}
+	stmt := conn.Prep("INSERT INTO blobs.BackupPins (Expires) VALUES ($expires);")
+	stmt.SetInt64("$expires", time.Now().Add(time.Hour).Unix())
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	pinID := conn.LastInsertRowID()
+
+	if err := box.deleteObjects(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.keys()) != 1 {
+		t.Fatal("object deleted while pinned")
+	}
+
+	// An expired pin, left by a Backup that did not finish, is ignored.
+	stmt = conn.Prep("UPDATE blobs.BackupPins SET Expires = $expires WHERE PinID = $pinID;")
+	stmt.SetInt64("$expires", time.Now().Add(-time.Minute).Unix())
+	stmt.SetInt64("$pinID", pinID)
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if err := box.deleteObjects(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if keys := store.keys(); len(keys) != 0 {
+		t.Errorf("objects %v not deleted after the pin expired", keys)
+	}
+}
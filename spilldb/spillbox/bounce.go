@@ -0,0 +1,80 @@
+package spillbox
+
+import (
+	"context"
+	"fmt"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/imap"
+)
+
+// Keywords set on the Sent copy of a message when a delivery
+// status notification for it comes back.
+const (
+	KeywordBounced = "$Bounced" // a recipient could not be reached
+	KeywordDelayed = "$Delayed" // delivery to a recipient is being retried
+)
+
+// FlagSent sets keyword on the copy of a message the user keeps in
+// a \Sent mailbox, found by its Message-ID without angle brackets.
+// It reports whether there was such a message.
+func (box *Box) FlagSent(ctx context.Context, messageID, keyword string) (found bool, err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer box.PutRW(conn)
+
+	u := new(LabelUpdates)
+	err = func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+
+		stmt := conn.Prep(`SELECT Msgs.MsgID, Msgs.MailboxID, Msgs.UID,
+			EXISTS (SELECT 1 FROM MsgKeywords
+				WHERE MsgKeywords.MsgID = Msgs.MsgID AND Keyword = $keyword) AS Flagged
+			FROM ThreadMsgIDs
+			INNER JOIN Msgs ON Msgs.MsgID = ThreadMsgIDs.MsgID
+			INNER JOIN Mailboxes ON Mailboxes.MailboxID = Msgs.MailboxID
+			WHERE MessageID = $messageID AND State = $msgReady
+			AND ifnull(Mailboxes.Attrs, 0) & $sent <> 0;`)
+		stmt.SetText("$keyword", keyword)
+		stmt.SetText("$messageID", messageID)
+		stmt.SetInt64("$msgReady", int64(MsgReady))
+		stmt.SetInt64("$sent", int64(imap.AttrSent))
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			return nil
+		}
+		found = true
+		msg := convoMsg{
+			msgID:     email.MsgID(stmt.GetInt64("MsgID")),
+			mailboxID: stmt.GetInt64("MailboxID"),
+			uid:       uint32(stmt.GetInt64("UID")),
+			labeled:   stmt.GetInt64("Flagged") != 0,
+		}
+		stmt.Reset()
+		if msg.labeled {
+			return nil
+		}
+
+		// The keyword is set by the server, not a client, so it is
+		// set even if the mailbox is at its keyword limit. It is
+		// then registered the next time it is used.
+		keywords := []string{keyword}
+		if err := RegisterKeywords(conn, msg.mailboxID, keywords, box.KeywordLimit()); err != nil && err != imap.ErrTooManyKeywords {
+			return err
+		}
+		if err := setMsgKeyword(conn, msg, keywords[0], true); err != nil {
+			return err
+		}
+		u.flag(msg.msgID, msg.mailboxID, msg.uid)
+		return nil
+	}()
+	if err != nil {
+		return false, fmt.Errorf("spillbox.FlagSent: %v", err)
+	}
+	box.NotifyLabelUpdates(u)
+	return found, nil
+}
@@ -0,0 +1,181 @@
+package spillbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+)
+
+// DefaultCompressThreshold is the size of a text part, in bytes,
+// above which it is worth storing gzip compressed.
+const DefaultCompressThreshold = 1 << 15
+
+// minCompressRatio is the compressed/uncompressed ratio a part must
+// beat to be stored compressed. It matches msgcleaver.
+const minCompressRatio = 0.9
+
+// CompressStats reports the work done by CompressParts.
+type CompressStats struct {
+	Parts       int   // parts newly stored compressed
+	BytesBefore int64 // stored size of those parts before compression
+	BytesAfter  int64 // stored size of those parts after compression
+}
+
+// Saved is the number of bytes of storage saved by compression.
+func (s CompressStats) Saved() int64 { return s.BytesBefore - s.BytesAfter }
+
+// compressTextPart decides whether a new part should be stored
+// gzip compressed, setting IsCompressed and CompressedSize.
+func compressTextPart(part *email.Part, threshold int64) error {
+	if threshold <= 0 || part.IsCompressed || part.Content == nil {
+		return nil
+	}
+	if !strings.HasPrefix(part.ContentType, "text/") || part.Content.Size() <= threshold {
+		return nil
+	}
+	if _, err := part.Content.Seek(0, 0); err != nil {
+		return err
+	}
+	lw := new(lengthWriter)
+	gzw := gzip.NewWriter(lw)
+	if _, err := io.Copy(gzw, part.Content); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	if _, err := part.Content.Seek(0, 0); err != nil {
+		return err
+	}
+	if float64(lw.n)/float64(part.Content.Size()) < minCompressRatio {
+		part.IsCompressed = true
+		part.CompressedSize = lw.n
+	}
+	return nil
+}
+
+type lengthWriter struct{ n int64 }
+
+func (w *lengthWriter) Write(p []byte) (n int, err error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// CompressParts gzip compresses the stored content of text parts
+// larger than threshold bytes.
+//
+// Compressed parts are decompressed transparently when loaded.
+// Parts that do not compress well are left as they are and
+// not considered again.
+//
+// The write connection is taken for one blob at a time,
+// so other writers to the box are not held up.
+func (box *Box) CompressParts(ctx context.Context, threshold int64) (stats CompressStats, err error) {
+	blobIDs, err := box.compressCandidates(ctx, threshold)
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.CompressParts: %v", err)
+	}
+	for _, blobID := range blobIDs {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		if err := box.compressBlob(ctx, blobID, &stats); err != nil {
+			return stats, fmt.Errorf("spillbox.CompressParts: blob %d: %v", blobID, err)
+		}
+	}
+	return stats, nil
+}
+
+// compressCandidates lists the blobs of uncompressed
+// text parts larger than threshold.
+func (box *Box) compressCandidates(ctx context.Context, threshold int64) (blobIDs []int64, err error) {
+	conn := box.PoolRO.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer box.PoolRO.Put(conn)
+
+	// Copied messages share blobs, so work by blob rather than by part.
+	stmt := conn.Prep(`SELECT DISTINCT MsgParts.BlobID FROM MsgParts
+		INNER JOIN blobs.Blobs ON MsgParts.BlobID = blobs.Blobs.BlobID
+		WHERE ifnull(MsgParts.IsCompressed, 0) = 0
+		AND MsgParts.CompressedSize IS NULL
+		AND MsgParts.ContentType LIKE 'text/%'
+		AND ` + storedSize + ` > $threshold;`)
+	stmt.SetInt64("$threshold", threshold)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		blobIDs = append(blobIDs, stmt.GetInt64("BlobID"))
+	}
+	return blobIDs, nil
+}
+
+func (box *Box) compressBlob(ctx context.Context, blobID int64, stats *CompressStats) (err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	// The box may have changed since the blob was listed.
+	stmt := conn.Prep(`SELECT count(*) FROM MsgParts
+		WHERE BlobID = $blobID
+		AND ifnull(IsCompressed, 0) = 0
+		AND CompressedSize IS NULL;`)
+	stmt.SetInt64("$blobID", blobID)
+	if n, err := sqlitex.ResultInt(stmt); err != nil || n == 0 {
+		return err
+	}
+
+	content, err := box.readBlob(ctx, conn, blobID)
+	if err != nil {
+		return err
+	}
+	size := int64(len(content))
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	if _, err := gzw.Write(content); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	compressedSize := int64(buf.Len())
+
+	if float64(compressedSize)/float64(size) >= minCompressRatio {
+		// Not worth it. Record the stored size without setting
+		// IsCompressed so the part is not considered again.
+		stmt = conn.Prep("UPDATE MsgParts SET CompressedSize = $size WHERE BlobID = $blobID;")
+		stmt.SetInt64("$blobID", blobID)
+		stmt.SetInt64("$size", size)
+		_, err := stmt.Step()
+		return err
+	}
+
+	stmt = conn.Prep(`UPDATE MsgParts SET IsCompressed = TRUE, CompressedSize = $size
+		WHERE BlobID = $blobID;`)
+	stmt.SetInt64("$blobID", blobID)
+	stmt.SetInt64("$size", compressedSize)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if err := box.writeBlob(conn, blobID, buf.Bytes()); err != nil {
+		return err
+	}
+
+	stats.Parts++
+	stats.BytesBefore += size
+	stats.BytesAfter += compressedSize
+	return nil
+}
@@ -0,0 +1,313 @@
+package spillbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/email/vcard"
+)
+
+// ContactCard is a contact in vCard form, as served to CardDAV clients.
+type ContactCard struct {
+	ContactID ContactID
+	ETag      string // changes whenever the encoded Card changes
+	Card      vcard.Card
+}
+
+// maxPartCards limits the number of vCards imported from a message part.
+const maxPartCards = 50
+
+func isVCardType(contentType string) bool {
+	switch contentType {
+	case "text/vcard", "text/x-vcard", "text/directory":
+		return true
+	}
+	return false
+}
+
+// ImportContacts adds vCards to the address book.
+//
+// A card is matched to an existing contact by its UID, then by
+// its email addresses. Unmatched cards become new contacts.
+// It reports the contacts the cards were stored under.
+func ImportContacts(conn *sqlite.Conn, cards []vcard.Card) (contactIDs []ContactID, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	for i := range cards {
+		contactID, err := importCard(conn, &cards[i])
+		if err != nil {
+			return nil, fmt.Errorf("spillbox.ImportContacts: card %d: %v", i, err)
+		}
+		contactIDs = append(contactIDs, contactID)
+	}
+	return contactIDs, nil
+}
+
+// ImportPartContacts adds the vCards of a text/vcard message part
+// to the address book, at the explicit request of the user.
+//
+// Cards that arrive in mail are never stored by delivery: a sender
+// could use them to rename the user's contacts or attach addresses
+// of their choosing, which ExportContacts would then sync to every
+// device.
+func (box *Box) ImportPartContacts(conn *sqlite.Conn, msgID email.MsgID, partNum int) (contactIDs []ContactID, err error) {
+	parts, err := LoadPartsSummary(conn, msgID)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.ImportPartContacts: %v", err)
+	}
+	var part *email.Part
+	for i := range parts {
+		if parts[i].PartNum == partNum {
+			part = &parts[i]
+			break
+		}
+	}
+	if part == nil {
+		return nil, fmt.Errorf("spillbox.ImportPartContacts: %v has no part %d", msgID, partNum)
+	}
+	if !isVCardType(part.ContentType) {
+		return nil, fmt.Errorf("spillbox.ImportPartContacts: part %d is %s, not a vCard", partNum, part.ContentType)
+	}
+	if err := box.LoadPartContent(conn, part); err != nil {
+		return nil, fmt.Errorf("spillbox.ImportPartContacts: %v", err)
+	}
+	defer part.Content.Close()
+	cards, err := vcard.Parse(part.Content)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.ImportPartContacts: %v", err)
+	}
+	if len(cards) > maxPartCards {
+		return nil, fmt.Errorf("spillbox.ImportPartContacts: %d vCards, limit %d", len(cards), maxPartCards)
+	}
+	return ImportContacts(conn, cards)
+}
+
+// importCard stores card under a contact.
+func importCard(conn *sqlite.Conn, card *vcard.Card) (contactID ContactID, err error) {
+	var uid string
+	if card.UID != "" {
+		stmt := conn.Prep("SELECT ContactID FROM ContactCards WHERE UID = $uid;")
+		stmt.SetText("$uid", card.UID)
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, err
+		} else if hasNext {
+			contactID = ContactID(stmt.GetInt64("ContactID"))
+			uid = card.UID
+			stmt.Reset()
+		}
+	}
+
+	for _, e := range card.Emails {
+		addr := &email.Address{Name: card.FormattedName, Addr: e.Addr}
+		if addr.Addr == "" {
+			continue
+		}
+		if contactID == 0 {
+			if _, contactID, err = ResolveAddressID(conn, addr, true); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := addContactAddress(conn, contactID, addr); err != nil {
+			return 0, err
+		}
+	}
+	if contactID == 0 {
+		stmt := conn.Prep("INSERT INTO Contacts (ContactID, Robot) VALUES ($contactID, FALSE);")
+		id, err := InsertRandID(stmt, "$contactID")
+		if err != nil {
+			return 0, err
+		}
+		contactID = ContactID(id)
+	}
+
+	if uid == "" {
+		stmt := conn.Prep("SELECT UID FROM ContactCards WHERE ContactID = $contactID;")
+		stmt.SetInt64("$contactID", int64(contactID))
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, err
+		} else if hasNext {
+			uid = stmt.GetText("UID")
+			stmt.Reset()
+		}
+	}
+	if uid == "" {
+		if card.UID != "" {
+			uid = card.UID
+		} else if uid, err = newCardUID(); err != nil {
+			return 0, err
+		}
+	}
+
+	c := *card
+	c.UID = uid
+	buf := new(bytes.Buffer)
+	if err := c.Encode(buf); err != nil {
+		return 0, err
+	}
+	stmt := conn.Prep(`INSERT OR REPLACE INTO ContactCards (ContactID, UID, Card, Imported)
+		VALUES ($contactID, $uid, $card, TRUE);`)
+	stmt.SetInt64("$contactID", int64(contactID))
+	stmt.SetText("$uid", uid)
+	stmt.SetText("$card", buf.String())
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	return contactID, nil
+}
+
+// addContactAddress adds a visible address to a contact, if the
+// address is not already known under any contact. A known address
+// is made visible.
+func addContactAddress(conn *sqlite.Conn, contactID ContactID, addr *email.Address) error {
+	stmt := conn.Prep("SELECT AddressID FROM Addresses WHERE Address = $addr;")
+	stmt.SetText("$addr", addr.Addr)
+	if hasNext, err := stmt.Step(); err != nil {
+		return err
+	} else if hasNext {
+		addressID := stmt.GetInt64("AddressID")
+		stmt.Reset()
+		stmt := conn.Prep("UPDATE Addresses SET Visible = TRUE WHERE AddressID = $addressID;")
+		stmt.SetInt64("$addressID", addressID)
+		_, err := stmt.Step()
+		return err
+	}
+
+	stmt = conn.Prep(`INSERT INTO Addresses (AddressID, ContactID, Name, Address, DefaultAddr, Visible)
+		VALUES ($addressID, $contactID, $name, $addr, FALSE, TRUE);`)
+	stmt.SetInt64("$contactID", int64(contactID))
+	stmt.SetText("$name", addr.Name)
+	stmt.SetText("$addr", addr.Addr)
+	_, err := InsertRandID(stmt, "$addressID")
+	return err
+}
+
+// ExportContacts reports the address book as vCards.
+//
+// The address book is every contact the user has imported or has
+// a visible address for, excluding the user and robots. Only the
+// stored cards of imported contacts are used: a card stored from
+// mail by an earlier version is ignored. Contacts
+// exported for the first time are assigned a permanent UID, so conn
+// must be writable.
+func ExportContacts(conn *sqlite.Conn) (cards []ContactCard, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`SELECT Contacts.ContactID, ContactCards.UID,
+			CASE WHEN ContactCards.Imported THEN ContactCards.Card END AS Card
+		FROM Contacts
+		LEFT JOIN ContactCards ON Contacts.ContactID = ContactCards.ContactID
+		WHERE Contacts.ContactID <> 1
+		AND ifnull(Contacts.Hidden, 0) = 0
+		AND ifnull(Contacts.Robot, 0) = 0
+		AND (ifnull(ContactCards.Imported, 0) <> 0 OR Contacts.ContactID IN (
+			SELECT ContactID FROM Addresses WHERE Visible
+		))
+		ORDER BY Contacts.ContactID;`)
+	type row struct {
+		contactID ContactID
+		uid, card string
+	}
+	var rows []row
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.ExportContacts: %v", err)
+		} else if !hasNext {
+			break
+		}
+		rows = append(rows, row{
+			contactID: ContactID(stmt.GetInt64("ContactID")),
+			uid:       stmt.GetText("UID"),
+			card:      stmt.GetText("Card"),
+		})
+	}
+
+	for _, r := range rows {
+		cc, err := contactCard(conn, r.contactID, r.uid, r.card)
+		if err != nil {
+			return nil, fmt.Errorf("spillbox.ExportContacts: contact %d: %v", r.contactID, err)
+		}
+		cards = append(cards, cc)
+	}
+	return cards, nil
+}
+
+// contactCard builds the vCard of a contact from its stored card,
+// if any, and its visible addresses.
+func contactCard(conn *sqlite.Conn, contactID ContactID, uid, cardText string) (cc ContactCard, err error) {
+	cc.ContactID = contactID
+	if cardText != "" {
+		cards, err := vcard.Parse(strings.NewReader(cardText))
+		if err != nil {
+			return cc, err
+		}
+		cc.Card = cards[0]
+	}
+	if uid == "" {
+		if uid, err = newCardUID(); err != nil {
+			return cc, err
+		}
+		stmt := conn.Prep(`INSERT INTO ContactCards (ContactID, UID, Imported)
+			VALUES ($contactID, $uid, FALSE);`)
+		stmt.SetInt64("$contactID", int64(contactID))
+		stmt.SetText("$uid", uid)
+		if _, err := stmt.Step(); err != nil {
+			return cc, err
+		}
+	}
+	cc.Card.UID = uid
+
+	stmt := conn.Prep(`SELECT Name, Address, DefaultAddr FROM Addresses
+		WHERE ContactID = $contactID AND Visible
+		ORDER BY DefaultAddr DESC, AddressID;`)
+	stmt.SetInt64("$contactID", int64(contactID))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return cc, err
+		} else if !hasNext {
+			break
+		}
+		if cc.Card.FormattedName == "" {
+			cc.Card.FormattedName = stmt.GetText("Name")
+		}
+		addr := stmt.GetText("Address")
+		found := false
+		for _, e := range cc.Card.Emails {
+			if strings.EqualFold(e.Addr, addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			cc.Card.Emails = append(cc.Card.Emails, vcard.Email{
+				Addr: addr,
+				Pref: stmt.GetInt64("DefaultAddr") != 0 && len(cc.Card.Emails) == 0,
+			})
+		}
+	}
+	if cc.Card.FormattedName == "" && len(cc.Card.Emails) > 0 {
+		cc.Card.FormattedName = cc.Card.Emails[0].Addr
+	}
+
+	h := sha256.New()
+	if err := cc.Card.Encode(h); err != nil {
+		return cc, err
+	}
+	cc.ETag = hex.EncodeToString(h.Sum(nil)[:16])
+	return cc, nil
+}
+
+func newCardUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,98 @@
+package spillbox
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"spilled.ink/email/vcard"
+)
+
+const vcardMsg = `From: Mallory <mallory@example.com>
+To: user@spilled.ink
+Subject: my details
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="b"
+
+--b
+Content-Type: text/plain
+
+Here is my card.
+--b
+Content-Type: text/vcard; name="bob.vcf"
+
+BEGIN:VCARD
+VERSION:3.0
+UID:bob-uid
+FN:Bob
+EMAIL:bob@example.com
+EMAIL:mallory-drop@example.com
+END:VCARD
+--b--
+`
+
+func TestContactCardsFromMail(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// The user's own card for Bob.
+	bob, err := vcard.Parse(strings.NewReader("BEGIN:VCARD\r\nUID:bob-uid\r\nFN:Bob Jones\r\nEMAIL:bob@example.com\r\nEND:VCARD\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportContacts(conn, bob)
+	box.PutRW(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := insertTestMsg(t, box, vcardMsg)
+	partNum := -1
+	for _, part := range msg.Parts {
+		if part.ContentType == "text/vcard" {
+			partNum = part.PartNum
+		}
+	}
+	if partNum < 0 {
+		t.Fatal("no text/vcard part")
+	}
+
+	if conn, err = box.GetRW(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer box.PutRW(conn)
+	cards, err := ExportContacts(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 {
+		t.Fatalf("%d contacts after delivery, want 1: %+v", len(cards), cards)
+	}
+	if got := cards[0].Card; got.FormattedName != "Bob Jones" || len(got.Emails) != 1 {
+		t.Errorf("delivered vCard changed the user's card: %+v", got)
+	}
+
+	// The user asks for the attached card.
+	if _, err := box.ImportPartContacts(conn, msg.MsgID, partNum); err != nil {
+		t.Fatal(err)
+	}
+	cards, err = ExportContacts(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 {
+		t.Fatalf("%d contacts after import, want 1: %+v", len(cards), cards)
+	}
+	if got := cards[0].Card; got.FormattedName != "Bob" || len(got.Emails) != 2 {
+		t.Errorf("imported card: %+v", got)
+	}
+
+	if _, err := box.ImportPartContacts(conn, msg.MsgID, partNum-1); err == nil {
+		t.Error("ImportPartContacts of a text/plain part succeeded")
+	}
+}
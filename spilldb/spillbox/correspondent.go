@@ -0,0 +1,178 @@
+package spillbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// ContactByAddress finds the contact an email address belongs to.
+// The address is matched as given and then normalized, the same
+// way ResolveAddressID matches it, but no contact is created.
+// It reports 0 if the address has never been seen.
+func ContactByAddress(conn *sqlite.Conn, addr string) (ContactID, error) {
+	stmt := conn.Prep("SELECT ContactID FROM Addresses WHERE Address = $addr;")
+	for _, a := range []string{addr, string(normalizeAddr([]byte(addr)))} {
+		stmt.SetText("$addr", a)
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, fmt.Errorf("spillbox.ContactByAddress(%q): %v", addr, err)
+		} else if hasNext {
+			contactID := ContactID(stmt.GetInt64("ContactID"))
+			stmt.Reset()
+			return contactID, nil
+		}
+	}
+	return 0, nil
+}
+
+// ContactAddresses lists the addresses of a contact, the default
+// address first. It includes the hidden normalized forms.
+func ContactAddresses(conn *sqlite.Conn, contactID ContactID) (addrs []email.Address, err error) {
+	stmt := conn.Prep(`SELECT Name, Address FROM Addresses
+		WHERE ContactID = $contactID
+		ORDER BY DefaultAddr DESC, Visible DESC, Address, Name;`)
+	stmt.SetInt64("$contactID", int64(contactID))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.ContactAddresses(%d): %v", contactID, err)
+		} else if !hasNext {
+			break
+		}
+		addrs = append(addrs, email.Address{
+			Name: stmt.GetText("Name"),
+			Addr: stmt.GetText("Address"),
+		})
+	}
+	return addrs, nil
+}
+
+// MsgAddresses lists the addresses of a message in a role,
+// as they appeared in its header.
+func MsgAddresses(conn *sqlite.Conn, msgID email.MsgID, role AddressRole) (addrs []email.Address, err error) {
+	stmt := conn.Prep(`SELECT Name, Address FROM MsgAddresses
+		INNER JOIN Addresses ON Addresses.AddressID = MsgAddresses.AddressID
+		WHERE MsgID = $msgID AND Role = $role
+		ORDER BY MsgAddresses.rowid;`)
+	stmt.SetInt64("$msgID", int64(msgID))
+	stmt.SetInt64("$role", int64(role))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.MsgAddresses(%s, %s): %v", msgID, role, err)
+		} else if !hasNext {
+			break
+		}
+		addrs = append(addrs, email.Address{
+			Name: stmt.GetText("Name"),
+			Addr: stmt.GetText("Address"),
+		})
+	}
+	return addrs, nil
+}
+
+// CorrespondentQuery selects the messages of a contact for
+// FindCorrespondentMsgs and FindCorrespondentConvos.
+// Zero fields other than ContactID match everything.
+type CorrespondentQuery struct {
+	ContactID ContactID
+	Roles     []AddressRole // roles the contact has in the message
+	MailboxID int64
+	Since     time.Time // message date
+	Limit     int       // default 100
+}
+
+// CorrespondentMsg is a message found by FindCorrespondentMsgs.
+type CorrespondentMsg struct {
+	MsgID     email.MsgID
+	ConvoID   ConvoID
+	MailboxID int64
+	Date      time.Time
+}
+
+// FindCorrespondentMsgs finds the ready messages a contact appears
+// in under any of its addresses, most recent first.
+func FindCorrespondentMsgs(conn *sqlite.Conn, q CorrespondentQuery) (msgs []CorrespondentMsg, err error) {
+	stmt := conn.Prep(`SELECT DISTINCT Msgs.MsgID, ConvoID, MailboxID, Date
+		` + q.from() + `
+		ORDER BY Date DESC, Msgs.MsgID
+		LIMIT $limit;`)
+	q.bind(stmt)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.FindCorrespondentMsgs(%d): %v", q.ContactID, err)
+		} else if !hasNext {
+			break
+		}
+		msgs = append(msgs, CorrespondentMsg{
+			MsgID:     email.MsgID(stmt.GetInt64("MsgID")),
+			ConvoID:   ConvoID(stmt.GetInt64("ConvoID")),
+			MailboxID: stmt.GetInt64("MailboxID"),
+			Date:      time.Unix(stmt.GetInt64("Date"), 0),
+		})
+	}
+	return msgs, nil
+}
+
+// FindCorrespondentConvos finds the conversations with ready
+// messages a contact appears in, most recently active first.
+func FindCorrespondentConvos(conn *sqlite.Conn, q CorrespondentQuery) (convos []ConvoID, err error) {
+	stmt := conn.Prep(`SELECT ConvoID, max(Date) AS LastDate
+		` + q.from() + ` AND ConvoID IS NOT NULL
+		GROUP BY ConvoID
+		ORDER BY LastDate DESC, ConvoID
+		LIMIT $limit;`)
+	q.bind(stmt)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.FindCorrespondentConvos(%d): %v", q.ContactID, err)
+		} else if !hasNext {
+			break
+		}
+		convos = append(convos, ConvoID(stmt.GetInt64("ConvoID")))
+	}
+	return convos, nil
+}
+
+// from is the FROM and WHERE clauses of the query.
+//
+// The AddressesContact and MsgAddressesAddress indexes take the
+// query from the contact to its messages without scanning Msgs.
+func (q CorrespondentQuery) from() string {
+	where := []string{"ContactID = $contactID", "State = $msgReady"}
+	if len(q.Roles) > 0 {
+		roles := make([]string, len(q.Roles))
+		for i, role := range q.Roles {
+			roles[i] = strconv.Itoa(int(role))
+		}
+		where = append(where, "Role IN ("+strings.Join(roles, ", ")+")")
+	}
+	if q.MailboxID != 0 {
+		where = append(where, "MailboxID = $mailboxID")
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "Date >= $since")
+	}
+	return `FROM Addresses
+		INNER JOIN MsgAddresses ON MsgAddresses.AddressID = Addresses.AddressID
+		INNER JOIN Msgs ON Msgs.MsgID = MsgAddresses.MsgID
+		WHERE ` + strings.Join(where, " AND ")
+}
+
+func (q CorrespondentQuery) bind(stmt *sqlite.Stmt) {
+	stmt.SetInt64("$contactID", int64(q.ContactID))
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	if q.MailboxID != 0 {
+		stmt.SetInt64("$mailboxID", q.MailboxID)
+	}
+	if !q.Since.IsZero() {
+		stmt.SetInt64("$since", q.Since.Unix())
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	stmt.SetInt64("$limit", int64(limit))
+}
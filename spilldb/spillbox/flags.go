@@ -0,0 +1,129 @@
+package spillbox
+
+import (
+	"sort"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// The IMAP flags of a message are kept in two places. The system
+// flags, such as \Seen, are bits of Msgs.SysFlags, so queries test
+// them with "SysFlags & bit" without decoding anything. Keywords,
+// and any system flag without a bit, are rows of MsgKeywords.
+
+// System flags, the bits of Msgs.SysFlags.
+//
+// The bits are used in the SQL of triggers and queries,
+// do not renumber them.
+const (
+	FlagSeen     = 1 << iota // \Seen
+	FlagAnswered             // \Answered
+	FlagFlagged              // \Flagged
+	FlagDeleted              // \Deleted
+	FlagDraft                // \Draft
+	FlagRecent               // \Recent
+)
+
+var sysFlagNames = []struct {
+	bit  int64
+	name string
+}{
+	{FlagSeen, `\Seen`},
+	{FlagAnswered, `\Answered`},
+	{FlagFlagged, `\Flagged`},
+	{FlagDeleted, `\Deleted`},
+	{FlagDraft, `\Draft`},
+	{FlagRecent, `\Recent`},
+}
+
+// SysFlag reports the bit of the system flag name,
+// or 0 if name is not a system flag.
+func SysFlag(name string) int64 {
+	for _, f := range sysFlagNames {
+		if f.name == name {
+			return f.bit
+		}
+	}
+	return 0
+}
+
+// SplitFlags splits IMAP flags into the bits of Msgs.SysFlags
+// and the keywords kept in MsgKeywords.
+func SplitFlags(flags []string) (sysFlags int64, keywords []string) {
+	for _, flag := range flags {
+		if bit := SysFlag(flag); bit != 0 {
+			sysFlags |= bit
+		} else if flag != "" {
+			keywords = append(keywords, flag)
+		}
+	}
+	return sysFlags, keywords
+}
+
+// JoinFlags reports the sorted IMAP flags of a message
+// from its SysFlags and keywords.
+func JoinFlags(sysFlags int64, keywords []string) []string {
+	flags := append([]string(nil), keywords...)
+	for _, f := range sysFlagNames {
+		if sysFlags&f.bit != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// KeywordsColumn is a result column of the keywords of the message
+// of the row Msgs, separated by spaces. Keywords are IMAP atoms,
+// which cannot hold a space.
+const KeywordsColumn = `(SELECT group_concat(Keyword, ' ') FROM MsgKeywords
+		WHERE MsgKeywords.MsgID = Msgs.MsgID) AS Keywords`
+
+// MsgFlags reports the IMAP flags of the message of the current row
+// of stmt, which has the columns SysFlags and KeywordsColumn.
+func MsgFlags(stmt *sqlite.Stmt) []string {
+	return JoinFlags(stmt.GetInt64("SysFlags"), strings.Fields(stmt.GetText("Keywords")))
+}
+
+// SetMsgFlags replaces the IMAP flags of a message and sets its
+// ModSequence to modSeq.
+func SetMsgFlags(conn *sqlite.Conn, msgID email.MsgID, flags []string, modSeq int64) error {
+	sysFlags, keywords := SplitFlags(flags)
+	stmt := conn.Prep("UPDATE Msgs SET SysFlags = $sysFlags, ModSequence = $modSeq WHERE MsgID = $msgID;")
+	stmt.SetInt64("$sysFlags", sysFlags)
+	stmt.SetInt64("$modSeq", modSeq)
+	stmt.SetInt64("$msgID", int64(msgID))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep("DELETE FROM MsgKeywords WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return insertMsgKeywords(conn, msgID, keywords)
+}
+
+func insertMsgKeywords(conn *sqlite.Conn, msgID email.MsgID, keywords []string) error {
+	for _, keyword := range keywords {
+		stmt := conn.Prep("INSERT OR IGNORE INTO MsgKeywords (MsgID, Keyword) VALUES ($msgID, $keyword);")
+		stmt.SetInt64("$msgID", int64(msgID))
+		stmt.SetText("$keyword", keyword)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyKeywords copies the keywords of a message to a copy of it.
+func CopyKeywords(conn *sqlite.Conn, src, dst email.MsgID) error {
+	stmt := conn.Prep(`INSERT OR IGNORE INTO MsgKeywords (MsgID, Keyword)
+		SELECT $dst, Keyword FROM MsgKeywords WHERE MsgID = $src;`)
+	stmt.SetInt64("$src", int64(src))
+	stmt.SetInt64("$dst", int64(dst))
+	_, err := stmt.Step()
+	return err
+}
@@ -0,0 +1,204 @@
+package spillbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// GCStats reports the work done by a garbage collection.
+type GCStats struct {
+	MsgsRemoved      int   // expunged Msgs rows deleted
+	MailboxesRemoved int   // deleted Mailboxes rows removed
+	BlobsRemoved     int   // unreferenced blobs tombstoned
+	BlobBytes        int64 // content bytes of the removed blobs
+	Reclaimed        int64 // bytes returned to the file system by vacuuming
+}
+
+// GC garbage collects the mailbox.
+//
+// Mailboxes deleted and messages expunged before the retention
+// window are removed, blobs no longer referenced by any message
+// are tombstoned along with their objects in the object store,
+// and the free pages of the databases are vacuumed.
+func (box *Box) GC(ctx context.Context, retention time.Duration) (stats GCStats, err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer box.PutRW(conn)
+
+	sizeBefore, err := dbSize(conn)
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.GC: %v", err)
+	}
+
+	cutoff := time.Now().Add(-retention)
+	if err := expireMailboxes(conn, cutoff); err != nil {
+		return stats, fmt.Errorf("spillbox.GC: %v", err)
+	}
+	if err := gcMsgs(conn, cutoff, &stats); err != nil {
+		return stats, fmt.Errorf("spillbox.GC: %v", err)
+	}
+	if err := gcMailboxes(conn, cutoff, &stats); err != nil {
+		return stats, fmt.Errorf("spillbox.GC: %v", err)
+	}
+	if err := box.deleteObjects(ctx, conn); err != nil {
+		return stats, fmt.Errorf("spillbox.GC: %v", err)
+	}
+	for _, schema := range []string{"main", "blobs"} {
+		if err := vacuum(conn, schema); err != nil {
+			return stats, fmt.Errorf("spillbox.GC: vacuum %s: %v", schema, err)
+		}
+	}
+
+	sizeAfter, err := dbSize(conn)
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.GC: %v", err)
+	}
+	stats.Reclaimed = sizeBefore - sizeAfter
+	return stats, nil
+}
+
+// expireMailboxes expunges the messages of mailboxes deleted
+// before cutoff, as of the time the mailbox was deleted.
+func expireMailboxes(conn *sqlite.Conn, cutoff time.Time) error {
+	stmt := conn.Prep(`UPDATE Msgs SET State = $msgExpunged, Expunged = (
+			SELECT Deleted FROM Mailboxes WHERE Mailboxes.MailboxID = Msgs.MailboxID
+		)
+		WHERE State <> $msgExpunged AND MailboxID IN (
+			SELECT MailboxID FROM Mailboxes
+			WHERE Name IS NULL AND Deleted < $cutoff
+		);`)
+	stmt.SetInt64("$msgExpunged", int64(MsgExpunged))
+	stmt.SetInt64("$cutoff", cutoff.Unix())
+	_, err := stmt.Step()
+	return err
+}
+
+// gcMailboxes removes the mailboxes deleted before cutoff
+// once their messages are gone.
+func gcMailboxes(conn *sqlite.Conn, cutoff time.Time, stats *GCStats) error {
+	stmt := conn.Prep(`DELETE FROM Mailboxes
+		WHERE Name IS NULL AND Deleted < $cutoff
+		AND MailboxID NOT IN (SELECT MailboxID FROM Msgs WHERE MailboxID IS NOT NULL);`)
+	stmt.SetInt64("$cutoff", cutoff.Unix())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stats.MailboxesRemoved = conn.Changes()
+	return nil
+}
+
+func gcMsgs(conn *sqlite.Conn, cutoff time.Time, stats *GCStats) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	const expired = `SELECT MsgID FROM Msgs
+		WHERE State = $msgExpunged AND Expunged < $cutoff`
+	for _, table := range []string{"MsgAddresses", "MsgParts", "Invites", "MsgTags", "MsgFetchCache", "MsgHeaderFields", "MsgUnsubscribe", "LabelMsgs", "MsgKeywords"} {
+		stmt := conn.Prep("DELETE FROM " + table + " WHERE MsgID IN (" + expired + ");")
+		stmt.SetInt64("$msgExpunged", int64(MsgExpunged))
+		stmt.SetInt64("$cutoff", cutoff.Unix())
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	// The Message-IDs stay in the thread index, a copy of the
+	// message or a later reply may still refer to them.
+	stmt := conn.Prep("UPDATE ThreadMsgIDs SET MsgID = NULL WHERE MsgID IN (" + expired + ");")
+	stmt.SetInt64("$msgExpunged", int64(MsgExpunged))
+	stmt.SetInt64("$cutoff", cutoff.Unix())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep(`DELETE FROM Msgs
+		WHERE State = $msgExpunged AND Expunged < $cutoff;`)
+	stmt.SetInt64("$msgExpunged", int64(MsgExpunged))
+	stmt.SetInt64("$cutoff", cutoff.Unix())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stats.MsgsRemoved = conn.Changes()
+
+	// Copied messages share blobs, so a blob is only garbage
+	// once no message part or message header refers to it.
+	const unreferenced = `Content IS NOT NULL
+		AND BlobID NOT IN (SELECT BlobID FROM MsgParts WHERE BlobID IS NOT NULL)
+		AND BlobID NOT IN (SELECT HdrsBlobID FROM Msgs WHERE HdrsBlobID IS NOT NULL)`
+	stmt = conn.Prep("SELECT count(*) AS Count, ifnull(sum(" + storedSize + "), 0) AS Size FROM blobs.Blobs WHERE " + unreferenced + ";")
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stats.BlobsRemoved = int(stmt.GetInt64("Count"))
+	stats.BlobBytes = stmt.GetInt64("Size")
+	stmt.Reset()
+
+	stmt = conn.Prep("UPDATE blobs.Blobs SET Content = NULL, Deleted = $now WHERE " + unreferenced + ";")
+	stmt.SetInt64("$now", time.Now().Unix())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep(`DELETE FROM blobs.SealedBlobs
+		WHERE BlobID IN (SELECT BlobID FROM blobs.Blobs WHERE Content IS NULL);`)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep(`INSERT OR IGNORE INTO blobs.DeletedObjects (ObjectKey)
+		SELECT ObjectKey FROM blobs.RemoteBlobs
+		WHERE BlobID IN (SELECT BlobID FROM blobs.Blobs WHERE Content IS NULL);`)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep(`DELETE FROM blobs.RemoteBlobs
+		WHERE BlobID IN (SELECT BlobID FROM blobs.Blobs WHERE Content IS NULL);`)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// vacuum releases the free pages of a database schema.
+//
+// Databases created before incremental vacuuming was enabled are
+// converted with a one-time full VACUUM.
+func vacuum(conn *sqlite.Conn, schema string) error {
+	autoVacuum, err := pragmaInt(conn, schema+".auto_vacuum")
+	if err != nil {
+		return err
+	}
+	const incremental = 2
+	if autoVacuum != incremental {
+		if err := sqlitex.ExecTransient(conn, "PRAGMA "+schema+".auto_vacuum = INCREMENTAL;", nil); err != nil {
+			return err
+		}
+		return sqlitex.ExecTransient(conn, "VACUUM "+schema+";", nil)
+	}
+	return sqlitex.ExecTransient(conn, "PRAGMA "+schema+".incremental_vacuum;", nil)
+}
+
+func pragmaInt(conn *sqlite.Conn, pragma string) (v int64, err error) {
+	err = sqlitex.ExecTransient(conn, "PRAGMA "+pragma+";", func(stmt *sqlite.Stmt) error {
+		v = stmt.ColumnInt64(0)
+		return nil
+	})
+	return v, err
+}
+
+// dbSize reports the combined file size of the main and blobs databases.
+func dbSize(conn *sqlite.Conn) (size int64, err error) {
+	for _, schema := range []string{"main", "blobs"} {
+		pageCount, err := pragmaInt(conn, schema+".page_count")
+		if err != nil {
+			return 0, err
+		}
+		pageSize, err := pragmaInt(conn, schema+".page_size")
+		if err != nil {
+			return 0, err
+		}
+		size += pageCount * pageSize
+	}
+	return size, nil
+}
@@ -15,7 +15,7 @@ import (
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"spilled.ink/email"
-	"spilled.ink/imap/imapparser"
+	"spilled.ink/imap/imapformat"
 )
 
 // InsertMsg inserts a message into the client database.
@@ -34,19 +34,21 @@ import (
 //
 // On success, msg is filled out with a MsgID.
 func (c *Box) InsertMsg(ctx context.Context, msg *email.Msg, stagingID int64) (done bool, err error) {
-	conn := c.PoolRW.Get(ctx)
-	if conn == nil {
-		return false, context.Canceled
+	conn, err := c.GetRW(ctx)
+	if err != nil {
+		return false, err
 	}
-	defer c.PoolRW.Put(conn)
+	defer c.PutRW(conn)
 
-	done, err = c.insertMsg(conn, msg, stagingID)
+	labels := new(LabelUpdates)
+	done, err = c.insertMsg(conn, msg, stagingID, labels)
 	if err != nil {
 		return false, fmt.Errorf("InsertMsg: %v", err)
 	}
 	if !done {
 		return done, nil
 	}
+	c.NotifyLabelUpdates(labels)
 
 	if stagingID != 0 && len(c.notifiers) > 0 {
 		stmt := conn.Prep("SELECT Name from Mailboxes WHERE MailboxID = $mailboxID")
@@ -57,7 +59,7 @@ func (c *Box) InsertMsg(ctx context.Context, msg *email.Msg, stagingID int64) (d
 		}
 
 		c.mu.Lock()
-		devices := append([]imapparser.ApplePushDevice{}, c.devices[mailboxName]...)
+		devices := c.devices[mailboxName]
 		c.mu.Unlock()
 
 		for i := 0; i < len(c.notifiers); i++ {
@@ -67,7 +69,7 @@ func (c *Box) InsertMsg(ctx context.Context, msg *email.Msg, stagingID int64) (d
 	return true, nil
 }
 
-func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64) (done bool, err error) {
+func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64, labels *LabelUpdates) (done bool, err error) {
 	defer sqlitex.Save(conn)(&err)
 
 	if msg.RawHash == "" {
@@ -91,39 +93,46 @@ func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64) (don
 		}
 
 	} else {
+		if stagingID != 0 && msg.MailboxID == 0 {
+			// New mail from the outside world, check for viruses and spam.
+			if err := fileVirus(conn, msg); err != nil {
+				return false, err
+			}
+			if msg.MailboxID == 0 {
+				if err := fileSpam(conn, msg); err != nil {
+					return false, err
+				}
+			}
+			if msg.MailboxID == 0 {
+				if err := fileTags(conn, msg); err != nil {
+					return false, err
+				}
+			}
+		}
+
 		hdrBuf := new(bytes.Buffer)
 		if _, err := msg.Headers.Encode(hdrBuf); err != nil {
 			return false, err
 		}
-		stmt := conn.Prep(`INSERT INTO blobs.Blobs (Sha256, Content) VALUES ($sha256, $hdrs);`)
-		hashVal := sha256.Sum256(hdrBuf.Bytes())
-		stmt.SetText("$sha256", hex.EncodeToString(hashVal[:]))
-		stmt.SetZeroBlob("$hdrs", int64(hdrBuf.Len()))
+		stmt := conn.Prep(`INSERT INTO blobs.Blobs (Content) VALUES (NULL);`)
 		if _, err := stmt.Step(); err != nil {
 			return false, err
 		}
 		hdrsBlobID := conn.LastInsertRowID()
-		blob, err := conn.OpenBlob("blobs", "Blobs", "Content", hdrsBlobID, true)
-		if err != nil {
-			return false, err
-		}
-		_, err = blob.Write(hdrBuf.Bytes())
-		if err2 := blob.Close(); err == nil {
-			err = err2
-		}
-		if err != nil {
+		if err := c.writeBlob(conn, hdrsBlobID, hdrBuf.Bytes()); err != nil {
 			return false, err
 		}
 
-		flagsBuf := new(bytes.Buffer)
-		encodeFlags(flagsBuf, msg.Flags)
+		sysFlags, keywords := SplitFlags(msg.Flags)
 
 		stmt = conn.Prep(`INSERT INTO Msgs (
 				MsgID, StagingID, Seed, RawHash, State,
-				HdrsBlobID, Date, Flags, EncodedSize
+				HdrsBlobID, Date, SysFlags, EncodedSize, VirusScan,
+				Skeleton, EnvelopeFrom, EnvelopeTo
 			) VALUES (
 				$msgID, $stagingID, $seed, $rawHash, $state,
-				$hdrsBlobID, $date, $flags, $encodedSize
+				$hdrsBlobID, $date, $sysFlags, $encodedSize, $virusScan,
+				$skeleton, $envelopeFrom, $envelopeTo
 			);`)
 		stmt.SetText("$rawHash", msg.RawHash)
 		if stagingID != 0 {
@@ -135,8 +144,33 @@ func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64) (don
 		stmt.SetInt64("$state", int64(MsgFetching))
 		stmt.SetInt64("$hdrsBlobID", hdrsBlobID)
 		stmt.SetInt64("$date", msg.Date.Unix())
-		stmt.SetBytes("$flags", flagsBuf.Bytes())
+		stmt.SetInt64("$sysFlags", sysFlags)
 		stmt.SetInt64("$encodedSize", msg.EncodedSize)
+		if msg.VirusScan != "" {
+			stmt.SetText("$virusScan", msg.VirusScan)
+		} else {
+			stmt.SetNull("$virusScan")
+		}
+		if msg.Skeleton != nil {
+			skeleton, err := json.Marshal(msg.Skeleton)
+			if err != nil {
+				return false, err
+			}
+			stmt.SetBytes("$skeleton", skeleton)
+		} else {
+			stmt.SetNull("$skeleton")
+		}
+		if len(msg.EnvelopeTo) > 0 {
+			envelopeTo, err := json.Marshal(msg.EnvelopeTo)
+			if err != nil {
+				return false, err
+			}
+			stmt.SetText("$envelopeFrom", msg.EnvelopeFrom)
+			stmt.SetText("$envelopeTo", string(envelopeTo))
+		} else {
+			stmt.SetNull("$envelopeFrom")
+			stmt.SetNull("$envelopeTo")
+		}
 		// TODO stmt.SetInt64("$readyDate", msg.ReadyDate)
 		//stmt.SetText("$parseError", msg.ParseError)
 		msgID := extractMsgID(msg.RawHash)
@@ -154,14 +188,46 @@ func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64) (don
 			msg.MsgID = 0
 			return false, err
 		}
+		if err := insertTags(conn, msg.MsgID, msg.Tags); err != nil {
+			msg.MsgID = 0
+			return false, err
+		}
+		if err := insertMsgKeywords(conn, msg.MsgID, keywords); err != nil {
+			msg.MsgID = 0
+			return false, err
+		}
+		if err := insertFetchCache(conn, msg); err != nil {
+			msg.MsgID = 0
+			return false, err
+		}
+		if err := insertHeaderFields(conn, msg); err != nil {
+			msg.MsgID = 0
+			return false, err
+		}
+		if err := insertUnsubscribe(conn, msg); err != nil {
+			msg.MsgID = 0
+			return false, err
+		}
 	}
 
 	for i := range msg.Parts {
 		part := &msg.Parts[i]
-		if err := insertPart(conn, msg.MsgID, part); err != nil {
+		if part.BlobID == 0 {
+			if err := compressTextPart(part, c.CompressThreshold); err != nil {
+				msg.MsgID = 0
+				return false, fmt.Errorf("part %d: compress: %v", i, err)
+			}
+		}
+		if err := c.insertPart(conn, msg.MsgID, part); err != nil {
 			msg.MsgID = 0
 			return false, fmt.Errorf("part %d: %v", i, err)
 		}
+		if part.Content != nil && part.ContentType == "text/calendar" {
+			if err := insertInvites(conn, msg.MsgID, part); err != nil {
+				msg.MsgID = 0
+				return false, fmt.Errorf("part %d: invites: %v", i, err)
+			}
+		}
 	}
 
 	stmt := conn.Prep("SELECT count(*) FROM blobs.Blobs WHERE Content IS NULL AND BlobID IN (SELECT BlobID FROM MsgParts WHERE MsgID = $MsgID);")
@@ -173,7 +239,7 @@ func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64) (don
 		return false, nil
 	}
 
-	mailboxID, err := c.setMsgFetched(conn, msg.MsgID, msg.MailboxID)
+	mailboxID, err := c.setMsgFetched(conn, msg.MsgID, msg.MailboxID, labels)
 	if err != nil {
 		return false, err
 	}
@@ -181,6 +247,70 @@ func (c *Box) insertMsg(conn *sqlite.Conn, msg *email.Msg, stagingID int64) (don
 	return true, nil
 }
 
+// insertFetchCache stores the IMAP FETCH responses for msg.
+// Messages the responses cannot be computed for are not cached,
+// imapserver reports the problem when a client fetches them.
+func insertFetchCache(conn *sqlite.Conn, msg *email.Msg) error {
+	env, err := imapformat.AppendEnvelope(nil, &msg.Headers)
+	if err != nil {
+		return nil
+	}
+	bs, err := imapformat.AppendBodyStructure(nil, msg)
+	if err != nil {
+		return nil
+	}
+	stmt := conn.Prep(`INSERT INTO MsgFetchCache (MsgID, Version, Envelope, BodyStructure)
+		VALUES ($msgID, $version, $envelope, $bodyStructure);`)
+	stmt.SetInt64("$msgID", int64(msg.MsgID))
+	stmt.SetInt64("$version", imapformat.CacheVersion)
+	stmt.SetText("$envelope", string(env))
+	stmt.SetText("$bodyStructure", string(bs))
+	_, err = stmt.Step()
+	return err
+}
+
+// CopyFetchCache copies the cached FETCH responses of a message.
+func CopyFetchCache(conn *sqlite.Conn, srcMsgID, dstMsgID email.MsgID) error {
+	stmt := conn.Prep(`INSERT INTO MsgFetchCache (MsgID, Version, Envelope, BodyStructure)
+		SELECT $dstMsgID, Version, Envelope, BodyStructure
+		FROM MsgFetchCache WHERE MsgID = $srcMsgID;`)
+	stmt.SetInt64("$srcMsgID", int64(srcMsgID))
+	stmt.SetInt64("$dstMsgID", int64(dstMsgID))
+	_, err := stmt.Step()
+	return err
+}
+
+// insertHeaderFields stores the HeaderFieldKeys fields of msg.
+func insertHeaderFields(conn *sqlite.Conn, msg *email.Msg) error {
+	stmt := conn.Prep(`INSERT INTO MsgHeaderFields (MsgID, Key, Value)
+		VALUES ($msgID, $key, $value);`)
+	for _, key := range HeaderFieldKeys {
+		stmt.Reset()
+		stmt.SetInt64("$msgID", int64(msg.MsgID))
+		stmt.SetText("$key", string(key))
+		if v := msg.Headers.Get(key); v != nil {
+			stmt.SetBytes("$value", v)
+		} else {
+			stmt.SetNull("$value")
+		}
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyHeaderFields copies the stored header fields of a message.
+func CopyHeaderFields(conn *sqlite.Conn, srcMsgID, dstMsgID email.MsgID) error {
+	stmt := conn.Prep(`INSERT INTO MsgHeaderFields (MsgID, Key, Value)
+		SELECT $dstMsgID, Key, Value
+		FROM MsgHeaderFields WHERE MsgID = $srcMsgID;`)
+	stmt.SetInt64("$srcMsgID", int64(srcMsgID))
+	stmt.SetInt64("$dstMsgID", int64(dstMsgID))
+	_, err := stmt.Step()
+	return err
+}
+
 func countMsgs(conn *sqlite.Conn, mailboxID int64) (int64, error) {
 	stmt := conn.Prep(`SELECT count(*) FROM Msgs
 		WHERE State = 1 AND MailboxID = $mailboxID;`)
@@ -199,20 +329,23 @@ func InsertPartSummary(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) e
 			ContentType, ContentID,
 			BlobID,
 			ContentTransferEncoding, ContentTransferSize,
-			ContentTransferLines
+			ContentTransferLines, TransferAnomalies,
+			OriginalCharset, IsSynthesized
 		) VALUES (
 			$MsgID,
 			$PartNum, $Name, $IsBody, $IsAttachment, $IsCompressed, $CompressedSize,
 			$ContentType, $ContentID,
 			$BlobID,
 			$ContentTransferEncoding, $ContentTransferSize,
-			$ContentTransferLines
+			$ContentTransferLines, $TransferAnomalies,
+			$OriginalCharset, $IsSynthesized
 		);`)
 	stmt.SetInt64("$MsgID", int64(msgID))
 	stmt.SetInt64("$PartNum", int64(part.PartNum))
 	stmt.SetText("$Name", part.Name)
 	stmt.SetBool("$IsBody", part.IsBody)
 	stmt.SetBool("$IsAttachment", part.IsAttachment)
+	stmt.SetBool("$IsSynthesized", part.IsSynthesized)
 	stmt.SetBool("$IsCompressed", part.IsCompressed)
 	if part.IsCompressed {
 		stmt.SetInt64("$CompressedSize", part.CompressedSize)
@@ -223,13 +356,23 @@ func InsertPartSummary(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) e
 	stmt.SetText("$ContentTransferEncoding", part.ContentTransferEncoding)
 	stmt.SetInt64("$ContentTransferSize", part.ContentTransferSize)
 	stmt.SetInt64("$ContentTransferLines", part.ContentTransferLines)
+	if part.TransferAnomalies != "" {
+		stmt.SetText("$TransferAnomalies", part.TransferAnomalies)
+	} else {
+		stmt.SetNull("$TransferAnomalies")
+	}
+	if part.OriginalCharset != "" {
+		stmt.SetText("$OriginalCharset", part.OriginalCharset)
+	} else {
+		stmt.SetNull("$OriginalCharset")
+	}
 	if _, err := stmt.Step(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func insertPart(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) (err error) {
+func (c *Box) insertPart(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) (err error) {
 	if part.BlobID == 0 {
 		stmt := conn.Prep(`INSERT INTO blobs.Blobs (BlobID, Content) VALUES ($BlobID, $Content);`)
 		if part.Content == nil {
@@ -270,6 +413,23 @@ func insertPart(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) (err err
 	part.Content.Seek(0, 0)
 	defer part.Content.Seek(0, 0)
 
+	if c.blobCipher != nil {
+		// Sealing needs the whole content.
+		buf := new(bytes.Buffer)
+		if part.IsCompressed {
+			gzw := gzip.NewWriter(buf)
+			if _, err := io.Copy(gzw, part.Content); err != nil {
+				return err
+			}
+			if err := gzw.Close(); err != nil {
+				return err
+			}
+		} else if _, err := io.Copy(buf, part.Content); err != nil {
+			return err
+		}
+		return c.writeBlob(conn, part.BlobID, buf.Bytes())
+	}
+
 	blob, err := conn.OpenBlob("blobs", "Blobs", "Content", part.BlobID, true)
 	if err != nil {
 		return err
@@ -306,18 +466,7 @@ func insertPart(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) (err err
 	return err
 }
 
-func encodeFlags(buf *bytes.Buffer, flags []string) {
-	buf.WriteByte('{')
-	for i, flag := range flags {
-		if i > 0 {
-			buf.WriteString(", ")
-		}
-		fmt.Fprintf(buf, "%q: 1", flag)
-	}
-	buf.WriteByte('}')
-}
-
-func (c *Box) setMsgFetched(conn *sqlite.Conn, msgID email.MsgID, provMailboxID int64) (mailboxID int64, err error) {
+func (c *Box) setMsgFetched(conn *sqlite.Conn, msgID email.MsgID, provMailboxID int64, labels *LabelUpdates) (mailboxID int64, err error) {
 	stmt := conn.Prep(`UPDATE Msgs SET State = $msgReady
 		WHERE MsgID = $msgID AND State = $msgFetching;`)
 	stmt.SetInt64("$msgReady", int64(MsgReady))
@@ -327,19 +476,44 @@ func (c *Box) setMsgFetched(conn *sqlite.Conn, msgID email.MsgID, provMailboxID
 		return 0, err
 	}
 
-	mailboxID, err = assignMailbox(conn, msgID, provMailboxID)
+	mailboxID, err = c.assignMailbox(conn, msgID, provMailboxID)
 	if err != nil {
 		return 0, err
 	}
-	if _, err := assignConvo(conn, msgID); err != nil {
+	convoID, err := c.assignConvo(conn, msgID)
+	if err != nil {
+		return 0, err
+	}
+	labels.newMsg = msgID
+	if err := syncConvoLabels(conn, convoID, labels); err != nil {
 		return 0, err
 	}
 
+	// Keywords the message is appended with label its conversation.
+	var keywords []string
+	stmt = conn.Prep("SELECT Keyword FROM MsgKeywords WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, err
+		} else if !hasNext {
+			break
+		}
+		if flag := stmt.GetText("Keyword"); IsLabelKeyword(flag) {
+			keywords = append(keywords, flag)
+		}
+	}
+	for _, keyword := range keywords {
+		if err := LabelConvo(conn, msgID, keyword, true, labels); err != nil {
+			return 0, err
+		}
+	}
+
 	return mailboxID, nil
 }
 
-func assignMailbox(conn *sqlite.Conn, msgID email.MsgID, provMailboxID int64) (mailboxID int64, err error) {
-	hdr, err := LoadMsgHdrs(conn, msgID)
+func (c *Box) assignMailbox(conn *sqlite.Conn, msgID email.MsgID, provMailboxID int64) (mailboxID int64, err error) {
+	hdr, err := c.LoadMsgHdrs(conn, msgID)
 	if err != nil {
 		return 0, err
 	}
@@ -392,30 +566,43 @@ func assignMailbox(conn *sqlite.Conn, msgID email.MsgID, provMailboxID int64) (m
 	return mailboxID, nil
 }
 
-func assignConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err error) {
+// assignConvo threads msgID into a conversation, see thread.go.
+func (c *Box) assignConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err error) {
 	defer sqlitex.Save(conn)(&err)
 
-	stmt := conn.Prep(`WITH TheseContacts AS (
-			SELECT ContactID From Addresses
-			INNER JOIN MsgAddresses ON Addresses.AddressID = MsgAddresses.AddressID
-			WHERE MsgID = $msgID
-			AND ContactID <> 1
-		)
-		SELECT ConvoID FROM ConvoContacts
-		WHERE ContactID IN TheseContacts
-		GROUP BY 1
-		HAVING count(*) = (SELECT count(*) FROM TheseContacts);`)
-	stmt.SetInt64("$msgID", int64(msgID))
-	if exists, err := stmt.Step(); err != nil {
+	hdr, err := c.LoadMsgHdrs(conn, msgID)
+	if err != nil {
 		return 0, err
-	} else if exists {
-		convoID = ConvoID(stmt.GetInt64("ConvoID"))
-		stmt.Reset()
+	}
+	id, refs := threadRefs(hdr)
+
+	convos, err := threadConvos(conn, id, refs)
+	if err != nil {
+		return 0, err
+	}
+	if len(convos) > maxThreadMerge {
+		convos = convos[:maxThreadMerge]
+	}
+	if len(convos) == 0 {
+		convoID, err = c.newConvo(conn, msgID)
+		if err != nil {
+			return 0, err
+		}
 	} else {
-		convoID, err = newConvo(conn, msgID)
+		// The conversation of the oldest ancestor absorbs the others.
+		convoID = convos[0]
+		if err := mergeConvos(conn, convoID, convos[1:]); err != nil {
+			return 0, err
+		}
+		if err := joinConvo(conn, convoID, msgID); err != nil {
+			return 0, err
+		}
+	}
+	if err := indexThread(conn, msgID, convoID, id, refs); err != nil {
+		return 0, err
 	}
 
-	stmt = conn.Prep("UPDATE Msgs SET ConvoID = $convoID WHERE MsgID = $msgID;")
+	stmt := conn.Prep("UPDATE Msgs SET ConvoID = $convoID WHERE MsgID = $msgID;")
 	stmt.SetInt64("$msgID", int64(msgID))
 	stmt.SetInt64("$convoID", int64(convoID))
 	_, err = stmt.Step()
@@ -423,15 +610,15 @@ func assignConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err err
 	return convoID, err
 }
 
-func newConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err error) {
-	summary := ConvoSummary{}
+// msgContacts returns the contacts on the addresses of msgID.
+func msgContacts(conn *sqlite.Conn, msgID email.MsgID) (contacts []Contact, err error) {
 	stmt := conn.Prep(`SELECT Name, Address, ContactID FROM Addresses
 		INNER JOIN MsgAddresses ON Addresses.AddressID = MsgAddresses.AddressID
 		WHERE MsgID = $msgID AND ContactID <> 1;`)
 	stmt.SetInt64("$msgID", int64(msgID))
 	for {
 		if hasNext, err := stmt.Step(); err != nil {
-			return 0, err
+			return nil, err
 		} else if !hasNext {
 			break
 		}
@@ -440,18 +627,27 @@ func newConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err error)
 			name = strings.ToLower(stmt.GetText("Address"))
 		}
 		contactID := ContactID(stmt.GetInt64("ContactID"))
-		summary.Contacts = append(summary.Contacts, Contact{
+		contacts = append(contacts, Contact{
 			ContactID: contactID,
 			Name:      name,
 		})
 	}
+	return contacts, nil
+}
+
+func (c *Box) newConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err error) {
+	contacts, err := msgContacts(conn, msgID)
+	if err != nil {
+		return 0, err
+	}
+	summary := ConvoSummary{Contacts: contacts}
 	// TODO ? sort.Slice(summary.Contacts, func(i, j int) bool {})
 	summaryBytes, err := json.Marshal(summary)
 	if err != nil {
 		return 0, err
 	}
 
-	stmt = conn.Prep("INSERT INTO Convos (ConvoID, ConvoSummary) VALUES ($convoID, $summary);")
+	stmt := conn.Prep("INSERT INTO Convos (ConvoID, ConvoSummary) VALUES ($convoID, $summary);")
 	stmt.SetBytes("$summary", summaryBytes)
 	stmt.SetInt64("$convoID", int64(msgID))
 	if _, err := stmt.Step(); sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_PRIMARYKEY {
@@ -476,15 +672,15 @@ func newConvo(conn *sqlite.Conn, msgID email.MsgID) (convoID ConvoID, err error)
 		return 0, err
 	}
 
-	if err := assignLabel(conn, msgID, convoID); err != nil {
+	if err := c.assignLabel(conn, msgID, convoID); err != nil {
 		return 0, err
 	}
 
 	return convoID, nil
 }
 
-func assignLabel(conn *sqlite.Conn, msgID email.MsgID, convoID ConvoID) (err error) {
-	hdr, err := LoadMsgHdrs(conn, msgID)
+func (c *Box) assignLabel(conn *sqlite.Conn, msgID email.MsgID, convoID ConvoID) (err error) {
+	hdr, err := c.LoadMsgHdrs(conn, msgID)
 	if err != nil {
 		return err
 	}
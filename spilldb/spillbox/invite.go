@@ -0,0 +1,108 @@
+package spillbox
+
+import (
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+	"spilled.ink/email/ical"
+)
+
+// insertInvites records the events of a text/calendar part.
+//
+// A malformed calendar is not an error, the part remains
+// available as an attachment.
+func insertInvites(conn *sqlite.Conn, msgID email.MsgID, part *email.Part) error {
+	if _, err := part.Content.Seek(0, 0); err != nil {
+		return err
+	}
+	cal, err := ical.Parse(part.Content)
+	if _, err := part.Content.Seek(0, 0); err != nil {
+		return err
+	}
+	if err != nil {
+		return nil
+	}
+
+	stmt := conn.Prep(`INSERT OR REPLACE INTO Invites (
+			MsgID, PartNum, UID, Method, Sequence,
+			Summary, Location, Organizer, OrganizerName,
+			StartTime, EndTime, AllDay
+		) VALUES (
+			$msgID, $partNum, $uid, $method, $sequence,
+			$summary, $location, $organizer, $organizerName,
+			$startTime, $endTime, $allDay
+		);`)
+	for _, ev := range cal.Events {
+		if ev.UID == "" {
+			continue
+		}
+		stmt.Reset()
+		stmt.SetInt64("$msgID", int64(msgID))
+		stmt.SetInt64("$partNum", int64(part.PartNum))
+		stmt.SetText("$uid", ev.UID)
+		stmt.SetText("$method", cal.Method)
+		stmt.SetInt64("$sequence", int64(ev.Sequence))
+		stmt.SetText("$summary", ev.Summary)
+		stmt.SetText("$location", ev.Location)
+		stmt.SetText("$organizer", ev.Organizer.Addr)
+		stmt.SetText("$organizerName", ev.Organizer.Name)
+		stmt.SetInt64("$startTime", ev.Start.Unix())
+		stmt.SetInt64("$endTime", ev.End.Unix())
+		stmt.SetBool("$allDay", ev.AllDay)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadInvites loads the calendar events carried by a message.
+func LoadInvites(conn *sqlite.Conn, msgID email.MsgID) (invites []email.Invite, err error) {
+	stmt := conn.Prep(`SELECT PartNum, UID, Method, Sequence,
+			Summary, Location, Organizer, OrganizerName,
+			StartTime, EndTime, AllDay
+		FROM Invites WHERE MsgID = $msgID
+		ORDER BY PartNum, StartTime;`)
+	stmt.SetInt64("$msgID", int64(msgID))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.LoadInvites(%s): %v", msgID, err)
+		} else if !hasNext {
+			break
+		}
+		invites = append(invites, email.Invite{
+			PartNum:       int(stmt.GetInt64("PartNum")),
+			Method:        stmt.GetText("Method"),
+			UID:           stmt.GetText("UID"),
+			Sequence:      int(stmt.GetInt64("Sequence")),
+			Summary:       stmt.GetText("Summary"),
+			Location:      stmt.GetText("Location"),
+			Organizer:     stmt.GetText("Organizer"),
+			OrganizerName: stmt.GetText("OrganizerName"),
+			Start:         time.Unix(stmt.GetInt64("StartTime"), 0),
+			End:           time.Unix(stmt.GetInt64("EndTime"), 0),
+			AllDay:        stmt.GetInt64("AllDay") != 0,
+		})
+	}
+	return invites, nil
+}
+
+// CopyInvites copies the calendar events of srcMsgID to dstMsgID,
+// a copy of the message.
+func CopyInvites(conn *sqlite.Conn, srcMsgID, dstMsgID email.MsgID) error {
+	stmt := conn.Prep(`INSERT INTO Invites (
+			MsgID, PartNum, UID, Method, Sequence,
+			Summary, Location, Organizer, OrganizerName,
+			StartTime, EndTime, AllDay
+		) SELECT
+			$dstMsgID, PartNum, UID, Method, Sequence,
+			Summary, Location, Organizer, OrganizerName,
+			StartTime, EndTime, AllDay
+		FROM Invites WHERE MsgID = $srcMsgID;`)
+	stmt.SetInt64("$srcMsgID", int64(srcMsgID))
+	stmt.SetInt64("$dstMsgID", int64(dstMsgID))
+	_, err := stmt.Step()
+	return err
+}
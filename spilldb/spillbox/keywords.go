@@ -0,0 +1,152 @@
+package spillbox
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/imap"
+)
+
+// IMAP keywords, the flags without a leading backslash, are made up
+// by clients. Each one set on a message is a row of MsgKeywords,
+// so a client that invents keywords freely bloats every message.
+//
+// MailboxKeywords registers the keywords of each mailbox, up to
+// Box.MaxKeywords. A keyword is matched without regard to case and
+// keeps the spelling it was first registered with.
+//
+// Mailboxes created before the registry, and messages given labels
+// or copied in from another mailbox, may have keywords that are not
+// registered. Such a keyword is registered the next time it is
+// used, without counting against the limit.
+
+// DefaultMaxKeywords is the number of keywords a mailbox may have
+// when Box.MaxKeywords is not set.
+const DefaultMaxKeywords = 250
+
+// KeywordLimit reports the number of keywords a mailbox may have.
+func (box *Box) KeywordLimit() int {
+	if box.MaxKeywords > 0 {
+		return box.MaxKeywords
+	}
+	return DefaultMaxKeywords
+}
+
+// RegisterKeywords registers the keywords in flags with the mailbox,
+// replacing each with its registered spelling.
+//
+// If registering a new keyword would give the mailbox more than max,
+// RegisterKeywords reports imap.ErrTooManyKeywords and registers none.
+func RegisterKeywords(conn *sqlite.Conn, mailboxID int64, flags []string, max int) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	count := -1
+	for i, flag := range flags {
+		if flag == "" || flag[0] == '\\' {
+			continue
+		}
+		keyword, found, err := findKeyword(conn, mailboxID, flag)
+		if err != nil {
+			return err
+		}
+		if found {
+			flags[i] = keyword
+			continue
+		}
+		keyword, found, err = findMsgKeyword(conn, mailboxID, flag)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if count == -1 {
+				stmt := conn.Prep("SELECT count(*) FROM MailboxKeywords WHERE MailboxID = $mailboxID;")
+				stmt.SetInt64("$mailboxID", mailboxID)
+				n, err := sqlitex.ResultInt(stmt)
+				if err != nil {
+					return err
+				}
+				count = n
+			}
+			if count >= max {
+				return imap.ErrTooManyKeywords
+			}
+			count++
+			keyword = flag
+		}
+		stmt := conn.Prep("INSERT INTO MailboxKeywords (MailboxID, Keyword) VALUES ($mailboxID, $keyword);")
+		stmt.SetInt64("$mailboxID", mailboxID)
+		stmt.SetText("$keyword", keyword)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		flags[i] = keyword
+	}
+	return nil
+}
+
+// CanonicalKeywords replaces each keyword in flags that is
+// registered with the mailbox with its registered spelling.
+// Keywords that are not registered are left as they are.
+func CanonicalKeywords(conn *sqlite.Conn, mailboxID int64, flags []string) error {
+	for i, flag := range flags {
+		if flag == "" || flag[0] == '\\' {
+			continue
+		}
+		keyword, found, err := findKeyword(conn, mailboxID, flag)
+		if err != nil {
+			return err
+		}
+		if found {
+			flags[i] = keyword
+		}
+	}
+	return nil
+}
+
+// KeywordsFull reports whether the mailbox has max keywords,
+// so no new keyword may be set on its messages.
+func KeywordsFull(conn *sqlite.Conn, mailboxID int64, max int) (bool, error) {
+	stmt := conn.Prep("SELECT count(*) FROM MailboxKeywords WHERE MailboxID = $mailboxID;")
+	stmt.SetInt64("$mailboxID", mailboxID)
+	n, err := sqlitex.ResultInt(stmt)
+	if err != nil {
+		return false, err
+	}
+	return n >= max, nil
+}
+
+func findKeyword(conn *sqlite.Conn, mailboxID int64, flag string) (keyword string, found bool, err error) {
+	stmt := conn.Prep(`SELECT Keyword FROM MailboxKeywords
+		WHERE MailboxID = $mailboxID AND Keyword = $keyword;`)
+	stmt.SetInt64("$mailboxID", mailboxID)
+	stmt.SetText("$keyword", flag)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", false, err
+	} else if !hasNext {
+		return "", false, nil
+	}
+	keyword = stmt.GetText("Keyword")
+	stmt.Reset()
+	return keyword, true, nil
+}
+
+// findMsgKeyword looks for an unregistered keyword on the
+// messages of the mailbox.
+func findMsgKeyword(conn *sqlite.Conn, mailboxID int64, flag string) (keyword string, found bool, err error) {
+	stmt := conn.Prep(`SELECT Keyword FROM MsgKeywords
+		INNER JOIN Msgs ON Msgs.MsgID = MsgKeywords.MsgID
+		WHERE MailboxID = $mailboxID
+		AND State = $msgReady
+		AND Keyword = $keyword COLLATE NOCASE
+		LIMIT 1;`)
+	stmt.SetInt64("$mailboxID", mailboxID)
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	stmt.SetText("$keyword", flag)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", false, err
+	} else if !hasNext {
+		return "", false, nil
+	}
+	keyword = stmt.GetText("Keyword")
+	stmt.Reset()
+	return keyword, true, nil
+}
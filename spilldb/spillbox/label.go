@@ -0,0 +1,404 @@
+package spillbox
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/imap"
+)
+
+// Labels of conversations are shown to IMAP clients as keywords,
+// the flags without a leading backslash.
+//
+// Setting a keyword on a message labels its conversation, and the
+// keyword is set on every message of the conversation, including
+// those that join it later. Clearing the keyword from a message
+// removes the label from the conversation and the keyword from
+// its messages.
+//
+// Each label is also a read-only mailbox named LabelMailboxPrefix
+// followed by the label. The messages of the mailbox are listed in
+// LabelMsgs with UIDs of their own, numbered from Labels.NextUID.
+//
+// The system labels assigned to new conversations, such as
+// "Personal Mail", are not keywords.
+
+// LabelMailboxPrefix begins the name of the mailbox of a label.
+const LabelMailboxPrefix = "label:"
+
+// labelMailboxBase is added to a LabelID to make the ID of its
+// mailbox. Mailboxes.MailboxID, from InsertRandID, is smaller.
+const labelMailboxBase = 1 << 40
+
+// LabelMailboxID reports the mailbox ID of the mailbox of a label.
+func LabelMailboxID(labelID LabelID) int64 {
+	return labelMailboxBase + int64(labelID)
+}
+
+// MailboxLabel reports the label of a mailbox ID made by
+// LabelMailboxID, or false for the ID of any other mailbox.
+func MailboxLabel(mailboxID int64) (LabelID, bool) {
+	if mailboxID <= labelMailboxBase {
+		return 0, false
+	}
+	return LabelID(mailboxID - labelMailboxBase), true
+}
+
+var systemLabels = map[string]bool{
+	"Personal Mail":  true,
+	"Subscriptions":  true,
+	"Spam and Trash": true,
+}
+
+// IsLabelKeyword reports whether an IMAP flag is a keyword
+// that labels conversations. System flags, such as \Seen, and
+// the $ keywords with meanings of their own, such as $Junk,
+// are not.
+func IsLabelKeyword(flag string) bool {
+	if flag == "" || flag[0] == '\\' || flag[0] == '$' || systemLabels[flag] {
+		return false
+	}
+	for _, c := range flag {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+		switch c {
+		case '(', ')', '{', '%', '*', '"', '\\', ']':
+			return false
+		}
+	}
+	return true
+}
+
+// Label is a label with a mailbox of its own.
+type Label struct {
+	LabelID LabelID
+	Label   string
+}
+
+// Labels lists the labels that are IMAP keywords.
+func Labels(conn *sqlite.Conn) (labels []Label, err error) {
+	stmt := conn.Prep("SELECT LabelID, Label FROM Labels WHERE Label IS NOT NULL ORDER BY Label;")
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		label := stmt.GetText("Label")
+		if !IsLabelKeyword(label) {
+			continue
+		}
+		labels = append(labels, Label{
+			LabelID: LabelID(stmt.GetInt64("LabelID")),
+			Label:   label,
+		})
+	}
+	return labels, nil
+}
+
+// FindLabel reports the ID of a label, or 0 if there is none.
+func FindLabel(conn *sqlite.Conn, label string) (LabelID, error) {
+	stmt := conn.Prep("SELECT LabelID FROM Labels WHERE Label = $label;")
+	stmt.SetText("$label", label)
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, err
+	} else if !hasNext {
+		return 0, nil
+	}
+	labelID := LabelID(stmt.GetInt64("LabelID"))
+	stmt.Reset()
+	return labelID, nil
+}
+
+// LabelUpdates collects the changes made to mailboxes by labeling
+// conversations. Once they are committed, NotifyLabelUpdates tells
+// the notifiers of the box about them.
+type LabelUpdates struct {
+	flags    map[int64][]uint32 // mailboxID -> UIDs of messages with changed keywords
+	expunged map[int64][]uint32 // label mailboxID -> sequence numbers removed
+	grown    map[int64]string   // label mailboxID -> name, mailboxes with new messages
+
+	// newMsg is a message being inserted, whose keywords
+	// are reported along with it, not as a change.
+	newMsg email.MsgID
+}
+
+func (u *LabelUpdates) flag(msgID email.MsgID, mailboxID int64, uid uint32) {
+	if u == nil || msgID == u.newMsg {
+		return
+	}
+	if u.flags == nil {
+		u.flags = make(map[int64][]uint32)
+	}
+	u.flags[mailboxID] = append(u.flags[mailboxID], uid)
+}
+
+func (u *LabelUpdates) expunge(labelID LabelID, seqNum uint32) {
+	if u == nil {
+		return
+	}
+	if u.expunged == nil {
+		u.expunged = make(map[int64][]uint32)
+	}
+	mailboxID := LabelMailboxID(labelID)
+	u.expunged[mailboxID] = append(u.expunged[mailboxID], seqNum)
+}
+
+func (u *LabelUpdates) grow(labelID LabelID, label string) {
+	if u == nil {
+		return
+	}
+	if u.grown == nil {
+		u.grown = make(map[int64]string)
+	}
+	u.grown[LabelMailboxID(labelID)] = LabelMailboxPrefix + label
+}
+
+// NotifyLabelUpdates tells the notifiers of the box about the
+// committed changes in u.
+func (box *Box) NotifyLabelUpdates(u *LabelUpdates) {
+	for _, n := range box.notifiers {
+		if un, ok := n.(imap.UpdateNotifier); ok {
+			for mailboxID, seqNums := range u.expunged {
+				go un.NotifyExpunge(box.userID, mailboxID, seqNums)
+			}
+			for mailboxID, uids := range u.flags {
+				go un.NotifyFlags(box.userID, mailboxID, uids)
+			}
+		}
+		for mailboxID, name := range u.grown {
+			go n.Notify(box.userID, mailboxID, name, imap.PushDevices{})
+		}
+	}
+}
+
+// LabelConvo sets or clears a label keyword on the conversation
+// of msgID. A message that is not part of a conversation keeps
+// the keyword as a flag of its own.
+func LabelConvo(conn *sqlite.Conn, msgID email.MsgID, label string, set bool, u *LabelUpdates) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep("SELECT ConvoID FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	id, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return err
+	}
+	convoID := ConvoID(id)
+	if convoID == 0 {
+		return nil
+	}
+
+	if set {
+		stmt = conn.Prep("INSERT OR IGNORE INTO Labels (Label) VALUES ($label);")
+		stmt.SetText("$label", label)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	labelID, err := FindLabel(conn, label)
+	if err != nil || labelID == 0 {
+		return err
+	}
+
+	if !set {
+		stmt = conn.Prep("DELETE FROM ConvoLabels WHERE LabelID = $labelID AND ConvoID = $convoID;")
+		stmt.SetInt64("$labelID", int64(labelID))
+		stmt.SetInt64("$convoID", int64(convoID))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		return unlabelConvoMsgs(conn, convoID, labelID, label, u)
+	}
+
+	stmt = conn.Prep("INSERT OR IGNORE INTO ConvoLabels (LabelID, ConvoID) VALUES ($labelID, $convoID);")
+	stmt.SetInt64("$labelID", int64(labelID))
+	stmt.SetInt64("$convoID", int64(convoID))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return labelConvoMsgs(conn, convoID, labelID, label, u)
+}
+
+// syncConvoLabels sets the label keywords of a conversation on all
+// of its messages, after a message joins it or conversations merge.
+func syncConvoLabels(conn *sqlite.Conn, convoID ConvoID, u *LabelUpdates) error {
+	stmt := conn.Prep(`SELECT Labels.LabelID, Label FROM ConvoLabels
+		INNER JOIN Labels ON Labels.LabelID = ConvoLabels.LabelID
+		WHERE ConvoID = $convoID AND Label IS NOT NULL;`)
+	stmt.SetInt64("$convoID", int64(convoID))
+	var labels []Label
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		label := stmt.GetText("Label")
+		if IsLabelKeyword(label) {
+			labels = append(labels, Label{
+				LabelID: LabelID(stmt.GetInt64("LabelID")),
+				Label:   label,
+			})
+		}
+	}
+	for _, label := range labels {
+		if err := labelConvoMsgs(conn, convoID, label.LabelID, label.Label, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type convoMsg struct {
+	msgID     email.MsgID
+	mailboxID int64
+	uid       uint32
+	labeled   bool // has the label keyword
+	listed    bool // in LabelMsgs
+}
+
+// convoMsgs loads the ready messages of a conversation, whether
+// they have the keyword label, and whether they are in the
+// mailbox of labelID.
+func convoMsgs(conn *sqlite.Conn, convoID ConvoID, labelID LabelID, label string) (msgs []convoMsg, err error) {
+	stmt := conn.Prep(`SELECT Msgs.MsgID, MailboxID, Msgs.UID,
+		EXISTS (SELECT 1 FROM MsgKeywords
+			WHERE MsgKeywords.MsgID = Msgs.MsgID AND Keyword = $label) AS Labeled,
+		LabelMsgs.MsgID IS NOT NULL AS Listed
+		FROM Msgs
+		LEFT JOIN LabelMsgs ON LabelMsgs.MsgID = Msgs.MsgID AND LabelMsgs.LabelID = $labelID
+		WHERE ConvoID = $convoID AND State = $msgReady
+		ORDER BY Date, Msgs.MsgID;`)
+	stmt.SetText("$label", label)
+	stmt.SetInt64("$labelID", int64(labelID))
+	stmt.SetInt64("$convoID", int64(convoID))
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		msgs = append(msgs, convoMsg{
+			msgID:     email.MsgID(stmt.GetInt64("MsgID")),
+			mailboxID: stmt.GetInt64("MailboxID"),
+			uid:       uint32(stmt.GetInt64("UID")),
+			labeled:   stmt.GetInt64("Labeled") != 0,
+			listed:    stmt.GetInt64("Listed") != 0,
+		})
+	}
+	return msgs, nil
+}
+
+// setMsgKeyword sets or clears a keyword of a message.
+func setMsgKeyword(conn *sqlite.Conn, msg convoMsg, keyword string, set bool) error {
+	modSeq, err := NextMsgModSeq(conn, msg.mailboxID)
+	if err != nil {
+		return err
+	}
+	stmt := conn.Prep("UPDATE Msgs SET ModSequence = $modSeq WHERE MsgID = $msgID;")
+	stmt.SetInt64("$modSeq", modSeq)
+	stmt.SetInt64("$msgID", int64(msg.msgID))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if set {
+		stmt = conn.Prep("INSERT OR IGNORE INTO MsgKeywords (MsgID, Keyword) VALUES ($msgID, $keyword);")
+	} else {
+		stmt = conn.Prep("DELETE FROM MsgKeywords WHERE MsgID = $msgID AND Keyword = $keyword;")
+	}
+	stmt.SetInt64("$msgID", int64(msg.msgID))
+	stmt.SetText("$keyword", keyword)
+	_, err = stmt.Step()
+	return err
+}
+
+func labelConvoMsgs(conn *sqlite.Conn, convoID ConvoID, labelID LabelID, label string, u *LabelUpdates) error {
+	msgs, err := convoMsgs(conn, convoID, labelID, label)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if !msg.labeled {
+			if err := setMsgKeyword(conn, msg, label, true); err != nil {
+				return err
+			}
+			u.flag(msg.msgID, msg.mailboxID, msg.uid)
+		}
+		if msg.listed {
+			continue
+		}
+		stmt := conn.Prep("SELECT NextUID FROM Labels WHERE LabelID = $labelID;")
+		stmt.SetInt64("$labelID", int64(labelID))
+		uid, err := sqlitex.ResultInt64(stmt)
+		if err != nil {
+			return err
+		}
+		stmt = conn.Prep("UPDATE Labels SET NextUID = $uid + 1 WHERE LabelID = $labelID;")
+		stmt.SetInt64("$uid", uid)
+		stmt.SetInt64("$labelID", int64(labelID))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		stmt = conn.Prep("INSERT INTO LabelMsgs (LabelID, MsgID, UID) VALUES ($labelID, $msgID, $uid);")
+		stmt.SetInt64("$labelID", int64(labelID))
+		stmt.SetInt64("$msgID", int64(msg.msgID))
+		stmt.SetInt64("$uid", uid)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		u.grow(labelID, label)
+	}
+	return nil
+}
+
+func unlabelConvoMsgs(conn *sqlite.Conn, convoID ConvoID, labelID LabelID, label string, u *LabelUpdates) error {
+	// Sequence numbers in the label mailbox of the messages
+	// removed from it, adjusted as EXPUNGE responses are.
+	stmt := conn.Prep(`WITH SeqNumMsgs AS (
+			SELECT row_number() OVER win AS SeqNum, ConvoID
+			FROM LabelMsgs
+			INNER JOIN Msgs ON Msgs.MsgID = LabelMsgs.MsgID
+			WHERE LabelID = $labelID AND State = $msgReady
+			WINDOW win AS (ORDER BY LabelMsgs.UID)
+		)
+		SELECT SeqNum FROM SeqNumMsgs WHERE ConvoID = $convoID ORDER BY SeqNum;`)
+	stmt.SetInt64("$labelID", int64(labelID))
+	stmt.SetInt64("$convoID", int64(convoID))
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	removed := uint32(0)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		u.expunge(labelID, uint32(stmt.GetInt64("SeqNum"))-removed)
+		removed++
+	}
+
+	stmt = conn.Prep(`DELETE FROM LabelMsgs WHERE LabelID = $labelID
+		AND MsgID IN (SELECT MsgID FROM Msgs WHERE ConvoID = $convoID);`)
+	stmt.SetInt64("$labelID", int64(labelID))
+	stmt.SetInt64("$convoID", int64(convoID))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	msgs, err := convoMsgs(conn, convoID, labelID, label)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if !msg.labeled {
+			continue
+		}
+		if err := setMsgKeyword(conn, msg, label, false); err != nil {
+			return err
+		}
+		u.flag(msg.msgID, msg.mailboxID, msg.uid)
+	}
+	return nil
+}
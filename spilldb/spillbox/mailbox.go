@@ -2,36 +2,78 @@ package spillbox
 
 import (
 	"fmt"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"spilled.ink/imap"
 )
 
+// Delimiter separates the levels of mailbox names,
+// "a/b" is a mailbox b inferior to a.
+const Delimiter = '/'
+
+// CreateMailbox creates the named mailbox and any of its superior
+// names that do not exist, RFC 3501 section 6.3.3.
+//
+// Creating a \Noselect name, left by deleting a mailbox with
+// inferiors, makes it a mailbox again.
 func CreateMailbox(conn *sqlite.Conn, name string, attr imap.ListAttrFlag) (err error) {
 	defer sqlitex.Save(conn)(&err)
 
 	for _, res := range noKidsMailboxes {
-		if strings.HasPrefix(name, res) && len(name) > len(res) && name[len(res)] == '/' {
+		if strings.HasPrefix(name, res) && len(name) > len(res) && name[len(res)] == Delimiter {
 			return fmt.Errorf("spillbox.CreateMailbox(%q): cannot create mailbox under %q", name, res)
 		}
 	}
 
+	attrs, found, err := mailboxAttrs(conn, name)
+	if err != nil {
+		return fmt.Errorf("spillbox.CreateMailbox(%q): %v", name, err)
+	}
+	if found {
+		if attrs&imap.AttrNoselect == 0 {
+			return fmt.Errorf("spillbox.CreateMailbox(%q): exists", name)
+		}
+		stmt := conn.Prep("UPDATE Mailboxes SET Attrs = $attrs WHERE Name = $name;")
+		stmt.SetText("$name", name)
+		stmt.SetInt64("$attrs", int64(attr))
+		_, err := stmt.Step()
+		return err
+	}
+
+	for _, parent := range imap.MailboxParents(name, Delimiter) {
+		if _, found, err := mailboxAttrs(conn, parent); err != nil {
+			return fmt.Errorf("spillbox.CreateMailbox(%q): %v", name, err)
+		} else if found {
+			continue
+		}
+		if err := createMailbox(conn, parent, 0); err != nil {
+			return fmt.Errorf("spillbox.CreateMailbox(%q) parent %q: %v", name, parent, err)
+		}
+	}
+	if err := createMailbox(conn, name, attr); err != nil {
+		return fmt.Errorf("spillbox.CreateMailbox(%q): %v", name, err)
+	}
+	return nil
+}
+
+// createMailbox adds a mailbox to the Mailboxes table.
+func createMailbox(conn *sqlite.Conn, name string, attr imap.ListAttrFlag) error {
 	stmt := conn.Prep(`INSERT INTO Mailboxes (
 			MailboxID, NextUID, UIDValidity, Name, Attrs
 		) VALUES (
 			$id, 1,
-			coalesce((SELECT max(UIDValidity) FROM Mailboxes), 42) + 1,
+			max(
+				coalesce((SELECT max(UIDValidity) FROM Mailboxes), 42),
+				coalesce((SELECT UIDValidity FROM MailboxSequencing WHERE Name = $name), 0)
+			) + 1,
 			$name, $attrs);`)
 	stmt.SetText("$name", name)
 	stmt.SetInt64("$attrs", int64(attr))
 	if _, err := InsertRandID(stmt, "$id"); err != nil {
-		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
-			return fmt.Errorf("spillbox.CreateMailbox(%q): exists", name)
-		}
-		return fmt.Errorf("spillbox.CreateMailbox(%q): %v", name, err)
+		return err
 	}
 
 	stmt = conn.Prep(`INSERT OR IGNORE INTO MailboxSequencing
@@ -40,45 +82,138 @@ func CreateMailbox(conn *sqlite.Conn, name string, attr imap.ListAttrFlag) (err
 	if _, err := stmt.Step(); err != nil {
 		return err
 	}
+	stmt = conn.Prep(`UPDATE MailboxSequencing
+		SET UIDValidity = (SELECT UIDValidity FROM Mailboxes WHERE Name = $name)
+		WHERE Name = $name;`)
+	stmt.SetText("$name", name)
+	_, err := stmt.Step()
+	return err
+}
 
-	outer := name
-	for {
-		outer = filepath.Dir(outer)
-		if outer == "." || outer == "INBOX" {
-			break
-		}
-
-		stmt.Reset()
-		stmt.SetText("$name", outer)
-		_, err := InsertRandID(stmt, "$id")
-		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
-			break // outer dir exists
-		}
-		if err != nil {
-			return fmt.Errorf("CreateMailbox(%q) outer name %q failed: %v", name, outer, err)
-		}
+// mailboxAttrs reports the attributes of the named mailbox
+// and whether it exists.
+func mailboxAttrs(conn *sqlite.Conn, name string) (attrs imap.ListAttrFlag, found bool, err error) {
+	stmt := conn.Prep("SELECT ifnull(Attrs, 0) AS Attrs FROM Mailboxes WHERE Name = $name;")
+	stmt.SetText("$name", name)
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, false, err
+	} else if !hasNext {
+		return 0, false, nil
 	}
+	attrs = imap.ListAttrFlag(stmt.GetInt64("Attrs"))
+	stmt.Reset()
+	return attrs, true, nil
+}
 
-	return nil
-
+// hasInferiors reports whether there are mailboxes inferior to name.
+func hasInferiors(conn *sqlite.Conn, name string) (bool, error) {
+	stmt := conn.Prep(`SELECT count(*) FROM Mailboxes
+		WHERE substr(Name, 1, length($prefix)) = $prefix;`)
+	stmt.SetText("$prefix", name+string(Delimiter))
+	count, err := sqlitex.ResultInt(stmt)
+	return count > 0, err
 }
 
+// DeleteMailbox deletes the named mailbox.
+//
+// The mailbox and its messages are kept, under DeletedName, until
+// they are removed by GC. A new mailbox with the same name is given
+// a higher UIDVALIDITY.
+//
+// A mailbox with inferior names is replaced by a \Noselect name,
+// RFC 3501 section 6.3.4. A \Noselect name cannot be deleted
+// until its inferiors are.
 func DeleteMailbox(conn *sqlite.Conn, name string) (err error) {
 	if reservedMailboxNames[name] {
 		return fmt.Errorf("spillbox.DeleteMailbox: cannot delete %q", name)
 	}
-	stmt := conn.Prep(`UPDATE Mailboxes SET DeletedName = Name, Name = NULL
+	defer sqlitex.Save(conn)(&err)
+
+	attrs, found, err := mailboxAttrs(conn, name)
+	if err != nil {
+		return fmt.Errorf("spillbox.DeleteMailbox(%q): %v", name, err)
+	} else if !found {
+		return fmt.Errorf("spillbox.DeleteMailbox(%q): no such mailbox", name)
+	}
+	hasKids, err := hasInferiors(conn, name)
+	if err != nil {
+		return fmt.Errorf("spillbox.DeleteMailbox(%q): %v", name, err)
+	}
+	if hasKids && attrs&imap.AttrNoselect != 0 {
+		return fmt.Errorf("spillbox.DeleteMailbox(%q): has inferior mailboxes", name)
+	}
+
+	stmt := conn.Prep(`UPDATE Mailboxes
+		SET DeletedName = Name, Name = NULL, Deleted = $now
 		WHERE Name = $name;`)
 	stmt.SetText("$name", name)
+	stmt.SetInt64("$now", time.Now().Unix())
 	if _, err := stmt.Step(); err != nil {
 		return fmt.Errorf("spillbox.DeleteMailbox(%q): %v", name, err)
 	}
-	if conn.Changes() == 0 {
-		return fmt.Errorf("spillbox.DeleteMailbox(%q): no such mailbox", name)
+	if hasKids {
+		if err := createMailbox(conn, name, imap.AttrNoselect); err != nil {
+			return fmt.Errorf("spillbox.DeleteMailbox(%q): %v", name, err)
+		}
 	}
 	return nil
 }
 
+// DeletedMailbox is a mailbox removed by DeleteMailbox.
+type DeletedMailbox struct {
+	MailboxID   int64
+	DeletedName string
+	Deleted     time.Time // zero if deleted before times were recorded
+	UIDValidity uint32
+	NumMsgs     int
+}
+
+// DeletedMailboxes lists the deleted mailboxes not yet removed by GC.
+func DeletedMailboxes(conn *sqlite.Conn) (mailboxes []DeletedMailbox, err error) {
+	stmt := conn.Prep(`SELECT MailboxID, DeletedName, Deleted, UIDValidity,
+			(SELECT count(*) FROM Msgs
+				WHERE Msgs.MailboxID = Mailboxes.MailboxID
+				AND State = $msgReady) AS NumMsgs
+		FROM Mailboxes
+		WHERE Name IS NULL
+		ORDER BY DeletedName, Deleted;`)
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.DeletedMailboxes: %v", err)
+		} else if !hasNext {
+			break
+		}
+		m := DeletedMailbox{
+			MailboxID:   stmt.GetInt64("MailboxID"),
+			DeletedName: stmt.GetText("DeletedName"),
+			UIDValidity: uint32(stmt.GetInt64("UIDValidity")),
+			NumMsgs:     int(stmt.GetInt64("NumMsgs")),
+		}
+		if t := stmt.GetInt64("Deleted"); t != 0 {
+			m.Deleted = time.Unix(t, 0)
+		}
+		mailboxes = append(mailboxes, m)
+	}
+	return mailboxes, nil
+}
+
+// DraftsMailboxID reports the \Drafts mailbox, 0 if there is none.
+func DraftsMailboxID(conn *sqlite.Conn) (int64, error) {
+	stmt := conn.Prep(`SELECT MailboxID FROM Mailboxes
+		WHERE Name IS NOT NULL AND Attrs & $drafts <> 0
+		ORDER BY MailboxID LIMIT 1;`)
+	stmt.SetInt64("$drafts", int64(imap.AttrDrafts))
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("spillbox.DraftsMailboxID: %v", err)
+	} else if !hasNext {
+		return 0, nil
+	}
+	mailboxID := stmt.GetInt64("MailboxID")
+	stmt.Reset()
+	return mailboxID, nil
+}
+
 var noKidsMailboxes = []string{
 	"INBOX",
 	"Archive",
@@ -0,0 +1,350 @@
+package spillbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+)
+
+// ObjectStore keeps the content of large blobs outside of the
+// blobs database, for example in an S3-compatible service.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Offloaded blobs.
+//
+// OffloadBlobs moves the content of large blobs to the ObjectStore
+// of the Box, keyed by its SHA256. The Content of the blobs.Blobs
+// row is left empty and the object key is recorded in
+// blobs.RemoteBlobs. Readers fetch the content when they need it.
+//
+// Offloading moves the stored bytes as they are, so sealed blobs
+// stay sealed in the object store.
+//
+// Objects no longer referenced, because their blob was rewritten
+// or garbage collected, are queued in blobs.DeletedObjects and
+// deleted by the next OffloadBlobs or GC that does not overlap
+// a Backup.
+
+// DefaultFetchTimeout is how long reading an offloaded blob may
+// take when Box.FetchTimeout is not set.
+const DefaultFetchTimeout = 2 * time.Minute
+
+// OffloadStats reports the work done by OffloadBlobs.
+type OffloadStats struct {
+	Blobs int   // blobs moved to the object store
+	Bytes int64 // stored bytes of those blobs
+}
+
+func remoteBlob(conn *sqlite.Conn, blobID int64) (key string, size int64, err error) {
+	stmt := conn.Prep("SELECT ObjectKey, Size FROM blobs.RemoteBlobs WHERE BlobID = $blobID;")
+	stmt.SetInt64("$blobID", blobID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", 0, err
+	} else if !hasNext {
+		return "", 0, nil
+	}
+	key = stmt.GetText("ObjectKey")
+	size = stmt.GetInt64("Size")
+	stmt.Reset()
+	return key, size, nil
+}
+
+// openStored opens the stored bytes of a blob,
+// fetching them from the object store if it was offloaded.
+func (box *Box) openStored(ctx context.Context, conn *sqlite.Conn, blobID int64) (email.Buffer, error) {
+	key, size, err := remoteBlob(conn, blobID)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return conn.OpenBlob("blobs", "Blobs", "Content", blobID, false)
+	}
+	rc, err := box.fetchObject(ctx, blobID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	buf := box.filer.BufferFile(0)
+	if _, err := io.Copy(buf, rc); err != nil {
+		buf.Close()
+		return nil, fmt.Errorf("blob %d: %v", blobID, err)
+	}
+	if buf.Size() != size {
+		buf.Close()
+		return nil, fmt.Errorf("blob %d: object %s is %d bytes, want %d", blobID, key, buf.Size(), size)
+	}
+	if _, err := buf.Seek(0, 0); err != nil {
+		buf.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readStored reads the stored bytes of a blob,
+// fetching them from the object store if it was offloaded.
+func (box *Box) readStored(ctx context.Context, conn *sqlite.Conn, blobID int64) ([]byte, error) {
+	key, size, err := remoteBlob(conn, blobID)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	if key == "" {
+		blob, err := conn.OpenBlob("blobs", "Blobs", "Content", blobID, false)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Close()
+		r, size = blob, blob.Size()
+	} else {
+		rc, err := box.fetchObject(ctx, blobID, key)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, fmt.Errorf("blob %d: %v", blobID, err)
+	}
+	return content, nil
+}
+
+// fetchObject opens the object of an offloaded blob. Reading it
+// must be done within the FetchTimeout of the box.
+func (box *Box) fetchObject(ctx context.Context, blobID int64, key string) (io.ReadCloser, error) {
+	if box.ObjectStore == nil {
+		return nil, fmt.Errorf("blob %d is offloaded and there is no object store", blobID)
+	}
+	timeout := box.FetchTimeout
+	if timeout == 0 {
+		timeout = DefaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	rc, err := box.ObjectStore.Get(ctx, key)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("blob %d: %v", blobID, err)
+	}
+	return cancelCloser{ReadCloser: rc, cancel: cancel}, nil
+}
+
+// cancelCloser cancels the context of a fetch when it is closed.
+type cancelCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// dropRemote forgets that a blob was offloaded,
+// queuing its object for deletion.
+func dropRemote(conn *sqlite.Conn, blobID int64) error {
+	stmt := conn.Prep(`INSERT OR IGNORE INTO blobs.DeletedObjects (ObjectKey)
+		SELECT ObjectKey FROM blobs.RemoteBlobs WHERE BlobID = $blobID;`)
+	stmt.SetInt64("$blobID", blobID)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep("DELETE FROM blobs.RemoteBlobs WHERE BlobID = $blobID;")
+	stmt.SetInt64("$blobID", blobID)
+	_, err := stmt.Step()
+	return err
+}
+
+// OffloadBlobs moves blobs of more than threshold stored bytes
+// to the object store.
+//
+// Blobs are read and uploaded on a private read connection.
+// The write connection is only held to empty each uploaded row,
+// so writers of the box are not kept waiting by the object store.
+func (box *Box) OffloadBlobs(ctx context.Context, threshold int64) (stats OffloadStats, err error) {
+	if box.ObjectStore == nil {
+		return stats, fmt.Errorf("spillbox.OffloadBlobs: no object store")
+	}
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return stats, err
+	}
+	err = box.deleteObjects(ctx, conn)
+	box.PutRW(conn)
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.OffloadBlobs: %v", err)
+	}
+
+	src, err := box.openPrivate()
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.OffloadBlobs: %v", err)
+	}
+	defer src.Close()
+
+	blobs, err := offloadCandidates(src, threshold)
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.OffloadBlobs: %v", err)
+	}
+	for _, b := range blobs {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		size, err := box.offloadBlob(ctx, src, b.blobID, b.sha256)
+		if err != nil {
+			return stats, fmt.Errorf("spillbox.OffloadBlobs: blob %d: %v", b.blobID, err)
+		}
+		if size > 0 {
+			stats.Blobs++
+			stats.Bytes += size
+		}
+	}
+	return stats, nil
+}
+
+type blobRef struct {
+	blobID int64
+	sha256 string
+}
+
+// offloadCandidates lists the inline blobs of more than
+// threshold stored bytes.
+func offloadCandidates(conn *sqlite.Conn, threshold int64) (blobs []blobRef, err error) {
+	stmt := conn.Prep(`SELECT BlobID, SHA256 FROM blobs.Blobs
+		WHERE Content IS NOT NULL AND SHA256 IS NOT NULL
+		AND BlobID NOT IN (SELECT BlobID FROM blobs.RemoteBlobs)
+		AND length(Content) > $threshold;`)
+	stmt.SetInt64("$threshold", threshold)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		blobs = append(blobs, blobRef{
+			blobID: stmt.GetInt64("BlobID"),
+			sha256: stmt.GetText("SHA256"),
+		})
+	}
+	return blobs, nil
+}
+
+// offloadBlob uploads a blob and empties its row.
+// It reports the size offloaded, 0 if the blob changed.
+// The upload reads from src, a private connection.
+func (box *Box) offloadBlob(ctx context.Context, src *sqlite.Conn, blobID int64, sum string) (size int64, err error) {
+	key := fmt.Sprintf("%d/%s", box.userID, sum)
+
+	size, got, err := box.uploadBlob(ctx, src, blobID, key)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer box.PutRW(conn)
+
+	if got != sum {
+		// The stored SHA256 is stale. Leave the blob be,
+		// the object is cleaned up by deleteObjects.
+		return 0, box.queueObjectDelete(conn, key)
+	}
+
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`UPDATE blobs.Blobs SET Content = zeroblob(0)
+		WHERE BlobID = $blobID AND SHA256 = $sha256;`)
+	stmt.SetInt64("$blobID", blobID)
+	stmt.SetText("$sha256", sum)
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	if conn.Changes() == 0 {
+		// Rewritten during the upload.
+		return 0, box.queueObjectDelete(conn, key)
+	}
+	stmt = conn.Prep(`INSERT INTO blobs.RemoteBlobs (BlobID, ObjectKey, Size)
+		VALUES ($blobID, $key, $size);`)
+	stmt.SetInt64("$blobID", blobID)
+	stmt.SetText("$key", key)
+	stmt.SetInt64("$size", size)
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// uploadBlob copies the stored bytes of a blob to the object
+// store under key, reporting their size and SHA256.
+func (box *Box) uploadBlob(ctx context.Context, src *sqlite.Conn, blobID int64, key string) (size int64, sum string, err error) {
+	blob, err := src.OpenBlob("blobs", "Blobs", "Content", blobID, false)
+	if err != nil {
+		return 0, "", err
+	}
+	defer blob.Close()
+	size = blob.Size()
+	h := sha256.New()
+	if err := box.ObjectStore.Put(ctx, key, io.TeeReader(blob, h), size); err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (box *Box) queueObjectDelete(conn *sqlite.Conn, key string) error {
+	stmt := conn.Prep("INSERT OR IGNORE INTO blobs.DeletedObjects (ObjectKey) VALUES ($key);")
+	stmt.SetText("$key", key)
+	_, err := stmt.Step()
+	return err
+}
+
+// deleteObjects deletes the queued objects no blob refers to.
+// While a Backup may be copying objects, it deletes none.
+func (box *Box) deleteObjects(ctx context.Context, conn *sqlite.Conn) error {
+	if box.ObjectStore == nil {
+		return nil
+	}
+	if pinned, err := objectsPinned(conn); err != nil || pinned {
+		return err
+	}
+	var keys []string
+	stmt := conn.Prep(`SELECT ObjectKey FROM blobs.DeletedObjects
+		WHERE ObjectKey NOT IN (SELECT ObjectKey FROM blobs.RemoteBlobs);`)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+		keys = append(keys, stmt.GetText("ObjectKey"))
+	}
+	for _, key := range keys {
+		if err := box.ObjectStore.Delete(ctx, key); err != nil {
+			return err
+		}
+		stmt := conn.Prep("DELETE FROM blobs.DeletedObjects WHERE ObjectKey = $key;")
+		stmt.SetText("$key", key)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+
+	// Queued keys that are referenced again are not garbage.
+	stmt = conn.Prep(`DELETE FROM blobs.DeletedObjects
+		WHERE ObjectKey IN (SELECT ObjectKey FROM blobs.RemoteBlobs);`)
+	_, err := stmt.Step()
+	return err
+}
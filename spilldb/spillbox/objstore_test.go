@@ -0,0 +1,208 @@
+package spillbox
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOffloadBlobs(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	store := newMemStore()
+	box.ObjectStore = store
+	insertOffloadedMsgs(t, box)
+
+	offloaded := dumpRows(t, box, "SELECT ObjectKey FROM blobs.RemoteBlobs ORDER BY BlobID;")
+	keys := store.keys()
+	if len(keys) == 0 || strings.Count(offloaded, "\n") != len(keys) {
+		t.Fatalf("objects %v, offloaded blobs:\n%s", keys, offloaded)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "1/") || !strings.Contains(offloaded, key) {
+			t.Errorf("object %s is not the key of an offloaded blob", key)
+		}
+	}
+	if inline := dumpRows(t, box, `SELECT BlobID FROM blobs.Blobs
+		WHERE BlobID IN (SELECT BlobID FROM blobs.RemoteBlobs)
+		AND length(Content) > 0;`); inline != "" {
+		t.Errorf("offloaded blobs kept their content:\n%s", inline)
+	}
+	if sizes := dumpRows(t, box, `SELECT BlobID FROM blobs.Blobs
+		INNER JOIN blobs.RemoteBlobs USING (BlobID)
+		WHERE `+storedSize+` != blobs.RemoteBlobs.Size;`); sizes != "" {
+		t.Errorf("storedSize is not the object size:\n%s", sizes)
+	}
+
+	// Offloaded content reads as it did before it was moved.
+	before := readBlobs(t, box)
+	box.ObjectStore = nil
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remoteID int64
+	for blobID := range before {
+		if _, err := box.readBlob(ctx, conn, blobID); err != nil {
+			remoteID = blobID
+		}
+	}
+	box.PutRW(conn)
+	if remoteID == 0 {
+		t.Fatal("offloaded blobs read without an object store")
+	}
+	box.ObjectStore = store
+	if got := readBlobs(t, box); !reflect.DeepEqual(got, before) {
+		t.Error("offloaded blobs read differently")
+	}
+
+	stats, err := box.OffloadBlobs(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 0 {
+		t.Errorf("second OffloadBlobs moved %d blobs", stats.Blobs)
+	}
+
+	// Rewriting an offloaded blob brings it back and
+	// queues its object for deletion.
+	if conn, err = box.GetRW(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer box.PutRW(conn)
+	if err := box.writeBlob(conn, remoteID, []byte("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := box.readBlob(ctx, conn, remoteID); err != nil || string(content) != "rewritten" {
+		t.Errorf("rewritten blob reads %q, %v", content, err)
+	}
+	if err := box.deleteObjects(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.keys()); n != len(keys)-1 {
+		t.Errorf("%d objects after the rewrite, want %d", n, len(keys)-1)
+	}
+}
+
+// stallStore is an ObjectStore that never answers.
+type stallStore struct{ *memStore }
+
+func (s stallStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFetchObjectTimeout(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	box.ObjectStore = newMemStore()
+	insertOffloadedMsgs(t, box)
+	var blobID int64
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.PutRW(conn)
+	stmt := conn.Prep("SELECT BlobID FROM blobs.RemoteBlobs LIMIT 1;")
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	blobID = stmt.GetInt64("BlobID")
+	stmt.Reset()
+
+	box.ObjectStore = stallStore{newMemStore()}
+	box.FetchTimeout = 10 * time.Millisecond
+	start := time.Now()
+	if _, err := box.readBlob(ctx, conn, blobID); err == nil {
+		t.Error("readBlob from a stalled store succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("readBlob took %s, past FetchTimeout", d)
+	}
+
+	// The caller's context ends the fetch too.
+	box.FetchTimeout = time.Hour
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := box.readBlob(cctx, conn, blobID); err == nil {
+		t.Error("readBlob with a canceled context succeeded")
+	}
+}
+
+// rewriteStore is an ObjectStore that rewrites a blob
+// before it accepts the object of its content.
+type rewriteStore struct {
+	*memStore
+	box    *Box
+	blobID int64
+	key    string
+	err    error
+}
+
+func (s *rewriteStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := s.memStore.Put(ctx, key, r, size); err != nil || key != s.key {
+		return err
+	}
+	conn, err := s.box.GetRW(ctx)
+	if err != nil {
+		s.err = err
+		return err
+	}
+	defer s.box.PutRW(conn)
+	s.err = s.box.writeBlob(conn, s.blobID, []byte("rewritten"))
+	return s.err
+}
+
+func TestOffloadBlobsConcurrentWrite(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 6000)
+	rnd.Read(big)
+	insertTestMsg(t, box, "From: a@example.com\nTo: user@spilled.ink\nSubject: big\n\n"+
+		base64.StdEncoding.EncodeToString(big)+"\n")
+
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := conn.Prep(`SELECT BlobID, SHA256 FROM blobs.Blobs
+		ORDER BY length(Content) DESC LIMIT 1;`)
+	if _, err := stmt.Step(); err != nil {
+		t.Fatal(err)
+	}
+	blobID := stmt.GetInt64("BlobID")
+	key := fmt.Sprintf("%d/%s", box.userID, stmt.GetText("SHA256"))
+	stmt.Reset()
+	box.PutRW(conn)
+
+	// The upload does not hold the write connection,
+	// so the box can be written while it runs.
+	box.WriteTimeout = time.Second
+	store := &rewriteStore{memStore: newMemStore(), box: box, blobID: blobID, key: key}
+	box.ObjectStore = store
+	if _, err := box.OffloadBlobs(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if store.err != nil {
+		t.Fatalf("write during the upload: %v", store.err)
+	}
+	if remote := dumpRows(t, box, fmt.Sprintf("SELECT ObjectKey FROM blobs.RemoteBlobs WHERE BlobID = %d;", blobID)); remote != "" {
+		t.Errorf("blob rewritten during the upload recorded as offloaded:\n%s", remote)
+	}
+	if queued := dumpRows(t, box, "SELECT ObjectKey FROM blobs.DeletedObjects;"); !strings.Contains(queued, key) {
+		t.Errorf("object %s of the rewritten blob is not queued for deletion:\n%s", key, queued)
+	}
+}
@@ -0,0 +1,266 @@
+package prettyhtml
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"spilled.ink/html/css"
+)
+
+// CSS custom properties used by the dark mode pass, see
+// Prettifier.DarkMode.
+//
+// A page showing a message sets them to recolor its neutral text
+// and backgrounds. Where a property is not set, the color the
+// message was written with is used.
+const (
+	TextVar          = "--msg-text"           // near-black text
+	MutedTextVar     = "--msg-text-muted"     // gray text
+	BackgroundVar    = "--msg-background"     // white backgrounds
+	AltBackgroundVar = "--msg-background-alt" // light gray backgrounds
+)
+
+// darkMode rewrites the neutral colors in the styles of the
+// document n to use the custom properties above.
+//
+// Only colors that are nearly gray are rewritten: dark text and
+// light backgrounds, which are what make a message unreadable
+// on a dark page. Saturated colors are usually branding and
+// are left alone.
+func darkMode(n *html.Node) {
+	if n.Type == html.ElementNode {
+		if n.DataAtom == atom.Style {
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.TextNode {
+					c.Data = darkModeSheet(c.Data)
+				}
+			}
+		}
+		var fontStyle string
+		attrs := n.Attr[:0]
+		for _, attr := range n.Attr {
+			switch {
+			case attr.Key == "style":
+				attr.Val = darkModeDecls(attr.Val)
+			case attr.Key == "color" && n.DataAtom == atom.Font:
+				// <font color> cannot hold var(), move it to a style.
+				if style := darkModeDecls("color: " + attr.Val); strings.Contains(style, "var(") {
+					fontStyle = style
+					continue
+				}
+			}
+			attrs = append(attrs, attr)
+		}
+		n.Attr = attrs
+		if fontStyle != "" {
+			setStyle(n, fontStyle)
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		darkMode(c)
+	}
+}
+
+// setStyle adds the declarations decls before any in the style of n.
+func setStyle(n *html.Node, decls string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == "style" {
+			n.Attr[i].Val = decls + " " + n.Attr[i].Val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: decls})
+}
+
+// darkModeDecls rewrites the colors of a style attribute.
+// The style has been sanitized, so it has no empty declarations.
+func darkModeDecls(style string) string {
+	errh := func(line, col, n int, msg string) {}
+	p := css.NewParser(css.NewScanner(strings.NewReader(style), errh))
+	var out []byte
+	var decl css.Decl
+	for i := 0; p.ParseDecl(&decl); i++ {
+		recolor(&decl)
+		if i > 0 {
+			out = append(out, ' ')
+		}
+		out = css.AppendDecl(out, &decl)
+	}
+	return string(out)
+}
+
+// darkModeSheet rewrites the colors of a <style> element.
+func darkModeSheet(text string) string {
+	errh := func(line, col, n int, msg string) {}
+	p := css.NewParser(css.NewScanner(strings.NewReader(text), errh))
+	sheet := p.ParseStylesheet()
+	recolorRules(sheet.Rules)
+	return string(css.AppendStylesheet(nil, sheet))
+}
+
+func recolorRules(rules []css.Rule) {
+	for i := range rules {
+		for j := range rules[i].Decls {
+			recolor(&rules[i].Decls[j])
+		}
+		recolorRules(rules[i].Rules)
+	}
+}
+
+// recolor replaces each neutral color in d with
+// var(--property, color).
+func recolor(d *css.Decl) {
+	var bg bool
+	switch string(bytes.ToLower(d.Property)) {
+	case "color":
+	case "background", "background-color":
+		bg = true
+	default:
+		return
+	}
+
+	var values []css.Value
+	depth := 0 // function nesting, colors inside var() are kept
+	for i := 0; i < len(d.Values); {
+		v := d.Values[i]
+		if depth == 0 {
+			if n, r, g, b, ok := parseColor(d.Values[i:]); ok {
+				if name := colorVar(r, g, b, bg); name != "" {
+					values = append(values,
+						css.Value{Type: css.ValueFunction, Value: []byte("var")},
+						css.Value{Type: css.ValueIdent, Value: []byte(name)},
+						css.Value{Type: css.ValueComma})
+					values = append(values, d.Values[i:i+n]...)
+					values = append(values, css.Value{Type: css.ValueDelim, Value: []byte(")")})
+					i += n
+					continue
+				}
+			}
+		}
+		switch {
+		case v.Type == css.ValueFunction:
+			depth++
+		case v.Type == css.ValueDelim && string(v.Value) == ")":
+			depth--
+		}
+		values = append(values, v)
+		i++
+	}
+	d.Values = values
+}
+
+// colorVar reports the custom property a color is replaced
+// with, or "" if it is kept.
+func colorVar(r, g, b float64, bg bool) string {
+	max, min := r, r
+	for _, c := range []float64{g, b} {
+		if c > max {
+			max = c
+		}
+		if c < min {
+			min = c
+		}
+	}
+	lightness := (max + min) / 2
+	chroma := max - min
+	if bg {
+		switch {
+		case chroma > 0.1:
+		case lightness >= 0.9:
+			return BackgroundVar
+		case lightness >= 0.75:
+			return AltBackgroundVar
+		}
+		return ""
+	}
+	switch {
+	case chroma > 0.2:
+	case lightness < 0.4:
+		return TextVar
+	case lightness < 0.7:
+		return MutedTextVar
+	}
+	return ""
+}
+
+// parseColor parses the color at the start of values: a hex color,
+// a named gray, or an rgb() function. It reports the number of
+// values that make up the color, and its channels from 0 to 1.
+func parseColor(values []css.Value) (n int, r, g, b float64, ok bool) {
+	v := &values[0]
+	switch v.Type {
+	case css.ValueHash:
+		hex := string(v.Value)
+		switch len(hex) {
+		case 3, 4:
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		case 6, 8:
+			hex = hex[:6]
+		default:
+			return 0, 0, 0, 0, false
+		}
+		rgb, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return 0, 0, 0, 0, false
+		}
+		return 1, float64(rgb>>16) / 255, float64(rgb>>8&0xff) / 255, float64(rgb&0xff) / 255, true
+	case css.ValueIdent:
+		gray, found := grays[strings.ToLower(string(v.Value))]
+		if !found {
+			return 0, 0, 0, 0, false
+		}
+		return 1, gray, gray, gray, true
+	case css.ValueFunction:
+		name := strings.ToLower(string(v.Value))
+		if name != "rgb" && name != "rgba" {
+			return 0, 0, 0, 0, false
+		}
+		var channels []float64
+		for i := 1; i < len(values); i++ {
+			arg := &values[i]
+			switch arg.Type {
+			case css.ValueInteger, css.ValueNumber:
+				channels = append(channels, arg.Number/255)
+			case css.ValuePercentage:
+				channels = append(channels, arg.Number/100)
+			case css.ValueComma:
+			case css.ValueDelim:
+				if string(arg.Value) == ")" {
+					if len(channels) < 3 {
+						return 0, 0, 0, 0, false
+					}
+					return i + 1, channels[0], channels[1], channels[2], true
+				}
+				if string(arg.Value) != "/" {
+					return 0, 0, 0, 0, false
+				}
+			default:
+				return 0, 0, 0, 0, false
+			}
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+// grays are the CSS named colors that are nearly gray,
+// with their lightness.
+var grays = map[string]float64{
+	"black":      0,
+	"dimgray":    0x69 / 255.0,
+	"dimgrey":    0x69 / 255.0,
+	"gray":       0x80 / 255.0,
+	"grey":       0x80 / 255.0,
+	"darkgray":   0xa9 / 255.0,
+	"darkgrey":   0xa9 / 255.0,
+	"silver":     0xc0 / 255.0,
+	"lightgray":  0xd3 / 255.0,
+	"lightgrey":  0xd3 / 255.0,
+	"gainsboro":  0xdc / 255.0,
+	"whitesmoke": 0xf5 / 255.0,
+	"snow":       0xfc / 255.0,
+	"ghostwhite": 0xf9 / 255.0,
+	"white":      1,
+}
@@ -10,10 +10,21 @@ import (
 	"strings"
 
 	"golang.org/x/net/html"
+	"spilled.ink/html/htmlproxy"
 	"spilled.ink/html/htmlsafe"
 )
 
 type Prettifier struct {
+	// Proxy, if set, rewrites remote images and style URLs to be
+	// fetched through a local proxy so the sender does not learn
+	// the reader's IP address or when a message is read.
+	// Without a proxy, remote URLs in styles are removed.
+	Proxy *htmlproxy.Signer
+
+	// DarkMode, if set, rewrites near-black text and white
+	// backgrounds to use CSS custom properties, so a page can show
+	// the message on a dark background. See TextVar.
+	DarkMode bool
 }
 
 func New() (*Prettifier, error) {
@@ -35,6 +46,17 @@ func (p *Prettifier) Pretty(r io.Reader, contentLinks map[string]string) (Result
 		if url.Scheme == "cid" && contentLinks != nil {
 			return contentLinks[url.Opaque]
 		}
+		if attr == "href" {
+			return url.String()
+		}
+		if p.Proxy != nil && (url.Scheme == "http" || url.Scheme == "https") {
+			return p.Proxy.URL(url.String())
+		}
+		if attr == "style" {
+			// Remote resources in styles are trackers more
+			// often than they are decoration. Drop them.
+			return ""
+		}
 		return url.String()
 	}
 	s := htmlsafe.Sanitizer{RewriteURL: rewrite}
@@ -74,6 +96,15 @@ func (p *Prettifier) Pretty(r io.Reader, contentLinks map[string]string) (Result
 	}
 	findUnsub(node)
 
+	if p.DarkMode {
+		darkMode(node)
+		buf.Reset()
+		if err := html.Render(buf, node); err != nil {
+			return Result{HTML: orderly}, err
+		}
+		res.HTML = buf.String()
+	}
+
 	return res, nil
 }
 
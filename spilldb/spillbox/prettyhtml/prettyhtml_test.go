@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+
+	"spilled.ink/html/htmlproxy"
 )
 
 func TestPlainText(t *testing.T) {
@@ -33,3 +35,76 @@ Regards.`, "\n", "\r\n", -1)
 		t.Errorf("PlainText()=\n%s\n\nwant:\n%s", got, want)
 	}
 }
+
+func TestPrettyStyles(t *testing.T) {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const html = `<p style="color: red; background: url(http://tracker.example/p.gif); position: fixed">hi</p>` +
+		`<img src="cid:logo" style="background: url(cid:logo) no-repeat">`
+	links := map[string]string{"logo": "/content/logo"}
+	res, err := p.Pretty(strings.NewReader(html), links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<p style="color: red;">hi</p>` +
+		`<img src="/content/logo" style="background: url(&#34;/content/logo&#34;) no-repeat;">`
+	if res.HTML != want {
+		t.Errorf("Pretty()=\n%s\n\nwant:\n%s", res.HTML, want)
+	}
+}
+
+func TestPrettyProxy(t *testing.T) {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Proxy = &htmlproxy.Signer{Path: "/proxy", Key: []byte("key")}
+
+	const html = `<a href="https://example.com/"><img src="https://t.example/a.gif" srcset="https://t.example/b.gif 2x"></a>` +
+		`<p style="background: url(https://t.example/c.gif)">hi</p>`
+	res, err := p.Pretty(strings.NewReader(html), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied := func(remote string) string {
+		return strings.Replace(p.Proxy.URL(remote), "&", "&amp;", -1)
+	}
+	want := `<a href="https://example.com/">` +
+		`<img src="` + p.Proxy.URL("https://t.example/a.gif") + `" srcset="` + proxied("https://t.example/b.gif") + ` 2x"></a>` +
+		`<p style="background: url(&#34;` + proxied("https://t.example/c.gif") + `&#34;);">hi</p>`
+	if res.HTML != want {
+		t.Errorf("Pretty()=\n%s\n\nwant:\n%s", res.HTML, want)
+	}
+}
+
+func TestPrettyDarkMode(t *testing.T) {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.DarkMode = true
+
+	const html = `<style>.text { color: #333; background-color: white } .brand { color: #e4002b }</style>` +
+		`<div style="background: #fff url(cid:bg) no-repeat; color: rgb(0, 0, 0)">` +
+		`<p style="color: #777777">muted</p><p style="color: #0055aa; background-color: #ddd">brand</p>` +
+		`<font color="black">old</font><font color="red">red</font></div>`
+	res, err := p.Pretty(strings.NewReader(html), map[string]string{"bg": "/content/bg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`.text { color: var(--msg-text, #333); background-color: var(--msg-background, white); }`,
+		`.brand { color: #e4002b; }`,
+		`style="background: var(--msg-background, #fff) url(&#34;/content/bg&#34;) no-repeat; color: var(--msg-text,rgb(0, 0, 0));"`,
+		`style="color: var(--msg-text-muted, #777777);"`,
+		`style="color: #0055aa; background-color: var(--msg-background-alt, #ddd);"`,
+		`<font style="color: var(--msg-text, black);">old</font>`,
+		`<font color="red">red</font>`,
+	} {
+		if !strings.Contains(res.HTML, want) {
+			t.Errorf("Pretty()=\n%s\n\nmissing:\n%s", res.HTML, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package spillbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+)
+
+// RepairStats reports the work done by Repair.
+type RepairStats struct {
+	Stuck     int     // messages found in the MsgFetching state
+	Completed int     // stuck messages with all their content, made ready
+	Failed    int     // stuck messages that could not be completed, expunged
+	Redeliver []int64 // staging IDs of failed messages delivered by spilld
+}
+
+// Repair finds the messages left in the MsgFetching state, which
+// no mailbox lists, by an InsertMsg interrupted by a crash.
+//
+// A stuck message with the content of all of its parts is made
+// ready as InsertMsg would have. Any other is expunged, with the
+// reason in its ParseError, and if it was delivered by spilld its
+// staging ID is reported so the delivery can be run again.
+func (box *Box) Repair(ctx context.Context) (stats RepairStats, err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer box.PutRW(conn)
+
+	type stuckMsg struct {
+		msgID     email.MsgID
+		stagingID int64
+		mailboxID int64
+	}
+	var msgs []stuckMsg
+	stmt := conn.Prep(`SELECT MsgID, ifnull(StagingID, 0) AS StagingID,
+		ifnull(MailboxID, 0) AS MailboxID
+		FROM Msgs WHERE State = $msgFetching ORDER BY MsgID;`)
+	stmt.SetInt64("$msgFetching", int64(MsgFetching))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return stats, fmt.Errorf("spillbox.Repair: %v", err)
+		} else if !hasNext {
+			break
+		}
+		msgs = append(msgs, stuckMsg{
+			msgID:     email.MsgID(stmt.GetInt64("MsgID")),
+			stagingID: stmt.GetInt64("StagingID"),
+			mailboxID: stmt.GetInt64("MailboxID"),
+		})
+	}
+
+	labels := new(LabelUpdates)
+	for _, m := range msgs {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		stats.Stuck++
+		completeErr := box.completeMsg(conn, m.msgID, m.mailboxID, labels)
+		if completeErr == nil {
+			stats.Completed++
+			continue
+		}
+		if err := failMsg(conn, m.msgID, completeErr); err != nil {
+			return stats, fmt.Errorf("spillbox.Repair: %s: %v", m.msgID, err)
+		}
+		stats.Failed++
+		if m.stagingID != 0 {
+			stats.Redeliver = append(stats.Redeliver, m.stagingID)
+		}
+	}
+	box.NotifyLabelUpdates(labels)
+	return stats, nil
+}
+
+// completeMsg makes a stuck message ready if all of its parts
+// have their content.
+func (box *Box) completeMsg(conn *sqlite.Conn, msgID email.MsgID, mailboxID int64, labels *LabelUpdates) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`SELECT count(*) FROM MsgParts
+		LEFT JOIN blobs.Blobs ON Blobs.BlobID = MsgParts.BlobID
+		WHERE MsgID = $msgID AND Blobs.Content IS NULL;`)
+	stmt.SetInt64("$msgID", int64(msgID))
+	if missing, err := sqlitex.ResultInt(stmt); err != nil {
+		return err
+	} else if missing > 0 {
+		return fmt.Errorf("%d parts missing content", missing)
+	}
+	_, err = box.setMsgFetched(conn, msgID, mailboxID, labels)
+	return err
+}
+
+// failMsg expunges a stuck message that cannot be completed.
+func failMsg(conn *sqlite.Conn, msgID email.MsgID, reason error) error {
+	stmt := conn.Prep(`UPDATE Msgs SET State = $msgExpunged, Expunged = $now,
+		ParseError = $reason
+		WHERE MsgID = $msgID;`)
+	stmt.SetInt64("$msgExpunged", int64(MsgExpunged))
+	stmt.SetInt64("$now", time.Now().Unix())
+	stmt.SetText("$reason", "repair: "+reason.Error())
+	stmt.SetInt64("$msgID", int64(msgID))
+	_, err := stmt.Step()
+	return err
+}
@@ -0,0 +1,424 @@
+package spillbox
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Replication.
+//
+// A primary records every changed row in ReplLog. EnableReplication
+// adds TEMP triggers to the PoolRW connection, which makes every
+// write of the box, so each insert, update, or delete on any table
+// of either database logs the table and rowid in the same
+// transaction. Blob content written incrementally is covered by
+// the insert or update of its row that precedes it.
+//
+// ReplEvents reads the log and ships the current state of each
+// changed row, or its absence. A standby applies the events with
+// ApplyReplEvents, which keeps its position in ReplState. Because
+// events carry row state rather than statements, applying them in
+// batches converges on the primary's databases.
+//
+// Tables kept by triggers, such as MailboxCounts, are replicated
+// like any other. While a standby applies events it sets
+// ReplState.Applying, which the triggers of the schema check, so
+// the derived rows are the primary's rather than re-derived.
+//
+// A standby is seeded with a Backup of the primary taken after
+// replication was enabled, or starts empty if replication was on
+// when the box was created. ReplApplied starts a seeded standby
+// from the last ReplLog entry in the backup.
+//
+// Promote turns a standby into a primary. It may have missed the
+// last events, so every mailbox gets a new UIDVALIDITY.
+
+// ReplEvent is the state of a row after a change.
+type ReplEvent struct {
+	Seq   int64
+	Table string // schema and name, "main.Msgs"
+	RowID int64
+	Cols  []string    // nil if the row was deleted
+	Vals  []ReplValue // values of Cols
+}
+
+// ReplValue is an SQLite value.
+type ReplValue struct {
+	Type  sqlite.ColumnType
+	Int   int64   `json:",omitempty"`
+	Float float64 `json:",omitempty"`
+	Text  string  `json:",omitempty"`
+	Blob  []byte  `json:",omitempty"`
+}
+
+// replTables lists the tables of the box that are replicated.
+func replTables(conn *sqlite.Conn) (tables []string, err error) {
+	for _, schema := range []string{"main", "blobs"} {
+		stmt := conn.Prep(fmt.Sprintf(`SELECT name FROM %s.sqlite_master
+			WHERE type = 'table' AND name NOT LIKE 'sqlite_%%'
+			AND name NOT IN ('ReplLog', 'ReplState', 'BackupPins')
+			ORDER BY name;`, schema))
+		for {
+			if hasNext, err := stmt.Step(); err != nil {
+				return nil, err
+			} else if !hasNext {
+				break
+			}
+			tables = append(tables, schema+"."+stmt.GetText("name"))
+		}
+	}
+	return tables, nil
+}
+
+// EnableReplication starts recording changes in ReplLog.
+// It is called once, when the box is opened on a primary.
+func (box *Box) EnableReplication(ctx context.Context) error {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+
+	tables, err := replTables(conn)
+	if err != nil {
+		return fmt.Errorf("spillbox.EnableReplication: %v", err)
+	}
+	for _, table := range tables {
+		name := "repl_" + strings.Replace(table, ".", "_", -1)
+		script := fmt.Sprintf(`
+			CREATE TEMP TRIGGER IF NOT EXISTS %[1]s_insert AFTER INSERT ON %[2]s
+			BEGIN
+				INSERT INTO main.ReplLog (TableName, RowID) VALUES ('%[2]s', new.rowid);
+			END;
+			CREATE TEMP TRIGGER IF NOT EXISTS %[1]s_update AFTER UPDATE ON %[2]s
+			BEGIN
+				INSERT INTO main.ReplLog (TableName, RowID)
+					SELECT '%[2]s', old.rowid WHERE old.rowid != new.rowid;
+				INSERT INTO main.ReplLog (TableName, RowID) VALUES ('%[2]s', new.rowid);
+			END;
+			CREATE TEMP TRIGGER IF NOT EXISTS %[1]s_delete AFTER DELETE ON %[2]s
+			BEGIN
+				INSERT INTO main.ReplLog (TableName, RowID) VALUES ('%[2]s', old.rowid);
+			END;`, name, table)
+		if err := sqlitex.ExecScript(conn, script); err != nil {
+			return fmt.Errorf("spillbox.EnableReplication: %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// ReplEvents reports up to max changes recorded after the
+// sequence number after. Changes up to after have been applied
+// by the standby, so they are removed from the log.
+func (box *Box) ReplEvents(ctx context.Context, after int64, max int) ([]ReplEvent, error) {
+	if err := box.trimReplLog(ctx, after); err != nil {
+		return nil, fmt.Errorf("spillbox.ReplEvents: %v", err)
+	}
+
+	conn := box.PoolRO.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer box.PoolRO.Put(conn)
+
+	events, err := readReplEvents(conn, after, max)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.ReplEvents: %v", err)
+	}
+	return events, nil
+}
+
+func (box *Box) trimReplLog(ctx context.Context, applied int64) error {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+	stmt := conn.Prep("DELETE FROM ReplLog WHERE Seq <= $applied;")
+	stmt.SetInt64("$applied", applied)
+	_, err = stmt.Step()
+	return err
+}
+
+func readReplEvents(conn *sqlite.Conn, after int64, max int) (events []ReplEvent, err error) {
+	// One read transaction, so every row is read at the same point.
+	defer sqlitex.Save(conn)(&err)
+
+	type rowKey struct {
+		table string
+		rowID int64
+	}
+	last := make(map[rowKey]int) // index in events
+	stmt := conn.Prep(`SELECT Seq, TableName, RowID FROM ReplLog
+		WHERE Seq > $after ORDER BY Seq LIMIT $max;`)
+	stmt.SetInt64("$after", after)
+	stmt.SetInt64("$max", int64(max))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		ev := ReplEvent{
+			Seq:   stmt.GetInt64("Seq"),
+			Table: stmt.GetText("TableName"),
+			RowID: stmt.GetInt64("RowID"),
+		}
+		// Only the latest change to a row is shipped.
+		k := rowKey{ev.Table, ev.RowID}
+		if i, ok := last[k]; ok {
+			events[i].Table = "" // superseded
+		}
+		last[k] = len(events)
+		events = append(events, ev)
+	}
+
+	var lastSeq int64
+	if len(events) > 0 {
+		lastSeq = events[len(events)-1].Seq
+	}
+	shipped := events[:0]
+	for _, ev := range events {
+		if ev.Table == "" {
+			continue
+		}
+		if err := readReplRow(conn, &ev); err != nil {
+			return nil, err
+		}
+		shipped = append(shipped, ev)
+	}
+	// The last event carries the position of the batch,
+	// even if its row changed again within the batch.
+	if n := len(shipped); n > 0 {
+		shipped[n-1].Seq = lastSeq
+	}
+	return shipped, nil
+}
+
+func readReplRow(conn *sqlite.Conn, ev *ReplEvent) error {
+	stmt := conn.Prep(fmt.Sprintf("SELECT * FROM %s WHERE rowid = $rowid;", ev.Table))
+	stmt.SetInt64("$rowid", ev.RowID)
+	if hasNext, err := stmt.Step(); err != nil {
+		return fmt.Errorf("%s: %v", ev.Table, err)
+	} else if !hasNext {
+		return nil // deleted
+	}
+	n := stmt.ColumnCount()
+	ev.Cols = make([]string, n)
+	ev.Vals = make([]ReplValue, n)
+	for i := 0; i < n; i++ {
+		ev.Cols[i] = stmt.ColumnName(i)
+		v := ReplValue{Type: stmt.ColumnType(i)}
+		switch v.Type {
+		case sqlite.SQLITE_INTEGER:
+			v.Int = stmt.ColumnInt64(i)
+		case sqlite.SQLITE_FLOAT:
+			v.Float = stmt.ColumnFloat(i)
+		case sqlite.SQLITE_TEXT:
+			v.Text = stmt.ColumnText(i)
+		case sqlite.SQLITE_BLOB:
+			v.Blob = make([]byte, stmt.ColumnLen(i))
+			stmt.ColumnBytes(i, v.Blob)
+		}
+		ev.Vals[i] = v
+	}
+	return stmt.Reset()
+}
+
+// ReplApplied reports the position of a standby in the primary's ReplLog.
+func (box *Box) ReplApplied(ctx context.Context) (int64, error) {
+	conn := box.PoolRO.Get(ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer box.PoolRO.Put(conn)
+
+	stmt := conn.Prep(`SELECT coalesce(
+		(SELECT Applied FROM ReplState),
+		(SELECT seq FROM sqlite_sequence WHERE name = 'ReplLog'),
+		0);`)
+	applied, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("spillbox.ReplApplied: %v", err)
+	}
+	return applied, nil
+}
+
+// ApplyReplEvents applies changes shipped from the primary by ReplEvents.
+func (box *Box) ApplyReplEvents(ctx context.Context, events []ReplEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+
+	// A batch may refer to rows whose changes are in the next one.
+	if err := sqlitex.ExecTransient(conn, "PRAGMA foreign_keys = OFF;", nil); err != nil {
+		return fmt.Errorf("spillbox.ApplyReplEvents: %v", err)
+	}
+	err = applyReplEvents(conn, events)
+	if ferr := sqlitex.ExecTransient(conn, "PRAGMA foreign_keys = ON;", nil); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return fmt.Errorf("spillbox.ApplyReplEvents: %v", err)
+	}
+	return nil
+}
+
+func applyReplEvents(conn *sqlite.Conn, events []ReplEvent) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	tables, err := replTables(conn)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, table := range tables {
+		known[table] = true
+	}
+
+	// Turn off the triggers of the schema, see ReplEvents.
+	// ReplState is only seen in this state inside the transaction.
+	stmt := conn.Prep("INSERT OR IGNORE INTO ReplState (ID, Applied) VALUES (1, 0);")
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep("UPDATE ReplState SET Applying = TRUE;")
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		if !known[ev.Table] {
+			return fmt.Errorf("event %d: unknown table %q", ev.Seq, ev.Table)
+		}
+		if ev.Cols == nil {
+			stmt := conn.Prep(fmt.Sprintf("DELETE FROM %s WHERE rowid = $rowid;", ev.Table))
+			stmt.SetInt64("$rowid", ev.RowID)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("event %d: %v", ev.Seq, err)
+			}
+			continue
+		}
+		if err := applyReplRow(conn, ev); err != nil {
+			return fmt.Errorf("event %d: %s: %v", ev.Seq, ev.Table, err)
+		}
+	}
+
+	stmt = conn.Prep("UPDATE ReplState SET Applied = $applied, Applying = FALSE;")
+	stmt.SetInt64("$applied", events[len(events)-1].Seq)
+	_, err = stmt.Step()
+	return err
+}
+
+// applyReplRow updates the row of an event, or inserts it if
+// the standby does not have it.
+//
+// OR REPLACE only resolves a conflict with another row on a
+// UNIQUE column, such as Mailboxes.Name after two mailboxes swap
+// names. The other row has changed on the primary too, so a later
+// event restores it.
+func applyReplRow(conn *sqlite.Conn, ev ReplEvent) error {
+	if len(ev.Cols) != len(ev.Vals) {
+		return fmt.Errorf("%d columns, %d values", len(ev.Cols), len(ev.Vals))
+	}
+	// Parameter ?1 is the rowid, ?2 on the values.
+	sets := make([]string, len(ev.Cols))
+	cols := []string{"rowid"}
+	params := []string{"?1"}
+	for i, col := range ev.Cols {
+		sets[i] = fmt.Sprintf("%s = ?%d", quoteIdent(col), i+2)
+		cols = append(cols, quoteIdent(col))
+		params = append(params, fmt.Sprintf("?%d", i+2))
+	}
+	update := fmt.Sprintf("UPDATE OR REPLACE %s SET %s WHERE rowid = ?1;",
+		ev.Table, strings.Join(sets, ", "))
+	insert := fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s);",
+		ev.Table, strings.Join(cols, ", "), strings.Join(params, ", "))
+
+	stmt, err := conn.Prepare(update)
+	if err != nil {
+		return err
+	}
+	bindReplRow(stmt, ev)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if conn.Changes() > 0 {
+		return nil
+	}
+	if stmt, err = conn.Prepare(insert); err != nil {
+		return err
+	}
+	bindReplRow(stmt, ev)
+	_, err = stmt.Step()
+	return err
+}
+
+func bindReplRow(stmt *sqlite.Stmt, ev ReplEvent) {
+	stmt.BindInt64(1, ev.RowID)
+	for i, v := range ev.Vals {
+		param := i + 2
+		switch v.Type {
+		case sqlite.SQLITE_INTEGER:
+			stmt.BindInt64(param, v.Int)
+		case sqlite.SQLITE_FLOAT:
+			stmt.BindFloat(param, v.Float)
+		case sqlite.SQLITE_TEXT:
+			stmt.BindText(param, v.Text)
+		case sqlite.SQLITE_BLOB:
+			if len(v.Blob) == 0 {
+				stmt.BindZeroBlob(param, 0)
+			} else {
+				stmt.BindBytes(param, v.Blob)
+			}
+		default:
+			stmt.BindNull(param)
+		}
+	}
+}
+
+// quoteIdent quotes an SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Promote makes a standby the primary. Clients may have seen
+// changes the standby missed, so every mailbox gets a new
+// UIDVALIDITY. Replication is enabled separately, as on any
+// primary.
+func (box *Box) Promote(ctx context.Context) error {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+
+	if err := promote(conn); err != nil {
+		return fmt.Errorf("spillbox.Promote: %v", err)
+	}
+	return nil
+}
+
+func promote(conn *sqlite.Conn) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	// Entries copied from the old primary by a seeding backup.
+	stmt := conn.Prep("DELETE FROM ReplLog;")
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep("DELETE FROM ReplState;")
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return bumpUIDValidity(conn, 0)
+}
@@ -0,0 +1,159 @@
+package spillbox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"crawshaw.io/iox"
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+func TestReplicationRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "spillbox-repl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filer := iox.NewFiler(0)
+	filer.Logf = t.Logf
+	defer filer.Shutdown(ctx)
+
+	primary, err := New(1, filer, filepath.Join(dir, "primary.db"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	if err := primary.EnableReplication(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	standby, err := New(1, filer, filepath.Join(dir, "standby.db"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+
+	var msgIDs []email.MsgID
+	for i := 0; i < 4; i++ {
+		msg := insertTestMsg(t, primary, fmt.Sprintf("From: a%d@example.com\nTo: user@spilled.ink\nSubject: msg %d\n\nHello %d.\n", i, i, i))
+		msgIDs = append(msgIDs, msg.MsgID)
+	}
+
+	sync := func() {
+		t.Helper()
+		for {
+			applied, err := standby.ReplApplied(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Small batches, so rows and the counts derived
+			// from them arrive in different batches.
+			events, err := primary.ReplEvents(ctx, applied, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) == 0 {
+				return
+			}
+			if err := standby.ApplyReplEvents(ctx, events); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sync()
+	compareReplicas(t, primary, standby)
+
+	// Flag, move, and expunge messages, then delete the
+	// expunged ones with their blobs.
+	conn, err := primary.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{
+		fmt.Sprintf("UPDATE Msgs SET SysFlags = SysFlags | 1 WHERE MsgID = %d;", msgIDs[0]),
+		fmt.Sprintf("UPDATE Msgs SET MailboxID = (SELECT MailboxID FROM Mailboxes WHERE Name = 'Archive') WHERE MsgID = %d;", msgIDs[1]),
+		fmt.Sprintf("UPDATE Msgs SET State = %d, Expunged = 0 WHERE MsgID IN (%d, %d);", MsgExpunged, msgIDs[2], msgIDs[3]),
+	} {
+		stmt := conn.Prep(sql)
+		if _, err := stmt.Step(); err != nil {
+			primary.PutRW(conn)
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	primary.PutRW(conn)
+	if _, err := primary.GC(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	compareReplicas(t, primary, standby)
+}
+
+// compareReplicas checks that the messages, mailbox counts,
+// and blobs of a standby match those of its primary.
+func compareReplicas(t *testing.T, primary, standby *Box) {
+	t.Helper()
+	for _, query := range []string{
+		"SELECT * FROM Msgs ORDER BY MsgID;",
+		"SELECT * FROM MailboxCounts ORDER BY MailboxID;",
+		"SELECT * FROM blobs.Blobs ORDER BY BlobID;",
+	} {
+		want := dumpRows(t, primary, query)
+		got := dumpRows(t, standby, query)
+		if got != want {
+			t.Errorf("%s\nstandby:\n%s\nprimary:\n%s", query, got, want)
+		}
+	}
+
+	// The standby counts agree with its messages.
+	counted := dumpRows(t, standby, `SELECT MailboxID,
+		(SELECT count(*) FROM Msgs WHERE Msgs.MailboxID = MailboxCounts.MailboxID AND State = 1),
+		(SELECT count(*) FROM Msgs WHERE Msgs.MailboxID = MailboxCounts.MailboxID AND State = 1 AND (SysFlags & 1) = 0)
+		FROM MailboxCounts ORDER BY MailboxID;`)
+	counts := dumpRows(t, standby, "SELECT MailboxID, NumMessages, NumUnseen FROM MailboxCounts ORDER BY MailboxID;")
+	if counts != counted {
+		t.Errorf("standby MailboxCounts:\n%s\ncounted from Msgs:\n%s", counts, counted)
+	}
+}
+
+func dumpRows(t *testing.T, box *Box, query string) string {
+	t.Helper()
+	conn := box.PoolRO.Get(nil)
+	defer box.PoolRO.Put(conn)
+
+	buf := new(strings.Builder)
+	stmt, _, err := conn.PrepareTransient(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Finalize()
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			t.Fatal(err)
+		} else if !hasNext {
+			break
+		}
+		for i := 0; i < stmt.ColumnCount(); i++ {
+			switch stmt.ColumnType(i) {
+			case sqlite.SQLITE_NULL:
+				fmt.Fprintf(buf, "%s=NULL ", stmt.ColumnName(i))
+			case sqlite.SQLITE_BLOB:
+				b := make([]byte, stmt.ColumnLen(i))
+				stmt.ColumnBytes(i, b)
+				fmt.Fprintf(buf, "%s=%x ", stmt.ColumnName(i), b)
+			default:
+				fmt.Fprintf(buf, "%s=%s ", stmt.ColumnName(i), stmt.ColumnText(i))
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,254 @@
+package spillbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+)
+
+// Blob sealing.
+//
+// A Box with a blob key stores the Content of blobs.Blobs rows
+// sealed with AES-GCM. Sealed rows are listed in blobs.SealedBlobs,
+// so a store can hold a mix of sealed and plain blobs while
+// SealBlobs encrypts the older ones.
+//
+// Sealed content is a random nonce followed by the ciphertext.
+// The BlobID is the additional data, so sealed content cannot be
+// moved to another row. The SHA256 of a sealed row is the hash
+// of the sealed bytes.
+
+// sealOverhead is the nonce and GCM tag added to sealed content.
+const sealOverhead = 12 + 16
+
+// storedSize is the SQL expression for the size of the content
+// of a blobs.Blobs row before sealing, wherever it is stored.
+var storedSize = fmt.Sprintf(`(ifnull(
+	(SELECT Size FROM blobs.RemoteBlobs WHERE BlobID = blobs.Blobs.BlobID),
+	length(blobs.Blobs.Content)) -
+	CASE WHEN blobs.Blobs.BlobID IN (SELECT BlobID FROM blobs.SealedBlobs)
+	THEN %d ELSE 0 END)`, sealOverhead)
+
+// SetBlobKey sets the AES-256 key new blobs are sealed with.
+// It must be called before the box is used.
+func (box *Box) SetBlobKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("spillbox.SetBlobKey: key is %d bytes, want 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("spillbox.SetBlobKey: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("spillbox.SetBlobKey: %v", err)
+	}
+	if n := aead.NonceSize() + aead.Overhead(); n != sealOverhead {
+		return fmt.Errorf("spillbox.SetBlobKey: seal overhead is %d, want %d", n, sealOverhead)
+	}
+	box.blobCipher = aead
+	return nil
+}
+
+func blobAD(blobID int64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(blobID))
+	return ad
+}
+
+func sealBlob(aead cipher.AEAD, blobID int64, content []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(content)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, content, blobAD(blobID)), nil
+}
+
+func unsealBlob(aead cipher.AEAD, blobID int64, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed blob %d too short", blobID)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	content, err := aead.Open(nil, nonce, ciphertext, blobAD(blobID))
+	if err != nil {
+		return nil, fmt.Errorf("unseal blob %d: %v", blobID, err)
+	}
+	return content, nil
+}
+
+func isSealed(conn *sqlite.Conn, blobID int64) (bool, error) {
+	stmt := conn.Prep("SELECT count(*) FROM blobs.SealedBlobs WHERE BlobID = $blobID;")
+	stmt.SetInt64("$blobID", blobID)
+	n, err := sqlitex.ResultInt(stmt)
+	return n > 0, err
+}
+
+// readBlob reads the content of a blobs.Blobs row, unsealing it if needed.
+func (box *Box) readBlob(ctx context.Context, conn *sqlite.Conn, blobID int64) ([]byte, error) {
+	sealed, err := isSealed(conn, blobID)
+	if err != nil {
+		return nil, err
+	}
+	content, err := box.readStored(ctx, conn, blobID)
+	if err != nil {
+		return nil, err
+	}
+	if !sealed {
+		return content, nil
+	}
+	if box.blobCipher == nil {
+		return nil, fmt.Errorf("blob %d is sealed and there is no blob key", blobID)
+	}
+	return unsealBlob(box.blobCipher, blobID, content)
+}
+
+// writeBlob replaces the content of a blobs.Blobs row,
+// sealing it if the box has a blob key.
+func (box *Box) writeBlob(conn *sqlite.Conn, blobID int64, content []byte) (err error) {
+	aead := box.blobCipher
+	if aead != nil {
+		if content, err = sealBlob(aead, blobID, content); err != nil {
+			return err
+		}
+	}
+	sum := sha256.Sum256(content)
+
+	stmt := conn.Prep(`UPDATE blobs.Blobs SET Content = $content, SHA256 = $sha256
+		WHERE BlobID = $blobID;`)
+	stmt.SetInt64("$blobID", blobID)
+	stmt.SetBytes("$content", content)
+	stmt.SetText("$sha256", hex.EncodeToString(sum[:]))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if aead != nil {
+		stmt = conn.Prep("INSERT OR IGNORE INTO blobs.SealedBlobs (BlobID) VALUES ($blobID);")
+	} else {
+		stmt = conn.Prep("DELETE FROM blobs.SealedBlobs WHERE BlobID = $blobID;")
+	}
+	stmt.SetInt64("$blobID", blobID)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return dropRemote(conn, blobID)
+}
+
+// readSealedMsgPart is readMsgPart for a sealed blob.
+func (box *Box) readSealedMsgPart(conn *sqlite.Conn, blobID int64, isCompressed bool) (_ email.Buffer, compressedSize int64, err error) {
+	content, err := box.readBlob(context.Background(), conn, blobID)
+	if err != nil {
+		return nil, 0, err
+	}
+	dst := box.filer.BufferFile(0)
+	defer func() {
+		if err != nil {
+			dst.Close()
+		}
+	}()
+	if isCompressed {
+		compressedSize = int64(len(content))
+		zr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err = io.Copy(dst, zr); err != nil {
+			return nil, 0, err
+		}
+		if err := zr.Close(); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		if _, err := dst.Write(content); err != nil {
+			return nil, 0, err
+		}
+	}
+	return dst, compressedSize, nil
+}
+
+// SealBlobs seals the content of every blob stored before
+// the box had a blob key. It reports the number sealed.
+//
+// The write connection is taken for one blob at a time,
+// so other writers to the box are not held up.
+func (box *Box) SealBlobs(ctx context.Context) (n int, err error) {
+	if box.blobCipher == nil {
+		return 0, fmt.Errorf("spillbox.SealBlobs: no blob key")
+	}
+	blobIDs, err := box.unsealedBlobs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("spillbox.SealBlobs: %v", err)
+	}
+	for _, blobID := range blobIDs {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		sealed, err := box.sealStoredBlob(ctx, blobID)
+		if err != nil {
+			return n, fmt.Errorf("spillbox.SealBlobs: blob %d: %v", blobID, err)
+		}
+		if sealed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (box *Box) unsealedBlobs(ctx context.Context) (blobIDs []int64, err error) {
+	conn := box.PoolRO.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer box.PoolRO.Put(conn)
+
+	stmt := conn.Prep(`SELECT BlobID FROM blobs.Blobs
+		WHERE Content IS NOT NULL
+		AND BlobID NOT IN (SELECT BlobID FROM blobs.SealedBlobs);`)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		blobIDs = append(blobIDs, stmt.GetInt64("BlobID"))
+	}
+	return blobIDs, nil
+}
+
+// sealStoredBlob seals a blob, reporting false if it was sealed
+// or removed since it was listed.
+func (box *Box) sealStoredBlob(ctx context.Context, blobID int64) (sealed bool, err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer box.PutRW(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`SELECT count(*) FROM blobs.Blobs
+		WHERE BlobID = $blobID AND Content IS NOT NULL
+		AND BlobID NOT IN (SELECT BlobID FROM blobs.SealedBlobs);`)
+	stmt.SetInt64("$blobID", blobID)
+	if n, err := sqlitex.ResultInt(stmt); err != nil || n == 0 {
+		return false, err
+	}
+	content, err := box.readBlob(ctx, conn, blobID)
+	if err != nil {
+		return false, err
+	}
+	if err := box.writeBlob(conn, blobID, content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
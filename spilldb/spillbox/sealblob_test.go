@@ -0,0 +1,129 @@
+package spillbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+)
+
+func TestSetBlobKeyLength(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+
+	if err := box.SetBlobKey(make([]byte, 16)); err == nil {
+		t.Error("SetBlobKey accepted a 16 byte key")
+	}
+	if box.blobCipher != nil {
+		t.Error("rejected key set a blob cipher")
+	}
+}
+
+func TestSealBlobs(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	key := bytes.Repeat([]byte{0x5e}, 32)
+	wrongKey := bytes.Repeat([]byte{0x5f}, 32)
+
+	newMsg := func(i int) string {
+		return fmt.Sprintf("From: a%d@example.com\nTo: user@spilled.ink\nSubject: sealed %d\n\nSecret body %d.\n", i, i, i)
+	}
+	plain := insertTestMsg(t, box, newMsg(1)) // stored before the box has a key
+	if err := box.SetBlobKey(key); err != nil {
+		t.Fatal(err)
+	}
+	sealed := insertTestMsg(t, box, newMsg(2))
+
+	n, err := box.SealBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("SealBlobs sealed nothing")
+	}
+	if n, err := box.SealBlobs(ctx); err != nil || n != 0 {
+		t.Errorf("second SealBlobs=%d, %v, want 0", n, err)
+	}
+
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.PutRW(conn)
+
+	unsealed, err := sqlitex.ResultInt(conn.Prep(`SELECT count(*) FROM blobs.Blobs
+		WHERE Content IS NOT NULL
+		AND BlobID NOT IN (SELECT BlobID FROM blobs.SealedBlobs);`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsealed != 0 {
+		t.Errorf("%d blobs left unsealed", unsealed)
+	}
+
+	// The stored bytes are sealed and storedSize is the unsealed size.
+	var blobIDs []int64
+	err = sqlitex.Exec(conn, "SELECT BlobID, Content, "+storedSize+" AS Size FROM blobs.Blobs WHERE Content IS NOT NULL;", func(stmt *sqlite.Stmt) error {
+		blobID := stmt.GetInt64("BlobID")
+		blobIDs = append(blobIDs, blobID)
+		stored := make([]byte, stmt.GetLen("Content"))
+		stmt.GetBytes("Content", stored)
+		if bytes.Contains(stored, []byte("Secret body")) {
+			t.Errorf("blob %d is stored in the clear", blobID)
+		}
+		content, err := box.readBlob(ctx, conn, blobID)
+		if err != nil {
+			return err
+		}
+		if size := stmt.GetInt64("Size"); size != int64(len(content)) {
+			t.Errorf("blob %d: storedSize=%d, want %d", blobID, size, len(content))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, msgID := range []email.MsgID{plain.MsgID, sealed.MsgID} {
+		buf, err := box.BuildMessage(conn, msgID)
+		if err != nil {
+			t.Fatalf("BuildMessage(%d): %v", msgID, err)
+		}
+		if _, err := buf.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(buf)
+		buf.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("Secret body %d.", i+1); !strings.Contains(string(b), want) {
+			t.Errorf("message %d does not contain %q:\n%s", msgID, want, b)
+		}
+	}
+
+	// Sealed blobs cannot be read with another key, or no key.
+	if err := box.SetBlobKey(wrongKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, blobID := range blobIDs {
+		if _, err := box.readBlob(ctx, conn, blobID); err == nil || !strings.Contains(err.Error(), "unseal") {
+			t.Errorf("readBlob(%d) with the wrong key: %v, want unseal error", blobID, err)
+		}
+	}
+	if _, err := box.BuildMessage(conn, sealed.MsgID); err == nil {
+		t.Error("BuildMessage with the wrong key succeeded")
+	}
+	box.blobCipher = nil
+	if _, err := box.readBlob(ctx, conn, blobIDs[0]); err == nil {
+		t.Error("readBlob of a sealed blob without a key succeeded")
+	}
+}
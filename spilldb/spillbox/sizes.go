@@ -0,0 +1,164 @@
+package spillbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/email/msgbuilder"
+)
+
+// SizeStats reports the work done by VerifySizes.
+type SizeStats struct {
+	Msgs   int   // messages rebuilt
+	Fixed  int   // messages with a missing or wrong EncodedSize
+	Failed int   // messages that could not be rebuilt
+	Delta  int64 // sum of the corrections to EncodedSize
+}
+
+// VerifySizes rebuilds messages as FETCH BODY[] does and corrects
+// their stored EncodedSize, the IMAP RFC822.SIZE, if it does not
+// match. Clients depend on RFC822.SIZE being the size of the
+// literal they are sent.
+//
+// If all is false, only messages not verified before are checked.
+// A message that cannot be rebuilt is counted as failed and left
+// unverified; the first such error is reported after all messages
+// are checked.
+//
+// The write connection is taken for one message at a time,
+// so other writers to the box are not held up.
+func (box *Box) VerifySizes(ctx context.Context, all bool) (stats SizeStats, err error) {
+	msgIDs, err := box.sizeCandidates(ctx, all)
+	if err != nil {
+		return stats, fmt.Errorf("spillbox.VerifySizes: %v", err)
+	}
+
+	var firstErr error
+	for _, msgID := range msgIDs {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		if err := box.verifySize(ctx, msgID, &stats); err != nil {
+			if err == ErrWriteTimeout || err == context.Canceled {
+				return stats, err
+			}
+			stats.Failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("spillbox.VerifySizes: %s: %v", msgID, err)
+			}
+		}
+	}
+	return stats, firstErr
+}
+
+func (box *Box) sizeCandidates(ctx context.Context, all bool) (msgIDs []email.MsgID, err error) {
+	conn := box.PoolRO.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer box.PoolRO.Put(conn)
+
+	stmt := conn.Prep(`SELECT MsgID FROM Msgs
+		WHERE State = $msgReady
+		AND ($all OR SizeVerified IS NULL)
+		ORDER BY MsgID;`)
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	stmt.SetBool("$all", all)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		msgIDs = append(msgIDs, email.MsgID(stmt.GetInt64("MsgID")))
+	}
+	return msgIDs, nil
+}
+
+func (box *Box) verifySize(ctx context.Context, msgID email.MsgID, stats *SizeStats) (err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep("SELECT EncodedSize FROM Msgs WHERE MsgID = $msgID AND State = $msgReady;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	stmt.SetInt64("$msgReady", int64(MsgReady))
+	if hasNext, err := stmt.Step(); err != nil {
+		return err
+	} else if !hasNext {
+		return nil // expunged since it was listed
+	}
+	hasSize := stmt.ColumnType(0) != sqlite.SQLITE_NULL
+	stored := stmt.GetInt64("EncodedSize")
+	stmt.Reset()
+
+	size, err := box.EncodedSize(conn, msgID)
+	if err != nil {
+		return err
+	}
+	stats.Msgs++
+
+	stmt = conn.Prep(`UPDATE Msgs SET EncodedSize = $size, SizeVerified = $now
+		WHERE MsgID = $msgID;`)
+	stmt.SetInt64("$msgID", int64(msgID))
+	stmt.SetInt64("$size", size)
+	stmt.SetInt64("$now", time.Now().Unix())
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if !hasSize || size != stored {
+		stats.Fixed++
+		stats.Delta += size - stored
+	}
+	return nil
+}
+
+// EncodedSize rebuilds a stored message to find its encoded size.
+func (box *Box) EncodedSize(conn *sqlite.Conn, msgID email.MsgID) (int64, error) {
+	hdrs, err := box.LoadMsgHdrs(conn, msgID)
+	if err != nil {
+		return 0, err
+	}
+	stmt := conn.Prep("SELECT Seed, Skeleton FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, err
+	} else if !hasNext {
+		return 0, fmt.Errorf("no message")
+	}
+	msg := &email.Msg{
+		MsgID:   msgID,
+		Seed:    stmt.GetInt64("Seed"),
+		Headers: *hdrs,
+	}
+	msg.Skeleton, err = DecodeSkeleton(stmt, "Skeleton")
+	stmt.Reset()
+	if err != nil {
+		return 0, err
+	}
+
+	msg.Parts, err = LoadPartsSummary(conn, msgID)
+	if err != nil {
+		return 0, err
+	}
+	defer msg.Close()
+	for i := range msg.Parts {
+		if err := box.LoadPartContent(conn, &msg.Parts[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	builder := msgbuilder.Builder{Filer: box.filer}
+	lw := new(lengthWriter)
+	if err := builder.Build(lw, msg); err != nil {
+		return 0, err
+	}
+	return lw.n, nil
+}
@@ -0,0 +1,188 @@
+package spillbox
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+	"spilled.ink/email/spamclass"
+	"spilled.ink/imap"
+)
+
+// SpamThreshold is the spam score at or above which newly delivered
+// mail is filed in the Junk mailbox.
+const SpamThreshold = 0.9
+
+// SpamScore scores msg with the user's spam classifier.
+// See spamclass.Score for the meaning of the result.
+func SpamScore(conn *sqlite.Conn, msg *email.Msg) (float64, error) {
+	total, err := spamTotals(conn)
+	if err != nil {
+		return 0, fmt.Errorf("spillbox.SpamScore: %v", err)
+	}
+	if total.Spam == 0 || total.Ham == 0 {
+		return spamclass.Score(total, nil), nil
+	}
+
+	tokens, err := spamclass.Tokens(msg)
+	if err != nil {
+		return 0, fmt.Errorf("spillbox.SpamScore: %v", err)
+	}
+	stmt := conn.Prep("SELECT Spam, Ham FROM SpamTokens WHERE Token = $token;")
+	counts := make([]spamclass.Counts, 0, len(tokens))
+	for _, token := range tokens {
+		stmt.Reset()
+		stmt.SetText("$token", token)
+		if hasNext, err := stmt.Step(); err != nil {
+			return 0, fmt.Errorf("spillbox.SpamScore: %v", err)
+		} else if !hasNext {
+			continue
+		}
+		counts = append(counts, spamclass.Counts{
+			Spam: stmt.GetInt64("Spam"),
+			Ham:  stmt.GetInt64("Ham"),
+		})
+		stmt.Reset()
+	}
+	return spamclass.Score(total, counts), nil
+}
+
+func spamTotals(conn *sqlite.Conn) (total spamclass.Counts, err error) {
+	stmt := conn.Prep(`SELECT
+		ifnull(sum(IsSpam <> 0), 0) AS Spam,
+		ifnull(sum(IsSpam = 0), 0) AS Ham
+		FROM SpamTraining;`)
+	if _, err := stmt.Step(); err != nil {
+		return total, err
+	}
+	total.Spam = stmt.GetInt64("Spam")
+	total.Ham = stmt.GetInt64("Ham")
+	stmt.Reset()
+	return total, nil
+}
+
+// TrainSpam teaches the user's spam classifier that msgID is spam
+// (or if isSpam is false, that it is ham).
+//
+// Training the same message twice in the same direction is a no-op.
+// Training a message in the opposite direction unlearns the original
+// classification, as happens when a user moves mail out of Junk.
+func (box *Box) TrainSpam(conn *sqlite.Conn, msgID email.MsgID, isSpam bool) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep("SELECT RawHash FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	rawHash, err := sqlitex.ResultText(stmt)
+	if err != nil {
+		return fmt.Errorf("spillbox.TrainSpam(%s): %v", msgID, err)
+	}
+	if rawHash == "" {
+		return nil // tombstone or draft, nothing to learn
+	}
+
+	retrain := false
+	stmt = conn.Prep("SELECT IsSpam FROM SpamTraining WHERE RawHash = $rawHash;")
+	stmt.SetText("$rawHash", rawHash)
+	if hasNext, err := stmt.Step(); err != nil {
+		return fmt.Errorf("spillbox.TrainSpam(%s): %v", msgID, err)
+	} else if hasNext {
+		wasSpam := stmt.GetInt64("IsSpam") != 0
+		stmt.Reset()
+		if wasSpam == isSpam {
+			return nil
+		}
+		retrain = true
+	}
+
+	msg, err := box.LoadMessage(conn, msgID, ContentFullCopy)
+	if err != nil {
+		return fmt.Errorf("spillbox.TrainSpam(%s): %v", msgID, err)
+	}
+	tokens, err := spamclass.Tokens(msg)
+	msg.Close()
+	if err != nil {
+		return fmt.Errorf("spillbox.TrainSpam(%s): %v", msgID, err)
+	}
+
+	var spamDelta, hamDelta int64 = 0, 1
+	if isSpam {
+		spamDelta, hamDelta = 1, 0
+	}
+	if retrain {
+		spamDelta, hamDelta = spamDelta-hamDelta, hamDelta-spamDelta
+	}
+	stmt = conn.Prep(`INSERT INTO SpamTokens (Token, Spam, Ham)
+		VALUES ($token, max($spam, 0), max($ham, 0))
+		ON CONFLICT (Token) DO UPDATE SET
+			Spam = max(Spam + $spam, 0),
+			Ham  = max(Ham + $ham, 0);`)
+	stmt.SetInt64("$spam", spamDelta)
+	stmt.SetInt64("$ham", hamDelta)
+	for _, token := range tokens {
+		stmt.Reset()
+		stmt.SetText("$token", token)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("spillbox.TrainSpam(%s): %v", msgID, err)
+		}
+	}
+
+	stmt = conn.Prep("INSERT OR REPLACE INTO SpamTraining (RawHash, IsSpam) VALUES ($rawHash, $isSpam);")
+	stmt.SetText("$rawHash", rawHash)
+	stmt.SetBool("$isSpam", isSpam)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("spillbox.TrainSpam(%s): %v", msgID, err)
+	}
+	return nil
+}
+
+// IsJunkMailbox reports whether mailboxID is a \Junk mailbox.
+func IsJunkMailbox(conn *sqlite.Conn, mailboxID int64) (bool, error) {
+	stmt := conn.Prep("SELECT ifnull(Attrs, 0) FROM Mailboxes WHERE MailboxID = $mailboxID;")
+	stmt.SetInt64("$mailboxID", mailboxID)
+	attrs, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return false, err
+	}
+	return imap.ListAttrFlag(attrs)&imap.AttrJunk != 0, nil
+}
+
+func junkMailboxID(conn *sqlite.Conn) (int64, error) {
+	stmt := conn.Prep(`SELECT MailboxID FROM Mailboxes
+		WHERE Name IS NOT NULL AND Attrs & $junk <> 0
+		ORDER BY MailboxID LIMIT 1;`)
+	stmt.SetInt64("$junk", int64(imap.AttrJunk))
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, err
+	} else if !hasNext {
+		return 0, nil
+	}
+	mailboxID := stmt.GetInt64("MailboxID")
+	stmt.Reset()
+	return mailboxID, nil
+}
+
+// fileSpam files new mail that scores as spam, or that a milter
+// quarantined, in the Junk mailbox.
+//
+// The X-Quarantine header is trusted: smtpserver removes the
+// copies senders include, so only a milter can have added it.
+func fileSpam(conn *sqlite.Conn, msg *email.Msg) error {
+	if len(msg.Headers.Get("X-Quarantine")) == 0 {
+		score, err := SpamScore(conn, msg)
+		if err != nil {
+			return err
+		}
+		if score < SpamThreshold {
+			return nil
+		}
+	}
+	mailboxID, err := junkMailboxID(conn)
+	if err != nil {
+		return fmt.Errorf("spillbox: junk mailbox: %v", err)
+	}
+	if mailboxID != 0 {
+		msg.MailboxID = mailboxID
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/cipher"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -26,6 +27,7 @@ import (
 	"spilled.ink/email/msgbuilder"
 	"spilled.ink/imap"
 	"spilled.ink/imap/imapparser"
+	"spilled.ink/spilldb/migrate"
 	"spilled.ink/spilldb/spillbox/prettyhtml"
 	"spilled.ink/third_party/imf"
 )
@@ -175,15 +177,41 @@ type Box struct {
 	PoolRO *sqlitex.Pool
 	PoolRW *sqlitex.Pool
 
+	// CompressThreshold, if non-zero, is the size above which
+	// InsertMsg stores new text parts gzip compressed.
+	CompressThreshold int64
+
+	// ObjectStore, if set, holds the blobs moved by OffloadBlobs.
+	ObjectStore ObjectStore
+
+	// WriteTimeout is how long GetRW waits for the write
+	// connection, DefaultWriteTimeout if zero.
+	WriteTimeout time.Duration
+
+	// FetchTimeout bounds the reading of an offloaded blob from
+	// the ObjectStore, DefaultFetchTimeout if zero. Loading
+	// messages takes no context, so it is their only limit.
+	FetchTimeout time.Duration
+
+	// MaxKeywords is the number of IMAP keywords a mailbox may
+	// have, DefaultMaxKeywords if zero. See RegisterKeywords.
+	MaxKeywords int
+
 	labelPersonalMail LabelID
 
 	filer     *iox.Filer
 	pretty    *prettyhtml.Prettifier
 	notifiers []imap.Notifier
 	userID    int64
+	dbfile    string
+
+	conns      []*sqlite.Conn // every connection of PoolRW and PoolRO
+	rwSem      chan struct{}  // held by the user of PoolRW, see GetRW
+	rwAcquired time.Time      // when rwSem was last acquired
+	blobCipher cipher.AEAD    // seals blobs, see SetBlobKey
 
 	mu      sync.Mutex
-	devices map[string][]imapparser.ApplePushDevice
+	devices map[string]imap.PushDevices // mailbox name -> devices
 }
 
 type NewMsgFunc func(mailboxID int64, mailboxName string, msgID email.MsgID)
@@ -192,6 +220,8 @@ func New(userID int64, filer *iox.Filer, dbfile string, poolSize int) (_ *Box, e
 	box := &Box{
 		userID: userID,
 		filer:  filer,
+		dbfile: dbfile,
+		rwSem:  make(chan struct{}, 1),
 	}
 	defer func() {
 		if err != nil {
@@ -199,8 +229,7 @@ func New(userID int64, filer *iox.Filer, dbfile string, poolSize int) (_ *Box, e
 		}
 	}()
 
-	dbdir, dbfilename := filepath.Split(dbfile)
-	blobsDBFile := filepath.Join(dbdir, strings.TrimSuffix(dbfilename, ".db")+"_blobs.db")
+	blobsDBFile := blobsDBFile(dbfile)
 
 	flags := sqlite.SQLITE_OPEN_SHAREDCACHE |
 		sqlite.SQLITE_OPEN_WAL |
@@ -212,7 +241,7 @@ func New(userID int64, filer *iox.Filer, dbfile string, poolSize int) (_ *Box, e
 	if err != nil {
 		return nil, err
 	}
-	if err := attachBlobsDB(box.PoolRW, 1, blobsDBFile); err != nil {
+	if err := box.attachBlobsDB(box.PoolRW, 1, blobsDBFile); err != nil {
 		return nil, err
 	}
 	conn := box.PoolRW.Get(nil)
@@ -228,14 +257,14 @@ func New(userID int64, filer *iox.Filer, dbfile string, poolSize int) (_ *Box, e
 		if err != nil {
 			return nil, err
 		}
-		if err := attachBlobsDB(box.PoolRO, poolSize-1, blobsDBFile); err != nil {
+		if err := box.attachBlobsDB(box.PoolRO, poolSize-1, blobsDBFile); err != nil {
 			return nil, err
 		}
 	} else {
 		box.PoolRO = box.PoolRW
 	}
 
-	box.devices = make(map[string][]imapparser.ApplePushDevice)
+	box.devices = make(map[string]imap.PushDevices)
 	conn = box.PoolRO.Get(nil)
 	defer box.PoolRO.Put(conn)
 	stmt := conn.Prep("SELECT Mailbox, AppleAccountID, AppleDeviceToken FROM ApplePushDevices;")
@@ -246,16 +275,40 @@ func New(userID int64, filer *iox.Filer, dbfile string, poolSize int) (_ *Box, e
 			break
 		}
 		mailbox := stmt.GetText("Mailbox")
-		box.devices[mailbox] = append(box.devices[mailbox], imapparser.ApplePushDevice{
+		devices := box.devices[mailbox]
+		devices.Apple = append(devices.Apple, imapparser.ApplePushDevice{
 			AccountID:   stmt.GetText("AppleAccountID"),
 			DeviceToken: stmt.GetText("AppleDeviceToken"),
 		})
+		box.devices[mailbox] = devices
+	}
+	stmt = conn.Prep("SELECT Mailbox, Endpoint, P256DH, Auth FROM WebPushSubscriptions;")
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+		mailbox := stmt.GetText("Mailbox")
+		devices := box.devices[mailbox]
+		devices.Web = append(devices.Web, imap.WebPushSubscription{
+			Endpoint: stmt.GetText("Endpoint"),
+			P256DH:   stmt.GetText("P256DH"),
+			Auth:     stmt.GetText("Auth"),
+		})
+		box.devices[mailbox] = devices
 	}
 
 	return box, nil
 }
 
-func attachBlobsDB(pool *sqlitex.Pool, poolSize int, blobsDBFile string) error {
+// blobsDBFile is the name of the blobs database kept beside dbfile.
+func blobsDBFile(dbfile string) string {
+	dbdir, dbfilename := filepath.Split(dbfile)
+	return filepath.Join(dbdir, strings.TrimSuffix(dbfilename, ".db")+"_blobs.db")
+}
+
+func (box *Box) attachBlobsDB(pool *sqlitex.Pool, poolSize int, blobsDBFile string) error {
 	var conns []*sqlite.Conn
 	defer func() {
 		for _, conn := range conns {
@@ -269,15 +322,9 @@ func attachBlobsDB(pool *sqlitex.Pool, poolSize int, blobsDBFile string) error {
 			return fmt.Errorf("spillbox: cannot get connection %d to attach blobs", i)
 		}
 		conns = append(conns, conn)
+		box.conns = append(box.conns, conn)
 
-		stmt, _, err := conn.PrepareTransient("ATTACH DATABASE $db AS blobs;")
-		if err != nil {
-			return err
-		}
-		stmt.SetText("$db", blobsDBFile)
-		_, err = stmt.Step()
-		stmt.Finalize()
-		if err != nil {
+		if err := attachBlobs(conn, blobsDBFile); err != nil {
 			return err
 		}
 	}
@@ -285,6 +332,17 @@ func attachBlobsDB(pool *sqlitex.Pool, poolSize int, blobsDBFile string) error {
 	return nil
 }
 
+func attachBlobs(conn *sqlite.Conn, blobsDBFile string) error {
+	stmt, _, err := conn.PrepareTransient("ATTACH DATABASE $db AS blobs;")
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$db", blobsDBFile)
+	_, err = stmt.Step()
+	stmt.Finalize()
+	return err
+}
+
 func (box *Box) RegisterNotifier(notifier imap.Notifier) {
 	box.notifiers = append(box.notifiers, notifier)
 }
@@ -316,20 +374,78 @@ func initDB(conn *sqlite.Conn) (err error) {
 	if err != nil {
 		return err
 	}
+	// Only takes effect on new databases, see vacuum in gc.go.
+	if err := sqlitex.ExecTransient(conn, "PRAGMA main.auto_vacuum = INCREMENTAL;", nil); err != nil {
+		return err
+	}
+	if err := sqlitex.ExecTransient(conn, "PRAGMA blobs.auto_vacuum = INCREMENTAL;", nil); err != nil {
+		return err
+	}
 
-	defer sqlitex.Save(conn)(&err)
-	if err := sqlitex.ExecScript(conn, createSQL); err != nil {
+	return migrate.Init(conn, createSQL, migrations)
+}
+
+// Migrate brings the schema of the box at dbfile up to date, as New
+// does, and reports the steps it applied. No Box may have dbfile open.
+//
+// If dryRun is set, the steps are reported but not applied.
+// If backupfile is set and there are steps to apply, the box is
+// first copied there. Unlike a Backup, the copy refers to the
+// offloaded blobs of the box rather than holding them.
+func Migrate(dbfile, backupfile string, dryRun bool) ([]migrate.Step, error) {
+	flags := sqlite.SQLITE_OPEN_READWRITE |
+		sqlite.SQLITE_OPEN_WAL |
+		sqlite.SQLITE_OPEN_URI |
+		sqlite.SQLITE_OPEN_NOMUTEX
+	conn, err := sqlite.OpenConn(dbfile, flags)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.Migrate: %v", err)
+	}
+	defer conn.Close()
+	if err := attachBlobs(conn, blobsDBFile(dbfile)); err != nil {
+		return nil, fmt.Errorf("spillbox.Migrate: %v", err)
+	}
+
+	steps, err := migrate.Pending(conn, migrations)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.Migrate: %v", err)
+	}
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+	if backupfile != "" {
+		if err := vacuumInto(conn, "main", backupfile); err != nil {
+			return nil, fmt.Errorf("spillbox.Migrate: backup: %v", err)
+		}
+		if err := vacuumInto(conn, "blobs", blobsDBFile(backupfile)); err != nil {
+			return nil, fmt.Errorf("spillbox.Migrate: backup: %v", err)
+		}
+	}
+	if err := initDB(conn); err != nil {
+		return nil, fmt.Errorf("spillbox.Migrate: %v", err)
+	}
+	return steps, nil
+}
+
+func vacuumInto(conn *sqlite.Conn, schema, path string) error {
+	stmt, _, err := conn.PrepareTransient(fmt.Sprintf("VACUUM %s INTO $path;", schema))
+	if err != nil {
 		return err
 	}
+	defer stmt.Finalize()
+	stmt.SetText("$path", path)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("%s: %v", schema, err)
+	}
 	return nil
 }
 
 func (box *Box) Init(ctx context.Context) error {
-	conn := box.PoolRW.Get(ctx)
-	if conn == nil {
-		return context.Canceled
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
 	}
-	defer box.PoolRW.Put(conn)
+	defer box.PutRW(conn)
 
 	mboxes := []struct {
 		name string
@@ -352,11 +468,11 @@ func (box *Box) Init(ctx context.Context) error {
 }
 
 func (box *Box) RegisterPushDevice(ctx context.Context, mailbox string, device imapparser.ApplePushDevice) error {
-	conn := box.PoolRW.Get(ctx)
-	if conn == nil {
-		return context.Canceled
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
 	}
-	defer box.PoolRW.Put(conn)
+	defer box.PutRW(conn)
 
 	stmt := conn.Prep("SELECT count(*) FROM ApplePushDevices WHERE Mailbox=$mailbox AND AppleAccountID=$appleAccountID AND AppleDeviceToken=$appleDeviceToken;")
 	stmt.SetText("$mailbox", mailbox)
@@ -367,7 +483,7 @@ func (box *Box) RegisterPushDevice(ctx context.Context, mailbox string, device i
 		return err
 	}
 	if count > 0 {
-		return nil
+		return clearPushFailures(conn, device.DeviceToken)
 	}
 
 	stmt = conn.Prep("INSERT INTO ApplePushDevices (Mailbox, AppleAccountID, AppleDeviceToken) VALUES ($mailbox, $appleAccountID, $appleDeviceToken);")
@@ -377,9 +493,200 @@ func (box *Box) RegisterPushDevice(ctx context.Context, mailbox string, device i
 	if _, err := stmt.Step(); err != nil {
 		return err
 	}
+	if err := clearPushFailures(conn, device.DeviceToken); err != nil {
+		return err
+	}
+
+	box.mu.Lock()
+	devices := box.devices[mailbox]
+	devices.Apple = append(devices.Apple[:len(devices.Apple):len(devices.Apple)], device)
+	box.devices[mailbox] = devices
+	box.mu.Unlock()
+
+	return nil
+}
+
+// clearPushFailures forgets past failures of a device that has
+// registered again, so it is evidently still in use.
+func clearPushFailures(conn *sqlite.Conn, token string) error {
+	stmt := conn.Prep("DELETE FROM ApplePushFailures WHERE AppleDeviceToken = $token;")
+	stmt.SetText("$token", token)
+	_, err := stmt.Step()
+	return err
+}
+
+// MaxPushFailures is the number of failed notifications after which
+// PushDeviceFailed removes an Apple push device.
+const MaxPushFailures = 3
+
+// PushDeviceFailed records that APNS refused a notification for
+// device. After MaxPushFailures without the device registering
+// again, it is removed from every mailbox and pruned is true.
+func (box *Box) PushDeviceFailed(ctx context.Context, device imapparser.ApplePushDevice) (pruned bool, err error) {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer box.PutRW(conn)
+
+	pruned, err = pushDeviceFailed(conn, device.DeviceToken)
+	if err != nil {
+		return false, fmt.Errorf("spillbox.PushDeviceFailed: %v", err)
+	}
+	if !pruned {
+		return false, nil
+	}
+
+	box.mu.Lock()
+	for mailbox, devices := range box.devices {
+		var apple []imapparser.ApplePushDevice
+		for _, d := range devices.Apple {
+			if d.DeviceToken != device.DeviceToken {
+				apple = append(apple, d)
+			}
+		}
+		devices.Apple = apple
+		box.devices[mailbox] = devices
+	}
+	box.mu.Unlock()
+
+	return true, nil
+}
+
+func pushDeviceFailed(conn *sqlite.Conn, token string) (pruned bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`INSERT INTO ApplePushFailures (AppleDeviceToken, Failures, LastFailure)
+		VALUES ($token, 1, $now)
+		ON CONFLICT (AppleDeviceToken) DO UPDATE SET
+			Failures = Failures + 1,
+			LastFailure = $now;`)
+	stmt.SetText("$token", token)
+	stmt.SetInt64("$now", time.Now().Unix())
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+
+	stmt = conn.Prep("SELECT Failures FROM ApplePushFailures WHERE AppleDeviceToken = $token;")
+	stmt.SetText("$token", token)
+	failures, err := sqlitex.ResultInt(stmt)
+	if err != nil {
+		return false, err
+	}
+	if failures < MaxPushFailures {
+		return false, nil
+	}
+
+	stmt = conn.Prep("DELETE FROM ApplePushDevices WHERE AppleDeviceToken = $token;")
+	stmt.SetText("$token", token)
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	if err := clearPushFailures(conn, token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PushDevice is a device registered for push notifications.
+type PushDevice struct {
+	Mailbox     string
+	Kind        string // "apns" or "webpush"
+	ID          string // APNS device token or Web Push endpoint
+	Failures    int    // APNS only, since the device last registered
+	LastFailure time.Time
+}
+
+// PushDevices lists the devices registered for push notifications.
+func PushDevices(conn *sqlite.Conn) (devices []PushDevice, err error) {
+	stmt := conn.Prep(`SELECT Mailbox, 'apns' AS Kind, ApplePushDevices.AppleDeviceToken AS ID,
+			coalesce(Failures, 0) AS Failures, coalesce(LastFailure, 0) AS LastFailure
+		FROM ApplePushDevices
+		LEFT JOIN ApplePushFailures
+			ON ApplePushFailures.AppleDeviceToken = ApplePushDevices.AppleDeviceToken
+		UNION ALL
+		SELECT Mailbox, 'webpush' AS Kind, Endpoint AS ID, 0 AS Failures, 0 AS LastFailure
+		FROM WebPushSubscriptions
+		ORDER BY Mailbox, Kind, ID;`)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.PushDevices: %v", err)
+		} else if !hasNext {
+			break
+		}
+		d := PushDevice{
+			Mailbox:  stmt.GetText("Mailbox"),
+			Kind:     stmt.GetText("Kind"),
+			ID:       stmt.GetText("ID"),
+			Failures: int(stmt.GetInt64("Failures")),
+		}
+		if t := stmt.GetInt64("LastFailure"); t != 0 {
+			d.LastFailure = time.Unix(t, 0)
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// RegisterWebPush subscribes a browser to notifications of new mail
+// in mailbox. A subscription with the same endpoint is replaced.
+func (box *Box) RegisterWebPush(ctx context.Context, mailbox string, sub imap.WebPushSubscription) error {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+
+	stmt := conn.Prep(`INSERT OR REPLACE INTO WebPushSubscriptions (Mailbox, Endpoint, P256DH, Auth)
+		VALUES ($mailbox, $endpoint, $p256dh, $auth);`)
+	stmt.SetText("$mailbox", mailbox)
+	stmt.SetText("$endpoint", sub.Endpoint)
+	stmt.SetText("$p256dh", sub.P256DH)
+	stmt.SetText("$auth", sub.Auth)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("spillbox.RegisterWebPush: %v", err)
+	}
+
+	box.mu.Lock()
+	devices := box.devices[mailbox]
+	var web []imap.WebPushSubscription
+	for _, s := range devices.Web {
+		if s.Endpoint != sub.Endpoint {
+			web = append(web, s)
+		}
+	}
+	devices.Web = append(web, sub)
+	box.devices[mailbox] = devices
+	box.mu.Unlock()
+
+	return nil
+}
+
+// RemoveWebPush removes a Web Push subscription from every mailbox.
+func (box *Box) RemoveWebPush(ctx context.Context, endpoint string) error {
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
+	}
+	defer box.PutRW(conn)
+
+	stmt := conn.Prep("DELETE FROM WebPushSubscriptions WHERE Endpoint = $endpoint;")
+	stmt.SetText("$endpoint", endpoint)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("spillbox.RemoveWebPush: %v", err)
+	}
 
 	box.mu.Lock()
-	box.devices[mailbox] = append(box.devices[mailbox], device)
+	for mailbox, devices := range box.devices {
+		var web []imap.WebPushSubscription
+		for _, s := range devices.Web {
+			if s.Endpoint != endpoint {
+				web = append(web, s)
+			}
+		}
+		devices.Web = web
+		box.devices[mailbox] = devices
+	}
 	box.mu.Unlock()
 
 	return nil
@@ -501,11 +808,11 @@ var (
 )
 
 /*func (box *Box) updateSearch(ctx context.Context) error {
-	conn := box.PoolRW.Get(ctx)
-	if conn == nil {
-		return context.Canceled
+	conn, err := box.GetRW(ctx)
+	if err != nil {
+		return err
 	}
-	defer box.PoolRW.Put(conn)
+	defer box.PutRW(conn)
 
 	// TODO: fill in the body from a blob
 	stmt := conn.Prep(`INSERT INTO MsgSearch (MsgID, ConvoID, Body)
@@ -527,20 +834,60 @@ func findLabel(conn *sqlite.Conn, labelName string) (LabelID, error) {
 	return LabelID(id), err
 }
 
-func LoadMsgHdrs(conn *sqlite.Conn, msgID email.MsgID) (*email.Header, error) {
-	stmt := conn.Prep("SELECT Content FROM blobs.Blobs WHERE BlobID = (SELECT HdrsBlobID FROM Msgs WHERE MsgID = $msgID);")
+func (box *Box) LoadMsgHdrs(conn *sqlite.Conn, msgID email.MsgID) (*email.Header, error) {
+	stmt := conn.Prep("SELECT HdrsBlobID FROM Msgs WHERE MsgID = $msgID;")
 	stmt.SetInt64("$msgID", int64(msgID))
-	hdrs, err := sqlitex.ResultText(stmt)
+	blobID, err := sqlitex.ResultInt64(stmt)
 	if err != nil {
 		return nil, err
 	}
-	hdr, err := imf.NewReader(bufio.NewReader(strings.NewReader(hdrs + "\n\n"))).ReadMIMEHeader()
+	hdrs, err := box.readBlob(context.Background(), conn, blobID)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := imf.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(hdrs), strings.NewReader("\n\n")))).ReadMIMEHeader()
 	if err != nil {
 		return nil, fmt.Errorf("%s: could not parse headers: %v", msgID, err)
 	}
 	return &hdr, nil
 }
 
+// HeaderFieldKeys are the header fields stored in MsgHeaderFields.
+// They are the fields mail clients commonly fetch to list a mailbox.
+var HeaderFieldKeys = []email.Key{
+	email.CanonicalKey([]byte("Date")),
+	email.CanonicalKey([]byte("From")),
+	email.CanonicalKey([]byte("To")),
+	email.CanonicalKey([]byte("Subject")),
+	email.CanonicalKey([]byte("Message-ID")),
+	email.CanonicalKey([]byte("List-ID")),
+}
+
+// LoadHeaderFields loads the stored header fields of a message
+// without reading its header blob.
+//
+// Fields that are not stored are missing from the map.
+// Stored fields the message does not have are nil.
+func LoadHeaderFields(conn *sqlite.Conn, msgID email.MsgID) (map[email.Key][]byte, error) {
+	fields := make(map[email.Key][]byte)
+	stmt := conn.Prep("SELECT Key, Value FROM MsgHeaderFields WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("spillbox.LoadHeaderFields(%s): %v", msgID, err)
+		} else if !hasNext {
+			break
+		}
+		var v []byte
+		if n := stmt.GetLen("Value"); n > 0 {
+			v = make([]byte, n)
+			stmt.GetBytes("Value", v)
+		}
+		fields[email.Key(stmt.GetText("Key"))] = v
+	}
+	return fields, nil
+}
+
 /*func MarkMsgRead(conn *sqlite.Conn, msgID email.MsgID) error {
 	// TODO: set \Seen flag
 	stmt := conn.Prep("UPDATE Msgs SET State = $msgRead WHERE MsgID = $msgID AND State = $msgUnread;")
@@ -598,8 +945,8 @@ const (
 // LoadMessage loads the message msgID from the database.
 //
 // It is the callers responsibility to close the message.
-func LoadMessage(conn *sqlite.Conn, filer *iox.Filer, msgID email.MsgID, contentState ContentState) (msg *email.Msg, err error) {
-	hdrs, err := LoadMsgHdrs(conn, msgID)
+func (box *Box) LoadMessage(conn *sqlite.Conn, msgID email.MsgID, contentState ContentState) (msg *email.Msg, err error) {
+	hdrs, err := box.LoadMsgHdrs(conn, msgID)
 	if err != nil {
 		return nil, fmt.Errorf("spillbox.LoadMessage(%s): loading headers: %v", msgID, err)
 	}
@@ -607,6 +954,14 @@ func LoadMessage(conn *sqlite.Conn, filer *iox.Filer, msgID email.MsgID, content
 	msg = new(email.Msg)
 	msg.MsgID = msgID
 	msg.Headers = *hdrs
+	msg.Skeleton, err = LoadSkeleton(conn, msgID)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.LoadMessage(%s): %v", msgID, err)
+	}
+	msg.EnvelopeFrom, msg.EnvelopeTo, err = LoadEnvelope(conn, msgID)
+	if err != nil {
+		return nil, fmt.Errorf("spillbox.LoadMessage(%s): %v", msgID, err)
+	}
 	// TODO msg.Seed
 	// TODO msg.RawHash
 	// TODO msg.Date
@@ -616,7 +971,7 @@ func LoadMessage(conn *sqlite.Conn, filer *iox.Filer, msgID email.MsgID, content
 	// TODO: call LoadPartSummary
 	stmt := conn.Prep(`SELECT
 		PartNum, IsBody, IsAttachment, IsCompressed,
-		ContentType, ContentID, Name, BlobID
+		ContentType, ContentID, Name, BlobID, IsSynthesized
 		FROM MsgParts
 		WHERE MsgID = $msgID ORDER BY PartNum;`)
 	stmt.SetInt64("$msgID", int64(msgID))
@@ -638,8 +993,10 @@ func LoadMessage(conn *sqlite.Conn, filer *iox.Filer, msgID email.MsgID, content
 			IsCompressed: isCompressed,
 			ContentType:  stmt.GetText("ContentType"),
 			ContentID:    stmt.GetText("ContentID"),
+
+			IsSynthesized: stmt.GetInt64("IsSynthesized") != 0,
 		}
-		p.Content, p.CompressedSize, err = readMsgPart(conn, filer, blobID, isCompressed, contentState)
+		p.Content, p.CompressedSize, err = box.readMsgPart(conn, blobID, isCompressed, contentState)
 		if err != nil {
 			stmt.Reset()
 			msg.Close()
@@ -648,16 +1005,69 @@ func LoadMessage(conn *sqlite.Conn, filer *iox.Filer, msgID email.MsgID, content
 		msg.Parts = append(msg.Parts, p)
 	}
 
+	msg.Invites, err = LoadInvites(conn, msgID)
+	if err != nil {
+		msg.Close()
+		return nil, fmt.Errorf("spillbox.LoadMessage(%s): %v", msgID, err)
+	}
+
 	return msg, nil
 }
 
+// LoadSkeleton loads the MIME framing of a message cleaved
+// for fidelity, or nil.
+func LoadSkeleton(conn *sqlite.Conn, msgID email.MsgID) (*email.Skeleton, error) {
+	stmt := conn.Prep("SELECT Skeleton FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	if hasNext, err := stmt.Step(); err != nil {
+		return nil, fmt.Errorf("skeleton: %v", err)
+	} else if !hasNext {
+		return nil, fmt.Errorf("skeleton: no message")
+	}
+	defer stmt.Reset()
+	return DecodeSkeleton(stmt, "Skeleton")
+}
+
+// DecodeSkeleton decodes the JSON email.Skeleton in column col.
+func DecodeSkeleton(stmt *sqlite.Stmt, col string) (*email.Skeleton, error) {
+	if stmt.GetLen(col) == 0 {
+		return nil, nil
+	}
+	sk := new(email.Skeleton)
+	if err := json.NewDecoder(stmt.GetReader(col)).Decode(sk); err != nil {
+		return nil, fmt.Errorf("skeleton: %v", err)
+	}
+	return sk, nil
+}
+
+// LoadEnvelope loads the SMTP envelope a message was delivered with.
+// A message not delivered over SMTP has no recipients.
+func LoadEnvelope(conn *sqlite.Conn, msgID email.MsgID) (from string, to []string, err error) {
+	stmt := conn.Prep("SELECT EnvelopeFrom, EnvelopeTo FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", nil, fmt.Errorf("envelope: %v", err)
+	} else if !hasNext {
+		return "", nil, fmt.Errorf("envelope: no message")
+	}
+	defer stmt.Reset()
+	if stmt.GetLen("EnvelopeTo") == 0 {
+		return "", nil, nil
+	}
+	if err := json.Unmarshal([]byte(stmt.GetText("EnvelopeTo")), &to); err != nil {
+		return "", nil, fmt.Errorf("envelope: %v", err)
+	}
+	return stmt.GetText("EnvelopeFrom"), to, nil
+}
+
 func LoadPartsSummary(conn *sqlite.Conn, msgID email.MsgID) (parts []email.Part, err error) {
 	stmt := conn.Prep(`SELECT
 		PartNum, IsBody, IsAttachment, IsCompressed,
 		ContentType, ContentID, Name, MsgParts.BlobID,
 		ContentTransferEncoding, ContentTransferSize,
-		ContentTransferLines,
-		length(blobs.Blobs.Content) AS CompressedSize
+		ContentTransferLines, TransferAnomalies, OriginalCharset,
+		IsSynthesized,
+		` + storedSize + ` AS CompressedSize
 		FROM MsgParts
 		INNER JOIN blobs.Blobs ON blobs.Blobs.BlobID = MsgParts.BlobID
 		WHERE MsgID = $msgID ORDER BY PartNum;`)
@@ -684,6 +1094,9 @@ func LoadPartsSummary(conn *sqlite.Conn, msgID email.MsgID) (parts []email.Part,
 			ContentTransferEncoding: stmt.GetText("ContentTransferEncoding"),
 			ContentTransferSize:     stmt.GetInt64("ContentTransferSize"),
 			ContentTransferLines:    stmt.GetInt64("ContentTransferLines"),
+			TransferAnomalies:       stmt.GetText("TransferAnomalies"),
+			OriginalCharset:         stmt.GetText("OriginalCharset"),
+			IsSynthesized:           stmt.GetInt64("IsSynthesized") != 0,
 		}
 		parts = append(parts, p)
 	}
@@ -691,16 +1104,16 @@ func LoadPartsSummary(conn *sqlite.Conn, msgID email.MsgID) (parts []email.Part,
 	return parts, nil
 }
 
-func BuildMessage(conn *sqlite.Conn, filer *iox.Filer, msgID email.MsgID) (*iox.BufferFile, error) {
-	msg, err := LoadMessage(conn, filer, msgID, ContentDB)
+func (box *Box) BuildMessage(conn *sqlite.Conn, msgID email.MsgID) (*iox.BufferFile, error) {
+	msg, err := box.LoadMessage(conn, msgID, ContentDB)
 	if err != nil {
 		return nil, err
 	}
 	defer msg.Close()
 	builder := msgbuilder.Builder{
-		Filer: filer,
+		Filer: box.filer,
 	}
-	buf := filer.BufferFile(0)
+	buf := box.filer.BufferFile(0)
 	if err := builder.Build(buf, msg); err != nil {
 		buf.Close()
 		return nil, err
@@ -724,8 +1137,8 @@ func randBoundary(seed int64) func() string {
 	}
 }
 
-func LoadPartContent(conn *sqlite.Conn, filer *iox.Filer, part *email.Part) error {
-	buf, _, err := readMsgPart(conn, filer, part.BlobID, part.IsCompressed, ContentFullCopy)
+func (box *Box) LoadPartContent(conn *sqlite.Conn, part *email.Part) error {
+	buf, _, err := box.readMsgPart(conn, part.BlobID, part.IsCompressed, ContentFullCopy)
 	if err != nil {
 		return fmt.Errorf("LoadPartContent(blobid=%d): %v", part.BlobID, err)
 	}
@@ -736,16 +1149,21 @@ func LoadPartContent(conn *sqlite.Conn, filer *iox.Filer, part *email.Part) erro
 	return nil
 }
 
-func readMsgPart(conn *sqlite.Conn, filer *iox.Filer, blobID int64, isCompressed bool, contentState ContentState) (_ email.Buffer, compressedSize int64, err error) {
+func (box *Box) readMsgPart(conn *sqlite.Conn, blobID int64, isCompressed bool, contentState ContentState) (_ email.Buffer, compressedSize int64, err error) {
 	if contentState == ContentNil {
-		stmt := conn.Prep("SELECT length(Content) FROM blobs.Blobs WHERE BlobID = $BlobID;")
+		stmt := conn.Prep("SELECT " + storedSize + " FROM blobs.Blobs WHERE BlobID = $BlobID;")
 		stmt.SetInt64("$BlobID", blobID)
 		compressedSize, err = sqlitex.ResultInt64(stmt)
 		return nil, compressedSize, err
 	}
+	if sealed, err := isSealed(conn, blobID); err != nil {
+		return nil, 0, err
+	} else if sealed {
+		return box.readSealedMsgPart(conn, blobID, isCompressed)
+	}
 
-	var blob *sqlite.Blob
-	blob, err = conn.OpenBlob("blobs", "Blobs", "Content", blobID, false)
+	var blob email.Buffer
+	blob, err = box.openStored(context.Background(), conn, blobID)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -753,7 +1171,7 @@ func readMsgPart(conn *sqlite.Conn, filer *iox.Filer, blobID int64, isCompressed
 		return blob, 0, nil
 	}
 
-	dst := filer.BufferFile(0)
+	dst := box.filer.BufferFile(0)
 	defer func() {
 		blob.Close()
 		if err != nil {
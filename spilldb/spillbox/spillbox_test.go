@@ -0,0 +1,126 @@
+package spillbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"crawshaw.io/iox"
+	"spilled.ink/email"
+	"spilled.ink/email/msgcleaver"
+)
+
+// newTestBox creates an initialized Box in a temporary directory.
+func newTestBox(t *testing.T) (box *Box, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "spillbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filer := iox.NewFiler(0)
+	filer.Logf = t.Logf
+	cleanup = func() {
+		if box != nil {
+			box.Close()
+		}
+		filer.Shutdown(context.Background())
+		os.RemoveAll(dir)
+	}
+
+	box, err = New(1, filer, filepath.Join(dir, "spillbox.db"), 2)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := box.Init(context.Background()); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return box, cleanup
+}
+
+var testStagingID int64 = 100
+
+// insertTestMsg delivers raw to box as new mail.
+// Lines of raw may end in "\n".
+func insertTestMsg(t *testing.T, box *Box, raw string) *email.Msg {
+	t.Helper()
+	raw = strings.Replace(strings.Replace(raw, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	msg, err := msgcleaver.Cleave(box.filer, strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Date = time.Now()
+	testStagingID++
+	done, err := box.InsertMsg(context.Background(), msg, testStagingID)
+	msg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Fatal("InsertMsg: not done")
+	}
+	return msg
+}
+
+// memStore is an in-memory ObjectStore.
+type memStore struct {
+	mu   sync.Mutex
+	objs map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{objs: make(map[string][]byte)}
+}
+
+func (s *memStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return fmt.Errorf("memStore.Put(%s): %d bytes, want %d", key, len(b), size)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objs[key] = b
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objs[key]
+	if !ok {
+		return nil, fmt.Errorf("memStore.Get(%s): no object", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objs, key)
+	return nil
+}
+
+func (s *memStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objs {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -1,5 +1,7 @@
 package spillbox
 
+import "spilled.ink/spilldb/migrate"
+
 const createSQL = `
 -- SQL schema for a spilldb single user mailbox, a.k.a. a spillbox.
 --
@@ -13,6 +15,26 @@ CREATE TABLE IF NOT EXISTS ApplePushDevices (
 	AppleDeviceToken TEXT NOT NULL
 );
 
+-- ApplePushFailures counts the notifications APNS has refused for
+-- a device token since it last registered. The device is removed
+-- after MaxPushFailures.
+CREATE TABLE IF NOT EXISTS ApplePushFailures (
+	AppleDeviceToken TEXT PRIMARY KEY,
+	Failures         INTEGER NOT NULL,
+	LastFailure      INTEGER NOT NULL -- time.Now().Unix()
+);
+
+-- WebPushSubscriptions are browsers subscribed to new mail
+-- notifications with Web Push, RFC 8030.
+CREATE TABLE IF NOT EXISTS WebPushSubscriptions (
+	Mailbox  TEXT NOT NULL,
+	Endpoint TEXT NOT NULL, -- push service URL
+	P256DH   TEXT NOT NULL, -- base64url client public key, RFC 8291
+	Auth     TEXT NOT NULL, -- base64url authentication secret
+
+	PRIMARY KEY(Mailbox, Endpoint)
+);
+
 -- Contacts is a list of contacts.
 -- It is generated from incoming email and curated by users.
 -- ContactID == 1 is always the user of this account.
@@ -35,6 +57,9 @@ CREATE TABLE IF NOT EXISTS Addresses (
 	FOREIGN KEY(ContactID) REFERENCES Contacts(ContactID)
 );
 
+CREATE INDEX IF NOT EXISTS AddressesAddress ON Addresses (Address);
+CREATE INDEX IF NOT EXISTS AddressesContact ON Addresses (ContactID);
+
 -- Tie the mod-sequence used by CONDSTORE to the mailbox name.
 --
 -- MailboxID is not visible to IMAP, so reusing a deleted
@@ -45,9 +70,15 @@ CREATE TABLE IF NOT EXISTS Addresses (
 -- but that is not explicitly mentioned in RFC 7162 for
 -- mod-sequences, so we play it safe and always increment
 -- the value for a given mailbox name.
+--
+-- UIDValidity is likewise the highest UIDVALIDITY given to a mailbox
+-- with the name. Deleted mailboxes are eventually removed by GC, so
+-- the Mailboxes table alone cannot guarantee a recreated mailbox
+-- gets a UIDVALIDITY its name has not had before.
 CREATE TABLE IF NOT EXISTS MailboxSequencing (
 	Name            TEXT PRIMARY KEY,
-	NextModSequence INTEGER NOT NULL  -- uint32, IMAP RFC 7162 CONDSTORE
+	NextModSequence INTEGER NOT NULL, -- uint32, IMAP RFC 7162 CONDSTORE
+	UIDValidity     INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE IF NOT EXISTS Mailboxes (
@@ -58,6 +89,7 @@ CREATE TABLE IF NOT EXISTS Mailboxes (
 	Name            TEXT,
 	DeletedName     TEXT,    -- Old label name before deletion
 	Subscribed      BOOLEAN,
+	Deleted         INTEGER, -- time mailbox was deleted (time.Now().Unix())
 
 	UNIQUE(Name)
 );
@@ -67,6 +99,8 @@ CREATE INDEX IF NOT EXISTS MailboxesName ON Mailboxes (Name);
 CREATE TABLE IF NOT EXISTS Labels (
 	LabelID     INTEGER PRIMARY KEY,
 	Label       TEXT,    -- NULL means the label is deleted
+	NextUID     INTEGER NOT NULL DEFAULT 1, -- of the label mailbox
+	UIDValidity INTEGER NOT NULL DEFAULT 1, -- of the label mailbox
 
 	UNIQUE(Label)
 );
@@ -78,6 +112,20 @@ CREATE TABLE IF NOT EXISTS Convos (
 	ConvoSummary TEXT     -- JSON encoding of mdb.ConvoSummary
 );
 
+-- ThreadMsgIDs maps the Message-IDs of messages, and of the messages
+-- they reference, to the conversation they are threaded into.
+-- MsgID is NULL for a referenced message that has not arrived.
+CREATE TABLE IF NOT EXISTS ThreadMsgIDs (
+	MessageID TEXT PRIMARY KEY, -- without angle brackets
+	MsgID     INTEGER,
+	ConvoID   INTEGER NOT NULL,
+
+	FOREIGN KEY(MsgID)   REFERENCES Msgs(MsgID),
+	FOREIGN KEY(ConvoID) REFERENCES Convos(ConvoID)
+);
+
+CREATE INDEX IF NOT EXISTS ThreadMsgIDsConvo ON ThreadMsgIDs (ConvoID);
+
 CREATE TABLE IF NOT EXISTS ConvoContacts (
 	ConvoID      INTEGER,
 	ContactID    INTEGER,
@@ -96,6 +144,20 @@ CREATE TABLE IF NOT EXISTS ConvoLabels (
        FOREIGN KEY(ConvoID) REFERENCES Convos(ConvoID)
 );
 
+-- LabelMsgs are the messages of the mailbox of a label, see label.go.
+CREATE TABLE IF NOT EXISTS LabelMsgs (
+	LabelID INTEGER NOT NULL,
+	MsgID   INTEGER NOT NULL,
+	UID     INTEGER NOT NULL, -- of the message in the label mailbox
+
+	PRIMARY KEY(LabelID, MsgID),
+	UNIQUE(LabelID, UID),
+	FOREIGN KEY(LabelID) REFERENCES Labels(LabelID),
+	FOREIGN KEY(MsgID)   REFERENCES Msgs(MsgID)
+);
+
+CREATE INDEX IF NOT EXISTS LabelMsgsMsgID ON LabelMsgs (MsgID);
+
 CREATE TABLE IF NOT EXISTS Msgs (
 	MsgID         INTEGER PRIMARY KEY,
 	StagingID     INTEGER, -- server staging ID, NULL for drafts
@@ -108,27 +170,60 @@ CREATE TABLE IF NOT EXISTS Msgs (
 
 	MailboxID  INTEGER,
 	UID        INTEGER, -- uint32, used by IMAP, only filled out by server
-	Flags      STRING,  -- JSON '{"flag": 1}' of IMAP flags
-	-- TODO: are Flags a replacement for labels?
+	SysFlags   INTEGER NOT NULL DEFAULT 0, -- bits of IMAP system flags, see flags.go
+	-- Keywords are in MsgKeywords. Databases from before SysFlags
+	-- have an unused Flags column, once JSON '{"flag": 1}'.
 
 	EncodedSize INTEGER,
+	SizeVerified INTEGER, -- time EncodedSize was checked, see VerifySizes
 
 	-- Date is created by the server with time.Now().Unix(), that is,
 	-- seconds since epoch.
 	-- For drafts, it is the last time the message was edited.
 	Date INTEGER NOT NULL,
 
+	-- Expunged messages are kept until GC. Their ModSequence is that
+	-- of the expunge, which QRESYNC reports as VANISHED.
 	Expunged INTEGER, -- time message was expunged (time.Now().Unix())
 
 	HdrsBlobID INTEGER,
 
 	HasUnsubscribe INTEGER, -- HTML contains "<a>.*[Uu]nsubscribe</a>""
 
+	VirusScan TEXT, -- NULL if not scanned, "clean", or the virus found
+
+	Skeleton BLOB, -- JSON email.Skeleton, NULL unless cleaved for fidelity
+
+	-- The SMTP envelope of a delivered message, NULL otherwise.
+	EnvelopeFrom TEXT, -- MAIL FROM, "" for the null sender of a bounce
+	EnvelopeTo   TEXT, -- JSON array of the RCPT TO addresses of the user
+
 	UNIQUE (StagingID), -- may be NULL
 	FOREIGN KEY(ConvoID) REFERENCES Convos(ConvoID),
 	FOREIGN KEY(MailboxID) REFERENCES Mailboxes(MailboxID)
 );
 
+-- MailboxKeywords registers the IMAP keywords of a mailbox,
+-- see RegisterKeywords.
+CREATE TABLE IF NOT EXISTS MailboxKeywords (
+	MailboxID INTEGER NOT NULL,
+	Keyword   TEXT NOT NULL COLLATE NOCASE, -- as first registered
+
+	PRIMARY KEY(MailboxID, Keyword),
+	FOREIGN KEY(MailboxID) REFERENCES Mailboxes(MailboxID)
+);
+
+CREATE TRIGGER IF NOT EXISTS MailboxKeywordsDelete
+AFTER DELETE ON Mailboxes
+FOR EACH ROW
+WHEN NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
+BEGIN
+	DELETE FROM MailboxKeywords WHERE MailboxID = old.MailboxID;
+END;
+
+-- MsgsMailboxUID finds the messages of a mailbox by UID.
+CREATE INDEX IF NOT EXISTS MsgsMailboxUID ON Msgs (MailboxID, UID);
+
 CREATE TABLE IF NOT EXISTS MsgAddresses (
 	MsgID     INTEGER NOT NULL,
 	AddressID INTEGER NOT NULL,
@@ -139,6 +234,31 @@ CREATE TABLE IF NOT EXISTS MsgAddresses (
 	FOREIGN KEY(AddressID) REFERENCES Addresses(AddressID)
 );
 
+-- MsgAddressesAddress finds the messages of a correspondent.
+CREATE INDEX IF NOT EXISTS MsgAddressesAddress ON MsgAddresses (AddressID, Role);
+
+-- MsgTags holds the tags of the addresses a message was delivered on,
+-- "tag" for mail to user+tag@example.com, or the tag of an alias.
+CREATE TABLE IF NOT EXISTS MsgTags (
+	MsgID INTEGER NOT NULL,
+	Tag   TEXT NOT NULL,
+
+	PRIMARY KEY(MsgID, Tag),
+	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+);
+
+CREATE INDEX IF NOT EXISTS MsgTagsTag ON MsgTags (Tag);
+
+-- MsgKeywords holds the IMAP keywords of messages, the flags that
+-- are not bits of Msgs.SysFlags.
+CREATE TABLE IF NOT EXISTS MsgKeywords (
+	MsgID   INTEGER NOT NULL,
+	Keyword TEXT NOT NULL,
+
+	PRIMARY KEY(MsgID, Keyword),
+	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+);
+
 -- MsgParts contains the cleaved multipart MIME components of messages.
 --
 -- The parts are "flattened", so the MIME tree, if desired, needs to be
@@ -158,11 +278,106 @@ CREATE TABLE IF NOT EXISTS MsgParts (
 	ContentTransferEncoding TEXT,
 	ContentTransferSize     INTEGER,
 	ContentTransferLines    INTEGER,
+	TransferAnomalies       TEXT, -- malformed transfer encoding tolerated when decoding
+	OriginalCharset         TEXT, -- charset text was received in, stored as UTF-8
+	IsSynthesized           BOOLEAN NOT NULL DEFAULT FALSE, -- generated text alternative, not received
 
 	PRIMARY KEY(MsgID, PartNum),
 	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
 );
 
+-- MsgPartsAttachmentType finds attachments by MIME type, see FindAttachments.
+CREATE INDEX IF NOT EXISTS MsgPartsAttachmentType ON MsgParts (ContentType) WHERE IsAttachment;
+
+-- MsgFetchCache holds IMAP FETCH responses computed when a message
+-- is inserted, so they are not rebuilt from the headers on every FETCH.
+-- A message without a row has its responses computed on demand.
+--
+-- Anything that rewrites the headers or parts of a message must
+-- delete its row. Rows with an old Version are ignored.
+CREATE TABLE IF NOT EXISTS MsgFetchCache (
+	MsgID         INTEGER PRIMARY KEY,
+	Version       INTEGER NOT NULL, -- imapformat.CacheVersion
+	Envelope      TEXT, -- imapformat.AppendEnvelope
+	BodyStructure TEXT, -- imapformat.AppendBodyStructure
+
+	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+);
+
+-- MsgHeaderFields holds the header fields mail clients fetch to list
+-- a mailbox, so fetching them does not read the header blob.
+-- Each message has a row for every one of spillbox.HeaderFieldKeys.
+-- Messages without rows have their header fields read from the blob.
+--
+-- Anything that rewrites the headers of a message must delete its rows.
+CREATE TABLE IF NOT EXISTS MsgHeaderFields (
+	MsgID INTEGER NOT NULL,
+	Key   TEXT NOT NULL, -- email.Key
+	Value BLOB,          -- first value of the field, NULL if missing
+
+	PRIMARY KEY(MsgID, Key),
+	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+) WITHOUT ROWID;
+
+-- MsgUnsubscribe holds the List-Unsubscribe header of messages that
+-- have one, RFC 2369. See spillbox.Unsubscribe.
+CREATE TABLE IF NOT EXISTS MsgUnsubscribe (
+	MsgID    INTEGER PRIMARY KEY,
+	Mailto   TEXT,    -- mailto: URI, NULL if none
+	URL      TEXT,    -- http: or https: URI, NULL if none
+	OneClick BOOLEAN, -- URL accepts an RFC 8058 one-click POST
+
+	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+);
+
+-- SpamTokens holds the per-user statistics of the spam classifier.
+CREATE TABLE IF NOT EXISTS SpamTokens (
+	Token TEXT PRIMARY KEY,
+	Spam  INTEGER NOT NULL, -- trained spam messages containing Token
+	Ham   INTEGER NOT NULL  -- trained ham messages containing Token
+);
+
+-- SpamTraining records the messages the spam classifier has learned.
+-- Messages are keyed by RawHash so copies are only learned once,
+-- and a message moved back out of Spam can be unlearned.
+CREATE TABLE IF NOT EXISTS SpamTraining (
+	RawHash TEXT PRIMARY KEY,
+	IsSpam  BOOLEAN NOT NULL
+);
+
+-- Invites holds the calendar events found in text/calendar parts.
+CREATE TABLE IF NOT EXISTS Invites (
+	MsgID         INTEGER NOT NULL,
+	PartNum       INTEGER NOT NULL,
+	UID           TEXT NOT NULL,  -- iCalendar UID
+	Method        TEXT,           -- iCalendar METHOD: REQUEST, CANCEL, ...
+	Sequence      INTEGER,
+	Summary       TEXT,
+	Location      TEXT,
+	Organizer     TEXT,
+	OrganizerName TEXT,
+	StartTime     INTEGER,        -- unix seconds
+	EndTime       INTEGER,        -- unix seconds
+	AllDay        BOOLEAN,
+
+	PRIMARY KEY(MsgID, PartNum, UID),
+	FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+);
+
+CREATE INDEX IF NOT EXISTS InvitesUID ON Invites (UID);
+
+-- ContactCards holds the vCard form of contacts, for CardDAV sync.
+-- A contact gets a row when it is first exported, or when the user
+-- imports a vCard for it. vCards in received mail are not stored.
+CREATE TABLE IF NOT EXISTS ContactCards (
+	ContactID INTEGER PRIMARY KEY,
+	UID       TEXT NOT NULL UNIQUE, -- vCard UID
+	Card      TEXT,                 -- last vCard imported, keeps properties Addresses cannot
+	Imported  BOOLEAN NOT NULL,     -- added to the address book by the user
+
+	FOREIGN KEY(ContactID) REFERENCES Contacts(ContactID)
+);
+
 -- TODO remove
 INSERT OR IGNORE INTO Contacts (ContactID, Hidden, Robot) VALUES (1, FALSE, FALSE);
 INSERT OR IGNORE INTO Labels (LabelID, Label) VALUES (1, 'Personal Mail');
@@ -172,16 +387,295 @@ INSERT OR IGNORE INTO Labels (LabelID, Label) VALUES (3, 'Spam and Trash');
 CREATE TRIGGER IF NOT EXISTS MailboxRenameUIDValidity
 AFTER UPDATE OF Name ON Mailboxes
 FOR EACH ROW
+WHEN new.Name IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
 BEGIN
+	INSERT OR IGNORE INTO MailboxSequencing (Name, NextModSequence)
+		VALUES (new.Name, 1);
 	UPDATE Mailboxes
-		SET UIDValidity = (SELECT max(UIDValidity) FROM Mailboxes) + 1
+		SET UIDValidity = max(
+			(SELECT max(UIDValidity) FROM Mailboxes),
+			(SELECT UIDValidity FROM MailboxSequencing WHERE Name = new.Name)
+		) + 1
 		WHERE MailboxID = new.MailboxID;
+	UPDATE MailboxSequencing
+		SET UIDValidity = (SELECT UIDValidity FROM Mailboxes WHERE MailboxID = new.MailboxID)
+		WHERE Name = new.Name;
 END;
 
+-- MailboxCounts caches the numbers IMAP STATUS reports for a mailbox,
+-- so they are not counted from Msgs on every STATUS. The triggers
+-- below keep a row up to date as messages are inserted, flagged,
+-- moved and expunged. Bit 1 of SysFlags is FlagSeen.
+--
+-- SeqVersion changes whenever a message joins or leaves the
+-- mailbox, which renumbers its IMAP sequence numbers. imapdb keeps
+-- the UIDs of a mailbox in memory, in sequence number order, and
+-- reloads them when SeqVersion changes. A row is created with a
+-- random SeqVersion, so a reused MailboxID does not match the UIDs
+-- kept for an old mailbox.
+--
+-- A mailbox without a row has its counts computed on demand.
+-- Mailboxes created before the table get a row, counted from Msgs,
+-- the first time one of their messages changes.
+CREATE TABLE IF NOT EXISTS MailboxCounts (
+	MailboxID          INTEGER PRIMARY KEY,
+	NumMessages        INTEGER NOT NULL DEFAULT 0, -- State = MsgReady
+	NumUnseen          INTEGER NOT NULL DEFAULT 0, -- State = MsgReady without \Seen
+	HighestModSequence INTEGER NOT NULL DEFAULT 0, -- never decreases
+	SeqVersion         INTEGER NOT NULL DEFAULT 0,
+
+	FOREIGN KEY(MailboxID) REFERENCES Mailboxes(MailboxID)
+);
+
+CREATE TRIGGER IF NOT EXISTS MailboxCountsCreate
+AFTER INSERT ON Mailboxes
+FOR EACH ROW
+WHEN NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
+BEGIN
+	INSERT OR IGNORE INTO MailboxCounts (MailboxID, SeqVersion)
+		VALUES (new.MailboxID, random());
+END;
+
+CREATE TRIGGER IF NOT EXISTS MailboxCountsDelete
+AFTER DELETE ON Mailboxes
+FOR EACH ROW
+WHEN NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
+BEGIN
+	DELETE FROM MailboxCounts WHERE MailboxID = old.MailboxID;
+END;
+
+CREATE TRIGGER IF NOT EXISTS MailboxCountsMsgInsert
+AFTER INSERT ON Msgs
+FOR EACH ROW
+WHEN new.MailboxID IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
+BEGIN
+	UPDATE MailboxCounts SET
+		NumMessages = NumMessages + (new.State IS 1),
+		NumUnseen = NumUnseen + (new.State IS 1 AND (new.SysFlags & 1) = 0),
+		HighestModSequence = max(HighestModSequence, coalesce(new.ModSequence, 0)),
+		SeqVersion = SeqVersion + (new.State IS 1)
+		WHERE MailboxID = new.MailboxID;
+	INSERT INTO MailboxCounts (MailboxID, NumMessages, NumUnseen, HighestModSequence, SeqVersion)
+		SELECT new.MailboxID,
+			(SELECT count(*) FROM Msgs
+				WHERE MailboxID = new.MailboxID AND State = 1),
+			(SELECT count(*) FROM Msgs
+				WHERE MailboxID = new.MailboxID AND State = 1
+				AND (SysFlags & 1) = 0),
+			(SELECT coalesce(max(ModSequence), 0) FROM Msgs
+				WHERE MailboxID = new.MailboxID),
+			random()
+		WHERE NOT EXISTS (SELECT 1 FROM MailboxCounts WHERE MailboxID = new.MailboxID);
+END;
+
+CREATE TRIGGER IF NOT EXISTS MailboxCountsMsgUpdate
+AFTER UPDATE OF MailboxID, UID, State, SysFlags, ModSequence ON Msgs
+FOR EACH ROW
+WHEN NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
+BEGIN
+	UPDATE MailboxCounts SET
+		NumMessages = NumMessages - (old.State IS 1),
+		NumUnseen = NumUnseen - (old.State IS 1 AND (old.SysFlags & 1) = 0),
+		SeqVersion = SeqVersion + (old.State IS 1 AND (new.State IS NOT 1
+			OR new.MailboxID IS NOT old.MailboxID OR new.UID IS NOT old.UID))
+		WHERE MailboxID = old.MailboxID;
+	UPDATE MailboxCounts SET
+		NumMessages = NumMessages + (new.State IS 1),
+		NumUnseen = NumUnseen + (new.State IS 1 AND (new.SysFlags & 1) = 0),
+		HighestModSequence = max(HighestModSequence, coalesce(new.ModSequence, 0)),
+		SeqVersion = SeqVersion + (new.State IS 1 AND (old.State IS NOT 1
+			OR new.MailboxID IS NOT old.MailboxID OR new.UID IS NOT old.UID))
+		WHERE MailboxID = new.MailboxID;
+	INSERT INTO MailboxCounts (MailboxID, NumMessages, NumUnseen, HighestModSequence, SeqVersion)
+		SELECT new.MailboxID,
+			(SELECT count(*) FROM Msgs
+				WHERE MailboxID = new.MailboxID AND State = 1),
+			(SELECT count(*) FROM Msgs
+				WHERE MailboxID = new.MailboxID AND State = 1
+				AND (SysFlags & 1) = 0),
+			(SELECT coalesce(max(ModSequence), 0) FROM Msgs
+				WHERE MailboxID = new.MailboxID),
+			random()
+		WHERE new.MailboxID IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM MailboxCounts WHERE MailboxID = new.MailboxID);
+END;
+
+CREATE TRIGGER IF NOT EXISTS MailboxCountsMsgDelete
+AFTER DELETE ON Msgs
+FOR EACH ROW
+WHEN NOT EXISTS (SELECT 1 FROM ReplState WHERE Applying)
+BEGIN
+	UPDATE MailboxCounts SET
+		NumMessages = NumMessages - (old.State IS 1),
+		NumUnseen = NumUnseen - (old.State IS 1 AND (old.SysFlags & 1) = 0),
+		SeqVersion = SeqVersion + (old.State IS 1)
+		WHERE MailboxID = old.MailboxID;
+END;
+
+-- ReplLog records the rows changed while replication is on.
+-- See replicate.go. AUTOINCREMENT keeps Seq growing after the
+-- log is trimmed.
+CREATE TABLE IF NOT EXISTS ReplLog (
+	Seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+	TableName TEXT NOT NULL,   -- "main.Msgs", "blobs.Blobs", ...
+	RowID     INTEGER NOT NULL
+);
+
+-- ReplState is the position of a standby in the primary's ReplLog.
+-- Applying is set while a standby applies events, which turns off
+-- the triggers above: the rows they keep are replicated.
+CREATE TABLE IF NOT EXISTS ReplState (
+	ID       INTEGER PRIMARY KEY CHECK (ID = 1),
+	Applied  INTEGER NOT NULL, -- last applied ReplLog.Seq
+	Applying BOOLEAN NOT NULL DEFAULT FALSE
+);
+
 CREATE TABLE IF NOT EXISTS blobs.Blobs (
 	BlobID  INTEGER PRIMARY KEY,
 	SHA256  TEXT,    -- hash of the exact bytes stored in Content
 	Deleted INTEGER, -- tombstone, unix seconds at blob garbage collection
 	Content BLOB
 );
+
+-- SealedBlobs lists the Blobs whose Content is encrypted.
+CREATE TABLE IF NOT EXISTS blobs.SealedBlobs (
+	BlobID INTEGER PRIMARY KEY
+);
+
+-- RemoteBlobs lists the Blobs whose Content is in the object store.
+-- Their Content is empty.
+CREATE TABLE IF NOT EXISTS blobs.RemoteBlobs (
+	BlobID    INTEGER PRIMARY KEY,
+	ObjectKey TEXT NOT NULL,    -- "userID/sha256"
+	Size      INTEGER NOT NULL  -- bytes of stored content
+);
+
+CREATE INDEX IF NOT EXISTS blobs.RemoteBlobsObjectKey ON RemoteBlobs (ObjectKey);
+
+-- DeletedObjects queues object store keys to delete.
+CREATE TABLE IF NOT EXISTS blobs.DeletedObjects (
+	ObjectKey TEXT PRIMARY KEY
+);
+
+-- BackupPins holds a row for each running Backup.
+-- No queued objects are deleted while one has not expired.
+CREATE TABLE IF NOT EXISTS blobs.BackupPins (
+	PinID   INTEGER PRIMARY KEY,
+	Expires INTEGER NOT NULL -- unix seconds
+);
 `
+
+// migrations make the changes to the tables of createSQL that it
+// cannot make to an existing mailbox. Changing a table in createSQL
+// needs a step here. See package migrate.
+var migrations = []migrate.Step{
+	{
+		Version: 1,
+		Name:    "MailboxSequencing.UIDValidity",
+		Fn:      migrate.AddColumns("MailboxSequencing", "UIDValidity INTEGER NOT NULL DEFAULT 0"),
+		SQL: `UPDATE MailboxSequencing SET UIDValidity = coalesce(
+			(SELECT max(UIDValidity) FROM Mailboxes WHERE Name = MailboxSequencing.Name), 0);`,
+	},
+	{
+		Version: 2,
+		Name:    "Mailboxes.Deleted",
+		Fn:      migrate.AddColumns("Mailboxes", "Deleted INTEGER"),
+	},
+	{
+		Version: 3,
+		Name:    "MailboxRenameUIDValidity uses MailboxSequencing",
+		SQL:     "DROP TRIGGER IF EXISTS MailboxRenameUIDValidity;", // recreated by createSQL
+	},
+	{
+		Version: 4,
+		Name:    "Msgs.SizeVerified",
+		Fn:      migrate.AddColumns("Msgs", "SizeVerified INTEGER"),
+	},
+	{
+		Version: 5,
+		Name:    "Msgs.VirusScan",
+		Fn:      migrate.AddColumns("Msgs", "VirusScan TEXT"),
+	},
+	{
+		Version: 6,
+		Name:    "Msgs.Skeleton",
+		Fn:      migrate.AddColumns("Msgs", "Skeleton BLOB"),
+	},
+	{
+		Version: 7,
+		Name:    "Labels.NextUID, Labels.UIDValidity",
+		Fn: migrate.AddColumns("Labels",
+			"NextUID INTEGER NOT NULL DEFAULT 1",
+			"UIDValidity INTEGER NOT NULL DEFAULT 1"),
+	},
+	{
+		Version: 8,
+		Name:    "MsgParts.TransferAnomalies",
+		Fn:      migrate.AddColumns("MsgParts", "TransferAnomalies TEXT"),
+	},
+	{
+		Version: 9,
+		Name:    "MsgParts.OriginalCharset",
+		Fn:      migrate.AddColumns("MsgParts", "OriginalCharset TEXT"),
+	},
+	{
+		Version: 10,
+		Name:    "MsgParts.IsSynthesized",
+		Fn:      migrate.AddColumns("MsgParts", "IsSynthesized BOOLEAN NOT NULL DEFAULT FALSE"),
+	},
+	{
+		Version: 11,
+		Name:    "MailboxCounts.SeqVersion",
+		Fn:      migrate.AddColumns("MailboxCounts", "SeqVersion INTEGER NOT NULL DEFAULT 0"),
+		SQL: `DROP TRIGGER IF EXISTS MailboxCountsCreate; -- recreated by createSQL
+			DROP TRIGGER IF EXISTS MailboxCountsMsgInsert;
+			DROP TRIGGER IF EXISTS MailboxCountsMsgUpdate;
+			DROP TRIGGER IF EXISTS MailboxCountsMsgDelete;`,
+	},
+	{
+		Version: 12,
+		Name:    "Msgs.SysFlags, MsgKeywords",
+		Fn:      migrate.AddColumns("Msgs", "SysFlags INTEGER NOT NULL DEFAULT 0"),
+		SQL: `DROP TRIGGER IF EXISTS MailboxCountsMsgInsert; -- recreated by createSQL
+			DROP TRIGGER IF EXISTS MailboxCountsMsgUpdate;
+			DROP TRIGGER IF EXISTS MailboxCountsMsgDelete;
+			CREATE TABLE IF NOT EXISTS MsgKeywords (
+				MsgID   INTEGER NOT NULL,
+				Keyword TEXT NOT NULL,
+				PRIMARY KEY(MsgID, Keyword),
+				FOREIGN KEY(MsgID) REFERENCES Msgs(MsgID)
+			);
+			UPDATE Msgs SET SysFlags = (SELECT coalesce(sum(CASE key
+				WHEN '\Seen' THEN 1
+				WHEN '\Answered' THEN 2
+				WHEN '\Flagged' THEN 4
+				WHEN '\Deleted' THEN 8
+				WHEN '\Draft' THEN 16
+				WHEN '\Recent' THEN 32
+				ELSE 0 END), 0) FROM json_each(Msgs.Flags))
+				WHERE Flags IS NOT NULL;
+			INSERT OR IGNORE INTO MsgKeywords (MsgID, Keyword)
+				SELECT MsgID, key FROM Msgs, json_each(Msgs.Flags)
+				WHERE key NOT IN ('\Seen', '\Answered', '\Flagged', '\Deleted', '\Draft', '\Recent');
+			UPDATE Msgs SET Flags = NULL;`,
+	},
+	{
+		Version: 13,
+		Name:    "Msgs.EnvelopeFrom, Msgs.EnvelopeTo",
+		Fn:      migrate.AddColumns("Msgs", "EnvelopeFrom TEXT", "EnvelopeTo TEXT"),
+	},
+	{
+		Version: 14,
+		Name:    "ReplState.Applying",
+		Fn:      migrate.AddColumns("ReplState", "Applying BOOLEAN NOT NULL DEFAULT FALSE"),
+		SQL: `DROP TRIGGER IF EXISTS MailboxKeywordsDelete; -- recreated by createSQL
+			DROP TRIGGER IF EXISTS MailboxRenameUIDValidity;
+			DROP TRIGGER IF EXISTS MailboxCountsCreate;
+			DROP TRIGGER IF EXISTS MailboxCountsDelete;
+			DROP TRIGGER IF EXISTS MailboxCountsMsgInsert;
+			DROP TRIGGER IF EXISTS MailboxCountsMsgUpdate;
+			DROP TRIGGER IF EXISTS MailboxCountsMsgDelete;`,
+	},
+}
@@ -0,0 +1,55 @@
+package spillbox
+
+import (
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// insertTags records the address tags a message was received on.
+func insertTags(conn *sqlite.Conn, msgID email.MsgID, tags []string) error {
+	stmt := conn.Prep(`INSERT OR IGNORE INTO MsgTags (MsgID, Tag) VALUES ($msgID, $tag);`)
+	for _, tag := range tags {
+		stmt.Reset()
+		stmt.SetInt64("$msgID", int64(msgID))
+		stmt.SetText("$tag", tag)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindMailbox reports the ID of the mailbox called name,
+// ignoring case, or 0 if there is none.
+func FindMailbox(conn *sqlite.Conn, name string) (mailboxID int64, err error) {
+	stmt := conn.Prep(`SELECT MailboxID FROM Mailboxes
+		WHERE Name = $name COLLATE NOCASE
+		ORDER BY MailboxID LIMIT 1;`)
+	stmt.SetText("$name", name)
+	if hasNext, err := stmt.Step(); err != nil {
+		return 0, err
+	} else if !hasNext {
+		return 0, nil
+	}
+	mailboxID = stmt.GetInt64("MailboxID")
+	stmt.Reset()
+	return mailboxID, nil
+}
+
+// fileTags files new mail received on a tagged address in the
+// mailbox named after the tag, if the user has created one.
+// Names are matched without regard to case, so mail sent to
+// user+receipts@example.com is filed in "Receipts".
+func fileTags(conn *sqlite.Conn, msg *email.Msg) error {
+	for _, tag := range msg.Tags {
+		mailboxID, err := FindMailbox(conn, tag)
+		if err != nil {
+			return err
+		}
+		if mailboxID != 0 {
+			msg.MailboxID = mailboxID
+			return nil
+		}
+	}
+	return nil
+}
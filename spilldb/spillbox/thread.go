@@ -0,0 +1,281 @@
+package spillbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// Messages are threaded into conversations by their References
+// and In-Reply-To headers, following the message ID linking of
+// https://www.jwz.org/doc/threading.html.
+//
+// Every Message-ID seen, either of a message or mentioned in the
+// references of one, is recorded in ThreadMsgIDs with the
+// conversation it belongs to. A Message-ID mentioned before its
+// message arrives holds the place of the missing parent, so the
+// parent joins the conversation of its replies. A message that
+// links conversations merges them, up to maxThreadMerge of them,
+// and only through the IDs of messages the user has, see
+// threadConvos. Only the nearest maxThreadRefs references of a
+// message are used.
+//
+// Unlike the full algorithm no parent/child tree is stored,
+// a conversation is the set of messages connected by references,
+// and messages are not grouped by subject.
+
+// maxThreadMerge is the number of conversations a message may join.
+// A message linking more joins the first of them and merges in the
+// next ones, the others are left alone.
+const maxThreadMerge = 3
+
+// maxThreadRefs is the number of references of a message threaded.
+const maxThreadRefs = 100
+
+// threadRefs returns the Message-ID of a message and the message
+// IDs it refers to, oldest ancestor first.
+func threadRefs(hdr *email.Header) (id string, refs []string) {
+	if ids := msgIDs(hdr.Get("Message-ID")); len(ids) > 0 {
+		id = ids[0]
+	}
+	refs = msgIDs(hdr.Get("References"))
+	// In-Reply-To is only used if it is missing from References.
+	if parents := msgIDs(hdr.Get("In-Reply-To")); len(parents) > 0 {
+		parent := parents[0]
+		if len(refs) == 0 || refs[len(refs)-1] != parent {
+			refs = append(refs, parent)
+		}
+	}
+
+	seen := map[string]bool{id: true}
+	uniq := refs[:0]
+	for _, ref := range refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		uniq = append(uniq, ref)
+	}
+	if len(uniq) > maxThreadRefs {
+		uniq = uniq[len(uniq)-maxThreadRefs:]
+	}
+	return id, uniq
+}
+
+// msgIDs returns the <message IDs> in a header value,
+// without angle brackets. Any other text is ignored.
+func msgIDs(v []byte) (ids []string) {
+	for {
+		i := bytes.IndexByte(v, '<')
+		if i == -1 {
+			return ids
+		}
+		v = v[i+1:]
+		j := bytes.IndexByte(v, '>')
+		if j == -1 {
+			return ids
+		}
+		id := strings.TrimSpace(string(v[:j]))
+		v = v[j+1:]
+		if id != "" && !strings.ContainsAny(id, "< \t\r\n") {
+			ids = append(ids, id)
+		}
+	}
+}
+
+// threadConvos reports the conversations a message with Message-ID
+// id and references refs is threaded into, in the order they are
+// first found.
+//
+// Anyone can send a message, so only IDs the user already has count:
+// references to messages in the box, and the ID of the message
+// itself if a reply in the box is waiting for it. A reference to a
+// message the user does not have, or a Message-ID copied from
+// another message, joins nothing.
+func threadConvos(conn *sqlite.Conn, id string, refs []string) (convos []ConvoID, err error) {
+	add := func(stmt *sqlite.Stmt, id string) error {
+		stmt.SetText("$id", id)
+		hasNext, err := stmt.Step()
+		if err != nil || !hasNext {
+			return err
+		}
+		convoID := ConvoID(stmt.GetInt64("ConvoID"))
+		stmt.Reset()
+		for _, c := range convos {
+			if c == convoID {
+				return nil
+			}
+		}
+		convos = append(convos, convoID)
+		return nil
+	}
+
+	stmt := conn.Prep("SELECT ConvoID FROM ThreadMsgIDs WHERE MessageID = $id AND MsgID IS NOT NULL;")
+	for _, ref := range refs {
+		stmt.Reset()
+		if err := add(stmt, ref); err != nil {
+			return nil, err
+		}
+	}
+	if id != "" {
+		stmt := conn.Prep("SELECT ConvoID FROM ThreadMsgIDs WHERE MessageID = $id AND MsgID IS NULL;")
+		if err := add(stmt, id); err != nil {
+			return nil, err
+		}
+	}
+	return convos, nil
+}
+
+// indexThread records the Message-ID and references of msgID as
+// belonging to convoID. A reference recorded earlier keeps its
+// conversation, the caller merges conversations before indexing.
+func indexThread(conn *sqlite.Conn, msgID email.MsgID, convoID ConvoID, id string, refs []string) error {
+	if id != "" {
+		stmt := conn.Prep(`INSERT OR IGNORE INTO ThreadMsgIDs (MessageID, MsgID, ConvoID)
+			VALUES ($id, $msgID, $convoID);`)
+		stmt.SetText("$id", id)
+		stmt.SetInt64("$msgID", int64(msgID))
+		stmt.SetInt64("$convoID", int64(convoID))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		// Fill in a placeholder left by an earlier reply.
+		stmt = conn.Prep(`UPDATE ThreadMsgIDs SET MsgID = $msgID
+			WHERE MessageID = $id AND MsgID IS NULL;`)
+		stmt.SetText("$id", id)
+		stmt.SetInt64("$msgID", int64(msgID))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+
+	stmt := conn.Prep(`INSERT OR IGNORE INTO ThreadMsgIDs (MessageID, ConvoID)
+		VALUES ($id, $convoID);`)
+	for _, ref := range refs {
+		stmt.Reset()
+		stmt.SetText("$id", ref)
+		stmt.SetInt64("$convoID", int64(convoID))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeConvos moves the messages, contacts, and labels of the
+// src conversations into dst and deletes the src conversations.
+func mergeConvos(conn *sqlite.Conn, dst ConvoID, src []ConvoID) error {
+	summary, err := loadConvoSummary(conn, dst)
+	if err != nil {
+		return err
+	}
+	for _, convoID := range src {
+		srcSummary, err := loadConvoSummary(conn, convoID)
+		if err != nil {
+			return err
+		}
+		summary.addContacts(srcSummary.Contacts)
+
+		for _, query := range []string{
+			"UPDATE Msgs SET ConvoID = $dst WHERE ConvoID = $src;",
+			"UPDATE ThreadMsgIDs SET ConvoID = $dst WHERE ConvoID = $src;",
+			`INSERT OR IGNORE INTO ConvoContacts (ConvoID, ContactID)
+				SELECT $dst, ContactID FROM ConvoContacts WHERE ConvoID = $src;`,
+			`INSERT OR IGNORE INTO ConvoLabels (LabelID, ConvoID)
+				SELECT LabelID, $dst FROM ConvoLabels WHERE ConvoID = $src;`,
+		} {
+			stmt := conn.Prep(query)
+			stmt.SetInt64("$dst", int64(dst))
+			stmt.SetInt64("$src", int64(convoID))
+			if _, err := stmt.Step(); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"ConvoContacts", "ConvoLabels", "Convos"} {
+			stmt := conn.Prep("DELETE FROM " + table + " WHERE ConvoID = $src;")
+			stmt.SetInt64("$src", int64(convoID))
+			if _, err := stmt.Step(); err != nil {
+				return err
+			}
+		}
+	}
+	return saveConvoSummary(conn, dst, summary)
+}
+
+// joinConvo adds the contacts of msgID to an existing conversation.
+func joinConvo(conn *sqlite.Conn, convoID ConvoID, msgID email.MsgID) error {
+	contacts, err := msgContacts(conn, msgID)
+	if err != nil {
+		return err
+	}
+	summary, err := loadConvoSummary(conn, convoID)
+	if err != nil {
+		return err
+	}
+	if summary.addContacts(contacts) {
+		if err := saveConvoSummary(conn, convoID, summary); err != nil {
+			return err
+		}
+	}
+
+	stmt := conn.Prep(`INSERT OR IGNORE INTO ConvoContacts (ConvoID, ContactID)
+			SELECT DISTINCT $convoID, ContactID FROM Addresses
+			INNER JOIN MsgAddresses ON Addresses.AddressID = MsgAddresses.AddressID
+			WHERE MsgID = $msgID AND ContactID <> 1;`)
+	stmt.SetInt64("$convoID", int64(convoID))
+	stmt.SetInt64("$msgID", int64(msgID))
+	_, err = stmt.Step()
+	return err
+}
+
+// addContacts adds the contacts not already in the summary.
+// It reports whether any were added.
+func (s *ConvoSummary) addContacts(contacts []Contact) (added bool) {
+	for _, c := range contacts {
+		found := false
+		for _, have := range s.Contacts {
+			if have.ContactID == c.ContactID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.Contacts = append(s.Contacts, c)
+			added = true
+		}
+	}
+	return added
+}
+
+func loadConvoSummary(conn *sqlite.Conn, convoID ConvoID) (summary ConvoSummary, err error) {
+	stmt := conn.Prep("SELECT ConvoSummary FROM Convos WHERE ConvoID = $convoID;")
+	stmt.SetInt64("$convoID", int64(convoID))
+	if hasNext, err := stmt.Step(); err != nil {
+		return summary, err
+	} else if !hasNext {
+		return summary, nil
+	}
+	defer stmt.Reset()
+	if stmt.GetLen("ConvoSummary") == 0 {
+		return summary, nil
+	}
+	if err := json.NewDecoder(stmt.GetReader("ConvoSummary")).Decode(&summary); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+func saveConvoSummary(conn *sqlite.Conn, convoID ConvoID, summary ConvoSummary) error {
+	summaryBytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	stmt := conn.Prep("UPDATE Convos SET ConvoSummary = $summary WHERE ConvoID = $convoID;")
+	stmt.SetBytes("$summary", summaryBytes)
+	stmt.SetInt64("$convoID", int64(convoID))
+	_, err = stmt.Step()
+	return err
+}
@@ -0,0 +1,132 @@
+package spillbox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/email"
+)
+
+// threadMsg is a message with a Message-ID and References.
+func threadMsg(id string, refs ...string) string {
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "From: a@example.com\nTo: user@spilled.ink\nSubject: thread %s\nMessage-ID: <%s>\n", id, id)
+	if len(refs) > 0 {
+		fmt.Fprintf(buf, "References: <%s>\n", strings.Join(refs, "> <"))
+		fmt.Fprintf(buf, "In-Reply-To: <%s>\n", refs[len(refs)-1])
+	}
+	fmt.Fprintf(buf, "\nMessage %s.\n", id)
+	return buf.String()
+}
+
+func convoOf(t *testing.T, box *Box, msgID email.MsgID) ConvoID {
+	t.Helper()
+	conn := box.PoolRO.Get(nil)
+	defer box.PoolRO.Put(conn)
+	stmt := conn.Prep("SELECT ConvoID FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	convoID, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convoID == 0 {
+		t.Fatalf("message %d has no conversation", msgID)
+	}
+	return ConvoID(convoID)
+}
+
+func TestThreadReplyChain(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+
+	a := insertTestMsg(t, box, threadMsg("a@example.com"))
+	b := insertTestMsg(t, box, threadMsg("b@example.com", "a@example.com"))
+	c := insertTestMsg(t, box, threadMsg("c@example.com", "a@example.com", "b@example.com"))
+	other := insertTestMsg(t, box, threadMsg("other@example.com"))
+
+	convoID := convoOf(t, box, a.MsgID)
+	for _, msg := range []*email.Msg{b, c} {
+		if got := convoOf(t, box, msg.MsgID); got != convoID {
+			t.Errorf("message %d in conversation %d, want %d", msg.MsgID, got, convoID)
+		}
+	}
+	if convoOf(t, box, other.MsgID) == convoID {
+		t.Error("unrelated message joined the conversation")
+	}
+}
+
+func TestThreadOutOfOrder(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+
+	// The last reply arrives first, then its ancestors.
+	c := insertTestMsg(t, box, threadMsg("c@example.com", "a@example.com", "b@example.com"))
+	a := insertTestMsg(t, box, threadMsg("a@example.com"))
+	b := insertTestMsg(t, box, threadMsg("b@example.com", "a@example.com"))
+
+	convoID := convoOf(t, box, c.MsgID)
+	for _, msg := range []*email.Msg{a, b} {
+		if got := convoOf(t, box, msg.MsgID); got != convoID {
+			t.Errorf("message %d in conversation %d, want %d", msg.MsgID, got, convoID)
+		}
+	}
+	if n := dumpRows(t, box, "SELECT MessageID FROM ThreadMsgIDs WHERE MsgID IS NULL;"); n != "" {
+		t.Errorf("placeholders left after the parents arrived:\n%s", n)
+	}
+}
+
+func TestThreadBogusReference(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+
+	a := insertTestMsg(t, box, threadMsg("a@example.com"))
+	b := insertTestMsg(t, box, threadMsg("b@example.com"))
+
+	// A reference to a message the user does not have
+	// starts a conversation of its own.
+	bogus := insertTestMsg(t, box, threadMsg("bogus@example.com", "missing@example.com"))
+	if got := convoOf(t, box, bogus.MsgID); got == convoOf(t, box, a.MsgID) || got == convoOf(t, box, b.MsgID) {
+		t.Error("message with a bogus reference joined another conversation")
+	}
+
+	// Another message mentioning the same missing message is not
+	// threaded with the first through it, the user has neither.
+	sibling := insertTestMsg(t, box, threadMsg("sibling@example.com", "missing@example.com"))
+	if convoOf(t, box, sibling.MsgID) == convoOf(t, box, bogus.MsgID) {
+		t.Error("messages threaded through a message the user does not have")
+	}
+
+	// A copied Message-ID does not join the conversation of the original.
+	forged := insertTestMsg(t, box, strings.Replace(threadMsg("a@example.com"), "Subject: thread", "Subject: forged", 1))
+	if convoOf(t, box, forged.MsgID) == convoOf(t, box, a.MsgID) {
+		t.Error("message with a copied Message-ID joined the conversation")
+	}
+}
+
+func TestThreadMergeLimit(t *testing.T) {
+	box, cleanup := newTestBox(t)
+	defer cleanup()
+
+	var ids []string
+	var msgs []*email.Msg
+	for i := 0; i < maxThreadMerge+3; i++ {
+		id := fmt.Sprintf("root%d@example.com", i)
+		ids = append(ids, id)
+		msgs = append(msgs, insertTestMsg(t, box, threadMsg(id)))
+	}
+	// One message refers to every conversation.
+	all := insertTestMsg(t, box, threadMsg("all@example.com", ids...))
+
+	convoID := convoOf(t, box, all.MsgID)
+	merged := 0
+	for _, msg := range msgs {
+		if convoOf(t, box, msg.MsgID) == convoID {
+			merged++
+		}
+	}
+	if merged != maxThreadMerge {
+		t.Errorf("message merged %d conversations, want %d", merged, maxThreadMerge)
+	}
+}
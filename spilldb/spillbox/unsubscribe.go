@@ -0,0 +1,286 @@
+package spillbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// Unsubscribe is the List-Unsubscribe header of a message, RFC 2369.
+// Zero fields are missing from the header.
+type Unsubscribe struct {
+	Mailto   string // "mailto:list-request@example.com?subject=unsubscribe"
+	URL      string // "https://example.com/unsubscribe?id=1234"
+	OneClick bool   // URL can be POSTed to with RFC 8058 one-click
+}
+
+func (u Unsubscribe) IsZero() bool { return u == Unsubscribe{} }
+
+// ParseUnsubscribe parses the List-Unsubscribe and
+// List-Unsubscribe-Post header fields.
+//
+// Only the first mailto and the first http or https URI are kept.
+// OneClick is only set for an https URI, as RFC 8058 requires.
+func ParseUnsubscribe(hdr *email.Header) (u Unsubscribe) {
+	v := hdr.Get("List-Unsubscribe")
+	for len(v) > 0 {
+		i := bytes.IndexByte(v, '<')
+		if i < 0 {
+			break
+		}
+		v = v[i+1:]
+		j := bytes.IndexByte(v, '>')
+		if j < 0 {
+			break
+		}
+		// Whitespace in the angle brackets is ignored, RFC 2369.
+		uri := strings.Join(strings.Fields(string(v[:j])), "")
+		v = v[j+1:]
+
+		scheme := uri
+		if i := strings.IndexByte(uri, ':'); i > 0 {
+			scheme = strings.ToLower(uri[:i])
+		}
+		switch scheme {
+		case "mailto":
+			if u.Mailto == "" {
+				u.Mailto = uri
+			}
+		case "http", "https":
+			if u.URL == "" {
+				u.URL = uri
+			}
+		}
+	}
+	post := strings.TrimSpace(string(hdr.Get("List-Unsubscribe-Post")))
+	if strings.EqualFold(post, "List-Unsubscribe=One-Click") && strings.HasPrefix(strings.ToLower(u.URL), "https:") {
+		u.OneClick = true
+	}
+	return u
+}
+
+func insertUnsubscribe(conn *sqlite.Conn, msg *email.Msg) error {
+	u := ParseUnsubscribe(&msg.Headers)
+	if u.IsZero() {
+		return nil
+	}
+	stmt := conn.Prep(`INSERT INTO MsgUnsubscribe (MsgID, Mailto, URL, OneClick)
+		VALUES ($msgID, $mailto, $url, $oneClick);`)
+	stmt.SetInt64("$msgID", int64(msg.MsgID))
+	if u.Mailto != "" {
+		stmt.SetText("$mailto", u.Mailto)
+	} else {
+		stmt.SetNull("$mailto")
+	}
+	if u.URL != "" {
+		stmt.SetText("$url", u.URL)
+	} else {
+		stmt.SetNull("$url")
+	}
+	stmt.SetBool("$oneClick", u.OneClick)
+	_, err := stmt.Step()
+	return err
+}
+
+// LoadUnsubscribe loads the List-Unsubscribe header of a message.
+// It reports a zero Unsubscribe if the message does not have one.
+func LoadUnsubscribe(conn *sqlite.Conn, msgID email.MsgID) (u Unsubscribe, err error) {
+	stmt := conn.Prep(`SELECT Mailto, URL, OneClick FROM MsgUnsubscribe
+		WHERE MsgID = $msgID;`)
+	stmt.SetInt64("$msgID", int64(msgID))
+	if hasNext, err := stmt.Step(); err != nil {
+		return Unsubscribe{}, fmt.Errorf("spillbox.LoadUnsubscribe(%s): %v", msgID, err)
+	} else if !hasNext {
+		return Unsubscribe{}, nil
+	}
+	u.Mailto = stmt.GetText("Mailto")
+	u.URL = stmt.GetText("URL")
+	u.OneClick = stmt.GetInt64("OneClick") != 0
+	stmt.Reset()
+	return u, nil
+}
+
+// CopyUnsubscribe copies the List-Unsubscribe header of a message
+// to a copy of it.
+func CopyUnsubscribe(conn *sqlite.Conn, src, dst email.MsgID) error {
+	stmt := conn.Prep(`INSERT INTO MsgUnsubscribe (MsgID, Mailto, URL, OneClick)
+		SELECT $dst, Mailto, URL, OneClick FROM MsgUnsubscribe WHERE MsgID = $src;`)
+	stmt.SetInt64("$src", int64(src))
+	stmt.SetInt64("$dst", int64(dst))
+	_, err := stmt.Step()
+	return err
+}
+
+// PostOneClick unsubscribes with an RFC 8058 one-click POST.
+//
+// The request carries no cookies or credentials and redirects are
+// not followed, a redirected POST would become a GET. The URL comes
+// from a stranger, so only public addresses are connected to.
+func (u Unsubscribe) PostOneClick(ctx context.Context) error {
+	if !u.OneClick {
+		return fmt.Errorf("spillbox: no one-click unsubscribe URL")
+	}
+	req, err := http.NewRequest("POST", u.URL, strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return fmt.Errorf("spillbox: unsubscribe: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := oneClickClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("spillbox: unsubscribe: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("spillbox: unsubscribe: %s: %s", u.URL, res.Status)
+	}
+	return nil
+}
+
+var oneClickClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: dialPublic,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// dialPublic is a net.Dialer Control function that refuses to
+// connect to addresses that are not public. It sees the address
+// after name resolution, so a name cannot be used to get around it.
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+var nonPublicNets = func() (nets []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // this network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"240.0.0.0/4",    // reserved, and broadcast
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPublicIP reports whether ip is a unicast address
+// on the public internet.
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if !ip.IsGlobalUnicast() {
+		return false // loopback, multicast, unspecified, link-local
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// MailtoMsg builds the message that unsubscribes from by mail.
+// The subject and body are taken from the mailto URI, RFC 6068.
+//
+// The mailto URI comes from a stranger. Its first address must be
+// a plain addr-spec, see email.CheckAddrSpec, and its subject must
+// be one line, so it cannot add header fields or recipients.
+func (u Unsubscribe) MailtoMsg(from string, date time.Time) (to string, msg []byte, err error) {
+	if u.Mailto == "" {
+		return "", nil, fmt.Errorf("spillbox: no mailto unsubscribe address")
+	}
+	uri, err := url.Parse(u.Mailto)
+	if err != nil {
+		return "", nil, fmt.Errorf("spillbox: unsubscribe: %v", err)
+	}
+	addrs, err := url.PathUnescape(uri.Opaque)
+	if err != nil {
+		return "", nil, fmt.Errorf("spillbox: unsubscribe: %v", err)
+	}
+	query := make(url.Values)
+	for k, v := range uri.Query() {
+		query[strings.ToLower(k)] = v
+	}
+	if addrs == "" {
+		addrs = query.Get("to")
+	}
+	to = strings.Split(addrs, ",")[0]
+	if err := email.CheckAddrSpec(to); err != nil {
+		return "", nil, fmt.Errorf("spillbox: unsubscribe: bad mailto address: %v", err)
+	}
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		return "", nil, fmt.Errorf("spillbox: unsubscribe: line break in mailto subject %q", subject)
+	}
+	body := query.Get("body")
+	if body == "" {
+		body = "unsubscribe"
+	}
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\r", "\n", -1)
+
+	domain := from[strings.LastIndexByte(from, '@')+1:]
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: <%s>\r\n", from)
+	fmt.Fprintf(buf, "To: <%s>\r\n", to)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	for _, line := range strings.Split(body, "\n") {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return to, buf.Bytes(), nil
+}
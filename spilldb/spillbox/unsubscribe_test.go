@@ -0,0 +1,175 @@
+package spillbox
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"spilled.ink/email"
+)
+
+func TestParseUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name  string
+		unsub string
+		post  string
+		want  Unsubscribe
+	}{
+		{
+			name:  "both",
+			unsub: "<mailto:list-request@example.com?subject=unsubscribe>, <https://example.com/u?id=1>",
+			post:  "List-Unsubscribe=One-Click",
+			want: Unsubscribe{
+				Mailto:   "mailto:list-request@example.com?subject=unsubscribe",
+				URL:      "https://example.com/u?id=1",
+				OneClick: true,
+			},
+		},
+		{
+			name:  "first of each kept",
+			unsub: "<https://example.com/1>, <mailto:a@example.com>, <https://example.com/2>, <mailto:b@example.com>",
+			want:  Unsubscribe{Mailto: "mailto:a@example.com", URL: "https://example.com/1"},
+		},
+		{
+			name:  "one-click needs https",
+			unsub: "<http://example.com/u>",
+			post:  "List-Unsubscribe=One-Click",
+			want:  Unsubscribe{URL: "http://example.com/u"},
+		},
+		{
+			name:  "whitespace in brackets",
+			unsub: "<https://example.com/\r\n u?id=1>",
+			want:  Unsubscribe{URL: "https://example.com/u?id=1"},
+		},
+		{
+			name:  "other schemes",
+			unsub: "<ftp://example.com/u>, <javascript:alert(1)>",
+		},
+		{
+			name:  "unterminated",
+			unsub: "<mailto:a@example.com",
+		},
+		{
+			name: "missing",
+			post: "List-Unsubscribe=One-Click",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hdr email.Header
+			if test.unsub != "" {
+				hdr.Add("List-Unsubscribe", []byte(test.unsub))
+			}
+			if test.post != "" {
+				hdr.Add("List-Unsubscribe-Post", []byte(test.post))
+			}
+			if got := ParseUnsubscribe(&hdr); got != test.want {
+				t.Errorf("ParseUnsubscribe=%+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMailtoMsg(t *testing.T) {
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := Unsubscribe{Mailto: "mailto:List-Request@example.com?Subject=remove%20me&body=line%201%0D%0Aline%202"}
+	to, msg, err := u.MailtoMsg("user@spilled.ink", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to != "List-Request@example.com" {
+		t.Errorf("to=%q", to)
+	}
+	for _, want := range []string{
+		"From: <user@spilled.ink>\r\n",
+		"To: <List-Request@example.com>\r\n",
+		"Subject: remove me\r\n",
+		"Date: Thu, 02 Jan 2020 03:04:05 +0000\r\n",
+		"@spilled.ink>\r\n",
+		"\r\n\r\nline 1\r\nline 2\r\n",
+	} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("message does not contain %q:\n%s", want, msg)
+		}
+	}
+
+	u = Unsubscribe{Mailto: "mailto:?to=list@example.com"}
+	if to, _, err := u.MailtoMsg("user@spilled.ink", date); err != nil || to != "list@example.com" {
+		t.Errorf("to from query: %q, %v", to, err)
+	}
+	u = Unsubscribe{Mailto: "mailto:a@example.com,b@example.com"}
+	if to, _, err := u.MailtoMsg("user@spilled.ink", date); err != nil || to != "a@example.com" {
+		t.Errorf("first of two addresses: %q, %v", to, err)
+	}
+	u = Unsubscribe{Mailto: "mailto:list@example.com?body=a%0Db"}
+	if _, msg, err := u.MailtoMsg("user@spilled.ink", date); err != nil {
+		t.Error(err)
+	} else if !strings.HasSuffix(string(msg), "\r\n\r\na\r\nb\r\n") {
+		t.Errorf("bare CR in body not made a line break:\n%q", msg)
+	}
+
+	for _, mailto := range []string{
+		"",
+		"mailto:list@example.com%0D%0ABcc:%20victim@example.com",
+		"mailto:list@example.com%0ABcc:%20victim@example.com",
+		"mailto:?to=list@example.com%0D%0ABcc:victim@example.com",
+		"mailto:list@example.com?subject=x%0D%0ABcc:%20victim@example.com",
+		"mailto:list@example.com?subject=x%0ABcc:%20victim@example.com",
+		"mailto:Victim%20%3Cvictim@example.com%3E",
+		"mailto:list",
+		"mailto:list@[127.0.0.1]",
+	} {
+		u := Unsubscribe{Mailto: mailto}
+		if to, msg, err := u.MailtoMsg("user@spilled.ink", date); err == nil {
+			t.Errorf("MailtoMsg(%q) succeeded, to %q:\n%s", mailto, to, msg)
+		}
+	}
+}
+
+func TestPostOneClickRefusesLocal(t *testing.T) {
+	posted := false
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = true
+	}))
+	defer srv.Close()
+
+	u := Unsubscribe{URL: srv.URL + "/unsubscribe", OneClick: true}
+	if err := u.PostOneClick(context.Background()); err == nil {
+		t.Error("PostOneClick to a loopback address succeeded")
+	} else if !strings.Contains(err.Error(), "non-public") {
+		t.Errorf("PostOneClick: %v, want a non-public address error", err)
+	}
+	if posted {
+		t.Error("loopback server received the POST")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"0.0.0.0":         false,
+		"::":              false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"224.0.0.1":       false,
+		"255.255.255.255": false,
+		"::ffff:10.0.0.1": false,
+		"::ffff:8.8.8.8":  true,
+	} {
+		if got := isPublicIP(net.ParseIP(addr)); got != want {
+			t.Errorf("isPublicIP(%s)=%v, want %v", addr, got, want)
+		}
+	}
+}
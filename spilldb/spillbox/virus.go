@@ -0,0 +1,65 @@
+package spillbox
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+)
+
+// VirusClean is the VirusScan verdict of a message found clean.
+const VirusClean = "clean"
+
+// QuarantineMailbox holds new mail found to carry a virus.
+// It is created when first needed.
+const QuarantineMailbox = "Quarantine"
+
+// fileVirus files new mail with a virus in the quarantine mailbox.
+func fileVirus(conn *sqlite.Conn, msg *email.Msg) error {
+	if msg.VirusScan == "" || msg.VirusScan == VirusClean {
+		return nil
+	}
+	mailboxID, err := FindMailbox(conn, QuarantineMailbox)
+	if err != nil {
+		return fmt.Errorf("spillbox: quarantine mailbox: %v", err)
+	}
+	if mailboxID == 0 {
+		if err := CreateMailbox(conn, QuarantineMailbox, 0); err != nil {
+			return err
+		}
+		if mailboxID, err = FindMailbox(conn, QuarantineMailbox); err != nil {
+			return fmt.Errorf("spillbox: quarantine mailbox: %v", err)
+		}
+	}
+	msg.MailboxID = mailboxID
+	return nil
+}
+
+// VirusScan reports the antivirus verdict recorded for a message,
+// "" if it was not scanned.
+func VirusScan(conn *sqlite.Conn, msgID email.MsgID) (string, error) {
+	stmt := conn.Prep("SELECT VirusScan FROM Msgs WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	if hasNext, err := stmt.Step(); err != nil {
+		return "", fmt.Errorf("spillbox.VirusScan(%s): %v", msgID, err)
+	} else if !hasNext {
+		return "", fmt.Errorf("spillbox.VirusScan(%s): no message", msgID)
+	}
+	verdict := stmt.GetText("VirusScan")
+	stmt.Reset()
+	return verdict, nil
+}
+
+// SetVirusScan records the antivirus verdict for a message.
+func SetVirusScan(conn *sqlite.Conn, msgID email.MsgID, verdict string) error {
+	stmt := conn.Prep("UPDATE Msgs SET VirusScan = $verdict WHERE MsgID = $msgID;")
+	stmt.SetInt64("$msgID", int64(msgID))
+	stmt.SetText("$verdict", verdict)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("spillbox.SetVirusScan(%s): %v", msgID, err)
+	}
+	if conn.Changes() == 0 {
+		return fmt.Errorf("spillbox.SetVirusScan(%s): no message", msgID)
+	}
+	return nil
+}
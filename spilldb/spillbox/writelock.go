@@ -0,0 +1,145 @@
+package spillbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// DefaultWriteTimeout is how long GetRW waits for the write
+// connection when Box.WriteTimeout is not set.
+const DefaultWriteTimeout = 30 * time.Second
+
+// ErrWriteTimeout is reported by GetRW when the write connection
+// is held by others for longer than the box's WriteTimeout.
+var ErrWriteTimeout = errors.New("spillbox: timeout waiting for the write connection")
+
+// GetRW returns the connection of PoolRW, waiting for it behind
+// any other writers. It must be returned with PutRW.
+//
+// PoolRW has a single connection, so every writer to a mailbox
+// waits on the one before it. Waiters are served in the order they
+// arrive, and give up with ErrWriteTimeout after WriteTimeout
+// rather than queueing behind a long transaction indefinitely.
+//
+// The wait is done before PoolRW.Get because cancelling the context
+// given to Get interrupts the connection, not just the wait.
+func (box *Box) GetRW(ctx context.Context) (*sqlite.Conn, error) {
+	start := time.Now()
+
+	select {
+	case box.rwSem <- struct{}{}:
+	default:
+		timeout := box.WriteTimeout
+		if timeout <= 0 {
+			timeout = DefaultWriteTimeout
+		}
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+		t := time.NewTimer(timeout)
+		writeStats.waiting(+1)
+		select {
+		case box.rwSem <- struct{}{}:
+		case <-done:
+			t.Stop()
+			writeStats.waiting(-1)
+			return nil, context.Canceled
+		case <-t.C:
+			writeStats.waiting(-1)
+			writeStats.timeout()
+			return nil, ErrWriteTimeout
+		}
+		t.Stop()
+		writeStats.waiting(-1)
+	}
+
+	conn := box.PoolRW.Get(ctx)
+	if conn == nil {
+		<-box.rwSem
+		return nil, context.Canceled
+	}
+	box.rwAcquired = time.Now()
+	writeStats.acquired(box.rwAcquired.Sub(start))
+	return conn, nil
+}
+
+// PutRW returns a connection acquired with GetRW.
+func (box *Box) PutRW(conn *sqlite.Conn) {
+	held := time.Since(box.rwAcquired)
+	box.PoolRW.Put(conn)
+	<-box.rwSem
+	writeStats.released(held)
+}
+
+// SetBusyTimeout sets how long each connection of the box retries
+// when it finds the database locked, by another process such as a
+// backup, before reporting SQLITE_BUSY.
+// It must be called before the box is used.
+func (box *Box) SetBusyTimeout(d time.Duration) {
+	for _, conn := range box.conns {
+		conn.SetBusyTimeout(d)
+	}
+}
+
+// WriteStats reports on the waits for the write connection of
+// every mailbox since the process started.
+type WriteStats struct {
+	Gets      int64         // write connections acquired with GetRW
+	Waiting   int64         // writers waiting now
+	Timeouts  int64         // writers that gave up with ErrWriteTimeout
+	WaitTotal time.Duration // time spent waiting by Gets
+	WaitMax   time.Duration // longest wait
+	HeldTotal time.Duration // time the write connection was held
+	HeldMax   time.Duration // longest hold, the longest write transaction
+}
+
+// writeStats counts the GetRW waits of every Box.
+var writeStats writeCounter
+
+type writeCounter struct {
+	mu sync.Mutex
+	s  WriteStats
+}
+
+// GetWriteStats reports the write connection waits of every mailbox.
+func GetWriteStats() WriteStats {
+	writeStats.mu.Lock()
+	defer writeStats.mu.Unlock()
+	return writeStats.s
+}
+
+func (c *writeCounter) waiting(n int64) {
+	c.mu.Lock()
+	c.s.Waiting += n
+	c.mu.Unlock()
+}
+
+func (c *writeCounter) timeout() {
+	c.mu.Lock()
+	c.s.Timeouts++
+	c.mu.Unlock()
+}
+
+func (c *writeCounter) acquired(wait time.Duration) {
+	c.mu.Lock()
+	c.s.Gets++
+	c.s.WaitTotal += wait
+	if wait > c.s.WaitMax {
+		c.s.WaitMax = wait
+	}
+	c.mu.Unlock()
+}
+
+func (c *writeCounter) released(held time.Duration) {
+	c.mu.Lock()
+	c.s.HeldTotal += held
+	if held > c.s.HeldMax {
+		c.s.HeldMax = held
+	}
+	c.mu.Unlock()
+}
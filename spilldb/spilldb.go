@@ -3,6 +3,7 @@ package spilldb
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -10,24 +11,35 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"crawshaw.io/iox"
 	"crawshaw.io/iox/webfetch"
 	"crawshaw.io/sqlite/sqlitex"
 	"golang.org/x/crypto/acme/autocert"
 	"spilled.ink/email/msgbuilder"
+	"spilled.ink/imap"
+	"spilled.ink/imap/imapparser"
 	"spilled.ink/imap/imapserver"
+	"spilled.ink/smtp/milter"
 	"spilled.ink/smtp/smtpserver"
 	"spilled.ink/spilldb/boxmgmt"
 	"spilled.ink/spilldb/db"
 	"spilled.ink/spilldb/deliverer"
+	"spilled.ink/spilldb/dkimkeys"
 	"spilled.ink/spilldb/dnsdb"
 	"spilled.ink/spilldb/honeypotdb"
 	"spilled.ink/spilldb/imapdb"
 	"spilled.ink/spilldb/localsender"
 	"spilled.ink/spilldb/processor"
+	"spilled.ink/spilldb/replication"
 	"spilled.ink/spilldb/smtpdb"
 	"spilled.ink/spilldb/webcache"
+	"spilled.ink/spilldb/webhook"
+	"spilled.ink/spilldb/webpush"
+	"spilled.ink/util/dnscache"
+	"spilled.ink/util/otlptrace"
 )
 
 type Server struct {
@@ -36,19 +48,53 @@ type Server struct {
 
 	CertManager *autocert.Manager
 	Version     string
-	APNSCert    *tls.Certificate
-
-	Deliverer   *deliverer.Deliverer
-	Processor   *processor.Processor
-	LocalSender *localsender.LocalSender
-	WebFetch    *webfetch.Client
-	BoxMgmt     *boxmgmt.BoxMgmt
-	MsgBuilder  *msgbuilder.Builder
-	Janitor     *db.Janitor
-	Logf        func(format string, v ...interface{})
+	APNSCert    *tls.Certificate // set with SetAPNSCert once serving
+	WebPush     *webpush.Sender  // if set, sends Web Push notifications
+	Limits      Limits
+
+	// SenderPolicy is applied to mail submitted to the MSA from
+	// addresses the user may not send as.
+	SenderPolicy smtpdb.SenderPolicy
+
+	Deliverer    *deliverer.Deliverer
+	Processor    *processor.Processor
+	LocalSender  *localsender.LocalSender
+	WebFetch     *webfetch.Client
+	BoxMgmt      *boxmgmt.BoxMgmt
+	Resolver     *dnscache.Resolver // shared DNS cache for DKIM and MX lookups
+	MsgBuilder   *msgbuilder.Builder
+	Janitor      *db.Janitor
+	DKIMRotator  *dkimkeys.Rotator
+	Lockout      *db.Lockout // failed login lockout for IMAP and MSA
+	Compressor   *boxmgmt.Compressor
+	Offloader    *boxmgmt.Offloader
+	SizeVerifier *boxmgmt.SizeVerifier
+	Webhooks     *webhook.Sender          // posts mail events to webhooks
+	Standby      *replication.Standby     // if set, copies mailboxes from a primary
+	Milters      []*milter.Client         // consulted about inbound SMTP mail
+	IMAPDebug    *imapserver.DebugCapture // IMAP transcripts, enabled from the admin API
+	Tracer       *otlptrace.Exporter      // if set, exports spans of IMAP commands and SMTP transactions
+	Logf         func(format string, v ...interface{})
+
+	// IMAPCompressLevel is the flate level of IMAP COMPRESS,
+	// see imapserver.Server.CompressLevel.
+	IMAPCompressLevel int
 
 	cacheDB *sqlitex.Pool
 
+	logLevel  LogLevel // accessed atomically
+	rateLimit rateLimiter
+
+	apnsMu     sync.Mutex
+	serving    bool
+	apns       []*imapserver.APNS
+	apnsPruned int64 // accessed atomically
+
+	imapsMu sync.Mutex
+	imaps   []*imapserver.Server
+
+	userFilers userFilers
+
 	shutdownFnsMu sync.Mutex
 	shutdownFns   []func(context.Context) error
 }
@@ -58,8 +104,9 @@ func New(filer *iox.Filer, dbDir string) (*Server, error) {
 		filer = iox.NewFiler(0)
 	}
 	s := &Server{
-		Filer: filer,
-		Logf:  log.Printf,
+		Filer:    filer,
+		Logf:     log.Printf,
+		logLevel: LogInfo,
 	}
 	logf := func(format string, v ...interface{}) {
 		s.Logf(format, v...)
@@ -73,6 +120,7 @@ func New(filer *iox.Filer, dbDir string) (*Server, error) {
 		}
 		dbfile = filepath.Join(dbDir, "spilld.db")
 		cacheDBFile = filepath.Join(dbDir, "spilld_cache.db")
+		s.userFilers.dir = filepath.Join(dbDir, "tmp")
 	}
 
 	var err error
@@ -86,6 +134,7 @@ func New(filer *iox.Filer, dbDir string) (*Server, error) {
 		s.DB.Close()
 		return nil, err
 	}
+	s.BoxMgmt.Logf = logf
 
 	s.cacheDB, err = sqlitex.Open(cacheDBFile, 0, 4)
 	if err != nil {
@@ -102,10 +151,34 @@ func New(filer *iox.Filer, dbDir string) (*Server, error) {
 	}
 
 	s.LocalSender = localsender.New(s.DB, s.Filer, s.BoxMgmt)
-	s.Processor = processor.NewProcessor(s.DB, s.Filer, s.WebFetch, s.LocalSender.Process)
-	s.Deliverer = deliverer.NewDeliverer(s.DB, s.Filer)
+	upstream := &dnscache.Upstream{}
+	s.Resolver = &dnscache.Resolver{
+		UpstreamTXT: upstream.LookupTXT,
+		UpstreamMX:  upstream.LookupMX,
+	}
+	s.Processor = processor.NewProcessor(s.DB, s.Filer, s.WebFetch, s.Resolver, s.LocalSender.Process)
+	s.Deliverer = deliverer.NewDeliverer(s.DB, s.Filer, s.Resolver)
+	s.Deliverer.Released = s.msgSubmitted
 	s.MsgBuilder = &msgbuilder.Builder{Filer: filer}
 	s.Janitor = db.NewJanitor(s.DB)
+	s.DKIMRotator = dkimkeys.NewRotator(s.DB)
+	s.DKIMRotator.Logf = logf
+	s.Lockout = &db.Lockout{}
+	s.Compressor = boxmgmt.NewCompressor(s.BoxMgmt)
+	s.Compressor.Logf = logf
+	s.Offloader = boxmgmt.NewOffloader(s.BoxMgmt)
+	s.Offloader.Logf = logf
+	s.SizeVerifier = boxmgmt.NewSizeVerifier(s.BoxMgmt)
+	s.SizeVerifier.Logf = logf
+	s.Webhooks = webhook.NewSender(s.DB)
+	s.Webhooks.Logf = logf
+	s.IMAPDebug = &imapserver.DebugCapture{
+		Dir:  filepath.Join(os.TempDir(), "spilld_imap_debug"),
+		Logf: logf,
+	}
+	if dbDir != "" {
+		s.IMAPDebug.Dir = filepath.Join(dbDir, "imap_debug")
+	}
 
 	return s, nil
 }
@@ -114,18 +187,38 @@ type ServerAddr struct {
 	Hostname  string
 	Ln        net.Listener   // TCP
 	PC        net.PacketConn // UDP
-	TLSConfig *tls.Config
+	TLSConfig *tls.Config    // if set, used as is
+
+	// GetCertificate, if set, provides the certificates of the
+	// listener in place of Server.CertManager.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 }
 
-func (s *Server) Serve(smtp, msa, msaStartTLS, imap, dns []ServerAddr) error {
+func (s *Server) Serve(smtp, msa, msaStartTLS, imap, imapStartTLS, dns []ServerAddr) error {
 	errCh := make(chan error, 8)
 
+	s.apnsMu.Lock()
+	s.serving = true
+	s.apnsMu.Unlock()
+
+	s.Lockout.Threshold = s.Limits.MaxLoginFailures
+	s.Lockout.MaxDelay = s.Limits.MaxLoginLockout
+
+	if s.WebPush != nil {
+		s.serveWebPush()
+	}
+
 	s.shutdownFnsMu.Lock()
 	s.shutdownFns = []func(context.Context) error{
 		func(context.Context) error { s.Deliverer.Shutdown(); return nil }, // TODO
 		func(ctx context.Context) error { s.Processor.Shutdown(ctx); return nil },
 		func(ctx context.Context) error { s.WebFetch.Shutdown(ctx); return nil },
 		s.Janitor.Shutdown,
+		s.DKIMRotator.Shutdown,
+		s.Compressor.Shutdown,
+		s.Offloader.Shutdown,
+		s.SizeVerifier.Shutdown,
+		s.Webhooks.Shutdown,
 	}
 	s.shutdownFnsMu.Unlock()
 
@@ -154,6 +247,40 @@ func (s *Server) Serve(smtp, msa, msaStartTLS, imap, dns []ServerAddr) error {
 		s.Logf("spilldb: message local deliverer disabled")
 	}
 
+	if s.Standby != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Logf("spilldb: standby replication from %s starting", s.Standby.Primary)
+
+			s.shutdownFnsMu.Lock()
+			s.shutdownFns = append(s.shutdownFns, s.Standby.Shutdown)
+			s.shutdownFnsMu.Unlock()
+
+			if err := s.Standby.Run(); err != nil {
+				errCh <- fmt.Errorf("spilldb.Standby: %v", err)
+			}
+			s.Logf("spilldb: standby replication shutdown")
+		}()
+	}
+
+	if s.Tracer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Logf("spilldb: trace exporter to %s starting", s.Tracer.Endpoint)
+
+			s.shutdownFnsMu.Lock()
+			s.shutdownFns = append(s.shutdownFns, s.Tracer.Shutdown)
+			s.shutdownFnsMu.Unlock()
+
+			if err := s.Tracer.Run(); err != nil {
+				errCh <- fmt.Errorf("spilldb.Tracer: %v", err)
+			}
+			s.Logf("spilldb: trace exporter shutdown")
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -184,6 +311,56 @@ func (s *Server) Serve(smtp, msa, msaStartTLS, imap, dns []ServerAddr) error {
 		s.Logf("spilldb: janitor shutdown")
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Logf("spilldb: DKIM key rotator starting")
+		if err := s.DKIMRotator.Run(); err != nil {
+			errCh <- fmt.Errorf("spilldb.DKIMRotator: %v", err)
+		}
+		s.Logf("spilldb: DKIM key rotator shutdown")
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Logf("spilldb: compressor starting")
+		if err := s.Compressor.Run(); err != nil {
+			errCh <- fmt.Errorf("spilldb.Compressor: %v", err)
+		}
+		s.Logf("spilldb: compressor shutdown")
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Logf("spilldb: offloader starting")
+		if err := s.Offloader.Run(); err != nil {
+			errCh <- fmt.Errorf("spilldb.Offloader: %v", err)
+		}
+		s.Logf("spilldb: offloader shutdown")
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Logf("spilldb: size verifier starting")
+		if err := s.SizeVerifier.Run(); err != nil {
+			errCh <- fmt.Errorf("spilldb.SizeVerifier: %v", err)
+		}
+		s.Logf("spilldb: size verifier shutdown")
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Logf("spilldb: webhook sender starting")
+		if err := s.Webhooks.Run(); err != nil {
+			errCh <- fmt.Errorf("spilldb.Webhooks: %v", err)
+		}
+		s.Logf("spilldb: webhook sender shutdown")
+	}()
+
 	for _, addr := range smtp {
 		addr := addr
 		wg.Add(1)
@@ -234,7 +411,18 @@ func (s *Server) Serve(smtp, msa, msaStartTLS, imap, dns []ServerAddr) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := s.serveIMAP(addr, i == 0); err != nil {
+			if err := s.serveIMAP(addr, i == 0, false); err != nil {
+				errCh <- fmt.Errorf("spilldb IMAP %s: %v", addr.Hostname, err)
+			}
+		}()
+	}
+
+	for _, addr := range imapStartTLS {
+		addr := addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serveIMAP(addr, false, true); err != nil {
 				errCh <- fmt.Errorf("spilldb IMAP %s: %v", addr.Hostname, err)
 			}
 		}()
@@ -309,6 +497,10 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	s.shutdownFns = nil
 	s.shutdownFnsMu.Unlock()
 
+	// Servers draining connections keep using the database
+	// until ctx is done.
+	wg.Wait()
+
 	// Stage 2: bring down the database and filer.
 	if err := s.DB.Close(); err != nil {
 		s.Logf("spilldb: DB shutdown: %v", err)
@@ -318,6 +510,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 	s.Logf("spilldb: DB shutdown")
 
+	s.shutdownUserFilers(ctx)
 	s.Filer = nil
 
 	shutdownDone <- struct{}{}
@@ -330,24 +523,42 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 }
 
+func (s *Server) maxMsgSize() int {
+	if s.Limits.MaxMsgSize != 0 {
+		return s.Limits.MaxMsgSize
+	}
+	return 1 << 27
+}
+
+// tlsConfig is the TLS configuration of a listener.
+// The certificates come from addr.GetCertificate if it is set,
+// otherwise from CertManager.
 func (s *Server) tlsConfig(addr ServerAddr) (*tls.Config, error) {
 	if addr.TLSConfig != nil {
 		return addr.TLSConfig, nil
 	}
 	config := &tls.Config{}
 
-	if s.CertManager != nil {
-		config.GetCertificate = s.CertManager.GetCertificate
-
+	getCert := addr.GetCertificate
+	if getCert == nil && s.CertManager != nil {
+		getCert = s.CertManager.GetCertificate
+	}
+	if getCert != nil {
 		// Some SMTP clients connect with bad SNI data for
 		// GetCertificate, so we serve them a (potentially
-		// outdated) static let's encrypt certificate.
+		// outdated) static certificate for the hostname.
 		hello := &tls.ClientHelloInfo{ServerName: addr.Hostname}
-		cert, err := s.CertManager.GetCertificate(hello)
+		fallback, err := getCert(hello)
 		if err != nil {
 			return nil, err
 		}
-		config.Certificates = append(config.Certificates, *cert)
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := getCert(hello)
+			if err != nil {
+				return fallback, nil
+			}
+			return cert, nil
+		}
 	}
 	return config, nil
 }
@@ -360,7 +571,7 @@ func (s *Server) serveSMTP(addr ServerAddr) error {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	msgMaker := smtpdb.New(ctx, s.DB, s.Filer, s.Processor.Process)
+	msgMaker := smtpdb.New(ctx, s.DB, s.Filer, s.Lockout, s.Processor.Process)
 
 	/*gl, err := greylistdb.New(s.dbpool)
 	if err != nil {
@@ -369,20 +580,31 @@ func (s *Server) serveSMTP(addr ServerAddr) error {
 	gl.Filer = s.filer
 	gl.ProcessMsg = msgMaker.NewMessage*/
 
-	honeypot, err := honeypotdb.New(ctx, s.cacheDB, s.Filer, msgMaker.NewMessage)
+	newMessage := func(remoteAddr net.Addr, from []byte, params smtpserver.MailParams, authToken uint64) (smtpserver.Msg, error) {
+		if !s.rateLimit.allow(remoteAddr, time.Now()) {
+			return nil, fmt.Errorf("rate limit exceeded for %s", remoteAddr)
+		}
+		return msgMaker.NewMessage(remoteAddr, from, params, authToken)
+	}
+	honeypot, err := honeypotdb.New(ctx, s.cacheDB, s.Filer, newMessage)
 	if err != nil {
 		return err
 	}
 
-	const maxMsgSize = 1 << 27
 	smtp := &smtpserver.Server{
-		Hostname:   addr.Hostname,
-		Auth:       honeypot.Auth,
-		NewMessage: honeypot.NewMessage,
-		MaxSize:    maxMsgSize,
+		Hostname:      addr.Hostname,
+		Auth:          honeypot.Auth,
+		NewMessage:    honeypot.NewMessage,
+		MaxSize:       s.maxMsgSize(),
+		MaxSessions:   s.Limits.MaxSMTPSessions,
+		MaxRecipients: s.Limits.MaxRecipients,
+
+		MaxMsgsPerConn: s.Limits.MaxSMTPMsgs,
 		// TODO Rand:       s.rand,
 		AllowNoTLS: true,
 		TLSConfig:  tlsConfig,
+		Milters:    s.Milters,
+		Tracer:     s.Tracer,
 	}
 
 	s.addShutdownFn(smtp.Shutdown)
@@ -404,23 +626,24 @@ func (s *Server) serveMSA(addr ServerAddr, starttls bool) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	doneFn := func(stagingID int64) {
-		// We need one of these, or both.
-		// It's not clear which without plumbing,
-		// but it's fine to give them both a kick.
-		s.Deliverer.Deliver(stagingID)
-		s.Processor.Process(stagingID)
-	}
-	msgMaker := smtpdb.New(ctx, s.DB, s.Filer, doneFn)
+	msgMaker := smtpdb.New(ctx, s.DB, s.Filer, s.Lockout, s.msgSubmitted)
+	msgMaker.SendDelay = s.Limits.SendDelay
+	msgMaker.HoldFn = s.Deliverer.Hold
+	msgMaker.SenderPolicy = s.SenderPolicy
 
-	const maxMsgSize = 1 << 27
 	smtp := &smtpserver.Server{
-		Hostname:   addr.Hostname,
-		Auth:       msgMaker.Auth,
-		NewMessage: msgMaker.NewMessage,
-		MaxSize:    maxMsgSize,
+		Hostname:      addr.Hostname,
+		Auth:          msgMaker.Auth,
+		NewMessage:    msgMaker.NewMessage,
+		MaxSize:       s.maxMsgSize(),
+		MaxSessions:   s.Limits.MaxSMTPSessions,
+		MaxRecipients: s.Limits.MaxRecipients,
+
+		MaxMsgsPerConn: s.Limits.MaxSMTPMsgs,
 		// TODO Rand:       s.rand,
-		TLSConfig: tlsConfig,
+		TLSConfig:  tlsConfig,
+		RequireTLS: true,
+		Tracer:     s.Tracer,
 	}
 	s.addShutdownFn(smtp.Shutdown)
 
@@ -437,22 +660,52 @@ func (s *Server) serveMSA(addr ServerAddr, starttls bool) error {
 	return nil
 }
 
-func (s *Server) serveIMAP(addr ServerAddr, first bool) error {
+// msgSubmitted is called when a user submits a message.
+func (s *Server) msgSubmitted(stagingID int64) {
+	// We need one of these, or both.
+	// It's not clear which without plumbing,
+	// but it's fine to give them both a kick.
+	s.Deliverer.Deliver(stagingID)
+	s.Processor.Process(stagingID)
+}
+
+func (s *Server) serveIMAP(addr ServerAddr, first, starttls bool) error {
 	tlsConfig, err := s.tlsConfig(addr)
 	if err != nil {
 		return err
 	}
 
-	imap := imapdb.New(tlsConfig, s.DB, s.Filer, s.BoxMgmt, s.Logf)
+	imap := imapdb.New(tlsConfig, s.DB, s.Filer, s.BoxMgmt, s.Lockout, s.Logf)
 	imap.Version = s.Version
-
+	imap.MaxConns = s.Limits.MaxIMAPConns
+	imap.MaxConnsPerUser = s.Limits.MaxIMAPConnsPerUser
+	imap.MaxConnsPerIP = s.Limits.MaxIMAPConnsPerIP
+	imap.KeepAlive = s.Limits.IMAPKeepAlive
+	imap.IdleHeartbeat = s.Limits.IMAPIdleHeartbeat
+	imap.AckTimeout = s.Limits.IMAPAckTimeout
+	imap.CompressLevel = s.IMAPCompressLevel
+	imap.LiteralMemSize = s.Limits.IMAPLiteralMemSize
+	imap.SlowCommand = s.Limits.IMAPSlowCommand
+	imap.UserFiler = s.userFiler
+	imap.Tracer = s.Tracer
+
+	s.imapsMu.Lock()
+	s.imaps = append(s.imaps, imap)
+	s.imapsMu.Unlock()
+
+	imap.Debug = s.IMAPDebug.Writer
+
+	s.apnsMu.Lock()
 	if s.APNSCert != nil {
 		imap.APNS = &imapserver.APNS{
 			Certificate: *s.APNSCert,
+			Failed:      s.apnsFailed,
 		}
 		// We only want one APNS notifier running, but we have two IMAP servers.
 		imap.NotifyAPNS = first
+		s.apns = append(s.apns, imap.APNS)
 	}
+	s.apnsMu.Unlock()
 
 	s.addShutdownFn(imap.Shutdown)
 
@@ -460,10 +713,19 @@ func (s *Server) serveIMAP(addr ServerAddr, first bool) error {
 	if imap.NotifyAPNS {
 		apnsLog = " with APNS"
 	}
-	s.Logf("spilldb: IMAP %s, %s: starting%s", addr.Hostname, addr.Ln.Addr(), apnsLog)
-	defer s.Logf("spilldb: IMAP %s, %s: shutdown", addr.Hostname, addr.Ln.Addr())
+	name := "IMAP"
+	if starttls {
+		name = "IMAP StartTLS"
+	}
+	s.Logf("spilldb: %s %s, %s: starting%s", name, addr.Hostname, addr.Ln.Addr(), apnsLog)
+	defer s.Logf("spilldb: %s %s, %s: shutdown", name, addr.Hostname, addr.Ln.Addr())
 
-	if err := imap.ServeTLS(addr.Ln); err != nil {
+	if starttls {
+		err = imap.ServeSTARTTLS(addr.Ln)
+	} else {
+		err = imap.ServeTLS(addr.Ln)
+	}
+	if err != nil {
 		if err != imapserver.ErrServerClosed {
 			return err
 		}
@@ -471,6 +733,126 @@ func (s *Server) serveIMAP(addr ServerAddr, first bool) error {
 	return nil
 }
 
+// apnsFailed records a notification APNS refused and
+// removes the device after repeated failures.
+func (s *Server) apnsFailed(userID int64, device imapparser.ApplePushDevice) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	u, err := s.BoxMgmt.Open(ctx, userID)
+	if err != nil {
+		s.Logf("spilldb: APNS: user %d: %v", userID, err)
+		return
+	}
+	pruned, err := u.Box.PushDeviceFailed(ctx, device)
+	if err != nil {
+		s.Logf("spilldb: APNS: user %d: %v", userID, err)
+		return
+	}
+	if pruned {
+		atomic.AddInt64(&s.apnsPruned, 1)
+		s.Logf("spilldb: APNS: user %d: removed device %s", userID, device.DeviceToken)
+	}
+}
+
+// PushStats counts push notifications since the server started.
+type PushStats struct {
+	APNSSent   int64
+	APNSFailed int64 // refused by APNS
+	APNSPruned int64 // devices removed after repeated failures
+}
+
+// PushStats reports push notification counts.
+func (s *Server) PushStats() PushStats {
+	s.apnsMu.Lock()
+	defer s.apnsMu.Unlock()
+
+	stats := PushStats{APNSPruned: atomic.LoadInt64(&s.apnsPruned)}
+	for _, apns := range s.apns {
+		a := apns.Stats()
+		stats.APNSSent += a.Sent
+		stats.APNSFailed += a.Failed
+	}
+	return stats
+}
+
+// IMAPStats reports the connections of all IMAP listeners.
+func (s *Server) IMAPStats() imapserver.ConnStats {
+	s.imapsMu.Lock()
+	defer s.imapsMu.Unlock()
+
+	stats := imapserver.ConnStats{
+		UserConns: make(map[int64]int),
+		IPConns:   make(map[string]int),
+		Commands:  make(map[string]imapserver.CommandStats),
+	}
+	for _, imap := range s.imaps {
+		c := imap.ConnStats()
+		stats.Conns += c.Conns
+		stats.Reaped += c.Reaped
+		stats.Compress.Conns += c.Compress.Conns
+		stats.Compress.InWire += c.Compress.InWire
+		stats.Compress.InData += c.Compress.InData
+		stats.Compress.OutData += c.Compress.OutData
+		stats.Compress.OutWire += c.Compress.OutWire
+		for userID, n := range c.UserConns {
+			stats.UserConns[userID] += n
+		}
+		for ip, n := range c.IPConns {
+			stats.IPConns[ip] += n
+		}
+		for name, cs := range c.Commands {
+			sum := stats.Commands[name]
+			sum.Count += cs.Count
+			sum.Slow += cs.Slow
+			sum.Total += cs.Total
+			if cs.Max > sum.Max {
+				sum.Max = cs.Max
+			}
+			stats.Commands[name] = sum
+		}
+	}
+	return stats
+}
+
+func (s *Server) serveWebPush() {
+	if s.WebPush.Logf == nil {
+		s.WebPush.Logf = s.Logf
+	}
+	if s.WebPush.Expired == nil {
+		s.WebPush.Expired = func(userID int64, sub imap.WebPushSubscription) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			u, err := s.BoxMgmt.Open(ctx, userID)
+			if err == nil {
+				err = u.Box.RemoveWebPush(ctx, sub.Endpoint)
+			}
+			if err != nil {
+				s.Logf("spilldb: web push: user %d: %v", userID, err)
+			}
+		}
+	}
+	s.BoxMgmt.RegisterNotifier(s.WebPush)
+	s.Logf("spilldb: web push starting, VAPID public key %s", s.WebPush.PublicKey())
+}
+
+// ErrNoWebPush is reported by RegisterWebPush when the server
+// does not send Web Push notifications.
+var ErrNoWebPush = errors.New("spilldb: web push is not configured")
+
+// RegisterWebPush subscribes a browser of userID to notifications
+// of new mail in mailbox. The subscription is made with the VAPID
+// public key reported by s.WebPush.PublicKey.
+func (s *Server) RegisterWebPush(ctx context.Context, userID int64, mailbox string, sub imap.WebPushSubscription) error {
+	if s.WebPush == nil {
+		return ErrNoWebPush
+	}
+	u, err := s.BoxMgmt.Open(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return u.Box.RegisterWebPush(ctx, mailbox, sub)
+}
+
 func (s *Server) serveDNS(addr ServerAddr) error {
 	dnsServer := dnsdb.DNS{
 		DB:   s.DB,
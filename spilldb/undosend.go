@@ -0,0 +1,93 @@
+package spilldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"spilled.ink/email/msgcleaver"
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/spillbox"
+)
+
+// CancelSend withdraws a message a user submitted to the MSA while
+// it is held for their undo send window, and puts it in the user's
+// Drafts mailbox to be edited and sent again.
+//
+// A message that has been released to be sent is not cancelled,
+// and db.ErrNotHeld is reported.
+func (s *Server) CancelSend(ctx context.Context, userID, stagingID int64) error {
+	conn := s.DB.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	err := db.CancelHeld(conn, userID, stagingID)
+	s.DB.Put(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := s.saveDraft(ctx, userID, stagingID); err != nil {
+		// Hold it again, it is released at the next tick.
+		conn := s.DB.Get(nil)
+		if err := db.RestoreCancelled(conn, stagingID); err != nil {
+			s.Logf("cancel send %d: restore: %v", stagingID, err)
+		}
+		s.DB.Put(conn)
+		s.Deliverer.Hold(stagingID, time.Now())
+		return err
+	}
+
+	conn = s.DB.Get(nil)
+	defer s.DB.Put(conn)
+	return db.RemoveCancelled(conn, stagingID)
+}
+
+// saveDraft copies a submitted message into the Drafts mailbox
+// of the user who sent it.
+func (s *Server) saveDraft(ctx context.Context, userID, stagingID int64) error {
+	conn := s.DB.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	raw, err := db.LoadMsg(conn, s.Filer, stagingID, true)
+	s.DB.Put(conn)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+
+	msg, err := msgcleaver.Cleave(s.Filer, raw)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+
+	user, err := s.BoxMgmt.Open(ctx, userID)
+	if err != nil {
+		return err
+	}
+	conn = user.Box.PoolRO.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	msg.MailboxID, err = spillbox.DraftsMailboxID(conn)
+	user.Box.PoolRO.Put(conn)
+	if err != nil {
+		return err
+	}
+	if msg.MailboxID == 0 {
+		return fmt.Errorf("spilldb: user %d has no Drafts mailbox", userID)
+	}
+	msg.Flags = []string{`\Draft`, `\Seen`}
+
+	done, err := user.Box.InsertMsg(ctx, msg, 0)
+	if err != nil {
+		return err
+	}
+	if !done {
+		return errors.New("spilldb: missing draft content")
+	}
+	return nil
+}
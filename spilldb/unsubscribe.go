@@ -0,0 +1,130 @@
+package spilldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+	"spilled.ink/smtp/smtpserver"
+	"spilled.ink/spilldb/smtpdb"
+	"spilled.ink/spilldb/spillbox"
+)
+
+// ErrNoUnsubscribe is reported by Unsubscribe for a message that
+// cannot be unsubscribed from without the user visiting a web page.
+var ErrNoUnsubscribe = errors.New("spilldb: message has no one-click or mailto unsubscribe")
+
+// Unsubscribe unsubscribes a user from the mailing list a message
+// came from, using its List-Unsubscribe header.
+//
+// A one-click URL (RFC 8058) is preferred. Otherwise an unsubscribe
+// message is sent to the mailto address, submitted for the user as
+// if by the MSA, from the address the user received the message on.
+func (s *Server) Unsubscribe(ctx context.Context, userID int64, msgID email.MsgID) error {
+	user, err := s.BoxMgmt.Open(ctx, userID)
+	if err != nil {
+		return err
+	}
+	conn := user.Box.PoolRO.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	unsub, err := spillbox.LoadUnsubscribe(conn, msgID)
+	var rcpts []email.Address
+	if err == nil && !unsub.OneClick && unsub.Mailto != "" {
+		rcpts, err = msgRecipients(conn, msgID)
+	}
+	user.Box.PoolRO.Put(conn)
+	if err != nil {
+		return err
+	}
+
+	if unsub.OneClick {
+		return unsub.PostOneClick(ctx)
+	}
+	if unsub.Mailto == "" {
+		return ErrNoUnsubscribe
+	}
+
+	conn = s.DB.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	from, err := unsubscribeFrom(conn, userID, rcpts)
+	s.DB.Put(conn)
+	if err != nil {
+		return err
+	}
+	to, msg, err := unsub.MailtoMsg(from, time.Now())
+	if err != nil {
+		return err
+	}
+	return s.submit(ctx, userID, from, to, msg)
+}
+
+func msgRecipients(conn *sqlite.Conn, msgID email.MsgID) (rcpts []email.Address, err error) {
+	for _, role := range []spillbox.AddressRole{spillbox.RoleTo, spillbox.RoleCC, spillbox.RoleBCC} {
+		addrs, err := spillbox.MsgAddresses(conn, msgID, role)
+		if err != nil {
+			return nil, err
+		}
+		rcpts = append(rcpts, addrs...)
+	}
+	return rcpts, nil
+}
+
+// unsubscribeFrom picks the address of the user a list sent to,
+// or if it cannot be found, the primary address of the user.
+func unsubscribeFrom(conn *sqlite.Conn, userID int64, rcpts []email.Address) (from string, err error) {
+	stmt := conn.Prep(`SELECT Address FROM UserAddresses WHERE UserID = $userID
+		ORDER BY ifnull(PrimaryAddr, 0) DESC, Address;`)
+	stmt.SetInt64("$userID", userID)
+	owned := make(map[string]bool)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return "", err
+		} else if !hasNext {
+			break
+		}
+		addr := stmt.GetText("Address")
+		if from == "" {
+			from = addr
+		}
+		owned[addr] = true
+	}
+	for _, rcpt := range rcpts {
+		if addr := strings.ToLower(rcpt.Addr); owned[addr] {
+			return addr, nil
+		}
+	}
+	if from == "" {
+		return "", fmt.Errorf("spilldb: user %d has no address", userID)
+	}
+	return from, nil
+}
+
+// submit sends a message from a user as the MSA does
+// when the user is authenticated.
+func (s *Server) submit(ctx context.Context, userID int64, from, to string, msg []byte) error {
+	msgMaker := smtpdb.New(ctx, s.DB, s.Filer, s.Lockout, s.msgSubmitted)
+	m, err := msgMaker.NewMessage(nil, []byte(from), smtpserver.MailParams{}, uint64(userID))
+	if err != nil {
+		return err
+	}
+	if ok, err := m.AddRecipient([]byte(to), smtpserver.RcptParams{}); err != nil || !ok {
+		m.Cancel()
+		if err == nil {
+			err = fmt.Errorf("spilldb: recipient %q rejected", to)
+		}
+		return err
+	}
+	if err := m.Write(msg); err != nil {
+		m.Cancel()
+		return err
+	}
+	return m.Close()
+}
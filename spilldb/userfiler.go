@@ -0,0 +1,71 @@
+package spilldb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"crawshaw.io/iox"
+)
+
+// userFilers are the Filers of the users logged in over IMAP.
+//
+// The temporary files holding a user's mail, such as a large
+// APPENDed message, are written to a directory of the user's own
+// under dbdir/tmp, readable only by spilld, not the shared temp
+// directory of the system.
+//
+// Spilled buffers are not encrypted. iox.BufferFile writes to the
+// file as is, and the IMAP parser and mailboxes use it directly,
+// so the dbdir permissions are what keep the files private.
+type userFilers struct {
+	dir string // dbdir/tmp, if empty Server.Filer is used
+
+	mu     sync.Mutex
+	filers map[int64]*iox.Filer
+}
+
+// userFiler returns the Filer of userID, creating it the first time
+// the user logs in. If the user directory cannot be created, it
+// logs the error and returns s.Filer.
+func (s *Server) userFiler(userID int64) *iox.Filer {
+	uf := &s.userFilers
+	if uf.dir == "" {
+		return s.Filer
+	}
+
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	if filer := uf.filers[userID]; filer != nil {
+		return filer
+	}
+	dir := filepath.Join(uf.dir, strconv.FormatInt(userID, 10))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.Logf("spilldb: user %d temp dir: %v", userID, err)
+		return s.Filer
+	}
+	filer := iox.NewFiler(0)
+	filer.SetTempdir(dir)
+	filer.DefaultBufferMemSize = s.Filer.DefaultBufferMemSize
+	filer.Logf = s.Filer.Logf
+	if uf.filers == nil {
+		uf.filers = make(map[int64]*iox.Filer)
+	}
+	uf.filers[userID] = filer
+	return filer
+}
+
+// shutdownUserFilers shuts down the Filer of every user.
+func (s *Server) shutdownUserFilers(ctx context.Context) {
+	uf := &s.userFilers
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	for userID, filer := range uf.filers {
+		if err := filer.Shutdown(ctx); err != nil {
+			s.Logf("spilldb: user %d filer shutdown: %v", userID, err)
+		}
+	}
+	uf.filers = nil
+}
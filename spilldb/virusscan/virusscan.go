@@ -0,0 +1,250 @@
+// Package virusscan checks incoming mail for viruses with clamd.
+//
+// A Hook scans the decoded attachments of each delivery. Infected
+// mail is rejected, or delivered to the spillbox.QuarantineMailbox.
+// The verdict is recorded with the message, see email.Msg.VirusScan.
+//
+// A Handler lets a user ask for an attachment to be scanned
+// again, for when the virus database has been updated.
+package virusscan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"crawshaw.io/sqlite"
+	"spilled.ink/email"
+	"spilled.ink/spilldb/boxmgmt"
+	"spilled.ink/spilldb/db"
+	"spilled.ink/spilldb/deliveryhook"
+	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/util/clamd"
+)
+
+// Hook is a deliveryhook.Hook that scans attachments.
+type Hook struct {
+	Clamd  *clamd.Client
+	Reject bool                                  // reject infected mail instead of quarantining it
+	Logf   func(format string, v ...interface{}) // default log.Printf
+}
+
+func (h *Hook) Deliver(ctx context.Context, d *deliveryhook.Delivery) error {
+	msg := d.Msg
+	if msg.VirusScan == "" {
+		// A message for several users is scanned once,
+		// the cleaved message and its verdict are shared.
+		virus, err := scanParts(ctx, h.Clamd, msg.Parts)
+		if err != nil {
+			return fmt.Errorf("virusscan: staging ID %d: %v", d.Envelope.StagingID, err)
+		}
+		msg.VirusScan = spillbox.VirusClean
+		if virus != "" {
+			msg.VirusScan = virus
+			h.logf("virusscan: staging ID %d: found %s", d.Envelope.StagingID, virus)
+		}
+	}
+	if msg.VirusScan == spillbox.VirusClean {
+		return nil
+	}
+	if h.Reject {
+		return &deliveryhook.RejectError{Reason: "virus found: " + msg.VirusScan}
+	}
+	d.Mailbox = spillbox.QuarantineMailbox
+	return nil
+}
+
+func (h *Hook) logf(format string, v ...interface{}) {
+	if h.Logf != nil {
+		h.Logf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// scanParts scans the content of the attachments in parts.
+// It reports the first virus found, or "" if they are clean.
+func scanParts(ctx context.Context, c *clamd.Client, parts []email.Part) (virus string, err error) {
+	for i := range parts {
+		part := &parts[i]
+		if !part.IsAttachment || part.Content == nil {
+			continue
+		}
+		if virus, err = scanPart(ctx, c, part); err != nil || virus != "" {
+			return virus, err
+		}
+	}
+	return "", nil
+}
+
+func scanPart(ctx context.Context, c *clamd.Client, part *email.Part) (virus string, err error) {
+	if _, err := part.Content.Seek(0, 0); err != nil {
+		return "", fmt.Errorf("part %d: %v", part.PartNum, err)
+	}
+	defer part.Content.Seek(0, 0)
+	virus, err = c.Scan(ctx, part.Content)
+	if err != nil {
+		return "", fmt.Errorf("part %d: %v", part.PartNum, err)
+	}
+	return virus, nil
+}
+
+// Result is the outcome of a Rescan.
+type Result struct {
+	MsgID     email.MsgID `json:"msg_id"`
+	PartNum   int         `json:"part_num"`
+	Virus     string      `json:"virus,omitempty"` // found in the part
+	VirusScan string      `json:"virus_scan"`      // new verdict for the message
+}
+
+// Rescan scans a message part again and updates the verdict of
+// the message. A message that was infected is only marked clean
+// once all of its attachments are found clean.
+//
+// The message is not moved into or out of quarantine.
+func Rescan(ctx context.Context, c *clamd.Client, box *spillbox.Box, msgID email.MsgID, partNum int) (res *Result, err error) {
+	conn := box.PoolRO.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	verdict, err := spillbox.VirusScan(conn, msgID)
+	if err != nil {
+		box.PoolRO.Put(conn)
+		return nil, err
+	}
+	parts, err := spillbox.LoadPartsSummary(conn, msgID)
+	if err == nil {
+		err = loadContent(conn, box, parts, partNum)
+	}
+	box.PoolRO.Put(conn)
+	defer func() {
+		for _, p := range parts {
+			if p.Content != nil {
+				p.Content.Close()
+			}
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("virusscan.Rescan(%s): %v", msgID, err)
+	}
+
+	var part *email.Part
+	for i := range parts {
+		if parts[i].PartNum == partNum {
+			part = &parts[i]
+		}
+	}
+	if part == nil {
+		return nil, fmt.Errorf("virusscan.Rescan(%s): no part %d", msgID, partNum)
+	}
+
+	res = &Result{MsgID: msgID, PartNum: partNum}
+	if res.Virus, err = scanPart(ctx, c, part); err != nil {
+		return nil, fmt.Errorf("virusscan.Rescan(%s): %v", msgID, err)
+	}
+	switch {
+	case res.Virus != "":
+		res.VirusScan = res.Virus
+	case verdict == "" || verdict == spillbox.VirusClean:
+		res.VirusScan = spillbox.VirusClean
+	default:
+		virus, err := scanParts(ctx, c, parts)
+		if err != nil {
+			return nil, fmt.Errorf("virusscan.Rescan(%s): %v", msgID, err)
+		}
+		res.VirusScan = spillbox.VirusClean
+		if virus != "" {
+			res.VirusScan = virus
+		}
+	}
+
+	conn, err = box.GetRW(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer box.PutRW(conn)
+	if err := spillbox.SetVirusScan(conn, msgID, res.VirusScan); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// loadContent loads the content of the attachments in parts,
+// and of part partNum.
+func loadContent(conn *sqlite.Conn, box *spillbox.Box, parts []email.Part, partNum int) error {
+	for i := range parts {
+		part := &parts[i]
+		if !part.IsAttachment && part.PartNum != partNum {
+			continue
+		}
+		if err := box.LoadPartContent(conn, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves rescans for the web frontend:
+//
+//	POST /virusscan/rescan  msg={msgID}&part={partNum}
+//
+// Requests are authenticated with a user's device password using
+// HTTP basic auth. The response is a JSON Result.
+type Handler struct {
+	Clamd   *clamd.Client
+	BoxMgmt *boxmgmt.BoxMgmt
+	Auth    *db.Authenticator
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/virusscan/rescan" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="spilld"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	userID, err := h.Auth.AuthDevice(ctx, remoteAddr, username, []byte(password))
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	msgID, err := spillbox.ParseMsgID(r.FormValue("msg"))
+	if err != nil {
+		http.Error(w, "bad msg", http.StatusBadRequest)
+		return
+	}
+	partNum, err := strconv.Atoi(r.FormValue("part"))
+	if err != nil {
+		http.Error(w, "bad part", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.BoxMgmt.Open(ctx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := Rescan(ctx, h.Clamd, u.Box, msgID, partNum)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
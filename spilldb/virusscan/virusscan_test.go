@@ -0,0 +1,125 @@
+package virusscan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"crawshaw.io/iox"
+	"spilled.ink/email"
+	"spilled.ink/spilldb/deliveryhook"
+	"spilled.ink/spilldb/spillbox"
+	"spilled.ink/util/clamd"
+)
+
+const signature = "FAKE-CLAMD-TEST-SIGNATURE"
+
+// fakeClamd finds "Test.Virus" in streams containing signature.
+// It counts the scans it is asked to do.
+func fakeClamd(t *testing.T, scans chan<- struct{}) (*clamd.Client, net.Listener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := br.ReadString(0); err != nil {
+					return
+				}
+				var content bytes.Buffer
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(br, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					io.CopyN(&content, br, int64(n))
+				}
+				scans <- struct{}{}
+				if strings.Contains(content.String(), signature) {
+					io.WriteString(conn, "stream: Test.Virus FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}()
+		}
+	}()
+	return &clamd.Client{Network: "tcp", Addr: ln.Addr().String()}, ln
+}
+
+func TestHook(t *testing.T) {
+	filer := iox.NewFiler(0)
+	defer filer.Shutdown(context.Background())
+
+	scans := make(chan struct{}, 100)
+	c, ln := fakeClamd(t, scans)
+	defer ln.Close()
+
+	newDelivery := func(attachment string) *deliveryhook.Delivery {
+		msg := &email.Msg{}
+		for i, content := range []string{"hello", attachment} {
+			buf := filer.BufferFile(0)
+			buf.Write([]byte(content))
+			msg.Parts = append(msg.Parts, email.Part{
+				PartNum:      i,
+				IsBody:       i == 0,
+				IsAttachment: i == 1,
+				Content:      buf,
+			})
+		}
+		return &deliveryhook.Delivery{Msg: msg}
+	}
+	ctx := context.Background()
+
+	d := newDelivery("a clean attachment")
+	defer d.Msg.Close()
+	hook := &Hook{Clamd: c, Logf: t.Logf}
+	if err := hook.Deliver(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Msg.VirusScan != spillbox.VirusClean || d.Mailbox != "" {
+		t.Errorf("clean: VirusScan=%q, Mailbox=%q", d.Msg.VirusScan, d.Mailbox)
+	}
+	if got := len(scans); got != 1 {
+		t.Errorf("clean: %d scans, want only the attachment scanned", got)
+	}
+
+	d = newDelivery("infected " + signature)
+	defer d.Msg.Close()
+	if err := hook.Deliver(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Msg.VirusScan != "Test.Virus" || d.Mailbox != spillbox.QuarantineMailbox {
+		t.Errorf("infected: VirusScan=%q, Mailbox=%q", d.Msg.VirusScan, d.Mailbox)
+	}
+	if pos, _ := d.Msg.Parts[1].Content.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Errorf("attachment left at offset %d", pos)
+	}
+
+	// A second recipient of the same message is not scanned again.
+	n := len(scans)
+	d2 := &deliveryhook.Delivery{Msg: d.Msg}
+	hook.Reject = true
+	err := hook.Deliver(ctx, d2)
+	if _, ok := err.(*deliveryhook.RejectError); !ok {
+		t.Errorf("reject: err=%v, want a RejectError", err)
+	}
+	if len(scans) != n {
+		t.Errorf("shared message scanned again")
+	}
+}
@@ -0,0 +1,308 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// DefaultMaxAttempts is the number of times a Sender tries to send
+// a payload. With the backoff between attempts, it gives up about
+// four hours after the event.
+const DefaultMaxAttempts = 10
+
+const (
+	minBackoff = 30 * time.Second
+	maxBackoff = 2 * time.Hour
+)
+
+// backoff is how long to wait after a payload has failed attempts times.
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Sender sends the payloads queued by Enqueue.
+type Sender struct {
+	// Client posts payloads. NewSender sets it to a client
+	// with a 30 second timeout that does not follow redirects,
+	// a redirected POST would become a GET.
+	Client *http.Client
+
+	MaxAttempts int // default DefaultMaxAttempts
+	Logf        func(format string, v ...interface{})
+
+	ctx      context.Context
+	cancelFn func()
+	done     chan struct{}
+
+	pool    *sqlitex.Pool
+	sendNow chan struct{}
+}
+
+func NewSender(pool *sqlitex.Pool) *Sender {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &Sender{
+		Client: &http.Client{
+			Timeout: 30 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Logf:     func(format string, v ...interface{}) {},
+		ctx:      ctx,
+		cancelFn: cancelFn,
+		done:     make(chan struct{}),
+		pool:     pool,
+		sendNow:  make(chan struct{}, 1),
+	}
+}
+
+// SendNow starts sending the queued payloads that are due
+// without waiting for the next periodic scan.
+func (s *Sender) SendNow() {
+	select {
+	case s.sendNow <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Sender) Run() error {
+	defer func() { close(s.done) }()
+
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-t.C:
+		case <-s.sendNow:
+		}
+
+		more, err := s.sendDue()
+		if err != nil {
+			if err == context.Canceled {
+				return nil
+			}
+			return err
+		}
+		if more {
+			s.SendNow()
+		}
+	}
+}
+
+func (s *Sender) Shutdown(ctx context.Context) error {
+	s.cancelFn()
+	<-s.done
+	return nil
+}
+
+// queued is a payload waiting to be sent.
+type queued struct {
+	queueID   int64
+	webhookID int64
+	url       string
+	secret    string
+	event     string
+	payload   []byte
+	attempts  int
+}
+
+func (s *Sender) sendDue() (more bool, err error) {
+	const limit = 16
+
+	conn := s.pool.Get(s.ctx)
+	if conn == nil {
+		return false, context.Canceled
+	}
+	var due []queued
+	stmt := conn.Prep(`SELECT QueueID, WebhookQueue.WebhookID, URL, Secret, Event, Payload, Attempts
+		FROM WebhookQueue
+		INNER JOIN Webhooks ON Webhooks.WebhookID = WebhookQueue.WebhookID
+		WHERE NextAttempt <= $now
+		ORDER BY NextAttempt, QueueID LIMIT $limit;`)
+	stmt.SetInt64("$now", time.Now().Unix())
+	stmt.SetInt64("$limit", limit)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			s.pool.Put(conn)
+			return false, err
+		} else if !hasNext {
+			break
+		}
+		due = append(due, queued{
+			queueID:   stmt.GetInt64("QueueID"),
+			webhookID: stmt.GetInt64("WebhookID"),
+			url:       stmt.GetText("URL"),
+			secret:    stmt.GetText("Secret"),
+			event:     stmt.GetText("Event"),
+			payload:   []byte(stmt.GetText("Payload")),
+			attempts:  int(stmt.GetInt64("Attempts")),
+		})
+	}
+	s.pool.Put(conn)
+
+	errs := make([]error, len(due))
+	var wg sync.WaitGroup
+	for i := range due {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.post(due[i])
+		}(i)
+	}
+	wg.Wait()
+
+	conn = s.pool.Get(s.ctx)
+	if conn == nil {
+		return false, context.Canceled
+	}
+	defer s.pool.Put(conn)
+	now := time.Now()
+	for i, q := range due {
+		if err := s.record(conn, q, errs[i], now); err != nil {
+			return false, err
+		}
+	}
+	return len(due) == limit, nil
+}
+
+// post sends a payload to its webhook.
+func (s *Sender) post(q queued) error {
+	req, err := http.NewRequest("POST", q.url, bytes.NewReader(q.payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(s.ctx)
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "spilld-webhook")
+	req.Header.Set(EventHeader, q.event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(q.queueID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(q.secret, now, q.payload))
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
+
+// record removes a sent payload from the queue. A failed payload is
+// scheduled for another attempt or, after the last, moved to the
+// WebhookDeadLetters.
+func (s *Sender) record(conn *sqlite.Conn, q queued, sendErr error, now time.Time) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if sendErr == nil {
+		stmt := conn.Prep("DELETE FROM WebhookQueue WHERE QueueID = $queueID;")
+		stmt.SetInt64("$queueID", q.queueID)
+		_, err := stmt.Step()
+		return err
+	}
+	if s.ctx.Err() != nil {
+		return nil // shutting down, try again on restart
+	}
+
+	attempts := q.attempts + 1
+	maxAttempts := s.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	if attempts < maxAttempts {
+		stmt := conn.Prep(`UPDATE WebhookQueue
+			SET Attempts = $attempts, NextAttempt = $next, LastError = $err
+			WHERE QueueID = $queueID;`)
+		stmt.SetInt64("$attempts", int64(attempts))
+		stmt.SetInt64("$next", now.Add(backoff(attempts)).Unix())
+		stmt.SetText("$err", sendErr.Error())
+		stmt.SetInt64("$queueID", q.queueID)
+		_, err := stmt.Step()
+		return err
+	}
+
+	s.Logf("webhook %d: dead letter %d (%s) after %d attempts: %v", q.webhookID, q.queueID, q.event, attempts, sendErr)
+	stmt := conn.Prep(`INSERT INTO WebhookDeadLetters
+		(QueueID, WebhookID, URL, Event, Payload, Created, Died, Attempts, LastError)
+		SELECT QueueID, WebhookID, $url, Event, Payload, Created, $now, $attempts, $err
+		FROM WebhookQueue WHERE QueueID = $queueID;`)
+	stmt.SetText("$url", q.url)
+	stmt.SetInt64("$now", now.Unix())
+	stmt.SetInt64("$attempts", int64(attempts))
+	stmt.SetText("$err", sendErr.Error())
+	stmt.SetInt64("$queueID", q.queueID)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	stmt = conn.Prep("DELETE FROM WebhookQueue WHERE QueueID = $queueID;")
+	stmt.SetInt64("$queueID", q.queueID)
+	_, err = stmt.Step()
+	return err
+}
+
+// DeadLetter is a payload that could not be sent.
+type DeadLetter struct {
+	QueueID   int64
+	WebhookID int64
+	URL       string
+	Event     Event
+	Payload   string
+	Created   time.Time
+	Died      time.Time
+	Attempts  int
+	LastError string
+}
+
+// DeadLetters lists the payloads that could not be sent,
+// most recent first.
+func DeadLetters(conn *sqlite.Conn, limit int) (letters []DeadLetter, err error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	stmt := conn.Prep(`SELECT QueueID, WebhookID, URL, Event, Payload, Created, Died, Attempts, LastError
+		FROM WebhookDeadLetters
+		ORDER BY Died DESC, QueueID DESC
+		LIMIT $limit;`)
+	stmt.SetInt64("$limit", int64(limit))
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("webhook.DeadLetters: %v", err)
+		} else if !hasNext {
+			break
+		}
+		letters = append(letters, DeadLetter{
+			QueueID:   stmt.GetInt64("QueueID"),
+			WebhookID: stmt.GetInt64("WebhookID"),
+			URL:       stmt.GetText("URL"),
+			Event:     Event(stmt.GetText("Event")),
+			Payload:   stmt.GetText("Payload"),
+			Created:   time.Unix(stmt.GetInt64("Created"), 0),
+			Died:      time.Unix(stmt.GetInt64("Died"), 0),
+			Attempts:  int(stmt.GetInt64("Attempts")),
+			LastError: stmt.GetText("LastError"),
+		})
+	}
+	return letters, nil
+}
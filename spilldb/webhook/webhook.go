@@ -0,0 +1,251 @@
+// Package webhook tells HTTP endpoints about mail events.
+//
+// A webhook is registered for one user, or for every user, and a set
+// of events: new mail delivered, new mail filed as spam, and mail a
+// user sent bouncing. Each event is a JSON Payload POSTed to the
+// webhook URL and signed with the webhook secret, see Sign.
+//
+// Events are queued in the spilld database by Enqueue, in the same
+// transaction that records the event, so a restart loses none.
+// A Sender posts them, retrying failures with exponential backoff.
+// A payload that still fails after MaxAttempts is logged and moved
+// to the WebhookDeadLetters table.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Event is a kind of mail event a webhook is told about.
+type Event string
+
+const (
+	EventDelivered Event = "delivered" // new mail filed in a mailbox
+	EventSpam      Event = "spam"      // new mail filed in the Junk mailbox
+	EventBounce    Event = "bounce"    // mail sent by the user failed permanently
+)
+
+// Events are all the events a webhook can be told about.
+var Events = []Event{EventDelivered, EventSpam, EventBounce}
+
+func (e Event) valid() bool {
+	for _, event := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload is the JSON body POSTed to a webhook.
+// New mail is either delivered or spam, never both.
+type Payload struct {
+	Event     Event     `json:"event"`
+	Time      time.Time `json:"time"`
+	UserID    int64     `json:"user_id"`
+	StagingID int64     `json:"staging_id,omitempty"`
+	MsgID     int64     `json:"msg_id,omitempty"`  // delivered, spam: the message in the user's mailbox
+	Mailbox   string    `json:"mailbox,omitempty"` // delivered, spam
+	From      string    `json:"from,omitempty"`    // SMTP MAIL FROM
+	Subject   string    `json:"subject,omitempty"`
+
+	// Recipient and Diagnostic describe a bounce.
+	Recipient  string `json:"recipient,omitempty"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+}
+
+// Webhook is an HTTP endpoint told about events.
+type Webhook struct {
+	WebhookID int64
+	UserID    int64 // 0 for the events of every user
+	URL       string
+	Secret    string
+	Events    []Event
+	Created   time.Time
+}
+
+// NewSecret generates a secret for signing payloads.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Add registers a webhook. The URL must be http or https.
+func Add(conn *sqlite.Conn, hook Webhook) (webhookID int64, err error) {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return 0, fmt.Errorf("webhook.Add: %v", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return 0, fmt.Errorf("webhook.Add: %q is not an http or https URL", hook.URL)
+	}
+	if hook.Secret == "" {
+		return 0, errors.New("webhook.Add: no secret")
+	}
+	if len(hook.Events) == 0 {
+		return 0, errors.New("webhook.Add: no events")
+	}
+	events := make([]string, len(hook.Events))
+	for i, e := range hook.Events {
+		if !e.valid() {
+			return 0, fmt.Errorf("webhook.Add: unknown event %q", e)
+		}
+		events[i] = string(e)
+	}
+	if hook.Created.IsZero() {
+		hook.Created = time.Now()
+	}
+
+	stmt := conn.Prep(`INSERT INTO Webhooks (UserID, URL, Secret, Events, Created)
+		VALUES ($userID, $url, $secret, $events, $created);`)
+	if hook.UserID != 0 {
+		stmt.SetInt64("$userID", hook.UserID)
+	} else {
+		stmt.SetNull("$userID")
+	}
+	stmt.SetText("$url", hook.URL)
+	stmt.SetText("$secret", hook.Secret)
+	stmt.SetText("$events", strings.Join(events, " "))
+	stmt.SetInt64("$created", hook.Created.Unix())
+	if _, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("webhook.Add: %v", err)
+	}
+	return conn.LastInsertRowID(), nil
+}
+
+// Remove removes a webhook and the payloads queued for it.
+func Remove(conn *sqlite.Conn, webhookID int64) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep("DELETE FROM WebhookQueue WHERE WebhookID = $webhookID;")
+	stmt.SetInt64("$webhookID", webhookID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("webhook.Remove(%d): %v", webhookID, err)
+	}
+	stmt = conn.Prep("DELETE FROM Webhooks WHERE WebhookID = $webhookID;")
+	stmt.SetInt64("$webhookID", webhookID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("webhook.Remove(%d): %v", webhookID, err)
+	}
+	if conn.Changes() == 0 {
+		return fmt.Errorf("webhook.Remove(%d): no such webhook", webhookID)
+	}
+	return nil
+}
+
+// List lists the webhooks of a user, or with a userID of 0,
+// every webhook.
+func List(conn *sqlite.Conn, userID int64) (hooks []Webhook, err error) {
+	where := ""
+	if userID != 0 {
+		where = "WHERE UserID = $userID"
+	}
+	stmt := conn.Prep(`SELECT WebhookID, ifnull(UserID, 0) AS UserID, URL, Secret, Events, Created
+		FROM Webhooks ` + where + ` ORDER BY WebhookID;`)
+	if userID != 0 {
+		stmt.SetInt64("$userID", userID)
+	}
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("webhook.List: %v", err)
+		} else if !hasNext {
+			break
+		}
+		hook := Webhook{
+			WebhookID: stmt.GetInt64("WebhookID"),
+			UserID:    stmt.GetInt64("UserID"),
+			URL:       stmt.GetText("URL"),
+			Secret:    stmt.GetText("Secret"),
+			Created:   time.Unix(stmt.GetInt64("Created"), 0),
+		}
+		for _, e := range strings.Fields(stmt.GetText("Events")) {
+			hook.Events = append(hook.Events, Event(e))
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// Enqueue queues a payload for every webhook of its user, or of
+// every user, that wants its event.
+//
+// It is called in the transaction that records the event.
+// A zero p.Time is the present.
+func Enqueue(conn *sqlite.Conn, p Payload) error {
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("webhook.Enqueue: %v", err)
+	}
+	stmt := conn.Prep(`INSERT INTO WebhookQueue (WebhookID, Event, Payload, Created, Attempts, NextAttempt)
+		SELECT WebhookID, $event, $payload, $now, 0, $now
+		FROM Webhooks
+		WHERE (UserID IS NULL OR UserID = $userID)
+		AND ' ' || Events || ' ' LIKE '% ' || $event || ' %';`)
+	stmt.SetText("$event", string(p.Event))
+	stmt.SetText("$payload", string(body))
+	stmt.SetInt64("$now", p.Time.Unix())
+	stmt.SetInt64("$userID", p.UserID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("webhook.Enqueue: %v", err)
+	}
+	return nil
+}
+
+// HTTP headers sent with each payload.
+const (
+	EventHeader     = "X-Spilld-Event"
+	DeliveryHeader  = "X-Spilld-Delivery" // unique ID of the payload, repeated on retries
+	TimestampHeader = "X-Spilld-Timestamp"
+	SignatureHeader = "X-Spilld-Signature"
+)
+
+// Sign computes the X-Spilld-Signature of a payload: "v1=" and the
+// hex HMAC-SHA256, keyed by the webhook secret, of the decimal Unix
+// X-Spilld-Timestamp, a period, and the body.
+//
+// Signing the timestamp lets a receiver refuse replayed payloads.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a payload received by a webhook.
+// Payloads signed more than maxAge before now are refused.
+func Verify(secret string, header http.Header, body []byte, maxAge time.Duration, now time.Time) error {
+	sec, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("webhook: bad %s: %v", TimestampHeader, err)
+	}
+	timestamp := time.Unix(sec, 0)
+	if d := now.Sub(timestamp); d > maxAge || d < -maxAge {
+		return fmt.Errorf("webhook: payload signed at %s, too far from %s", timestamp, now)
+	}
+	want := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(want)) {
+		return errors.New("webhook: bad signature")
+	}
+	return nil
+}
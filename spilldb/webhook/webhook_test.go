@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"spilled.ink/spilldb/db"
+)
+
+func TestSignVerify(t *testing.T) {
+	const secret = "shh"
+	now := time.Unix(1500000000, 0)
+	body := []byte(`{"event":"delivered"}`)
+
+	header := make(http.Header)
+	header.Set(TimestampHeader, "1500000000")
+	header.Set(SignatureHeader, Sign(secret, now, body))
+	if err := Verify(secret, header, body, 5*time.Minute, now.Add(time.Minute)); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if err := Verify("other", header, body, 5*time.Minute, now); err == nil {
+		t.Error("Verify with the wrong secret succeeded")
+	}
+	if err := Verify(secret, header, []byte(`{"event":"spam"}`), 5*time.Minute, now); err == nil {
+		t.Error("Verify of a changed body succeeded")
+	}
+	if err := Verify(secret, header, body, 5*time.Minute, now.Add(time.Hour)); err == nil {
+		t.Error("Verify of an old payload succeeded")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var total time.Duration
+	for attempts := 1; attempts < DefaultMaxAttempts; attempts++ {
+		d := backoff(attempts)
+		if d < minBackoff || d > maxBackoff {
+			t.Errorf("backoff(%d) = %v", attempts, d)
+		}
+		total += d
+	}
+	if total < 3*time.Hour || total > 5*time.Hour {
+		t.Errorf("all retries take %v, want about four hours", total)
+	}
+}
+
+func openDB(t *testing.T) *sqlitex.Pool {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "webhook-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpool, err := db.Open(filepath.Join(dir, "spilld.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbpool
+}
+
+func TestSender(t *testing.T) {
+	dbpool := openDB(t)
+	defer dbpool.Close()
+
+	var mu sync.Mutex
+	var got []Payload
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify("secret", r.Header, body, time.Minute, time.Now()); err != nil {
+			t.Errorf("server: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("server: %v", err)
+		}
+		got = append(got, p)
+	}))
+	defer ts.Close()
+
+	conn := dbpool.Get(nil)
+	defer dbpool.Put(conn)
+	userID, err := db.AddUser(conn, db.UserDetails{
+		EmailAddr: "foo@spilled.ink",
+		Password:  "agenericpassword",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Add(conn, Webhook{
+		UserID: userID,
+		URL:    ts.URL,
+		Secret: "secret",
+		Events: []Event{EventBounce, EventDelivered},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Add(conn, Webhook{URL: "ftp://example.com", Secret: "secret", Events: Events}); err == nil {
+		t.Error("Add of an ftp URL succeeded")
+	}
+
+	for _, p := range []Payload{
+		{Event: EventDelivered, UserID: userID, MsgID: 7, Mailbox: "INBOX"},
+		{Event: EventSpam, UserID: userID, MsgID: 8},          // not wanted
+		{Event: EventDelivered, UserID: userID + 1, MsgID: 9}, // other user
+	} {
+		if err := Enqueue(conn, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewSender(dbpool)
+	s.MaxAttempts = 2
+	if _, err := s.sendDue(); err != nil {
+		t.Fatal(err)
+	}
+	queueLen := func() int64 {
+		n, err := sqlitex.ResultInt64(conn.Prep("SELECT count(*) FROM WebhookQueue;"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := queueLen(); n != 1 {
+		t.Fatalf("after a failure, queue has %d payloads, want 1", n)
+	}
+
+	// Retry now rather than after the backoff.
+	if _, err := conn.Prep("UPDATE WebhookQueue SET NextAttempt = 0;").Step(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sendDue(); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLen(); n != 0 {
+		t.Fatalf("after the last attempt, queue has %d payloads", n)
+	}
+	letters, err := DeadLetters(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Attempts != 2 || letters[0].URL != ts.URL {
+		t.Fatalf("dead letters: %+v", letters)
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if err := Enqueue(conn, Payload{Event: EventBounce, UserID: userID, Recipient: "bar@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sendDue(); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLen(); n != 0 {
+		t.Errorf("after sending, queue has %d payloads", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0].Event != EventBounce || got[0].Recipient != "bar@example.com" {
+		t.Errorf("received %+v", got)
+	}
+}
@@ -0,0 +1,348 @@
+// Package webpush sends new mail notifications to browsers with
+// Web Push, RFC 8030.
+//
+// Notifications are encrypted for the subscriber as described in
+// RFC 8291 and the sender identifies itself to push services with
+// a VAPID key, RFC 8292. Browsers subscribe with the public key
+// reported by Sender.PublicKey as the applicationServerKey.
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"spilled.ink/imap"
+)
+
+// Sender sends Web Push notifications. It is an imap.Notifier.
+type Sender struct {
+	Key     *ecdsa.PrivateKey // VAPID key, P-256
+	Subject string            // VAPID contact, a mailto: or https: URL
+	Client  *http.Client      // default defaultClient
+	TTL     time.Duration     // time a push service holds a notification, default 1 day
+	Logf    func(format string, v ...interface{})
+
+	// Expired, if set, is called with the subscriptions a
+	// push service reports no longer exist.
+	Expired func(userID int64, sub imap.WebPushSubscription)
+}
+
+// defaultClient posts notifications with a 30 second timeout
+// and does not follow redirects, a redirected POST would become
+// a GET and a push service has no reason to redirect.
+var defaultClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Notification is the JSON payload of a push message.
+type Notification struct {
+	Mailbox string `json:"mailbox"`
+}
+
+// LoadKey reads a PEM encoded P-256 private key from a file,
+// as created by:
+//
+//	openssl ecparam -name prime256v1 -genkey -noout -out vapid.pem
+func LoadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("webpush: %s: no PEM data", path)
+	}
+	var key *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = k.(*ecdsa.PrivateKey); !ok {
+				err = fmt.Errorf("key is %T, want ECDSA", k)
+			}
+		}
+	default:
+		err = fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("webpush: %s: %v", path, err)
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("webpush: %s: key is not P-256", path)
+	}
+	return key, nil
+}
+
+// PublicKey reports the VAPID public key in the base64url form
+// browsers take as the applicationServerKey of a subscription.
+func (s *Sender) PublicKey() string {
+	pub := elliptic.Marshal(elliptic.P256(), s.Key.X, s.Key.Y)
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// Notify sends a notification to each Web Push subscription.
+func (s *Sender) Notify(userID int64, mailboxID int64, mailboxName string, devices imap.PushDevices) {
+	if len(devices.Web) == 0 {
+		return
+	}
+	payload, err := json.Marshal(Notification{Mailbox: mailboxName})
+	if err != nil {
+		panic("webpush: bad JSON: " + err.Error())
+	}
+	for _, sub := range devices.Web {
+		err := s.Send(sub, payload)
+		if err == errGone {
+			s.logf("webpush: user %d: subscription expired: %s", userID, sub.Endpoint)
+			if s.Expired != nil {
+				s.Expired(userID, sub)
+			}
+		} else if err != nil {
+			s.logf("webpush: user %d: %v", userID, err)
+		}
+	}
+}
+
+var errGone = errors.New("webpush: subscription gone")
+
+// ParseSubscription parses the JSON form of a browser's
+// PushSubscription, as reported by its toJSON method:
+//
+//	{"endpoint": "https://...", "keys": {"p256dh": "...", "auth": "..."}}
+//
+// The endpoint must be an https URL and the keys must be usable
+// to encrypt notifications.
+func ParseSubscription(data []byte) (imap.WebPushSubscription, error) {
+	var v struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256DH string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return imap.WebPushSubscription{}, fmt.Errorf("webpush: bad subscription: %v", err)
+	}
+	sub := imap.WebPushSubscription{
+		Endpoint: v.Endpoint,
+		P256DH:   v.Keys.P256DH,
+		Auth:     v.Keys.Auth,
+	}
+	if endpoint, err := url.Parse(sub.Endpoint); err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return imap.WebPushSubscription{}, fmt.Errorf("webpush: bad endpoint %q", sub.Endpoint)
+	}
+	if uaPublic, err := decodeBase64(sub.P256DH); err != nil {
+		return imap.WebPushSubscription{}, fmt.Errorf("webpush: bad p256dh key: %v", err)
+	} else if x, _ := elliptic.Unmarshal(elliptic.P256(), uaPublic); x == nil {
+		return imap.WebPushSubscription{}, errors.New("webpush: bad p256dh key")
+	}
+	if authSecret, err := decodeBase64(sub.Auth); err != nil || len(authSecret) != 16 {
+		return imap.WebPushSubscription{}, errors.New("webpush: bad auth secret")
+	}
+	return sub, nil
+}
+
+// Send sends an encrypted payload to a subscription.
+func (s *Sender) Send(sub imap.WebPushSubscription, payload []byte) error {
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" {
+		return fmt.Errorf("webpush: bad endpoint %q", sub.Endpoint)
+	}
+	uaPublic, err := decodeBase64(sub.P256DH)
+	if err != nil {
+		return fmt.Errorf("webpush: bad p256dh key: %v", err)
+	}
+	authSecret, err := decodeBase64(sub.Auth)
+	if err != nil {
+		return fmt.Errorf("webpush: bad auth secret: %v", err)
+	}
+
+	asKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	body, err := encrypt(payload, uaPublic, authSecret, asKey, salt)
+	if err != nil {
+		return fmt.Errorf("webpush: %v", err)
+	}
+
+	jwt, err := s.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return fmt.Errorf("webpush: %v", err)
+	}
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webpush: %v", err)
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(ttl/time.Second)))
+	req.Header.Set("Authorization", "vapid t="+jwt+", k="+s.PublicKey())
+
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webpush: %v", err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return errGone
+	case res.StatusCode/100 != 2:
+		return fmt.Errorf("webpush: %s: %s", endpoint.Host, res.Status)
+	}
+	return nil
+}
+
+// vapidToken returns a signed JWT for the push service at aud, RFC 8292.
+func (s *Sender) vapidToken(aud string) (string, error) {
+	header := `{"typ":"JWT","alg":"ES256"}`
+	claims, err := json.Marshal(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub,omitempty"`
+	}{
+		Aud: aud,
+		Exp: time.Now().Add(12 * time.Hour).Unix(),
+		Sub: s.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.Key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	sigBytes := append(fixedBytes(r, 32), fixedBytes(sig, 32)...)
+	return unsigned + "." + enc.EncodeToString(sigBytes), nil
+}
+
+// recordSize is the aes128gcm record size. Notifications are
+// small and always fit in a single record.
+const recordSize = 4096
+
+// encrypt encrypts plaintext for the user agent as described in
+// RFC 8291 section 3, using the application server key asKey.
+func encrypt(plaintext, uaPublic, authSecret []byte, asKey *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("bad p256dh key")
+	}
+	if len(authSecret) != 16 {
+		return nil, fmt.Errorf("auth secret is %d bytes, want 16", len(authSecret))
+	}
+	asPublic := elliptic.Marshal(curve, asKey.X, asKey.Y)
+
+	sx, _ := curve.ScalarMult(uaX, uaY, asKey.D.Bytes())
+	ecdhSecret := fixedBytes(sx, 32)
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	record := append(append([]byte{}, plaintext...), 0x02) // last record delimiter
+	if len(record)+gcm.Overhead() > recordSize {
+		return nil, fmt.Errorf("payload too big: %d bytes", len(plaintext))
+	}
+
+	// RFC 8188 section 2.1 header: salt, rs, idlen, keyid.
+	body := make([]byte, 0, 16+4+1+len(asPublic)+len(record)+gcm.Overhead())
+	body = append(body, salt...)
+	var rs [4]byte
+	binary.BigEndian.PutUint32(rs[:], recordSize)
+	body = append(body, rs[:]...)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	return gcm.Seal(body, nonce, record, nil), nil
+}
+
+// hkdf is HKDF-SHA-256, RFC 5869, for an output of at most 32 bytes.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)[:length]
+}
+
+// decodeBase64 decodes base64url with or without padding,
+// browsers and libraries produce both.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func (s *Sender) logf(format string, v ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, v...)
+	}
+}
+
+// fixedBytes returns n as a big-endian number of size bytes.
+func fixedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b[len(b)-size:]
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,209 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"spilled.ink/imap"
+)
+
+func b64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestEncrypt checks the example from RFC 8291 Appendix A.
+func TestEncrypt(t *testing.T) {
+	const (
+		plaintext  = "When I grow up, I want to be a watermelon"
+		asPrivate  = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+		uaPublic   = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+		authSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+		salt       = "DGv6ra1nlYgDCS1FRnbzlw"
+		want       = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	)
+
+	curve := elliptic.P256()
+	asKey := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(b64(t, asPrivate))}
+	asKey.Curve = curve
+	asKey.X, asKey.Y = curve.ScalarBaseMult(asKey.D.Bytes())
+
+	body, err := encrypt([]byte(plaintext), b64(t, uaPublic), b64(t, authSecret), asKey, b64(t, salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got != want {
+		t.Errorf("encrypt:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestSend(t *testing.T) {
+	vapidKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPublic := elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)
+
+	var gotAuth, gotEncoding string
+	var gotLen int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		gotAuth = r.Header.Get("Authorization")
+		gotEncoding = r.Header.Get("Content-Encoding")
+		gotLen = int(r.ContentLength)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	var expired []string
+	s := &Sender{
+		Key:     vapidKey,
+		Subject: "mailto:postmaster@example.com",
+		Client:  ts.Client(),
+		Expired: func(userID int64, sub imap.WebPushSubscription) {
+			expired = append(expired, sub.Endpoint)
+		},
+	}
+	sub := imap.WebPushSubscription{
+		Endpoint: ts.URL + "/push/1",
+		P256DH:   base64.RawURLEncoding.EncodeToString(uaPublic),
+		Auth:     "BTBZMqHH6r4Tts7J_aSIgg==",
+	}
+	gone := sub
+	gone.Endpoint = ts.URL + "/gone"
+	s.Notify(1, 1, "INBOX", imap.PushDevices{Web: []imap.WebPushSubscription{sub, gone}})
+
+	if gotEncoding != "aes128gcm" {
+		t.Errorf("Content-Encoding: %q", gotEncoding)
+	}
+	payload, _ := json.Marshal(Notification{Mailbox: "INBOX"})
+	if want := 16 + 4 + 1 + 65 + len(payload) + 1 + 16; gotLen != want {
+		t.Errorf("body length %d, want %d", gotLen, want)
+	}
+	if len(expired) != 1 || expired[0] != gone.Endpoint {
+		t.Errorf("expired: %v, want %s", expired, gone.Endpoint)
+	}
+
+	// Authorization: vapid t=<jwt>, k=<key>
+	if !strings.HasPrefix(gotAuth, "vapid t=") {
+		t.Fatalf("Authorization: %q", gotAuth)
+	}
+	i := strings.Index(gotAuth, ", k=")
+	if i == -1 {
+		t.Fatalf("Authorization: %q", gotAuth)
+	}
+	jwt, k := gotAuth[len("vapid t="):i], gotAuth[i+len(", k="):]
+	if k != s.PublicKey() {
+		t.Errorf("k=%s, want %s", k, s.PublicKey())
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT: %q", jwt)
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(b64(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != ts.URL || claims.Sub != s.Subject {
+		t.Errorf("claims: %+v", claims)
+	}
+	sig := b64(t, parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&vapidKey.PublicKey, hash[:], r, ss) {
+		t.Error("JWT signature does not verify")
+	}
+}
+
+func TestSendNoRedirect(t *testing.T) {
+	vapidKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirected := false
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere" {
+			redirected = true
+			return
+		}
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	client := *defaultClient
+	client.Transport = ts.Client().Transport
+	s := &Sender{Key: vapidKey, Client: &client}
+	sub := imap.WebPushSubscription{
+		Endpoint: ts.URL + "/push/1",
+		P256DH:   base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)),
+		Auth:     "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	if err := s.Send(sub, []byte("{}")); err == nil || !strings.Contains(err.Error(), "302") {
+		t.Errorf("Send: %v, want 302 error", err)
+	}
+	if redirected {
+		t.Error("redirect followed")
+	}
+	if defaultClient.Timeout == 0 {
+		t.Error("default client has no timeout")
+	}
+}
+
+func TestParseSubscription(t *testing.T) {
+	uaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256dh := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y))
+	const auth = "BTBZMqHH6r4Tts7J_aSIgg"
+
+	sub, err := ParseSubscription([]byte(`{"endpoint": "https://push.example.com/a", "expirationTime": null, "keys": {"p256dh": "` + p256dh + `", "auth": "` + auth + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := imap.WebPushSubscription{Endpoint: "https://push.example.com/a", P256DH: p256dh, Auth: auth}
+	if sub != want {
+		t.Errorf("sub=%+v, want %+v", sub, want)
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"endpoint": "http://push.example.com/a", "keys": {"p256dh": "` + p256dh + `", "auth": "` + auth + `"}}`,
+		`{"endpoint": "https:///a", "keys": {"p256dh": "` + p256dh + `", "auth": "` + auth + `"}}`,
+		`{"endpoint": "https://push.example.com/a", "keys": {"p256dh": "AAAA", "auth": "` + auth + `"}}`,
+		`{"endpoint": "https://push.example.com/a", "keys": {"p256dh": "` + p256dh + `", "auth": "AAAA"}}`,
+		`{"endpoint": "https://push.example.com/a"}`,
+	} {
+		if _, err := ParseSubscription([]byte(bad)); err == nil {
+			t.Errorf("ParseSubscription(%s) succeeded", bad)
+		}
+	}
+}
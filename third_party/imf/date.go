@@ -0,0 +1,291 @@
+package imf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDate parses the value of a Date header field.
+//
+// It accepts the RFC 5322 date-time and the obsolete forms of
+// section 4.3, and is lenient with what is found in the wild:
+// a missing day of the week or seconds, one-digit days, full month
+// names, two-digit years, zone names, zones with a colon or without
+// minutes, comments such as "(PDT)", and the asctime format
+// "Mon Jan  2 15:04:05 2006".
+//
+// A zone that is missing or not recognized is treated as UTC.
+func ParseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC1123Z, s); err == nil {
+		return t, nil // the common case
+	}
+
+	// Comments are dropped, except that a zone name given
+	// only as a comment, "12:00:00 (EST)", is used.
+	var fields []string
+	var commentZone string
+	rest := s
+	for len(rest) > 0 {
+		i := strings.IndexByte(rest, '(')
+		if i < 0 {
+			fields = append(fields, strings.Fields(rest)...)
+			break
+		}
+		fields = append(fields, strings.Fields(rest[:i])...)
+		j := strings.IndexByte(rest[i:], ')')
+		if j < 0 {
+			break
+		}
+		if c := strings.TrimSpace(rest[i+1 : i+j]); commentZone == "" {
+			if _, ok := zoneNames[strings.ToUpper(c)]; ok {
+				commentZone = c
+			}
+		}
+		rest = rest[i+j+1:]
+	}
+	// Some commas end up attached to the wrong field, "Mon ,2 Jan".
+	var toks []string
+	for _, f := range fields {
+		for _, tok := range strings.Split(f, ",") {
+			if tok != "" {
+				toks = append(toks, tok)
+			}
+		}
+	}
+
+	if len(toks) == 1 {
+		// No spaces, maybe RFC 3339.
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, toks[0]); err == nil {
+				return t, nil
+			}
+		}
+	}
+
+	var (
+		year, month, day   = -1, 0, -1
+		hour, min, sec     = -1, 0, 0
+		offset, haveOffset = 0, false
+		zoneName           string
+		yearDigits         int
+	)
+	bad := func() (time.Time, error) {
+		return time.Time{}, fmt.Errorf("mail: bad date %q", s)
+	}
+	for _, tok := range toks {
+		switch c := tok[0]; {
+		case c == '+' || c == '-':
+			var ok bool
+			if offset, ok = parseOffset(tok); !ok {
+				return bad()
+			}
+			haveOffset = true
+		case strings.IndexByte(tok, ':') > 0:
+			if hour != -1 {
+				return bad()
+			}
+			var ok bool
+			if hour, min, sec, ok = parseClock(tok); !ok {
+				return bad()
+			}
+		case c >= '0' && c <= '9':
+			// ISO 8601 dates show up too, "2006-01-02 15:04:05".
+			if parts := strings.Split(tok, "-"); len(parts) == 3 && month == 0 {
+				y, err1 := strconv.Atoi(parts[0])
+				m, err2 := strconv.Atoi(parts[1])
+				d, err3 := strconv.Atoi(parts[2])
+				if err1 != nil || err2 != nil || err3 != nil || m < 1 || m > 12 {
+					return bad()
+				}
+				year, month, day, yearDigits = y, m, d, len(parts[0])
+				continue
+			}
+			n, err := strconv.Atoi(tok)
+			if err != nil {
+				return bad()
+			}
+			switch {
+			case len(tok) >= 3 && year == -1:
+				year, yearDigits = n, len(tok)
+			case day == -1:
+				day = n
+			case year == -1:
+				year, yearDigits = n, len(tok)
+			default:
+				return bad()
+			}
+		default:
+			upper := strings.ToUpper(tok)
+			if m := parseMonth(upper); m != 0 && month == 0 {
+				month = m
+				continue
+			}
+			if isWeekday(upper) {
+				continue
+			}
+			if i := strings.IndexAny(upper, "+-"); i > 0 {
+				// "GMT+0100"
+				if _, ok := zoneNames[upper[:i]]; ok {
+					var ok bool
+					if offset, ok = parseOffset(upper[i:]); !ok {
+						return bad()
+					}
+					haveOffset = true
+					continue
+				}
+			}
+			if _, ok := zoneNames[upper]; ok || hour != -1 {
+				// Words after the time name a zone,
+				// "Eastern Standard Time". Use the first.
+				if zoneName == "" {
+					zoneName = upper
+				}
+				continue
+			}
+			return bad()
+		}
+	}
+	if year == -1 || month == 0 || day == -1 || hour == -1 {
+		return bad()
+	}
+
+	// RFC 5322 section 4.3, obsolete years.
+	switch {
+	case yearDigits == 2 && year < 50:
+		year += 2000
+	case yearDigits <= 3:
+		year += 1900
+	}
+
+	loc := time.UTC
+	switch {
+	case haveOffset:
+		if offset != 0 {
+			loc = time.FixedZone("", offset)
+		}
+	case zoneName != "" || commentZone != "":
+		if zoneName == "" {
+			zoneName = strings.ToUpper(commentZone)
+		}
+		if off := zoneNames[zoneName]; off != 0 {
+			loc = time.FixedZone(zoneName, off)
+		}
+	}
+	if sec == 60 {
+		sec = 59 // leap second
+	}
+	t := time.Date(year, time.Month(month), day, hour, min, sec, 0, loc)
+	if t.Day() != day {
+		return bad() // 31 Feb
+	}
+	return t, nil
+}
+
+// parseClock parses hh:mm, hh:mm:ss, or hh:mm:ss.frac.
+// Fractions of a second are dropped.
+func parseClock(s string) (hour, min, sec int, ok bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, 0, false
+	}
+	if len(parts) == 3 {
+		if i := strings.IndexByte(parts[2], '.'); i >= 0 {
+			parts[2] = parts[2][:i]
+		}
+	}
+	var n [3]int
+	for i, p := range parts {
+		if len(p) == 0 || len(p) > 2 {
+			return 0, 0, 0, false
+		}
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		n[i] = v
+	}
+	if n[0] > 23 || n[1] > 59 || n[2] > 60 {
+		return 0, 0, 0, false
+	}
+	return n[0], n[1], n[2], true
+}
+
+// parseOffset parses a numeric zone: +hhmm, +hh:mm, or +hh.
+// It reports the offset in seconds east of UTC.
+func parseOffset(s string) (int, bool) {
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+	s = strings.Replace(s[1:], ":", "", 1)
+	if len(s) == 2 {
+		s += "00"
+	}
+	if len(s) != 4 {
+		return 0, false
+	}
+	hh, err1 := strconv.Atoi(s[:2])
+	mm, err2 := strconv.Atoi(s[2:])
+	if err1 != nil || err2 != nil || hh > 23 || mm > 59 {
+		return 0, false
+	}
+	return sign * (hh*3600 + mm*60), true
+}
+
+// parseMonth reports the month named by an upper case English
+// month name or its three letter abbreviation, or 0.
+func parseMonth(s string) int {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) < 3 {
+		return 0
+	}
+	for i, name := range monthNames {
+		if strings.HasPrefix(name, s) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+var monthNames = []string{
+	"JANUARY", "FEBRUARY", "MARCH", "APRIL", "MAY", "JUNE", "JULY",
+	"AUGUST", "SEPTEMBER", "OCTOBER", "NOVEMBER", "DECEMBER",
+}
+
+func isWeekday(s string) bool {
+	if len(s) < 3 {
+		return false
+	}
+	s = strings.TrimSuffix(s, ".")
+	for _, name := range []string{"MONDAY", "TUESDAY", "WEDNESDAY", "THURSDAY", "FRIDAY", "SATURDAY", "SUNDAY"} {
+		if strings.HasPrefix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneNames are the zone names recognized by ParseDate with their
+// offsets in seconds east of UTC. They include the obsolete zones
+// of RFC 5322 section 4.3 and some common in the wild.
+// Any other name, such as a military zone, is treated as UTC,
+// as the RFC suggests.
+var zoneNames = map[string]int{
+	"UT": 0, "UTC": 0, "GMT": 0, "Z": 0, "WET": 0,
+	"EST": -5 * 3600, "EDT": -4 * 3600,
+	"CST": -6 * 3600, "CDT": -5 * 3600,
+	"MST": -7 * 3600, "MDT": -6 * 3600,
+	"PST": -8 * 3600, "PDT": -7 * 3600,
+	"AKST": -9 * 3600, "AKDT": -8 * 3600,
+	"HST": -10 * 3600,
+	"BST": 1 * 3600, "WEST": 1 * 3600,
+	"CET": 1 * 3600, "CEST": 2 * 3600,
+	"MET": 1 * 3600, "MEST": 2 * 3600,
+	"EET": 2 * 3600, "EEST": 3 * 3600,
+	"MSK": 3 * 3600,
+	"JST": 9 * 3600, "KST": 9 * 3600,
+	"AEST": 10 * 3600, "AEDT": 11 * 3600,
+	"NZST": 12 * 3600, "NZDT": 13 * 3600,
+}
@@ -0,0 +1,74 @@
+package imf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	zone := func(off int) *time.Location { return time.FixedZone("", off*3600) }
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"Fri, 13 Jul 2018 16:39:01 -0000", time.Date(2018, 7, 13, 16, 39, 1, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05 -0700", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"Mon, 4 Mar 2019 15:04:05 -0700", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"4 Mar 2019 15:04:05 +0100", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(1))},
+		{"Mon, 04 Mar 2019 15:04 -0700", time.Date(2019, 3, 4, 15, 4, 0, 0, zone(-7))},
+		{"Mon, 04 Mar 19 15:04:05 -0700", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"Thu, 01 Jan 98 00:00:00 +0000", time.Date(1998, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"Thu, 01 Jan 102 00:00:00 +0000", time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05 GMT", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05 UT", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05 EST", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-5))},
+		{"Mon, 04 Mar 2019 15:04:05 pdt", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"Mon, 04 Mar 2019 15:04:05 CEST", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(2))},
+		{"Mon, 04 Mar 2019 15:04:05 J", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05 Eastern Standard Time", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05 -0700 (PDT)", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"Mon, 04 Mar 2019 15:04:05 (PDT)", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"Mon, 04 Mar 2019 15:04:05 +01:00", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(1))},
+		{"Mon, 04 Mar 2019 15:04:05 +01", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(1))},
+		{"Mon, 04 Mar 2019 15:04:05 GMT+0100", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(1))},
+		{"Mon, 04 Mar 2019 15:04:05", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon, 04 Mar 2019 15:04:05.123 +0000", time.Date(2019, 3, 4, 15, 4, 5, 123e6, time.UTC)},
+		{"Mon, 4 Mar 2019 15:04:05.123 +0000", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Monday, 04 March 2019 15:04:05 +0000", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon,04 Mar 2019 15:04:05 +0000", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon , 04 Sept. 2019 15:04:05 +0000", time.Date(2019, 9, 4, 15, 4, 5, 0, time.UTC)},
+		{"  Mon,  04   Mar 2019   15:04:05   +0000  ", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon Mar  4 15:04:05 2019", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"Mon Mar 4 15:04:05 PST 2019", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-8))},
+		{"2019-03-04 15:04:05 +0000", time.Date(2019, 3, 4, 15, 4, 5, 0, time.UTC)},
+		{"2019-03-04T15:04:05-07:00", time.Date(2019, 3, 4, 15, 4, 5, 0, zone(-7))},
+		{"Mon, 31 Dec 2018 23:59:60 +0000", time.Date(2018, 12, 31, 23, 59, 59, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := ParseDate(tt.in)
+		if err != nil {
+			t.Errorf("ParseDate(%q): %v", tt.in, err)
+			continue
+		}
+		_, gotOff := got.Zone()
+		_, wantOff := tt.want.Zone()
+		if !got.Equal(tt.want) || gotOff != wantOff {
+			t.Errorf("ParseDate(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"yesterday",
+		"Mon, 04 Mar 2019",
+		"Mon, 31 Feb 2019 15:04:05 +0000",
+		"Mon, 04 Foo 2019 15:04:05 +0000",
+		"Mon, 04 Mar 2019 25:04:05 +0000",
+		"Mon, 04 Mar 2019 15:04:05 +99999",
+		"Mon, 04 Mar 2019 15:04:05 15:04:05",
+	} {
+		if got, err := ParseDate(in); err == nil {
+			t.Errorf("ParseDate(%q) = %v, want error", in, got)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package imf
+
+import "testing"
+
+func FuzzParseAddress(f *testing.F) {
+	for _, seed := range []string{
+		`jdoe@machine.example`,
+		`John Doe <jdoe@machine.example>`,
+		`"Joe Q. Public" <john.q.public@example.com>`,
+		`Mary Smith <mary@x.test>, jdoe@example.org, Who? <one@y.test>`,
+		`A Group:Ed Jones <c@a.test>,joe@where.test,John <jdoe@one.test>;`,
+		`Pete(A nice \) chap) <pete(his account)@silly.test(his host)>`,
+		`=?iso-8859-1?q?J=F6rg_Doe?= <joerg@example.com>`,
+		`=?UTF-8?B?0JbQtdC90Y8=?= <zhenya@example.com>`,
+		`"\"\\\x1f,\"" <0@0>`,
+		`<jdoe#machine.example>`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		ParseAddressList(input)
+		ParseReferences(input)
+
+		addr, err := ParseAddress(input)
+		if err != nil {
+			return
+		}
+		// A parsed address formats to one that parses the same.
+		str := FormatAddress(addr)
+		addr2, err := ParseAddress(str)
+		if err != nil {
+			t.Fatalf("ParseAddress(%q) formatted as %q: %v", input, str, err)
+		}
+		if addr2.Addr != addr.Addr {
+			t.Errorf("ParseAddress(%q).Addr=%q, formatted as %q parses to %q", input, addr.Addr, str, addr2.Addr)
+		}
+	})
+}
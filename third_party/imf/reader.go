@@ -16,8 +16,15 @@ import (
 // A Reader implements convenience methods for reading requests
 // or responses from a text protocol network connection.
 type Reader struct {
-	R     *bufio.Reader
+	R *bufio.Reader
+
+	// KeepRaw records the field body of each header entry as it
+	// was read in HeaderEntry.Raw, so WriteHeader can write an
+	// unmodified field with its original folding.
+	KeepRaw bool
+
 	buf   []byte // a re-usable buffer for readContinuedLineSlice
+	raw   []byte // the line as read by readContinuedLineSlice, if KeepRaw
 	nRead int    // bytes read from R
 }
 
@@ -68,6 +75,9 @@ func (r *Reader) readContinuedLineSlice() ([]byte, error) {
 	if len(line) == 0 { // blank line - no continuation
 		return line, nil
 	}
+	if r.KeepRaw {
+		r.raw = append(r.raw[:0], line...)
+	}
 
 	// Optimistically assume that we have started to buffer the next line
 	// and it starts with an ASCII letter (the next header key), or a blank
@@ -86,11 +96,22 @@ func (r *Reader) readContinuedLineSlice() ([]byte, error) {
 	r.buf = append(r.buf[:0], trim(line)...)
 
 	// Read continuation lines.
-	for r.skipSpace() > 0 {
+	for {
+		mark := len(r.raw)
+		if r.KeepRaw {
+			r.raw = append(r.raw, '\r', '\n')
+		}
+		if r.skipSpace() == 0 {
+			r.raw = r.raw[:mark]
+			break
+		}
 		line, err := r.readLineSlice()
 		if err != nil {
 			break
 		}
+		if r.KeepRaw {
+			r.raw = append(r.raw, line...)
+		}
 		r.buf = append(r.buf, ' ')
 		r.buf = append(r.buf, trim(line)...)
 	}
@@ -110,6 +131,9 @@ func (r *Reader) skipSpace() int {
 			r.R.UnreadByte()
 			break
 		}
+		if r.KeepRaw {
+			r.raw = append(r.raw, c)
+		}
 		n++
 	}
 	r.nRead += n
@@ -226,10 +250,15 @@ func (r *Reader) ReadMIMEHeader() (email.Header, error) {
 		} else {
 			m.Index[key] = append(vv, value)
 		}
-		m.Entries = append(m.Entries, email.HeaderEntry{
+		entry := email.HeaderEntry{
 			Key:   key,
 			Value: value,
-		})
+		}
+		if r.KeepRaw {
+			raw := r.raw[bytes.IndexByte(r.raw, ':')+1:]
+			entry.Raw = append(make([]byte, 0, len(raw)), raw...)
+		}
+		m.Entries = append(m.Entries, entry)
 
 		if err != nil {
 			return m, err
@@ -0,0 +1,185 @@
+package imf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"spilled.ink/email"
+)
+
+// WriteHeader writes hdr to w, followed by the blank line that
+// ends a header. Each field is written as WriteField writes it.
+func WriteHeader(w io.Writer, hdr *email.Header) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	for i := range hdr.Entries {
+		n2, err := WriteField(bw, &hdr.Entries[i])
+		n += n2
+		if err != nil {
+			return n, err
+		}
+	}
+	n2, _ := bw.WriteString("\r\n")
+	n += n2
+	return n, bw.Flush()
+}
+
+// WriteField writes a single header field to w, ending in CRLF.
+//
+// If the entry was read with KeepRaw and its value has not been
+// changed since, the field is written as it was read.
+//
+// Otherwise non-ASCII text in the display names of address fields
+// and in unstructured fields such as Subject is RFC 2047 encoded,
+// and the field is folded at whitespace to lines of no more than
+// 78 characters where possible. No line is longer than 998.
+func WriteField(w io.Writer, entry *email.HeaderEntry) (n int, err error) {
+	var buf []byte
+	if entry.Raw != nil && bytes.Equal(unfold(entry.Raw), entry.Value) {
+		buf = make([]byte, 0, len(entry.Key)+len(entry.Raw)+3)
+		buf = append(buf, entry.Key...)
+		buf = append(buf, ':')
+		buf = append(buf, entry.Raw...)
+		buf = append(buf, '\r', '\n')
+	} else {
+		buf = fold(entry.Key, encodeValue(entry.Key, entry.Value))
+	}
+	return w.Write(buf)
+}
+
+// EncodedValue is the field body WriteField writes for entry,
+// unfolded. It is what a DKIM signature of the field covers.
+func EncodedValue(entry *email.HeaderEntry) []byte {
+	if entry.Raw != nil && bytes.Equal(unfold(entry.Raw), entry.Value) {
+		return bytes.TrimLeft(bytes.Replace(entry.Raw, []byte("\r\n"), nil, -1), " \t")
+	}
+	return encodeValue(entry.Key, entry.Value)
+}
+
+// unfold reproduces the value ReadMIMEHeader reads from raw.
+// It returns nil if raw cannot be decoded.
+func unfold(raw []byte) []byte {
+	var v []byte
+	for i, line := range bytes.Split(raw, []byte("\r\n")) {
+		if i > 0 {
+			v = append(v, ' ')
+		}
+		v = append(v, trim(line)...)
+	}
+	v = bytes.TrimLeft(v, " \t")
+	if bytes.Contains(v, []byte("=?")) {
+		s, err := mimeDecoder.DecodeHeader(string(v))
+		if err != nil {
+			return nil
+		}
+		v = []byte(s)
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
+
+// encodeValue RFC 2047 encodes the non-ASCII text of a field value
+// where the field allows encoded-words.
+func encodeValue(key email.Key, v []byte) []byte {
+	// A value must not carry its own line breaks.
+	// Folding is the writer's to do.
+	if bytes.ContainsAny(v, "\r\n") {
+		v = bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return ' '
+			}
+			return r
+		}, v)
+	}
+	if isASCII(v) {
+		return v
+	}
+	switch strings.ToLower(string(key)) {
+	case "from", "sender", "reply-to", "to", "cc", "bcc",
+		"resent-from", "resent-sender", "resent-to", "resent-cc", "resent-bcc":
+		addrs, err := ParseAddressList(string(v))
+		if err != nil || len(addrs) == 0 {
+			return v
+		}
+		var s []string
+		for _, a := range addrs {
+			s = append(s, FormatAddress(a))
+		}
+		return []byte(strings.Join(s, ", "))
+	case "subject", "comments", "content-description", "thread-topic":
+		return []byte(mime.QEncoding.Encode("utf-8", string(v)))
+	}
+	return v
+}
+
+func isASCII(v []byte) bool {
+	for _, c := range v {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// fold formats a field, breaking lines before whitespace so no
+// line is more than 78 characters where possible.
+//
+// Header line limit:
+//
+//	Each line of characters MUST be no more than 998 characters, and
+//	SHOULD be no more than 78 characters, excluding the CRLF.
+//
+// https://tools.ietf.org/html/rfc5322#section-2.1.1
+//
+// A run of more than 998 characters without whitespace has
+// folding whitespace inserted into it.
+func fold(key email.Key, v []byte) []byte {
+	const limit, hardLimit = 78, 998
+
+	buf := make([]byte, 0, len(key)+len(v)+8)
+	buf = append(buf, key...)
+	buf = append(buf, ':')
+	if len(v) == 0 {
+		return append(buf, '\r', '\n')
+	}
+	buf = append(buf, ' ')
+	col := len(buf)
+
+	first := true
+	for len(v) > 0 {
+		// Each word after the first starts with its whitespace,
+		// so a fold can be made by writing CRLF before it.
+		i := 0
+		for i < len(v) && (v[i] == ' ' || v[i] == '\t') {
+			i++
+		}
+		for i < len(v) && v[i] != ' ' && v[i] != '\t' {
+			i++
+		}
+		word := v[:i]
+		v = v[i:]
+
+		// Trailing whitespace is never folded onto a line
+		// of its own, a line of only whitespace is not allowed.
+		blank := len(bytes.TrimLeft(word, " \t")) == 0
+		if !first && !blank && col+len(word) > limit && col > 1 {
+			buf = append(buf, '\r', '\n')
+			col = 0
+		}
+		first = false
+		for col+len(word) > hardLimit {
+			n := hardLimit - col
+			buf = append(buf, word[:n]...)
+			buf = append(buf, '\r', '\n', ' ')
+			col = 1
+			word = word[n:]
+		}
+		buf = append(buf, word...)
+		col += len(word)
+	}
+	return append(buf, '\r', '\n')
+}
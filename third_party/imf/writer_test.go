@@ -0,0 +1,88 @@
+package imf
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"spilled.ink/email"
+)
+
+func TestWriteField(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       string
+	}{
+		{"Subject", "hello", "Subject: hello\r\n"},
+		{"Subject", "", "Subject:\r\n"},
+		{"Subject", "¡Hola, señor!", "Subject: =?utf-8?q?=C2=A1Hola,_se=C3=B1or!?=\r\n"},
+		{"From", "José Pérez <jose@example.com>", "From: =?utf-8?q?Jos=C3=A9_P=C3=A9rez?= <jose@example.com>\r\n"},
+		{"Message-Id", "<a\r\nX-Injected: 1>", "Message-Id: <a  X-Injected: 1>\r\n"},
+		{
+			"References",
+			"<aaaaaaaaaaaaaaaaaaaa@example.com> <bbbbbbbbbbbbbbbbbbbb@example.com> <cccccccccccccccccccc@example.com>",
+			"References: <aaaaaaaaaaaaaaaaaaaa@example.com>\r\n" +
+				" <bbbbbbbbbbbbbbbbbbbb@example.com> <cccccccccccccccccccc@example.com>\r\n",
+		},
+		{
+			"X-Long",
+			strings.Repeat("x", 1000),
+			"X-Long: " + strings.Repeat("x", 990) + "\r\n " + strings.Repeat("x", 10) + "\r\n",
+		},
+	}
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		entry := email.HeaderEntry{Key: email.Key(tt.key), Value: []byte(tt.value)}
+		if _, err := WriteField(buf, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("WriteField(%s: %q):\n%q\nwant:\n%q", tt.key, tt.value, got, tt.want)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+			if len(line) > 998 {
+				t.Errorf("%s: line of %d bytes", tt.key, len(line))
+			}
+		}
+	}
+}
+
+func TestWriteHeaderRoundTrip(t *testing.T) {
+	const hdr = "Subject: =?ISO-8859-1?Q?Caf=E9?= is\r\n" +
+		"\tfolded   oddly\r\n" +
+		"From: Bob <bob@example.com>\r\n" +
+		"To: alice@example.com,\r\n" +
+		"    carol@example.com\r\n" +
+		"\r\n"
+	r := NewReader(bufio.NewReader(strings.NewReader(hdr)))
+	r.KeepRaw = true
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(h.Get("Subject")); got != "Café is folded   oddly" {
+		t.Errorf("Subject=%q", got)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := WriteHeader(buf, &h); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != hdr {
+		t.Errorf("round trip:\n%q\nwant:\n%q", got, hdr)
+	}
+
+	// A changed field is written afresh.
+	h.Entries[0].Value = []byte("Tea")
+	buf.Reset()
+	if _, err := WriteHeader(buf, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Subject: Tea\r\n" + hdr[strings.Index(hdr, "From:"):]; buf.String() != want {
+		t.Errorf("after edit:\n%q\nwant:\n%q", buf.String(), want)
+	}
+	if got := string(EncodedValue(&h.Entries[2])); got != "alice@example.com,    carol@example.com" {
+		t.Errorf("EncodedValue(To)=%q", got)
+	}
+}
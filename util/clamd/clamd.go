@@ -0,0 +1,120 @@
+// Package clamd is a client for the ClamAV daemon.
+//
+// Content is streamed to clamd with the INSTREAM command,
+// so clamd does not need access to the files being scanned.
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client scans content with a clamd.
+type Client struct {
+	Network string        // "tcp" or "unix"
+	Addr    string        // "127.0.0.1:3310" or a socket path
+	Timeout time.Duration // per scan, default 2m
+}
+
+// chunkSize is the size of INSTREAM chunks. It is well under
+// the default StreamMaxLength of clamd.
+const chunkSize = 32 << 10
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// Scan sends the content of r to clamd.
+// If a virus is found, Scan reports its name. Clean content
+// reports the empty string.
+func (c *Client) Scan(ctx context.Context, r io.Reader) (virus string, err error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	defer conn.Close()
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("zINSTREAM\x00")
+	buf := make([]byte, chunkSize)
+	var size [4]byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			bw.Write(size[:])
+			bw.Write(buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("clamd: %v", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	bw.Write(size[:])
+	if err := bw.Flush(); err != nil {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return "", fmt.Errorf("clamd: %v", err)
+	}
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseReply parses a scan reply, "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseReply(reply string) (virus string, err error) {
+	reply = strings.TrimSpace(reply)
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.HasSuffix(result, " ERROR"):
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(result, " ERROR"))
+	}
+	return "", fmt.Errorf("clamd: unexpected reply %q", reply)
+}
+
+// Ping checks that clamd is running.
+func (c *Client) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("clamd: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "zPING\x00"); err != nil {
+		return fmt.Errorf("clamd: %v", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return fmt.Errorf("clamd: %v", err)
+	}
+	if reply = strings.TrimSuffix(reply, "\x00"); reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// signature is found by fakeClamd. It is not the EICAR test
+// file, so the source does not upset real virus scanners.
+const signature = "FAKE-CLAMD-TEST-SIGNATURE"
+
+// fakeClamd answers INSTREAM scans, finding content that
+// contains signature.
+func fakeClamd(t *testing.T) (*Client, net.Listener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn)
+		}
+	}()
+	return &Client{Network: "tcp", Addr: ln.Addr().String()}, ln
+}
+
+func serveClamd(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	cmd, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		io.WriteString(conn, "PONG\x00")
+	case "zINSTREAM\x00":
+		var content bytes.Buffer
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(br, size[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&content, br, int64(n)); err != nil {
+				return
+			}
+		}
+		if strings.Contains(content.String(), signature) {
+			io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+		} else {
+			io.WriteString(conn, "stream: OK\x00")
+		}
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, ln := fakeClamd(t)
+	defer ln.Close()
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		virus   string
+	}{
+		{"empty", "", ""},
+		{"clean", "hello, world\n", ""},
+		{"found", signature, "Eicar-Signature"},
+		{"large", strings.Repeat("x", 3*chunkSize+17) + signature, "Eicar-Signature"},
+	}
+	for _, test := range tests {
+		virus, err := c.Scan(ctx, strings.NewReader(test.content))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if virus != test.virus {
+			t.Errorf("%s: virus=%q, want %q", test.name, virus, test.virus)
+		}
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply, virus string
+		err          bool
+	}{
+		{"stream: OK", "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND\n", "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR", "", true},
+		{"stream: Can't allocate memory ERROR", "", true},
+		{"garbage", "", true},
+	}
+	for _, test := range tests {
+		virus, err := parseReply(test.reply)
+		if virus != test.virus || (err != nil) != test.err {
+			t.Errorf("parseReply(%q) = %q, %v", test.reply, virus, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package dnscache caches the DNS lookups made to send and receive mail.
+//
+// Answers are kept for the TTL reported by the upstream lookup.
+// Names that do not exist, or have no records of the type, are
+// cached for NegativeTTL. Temporary failures are not cached.
+package dnscache
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver is a caching DNS resolver. It is safe for concurrent use.
+//
+// The results of the lookup methods are shared by all callers
+// and must not be modified.
+type Resolver struct {
+	// UpstreamTXT and UpstreamMX look up uncached records.
+	// Each reports the TTL of its answer in seconds.
+	//
+	// The defaults use net.DefaultResolver, which does not
+	// report TTLs, so answers are kept for DefaultTTL.
+	// Use the methods of an Upstream to honor TTLs.
+	UpstreamTXT func(ctx context.Context, name string) (txts []string, ttl int, err error)
+	UpstreamMX  func(ctx context.Context, name string) (mxs []*net.MX, ttl int, err error)
+
+	MaxEntries  int           // default 10000, least recently used are evicted
+	DefaultTTL  time.Duration // default 5 minutes
+	MaxTTL      time.Duration // default 1 day
+	NegativeTTL time.Duration // default 5 minutes
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element // of *entry
+	lru     list.List                  // front is most recently used
+	stats   Stats
+}
+
+// Stats counts the lookups made through a Resolver.
+type Stats struct {
+	Hits         int64 // answered from the cache
+	NegativeHits int64 // answered from the cache with an error
+	Misses       int64 // looked up upstream
+	Errors       int64 // upstream lookups that failed, including not found
+	Evictions    int64 // entries removed to make room
+	Entries      int   // entries currently cached
+}
+
+type cacheKey struct {
+	qtype string // "TXT" or "MX"
+	name  string // lowercase
+}
+
+type entry struct {
+	key     cacheKey
+	txts    []string
+	mxs     []*net.MX
+	err     error
+	expires time.Time
+}
+
+// LookupTXT returns the TXT records of name and their remaining
+// TTL in seconds. It has the signature of dkim.Verifier.LookupTXT.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) (txts []string, ttl int, err error) {
+	e, err := r.lookup(ctx, cacheKey{qtype: "TXT", name: strings.ToLower(name)}, func(e *entry) (int, error) {
+		upstream := r.UpstreamTXT
+		if upstream == nil {
+			upstream = r.defaultTXT
+		}
+		var ttl int
+		var err error
+		e.txts, ttl, err = upstream(ctx, name)
+		if err == nil && len(e.txts) == 0 {
+			err = notFound(name)
+		}
+		return ttl, err
+	})
+	if e == nil {
+		return nil, 0, err
+	}
+	return e.txts, remaining(e), err
+}
+
+// LookupMX returns the MX records of name, sorted by preference,
+// and their remaining TTL in seconds.
+func (r *Resolver) LookupMX(ctx context.Context, name string) (mxs []*net.MX, ttl int, err error) {
+	e, err := r.lookup(ctx, cacheKey{qtype: "MX", name: strings.ToLower(name)}, func(e *entry) (int, error) {
+		upstream := r.UpstreamMX
+		if upstream == nil {
+			upstream = r.defaultMX
+		}
+		var ttl int
+		var err error
+		e.mxs, ttl, err = upstream(ctx, name)
+		if err == nil && len(e.mxs) == 0 {
+			err = notFound(name)
+		}
+		return ttl, err
+	})
+	if e == nil {
+		return nil, 0, err
+	}
+	return e.mxs, remaining(e), err
+}
+
+// Stats reports the lookups made since the Resolver was created.
+func (r *Resolver) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Entries = len(r.entries)
+	return stats
+}
+
+// lookup returns the cached entry for key, or calls fill to look it up.
+// It returns a nil entry for errors that are not cached.
+func (r *Resolver) lookup(ctx context.Context, key cacheKey, fill func(*entry) (ttl int, err error)) (*entry, error) {
+	now := timeNow()
+
+	r.mu.Lock()
+	if elem := r.entries[key]; elem != nil {
+		e := elem.Value.(*entry)
+		if now.Before(e.expires) {
+			r.lru.MoveToFront(elem)
+			if e.err != nil {
+				r.stats.NegativeHits++
+			} else {
+				r.stats.Hits++
+			}
+			r.mu.Unlock()
+			return e, e.err
+		}
+		r.remove(elem)
+	}
+	r.stats.Misses++
+	r.mu.Unlock()
+
+	e := &entry{key: key}
+	ttl, err := fill(e)
+	var d time.Duration
+	if err != nil {
+		r.mu.Lock()
+		r.stats.Errors++
+		r.mu.Unlock()
+		if !isNotFound(err) {
+			return nil, err
+		}
+		e.txts, e.mxs, e.err = nil, nil, err
+		d = r.negativeTTL()
+	} else {
+		d = r.ttl(ttl)
+	}
+	if d <= 0 {
+		return e, err
+	}
+	e.expires = now.Add(d)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[cacheKey]*list.Element)
+	}
+	if elem := r.entries[key]; elem != nil {
+		r.remove(elem) // filled by a concurrent lookup
+	}
+	for len(r.entries) >= r.maxEntries() {
+		r.remove(r.lru.Back())
+		r.stats.Evictions++
+	}
+	r.entries[key] = r.lru.PushFront(e)
+	return e, err
+}
+
+func (r *Resolver) remove(elem *list.Element) {
+	e := r.lru.Remove(elem).(*entry)
+	delete(r.entries, e.key)
+}
+
+// ttl converts an upstream TTL in seconds to a cache duration.
+func (r *Resolver) ttl(seconds int) time.Duration {
+	maxTTL := r.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = 24 * time.Hour
+	}
+	d := time.Duration(seconds) * time.Second
+	if d > maxTTL {
+		d = maxTTL
+	}
+	return d
+}
+
+func (r *Resolver) negativeTTL() time.Duration {
+	if r.NegativeTTL == 0 {
+		return 5 * time.Minute
+	}
+	return r.NegativeTTL
+}
+
+func (r *Resolver) maxEntries() int {
+	if r.MaxEntries <= 0 {
+		return 10000
+	}
+	return r.MaxEntries
+}
+
+func (r *Resolver) defaultTTL() int {
+	if r.DefaultTTL == 0 {
+		return int(5 * time.Minute / time.Second)
+	}
+	return int(r.DefaultTTL / time.Second)
+}
+
+func (r *Resolver) defaultTXT(ctx context.Context, name string) ([]string, int, error) {
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+	return txts, r.defaultTTL(), err
+}
+
+func (r *Resolver) defaultMX(ctx context.Context, name string) ([]*net.MX, int, error) {
+	mxs, err := net.DefaultResolver.LookupMX(ctx, name)
+	return mxs, r.defaultTTL(), err
+}
+
+var timeNow = time.Now
+
+func remaining(e *entry) int {
+	if e.expires.IsZero() {
+		return 0
+	}
+	ttl := int(e.expires.Sub(timeNow()) / time.Second)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// isNotFound reports whether err is an authoritative answer that
+// the name or its records do not exist, which may be cached.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
@@ -0,0 +1,144 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolver(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	lookups := make(map[string]int)
+	r := &Resolver{
+		UpstreamTXT: func(ctx context.Context, name string) ([]string, int, error) {
+			lookups[name]++
+			switch name {
+			case "sel._domainkey.example.com":
+				return []string{"v=DKIM1; p=abc"}, 300, nil
+			case "temp.example.com":
+				return nil, 0, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+			case "empty.example.com":
+				return nil, 60, nil
+			case "refused.example.com":
+				return nil, 0, &net.DNSError{Err: "server misbehaving", Name: name}
+			}
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		},
+		NegativeTTL: time.Minute,
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		txts, ttl, err := r.LookupTXT(ctx, "sel._domainkey.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txts) != 1 || txts[0] != "v=DKIM1; p=abc" {
+			t.Errorf("txts=%q", txts)
+		}
+		if want := 300 - 10*i; ttl != want {
+			t.Errorf("lookup %d: ttl=%d, want %d", i, ttl, want)
+		}
+		now = now.Add(10 * time.Second)
+	}
+	if _, _, err := r.LookupTXT(ctx, "SEL._domainkey.example.COM"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookups["sel._domainkey.example.com"]; got != 1 {
+		t.Errorf("%d upstream lookups, want 1", got)
+	}
+
+	now = now.Add(300 * time.Second)
+	if _, _, err := r.LookupTXT(ctx, "sel._domainkey.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookups["sel._domainkey.example.com"]; got != 2 {
+		t.Errorf("after expiry %d upstream lookups, want 2", got)
+	}
+
+	for _, name := range []string{"nx.example.com", "empty.example.com", "temp.example.com", "refused.example.com"} {
+		for i := 0; i < 2; i++ {
+			if _, _, err := r.LookupTXT(ctx, name); err == nil {
+				t.Errorf("%s: no error", name)
+			}
+		}
+	}
+	if lookups["nx.example.com"] != 1 || lookups["empty.example.com"] != 1 {
+		t.Errorf("negative answers not cached: %v", lookups)
+	}
+	if lookups["temp.example.com"] != 2 || lookups["refused.example.com"] != 2 {
+		t.Errorf("failed lookup cached: %v", lookups)
+	}
+	now = now.Add(time.Minute)
+	r.LookupTXT(ctx, "nx.example.com")
+	if lookups["nx.example.com"] != 2 {
+		t.Errorf("negative answer not expired: %v", lookups)
+	}
+
+	want := Stats{Hits: 3, NegativeHits: 2, Misses: 9, Errors: 7, Entries: 3}
+	if got := r.Stats(); got != want {
+		t.Errorf("stats=%+v, want %+v", got, want)
+	}
+}
+
+func TestResolverEvict(t *testing.T) {
+	lookups := 0
+	r := &Resolver{
+		UpstreamMX: func(ctx context.Context, name string) ([]*net.MX, int, error) {
+			lookups++
+			return []*net.MX{{Host: "mx." + name, Pref: 10}}, 3600, nil
+		},
+		MaxEntries: 3,
+	}
+	ctx := context.Background()
+	lookup := func(name string) {
+		t.Helper()
+		mxs, _, err := r.LookupMX(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mxs[0].Host != "mx."+name {
+			t.Errorf("%s: MX %s", name, mxs[0].Host)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		lookup(fmt.Sprintf("d%d.example", i))
+	}
+	lookup("d0.example") // d1 is now least recently used
+	lookup("d3.example")
+	lookups = 0
+	lookup("d0.example")
+	lookup("d2.example")
+	lookup("d3.example")
+	if lookups != 0 {
+		t.Errorf("%d recently used entries evicted", lookups)
+	}
+	lookup("d1.example")
+	if lookups != 1 {
+		t.Errorf("least recently used entry not evicted")
+	}
+	if stats := r.Stats(); stats.Evictions != 2 || stats.Entries != 3 {
+		t.Errorf("stats=%+v", stats)
+	}
+}
+
+func TestResolverUncachedError(t *testing.T) {
+	errUpstream := errors.New("upstream failed")
+	r := &Resolver{
+		UpstreamMX: func(ctx context.Context, name string) ([]*net.MX, int, error) {
+			return nil, 0, errUpstream
+		},
+	}
+	if _, _, err := r.LookupMX(context.Background(), "example.com"); err != errUpstream {
+		t.Errorf("err=%v, want %v", err, errUpstream)
+	}
+	if stats := r.Stats(); stats.Entries != 0 {
+		t.Errorf("error cached: %+v", stats)
+	}
+}
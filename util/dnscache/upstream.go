@@ -0,0 +1,214 @@
+package dnscache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"spilled.ink/third_party/dns"
+)
+
+// Upstream looks up records on recursive DNS servers and reports
+// the TTLs of their answers. Its methods can be used as the
+// UpstreamTXT and UpstreamMX of a Resolver.
+type Upstream struct {
+	// Servers are the "host:port" addresses of the recursive
+	// servers, tried in order. If empty, the nameservers of
+	// /etc/resolv.conf are used.
+	Servers []string
+	Timeout time.Duration // per server, default 5 seconds
+}
+
+// LookupTXT returns the TXT records of name, the strings of
+// each record joined as net.LookupTXT does, and their TTL.
+func (u *Upstream) LookupTXT(ctx context.Context, name string) (txts []string, ttl int, err error) {
+	answer, ttl, err := u.query(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, rr := range answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(txt.Txt, ""))
+		}
+	}
+	if len(txts) == 0 {
+		return nil, 0, notFound(name)
+	}
+	return txts, ttl, nil
+}
+
+// LookupMX returns the MX records of name, sorted by preference,
+// and their TTL.
+func (u *Upstream) LookupMX(ctx context.Context, name string) (mxs []*net.MX, ttl int, err error) {
+	answer, ttl, err := u.query(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, rr := range answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+	if len(mxs) == 0 {
+		return nil, 0, notFound(name)
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, ttl, nil
+}
+
+// query returns the answer section for name and qtype, and the
+// smallest TTL of its records, from the first server that answers.
+func (u *Upstream) query(ctx context.Context, name string, qtype uint16) (answer []dns.RR, ttl int, err error) {
+	servers := u.Servers
+	if len(servers) == 0 {
+		servers = resolvConfServers()
+	}
+	req := new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype)
+	for _, server := range servers {
+		var resp *dns.Msg
+		resp, err = u.exchange(ctx, server, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, 0, notFound(name)
+		default:
+			err = &net.DNSError{
+				Err:         "server misbehaving: " + dns.RcodeToString[resp.Rcode],
+				Name:        name,
+				Server:      server,
+				IsTemporary: true,
+			}
+			continue
+		}
+		for i, rr := range resp.Answer {
+			if rrTTL := int(rr.Header().Ttl); i == 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		return resp.Answer, ttl, nil
+	}
+	if err == nil {
+		err = errors.New("no DNS servers")
+	}
+	return nil, 0, dnsError(name, err)
+}
+
+// exchange sends req to server over UDP, and again over TCP
+// if the UDP answer is truncated.
+func (u *Upstream) exchange(ctx context.Context, server string, req *dns.Msg) (*dns.Msg, error) {
+	timeout := u.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchangeConn(ctx, "udp", server, req.Id, b)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeConn(ctx, "tcp", server, req.Id, b)
+	}
+	return resp, err
+}
+
+func exchangeConn(ctx context.Context, network, server string, id uint16, b []byte) (*dns.Msg, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		msg := make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(msg, uint16(len(b)))
+		copy(msg[2:], b)
+		b = msg
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	for {
+		var buf []byte
+		if network == "tcp" {
+			var n [2]byte
+			if _, err := io.ReadFull(conn, n[:]); err != nil {
+				return nil, err
+			}
+			buf = make([]byte, binary.BigEndian.Uint16(n[:]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return nil, err
+			}
+		} else {
+			buf = make([]byte, 65535)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			buf = buf[:n]
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf); err != nil {
+			return nil, err
+		}
+		if resp.Id == id && resp.Response {
+			return resp, nil
+		}
+		// A late or forged answer to another query, keep reading.
+	}
+}
+
+// dnsError reports a failed exchange as a temporary net.DNSError,
+// which the Resolver does not cache.
+func dnsError(name string, err error) error {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr
+	}
+	dnsErr := &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		dnsErr.IsTimeout = true
+	}
+	return dnsErr
+}
+
+var resolvConf = "/etc/resolv.conf"
+
+// resolvConfServers returns the nameservers of resolv.conf,
+// or the local host if there are none.
+func resolvConfServers() (servers []string) {
+	f, err := os.Open(resolvConf)
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
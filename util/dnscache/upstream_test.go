@@ -0,0 +1,189 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"spilled.ink/third_party/dns"
+)
+
+// fakeServer answers DNS queries over UDP and TCP on the
+// same port with the reply of answer.
+type fakeServer struct {
+	addr     string
+	pc       net.PacketConn
+	ln       net.Listener
+	answer   func(req *dns.Msg, tcp bool) *dns.Msg
+	tcpCount int64 // atomic
+}
+
+func newFakeServer(t *testing.T, answer func(req *dns.Msg, tcp bool) *dns.Msg) *fakeServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skipf("cannot listen on TCP port of %s: %v", pc.LocalAddr(), err)
+	}
+	s := &fakeServer{addr: pc.LocalAddr().String(), pc: pc, ln: ln, answer: answer}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *fakeServer) Close() {
+	s.pc.Close()
+	s.ln.Close()
+}
+
+func (s *fakeServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		b, err := s.answer(req, false).Pack()
+		if err != nil {
+			continue
+		}
+		s.pc.WriteTo(b, addr)
+	}
+}
+
+func (s *fakeServer) serveTCP() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.tcpCount, 1)
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			conn.Close()
+			continue
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			conn.Close()
+			continue
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err == nil {
+			if b, err := s.answer(req, true).Pack(); err == nil {
+				binary.BigEndian.PutUint16(n[:], uint16(len(b)))
+				conn.Write(append(n[:], b...))
+			}
+		}
+		conn.Close()
+	}
+}
+
+func rrHeader(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+}
+
+func TestUpstream(t *testing.T) {
+	s := newFakeServer(t, func(req *dns.Msg, tcp bool) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		q := req.Question[0]
+		switch q.Name {
+		case "sel._domainkey.example.com.":
+			resp.Answer = []dns.RR{
+				&dns.TXT{Hdr: rrHeader(q.Name, dns.TypeTXT, 300), Txt: []string{"v=DKIM1; ", "p=abc"}},
+				&dns.TXT{Hdr: rrHeader(q.Name, dns.TypeTXT, 120), Txt: []string{"other"}},
+			}
+		case "example.com.":
+			resp.Answer = []dns.RR{
+				&dns.MX{Hdr: rrHeader(q.Name, dns.TypeMX, 600), Preference: 20, Mx: "mx2.example.com."},
+				&dns.MX{Hdr: rrHeader(q.Name, dns.TypeMX, 600), Preference: 10, Mx: "mx1.example.com."},
+			}
+		case "big.example.com.":
+			if !tcp {
+				resp.Truncated = true
+				break
+			}
+			resp.Answer = []dns.RR{&dns.TXT{Hdr: rrHeader(q.Name, dns.TypeTXT, 60), Txt: []string{"big"}}}
+		case "empty.example.com.":
+		case "fail.example.com.":
+			resp.Rcode = dns.RcodeServerFailure
+		default:
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp
+	})
+	defer s.Close()
+
+	u := &Upstream{Servers: []string{s.addr}, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	txts, ttl, err := u.LookupTXT(ctx, "sel._domainkey.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"v=DKIM1; p=abc", "other"}; !reflect.DeepEqual(txts, want) || ttl != 120 {
+		t.Errorf("LookupTXT=%q, %d, want %q, 120", txts, ttl, want)
+	}
+
+	mxs, ttl, err := u.LookupMX(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 2 || mxs[0].Host != "mx1.example.com." || mxs[1].Host != "mx2.example.com." || ttl != 600 {
+		t.Errorf("LookupMX=%v %v, %d", mxs[0], mxs[1], ttl)
+	}
+
+	txts, _, err = u.LookupTXT(ctx, "big.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&s.tcpCount); len(txts) != 1 || txts[0] != "big" || n != 1 {
+		t.Errorf("truncated answer: %q, %d TCP queries", txts, n)
+	}
+
+	for _, name := range []string{"nx.example.com", "empty.example.com"} {
+		_, _, err := u.LookupTXT(ctx, name)
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Errorf("%s: err=%v, want not found", name, err)
+		}
+	}
+	_, _, err = u.LookupTXT(ctx, "fail.example.com")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.Temporary() || dnsErr.IsNotFound {
+		t.Errorf("SERVFAIL: err=%v, want temporary error", err)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close() // never answers
+
+	u := &Upstream{Servers: []string{pc.LocalAddr().String()}, Timeout: 50 * time.Millisecond}
+	_, _, err = u.LookupMX(context.Background(), "example.com")
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.Timeout() || dnsErr.IsNotFound {
+		t.Fatalf("err=%v, want timeout", err)
+	}
+
+	// The Resolver does not cache the failure.
+	r := &Resolver{UpstreamMX: u.LookupMX}
+	r.LookupMX(context.Background(), "example.com")
+	if stats := r.Stats(); stats.Entries != 0 {
+		t.Errorf("timeout cached: %+v", stats)
+	}
+}
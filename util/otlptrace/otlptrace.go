@@ -0,0 +1,394 @@
+// Package otlptrace exports spans, timed operations such as an IMAP
+// command or an SMTP transaction, to an OpenTelemetry collector.
+//
+// Spans are sent in batches with OTLP over HTTP, JSON encoded, so
+// operators can find slow commands in their existing tracing stack.
+// They complement the runtime/trace tasks, which are only seen by
+// go tool trace.
+//
+// A nil *Exporter and a nil *Span are valid and do nothing, so
+// tracing costs little when it is not configured.
+package otlptrace
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueue  = 4096 // spans held for export, more are dropped
+	batchSize = 512  // spans in one export request
+	interval  = 5 * time.Second
+)
+
+// Exporter sends ended spans to an OTLP/HTTP endpoint.
+// It is safe for concurrent use.
+type Exporter struct {
+	Endpoint    string // traces URL, "http://localhost:4318/v1/traces"
+	ServiceName string // resource service.name, default "spilld"
+	Client      *http.Client
+	Logf        func(format string, v ...interface{})
+
+	ctx      context.Context
+	cancelFn func()
+	done     chan struct{}
+	flushNow chan struct{}
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+}
+
+func NewExporter(endpoint string) *Exporter {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &Exporter{
+		Endpoint:    endpoint,
+		ServiceName: "spilld",
+		Client:      &http.Client{Timeout: 30 * time.Second},
+		Logf:        func(format string, v ...interface{}) {},
+		ctx:         ctx,
+		cancelFn:    cancelFn,
+		done:        make(chan struct{}),
+		flushNow:    make(chan struct{}, 1),
+	}
+}
+
+// Run exports spans until Shutdown is called.
+func (e *Exporter) Run() error {
+	defer func() { close(e.done) }()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			// Send what is left, without the canceled context.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			e.export(ctx)
+			cancel()
+			return nil
+		case <-t.C:
+		case <-e.flushNow:
+		}
+		e.export(e.ctx)
+	}
+}
+
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.cancelFn()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// export sends the queued spans.
+func (e *Exporter) export(ctx context.Context) {
+	for {
+		e.mu.Lock()
+		batch := e.queue
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		e.queue = e.queue[len(batch):]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			e.Logf("otlptrace: queue full, %d spans dropped", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(ctx, batch); err != nil {
+			e.Logf("otlptrace: %d spans dropped: %v", len(batch), err)
+			return
+		}
+	}
+}
+
+func (e *Exporter) send(ctx context.Context, batch []*Span) error {
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("export: %s", res.Status)
+	}
+	return nil
+}
+
+// enqueue adds an ended span to the next export.
+func (e *Exporter) enqueue(sp *Span) {
+	e.mu.Lock()
+	if len(e.queue) >= maxQueue {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.queue = append(e.queue, sp)
+	full := len(e.queue) >= batchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start starts a span. If ctx holds a span, the new span is its
+// child, otherwise it starts a trace. The returned context holds
+// the new span.
+func (e *Exporter) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if e == nil {
+		return ctx, nil
+	}
+	if parent := FromContext(ctx); parent != nil {
+		return Start(ctx, name)
+	}
+	sp := &Span{
+		e:     e,
+		name:  name,
+		kind:  kindServer,
+		start: time.Now(),
+	}
+	rand.Read(sp.traceID[:])
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// Start starts a child of the span held by ctx. Without one it
+// returns a nil *Span, operations only make spans inside a trace.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := &Span{
+		e:        parent.e,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kindInternal,
+		start:    time.Now(),
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+type spanKey struct{}
+
+// FromContext returns the span held by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	sp, _ := ctx.Value(spanKey{}).(*Span)
+	return sp
+}
+
+// Span kinds and status codes of the OTLP protocol.
+const (
+	kindInternal = 1
+	kindServer   = 2
+
+	statusError = 2
+)
+
+// Span is a timed operation. A Span is not safe for concurrent use.
+type Span struct {
+	e        *Exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []attr
+	errMsg   string
+	ended    bool
+}
+
+type attr struct {
+	key   string
+	value interface{}
+}
+
+// SetAttr records an attribute of the span. The value is a string,
+// bool, integer, float64, or time.Duration, which is recorded in
+// milliseconds. Other values are recorded as their fmt.Sprint.
+func (sp *Span) SetAttr(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	switch v := value.(type) {
+	case string, bool, int64, float64:
+	case int:
+		value = int64(v)
+	case uint32:
+		value = int64(v)
+	case time.Duration:
+		value = v.Seconds() * 1000
+	default:
+		value = fmt.Sprint(v)
+	}
+	for i := range sp.attrs {
+		if sp.attrs[i].key == key {
+			sp.attrs[i].value = value
+			return
+		}
+	}
+	sp.attrs = append(sp.attrs, attr{key: key, value: value})
+}
+
+// SetError marks the span as failed if err is not nil.
+func (sp *Span) SetError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.errMsg = err.Error()
+}
+
+// End ends the span and queues it for export.
+// Calls after the first do nothing.
+func (sp *Span) End() {
+	if sp == nil || sp.ended {
+		return
+	}
+	sp.ended = true
+	sp.end = time.Now()
+	sp.e.enqueue(sp)
+}
+
+// The OTLP JSON encoding, see opentelemetry-proto's
+// opentelemetry/proto/collector/trace/v1/trace_service.proto.
+// IDs are hex, and 64-bit integers are decimal strings.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            *status    `json:"status,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *Exporter) encode(batch []*Span) exportRequest {
+	service := e.ServiceName
+	if service == "" {
+		service = "spilld"
+	}
+	spans := make([]jsonSpan, 0, len(batch))
+	for _, sp := range batch {
+		js := jsonSpan{
+			TraceID:           hex.EncodeToString(sp.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.spanID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		}
+		if sp.parentID != [8]byte{} {
+			js.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+		for _, a := range sp.attrs {
+			js.Attributes = append(js.Attributes, encodeAttr(a.key, a.value))
+		}
+		if sp.errMsg != "" {
+			js.Status = &status{Code: statusError, Message: sp.errMsg}
+		}
+		spans = append(spans, js)
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{
+			encodeAttr("service.name", service),
+		}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "spilled.ink"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func encodeAttr(key string, value interface{}) keyValue {
+	kv := keyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	}
+	return kv
+}
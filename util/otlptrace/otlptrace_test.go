@@ -0,0 +1,106 @@
+package otlptrace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	reqs := make(chan exportRequest, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type=%q", ct)
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		reqs <- req
+	}))
+	defer ts.Close()
+
+	e := NewExporter(ts.URL + "/v1/traces")
+	e.ServiceName = "spilld-test"
+	errCh := make(chan error)
+	go func() { errCh <- e.Run() }()
+
+	ctx, cmd := e.Start(context.Background(), "imap FETCH")
+	cmd.SetAttr("imap.command", "FETCH")
+	cmd.SetAttr("spilld.user_id", int64(7))
+	_, op := Start(ctx, "imapdb.fetch")
+	op.SetAttr("db.rows", 3)
+	op.SetAttr("db.rows", 4)
+	op.SetError(errors.New("disk full"))
+	op.End()
+	cmd.End()
+	cmd.End() // second End does nothing
+
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	var req exportRequest
+	select {
+	case req = <-reqs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export")
+	}
+	if len(req.ResourceSpans) != 1 {
+		t.Fatalf("%d resource spans, want 1", len(req.ResourceSpans))
+	}
+	rs := req.ResourceSpans[0]
+	if got := *rs.Resource.Attributes[0].Value.StringValue; got != "spilld-test" {
+		t.Errorf("service.name=%q", got)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	opSpan, cmdSpan := spans[0], spans[1]
+	if cmdSpan.Name != "imap FETCH" || cmdSpan.Kind != kindServer {
+		t.Errorf("command span %q kind %d", cmdSpan.Name, cmdSpan.Kind)
+	}
+	if cmdSpan.ParentSpanID != "" {
+		t.Errorf("command span parent %q, want none", cmdSpan.ParentSpanID)
+	}
+	if opSpan.TraceID != cmdSpan.TraceID || len(opSpan.TraceID) != 32 {
+		t.Errorf("trace IDs %q and %q", opSpan.TraceID, cmdSpan.TraceID)
+	}
+	if opSpan.ParentSpanID != cmdSpan.SpanID {
+		t.Errorf("op parent %q, want %q", opSpan.ParentSpanID, cmdSpan.SpanID)
+	}
+	if len(opSpan.Attributes) != 1 || *opSpan.Attributes[0].Value.IntValue != "4" {
+		t.Errorf("op attributes %+v", opSpan.Attributes)
+	}
+	if opSpan.Status == nil || opSpan.Status.Code != statusError || opSpan.Status.Message != "disk full" {
+		t.Errorf("op status %+v", opSpan.Status)
+	}
+	if cmdSpan.Status != nil {
+		t.Errorf("command status %+v, want none", cmdSpan.Status)
+	}
+	if got := *cmdSpan.Attributes[1].Value.IntValue; got != "7" {
+		t.Errorf("user_id=%q", got)
+	}
+}
+
+func TestNil(t *testing.T) {
+	var e *Exporter
+	ctx, sp := e.Start(context.Background(), "cmd")
+	sp.SetAttr("key", "value")
+	sp.SetError(errors.New("err"))
+	sp.End()
+	if FromContext(ctx) != nil {
+		t.Error("nil exporter put a span in the context")
+	}
+	if _, sp := Start(ctx, "op"); sp != nil {
+		t.Error("Start without a trace returned a span")
+	}
+}
@@ -0,0 +1,196 @@
+// Package s3store stores objects in an S3-compatible service.
+//
+// Requests are signed with AWS Signature Version 4 and use
+// path-style URLs, so it works with S3 as well as services like
+// MinIO that serve a bucket from a single endpoint.
+package s3store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store is a bucket in an S3-compatible service.
+// It implements spillbox.ObjectStore.
+type Store struct {
+	Endpoint    string // base URL, for example "https://s3.us-east-1.amazonaws.com"
+	Bucket      string
+	Region      string // default "us-east-1"
+	AccessKeyID string
+	SecretKey   string
+	Client      *http.Client // default http.DefaultClient
+}
+
+// unsignedPayload skips hashing object bodies while signing.
+// Uploads are streamed, so the hash is not known in advance.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// emptyPayload is the SHA256 of an empty request body.
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, "PUT", key, r)
+	if err != nil {
+		return fmt.Errorf("s3store.Put: %v", err)
+	}
+	req.ContentLength = size
+	res, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return fmt.Errorf("s3store.Put: %s: %v", key, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("s3store.Get: %v", err)
+	}
+	res, err := s.do(req, emptyPayload)
+	if err != nil {
+		return nil, fmt.Errorf("s3store.Get: %s: %v", key, err)
+	}
+	return res.Body, nil
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, "DELETE", key, nil)
+	if err != nil {
+		return fmt.Errorf("s3store.Delete: %v", err)
+	}
+	res, err := s.do(req, emptyPayload)
+	if err != nil {
+		return fmt.Errorf("s3store.Delete: %s: %v", key, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do signs and sends req. Any response other than a 2xx is an error.
+func (s *Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+func (s *Store) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: host and every x-amz-* or range header.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	reqHash := sha256.Sum256([]byte(canonReq))
+
+	scope := date + "/" + s.region() + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+func canonicalQuery(v url.Values) string {
+	var keys []string
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), v[k]...)
+		sort.Strings(vals)
+		for _, val := range vals {
+			parts = append(parts, escape(k)+"="+escape(val))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape is URI encoding as SigV4 defines it:
+// everything but unreserved characters is percent-encoded.
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238 Appendix B, truncated to six digits.
+var rfcTests = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+// rfcSecret is the ASCII key "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	for _, test := range rfcTests {
+		got, err := Code(rfcSecret, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.code {
+			t.Errorf("Code at %d = %s, want %s", test.unix, got, test.code)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if step, ok := Verify(secret, code, now); !ok || step != Step(now) {
+		t.Errorf("Verify(now)=%d, %v, want %d, true", step, ok, Step(now))
+	}
+	if _, ok := Verify(strings.ToLower(secret), code[:3]+" "+code[3:], now.Add(period*time.Second)); !ok {
+		t.Error("Verify rejects code from the previous step")
+	}
+	if _, ok := Verify(secret, code, now.Add(2*period*time.Second)); ok {
+		t.Error("Verify accepts code two steps old")
+	}
+	if _, ok := Verify(secret, "", now); ok {
+		t.Error("Verify accepts empty code")
+	}
+	if _, ok := Verify("not base32!", code, now); ok {
+		t.Error("Verify accepts bad secret")
+	}
+}
+
+func TestURL(t *testing.T) {
+	got := URL("spilled.ink", "foo@spilled.ink", "ABCD")
+	want := "otpauth://totp/spilled.ink:foo@spilled.ink?issuer=spilled.ink&secret=ABCD"
+	if got != want {
+		t.Errorf("URL=%s, want %s", got, want)
+	}
+}